@@ -23,11 +23,13 @@ import (
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 	"sync/atomic"
 	"time"
 
 	"github.com/ethereum/go-ethereum/cmd/utils"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
 	"github.com/ethereum/go-ethereum/console/prompt"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/rawdb"
@@ -146,6 +148,42 @@ be gzipped.`,
 		Category: "BLOCKCHAIN COMMANDS",
 		Description: `
 The export-preimages command export hash preimages to an RLP encoded stream`,
+	}
+	exportDatabaseCommand = cli.Command{
+		Action:    utils.MigrateFlags(exportDatabase),
+		Name:      "export-db",
+		Usage:     "Export the chain database into a portable directory",
+		ArgsUsage: "<dumpdir> [<prefix>...]",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.SyncModeFlag,
+			utils.ExportTablesFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The export-db command writes a consistent copy of the chain database into an
+empty directory: the ancient chain tables selected by --tables, the key-value
+entries with the given hex prefixes (all of them if none given) and a manifest
+describing the export. Only exports of all the ancient chain tables can be
+imported along with their ancients. The node must not be running.`,
+	}
+	importDatabaseCommand = cli.Command{
+		Action:    utils.MigrateFlags(importDatabase),
+		Name:      "import-db",
+		Usage:     "Import a chain database exported by export-db",
+		ArgsUsage: "<dumpdir>",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.SyncModeFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The import-db command imports a chain database exported by export-db into a node
+without a chain, validating it against the manifest of the export.`,
 	}
 	copydbCommand = cli.Command{
 		Action:    utils.MigrateFlags(copyDb),
@@ -215,6 +253,64 @@ Use "ethereum dump 0" to dump the genesis block.`,
 		},
 		Category: "BLOCKCHAIN COMMANDS",
 	}
+	inspectAncientsCommand = cli.Command{
+		Action:    utils.MigrateFlags(inspectAncients),
+		Name:      "inspect-ancients",
+		Usage:     "Inspect the stored and decoded sizes of the ancient items",
+		ArgsUsage: "[<start> [<count>]]",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.RopstenFlag,
+			utils.RinkebyFlag,
+			utils.GoerliFlag,
+			utils.LegacyTestnetFlag,
+			utils.SyncModeFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The optional arguments limit the inspection to the given number of items after
+the starting one, allowing to evaluate the compression of the ancient store.`,
+	}
+	compactAncientsCommand = cli.Command{
+		Action:    utils.MigrateFlags(compactAncients),
+		Name:      "compact-ancients",
+		Usage:     "Reclaim the space of the deleted ancient items",
+		ArgsUsage: " ",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.RopstenFlag,
+			utils.RinkebyFlag,
+			utils.GoerliFlag,
+			utils.LegacyTestnetFlag,
+			utils.SyncModeFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+	}
+	rechunkAncientsCommand = cli.Command{
+		Action:    utils.MigrateFlags(rechunkAncients),
+		Name:      "rechunk-ancients",
+		Usage:     "Rewrite the ancient store into files of a different size",
+		ArgsUsage: "<maxFileSize>",
+		Flags: []cli.Flag{
+			utils.DataDirFlag,
+			utils.AncientFlag,
+			utils.CacheFlag,
+			utils.RopstenFlag,
+			utils.RinkebyFlag,
+			utils.GoerliFlag,
+			utils.LegacyTestnetFlag,
+			utils.SyncModeFlag,
+		},
+		Category: "BLOCKCHAIN COMMANDS",
+		Description: `
+The maximum file size is given in bytes and also applies to the files created
+afterwards. An interrupted re-chunking is continued by running the command again
+with the same size.`,
+	}
 )
 
 // initGenesis will initialise the given JSON format genesis file and writes it as
@@ -429,6 +525,61 @@ func exportPreimages(ctx *cli.Context) error {
 	return nil
 }
 
+func exportDatabase(ctx *cli.Context) error {
+	if len(ctx.Args()) < 1 {
+		utils.Fatalf("This command requires an argument.")
+	}
+	var prefixes [][]byte
+	for _, arg := range ctx.Args()[1:] {
+		prefix, err := hexutil.Decode(arg)
+		if err != nil {
+			utils.Fatalf("Invalid key prefix %q: %v", arg, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	var tables []string
+	if list := ctx.GlobalString(utils.ExportTablesFlag.Name); list != "" {
+		tables = strings.Split(list, ",")
+	}
+	stack := makeFullNode(ctx)
+	defer stack.Close()
+
+	db := utils.MakeChainDatabase(ctx, stack)
+	defer db.Close()
+
+	start := time.Now()
+	manifest, err := rawdb.ExportDatabase(db, ctx.Args().First(), prefixes, tables)
+	if err != nil {
+		utils.Fatalf("Export error: %v\n", err)
+	}
+	fmt.Printf("Exported %d entries and %d ancients (blocks #%d-#%d) in %v\n", manifest.Entries, manifest.Ancients, manifest.FirstBlock, manifest.HeadNumber, time.Since(start))
+	return nil
+}
+
+func importDatabase(ctx *cli.Context) error {
+	if len(ctx.Args()) < 1 {
+		utils.Fatalf("This command requires an argument.")
+	}
+	stack := makeFullNode(ctx)
+	defer stack.Close()
+
+	// Import into the bare key-value store, the freezer must not be opened yet
+	db, ancient := utils.MakeChainKeyValueStore(ctx, stack)
+
+	start := time.Now()
+	manifest, err := rawdb.ImportDatabase(db, ancient, ctx.Args().First())
+	db.Close()
+	if err != nil {
+		utils.Fatalf("Import error: %v\n", err)
+	}
+	// Reopen the database with the freezer to ensure they are consistent
+	db = utils.MakeChainDatabase(ctx, stack)
+	db.Close()
+
+	fmt.Printf("Imported %d entries and %d ancients (head #%d) in %v\n", manifest.Entries, manifest.Ancients, manifest.HeadNumber, time.Since(start))
+	return nil
+}
+
 func copyDb(ctx *cli.Context) error {
 	// Ensure we have a source chain directory to copy
 	if len(ctx.Args()) < 1 {
@@ -594,6 +745,69 @@ func inspect(ctx *cli.Context) error {
 	return rawdb.InspectDatabase(chainDb)
 }
 
+func inspectAncients(ctx *cli.Context) error {
+	if len(ctx.Args()) > 2 {
+		utils.Fatalf("This command requires at most two arguments.")
+	}
+	var start, count uint64
+	if len(ctx.Args()) > 0 {
+		var err error
+		if start, err = strconv.ParseUint(ctx.Args().Get(0), 10, 64); err != nil {
+			utils.Fatalf("Invalid start item: %v", err)
+		}
+		if len(ctx.Args()) > 1 {
+			if count, err = strconv.ParseUint(ctx.Args().Get(1), 10, 64); err != nil {
+				utils.Fatalf("Invalid item count: %v", err)
+			}
+		}
+	}
+	node, _ := makeConfigNode(ctx)
+	defer node.Close()
+
+	chainDb := utils.MakeChainDatabase(ctx, node)
+	defer chainDb.Close()
+
+	return rawdb.InspectAncients(chainDb, start, count)
+}
+
+func compactAncients(ctx *cli.Context) error {
+	node, _ := makeConfigNode(ctx)
+	defer node.Close()
+
+	chainDb := utils.MakeChainDatabase(ctx, node)
+	defer chainDb.Close()
+
+	start := time.Now()
+	freed, err := rawdb.CompactAncients(chainDb)
+	if err != nil {
+		utils.Fatalf("Compaction failed: %v", err)
+	}
+	log.Info("Compacted ancient store", "freed", freed, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+func rechunkAncients(ctx *cli.Context) error {
+	if len(ctx.Args()) != 1 {
+		utils.Fatalf("This command requires an argument.")
+	}
+	size, err := strconv.ParseUint(ctx.Args().First(), 10, 32)
+	if err != nil || size == 0 {
+		utils.Fatalf("Invalid maximum file size: %v", ctx.Args().First())
+	}
+	node, _ := makeConfigNode(ctx)
+	defer node.Close()
+
+	chainDb := utils.MakeChainDatabase(ctx, node)
+	defer chainDb.Close()
+
+	start := time.Now()
+	if err := rawdb.RechunkAncients(chainDb, uint32(size)); err != nil {
+		utils.Fatalf("Re-chunking failed: %v", err)
+	}
+	log.Info("Re-chunked ancient store", "size", size, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
 // hashish returns true for strings that look like hashes.
 func hashish(x string) bool {
 	_, err := strconv.Atoi(x)
@@ -65,6 +65,16 @@ var (
 		utils.LegacyBootnodesV5Flag,
 		utils.DataDirFlag,
 		utils.AncientFlag,
+		utils.AncientFullCheckFlag,
+		utils.AncientDropCacheFlag,
+		utils.AncientMigrateFlag,
+		utils.AncientInlineIndexFlag,
+		utils.AncientMaxOpenFilesFlag,
+		utils.AncientSyncFlag,
+		utils.AncientRetentionBlocksFlag,
+		utils.AncientRetentionSizeFlag,
+		utils.AncientRetentionAgeFlag,
+		utils.DBEngineFlag,
 		utils.KeyStoreDirFlag,
 		utils.ExternalSignerFlag,
 		utils.NoUSBFlag,
@@ -92,7 +102,11 @@ var (
 		utils.ExitWhenSyncedFlag,
 		utils.GCModeFlag,
 		utils.SnapshotFlag,
+		utils.SnapshotAuditFlag,
+		utils.SnapshotStrictFlag,
 		utils.TxLookupLimitFlag,
+		utils.TxLookupScanWindowFlag,
+		utils.LogIndexFlag,
 		utils.LightServeFlag,
 		utils.LegacyLightServFlag,
 		utils.LightIngressFlag,
@@ -109,6 +123,10 @@ var (
 		utils.CacheTrieFlag,
 		utils.CacheGCFlag,
 		utils.CacheSnapshotFlag,
+		utils.CacheSnapshotFlushFlag,
+		utils.CacheSnapshotFilterFlag,
+		utils.CacheSnapshotDiffBudgetFlag,
+		utils.CacheSnapshotDiffLayersFlag,
 		utils.CacheNoPrefetchFlag,
 		utils.ListenPortFlag,
 		utils.MaxPeersFlag,
@@ -219,11 +237,16 @@ func init() {
 		exportCommand,
 		importPreimagesCommand,
 		exportPreimagesCommand,
+		exportDatabaseCommand,
+		importDatabaseCommand,
 		copydbCommand,
 		removedbCommand,
 		dumpCommand,
 		dumpGenesisCommand,
 		inspectCommand,
+		inspectAncientsCommand,
+		compactAncientsCommand,
+		rechunkAncientsCommand,
 		// See accountcmd.go:
 		accountCommand,
 		walletCommand,
@@ -717,29 +717,33 @@ func (api *RetestethAPI) AccountRange(ctx context.Context,
 func (api *RetestethAPI) GetBalance(ctx context.Context, address common.Address, blockNr math.HexOrDecimal64) (*math.HexOrDecimal256, error) {
 	//fmt.Printf("GetBalance %x, block %d\n", address, blockNr)
 	header := api.blockchain.GetHeaderByNumber(uint64(blockNr))
-	statedb, err := api.blockchain.StateAt(header.Root)
+	view, err := api.blockchain.ReadOnlyState(header.Root)
 	if err != nil {
 		return nil, err
 	}
-	return (*math.HexOrDecimal256)(statedb.GetBalance(address)), nil
+	balance, err := view.GetBalance(address)
+	if err != nil {
+		return nil, err
+	}
+	return (*math.HexOrDecimal256)(balance), nil
 }
 
 func (api *RetestethAPI) GetCode(ctx context.Context, address common.Address, blockNr math.HexOrDecimal64) (hexutil.Bytes, error) {
 	header := api.blockchain.GetHeaderByNumber(uint64(blockNr))
-	statedb, err := api.blockchain.StateAt(header.Root)
+	view, err := api.blockchain.ReadOnlyState(header.Root)
 	if err != nil {
 		return nil, err
 	}
-	return statedb.GetCode(address), nil
+	return view.GetCode(address)
 }
 
 func (api *RetestethAPI) GetTransactionCount(ctx context.Context, address common.Address, blockNr math.HexOrDecimal64) (uint64, error) {
 	header := api.blockchain.GetHeaderByNumber(uint64(blockNr))
-	statedb, err := api.blockchain.StateAt(header.Root)
+	view, err := api.blockchain.ReadOnlyState(header.Root)
 	if err != nil {
 		return 0, err
 	}
-	return statedb.GetNonce(address), nil
+	return view.GetNonce(address)
 }
 
 func (api *RetestethAPI) StorageRangeAt(ctx context.Context,
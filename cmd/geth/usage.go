@@ -68,6 +68,16 @@ var AppHelpFlagGroups = []flagGroup{
 			configFileFlag,
 			utils.DataDirFlag,
 			utils.AncientFlag,
+			utils.AncientFullCheckFlag,
+			utils.AncientDropCacheFlag,
+			utils.AncientMigrateFlag,
+			utils.AncientInlineIndexFlag,
+			utils.AncientMaxOpenFilesFlag,
+			utils.AncientSyncFlag,
+			utils.AncientRetentionBlocksFlag,
+			utils.AncientRetentionSizeFlag,
+			utils.AncientRetentionAgeFlag,
+			utils.DBEngineFlag,
 			utils.KeyStoreDirFlag,
 			utils.NoUSBFlag,
 			utils.SmartCardDaemonPathFlag,
@@ -79,6 +89,8 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.ExitWhenSyncedFlag,
 			utils.GCModeFlag,
 			utils.TxLookupLimitFlag,
+			utils.TxLookupScanWindowFlag,
+			utils.LogIndexFlag,
 			utils.EthStatsURLFlag,
 			utils.IdentityFlag,
 			utils.LightKDFFlag,
@@ -141,6 +153,10 @@ var AppHelpFlagGroups = []flagGroup{
 			utils.CacheTrieFlag,
 			utils.CacheGCFlag,
 			utils.CacheSnapshotFlag,
+			utils.CacheSnapshotFlushFlag,
+			utils.CacheSnapshotFilterFlag,
+			utils.CacheSnapshotDiffBudgetFlag,
+			utils.CacheSnapshotDiffLayersFlag,
 			utils.CacheNoPrefetchFlag,
 		},
 	},
@@ -264,6 +280,8 @@ var AppHelpFlagGroups = []flagGroup{
 		Name: "MISC",
 		Flags: []cli.Flag{
 			utils.SnapshotFlag,
+			utils.SnapshotAuditFlag,
+			utils.SnapshotStrictFlag,
 			cli.HelpFlag,
 		},
 	},
@@ -26,6 +26,7 @@ import (
 	"math/big"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"text/tabwriter"
@@ -40,6 +41,7 @@ import (
 	"github.com/ethereum/go-ethereum/consensus/clique"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/eth"
@@ -147,6 +149,47 @@ var (
 		Name:  "datadir.ancient",
 		Usage: "Data directory for ancient chain segments (default = inside chaindata)",
 	}
+	AncientFullCheckFlag = cli.BoolFlag{
+		Name:  "datadir.ancient.fullcheck",
+		Usage: "Verify every ancient chain item on startup instead of a random sample",
+	}
+	AncientDropCacheFlag = cli.BoolFlag{
+		Name:  "datadir.ancient.dropcache",
+		Usage: "Evict written ancient chain data from the OS page cache (Linux only)",
+	}
+	AncientMigrateFlag = cli.BoolFlag{
+		Name:  "datadir.ancient.migrate",
+		Usage: "Convert the ancient chain tables stored in a legacy format on startup",
+	}
+	AncientInlineIndexFlag = cli.BoolFlag{
+		Name:  "datadir.ancient.inlineindex",
+		Usage: "Store small ancient chain items in the indexes of new tables (not readable by older versions)",
+	}
+	AncientMaxOpenFilesFlag = cli.IntFlag{
+		Name:  "datadir.ancient.maxopenfiles",
+		Usage: "Maximum number of data files kept open by each ancient chain table (0 = no limit)",
+	}
+	AncientSyncFlag = cli.StringFlag{
+		Name:  "datadir.ancient.sync",
+		Usage: "Comma separated ancient chain table flush strategies as [table=]mode, mode being default, always or an interval (e.g. bodies=1s,receipts=always)",
+	}
+	AncientRetentionBlocksFlag = cli.Uint64Flag{
+		Name:  "datadir.ancient.retention.blocks",
+		Usage: "Number of most recent ancient block bodies and receipts to keep (0 = all)",
+	}
+	AncientRetentionSizeFlag = cli.Uint64Flag{
+		Name:  "datadir.ancient.retention.size",
+		Usage: "Megabytes of most recent ancient block bodies and receipts to keep (0 = all)",
+	}
+	AncientRetentionAgeFlag = cli.DurationFlag{
+		Name:  "datadir.ancient.retention.age",
+		Usage: "Maximum age of the ancient block bodies and receipts kept, since they were frozen (0 = all)",
+	}
+	DBEngineFlag = cli.StringFlag{
+		Name:  "db.engine",
+		Usage: "Backing database implementation to use (registered backends: " + strings.Join(rawdb.Backends(), ", ") + ")",
+		Value: rawdb.DefaultBackend,
+	}
 	KeyStoreDirFlag = DirectoryFlag{
 		Name:  "keystore",
 		Usage: "Directory for the keystore (default = inside the datadir)",
@@ -214,6 +257,11 @@ var (
 		Name:  "nocode",
 		Usage: "Exclude contract code (save db lookups)",
 	}
+	ExportTablesFlag = cli.StringFlag{
+		Name:  "tables",
+		Usage: "Comma separated ancient chain tables to export (empty = none)",
+		Value: strings.Join(rawdb.FreezerTables(), ","),
+	}
 	defaultSyncMode = eth.DefaultConfig.SyncMode
 	SyncModeFlag    = TextMarshalerFlag{
 		Name:  "syncmode",
@@ -229,11 +277,28 @@ var (
 		Name:  "snapshot",
 		Usage: `Enables snapshot-database mode -- experimental work in progress feature`,
 	}
+	SnapshotAuditFlag = cli.BoolFlag{
+		Name:  "snapshot.audit",
+		Usage: "Verify every snapshot journal written by reading it back (slower shutdown)",
+	}
+	SnapshotStrictFlag = cli.BoolFlag{
+		Name:  "snapshot.strict",
+		Usage: "Reject snapshot layers not increasing the block number of their parent",
+	}
 	TxLookupLimitFlag = cli.Int64Flag{
 		Name:  "txlookuplimit",
 		Usage: "Number of recent blocks to maintain transactions index by-hash for (default = index all blocks)",
 		Value: 0,
 	}
+	TxLookupScanWindowFlag = cli.Uint64Flag{
+		Name:  "txlookupscanwindow",
+		Usage: "Number of unindexed blocks below the transaction index to search for transactions by-hash (default = disabled)",
+		Value: 0,
+	}
+	LogIndexFlag = cli.BoolFlag{
+		Name:  "logindex",
+		Usage: "Maintain an address and topic index of the canonical logs to speed up log filtering",
+	}
 	LightKDFFlag = cli.BoolFlag{
 		Name:  "lightkdf",
 		Usage: "Reduce key-derivation RAM & CPU usage at some expense of KDF strength",
@@ -395,6 +460,22 @@ var (
 		Usage: "Percentage of cache memory allowance to use for snapshot caching (default = 10% full mode, 20% archive mode)",
 		Value: 10,
 	}
+	CacheSnapshotFlushFlag = cli.Uint64Flag{
+		Name:  "cache.snapshot.flush",
+		Usage: "Size (KB) of the snapshot accumulator layer triggering a flush to disk (default = 4096)",
+	}
+	CacheSnapshotFilterFlag = cli.Float64Flag{
+		Name:  "cache.snapshot.filter",
+		Usage: "False-positive rate of the snapshot account existence filter (0 = disabled)",
+	}
+	CacheSnapshotDiffBudgetFlag = cli.Uint64Flag{
+		Name:  "cache.snapshot.diffbudget",
+		Usage: "Megabytes of memory the snapshot diff layers may hold before being flattened (0 = no limit)",
+	}
+	CacheSnapshotDiffLayersFlag = cli.IntFlag{
+		Name:  "cache.snapshot.difflayers",
+		Usage: "Minimum number of snapshot diff layers kept despite the memory budget",
+	}
 	CacheNoPrefetchFlag = cli.BoolFlag{
 		Name:  "cache.noprefetch",
 		Usage: "Disable heuristic state prefetch during block import (less CPU and disk IO, more time waiting for data)",
@@ -1210,6 +1291,38 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 		cfg.ExternalSigner = ctx.GlobalString(ExternalSignerFlag.Name)
 	}
 
+	if ctx.GlobalIsSet(DBEngineFlag.Name) {
+		cfg.DBEngine = ctx.GlobalString(DBEngineFlag.Name)
+	}
+	if ctx.GlobalIsSet(AncientFullCheckFlag.Name) {
+		cfg.AncientFullCheck = ctx.GlobalBool(AncientFullCheckFlag.Name)
+	}
+	if ctx.GlobalIsSet(AncientDropCacheFlag.Name) {
+		cfg.AncientDropCache = ctx.GlobalBool(AncientDropCacheFlag.Name)
+	}
+	if ctx.GlobalIsSet(AncientMigrateFlag.Name) {
+		cfg.AncientMigrate = ctx.GlobalBool(AncientMigrateFlag.Name)
+	}
+	if ctx.GlobalIsSet(AncientInlineIndexFlag.Name) {
+		cfg.AncientInlineIndex = ctx.GlobalBool(AncientInlineIndexFlag.Name)
+	}
+	if ctx.GlobalIsSet(AncientMaxOpenFilesFlag.Name) {
+		cfg.AncientMaxOpenFiles = ctx.GlobalInt(AncientMaxOpenFilesFlag.Name)
+	}
+	if ctx.GlobalIsSet(AncientSyncFlag.Name) {
+		sync, err := parseAncientSync(ctx.GlobalString(AncientSyncFlag.Name))
+		if err != nil {
+			Fatalf("Option %q: %v", AncientSyncFlag.Name, err)
+		}
+		cfg.AncientSync = sync
+	}
+	if ctx.GlobalIsSet(AncientRetentionBlocksFlag.Name) || ctx.GlobalIsSet(AncientRetentionSizeFlag.Name) || ctx.GlobalIsSet(AncientRetentionAgeFlag.Name) {
+		cfg.AncientHistoryRetention = &ethdb.AncientRetention{
+			Items: ctx.GlobalUint64(AncientRetentionBlocksFlag.Name),
+			Bytes: ctx.GlobalUint64(AncientRetentionSizeFlag.Name) * 1024 * 1024,
+			Age:   ctx.GlobalDuration(AncientRetentionAgeFlag.Name),
+		}
+	}
 	if ctx.GlobalIsSet(KeyStoreDirFlag.Name) {
 		cfg.KeyStoreDir = ctx.GlobalString(KeyStoreDirFlag.Name)
 	}
@@ -1224,6 +1337,46 @@ func SetNodeConfig(ctx *cli.Context, cfg *node.Config) {
 	}
 }
 
+// parseAncientSync parses the comma separated flush strategies of the freezer
+// tables. Each entry is either "table=mode" or a lone mode applying to all the
+// tables, the mode being "default", "always" or a flush interval.
+func parseAncientSync(spec string) (map[string]rawdb.FreezerSync, error) {
+	var (
+		sync  = make(map[string]rawdb.FreezerSync)
+		known = rawdb.FreezerTables()
+	)
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		tables, mode := known, entry
+		if i := strings.Index(entry, "="); i >= 0 {
+			tables, mode = []string{entry[:i]}, entry[i+1:]
+			if n := sort.SearchStrings(known, tables[0]); n == len(known) || known[n] != tables[0] {
+				return nil, fmt.Errorf("unknown ancient table %q", tables[0])
+			}
+		}
+		var policy rawdb.FreezerSync
+		switch mode {
+		case "default":
+			policy.Mode = rawdb.FreezerSyncDefault
+		case "always":
+			policy.Mode = rawdb.FreezerSyncAlways
+		default:
+			interval, err := time.ParseDuration(mode)
+			if err != nil || interval <= 0 {
+				return nil, fmt.Errorf("invalid flush strategy %q", mode)
+			}
+			policy = rawdb.FreezerSync{Mode: rawdb.FreezerSyncInterval, Interval: interval}
+		}
+		for _, table := range tables {
+			sync[table] = policy
+		}
+	}
+	return sync, nil
+}
+
 func setSmartCard(ctx *cli.Context, cfg *node.Config) {
 	// Skip enabling smartcards if no path is set
 	path := ctx.GlobalString(SmartCardDaemonPathFlag.Name)
@@ -1517,6 +1670,12 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 	if ctx.GlobalIsSet(TxLookupLimitFlag.Name) {
 		cfg.TxLookupLimit = ctx.GlobalUint64(TxLookupLimitFlag.Name)
 	}
+	if ctx.GlobalIsSet(TxLookupScanWindowFlag.Name) {
+		cfg.TxLookupScanWindow = ctx.GlobalUint64(TxLookupScanWindowFlag.Name)
+	}
+	if ctx.GlobalIsSet(LogIndexFlag.Name) {
+		cfg.LogIndexing = ctx.GlobalBool(LogIndexFlag.Name)
+	}
 	if ctx.GlobalIsSet(CacheFlag.Name) || ctx.GlobalIsSet(CacheTrieFlag.Name) {
 		cfg.TrieCleanCache = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheTrieFlag.Name) / 100
 	}
@@ -1529,6 +1688,24 @@ func SetEthConfig(ctx *cli.Context, stack *node.Node, cfg *eth.Config) {
 	if !ctx.GlobalIsSet(SnapshotFlag.Name) {
 		cfg.SnapshotCache = 0 // Disabled
 	}
+	if ctx.GlobalIsSet(CacheSnapshotFlushFlag.Name) {
+		cfg.SnapshotFlushLimit = ctx.GlobalUint64(CacheSnapshotFlushFlag.Name) * 1024
+	}
+	if ctx.GlobalIsSet(CacheSnapshotFilterFlag.Name) {
+		cfg.SnapshotFilterRate = ctx.GlobalFloat64(CacheSnapshotFilterFlag.Name)
+	}
+	if ctx.GlobalIsSet(CacheSnapshotDiffBudgetFlag.Name) {
+		cfg.SnapshotDiffBudget = ctx.GlobalUint64(CacheSnapshotDiffBudgetFlag.Name) * 1024 * 1024
+	}
+	if ctx.GlobalIsSet(CacheSnapshotDiffLayersFlag.Name) {
+		cfg.SnapshotDiffLayers = ctx.GlobalInt(CacheSnapshotDiffLayersFlag.Name)
+	}
+	if ctx.GlobalIsSet(SnapshotAuditFlag.Name) {
+		cfg.SnapshotAudit = ctx.GlobalBool(SnapshotAuditFlag.Name)
+	}
+	if ctx.GlobalIsSet(SnapshotStrictFlag.Name) {
+		cfg.SnapshotStrict = ctx.GlobalBool(SnapshotStrictFlag.Name)
+	}
 	if ctx.GlobalIsSet(DocRootFlag.Name) {
 		cfg.DocRoot = ctx.GlobalString(DocRootFlag.Name)
 	}
@@ -1732,6 +1909,32 @@ func SplitTagsFlag(tagsFlag string) map[string]string {
 	return tagsMap
 }
 
+// MakeChainKeyValueStore opens the key-value store of the chain database without
+// attaching the freezer to it, returning the store along with the directory of the
+// freezer. It will hard crash if it fails.
+func MakeChainKeyValueStore(ctx *cli.Context, stack *node.Node) (ethdb.Database, string) {
+	var (
+		cache   = ctx.GlobalInt(CacheFlag.Name) * ctx.GlobalInt(CacheDatabaseFlag.Name) / 100
+		handles = makeDatabaseHandles()
+	)
+	name := "chaindata"
+	if ctx.GlobalString(SyncModeFlag.Name) == "light" {
+		name = "lightchaindata"
+	}
+	db, err := stack.OpenDatabase(name, cache, handles, "")
+	if err != nil {
+		Fatalf("Could not open database: %v", err)
+	}
+	freezer := ctx.GlobalString(AncientFlag.Name)
+	switch {
+	case freezer == "":
+		freezer = filepath.Join(stack.ResolvePath(name), "ancient")
+	case !filepath.IsAbs(freezer):
+		freezer = stack.ResolvePath(freezer)
+	}
+	return db, freezer
+}
+
 // MakeChainDatabase open an LevelDB using the flags passed to the client and will hard crash if it fails.
 func MakeChainDatabase(ctx *cli.Context, stack *node.Node) ethdb.Database {
 	var (
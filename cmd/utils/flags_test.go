@@ -20,6 +20,9 @@ package utils
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/ethereum/go-ethereum/core/rawdb"
 )
 
 func Test_SplitTagsFlag(t *testing.T) {
@@ -62,3 +65,45 @@ func Test_SplitTagsFlag(t *testing.T) {
 		})
 	}
 }
+
+func TestParseAncientSync(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[string]rawdb.FreezerSync
+		fail bool
+	}{
+		{spec: "", want: map[string]rawdb.FreezerSync{}},
+		{
+			spec: "bodies=1s, receipts=always",
+			want: map[string]rawdb.FreezerSync{
+				"bodies":   {Mode: rawdb.FreezerSyncInterval, Interval: time.Second},
+				"receipts": {Mode: rawdb.FreezerSyncAlways},
+			},
+		},
+		{spec: "always,hashes=default", want: func() map[string]rawdb.FreezerSync {
+			sync := make(map[string]rawdb.FreezerSync)
+			for _, table := range rawdb.FreezerTables() {
+				sync[table] = rawdb.FreezerSync{Mode: rawdb.FreezerSyncAlways}
+			}
+			sync["hashes"] = rawdb.FreezerSync{Mode: rawdb.FreezerSyncDefault}
+			return sync
+		}()},
+		{spec: "logs=always", fail: true},
+		{spec: "bodies=sometimes", fail: true},
+		{spec: "bodies=-1s", fail: true},
+	}
+	for _, tt := range tests {
+		sync, err := parseAncientSync(tt.spec)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("%q: expected failure, got %v", tt.spec, sync)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: failed to parse: %v", tt.spec, err)
+		} else if !reflect.DeepEqual(sync, tt.want) {
+			t.Errorf("%q: mismatch: have %v, want %v", tt.spec, sync, tt.want)
+		}
+	}
+}
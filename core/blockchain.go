@@ -87,8 +87,15 @@ const (
 	maxFutureBlocks     = 256
 	maxTimeFutureBlocks = 30
 	badBlockLimit       = 10
+	growthCacheLimit    = 256
 	TriesInMemory       = 128
 
+	// snapshotFallbackWarnRate is the fraction of the state reads of a block
+	// falling back from the snapshot to the tries, above which the snapshot is
+	// reported unhealthy, at most once per snapshotFallbackWarnInterval.
+	snapshotFallbackWarnRate     = 0.05
+	snapshotFallbackWarnInterval = time.Minute
+
 	// BlockChainVersion ensures that an incompatible database forces a resync from scratch.
 	//
 	// Changelog:
@@ -121,6 +128,23 @@ type CacheConfig struct {
 	TrieDirtyDisabled   bool          // Whether to disable trie write caching and GC altogether (archive node)
 	TrieTimeLimit       time.Duration // Time limit after which to flush the current in-memory trie to disk
 	SnapshotLimit       int           // Memory allowance (MB) to use for caching snapshot entries in memory
+	SnapshotFilterRate  float64       // False-positive rate of the snapshot account existence filter (0 = disabled)
+	SnapshotFlushLimit  uint64        // Size of the snapshot accumulator layer triggering a flush to disk (0 = default)
+	SnapshotDiffBudget  uint64        // Memory limit of the snapshot diff layers, flattening beyond it (0 = disabled)
+	SnapshotDiffLayers  int           // Minimum number of snapshot diff layers kept despite the memory limit
+	SnapshotAudit       bool          // Whether to read back and verify every snapshot journal written
+	SnapshotStrict      bool          // Whether to reject snapshot layers not increasing the block number
+	LogIndexing         bool          // Whether to maintain the address and topic index of the canonical logs
+	TxLookupScanWindow  uint64        // Number of unindexed blocks below the tx index tail searched on lookup misses (0 = disabled)
+
+	SnapshotSeal *snapshot.JournalSeal // Sealing of the snapshot journal, nil to store it plain
+
+	// StateGrowthLimit is a soft limit of the state growth per block, zero if
+	// unlimited. Blocks exceeding it are still accepted, but StateGrowthHook is
+	// invoked for them (or a warning is logged if there's no hook), allowing
+	// block producers to throttle the growth.
+	StateGrowthLimit common.StorageSize
+	StateGrowthHook  func(block *types.Block, growth state.StateGrowth)
 
 	SnapshotWait bool // Wait for snapshot construction on startup. TODO(karalabe): This is a dirty hack for testing, nuke it
 }
@@ -148,6 +172,8 @@ type BlockChain struct {
 	triegc *prque.Prque   // Priority queue mapping block numbers to tries to gc
 	gcproc time.Duration  // Accumulates canonical block processing for trie dumping
 
+	snapWarned time.Time // Last time the snapshot was reported unhealthy
+
 	// txLookupLimit is the maximum number of blocks from head whose tx indices
 	// are reserved:
 	//  * 0:   means no limit and regenerate any missing indexes
@@ -169,6 +195,7 @@ type BlockChain struct {
 
 	currentBlock     atomic.Value // Current head of the block chain
 	currentFastBlock atomic.Value // Current head of the fast-sync chain (may be above the block chain!)
+	readOnlyState    atomic.Value // Shared read-only view of the most recently requested state
 
 	stateCache    state.Database // State database to reuse between imports (contains state cache)
 	bodyCache     *lru.Cache     // Cache for the most recent block bodies
@@ -177,6 +204,7 @@ type BlockChain struct {
 	blockCache    *lru.Cache     // Cache for the most recent entire blocks
 	txLookupCache *lru.Cache     // Cache for the most recent transaction lookup data.
 	futureBlocks  *lru.Cache     // future blocks are blocks added for later processing
+	growthCache   *lru.Cache     // Cache for the state growth of the most recent blocks
 
 	quit          chan struct{}  // blockchain quit channel
 	wg            sync.WaitGroup // chain processing wait group for shutting down
@@ -189,6 +217,10 @@ type BlockChain struct {
 	processor  Processor  // Block transaction processor interface
 	vmConfig   vm.Config
 
+	hinter    state.PrefetchHinter // Source of the state expected to be accessed by the next blocks, nil if unset
+	hintAbort *uint32              // Interrupt flag of the running hint prefetcher, nil if none running
+	hintLock  sync.Mutex           // Lock protecting the hinter and its interrupt flag
+
 	badBlocks       *lru.Cache                     // Bad block cache
 	shouldPreserve  func(*types.Block) bool        // Function used to determine whether should preserve the given block.
 	terminateInsert func(common.Hash, uint64) bool // Testing hook used to terminate ancient receipt chain insertion.
@@ -214,6 +246,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	txLookupCache, _ := lru.New(txLookupCacheLimit)
 	futureBlocks, _ := lru.New(maxFutureBlocks)
 	badBlocks, _ := lru.New(badBlockLimit)
+	growthCache, _ := lru.New(growthCacheLimit)
 
 	bc := &BlockChain{
 		chainConfig:    chainConfig,
@@ -229,6 +262,7 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		blockCache:     blockCache,
 		txLookupCache:  txLookupCache,
 		futureBlocks:   futureBlocks,
+		growthCache:    growthCache,
 		engine:         engine,
 		vmConfig:       vmConfig,
 		badBlocks:      badBlocks,
@@ -320,7 +354,22 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 	}
 	// Load any existing snapshot, regenerating it if loading failed
 	if bc.cacheConfig.SnapshotLimit > 0 {
-		bc.snaps = snapshot.New(bc.db, bc.stateCache.TrieDB(), bc.cacheConfig.SnapshotLimit, bc.CurrentBlock().Root(), !bc.cacheConfig.SnapshotWait)
+		bc.snaps = snapshot.NewWithSeal(bc.db, bc.stateCache.TrieDB(), bc.cacheConfig.SnapshotLimit, bc.CurrentBlock().Root(), !bc.cacheConfig.SnapshotWait, bc.cacheConfig.SnapshotSeal)
+		if bc.cacheConfig.SnapshotFilterRate > 0 {
+			bc.snaps.EnableAccountFilter(bc.cacheConfig.SnapshotFilterRate)
+		}
+		if bc.cacheConfig.SnapshotFlushLimit > 0 {
+			bc.snaps.SetFlushLimit(bc.cacheConfig.SnapshotFlushLimit)
+		}
+		if bc.cacheConfig.SnapshotDiffBudget > 0 {
+			bc.snaps.SetMemoryBudget(bc.cacheConfig.SnapshotDiffBudget, bc.cacheConfig.SnapshotDiffLayers)
+		}
+		if bc.cacheConfig.SnapshotAudit {
+			bc.snaps.EnableAudit()
+		}
+		if bc.cacheConfig.SnapshotStrict {
+			bc.snaps.EnableStrict()
+		}
 	}
 	// Take ownership of this particular state
 	go bc.update()
@@ -328,6 +377,13 @@ func NewBlockChain(db ethdb.Database, cacheConfig *CacheConfig, chainConfig *par
 		bc.txLookupLimit = *txLookupLimit
 		go bc.maintainTxIndex(txIndexBlock)
 	}
+	if bc.cacheConfig.LogIndexing {
+		go bc.maintainLogIndex()
+	} else if rawdb.ReadLogIndexTail(bc.db) != nil {
+		// The log index isn't updated any more, drop the tail so it's rebuilt
+		// from scratch if log indexing is enabled again.
+		rawdb.DeleteLogIndexTail(bc.db)
+	}
 	return bc, nil
 }
 
@@ -543,6 +599,32 @@ func (bc *BlockChain) Snapshot() *snapshot.Tree {
 	return bc.snaps
 }
 
+// StateGrowth retrieves the amount of data added to the state by a recently
+// processed block, if it's still known.
+func (bc *BlockChain) StateGrowth(hash common.Hash) (state.StateGrowth, bool) {
+	if growth, ok := bc.growthCache.Get(hash); ok {
+		return growth.(state.StateGrowth), true
+	}
+	return state.StateGrowth{}, false
+}
+
+// trackStateGrowth records the amount of data added to the state by a block and
+// checks it against the configured soft limit.
+func (bc *BlockChain) trackStateGrowth(block *types.Block, growth state.StateGrowth) {
+	bc.growthCache.Add(block.Hash(), growth)
+
+	limit := bc.cacheConfig.StateGrowthLimit
+	if limit <= 0 || growth.Total() <= limit {
+		return
+	}
+	if hook := bc.cacheConfig.StateGrowthHook; hook != nil {
+		hook(block, growth)
+		return
+	}
+	log.Warn("Block exceeded state growth limit", "number", block.Number(), "hash", block.Hash(),
+		"growth", growth.Total(), "limit", limit, "trie", growth.TrieNodes, "flat", growth.FlatState, "code", growth.Code)
+}
+
 // CurrentFastBlock retrieves the current fast-sync head block of the canonical
 // chain. The block is retrieved from the blockchain's internal cache.
 func (bc *BlockChain) CurrentFastBlock() *types.Block {
@@ -569,6 +651,29 @@ func (bc *BlockChain) StateAt(root common.Hash) (*state.StateDB, error) {
 	return state.New(root, bc.stateCache, bc.snaps)
 }
 
+// StateReaderAt returns a read-only view of the state at a particular point in
+// time, served from the snapshot if available. The number of the block the state
+// belongs to is optional, zero if unknown. See state.Reader for the details.
+func (bc *BlockChain) StateReaderAt(root common.Hash, number uint64) (*state.Reader, error) {
+	return state.StateReaderAt(bc.stateCache, bc.snaps, root, number)
+}
+
+// ReadOnlyState returns an immutable view of the state at a particular point in
+// time, which can be queried concurrently. The view of the most recently
+// requested root is shared between the callers, so consecutive requests for the
+// same state (e.g. the RPC calls of the chain head) share its caches.
+func (bc *BlockChain) ReadOnlyState(root common.Hash) (*state.ReadOnlyState, error) {
+	if cached, ok := bc.readOnlyState.Load().(*state.ReadOnlyState); ok && cached.Root() == root {
+		return cached, nil
+	}
+	view, err := state.NewReadOnlyState(bc.stateCache, bc.snaps, root)
+	if err != nil {
+		return nil, err
+	}
+	bc.readOnlyState.Store(view)
+	return view, nil
+}
+
 // StateCache returns the caching database underpinning the blockchain instance.
 func (bc *BlockChain) StateCache() state.Database {
 	return bc.stateCache
@@ -677,6 +782,9 @@ func (bc *BlockChain) writeHeadBlock(block *types.Block) {
 	batch := bc.db.NewBatch()
 	rawdb.WriteCanonicalHash(batch, block.Hash(), block.NumberU64())
 	rawdb.WriteTxLookupEntries(batch, block)
+	if bc.cacheConfig.LogIndexing {
+		rawdb.WriteLogIndex(batch, block.NumberU64(), rawdb.ReadRawReceipts(bc.db, block.Hash(), block.NumberU64()))
+	}
 	rawdb.WriteHeadBlockHash(batch, block.Hash())
 
 	// If the block is better than our head or is on a different chain, force update heads
@@ -763,10 +871,13 @@ func (bc *BlockChain) HasFastBlock(hash common.Hash, number uint64) bool {
 	return rawdb.HasReceipts(bc.db, hash, number)
 }
 
-// HasState checks if state trie is fully present in the database or not.
+// HasState checks if state trie is fully present in the database or not. Only
+// the existence of the root node is probed, it's not read and decoded.
 func (bc *BlockChain) HasState(hash common.Hash) bool {
-	_, err := bc.stateCache.OpenTrie(hash)
-	return err == nil
+	if hash == types.EmptyRootHash {
+		return true // The empty trie has no nodes
+	}
+	return bc.stateCache.TrieDB().HasNode(hash)
 }
 
 // HasBlockAndState checks if a block and associated state trie is fully present
@@ -878,6 +989,7 @@ func (bc *BlockChain) Stop() {
 	bc.scope.Close()
 	close(bc.quit)
 	bc.StopInsert()
+	bc.abortHints()
 	bc.wg.Wait()
 
 	// Ensure that the entirety of the state snapshot is journalled to disk.
@@ -1363,6 +1475,46 @@ func (bc *BlockChain) TxLookupLimit() uint64 {
 	return bc.txLookupLimit
 }
 
+// TxIndexProgress is the status of the transaction index, reporting the range
+// of blocks whose transactions are indexed and searched on lookups.
+type TxIndexProgress struct {
+	Head       uint64  `json:"head"`       // Number of the current head block (fast synced included)
+	Tail       *uint64 `json:"tail"`       // Oldest indexed block, nil if the index isn't initialized yet
+	Limit      uint64  `json:"limit"`      // Number of recent blocks whose transactions are indexed (0 = all)
+	ScanWindow uint64  `json:"scanWindow"` // Number of unindexed blocks searched on lookup misses
+}
+
+// TxIndexProgress retrieves the current status of the transaction index.
+func (bc *BlockChain) TxIndexProgress() TxIndexProgress {
+	return TxIndexProgress{
+		Head:       bc.CurrentFastBlock().NumberU64(),
+		Tail:       rawdb.ReadTxIndexTail(bc.db),
+		Limit:      bc.txLookupLimit,
+		ScanWindow: bc.cacheConfig.TxLookupScanWindow,
+	}
+}
+
+// BackfillTxIndex extends the transaction index down to the given block number.
+// The txlookup limit is raised to cover the requested block and the missing
+// indices are constructed by the background index maintenance routine upon the
+// next chain head event.
+func (bc *BlockChain) BackfillTxIndex(from uint64) error {
+	if bc.txLookupLimit == 0 {
+		return nil // All transactions are already indexed
+	}
+	head := bc.CurrentFastBlock().NumberU64()
+	if from > head {
+		return fmt.Errorf("backfill origin %d beyond head %d", from, head)
+	}
+	if tail := rawdb.ReadTxIndexTail(bc.db); tail != nil && *tail <= from {
+		return nil // Requested range is already indexed
+	}
+	if head-from+1 > bc.txLookupLimit {
+		bc.SetTxLookupLimit(head - from + 1)
+	}
+	return nil
+}
+
 var lastWrite uint64
 
 // writeBlockWithoutState writes only the block and its metadata to the database,
@@ -1434,10 +1586,13 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 		log.Crit("Failed to write block into disk", "err", err)
 	}
 	// Commit all cached state changes into underlying memory database.
+	state.SetBlockNumber(block.NumberU64())
 	root, err := state.Commit(bc.chainConfig.IsEIP158(block.Number()))
 	if err != nil {
 		return NonStatTy, err
 	}
+	bc.trackStateGrowth(block, state.StateGrowth())
+
 	triedb := bc.stateCache.TrieDB()
 
 	// If we're running an archive node, always flush
@@ -1489,6 +1644,7 @@ func (bc *BlockChain) writeBlockWithState(block *types.Block, receipts []*types.
 					break
 				}
 				triedb.Dereference(root.(common.Hash))
+				bc.stateCache.ReleaseTrie(root.(common.Hash))
 			}
 		}
 	}
@@ -1763,6 +1919,7 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		}
 		// Retrieve the parent block and it's state to execute on top
 		start := time.Now()
+		bc.abortHints()
 
 		parent := it.previous()
 		if parent == nil {
@@ -1772,10 +1929,24 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		if err != nil {
 			return it.index, err
 		}
+		if bc.vmConfig.EnablePreimageRecording {
+			statedb.RecordSlotPreimages()
+		}
 		// If we have a followup block, run that against the current state to pre-cache
 		// transactions and probabilistically some of the account/storage trie nodes.
+		// The code of the contracts called by the transactions is loaded in the
+		// background too, until the block is processed.
 		var followupInterrupt uint32
 		if !bc.cacheConfig.TrieCleanNoPrefetch {
+			if targets := callTargets(block); len(targets) > 0 {
+				// Track the prefetcher in the chain wait group, so a shutdown
+				// doesn't close the database from under it
+				bc.wg.Add(1)
+				go func() {
+					defer bc.wg.Done()
+					state.PrefetchCode(bc.stateCache, bc.snaps, parent.Root, targets, &followupInterrupt)
+				}()
+			}
 			if followup, err := it.peek(); followup != nil && err == nil {
 				throwaway, _ := state.New(parent.Root, bc.stateCache, bc.snaps)
 				go func(start time.Time, followup *types.Block, throwaway *state.StateDB, interrupt *uint32) {
@@ -1810,6 +1981,13 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 
 		blockExecutionTimer.Update(time.Since(substart) - trieproc - triehash)
 
+		// Report the snapshot unhealthy if too many reads fell back to the tries
+		if fallbacks := statedb.SnapshotFallbacks(); fallbacks.Rate() > snapshotFallbackWarnRate && time.Since(bc.snapWarned) > snapshotFallbackWarnInterval {
+			log.Warn("Snapshot reads falling back to the tries", "number", block.Number(), "hash", block.Hash(), "reads", fallbacks.Reads,
+				"notcovered", fallbacks.NotCovered, "stale", fallbacks.Stale, "missing", fallbacks.Missing)
+			bc.snapWarned = time.Now()
+		}
+
 		// Validate the state using the default validator
 		substart = time.Now()
 		if err := bc.validator.ValidateState(block, statedb, receipts, usedGas); err != nil {
@@ -1873,6 +2051,10 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 		dirty, _ := bc.stateCache.TrieDB().Size()
 		stats.report(chain, it.index, dirty)
 	}
+	// Warm the caches for the next block with the state hinted by the pending txs
+	if lastCanon != nil && !bc.cacheConfig.TrieCleanNoPrefetch {
+		bc.prefetchHints(lastCanon.Root())
+	}
 	// Any blocks remaining here? The only ones we care about are the future ones
 	if block != nil && err == consensus.ErrFutureBlock {
 		if err := bc.addFutureBlock(block); err != nil {
@@ -1892,6 +2074,51 @@ func (bc *BlockChain) insertChain(chain types.Blocks, verifySeals bool) (int, er
 	return it.index, err
 }
 
+// SetPrefetchHinter sets the source of the accounts and slots expected to be
+// accessed by the next block (e.g. the transaction pool), which are loaded into
+// the state caches after each imported head, ahead of the next block arriving.
+func (bc *BlockChain) SetPrefetchHinter(hinter state.PrefetchHinter) {
+	bc.hintLock.Lock()
+	defer bc.hintLock.Unlock()
+
+	bc.hinter = hinter
+}
+
+// prefetchHints starts warming the state caches in the background with the state
+// hinted to be accessed by the blocks on top of the given root, interrupting the
+// previous warming if it's still running.
+func (bc *BlockChain) prefetchHints(root common.Hash) {
+	bc.hintLock.Lock()
+	defer bc.hintLock.Unlock()
+
+	if bc.hintAbort != nil {
+		atomic.StoreUint32(bc.hintAbort, 1)
+		bc.hintAbort = nil
+	}
+	if bc.hinter == nil {
+		return
+	}
+	hints := bc.hinter.PrefetchHints()
+	if hints == nil {
+		return
+	}
+	interrupt := new(uint32)
+	bc.hintAbort = interrupt
+	go state.PrefetchState(bc.stateCache, bc.snaps, root, hints, interrupt)
+}
+
+// abortHints interrupts the running hint prefetcher, if any, as the hinted block
+// started being processed.
+func (bc *BlockChain) abortHints() {
+	bc.hintLock.Lock()
+	defer bc.hintLock.Unlock()
+
+	if bc.hintAbort != nil {
+		atomic.StoreUint32(bc.hintAbort, 1)
+		bc.hintAbort = nil
+	}
+}
+
 // insertSideChain is called when an import batch hits upon a pruned ancestor
 // error, which happens when a sidechain with a sufficiently old fork-block is
 // found.
@@ -2134,6 +2361,17 @@ func (bc *BlockChain) reorg(oldBlock, newBlock *types.Block) error {
 	} else {
 		log.Error("Impossible reorg, please file an issue", "oldnum", oldBlock.Number(), "oldhash", oldBlock.Hash(), "newnum", newBlock.Number(), "newhash", newBlock.Hash())
 	}
+	// Drop the log index entries of the old chain before indexing the new one,
+	// since the two chains might share entries at the same heights.
+	if bc.cacheConfig.LogIndexing && len(oldChain) > 0 {
+		batch := bc.db.NewBatch()
+		for _, block := range oldChain {
+			rawdb.DeleteLogIndex(batch, block.NumberU64(), rawdb.ReadRawReceipts(bc.db, block.Hash(), block.NumberU64()))
+		}
+		if err := batch.Write(); err != nil {
+			log.Crit("Failed to delete stale log indexes", "err", err)
+		}
+	}
 	// Insert the new chain(except the head block(reverse order)),
 	// taking care of the proper incremental order.
 	for i := len(newChain) - 1; i >= 1; i-- {
@@ -2275,6 +2513,48 @@ func (bc *BlockChain) maintainTxIndex(ancients uint64) {
 	}
 }
 
+// maintainLogIndex is responsible for the construction of the log index.
+//
+// The blocks becoming the chain head are indexed as they are written, so only
+// the blocks below the log index tail need to be indexed in the background. If
+// no tail exists yet, the entire canonical chain is indexed.
+func (bc *BlockChain) maintainLogIndex() {
+	// indexBlocks indexes all the blocks below the tail, or the entire chain
+	indexBlocks := func(tail *uint64, head uint64, done chan struct{}) {
+		defer func() { done <- struct{}{} }()
+
+		if tail == nil {
+			rawdb.IndexLogs(bc.db, 0, head+1)
+		} else if *tail > 0 {
+			rawdb.IndexLogs(bc.db, 0, *tail)
+		}
+	}
+	// Start listening to chain events and index any missing blocks
+	var (
+		done   chan struct{}                  // Non-nil if background indexing routine is active.
+		headCh = make(chan ChainHeadEvent, 1) // Buffered to avoid locking up the event feed
+	)
+	sub := bc.SubscribeChainHeadEvent(headCh)
+	if sub == nil {
+		return
+	}
+	defer sub.Unsubscribe()
+
+	for {
+		select {
+		case head := <-headCh:
+			if done == nil {
+				done = make(chan struct{})
+				go indexBlocks(rawdb.ReadLogIndexTail(bc.db), head.Block.NumberU64(), done)
+			}
+		case <-done:
+			done = nil
+		case <-bc.quit:
+			return
+		}
+	}
+}
+
 // BadBlocks returns a list of the last 'bad blocks' that the client has seen on the network
 func (bc *BlockChain) BadBlocks() []*types.Block {
 	blocks := make([]*types.Block, 0, bc.badBlocks.Len())
@@ -2414,13 +2694,50 @@ func (bc *BlockChain) GetTransactionLookup(hash common.Hash) *rawdb.LegacyTxLook
 	}
 	tx, blockHash, blockNumber, txIndex := rawdb.ReadTransaction(bc.db, hash)
 	if tx == nil {
-		return nil
+		// The transaction is not indexed, search the unindexed blocks if allowed
+		tx, blockHash, blockNumber, txIndex = bc.findUnindexedTransaction(hash)
+		if tx == nil {
+			return nil
+		}
 	}
 	lookup := &rawdb.LegacyTxLookupEntry{BlockHash: blockHash, BlockIndex: blockNumber, Index: txIndex}
 	bc.txLookupCache.Add(hash, lookup)
 	return lookup
 }
 
+// GetTransaction retrieves a canonical transaction by hash along with its
+// positional metadata, falling back to searching the recent unindexed blocks
+// if the transaction lookup entry has been pruned.
+func (bc *BlockChain) GetTransaction(hash common.Hash) (*types.Transaction, common.Hash, uint64, uint64) {
+	lookup := bc.GetTransactionLookup(hash)
+	if lookup == nil {
+		return nil, common.Hash{}, 0, 0
+	}
+	body := bc.GetBody(lookup.BlockHash)
+	if body == nil || uint64(len(body.Transactions)) <= lookup.Index {
+		return nil, common.Hash{}, 0, 0
+	}
+	return body.Transactions[lookup.Index], lookup.BlockHash, lookup.BlockIndex, lookup.Index
+}
+
+// findUnindexedTransaction searches the configured window of blocks below the
+// transaction index tail for the transaction with the given hash.
+func (bc *BlockChain) findUnindexedTransaction(hash common.Hash) (*types.Transaction, common.Hash, uint64, uint64) {
+	window := bc.cacheConfig.TxLookupScanWindow
+	if window == 0 {
+		return nil, common.Hash{}, 0, 0
+	}
+	tail := rawdb.ReadTxIndexTail(bc.db)
+	if tail == nil || *tail == 0 {
+		return nil, common.Hash{}, 0, 0
+	}
+	var from uint64
+	if *tail > window {
+		from = *tail - window
+	}
+	return rawdb.FindTransaction(bc.db, hash, from, *tail)
+}
+
 // Config retrieves the chain's fork configuration.
 func (bc *BlockChain) Config() *params.ChainConfig { return bc.chainConfig }
 
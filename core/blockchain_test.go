@@ -2280,6 +2280,87 @@ func TestSkipStaleTxIndicesInFastSync(t *testing.T) {
 	check(&tail, chain)
 }
 
+// Tests that transactions of blocks below the tx index tail can be resolved by
+// searching the configured window of unindexed blocks.
+func TestTxLookupScanWindow(t *testing.T) {
+	var (
+		gendb   = rawdb.NewMemoryDatabase()
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		address = crypto.PubkeyToAddress(key.PublicKey)
+		funds   = big.NewInt(1000000000)
+		gspec   = &Genesis{Config: params.TestChainConfig, Alloc: GenesisAlloc{address: {Balance: funds}}}
+		genesis = gspec.MustCommit(gendb)
+		signer  = types.NewEIP155Signer(gspec.Config.ChainID)
+	)
+	blocks, receipts := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), gendb, 128, func(i int, block *BlockGen) {
+		tx, err := types.SignTx(types.NewTransaction(block.TxNonce(address), common.Address{0x00}, big.NewInt(1000), params.TxGas, nil, nil), signer, key)
+		if err != nil {
+			panic(err)
+		}
+		block.AddTx(tx)
+	})
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+	ancientDb, err := rawdb.NewDatabaseWithFreezer(rawdb.NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer db: %v", err)
+	}
+	gspec.MustCommit(ancientDb)
+
+	// Import all blocks into the ancient db, keeping the indices of HEAD-32 only
+	// and searching 16 blocks below the index tail.
+	config := &CacheConfig{
+		TrieCleanLimit:     256,
+		TrieDirtyLimit:     256,
+		TrieTimeLimit:      5 * time.Minute,
+		TxLookupScanWindow: 16,
+	}
+	limit := uint64(32)
+	chain, err := NewBlockChain(ancientDb, config, params.TestChainConfig, ethash.NewFaker(), vm.Config{}, nil, &limit)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	headers := make([]*types.Header, len(blocks))
+	for i, block := range blocks {
+		headers[i] = block.Header()
+	}
+	if n, err := chain.InsertHeaderChain(headers, 0); err != nil {
+		t.Fatalf("failed to insert header %d: %v", n, err)
+	}
+	if n, err := chain.InsertReceiptChain(blocks, receipts, 64); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	if progress := chain.TxIndexProgress(); progress.Tail == nil || *progress.Tail != 32 {
+		t.Fatalf("tx index tail mismatch: have %v, want 32", progress.Tail)
+	}
+	for _, block := range blocks {
+		tx := block.Transactions()[0]
+		found, hash, number, _ := chain.GetTransaction(tx.Hash())
+
+		if block.NumberU64() < 16 {
+			if found != nil {
+				t.Fatalf("block %d: transaction outside of the scan window found", block.NumberU64())
+			}
+			continue
+		}
+		if found == nil || found.Hash() != tx.Hash() || hash != block.Hash() || number != block.NumberU64() {
+			t.Fatalf("block %d: transaction mismatch: have %v/%x/%d", block.NumberU64(), found, hash, number)
+		}
+	}
+	// Backfilling the index should extend the lookup limit to cover the block
+	if err := chain.BackfillTxIndex(8); err != nil {
+		t.Fatalf("failed to backfill tx index: %v", err)
+	}
+	if limit := chain.TxLookupLimit(); limit != 121 {
+		t.Fatalf("tx lookup limit mismatch: have %d, want %d", limit, 121)
+	}
+}
+
 // Benchmarks large blocks with value transfers to non-existing accounts
 func benchmarkLargeNumberOfValueToNonexisting(b *testing.B, numTxs, numBlocks int, recipientFn func(uint64) common.Address, dataFn func(uint64) []byte) {
 	var (
@@ -3028,3 +3109,38 @@ func TestInitThenFailCreateContract(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the blocks imported with the strict snapshot mode are accepted by
+// the snapshot tree, their numbers being recorded with the layers.
+func TestStrictSnapshotImport(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		gspec   = &Genesis{Config: params.TestChainConfig}
+		genesis = gspec.MustCommit(db)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 8, func(i int, block *BlockGen) {
+		block.SetCoinbase(common.Address{byte(i + 1)})
+	})
+	config := &CacheConfig{
+		TrieCleanLimit: 256,
+		TrieDirtyLimit: 256,
+		TrieTimeLimit:  5 * time.Minute,
+		SnapshotLimit:  256,
+		SnapshotStrict: true,
+		SnapshotWait:   true,
+	}
+	chain, err := NewBlockChain(db, config, params.TestChainConfig, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create tester chain: %v", err)
+	}
+	defer chain.Stop()
+
+	if n, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("block %d: failed to insert into chain: %v", n, err)
+	}
+	for _, block := range blocks {
+		if chain.snaps.Snapshot(block.Root()) == nil {
+			t.Fatalf("block %d: snapshot layer missing", block.NumberU64())
+		}
+	}
+}
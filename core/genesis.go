@@ -43,6 +43,10 @@ import (
 
 var errGenesisNoConfig = errors.New("genesis has no chain configuration")
 
+// genesisBulkThreshold is the number of allocated accounts above which the
+// genesis state is committed in bulk instead of through a StateDB.
+const genesisBulkThreshold = 10000
+
 // Genesis specifies the header fields, state of a genesis block. It also defines hard
 // fork switch-over blocks through the chain configuration.
 type Genesis struct {
@@ -78,6 +82,22 @@ func (ga *GenesisAlloc) UnmarshalJSON(data []byte) error {
 	return nil
 }
 
+// commitBulk streams the allocation into the database along with its snapshot,
+// returning the state root.
+func (ga GenesisAlloc) commitBulk(db ethdb.KeyValueStore) (common.Hash, error) {
+	accounts := make([]state.BulkAccount, 0, len(ga))
+	for addr, account := range ga {
+		accounts = append(accounts, state.BulkAccount{
+			Address: addr,
+			Nonce:   account.Nonce,
+			Balance: account.Balance,
+			Code:    account.Code,
+			Storage: account.Storage,
+		})
+	}
+	return state.CommitBulk(db, accounts)
+}
+
 // GenesisAccount is an account in the state of the genesis block.
 type GenesisAccount struct {
 	Code       []byte                      `json:"code,omitempty"`
@@ -253,16 +273,29 @@ func (g *Genesis) ToBlock(db ethdb.Database) *types.Block {
 	if db == nil {
 		db = rawdb.NewMemoryDatabase()
 	}
-	statedb, _ := state.New(common.Hash{}, state.NewDatabase(db), nil)
-	for addr, account := range g.Alloc {
-		statedb.AddBalance(addr, account.Balance)
-		statedb.SetCode(addr, account.Code)
-		statedb.SetNonce(addr, account.Nonce)
-		for key, value := range account.Storage {
-			statedb.SetState(addr, key, value)
+	// Huge allocations are streamed into the database in bulk, the rest are built
+	// through a regular state
+	var (
+		statedb *state.StateDB
+		root    common.Hash
+	)
+	if len(g.Alloc) >= genesisBulkThreshold {
+		var err error
+		if root, err = g.Alloc.commitBulk(db); err != nil {
+			log.Crit("Failed to commit genesis state", "err", err)
 		}
+	} else {
+		statedb, _ = state.New(common.Hash{}, state.NewDatabase(db), nil)
+		for addr, account := range g.Alloc {
+			statedb.AddBalance(addr, account.Balance)
+			statedb.SetCode(addr, account.Code)
+			statedb.SetNonce(addr, account.Nonce)
+			for key, value := range account.Storage {
+				statedb.SetState(addr, key, value)
+			}
+		}
+		root = statedb.IntermediateRoot(false)
 	}
-	root := statedb.IntermediateRoot(false)
 	head := &types.Header{
 		Number:     new(big.Int).SetUint64(g.Number),
 		Nonce:      types.EncodeNonce(g.Nonce),
@@ -282,9 +315,10 @@ func (g *Genesis) ToBlock(db ethdb.Database) *types.Block {
 	if g.Difficulty == nil {
 		head.Difficulty = params.GenesisDifficulty
 	}
-	statedb.Commit(false)
-	statedb.Database().TrieDB().Commit(root, true)
-
+	if statedb != nil {
+		statedb.Commit(false)
+		statedb.Database().TrieDB().Commit(root, true)
+	}
 	return types.NewBlock(head, nil, nil, nil)
 }
 
@@ -17,6 +17,7 @@
 package core
 
 import (
+	"bytes"
 	"math/big"
 	"reflect"
 	"testing"
@@ -25,9 +26,13 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/consensus/ethash"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 func TestDefaultGenesisBlock(t *testing.T) {
@@ -162,3 +167,61 @@ func TestSetupGenesis(t *testing.T) {
 		}
 	}
 }
+
+// Tests that committing the genesis allocation in bulk produces the same state
+// as building it through a StateDB, along with a usable snapshot.
+func TestGenesisCommitBulk(t *testing.T) {
+	// Ensure the bulk commit reproduces the mainnet genesis state
+	mainnet := DefaultGenesisBlock()
+	root, err := mainnet.Alloc.commitBulk(rawdb.NewMemoryDatabase())
+	if err != nil {
+		t.Fatalf("failed to commit mainnet allocation: %v", err)
+	}
+	if want := mainnet.ToBlock(nil).Root(); root != want {
+		t.Fatalf("mainnet root mismatch: have %x, want %x", root, want)
+	}
+	// Ensure contracts, storage (including zero slots) and empty accounts match
+	alloc := GenesisAlloc{
+		common.Address{0x1}: {Balance: big.NewInt(1)},
+		common.Address{0x2}: {Balance: new(big.Int), Nonce: 5},
+		common.Address{0x3}: {
+			Balance: big.NewInt(3),
+			Code:    []byte{0x60, 0x00, 0x60, 0x00, 0xf3},
+			Storage: map[common.Hash]common.Hash{
+				{0x1}: {0x1},
+				{0x2}: {},
+				{0x3}: common.BigToHash(big.NewInt(3)),
+			},
+		},
+	}
+	want := (&Genesis{Alloc: alloc}).ToBlock(nil).Root()
+
+	db := rawdb.NewMemoryDatabase()
+	if root, err = alloc.commitBulk(db); err != nil {
+		t.Fatalf("failed to commit allocation: %v", err)
+	}
+	if root != want {
+		t.Fatalf("root mismatch: have %x, want %x", root, want)
+	}
+	statedb, err := state.New(root, state.NewDatabase(db), nil)
+	if err != nil {
+		t.Fatalf("failed to open state: %v", err)
+	}
+	if code := statedb.GetCode(common.Address{0x3}); !bytes.Equal(code, alloc[common.Address{0x3}].Code) {
+		t.Fatalf("code mismatch: have %x, want %x", code, alloc[common.Address{0x3}].Code)
+	}
+	if value := statedb.GetState(common.Address{0x3}, common.Hash{0x1}); value != (common.Hash{0x1}) {
+		t.Fatalf("slot mismatch: have %x, want %x", value, common.Hash{0x1})
+	}
+	// Ensure the snapshot is loaded as generated instead of being regenerated
+	if have := rawdb.ReadSnapshotRoot(db); have != root {
+		t.Fatalf("snapshot root mismatch: have %x, want %x", have, root)
+	}
+	snaps := snapshot.New(db, trie.NewDatabase(db), 16, root, true)
+	if _, err := snaps.Snapshot(root).Account(crypto.Keccak256Hash(common.Address{0x3}.Bytes())); err != nil {
+		t.Fatalf("failed to read snapshot account: %v", err)
+	}
+	if err := snapshot.VerifyState(snaps, root); err != nil {
+		t.Fatalf("snapshot verification failed: %v", err)
+	}
+}
@@ -597,6 +597,16 @@ func WriteBlock(db ethdb.KeyValueWriter, block *types.Block) {
 
 // WriteAncientBlock writes entire block data into ancient store and returns the total written size.
 func WriteAncientBlock(db ethdb.AncientWriter, block *types.Block, receipts types.Receipts, td *big.Int) int {
+	size, err := writeAncientBlock(db, block, receipts, td)
+	if err != nil {
+		log.Crit("Failed to write block data to ancient store", "err", err)
+	}
+	return size
+}
+
+// writeAncientBlock writes entire block data into ancient store and returns the
+// total written size, or the error if the ancient store rejected the block.
+func writeAncientBlock(db ethdb.AncientWriter, block *types.Block, receipts types.Receipts, td *big.Int) (int, error) {
 	// Encode all block components to RLP format.
 	headerBlob, err := rlp.EncodeToBytes(block.Header())
 	if err != nil {
@@ -621,9 +631,9 @@ func WriteAncientBlock(db ethdb.AncientWriter, block *types.Block, receipts type
 	// Write all blob to flatten files.
 	err = db.AppendAncient(block.NumberU64(), block.Hash().Bytes(), headerBlob, bodyBlob, receiptBlob, tdBlob)
 	if err != nil {
-		log.Crit("Failed to write block data to ancient store", "err", err)
+		return 0, err
 	}
-	return len(headerBlob) + len(bodyBlob) + len(receiptBlob) + len(tdBlob) + common.HashLength
+	return len(headerBlob) + len(bodyBlob) + len(receiptBlob) + len(tdBlob) + common.HashLength, nil
 }
 
 // DeleteBlock removes all block data associated with a hash.
@@ -632,6 +642,7 @@ func DeleteBlock(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
 	DeleteHeader(db, hash, number)
 	DeleteBody(db, hash, number)
 	DeleteTd(db, hash, number)
+	DeleteWitness(db, hash, number)
 }
 
 // DeleteBlockWithoutNumber removes all block data associated with a hash, except
@@ -641,6 +652,7 @@ func DeleteBlockWithoutNumber(db ethdb.KeyValueWriter, hash common.Hash, number
 	deleteHeaderWithoutNumber(db, hash, number)
 	DeleteBody(db, hash, number)
 	DeleteTd(db, hash, number)
+	DeleteWitness(db, hash, number)
 }
 
 // FindCommonAncestor returns the last common ancestor of two block headers
@@ -19,14 +19,17 @@ package rawdb
 import (
 	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"math/big"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"golang.org/x/crypto/sha3"
@@ -210,6 +213,35 @@ func TestTdStorage(t *testing.T) {
 	}
 }
 
+// Tests execution witness storage, retrieval and pruning operations.
+func TestWitnessStorage(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	witness, _ := rlp.EncodeToBytes([][]byte{{0x01}, {0x02, 0x03}})
+	if entry := ReadWitness(db, common.Hash{0x01}, 1); entry != nil {
+		t.Fatalf("Non existent witness returned: %x", entry)
+	}
+	for i := uint64(1); i <= 4; i++ {
+		WriteWitness(db, common.Hash{byte(i)}, i, witness)
+	}
+	if entry := ReadWitness(db, common.Hash{0x01}, 1); !bytes.Equal(entry, witness) {
+		t.Fatalf("Retrieved witness mismatch: have %x, want %x", entry, witness)
+	}
+	// Delete a witness along with its block and prune the old ones
+	DeleteBlock(db, common.Hash{0x04}, 4)
+	if HasWitness(db, common.Hash{0x04}, 4) {
+		t.Fatalf("Witness of deleted block retained")
+	}
+	if deleted, err := PruneWitnesses(db, 3); err != nil || deleted != 2 {
+		t.Fatalf("Pruned witness count mismatch: have %d, want %d (%v)", deleted, 2, err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		if have, want := HasWitness(db, common.Hash{byte(i)}, i), i == 3; have != want {
+			t.Fatalf("Witness %d presence mismatch: have %v, want %v", i, have, want)
+		}
+	}
+}
+
 // Tests that canonical numbers can be mapped to hashes and retrieved.
 func TestCanonicalMappingStorage(t *testing.T) {
 	db := NewMemoryDatabase()
@@ -424,3 +456,248 @@ func TestAncientStorage(t *testing.T) {
 		t.Fatalf("invalid td returned")
 	}
 }
+
+func TestAncientBackfill(t *testing.T) {
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create database with ancient backend")
+	}
+	// Create a short chain with the genesis already frozen
+	var blocks types.Blocks
+	for i := 0; i < 4; i++ {
+		header := &types.Header{
+			Number:      big.NewInt(int64(i)),
+			Difficulty:  big.NewInt(10),
+			Extra:       []byte("test block"),
+			UncleHash:   types.EmptyUncleHash,
+			TxHash:      types.EmptyRootHash,
+			ReceiptHash: types.EmptyRootHash,
+		}
+		if i > 0 {
+			header.ParentHash = blocks[i-1].Hash()
+		}
+		blocks = append(blocks, types.NewBlockWithHeader(header))
+	}
+	WriteAncientBlock(db, blocks[0], nil, big.NewInt(10))
+	receipts := make([]types.Receipts, 3)
+
+	// Backfilling without an anchor in the header chain should fail
+	if _, err := BackfillAncients(db, blocks[1:], receipts); err != errBackfillNotAnchored {
+		t.Fatalf("unanchored backfill error mismatch: have %v, want %v", err, errBackfillNotAnchored)
+	}
+	WriteCanonicalHash(db, blocks[3].Hash(), 3)
+
+	// Backfilling with a gap or a broken link should fail
+	if _, err := BackfillAncients(db, blocks[2:], receipts[1:]); err == nil {
+		t.Fatalf("gapped backfill succeeded")
+	}
+	if _, err := BackfillAncients(db, types.Blocks{blocks[1], blocks[3]}, receipts[1:]); err == nil {
+		t.Fatalf("non contiguous backfill succeeded")
+	}
+	if frozen, _ := db.Ancients(); frozen != 1 {
+		t.Fatalf("ancient head mismatch after failed backfills: have %d, want %d", frozen, 1)
+	}
+	// Backfill the missing range while the freezer is busy, ensuring it waits
+	// for the freezer to finish and the range is retrievable afterwards
+	frdb := db.(*freezerdb)
+	frdb.freezeLock.Lock()
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := BackfillAncients(db, blocks[1:], receipts)
+		errc <- err
+	}()
+	select {
+	case err := <-errc:
+		t.Fatalf("backfill not held off by the freezer: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	frdb.freezeLock.Unlock()
+	if err := <-errc; err != nil {
+		t.Fatalf("failed to backfill ancients: %v", err)
+	}
+	if frozen, _ := db.Ancients(); frozen != 4 {
+		t.Fatalf("ancient head mismatch: have %d, want %d", frozen, 4)
+	}
+	for i, block := range blocks {
+		if hash := ReadCanonicalHash(db, uint64(i)); hash != block.Hash() {
+			t.Fatalf("block %d: canonical hash mismatch: have %x, want %x", i, hash, block.Hash())
+		}
+		if td := ReadTd(db, block.Hash(), uint64(i)); td == nil || td.Int64() != int64(10*(i+1)) {
+			t.Fatalf("block %d: total difficulty mismatch: have %v, want %d", i, td, 10*(i+1))
+		}
+	}
+}
+
+// Tests that the freezer rejects blocks failing the append validators, without
+// writing any of their data.
+func TestAncientValidation(t *testing.T) {
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create database with ancient backend")
+	}
+	defer db.Close()
+
+	newBlock := func(number int64, parent common.Hash) *types.Block {
+		return types.NewBlockWithHeader(&types.Header{
+			Number:      big.NewInt(number),
+			ParentHash:  parent,
+			Difficulty:  big.NewInt(10),
+			UncleHash:   types.EmptyUncleHash,
+			TxHash:      types.EmptyRootHash,
+			ReceiptHash: types.EmptyRootHash,
+		})
+	}
+	genesis := newBlock(0, common.Hash{})
+	if _, err := writeAncientBlock(db, newBlock(1, common.Hash{}), nil, big.NewInt(10)); err == nil {
+		t.Fatalf("misnumbered block accepted")
+	}
+	if _, err := writeAncientBlock(db, genesis, nil, big.NewInt(10)); err != nil {
+		t.Fatalf("failed to write genesis: %v", err)
+	}
+	if _, err := writeAncientBlock(db, newBlock(1, common.Hash{0x01}), nil, big.NewInt(20)); err == nil {
+		t.Fatalf("unlinked block accepted")
+	}
+	if frozen, _ := db.Ancients(); frozen != 1 {
+		t.Fatalf("rejected block written: have %d items, want %d", frozen, 1)
+	}
+	// Register an additional validator and ensure it's consulted
+	block := newBlock(1, genesis.Hash())
+	f := db.(ethdb.AncientMaintainer)
+	if err := f.RegisterValidator("missing", nil); err != errUnknownTable {
+		t.Fatalf("validator of unknown table error mismatch: have %v, want %v", err, errUnknownTable)
+	}
+	f.RegisterValidator(freezerDifficultyTable, func(number uint64, item []byte, prev []byte) error {
+		if bytes.Compare(item, prev) <= 0 {
+			return errors.New("difficulty not increasing")
+		}
+		return nil
+	})
+	if _, err := writeAncientBlock(db, block, nil, big.NewInt(5)); err == nil {
+		t.Fatalf("block rejected by custom validator accepted")
+	}
+	if _, err := writeAncientBlock(db, block, nil, big.NewInt(20)); err != nil {
+		t.Fatalf("failed to write valid block: %v", err)
+	}
+	if hash := ReadCanonicalHash(db, 1); hash != block.Hash() {
+		t.Fatalf("ancient hash mismatch: have %x, want %x", hash, block.Hash())
+	}
+}
+
+// Tests that the database backed by a freezer exposes its maintenance methods,
+// while the one without it doesn't.
+func TestAncientMaintainer(t *testing.T) {
+	if _, ok := NewMemoryDatabase().(ethdb.AncientMaintainer); ok {
+		t.Fatalf("database without freezer exposes the ancient maintenance")
+	}
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create database with ancient backend")
+	}
+	defer db.Close()
+
+	maintainer, ok := db.(ethdb.AncientMaintainer)
+	if !ok {
+		t.Fatalf("database with freezer doesn't expose the ancient maintenance")
+	}
+	genesis := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(0), Extra: make([]byte, 256)})
+	if _, err := writeAncientBlock(db, genesis, nil, big.NewInt(10)); err != nil {
+		t.Fatalf("failed to write genesis: %v", err)
+	}
+	blob, _ := db.Ancient(freezerHeaderTable, 0)
+	stored, decoded, err := maintainer.AncientSizes(freezerHeaderTable, 0, 1)
+	if err != nil {
+		t.Fatalf("failed to retrieve header sizes: %v", err)
+	}
+	if decoded != uint64(len(blob)) || stored >= decoded {
+		t.Fatalf("header sizes mismatch: have %d/%d, want <%d/%d", stored, decoded, len(blob), len(blob))
+	}
+	if _, _, err := maintainer.AncientSizes("missing", 0, 1); err != errUnknownTable {
+		t.Fatalf("sizes of unknown table error mismatch: have %v, want %v", err, errUnknownTable)
+	}
+	// Delete the header and ensure it's not served anymore
+	if err := maintainer.DeleteAncient(freezerHeaderTable, 0); err != nil {
+		t.Fatalf("failed to delete header: %v", err)
+	}
+	if _, err := db.Ancient(freezerHeaderTable, 0); err != errDeleted {
+		t.Fatalf("deleted header error mismatch: have %v, want %v", err, errDeleted)
+	}
+	if _, err := CompactAncients(db); err != nil {
+		t.Fatalf("failed to compact ancients: %v", err)
+	}
+	if _, err := CompactAncients(NewMemoryDatabase()); err != errNotSupported {
+		t.Fatalf("compaction without freezer error mismatch: have %v, want %v", err, errNotSupported)
+	}
+	// Re-chunk the ancients and ensure the remaining items are still served
+	if err := RechunkAncients(db, 64); err != nil {
+		t.Fatalf("failed to re-chunk ancients: %v", err)
+	}
+	if hash := ReadCanonicalHash(db, 0); hash != genesis.Hash() {
+		t.Fatalf("re-chunked hash mismatch: have %x, want %x", hash, genesis.Hash())
+	}
+}
+
+// Tests that the blocks are still validated and appended after the retention of
+// the headers deleted their predecessors.
+func TestAncientRetentionValidation(t *testing.T) {
+	frdir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp freezer dir: %v", err)
+	}
+	defer os.RemoveAll(frdir)
+
+	db, err := NewDatabaseWithFreezer(NewMemoryDatabase(), frdir, "")
+	if err != nil {
+		t.Fatalf("failed to create database with ancient backend")
+	}
+	defer db.Close()
+
+	// Retain less than a single header, only the last one is kept
+	if err := db.(ethdb.AncientMaintainer).SetRetention(freezerHeaderTable, ethdb.AncientRetention{Bytes: 1}); err != nil {
+		t.Fatalf("failed to set header retention: %v", err)
+	}
+	var parent common.Hash
+	for i := int64(0); i < retentionBatch+2; i++ {
+		block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(i), ParentHash: parent})
+		if _, err := writeAncientBlock(db, block, nil, big.NewInt(i+1)); err != nil {
+			t.Fatalf("block %d: failed to write: %v", i, err)
+		}
+		parent = block.Hash()
+	}
+	if _, err := db.Ancient(freezerHeaderTable, 0); err != errDeleted {
+		t.Fatalf("expired header error mismatch: have %v, want %v", err, errDeleted)
+	}
+	if header := ReadHeader(db, parent, retentionBatch+1); header == nil {
+		t.Fatalf("last header deleted")
+	}
+	// Delete the last header too, the next block is appended without the linkage
+	if err := db.(ethdb.AncientMaintainer).DeleteAncient(freezerHeaderTable, retentionBatch+1); err != nil {
+		t.Fatalf("failed to delete header: %v", err)
+	}
+	block := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(retentionBatch + 2), ParentHash: parent})
+	if _, err := writeAncientBlock(db, block, nil, big.NewInt(retentionBatch+3)); err != nil {
+		t.Fatalf("failed to write block after deleted parent: %v", err)
+	}
+	misnumbered := types.NewBlockWithHeader(&types.Header{Number: big.NewInt(retentionBatch + 4), ParentHash: block.Hash()})
+	if _, err := writeAncientBlock(db, misnumbered, nil, big.NewInt(retentionBatch+4)); err == nil {
+		t.Fatalf("misnumbered block accepted")
+	}
+}
@@ -17,6 +17,7 @@
 package rawdb
 
 import (
+	"encoding/binary"
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -115,6 +116,31 @@ func ReadTransaction(db ethdb.Reader, hash common.Hash) (*types.Transaction, com
 	return nil, common.Hash{}, 0, 0
 }
 
+// FindTransaction searches the canonical blocks of the range [from, to) for the
+// transaction with the given hash, along with its positional metadata. It's meant
+// to resolve transactions of the blocks whose lookup entries have been pruned.
+//
+// The blocks are walked in reverse order, as the recent transactions are usually
+// the ones queried the most.
+func FindTransaction(db ethdb.Reader, hash common.Hash, from uint64, to uint64) (*types.Transaction, common.Hash, uint64, uint64) {
+	for number := to; number > from; number-- {
+		blockHash := ReadCanonicalHash(db, number-1)
+		if blockHash == (common.Hash{}) {
+			continue
+		}
+		body := ReadBody(db, blockHash, number-1)
+		if body == nil {
+			continue
+		}
+		for txIndex, tx := range body.Transactions {
+			if tx.Hash() == hash {
+				return tx, blockHash, number - 1, uint64(txIndex)
+			}
+		}
+	}
+	return nil, common.Hash{}, 0, 0
+}
+
 // ReadReceipt retrieves a specific transaction receipt from the database, along with
 // its added positional metadata.
 func ReadReceipt(db ethdb.Reader, hash common.Hash, config *params.ChainConfig) (*types.Receipt, common.Hash, uint64, uint64) {
@@ -151,3 +177,109 @@ func WriteBloomBits(db ethdb.KeyValueWriter, bit uint, section uint64, head comm
 		log.Crit("Failed to store bloom bits", "err", err)
 	}
 }
+
+// logIndexAddress is the log index position of the emitting contract address,
+// topics are indexed at their position in the log plus one.
+const logIndexAddress = 0
+
+// Sizes of the log index entry keys of an address and a topic: prefix, position,
+// value and block number.
+const (
+	logIndexAddressKeySize = 1 + 1 + common.AddressLength + 8
+	logIndexTopicKeySize   = 1 + 1 + common.HashLength + 8
+)
+
+// ReadLogIndexTail retrieves the number of the oldest block whose logs have been
+// indexed. If the entry is non-existent in the database, no logs are indexed.
+func ReadLogIndexTail(db ethdb.KeyValueReader) *uint64 {
+	data, _ := db.Get(logIndexTailKey)
+	if len(data) != 8 {
+		return nil
+	}
+	number := binary.BigEndian.Uint64(data)
+	return &number
+}
+
+// WriteLogIndexTail stores the number of the oldest block whose logs have been
+// indexed into the database.
+func WriteLogIndexTail(db ethdb.KeyValueWriter, number uint64) {
+	if err := db.Put(logIndexTailKey, encodeBlockNumber(number)); err != nil {
+		log.Crit("Failed to store the log index tail", "err", err)
+	}
+}
+
+// DeleteLogIndexTail removes the log index tail from the database, marking the
+// log index as not maintained.
+func DeleteLogIndexTail(db ethdb.KeyValueWriter) {
+	if err := db.Delete(logIndexTailKey); err != nil {
+		log.Crit("Failed to delete the log index tail", "err", err)
+	}
+}
+
+// WriteLogIndex stores the log index entries of a canonical block, mapping the
+// addresses and the topics of all the logs in the receipts to the block number.
+func WriteLogIndex(db ethdb.KeyValueWriter, number uint64, receipts types.Receipts) {
+	for _, receipt := range receipts {
+		for _, l := range receipt.Logs {
+			if err := db.Put(logIndexKey(logIndexAddress, l.Address.Bytes(), number), nil); err != nil {
+				log.Crit("Failed to store log index entry", "err", err)
+			}
+			for i, topic := range l.Topics {
+				if err := db.Put(logIndexKey(byte(i+1), topic.Bytes(), number), nil); err != nil {
+					log.Crit("Failed to store log index entry", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// DeleteLogIndex removes the log index entries of a block no longer canonical.
+func DeleteLogIndex(db ethdb.KeyValueWriter, number uint64, receipts types.Receipts) {
+	for _, receipt := range receipts {
+		for _, l := range receipt.Logs {
+			if err := db.Delete(logIndexKey(logIndexAddress, l.Address.Bytes(), number)); err != nil {
+				log.Crit("Failed to delete log index entry", "err", err)
+			}
+			for i, topic := range l.Topics {
+				if err := db.Delete(logIndexKey(byte(i+1), topic.Bytes(), number)); err != nil {
+					log.Crit("Failed to delete log index entry", "err", err)
+				}
+			}
+		}
+	}
+}
+
+// ReadAddressLogBlocks retrieves the numbers of all the indexed blocks in the
+// inclusive range [from, to] containing logs emitted by the given address.
+func ReadAddressLogBlocks(db ethdb.Iteratee, address common.Address, from uint64, to uint64) []uint64 {
+	return readLogIndexRange(db, logIndexAddress, address.Bytes(), from, to)
+}
+
+// ReadTopicLogBlocks retrieves the numbers of all the indexed blocks in the
+// inclusive range [from, to] containing logs with the given topic at the given
+// position.
+func ReadTopicLogBlocks(db ethdb.Iteratee, position int, topic common.Hash, from uint64, to uint64) []uint64 {
+	return readLogIndexRange(db, byte(position+1), topic.Bytes(), from, to)
+}
+
+// readLogIndexRange iterates the log index entries of an address or a topic,
+// collecting the block numbers in the inclusive range [from, to].
+func readLogIndexRange(db ethdb.Iteratee, position byte, value []byte, from uint64, to uint64) []uint64 {
+	prefix := logIndexValueKey(position, value)
+	it := db.NewIterator(prefix, encodeBlockNumber(from))
+	defer it.Release()
+
+	var numbers []uint64
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(prefix)+8 {
+			continue
+		}
+		number := binary.BigEndian.Uint64(key[len(prefix):])
+		if number > to {
+			break
+		}
+		numbers = append(numbers, number)
+	}
+	return numbers
+}
@@ -18,6 +18,7 @@ package rawdb
 
 import (
 	"math/big"
+	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -106,3 +107,82 @@ func TestLookupStorage(t *testing.T) {
 		})
 	}
 }
+
+// Tests that transactions of unindexed blocks can be found by searching a range
+// of canonical blocks.
+func TestFindTransaction(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	var txs []*types.Transaction
+	for i := uint64(0); i < 8; i++ {
+		tx := types.NewTransaction(i, common.BytesToAddress([]byte{0x11}), big.NewInt(111), 1111, big.NewInt(11111), nil)
+		block := types.NewBlock(&types.Header{Number: new(big.Int).SetUint64(i)}, []*types.Transaction{tx}, nil, nil)
+		WriteCanonicalHash(db, block.Hash(), block.NumberU64())
+		WriteBlock(db, block)
+		txs = append(txs, tx)
+	}
+	for i, tx := range txs {
+		if txn, _, number, index := FindTransaction(db, tx.Hash(), 0, 8); txn == nil || txn.Hash() != tx.Hash() || number != uint64(i) || index != 0 {
+			t.Fatalf("tx #%d: search mismatch: have %v/%d/%d", i, txn, number, index)
+		}
+	}
+	// Transactions outside of the searched range should not be found
+	if txn, _, _, _ := FindTransaction(db, txs[1].Hash(), 2, 8); txn != nil {
+		t.Fatalf("transaction below the range found")
+	}
+	if txn, _, _, _ := FindTransaction(db, txs[7].Hash(), 2, 7); txn != nil {
+		t.Fatalf("transaction above the range found")
+	}
+}
+
+// Tests that the log index entries can be stored, queried by range, deleted and
+// backfilled from the stored receipts.
+func TestLogIndex(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	var (
+		addrA  = common.Address{0x0a}
+		addrB  = common.Address{0x0b}
+		topicA = common.Hash{0x01}
+		topicB = common.Hash{0x02}
+	)
+	receipts := map[uint64]types.Receipts{
+		1: {{Logs: []*types.Log{{Address: addrA, Topics: []common.Hash{topicA}}}}},
+		2: {{Logs: []*types.Log{{Address: addrB, Topics: []common.Hash{topicB, topicA}}}}},
+		3: {},
+		4: {{Logs: []*types.Log{{Address: addrA, Topics: []common.Hash{topicA}}}}, {Logs: []*types.Log{{Address: addrA}}}},
+	}
+	for number := uint64(0); number <= 4; number++ {
+		block := types.NewBlockWithHeader(&types.Header{Number: new(big.Int).SetUint64(number), Extra: []byte("logindex")})
+		WriteCanonicalHash(db, block.Hash(), number)
+		WriteReceipts(db, block.Hash(), number, receipts[number])
+	}
+	IndexLogs(db, 0, 5)
+	if tail := ReadLogIndexTail(db); tail == nil || *tail != 0 {
+		t.Fatalf("log index tail mismatch: have %v, want %d", tail, 0)
+	}
+	tests := []struct {
+		blocks []uint64
+		want   []uint64
+	}{
+		{ReadAddressLogBlocks(db, addrA, 0, 4), []uint64{1, 4}},
+		{ReadAddressLogBlocks(db, addrA, 2, 3), nil},
+		{ReadAddressLogBlocks(db, addrB, 2, 2), []uint64{2}},
+		{ReadTopicLogBlocks(db, 0, topicA, 0, 4), []uint64{1, 4}},
+		{ReadTopicLogBlocks(db, 1, topicA, 0, 4), []uint64{2}},
+		{ReadTopicLogBlocks(db, 0, topicB, 3, 4), nil},
+	}
+	for i, tt := range tests {
+		if !reflect.DeepEqual(tt.blocks, tt.want) {
+			t.Errorf("test %d: block mismatch: have %v, want %v", i, tt.blocks, tt.want)
+		}
+	}
+	// Delete a block and ensure its entries are gone
+	DeleteLogIndex(db, 4, receipts[4])
+	if blocks := ReadAddressLogBlocks(db, addrA, 0, 10); !reflect.DeepEqual(blocks, []uint64{1}) {
+		t.Fatalf("address blocks mismatch after deletion: have %v, want %v", blocks, []uint64{1})
+	}
+	if blocks := ReadTopicLogBlocks(db, 0, topicA, 0, 10); !reflect.DeepEqual(blocks, []uint64{1}) {
+		t.Fatalf("topic blocks mismatch after deletion: have %v, want %v", blocks, []uint64{1})
+	}
+}
@@ -20,8 +20,16 @@ import (
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
 )
 
+// StorageStats is the storage accounting maintained for every account in the
+// persisted snapshot, tracking the number of slots and their total value size.
+type StorageStats struct {
+	Slots uint64 // Number of storage slots in the account
+	Size  uint64 // Total size of the (RLP encoded) slot values
+}
+
 // ReadSnapshotRoot retrieves the root of the block whose state is contained in
 // the persisted snapshot.
 func ReadSnapshotRoot(db ethdb.KeyValueReader) common.Hash {
@@ -96,6 +104,72 @@ func IterateStorageSnapshots(db ethdb.Iteratee, accountHash common.Hash) ethdb.I
 	return db.NewIterator(storageSnapshotsKey(accountHash), nil)
 }
 
+// ReadStorageStats retrieves the storage accounting of an account from the
+// persisted snapshot. Nil is returned if no stats are tracked for the account.
+func ReadStorageStats(db ethdb.KeyValueReader, accountHash common.Hash) *StorageStats {
+	data, _ := db.Get(storageStatsKey(accountHash))
+	if len(data) == 0 {
+		return nil
+	}
+	stats := new(StorageStats)
+	if err := rlp.DecodeBytes(data, stats); err != nil {
+		log.Error("Invalid storage stats RLP", "account", accountHash, "err", err)
+		return nil
+	}
+	return stats
+}
+
+// WriteStorageStats stores the storage accounting of an account into the
+// persisted snapshot.
+func WriteStorageStats(db ethdb.KeyValueWriter, accountHash common.Hash, stats *StorageStats) {
+	data, err := rlp.EncodeToBytes(stats)
+	if err != nil {
+		log.Crit("Failed to RLP encode storage stats", "err", err)
+	}
+	if err := db.Put(storageStatsKey(accountHash), data); err != nil {
+		log.Crit("Failed to store storage stats", "err", err)
+	}
+}
+
+// DeleteStorageStats removes the storage accounting of an account from the
+// persisted snapshot.
+func DeleteStorageStats(db ethdb.KeyValueWriter, accountHash common.Hash) {
+	if err := db.Delete(storageStatsKey(accountHash)); err != nil {
+		log.Crit("Failed to delete storage stats", "err", err)
+	}
+}
+
+// ReadStorageWipes retrieves the hashes of all the accounts whose storage in the
+// persisted snapshot is scheduled for deletion.
+func ReadStorageWipes(db ethdb.Iteratee) []common.Hash {
+	it := db.NewIterator(SnapshotWipePrefix, nil)
+	defer it.Release()
+
+	var hashes []common.Hash
+	for it.Next() {
+		if key := it.Key(); len(key) == len(SnapshotWipePrefix)+common.HashLength {
+			hashes = append(hashes, common.BytesToHash(key[len(SnapshotWipePrefix):]))
+		}
+	}
+	return hashes
+}
+
+// WriteStorageWipe schedules the deletion of the storage of an account from the
+// persisted snapshot.
+func WriteStorageWipe(db ethdb.KeyValueWriter, accountHash common.Hash) {
+	if err := db.Put(storageWipeKey(accountHash), []byte{}); err != nil {
+		log.Crit("Failed to store storage wipe", "err", err)
+	}
+}
+
+// DeleteStorageWipe removes the scheduled deletion of the storage of an account
+// from the persisted snapshot.
+func DeleteStorageWipe(db ethdb.KeyValueWriter, accountHash common.Hash) {
+	if err := db.Delete(storageWipeKey(accountHash)); err != nil {
+		log.Crit("Failed to delete storage wipe", "err", err)
+	}
+}
+
 // ReadSnapshotJournal retrieves the serialized in-memory diff layers saved at
 // the last shutdown. The blob is expected to be max a few 10s of megabytes.
 func ReadSnapshotJournal(db ethdb.KeyValueReader) []byte {
@@ -118,3 +192,26 @@ func DeleteSnapshotJournal(db ethdb.KeyValueWriter) {
 		log.Crit("Failed to remove snapshot journal", "err", err)
 	}
 }
+
+// ReadSnapshotGenerator retrieves the serialized snapshot wiping and generation
+// progress saved along with the generated snapshot data.
+func ReadSnapshotGenerator(db ethdb.KeyValueReader) []byte {
+	data, _ := db.Get(snapshotGeneratorKey)
+	return data
+}
+
+// WriteSnapshotGenerator stores the serialized snapshot wiping and generation
+// progress.
+func WriteSnapshotGenerator(db ethdb.KeyValueWriter, generator []byte) {
+	if err := db.Put(snapshotGeneratorKey, generator); err != nil {
+		log.Crit("Failed to store snapshot generator", "err", err)
+	}
+}
+
+// DeleteSnapshotGenerator deletes the serialized snapshot wiping and generation
+// progress.
+func DeleteSnapshotGenerator(db ethdb.KeyValueWriter) {
+	if err := db.Delete(snapshotGeneratorKey); err != nil {
+		log.Crit("Failed to remove snapshot generator", "err", err)
+	}
+}
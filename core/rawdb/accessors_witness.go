@@ -0,0 +1,80 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+var (
+	witnessReadMeter  = metrics.NewRegisteredMeter("db/witness/read", nil)  // Bytes of witnesses read
+	witnessWriteMeter = metrics.NewRegisteredMeter("db/witness/write", nil) // Bytes of witnesses written
+	witnessPruneMeter = metrics.NewRegisteredMeter("db/witness/prune", nil) // Number of witnesses pruned
+)
+
+// Execution witnesses are stored in the key-value store only, they are not moved
+// into the freezer: the ancient tables need an item for every block, whereas
+// witnesses are only kept for the blocks they were requested for. A witness is
+// deleted along with its block from the key-value store, i.e. once the block is
+// frozen or dropped from a side chain, unless pruned explicitly before that.
+
+// ReadWitness retrieves the RLP encoded execution witness of a block, nil if
+// it's not stored.
+func ReadWitness(db ethdb.KeyValueReader, hash common.Hash, number uint64) rlp.RawValue {
+	data, _ := db.Get(witnessKey(number, hash))
+	if len(data) == 0 {
+		return nil
+	}
+	witnessReadMeter.Mark(int64(len(data)))
+	return data
+}
+
+// HasWitness verifies the existence of the execution witness of a block.
+func HasWitness(db ethdb.KeyValueReader, hash common.Hash, number uint64) bool {
+	has, err := db.Has(witnessKey(number, hash))
+	return has && err == nil
+}
+
+// WriteWitness stores the RLP encoded execution witness of a block.
+func WriteWitness(db ethdb.KeyValueWriter, hash common.Hash, number uint64, witness rlp.RawValue) {
+	if err := db.Put(witnessKey(number, hash), witness); err != nil {
+		log.Crit("Failed to store block witness", "err", err)
+	}
+	witnessWriteMeter.Mark(int64(len(witness)))
+}
+
+// DeleteWitness removes the execution witness of a block.
+func DeleteWitness(db ethdb.KeyValueWriter, hash common.Hash, number uint64) {
+	if err := db.Delete(witnessKey(number, hash)); err != nil {
+		log.Crit("Failed to delete block witness", "err", err)
+	}
+}
+
+// PruneWitnesses deletes the execution witnesses of all the blocks below the
+// given number, canonical or not, returning the number of witnesses deleted.
+func PruneWitnesses(db ethdb.KeyValueStore, limit uint64) (int, error) {
+	deleted, err := witnessKeyPrefix.DeleteRange(db, nil, encodeBlockNumber(limit))
+	if err != nil {
+		return 0, err
+	}
+	witnessPruneMeter.Mark(int64(deleted))
+	return deleted, nil
+}
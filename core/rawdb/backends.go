@@ -0,0 +1,148 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/leveldb"
+)
+
+// DefaultBackend is the key-value store backend used if none is selected.
+const DefaultBackend = "leveldb"
+
+// BackendFactory opens (or creates) a persistent key-value store at the given
+// path, with the given cache allowance in megabytes and number of file handles.
+// The namespace is the prefix of the metrics reported by the store.
+type BackendFactory func(file string, cache int, handles int, namespace string) (ethdb.KeyValueStore, error)
+
+// BackendCapabilities are the optional features of a key-value store backend,
+// which callers can consult to pick the most efficient way of operating on it.
+type BackendCapabilities struct {
+	RangeDelete bool // Whether key ranges can be deleted natively, without iterating them
+	Snapshots   bool // Whether consistent point-in-time views of the store are supported
+}
+
+// backend is a registered key-value store backend.
+type backend struct {
+	factory BackendFactory
+	caps    BackendCapabilities
+}
+
+var (
+	backendsLock sync.RWMutex
+	backends     = map[string]backend{
+		DefaultBackend: {
+			factory: func(file string, cache int, handles int, namespace string) (ethdb.KeyValueStore, error) {
+				return leveldb.New(file, cache, handles, namespace)
+			},
+			caps: BackendCapabilities{Snapshots: true},
+		},
+	}
+)
+
+// RegisterBackend makes a key-value store backend available under the given
+// name, so it can be selected when opening a database. It's meant to be called
+// by external modules (e.g. from an init function) providing other backends.
+// Registering a name twice is an error.
+func RegisterBackend(name string, factory BackendFactory, caps BackendCapabilities) error {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+
+	if _, ok := backends[name]; ok {
+		return fmt.Errorf("database backend %q already registered", name)
+	}
+	backends[name] = backend{factory: factory, caps: caps}
+	return nil
+}
+
+// Backends returns the names of the registered key-value store backends, sorted.
+func Backends() []string {
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Capabilities returns the optional features of a registered backend, the empty
+// name standing for the default one.
+func Capabilities(name string) (BackendCapabilities, error) {
+	b, err := lookupBackend(name)
+	if err != nil {
+		return BackendCapabilities{}, err
+	}
+	return b.caps, nil
+}
+
+// lookupBackend retrieves a registered backend, the empty name standing for the
+// default one.
+func lookupBackend(name string) (backend, error) {
+	if name == "" {
+		name = DefaultBackend
+	}
+	backendsLock.RLock()
+	defer backendsLock.RUnlock()
+
+	b, ok := backends[name]
+	if !ok {
+		return backend{}, fmt.Errorf("unknown database backend %q", name)
+	}
+	return b, nil
+}
+
+// NewBackendDatabase creates a persistent key-value database on top of the named
+// backend (the default one if empty), without a freezer moving immutable chain
+// segments into cold storage.
+func NewBackendDatabase(name string, file string, cache int, handles int, namespace string) (ethdb.Database, error) {
+	b, err := lookupBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	kvdb, err := b.factory(file, cache, handles, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return NewDatabase(kvdb), nil
+}
+
+// NewBackendDatabaseWithFreezer creates a persistent key-value database on top
+// of the named backend (the default one if empty), with a freezer moving
+// immutable chain segments into cold storage, configured by the given settings.
+func NewBackendDatabaseWithFreezer(name string, file string, cache int, handles int, freezer string, namespace string, config FreezerConfig) (ethdb.Database, error) {
+	b, err := lookupBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	kvdb, err := b.factory(file, cache, handles, namespace)
+	if err != nil {
+		return nil, err
+	}
+	frdb, err := NewDatabaseWithFreezerConfig(kvdb, freezer, namespace, config)
+	if err != nil {
+		kvdb.Close()
+		return nil, err
+	}
+	return frdb, nil
+}
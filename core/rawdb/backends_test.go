@@ -0,0 +1,75 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that custom backends can be registered and selected by name.
+func TestRegisterBackend(t *testing.T) {
+	var opened string
+	factory := func(file string, cache int, handles int, namespace string) (ethdb.KeyValueStore, error) {
+		opened = file
+		return memorydb.New(), nil
+	}
+	caps := BackendCapabilities{RangeDelete: true, Snapshots: true}
+	if err := RegisterBackend("test-memory", factory, caps); err != nil {
+		t.Fatalf("failed to register backend: %v", err)
+	}
+	if err := RegisterBackend("test-memory", factory, caps); err == nil {
+		t.Fatalf("duplicate registration succeeded")
+	}
+	if err := RegisterBackend(DefaultBackend, factory, caps); err == nil {
+		t.Fatalf("default backend overridden")
+	}
+	names := Backends()
+	if len(names) != 2 || names[0] != DefaultBackend || names[1] != "test-memory" {
+		t.Fatalf("backend list mismatch: have %v", names)
+	}
+	if have, err := Capabilities("test-memory"); err != nil || have != caps {
+		t.Fatalf("capabilities mismatch: have %+v, %v, want %+v", have, err, caps)
+	}
+	if have, err := Capabilities(""); err != nil || have.RangeDelete || !have.Snapshots {
+		t.Fatalf("default capabilities mismatch: have %+v, %v", have, err)
+	}
+	if _, err := Capabilities("missing"); err == nil {
+		t.Fatalf("capabilities of unknown backend returned")
+	}
+	if _, err := NewBackendDatabase("missing", "path", 16, 16, ""); err == nil {
+		t.Fatalf("unknown backend opened")
+	}
+	db, err := NewBackendDatabase("test-memory", "path", 16, 16, "")
+	if err != nil {
+		t.Fatalf("failed to open backend: %v", err)
+	}
+	defer db.Close()
+
+	if opened != "path" {
+		t.Fatalf("factory invoked with wrong path: have %q, want %q", opened, "path")
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	if blob, err := db.Get([]byte("key")); err != nil || !bytes.Equal(blob, []byte("value")) {
+		t.Fatalf("read mismatch: have %x, %v", blob, err)
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+var (
+	// errBackfillNotAnchored is returned if the blocks to backfill can't be linked
+	// to the local header chain, so their canonicality can't be verified.
+	errBackfillNotAnchored = errors.New("backfilled blocks not anchored to the header chain")
+
+	// errBackfillUnknownTd is returned if the total difficulty of the parent of
+	// the first backfilled block is not available.
+	errBackfillUnknownTd = errors.New("unknown parent total difficulty")
+)
+
+// BackfillAncients appends a contiguous range of blocks, retrieved from the
+// network, to the ancient store, restoring the chain history missing from it
+// (e.g. after a freezer truncation) without a full resync.
+//
+// The first block must directly follow the current head of the ancient store.
+// All blocks are validated before anything is written: the blocks must form a
+// chain linked to the last frozen block, their bodies and receipts must match
+// the roots committed to in the headers, and the range must be anchored to the
+// local header chain, either by the canonical hash of the last block or by the
+// parent hash of the next canonical header.
+//
+// The blocks are appended in order and the ancient store is synced afterwards.
+// If any append fails, the ancient store is truncated back to its original head.
+// The size of the written data is returned.
+//
+// The background freezer is held off for the duration of the backfill, so it
+// doesn't move the same blocks out of the key-value store concurrently.
+func BackfillAncients(db ethdb.Database, blocks types.Blocks, receipts []types.Receipts) (int, error) {
+	if len(blocks) == 0 {
+		return 0, nil
+	}
+	if len(blocks) != len(receipts) {
+		return 0, fmt.Errorf("block and receipt count mismatch: %d != %d", len(blocks), len(receipts))
+	}
+	if frdb, ok := db.(*freezerdb); ok {
+		frdb.freezeLock.Lock()
+		defer frdb.freezeLock.Unlock()
+	}
+	frozen, err := db.Ancients()
+	if err != nil {
+		return 0, err
+	}
+	if first := blocks[0].NumberU64(); first != frozen {
+		return 0, fmt.Errorf("backfill not contiguous with ancient head: have %d, want %d", first, frozen)
+	}
+	// Validate the chain linkage and the block contents
+	for i, block := range blocks {
+		number := block.NumberU64()
+		if i > 0 {
+			if prev := blocks[i-1]; number != prev.NumberU64()+1 || block.ParentHash() != prev.Hash() {
+				return 0, fmt.Errorf("non contiguous backfill: item %d is #%d [%x…], item %d is #%d [%x…] (parent [%x…])",
+					i-1, prev.NumberU64(), prev.Hash().Bytes()[:4], i, number, block.Hash().Bytes()[:4], block.ParentHash().Bytes()[:4])
+			}
+		} else if number > 0 {
+			if parent := ReadCanonicalHash(db, number-1); block.ParentHash() != parent {
+				return 0, fmt.Errorf("backfill not linked to ancient head: parent [%x…], want [%x…]", block.ParentHash().Bytes()[:4], parent.Bytes()[:4])
+			}
+		}
+		if hash := types.DeriveSha(block.Transactions()); hash != block.TxHash() {
+			return 0, fmt.Errorf("transaction root mismatch in block #%d: have %x, want %x", number, hash, block.TxHash())
+		}
+		if hash := types.CalcUncleHash(block.Uncles()); hash != block.UncleHash() {
+			return 0, fmt.Errorf("uncle root mismatch in block #%d: have %x, want %x", number, hash, block.UncleHash())
+		}
+		if hash := types.DeriveSha(receipts[i]); hash != block.ReceiptHash() {
+			return 0, fmt.Errorf("receipt root mismatch in block #%d: have %x, want %x", number, hash, block.ReceiptHash())
+		}
+	}
+	// Ensure the range is part of the canonical chain known locally
+	last := blocks[len(blocks)-1]
+	if ReadCanonicalHash(db, last.NumberU64()) != last.Hash() {
+		next := ReadCanonicalHash(db, last.NumberU64()+1)
+		if header := ReadHeader(db, next, last.NumberU64()+1); header == nil || header.ParentHash != last.Hash() {
+			return 0, errBackfillNotAnchored
+		}
+	}
+	// Resolve the total difficulty to continue from
+	td := new(big.Int)
+	if number := blocks[0].NumberU64(); number > 0 {
+		parent := ReadTd(db, blocks[0].ParentHash(), number-1)
+		if parent == nil {
+			return 0, errBackfillUnknownTd
+		}
+		td.Set(parent)
+	}
+	// Everything checks out, append the blocks in order
+	var size int
+	for i, block := range blocks {
+		td.Add(td, block.Difficulty())
+		n, err := writeAncientBlock(db, block, receipts[i], td)
+		if err != nil {
+			if err := db.TruncateAncients(frozen); err != nil {
+				log.Error("Failed to revert ancient backfill", "err", err)
+			}
+			return 0, err
+		}
+		size += n
+	}
+	if err := db.Sync(); err != nil {
+		return 0, err
+	}
+	log.Info("Backfilled ancient chain segment", "count", len(blocks), "first", blocks[0].NumberU64(), "last", last.NumberU64(), "size", size)
+	return size, nil
+}
@@ -302,3 +302,63 @@ func UnindexTransactions(db ethdb.Database, from uint64, to uint64) {
 	}
 	log.Info("Unindexed transactions", "blocks", blocks, "txs", txs, "tail", to, "elapsed", common.PrettyDuration(time.Since(start)))
 }
+
+// IndexLogs creates log index entries for the canonical blocks of the specified
+// range [from, to).
+//
+// Similarly to the transaction indexing, the chain is iterated in reverse order,
+// periodically writing the log index tail, so an interrupted backfill can be
+// resumed from the tail next time.
+func IndexLogs(db ethdb.Database, from uint64, to uint64) {
+	// short circuit for invalid range
+	if from >= to {
+		return
+	}
+	var (
+		batch  = db.NewBatch()
+		start  = time.Now()
+		logged = start.Add(-7 * time.Second)
+		blocks = 0
+		logs   = 0
+		size   = 0 // Size of the keys in the batch, the entries have no values
+	)
+	for number := to; number > from; number-- {
+		hash := ReadCanonicalHash(db, number-1)
+		if hash == (common.Hash{}) {
+			log.Warn("Missing canonical block for log indexing", "number", number-1)
+			break
+		}
+		receipts := ReadRawReceipts(db, hash, number-1)
+		WriteLogIndex(batch, number-1, receipts)
+		for _, receipt := range receipts {
+			for _, l := range receipt.Logs {
+				size += logIndexAddressKeySize + len(l.Topics)*logIndexTopicKeySize
+			}
+			logs += len(receipt.Logs)
+		}
+		blocks++
+
+		// If enough data was accumulated in memory, dump to disk along the tail
+		if size > ethdb.IdealBatchSize {
+			WriteLogIndexTail(batch, number-1)
+			if err := batch.Write(); err != nil {
+				log.Crit("Failed writing batch to db", "error", err)
+				return
+			}
+			batch.Reset()
+			size = 0
+		}
+		// If we've spent too much time already, notify the user of what we're doing
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Indexing logs", "blocks", blocks, "logs", logs, "tail", number-1, "total", to-from, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	tail := to - uint64(blocks)
+	WriteLogIndexTail(batch, tail)
+	if err := batch.Write(); err != nil {
+		log.Crit("Failed writing batch to db", "error", err)
+		return
+	}
+	log.Info("Indexed logs", "blocks", blocks, "logs", logs, "tail", tail, "elapsed", common.PrettyDuration(time.Since(start)))
+}
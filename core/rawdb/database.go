@@ -31,17 +31,18 @@ import (
 	"github.com/olekukonko/tablewriter"
 )
 
-// freezerdb is a database wrapper that enabled freezer data retrievals.
+// freezerdb is a database wrapper that enabled freezer data retrievals. It also
+// exposes the maintenance methods of the freezer.
 type freezerdb struct {
 	ethdb.KeyValueStore
-	ethdb.AncientStore
+	*freezer
 }
 
 // Close implements io.Closer, closing both the fast key-value store as well as
 // the slow ancient tables.
 func (frdb *freezerdb) Close() error {
 	var errs []error
-	if err := frdb.AncientStore.Close(); err != nil {
+	if err := frdb.freezer.Close(); err != nil {
 		errs = append(errs, err)
 	}
 	if err := frdb.KeyValueStore.Close(); err != nil {
@@ -68,6 +69,11 @@ func (db *nofreezedb) Ancient(kind string, number uint64) ([]byte, error) {
 	return nil, errNotSupported
 }
 
+// AncientInto returns an error as we don't have a backing chain freezer.
+func (db *nofreezedb) AncientInto(kind string, number uint64, buf []byte) ([]byte, error) {
+	return nil, errNotSupported
+}
+
 // Ancients returns an error as we don't have a backing chain freezer.
 func (db *nofreezedb) Ancients() (uint64, error) {
 	return 0, errNotSupported
@@ -101,12 +107,71 @@ func NewDatabase(db ethdb.KeyValueStore) ethdb.Database {
 	}
 }
 
+// FreezerSyncMode is the strategy of the freezer tables to flush the appended
+// data to disk.
+type FreezerSyncMode int
+
+const (
+	// FreezerSyncDefault flushes the sealed data files of the tables, the rest
+	// is flushed explicitly before the chain data is deleted from the key-value
+	// store.
+	FreezerSyncDefault FreezerSyncMode = iota
+
+	// FreezerSyncAlways flushes the tables after every append, making the
+	// explicit flushes no-ops.
+	FreezerSyncAlways
+
+	// FreezerSyncInterval flushes the tables on append if the configured interval
+	// has elapsed since the last flush.
+	FreezerSyncInterval
+)
+
+// FreezerConfig contains the optional settings of the freezer attached to a
+// database. The zero value is the default configuration.
+type FreezerConfig struct {
+	MaxOpenFiles int  // Number of data files kept open by each table, zero meaning no limit
+	Migrate      bool // Whether to convert the tables stored in a legacy format on open
+	FullCheck    bool // Whether to verify every item on open instead of a random sample
+	DropCache    bool // Whether to evict the flushed data from the OS page cache
+	InlineIndex  bool // Whether to store small items in the table indexes, unreadable by older versions
+
+	Sync map[string]FreezerSync // Flush strategy per table name, tables not listed keep their default
+
+	HistoryRetention *ethdb.AncientRetention // Retention of the block bodies and receipts replacing the persisted one, nil to keep it
+}
+
+// FreezerSync is the flush strategy configured for a single freezer table.
+type FreezerSync struct {
+	Mode     FreezerSyncMode // Strategy of the table to flush the appended data to disk
+	Interval time.Duration   // Minimal time between flushes, used by FreezerSyncInterval
+}
+
+// syncPolicy returns the flush policy of the given table, overriding the default
+// one of the table if another sync mode is configured for it.
+func (config FreezerConfig) syncPolicy(table string) syncPolicy {
+	switch sync := config.Sync[table]; sync.Mode {
+	case FreezerSyncAlways:
+		return syncPolicy{mode: syncAlways}
+	case FreezerSyncInterval:
+		return syncPolicy{mode: syncInterval, interval: sync.Interval}
+	default:
+		return freezerSyncPolicy[table]
+	}
+}
+
 // NewDatabaseWithFreezer creates a high level database on top of a given key-
 // value data store with a freezer moving immutable chain segments into cold
 // storage.
 func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezer string, namespace string) (ethdb.Database, error) {
+	return NewDatabaseWithFreezerConfig(db, freezer, namespace, FreezerConfig{})
+}
+
+// NewDatabaseWithFreezerConfig creates a high level database on top of a given
+// key-value data store with a freezer moving immutable chain segments into cold
+// storage, configured by the given settings.
+func NewDatabaseWithFreezerConfig(db ethdb.KeyValueStore, freezer string, namespace string, config FreezerConfig) (ethdb.Database, error) {
 	// Create the idle freezer instance
-	frdb, err := newFreezer(freezer, namespace)
+	frdb, err := newFreezer(freezer, namespace, config)
 	if err != nil {
 		return nil, err
 	}
@@ -176,7 +241,7 @@ func NewDatabaseWithFreezer(db ethdb.KeyValueStore, freezer string, namespace st
 
 	return &freezerdb{
 		KeyValueStore: db,
-		AncientStore:  frdb,
+		freezer:       frdb,
 	}, nil
 }
 
@@ -230,20 +295,9 @@ func InspectDatabase(db ethdb.Database) error {
 		logged = time.Now()
 
 		// Key-value store statistics
-		total           common.StorageSize
-		headerSize      common.StorageSize
-		bodySize        common.StorageSize
-		receiptSize     common.StorageSize
-		tdSize          common.StorageSize
-		numHashPairing  common.StorageSize
-		hashNumPairing  common.StorageSize
-		trieSize        common.StorageSize
-		txlookupSize    common.StorageSize
-		accountSnapSize common.StorageSize
-		storageSnapSize common.StorageSize
-		preimageSize    common.StorageSize
-		bloomBitsSize   common.StorageSize
-		cliqueSnapsSize common.StorageSize
+		total    common.StorageSize
+		sizes    = make(map[*KeyPrefix]common.StorageSize)
+		trieSize common.StorageSize
 
 		// Ancient store statistics
 		ancientHeaders  common.StorageSize
@@ -252,10 +306,6 @@ func InspectDatabase(db ethdb.Database) error {
 		ancientHashes   common.StorageSize
 		ancientTds      common.StorageSize
 
-		// Les statistic
-		chtTrieNodes   common.StorageSize
-		bloomTrieNodes common.StorageSize
-
 		// Meta- and unaccounted data
 		metadata    common.StorageSize
 		unaccounted common.StorageSize
@@ -267,35 +317,9 @@ func InspectDatabase(db ethdb.Database) error {
 			size = common.StorageSize(len(key) + len(it.Value()))
 		)
 		total += size
-		switch {
-		case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, headerTDSuffix):
-			tdSize += size
-		case bytes.HasPrefix(key, headerPrefix) && bytes.HasSuffix(key, headerHashSuffix):
-			numHashPairing += size
-		case bytes.HasPrefix(key, headerPrefix) && len(key) == (len(headerPrefix)+8+common.HashLength):
-			headerSize += size
-		case bytes.HasPrefix(key, headerNumberPrefix) && len(key) == (len(headerNumberPrefix)+common.HashLength):
-			hashNumPairing += size
-		case bytes.HasPrefix(key, blockBodyPrefix) && len(key) == (len(blockBodyPrefix)+8+common.HashLength):
-			bodySize += size
-		case bytes.HasPrefix(key, blockReceiptsPrefix) && len(key) == (len(blockReceiptsPrefix)+8+common.HashLength):
-			receiptSize += size
-		case bytes.HasPrefix(key, txLookupPrefix) && len(key) == (len(txLookupPrefix)+common.HashLength):
-			txlookupSize += size
-		case bytes.HasPrefix(key, SnapshotAccountPrefix) && len(key) == (len(SnapshotAccountPrefix)+common.HashLength):
-			accountSnapSize += size
-		case bytes.HasPrefix(key, SnapshotStoragePrefix) && len(key) == (len(SnapshotStoragePrefix)+2*common.HashLength):
-			storageSnapSize += size
-		case bytes.HasPrefix(key, preimagePrefix) && len(key) == (len(preimagePrefix)+common.HashLength):
-			preimageSize += size
-		case bytes.HasPrefix(key, bloomBitsPrefix) && len(key) == (len(bloomBitsPrefix)+10+common.HashLength):
-			bloomBitsSize += size
-		case bytes.HasPrefix(key, []byte("clique-")) && len(key) == 7+common.HashLength:
-			cliqueSnapsSize += size
-		case bytes.HasPrefix(key, []byte("cht-")) && len(key) == 4+common.HashLength:
-			chtTrieNodes += size
-		case bytes.HasPrefix(key, []byte("blt-")) && len(key) == 4+common.HashLength:
-			bloomTrieNodes += size
+		switch prefix := LookupKeyPrefix(key); {
+		case prefix != nil:
+			sizes[prefix] += size
 		case len(key) == common.HashLength:
 			trieSize += size
 		default:
@@ -326,28 +350,25 @@ func InspectDatabase(db ethdb.Database) error {
 		}
 	}
 	// Display the database statistic.
-	stats := [][]string{
-		{"Key-Value store", "Headers", headerSize.String()},
-		{"Key-Value store", "Bodies", bodySize.String()},
-		{"Key-Value store", "Receipts", receiptSize.String()},
-		{"Key-Value store", "Difficulties", tdSize.String()},
-		{"Key-Value store", "Block number->hash", numHashPairing.String()},
-		{"Key-Value store", "Block hash->number", hashNumPairing.String()},
-		{"Key-Value store", "Transaction index", txlookupSize.String()},
-		{"Key-Value store", "Bloombit index", bloomBitsSize.String()},
+	var stats [][]string
+	for _, prefix := range KeyPrefixes {
+		if prefix.Group == "Key-Value store" {
+			stats = append(stats, []string{prefix.Group, prefix.Name, sizes[prefix].String()})
+		}
+	}
+	stats = append(stats, [][]string{
 		{"Key-Value store", "Trie nodes", trieSize.String()},
-		{"Key-Value store", "Trie preimages", preimageSize.String()},
-		{"Key-Value store", "Account snapshot", accountSnapSize.String()},
-		{"Key-Value store", "Storage snapshot", storageSnapSize.String()},
-		{"Key-Value store", "Clique snapshots", cliqueSnapsSize.String()},
 		{"Key-Value store", "Singleton metadata", metadata.String()},
 		{"Ancient store", "Headers", ancientHeaders.String()},
 		{"Ancient store", "Bodies", ancientBodies.String()},
 		{"Ancient store", "Receipts", ancientReceipts.String()},
 		{"Ancient store", "Difficulties", ancientTds.String()},
 		{"Ancient store", "Block number->hash", ancientHashes.String()},
-		{"Light client", "CHT trie nodes", chtTrieNodes.String()},
-		{"Light client", "Bloom trie nodes", bloomTrieNodes.String()},
+	}...)
+	for _, prefix := range KeyPrefixes {
+		if prefix.Group != "Key-Value store" {
+			stats = append(stats, []string{prefix.Group, prefix.Name, sizes[prefix].String()})
+		}
 	}
 	table := tablewriter.NewWriter(os.Stdout)
 	table.SetHeader([]string{"Database", "Category", "Size"})
@@ -360,3 +381,97 @@ func InspectDatabase(db ethdb.Database) error {
 	}
 	return nil
 }
+
+// ancientCategories are the categories of the ancient store, along with their
+// human readable names.
+var ancientCategories = []struct{ name, kind string }{
+	{"Headers", freezerHeaderTable},
+	{"Bodies", freezerBodiesTable},
+	{"Receipts", freezerReceiptTable},
+	{"Difficulties", freezerDifficultyTable},
+	{"Block number->hash", freezerHashTable},
+}
+
+// InspectAncients reports the stored and decoded sizes of the given range of
+// items in all the ancient categories, allowing the evaluation of the freezer
+// compression. A zero count covers all the items after the starting one.
+func InspectAncients(db ethdb.Database, start, count uint64) error {
+	maintainer, ok := db.(ethdb.AncientMaintainer)
+	if !ok {
+		return errNotSupported
+	}
+	frozen, err := db.Ancients()
+	if err != nil {
+		return err
+	}
+	if start >= frozen {
+		return fmt.Errorf("start item #%d beyond the ancient store (%d items)", start, frozen)
+	}
+	if count == 0 || count > frozen-start {
+		count = frozen - start
+	}
+	var (
+		stats                     [][]string
+		totalStored, totalDecoded common.StorageSize
+	)
+	for _, category := range ancientCategories {
+		stored, decoded, err := maintainer.AncientSizes(category.kind, start, count)
+		if err != nil {
+			return fmt.Errorf("failed to inspect %s: %v", category.kind, err)
+		}
+		ratio := "-"
+		if stored > 0 {
+			ratio = fmt.Sprintf("%.2f", float64(decoded)/float64(stored))
+		}
+		stats = append(stats, []string{category.name, common.StorageSize(stored).String(), common.StorageSize(decoded).String(), ratio})
+
+		totalStored += common.StorageSize(stored)
+		totalDecoded += common.StorageSize(decoded)
+	}
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetHeader([]string{"Category", "Stored", "Decoded", "Ratio"})
+	table.SetFooter([]string{"Total", totalStored.String(), totalDecoded.String(), ""})
+	table.AppendBulk(stats)
+	table.Render()
+
+	log.Info("Inspected ancient items", "start", start, "count", count)
+	return nil
+}
+
+// CompactAncients reclaims the space of the deleted items in all the ancient
+// categories, returning the total number of bytes freed.
+func CompactAncients(db ethdb.Database) (common.StorageSize, error) {
+	maintainer, ok := db.(ethdb.AncientMaintainer)
+	if !ok {
+		return 0, errNotSupported
+	}
+	var total common.StorageSize
+	for _, category := range ancientCategories {
+		start := time.Now()
+		freed, err := maintainer.CompactAncients(category.kind)
+		if err != nil {
+			return total, fmt.Errorf("failed to compact %s: %v", category.kind, err)
+		}
+		total += common.StorageSize(freed)
+		log.Info("Compacted ancient category", "category", category.name, "freed", common.StorageSize(freed), "elapsed", common.PrettyDuration(time.Since(start)))
+	}
+	return total, nil
+}
+
+// RechunkAncients rewrites the files of all the ancient categories into files
+// of the given maximum size. An interrupted re-chunking is continued by calling
+// it again with the same size.
+func RechunkAncients(db ethdb.Database, maxFileSize uint32) error {
+	maintainer, ok := db.(ethdb.AncientMaintainer)
+	if !ok {
+		return errNotSupported
+	}
+	for _, category := range ancientCategories {
+		start := time.Now()
+		if err := maintainer.RechunkAncients(category.kind, maxFileSize); err != nil {
+			return fmt.Errorf("failed to re-chunk %s: %v", category.kind, err)
+		}
+		log.Info("Re-chunked ancient category", "category", category.name, "elapsed", common.PrettyDuration(time.Since(start)))
+	}
+	return nil
+}
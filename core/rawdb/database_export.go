@@ -0,0 +1,317 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// exportVersion is the version of the database export format.
+	exportVersion = 1
+
+	exportManifestFile = "manifest.json" // File of the export manifest
+	exportEntriesFile  = "entries.rlp"   // File of the exported key-value entries
+	exportAncientDir   = "ancient"       // Directory of the exported freezer
+)
+
+var (
+	// errExportNoFreezer is returned if the ancients are requested to be exported
+	// from a database without a freezer.
+	errExportNoFreezer = errors.New("database has no freezer")
+
+	// errImportNotEmpty is returned if an export is imported into a database
+	// already containing a chain.
+	errImportNotEmpty = errors.New("target database not empty")
+)
+
+// ExportManifest describes the content of a database export.
+type ExportManifest struct {
+	Version         uint64          `json:"version"`         // Version of the export format
+	DatabaseVersion *uint64         `json:"databaseVersion"` // Schema version of the exported database, nil if unset
+	Prefixes        []hexutil.Bytes `json:"prefixes"`        // Key prefixes of the exported entries, empty for all
+	Entries         uint64          `json:"entries"`         // Number of exported key-value entries
+	Tables          []string        `json:"tables"`          // Freezer tables of the exported ancients, empty if none
+	Ancients        uint64          `json:"ancients"`        // Number of exported ancient items, zero if none
+	FirstBlock      uint64          `json:"firstBlock"`      // Number of the first block covered by the export
+	HeadNumber      uint64          `json:"headNumber"`      // Number of the head block
+	HeadHash        common.Hash     `json:"headHash"`        // Hash of the head block
+	StateRoot       common.Hash     `json:"stateRoot"`       // State root of the head block
+}
+
+// exportEntry is a key-value entry of a database export.
+type exportEntry struct {
+	Key   []byte
+	Value []byte
+}
+
+// hasExportPrefix reports whether the key is covered by any of the prefixes,
+// an empty prefix list covering all keys.
+func hasExportPrefix(key []byte, prefixes []hexutil.Bytes) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportDatabase writes the key-value entries with the given prefixes (all of
+// them if none given) into dir, which must be empty or non-existent, along with
+// the given freezer tables and a manifest describing the export.
+//
+// The key-value entries are read through a single iterator, which is a point in
+// time view of the store. It's opened before the freezer is exported, so the
+// items frozen in the meantime are exported twice instead of being lost. The
+// manifest is filled from the same view, regardless of the prefixes exported.
+func ExportDatabase(db ethdb.Database, dir string, prefixes [][]byte, tables []string) (*ExportManifest, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		return nil, err
+	} else if len(files) > 0 {
+		return nil, errExportNotEmpty
+	}
+	manifest := &ExportManifest{
+		Version: exportVersion,
+	}
+	for _, prefix := range prefixes {
+		manifest.Prefixes = append(manifest.Prefixes, common.CopyBytes(prefix))
+	}
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+
+	if len(tables) > 0 {
+		frdb, ok := db.(*freezerdb)
+		if !ok {
+			return nil, errExportNoFreezer
+		}
+		frozen, err := frdb.Export(filepath.Join(dir, exportAncientDir), tables)
+		if err != nil {
+			return nil, err
+		}
+		manifest.Tables = append([]string{}, tables...)
+		sort.Strings(manifest.Tables)
+		manifest.Ancients = frozen
+	} else if frozen, err := db.Ancients(); err == nil {
+		// The blocks frozen after the iterator was opened are still included in
+		// the key-value entries, those before are left out
+		manifest.FirstBlock = frozen
+	}
+	// Stream the selected key-value entries into the export
+	file, err := os.OpenFile(filepath.Join(dir, exportEntriesFile), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	for it.Next() {
+		manifest.track(it.Key(), it.Value())
+		if !hasExportPrefix(it.Key(), manifest.Prefixes) {
+			continue
+		}
+		if err := rlp.Encode(writer, &exportEntry{Key: it.Key(), Value: it.Value()}); err != nil {
+			return nil, err
+		}
+		manifest.Entries++
+	}
+	if err := it.Error(); err != nil {
+		return nil, err
+	}
+	if err := writer.Flush(); err != nil {
+		return nil, err
+	}
+	if err := file.Sync(); err != nil {
+		return nil, err
+	}
+	// Write the manifest last, its presence marks the export complete
+	blob, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, exportManifestFile), blob, 0644); err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+// track fills the manifest from an entry of the exported store. The entries must
+// be tracked in key order, the head block hash preceding the head header.
+func (m *ExportManifest) track(key, value []byte) {
+	switch {
+	case bytes.Equal(key, databaseVerisionKey):
+		var version uint64
+		if err := rlp.DecodeBytes(value, &version); err == nil {
+			m.DatabaseVersion = &version
+		}
+	case bytes.Equal(key, headBlockKey):
+		m.HeadHash = common.BytesToHash(value)
+
+	case len(key) == len(headerPrefix)+8+common.HashLength && bytes.HasPrefix(key, headerPrefix):
+		if m.HeadHash == (common.Hash{}) || !bytes.Equal(key[len(key)-common.HashLength:], m.HeadHash[:]) {
+			return
+		}
+		header := new(types.Header)
+		if err := rlp.DecodeBytes(value, header); err == nil {
+			m.HeadNumber = header.Number.Uint64()
+			m.StateRoot = header.Root
+		}
+	}
+}
+
+// ReadExportManifest reads the manifest of the database export in dir.
+func ReadExportManifest(dir string) (*ExportManifest, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(dir, exportManifestFile))
+	if err != nil {
+		return nil, err
+	}
+	manifest := new(ExportManifest)
+	if err := json.Unmarshal(blob, manifest); err != nil {
+		return nil, fmt.Errorf("invalid export manifest: %v", err)
+	}
+	if manifest.Version != exportVersion {
+		return nil, fmt.Errorf("unsupported export version %d, want %d", manifest.Version, exportVersion)
+	}
+	return manifest, nil
+}
+
+// ImportDatabase imports the database export in dir into the given key-value
+// store, and its ancients (if any) into the freezer directory ancient, which must
+// be empty or non-existent. The freezer must not be opened before the import is
+// done, while the key-value store must not contain a chain yet. The ancients can
+// only be imported if all the freezer tables were exported.
+//
+// The imported entries are validated against the manifest of the export, as far
+// as they were exported. The consistency of the freezer with the key-value store
+// is checked once they are opened together.
+func ImportDatabase(db ethdb.KeyValueStore, ancient string, dir string) (*ExportManifest, error) {
+	manifest, err := ReadExportManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	if ReadHeadHeaderHash(db) != (common.Hash{}) {
+		return nil, errImportNotEmpty
+	}
+	if len(manifest.Tables) > 0 {
+		for _, table := range FreezerTables() {
+			if i := sort.SearchStrings(manifest.Tables, table); i == len(manifest.Tables) || manifest.Tables[i] != table {
+				return nil, fmt.Errorf("freezer table %s not exported", table)
+			}
+		}
+		if err := importAncients(filepath.Join(dir, exportAncientDir), ancient); err != nil {
+			return nil, err
+		}
+	}
+	// Import the key-value entries in batches
+	file, err := os.Open(filepath.Join(dir, exportEntriesFile))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var (
+		stream  = rlp.NewStream(bufio.NewReader(file), 0)
+		batch   = db.NewBatch()
+		entries uint64
+	)
+	for {
+		var entry exportEntry
+		if err := stream.Decode(&entry); err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, fmt.Errorf("invalid entry %d: %v", entries, err)
+		}
+		if !hasExportPrefix(entry.Key, manifest.Prefixes) {
+			return nil, fmt.Errorf("entry %d key %x outside of the exported prefixes", entries, entry.Key)
+		}
+		if err := batch.Put(entry.Key, entry.Value); err != nil {
+			return nil, err
+		}
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				return nil, err
+			}
+			batch.Reset()
+		}
+		entries++
+	}
+	if err := batch.Write(); err != nil {
+		return nil, err
+	}
+	// Ensure the import matches the manifest
+	if entries != manifest.Entries {
+		return nil, fmt.Errorf("imported entries mismatch: have %d, want %d", entries, manifest.Entries)
+	}
+	if hasExportPrefix(databaseVerisionKey, manifest.Prefixes) {
+		if version := ReadDatabaseVersion(db); (version == nil) != (manifest.DatabaseVersion == nil) || (version != nil && *version != *manifest.DatabaseVersion) {
+			return nil, fmt.Errorf("imported database version mismatch: have %v, want %v", version, manifest.DatabaseVersion)
+		}
+	}
+	if hasExportPrefix(headBlockKey, manifest.Prefixes) {
+		if head := ReadHeadBlockHash(db); head != manifest.HeadHash {
+			return nil, fmt.Errorf("imported head block mismatch: have %x, want %x", head, manifest.HeadHash)
+		}
+	}
+	return manifest, nil
+}
+
+// importAncients copies the exported freezer files from src into the directory
+// dst, which must be empty or non-existent.
+func importAncients(src, dst string) error {
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	if files, err := ioutil.ReadDir(dst); err != nil {
+		return err
+	} else if len(files) > 0 {
+		return fmt.Errorf("ancient directory not empty: %s", dst)
+	}
+	files, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !file.Mode().IsRegular() {
+			continue
+		}
+		if err := copyFreezerFile(filepath.Join(dst, file.Name()), filepath.Join(src, file.Name()), -1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
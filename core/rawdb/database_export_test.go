@@ -0,0 +1,132 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+)
+
+// Tests that a database can be exported along with its freezer and imported on
+// a fresh node, and that inconsistent imports are rejected.
+func TestDatabaseExportImport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a database with two frozen blocks and a live head block
+	src, err := NewDatabaseWithFreezer(NewMemoryDatabase(), filepath.Join(dir, "src"), "")
+	if err != nil {
+		t.Fatalf("failed to create database: %v", err)
+	}
+	defer src.Close()
+
+	var (
+		blocks []*types.Block
+		parent common.Hash
+	)
+	for i := 0; i < 3; i++ {
+		block := types.NewBlockWithHeader(&types.Header{
+			Number:      big.NewInt(int64(i)),
+			ParentHash:  parent,
+			Root:        common.Hash{byte(i + 1)},
+			Difficulty:  big.NewInt(10),
+			UncleHash:   types.EmptyUncleHash,
+			TxHash:      types.EmptyRootHash,
+			ReceiptHash: types.EmptyRootHash,
+		})
+		blocks, parent = append(blocks, block), block.Hash()
+	}
+	for _, block := range blocks[:2] {
+		if _, err := writeAncientBlock(src, block, nil, big.NewInt(10)); err != nil {
+			t.Fatalf("failed to freeze block: %v", err)
+		}
+	}
+	WriteBlock(src, blocks[2])
+	WriteCanonicalHash(src, blocks[2].Hash(), 2)
+	WriteHeadHeaderHash(src, blocks[2].Hash())
+	WriteHeadBlockHash(src, blocks[2].Hash())
+	WriteDatabaseVersion(src, 7)
+
+	// Export everything and ensure the manifest describes it
+	manifest, err := ExportDatabase(src, filepath.Join(dir, "export"), nil, FreezerTables())
+	if err != nil {
+		t.Fatalf("failed to export database: %v", err)
+	}
+	if manifest.Ancients != 2 || manifest.FirstBlock != 0 || manifest.HeadNumber != 2 || manifest.HeadHash != blocks[2].Hash() || manifest.StateRoot != blocks[2].Root() {
+		t.Fatalf("manifest mismatch: %+v", manifest)
+	}
+	if _, err := ExportDatabase(src, filepath.Join(dir, "export"), nil, FreezerTables()); err != errExportNotEmpty {
+		t.Fatalf("export into used directory error mismatch: have %v, want %v", err, errExportNotEmpty)
+	}
+	// Import the export into a fresh database and ensure the chain is intact
+	kvdb := NewMemoryDatabase()
+	if _, err := ImportDatabase(kvdb, filepath.Join(dir, "dst"), filepath.Join(dir, "export")); err != nil {
+		t.Fatalf("failed to import database: %v", err)
+	}
+	dst, err := NewDatabaseWithFreezer(kvdb, filepath.Join(dir, "dst"), "")
+	if err != nil {
+		t.Fatalf("failed to open imported database: %v", err)
+	}
+	defer dst.Close()
+
+	for i, block := range blocks {
+		if have := ReadBlock(dst, block.Hash(), uint64(i)); have == nil || have.Hash() != block.Hash() {
+			t.Fatalf("block %d: imported block mismatch: %v", i, have)
+		}
+	}
+	if version := ReadDatabaseVersion(dst); version == nil || *version != 7 {
+		t.Fatalf("imported database version mismatch: %v", version)
+	}
+	if _, err := ImportDatabase(kvdb, filepath.Join(dir, "again"), filepath.Join(dir, "export")); err != errImportNotEmpty {
+		t.Fatalf("import into used database error mismatch: have %v, want %v", err, errImportNotEmpty)
+	}
+	// Export a subset of the entries lacking the chain head and ensure it's still
+	// described by the manifest and can be imported
+	manifest, err = ExportDatabase(src, filepath.Join(dir, "partial"), [][]byte{databaseVerisionKey}, nil)
+	if err != nil {
+		t.Fatalf("failed to export database subset: %v", err)
+	}
+	if manifest.Entries != 1 || manifest.Ancients != 0 || manifest.FirstBlock != 2 || manifest.HeadHash != blocks[2].Hash() || manifest.HeadNumber != 2 {
+		t.Fatalf("subset manifest mismatch: %+v", manifest)
+	}
+	partial := NewMemoryDatabase()
+	if _, err := ImportDatabase(partial, filepath.Join(dir, "none"), filepath.Join(dir, "partial")); err != nil {
+		t.Fatalf("failed to import database subset: %v", err)
+	}
+	if version := ReadDatabaseVersion(partial); version == nil || *version != 7 {
+		t.Fatalf("imported subset database version mismatch: %v", version)
+	}
+	// Export a subset of the freezer tables and ensure it's rejected on import
+	if _, err := ExportDatabase(src, filepath.Join(dir, "headers"), nil, []string{freezerHeaderTable}); err != nil {
+		t.Fatalf("failed to export freezer table subset: %v", err)
+	}
+	if _, err := ImportDatabase(NewMemoryDatabase(), filepath.Join(dir, "incomplete"), filepath.Join(dir, "headers")); err == nil {
+		t.Fatalf("incomplete freezer import accepted")
+	}
+	if _, err := ExportDatabase(src, filepath.Join(dir, "unknown"), nil, []string{"unknown"}); err == nil {
+		t.Fatalf("unknown freezer table exported")
+	}
+}
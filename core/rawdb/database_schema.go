@@ -0,0 +1,162 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+const (
+	// SchemaVersion is the version of the database schema written by this binary.
+	SchemaVersion = 1
+
+	// FreezerLayoutVersion is the newest version of the freezer table layout
+	// supported by this binary. Version 2 stores the small items in the table
+	// indexes.
+	FreezerLayoutVersion = 2
+)
+
+// Optional features whose data might be present in the database.
+const (
+	FeatureSnapshot    uint64 = 1 << iota // Persistent state snapshot
+	FeatureLogIndex                       // Address and topic index of the canonical logs
+	FeatureInlineIndex                    // Small freezer items stored in the table indexes
+)
+
+// schemaFeature describes an optional database feature in the compatibility
+// matrix.
+type schemaFeature struct {
+	name    string // Human readable name of the feature
+	since   uint64 // Oldest schema version able to handle the feature's data
+	freezer uint64 // Oldest freezer layout version able to handle the feature's data
+}
+
+// schemaFeatures is the compatibility matrix of the features known to this
+// binary, defining the oldest schema version which can safely open a database
+// containing them.
+var schemaFeatures = map[uint64]schemaFeature{
+	FeatureSnapshot:    {name: "snapshot", since: 1, freezer: 1},
+	FeatureLogIndex:    {name: "log index", since: 1, freezer: 1},
+	FeatureInlineIndex: {name: "inline freezer index", since: 1, freezer: 2},
+}
+
+// DatabaseSchema is the schema record stored in the database, describing the
+// layout it was written with.
+type DatabaseSchema struct {
+	Version    uint64 // Newest schema version the database was opened with
+	Compatible uint64 // Oldest schema version able to open the database
+	Features   uint64 // Optional features present in the database
+	Freezer    uint64 // Layout version of the freezer tables
+}
+
+// ReadDatabaseSchema retrieves the schema record of the database.
+func ReadDatabaseSchema(db ethdb.KeyValueReader) *DatabaseSchema {
+	enc, _ := db.Get(databaseSchemaKey)
+	if len(enc) == 0 {
+		return nil
+	}
+	schema := new(DatabaseSchema)
+	if err := rlp.DecodeBytes(enc, schema); err != nil {
+		log.Error("Invalid database schema RLP", "err", err)
+		return nil
+	}
+	return schema
+}
+
+// WriteDatabaseSchema stores the schema record of the database.
+func WriteDatabaseSchema(db ethdb.KeyValueWriter, schema *DatabaseSchema) {
+	enc, err := rlp.EncodeToBytes(schema)
+	if err != nil {
+		log.Crit("Failed to encode database schema", "err", err)
+	}
+	if err := db.Put(databaseSchemaKey, enc); err != nil {
+		log.Crit("Failed to store database schema", "err", err)
+	}
+}
+
+// featureNames returns the human readable names of the features in the set,
+// falling back to the raw flag for the ones unknown to this binary.
+func featureNames(features uint64) string {
+	var names []string
+	for i := uint(0); i < 64; i++ {
+		flag := uint64(1) << i
+		if features&flag == 0 {
+			continue
+		}
+		if feature, ok := schemaFeatures[flag]; ok {
+			names = append(names, feature.name)
+		} else {
+			names = append(names, fmt.Sprintf("unknown(%#x)", flag))
+		}
+	}
+	return strings.Join(names, ", ")
+}
+
+// ValidateSchema checks that the database is compatible with this binary and
+// records the features about to be used in it.
+//
+// Databases without a schema record are assumed to be written by a binary
+// predating the record and are accepted as is. Databases written by newer
+// binaries are accepted as long as they declare themselves compatible with the
+// schema version of this binary, otherwise an error is returned detailing which
+// binaries can open the database. The freezer layout is only raised above the
+// legacy one if a feature needing it is used. The stored record is only ever
+// upgraded, so a database keeps the strictest requirements it was opened with.
+func ValidateSchema(db ethdb.KeyValueStore, features uint64) error {
+	stored := ReadDatabaseSchema(db)
+	missing := stored == nil
+	if missing {
+		stored = &DatabaseSchema{Compatible: 1, Freezer: 1}
+	}
+	if stored.Compatible > SchemaVersion {
+		return fmt.Errorf("database schema v%d (features: %s) requires a binary supporting schema v%d or newer, this binary supports v%d; upgrade the binary or resync into a new datadir",
+			stored.Version, featureNames(stored.Features), stored.Compatible, SchemaVersion)
+	}
+	if stored.Freezer > FreezerLayoutVersion {
+		return fmt.Errorf("freezer layout v%d is newer than the supported v%d; upgrade the binary or resync into a new ancient datadir", stored.Freezer, FreezerLayoutVersion)
+	}
+	if stored.Version > SchemaVersion {
+		log.Warn("Opening database written by a newer binary", "schema", stored.Version, "supported", SchemaVersion, "compatible", stored.Compatible)
+	}
+	// Database is compatible, record the features about to be used in it
+	updated := *stored
+	if updated.Version < SchemaVersion {
+		updated.Version = SchemaVersion
+	}
+	updated.Features |= features
+	for flag, feature := range schemaFeatures {
+		if features&flag == 0 {
+			continue
+		}
+		if updated.Compatible < feature.since {
+			updated.Compatible = feature.since
+		}
+		if updated.Freezer < feature.freezer {
+			updated.Freezer = feature.freezer
+		}
+	}
+	if missing || updated != *stored {
+		log.Info("Upgraded database schema", "version", updated.Version, "compatible", updated.Compatible, "features", featureNames(updated.Features))
+		WriteDatabaseSchema(db, &updated)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import "testing"
+
+// Tests that the schema record is created, upgraded and validated against the
+// running binary.
+func TestValidateSchema(t *testing.T) {
+	db := NewMemoryDatabase()
+
+	// A database without schema record should be accepted and stamped
+	if err := ValidateSchema(db, FeatureSnapshot); err != nil {
+		t.Fatalf("failed to validate fresh database: %v", err)
+	}
+	want := DatabaseSchema{Version: SchemaVersion, Compatible: 1, Features: FeatureSnapshot, Freezer: 1}
+	if have := ReadDatabaseSchema(db); have == nil || *have != want {
+		t.Fatalf("schema mismatch: have %+v, want %+v", have, want)
+	}
+	// Additional features should be merged into the record
+	if err := ValidateSchema(db, FeatureLogIndex); err != nil {
+		t.Fatalf("failed to validate database: %v", err)
+	}
+	want.Features |= FeatureLogIndex
+	if have := ReadDatabaseSchema(db); *have != want {
+		t.Fatalf("schema mismatch: have %+v, want %+v", have, want)
+	}
+	// Features changing the freezer layout should raise the recorded layout
+	if err := ValidateSchema(db, FeatureInlineIndex); err != nil {
+		t.Fatalf("failed to validate database: %v", err)
+	}
+	want.Features |= FeatureInlineIndex
+	want.Freezer = FreezerLayoutVersion
+	if have := ReadDatabaseSchema(db); *have != want {
+		t.Fatalf("schema mismatch: have %+v, want %+v", have, want)
+	}
+	// A newer database declaring itself compatible should be accepted untouched
+	newer := DatabaseSchema{Version: SchemaVersion + 1, Compatible: SchemaVersion, Features: 1 << 63, Freezer: FreezerLayoutVersion}
+	WriteDatabaseSchema(db, &newer)
+	if err := ValidateSchema(db, 0); err != nil {
+		t.Fatalf("failed to validate compatible newer database: %v", err)
+	}
+	if have := ReadDatabaseSchema(db); *have != newer {
+		t.Fatalf("schema mismatch: have %+v, want %+v", have, newer)
+	}
+	// Incompatible schemas and freezer layouts should be rejected
+	WriteDatabaseSchema(db, &DatabaseSchema{Version: SchemaVersion + 1, Compatible: SchemaVersion + 1, Freezer: FreezerLayoutVersion})
+	if err := ValidateSchema(db, 0); err == nil {
+		t.Fatalf("incompatible schema accepted")
+	}
+	WriteDatabaseSchema(db, &DatabaseSchema{Version: SchemaVersion, Compatible: SchemaVersion, Freezer: FreezerLayoutVersion + 1})
+	if err := ValidateSchema(db, 0); err == nil {
+		t.Fatalf("incompatible freezer layout accepted")
+	}
+}
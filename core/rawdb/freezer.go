@@ -22,6 +22,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -74,16 +75,41 @@ type freezer struct {
 	tables       map[string]*freezerTable // Data tables for storing everything
 	instanceLock fileutil.Releaser        // File-system lock to prevent double opens
 	quit         chan struct{}
+
+	appendLock sync.Mutex   // Lock held by appends, taken by exports to record a consistent extent
+	exportLock sync.RWMutex // Lock held by exports and re-chunkings, read-locked by the table rewrites (truncation, compaction)
+	freezeLock sync.Mutex   // Lock held by the freeze loop per batch and by backfills, serializing the writers of new blocks
+
+	validators  map[string][]ethdb.AppendValidator // Checks run on the items before appending them, protected by appendLock
+	rejectMeter metrics.Meter                      // Meter for the blocks rejected by the validators
+
+	checkMeter   metrics.Meter // Meter for the items read back by the integrity checks
+	corruptMeter metrics.Meter // Meter for the data files found corrupted by the integrity checks
 }
 
 // newFreezer creates a chain freezer that moves ancient chain data into
 // append-only flat file containers.
-func newFreezer(datadir string, namespace string) (*freezer, error) {
+//
+// The number of data files each table keeps open is capped by the configured
+// limit, with the sealed ones being opened on demand. Zero means unlimited.
+//
+// If migration is enabled, tables stored in a format other than the configured
+// one are converted before being opened.
+//
+// The integrity of the tables is checked on open, only sampling the items unless
+// the full check is requested, in which case all of them are verified.
+//
+// If cache dropping is enabled, the flushed table data is evicted from the OS
+// page cache to avoid crowding out the hot data of the key-value store.
+func newFreezer(datadir string, namespace string, config FreezerConfig) (*freezer, error) {
 	// Create the initial freezer object
 	var (
-		readMeter  = metrics.NewRegisteredMeter(namespace+"ancient/read", nil)
-		writeMeter = metrics.NewRegisteredMeter(namespace+"ancient/write", nil)
-		sizeGauge  = metrics.NewRegisteredGauge(namespace+"ancient/size", nil)
+		readMeter   = metrics.NewRegisteredMeter(namespace+"ancient/read", nil)
+		writeMeter  = metrics.NewRegisteredMeter(namespace+"ancient/write", nil)
+		sizeGauge   = metrics.NewRegisteredGauge(namespace+"ancient/size", nil)
+		openMeter   = metrics.NewRegisteredMeter(namespace+"ancient/file/open", nil)
+		closeMeter  = metrics.NewRegisteredMeter(namespace+"ancient/file/close", nil)
+		rejectMeter = metrics.NewRegisteredMeter(namespace+"ancient/rejected", nil)
 	)
 	// Ensure the datadir is not a symbolic link if it exists.
 	if info, err := os.Lstat(datadir); !os.IsNotExist(err) {
@@ -103,9 +129,35 @@ func newFreezer(datadir string, namespace string) (*freezer, error) {
 		tables:       make(map[string]*freezerTable),
 		instanceLock: lock,
 		quit:         make(chan struct{}),
+		validators:   make(map[string][]ethdb.AppendValidator),
+		rejectMeter:  rejectMeter,
+		checkMeter:   metrics.NewRegisteredMeter(namespace+"ancient/check/items", nil),
+		corruptMeter: metrics.NewRegisteredMeter(namespace+"ancient/check/corrupt", nil),
+	}
+	for name, validators := range freezerValidators {
+		freezer.validators[name] = append([]ethdb.AppendValidator{}, validators...)
 	}
 	for name, disableSnappy := range freezerNoSnappy {
-		table, err := newTable(datadir, name, readMeter, writeMeter, sizeGauge, disableSnappy)
+		// Storing items in the indexes is opt-in, as older binaries can't read them
+		var inline int
+		if config.InlineIndex {
+			inline = freezerInlineLimit[name]
+		}
+		if config.Migrate {
+			if err := migrateTable(datadir, name, freezerTableSize, disableSnappy, inline); err != nil {
+				for _, table := range freezer.tables {
+					table.Close()
+				}
+				lock.Release()
+				return nil, fmt.Errorf("failed to migrate table %s: %v", name, err)
+			}
+		}
+		table, err := newTable(datadir, name, readMeter, writeMeter, sizeGauge, disableSnappy, config.syncPolicy(name), inline)
+		if err == nil && config.MaxOpenFiles > 0 {
+			if err = table.limitOpenFiles(config.MaxOpenFiles, openMeter, closeMeter); err != nil {
+				table.Close()
+			}
+		}
 		if err != nil {
 			for _, table := range freezer.tables {
 				table.Close()
@@ -113,8 +165,22 @@ func newFreezer(datadir string, namespace string) (*freezer, error) {
 			lock.Release()
 			return nil, err
 		}
+		table.setDropCache(config.DropCache)
 		freezer.tables[name] = table
 	}
+	// Replace the persisted retention of the block history if requested
+	if config.HistoryRetention != nil {
+		for _, name := range []string{freezerBodiesTable, freezerReceiptTable} {
+			if err := freezer.tables[name].setRetention(*config.HistoryRetention); err != nil {
+				for _, table := range freezer.tables {
+					table.Close()
+				}
+				lock.Release()
+				return nil, err
+			}
+		}
+		log.Info("Configured ancient history retention", "blocks", config.HistoryRetention.Items, "size", common.StorageSize(config.HistoryRetention.Bytes), "age", config.HistoryRetention.Age)
+	}
 	if err := freezer.repair(); err != nil {
 		for _, table := range freezer.tables {
 			table.Close()
@@ -122,6 +188,13 @@ func newFreezer(datadir string, namespace string) (*freezer, error) {
 		lock.Release()
 		return nil, err
 	}
+	if err := freezer.check(config.FullCheck); err != nil {
+		for _, table := range freezer.tables {
+			table.Close()
+		}
+		lock.Release()
+		return nil, err
+	}
 	log.Info("Opened ancient database", "database", datadir)
 	return freezer, nil
 }
@@ -161,6 +234,53 @@ func (f *freezer) Ancient(kind string, number uint64) ([]byte, error) {
 	return nil, errUnknownTable
 }
 
+// AncientInto retrieves an ancient binary blob into the supplied buffer, growing
+// it if too small. The buffer is never retained by the freezer, so callers on hot
+// paths can reuse a single one across reads.
+func (f *freezer) AncientInto(kind string, number uint64, buf []byte) ([]byte, error) {
+	if table := f.tables[kind]; table != nil {
+		return table.RetrieveInto(number, buf)
+	}
+	return nil, errUnknownTable
+}
+
+// DeleteAncient logically deletes a single item of the specified category, the
+// item is not served anymore, but all the other items are left in place. The
+// space of the deleted items is reclaimed by CompactAncients.
+func (f *freezer) DeleteAncient(kind string, number uint64) error {
+	if table := f.tables[kind]; table != nil {
+		return table.Delete(number)
+	}
+	return errUnknownTable
+}
+
+// CompactAncients rewrites the data files of the specified category containing
+// deleted items, returning the number of bytes reclaimed.
+func (f *freezer) CompactAncients(kind string) (uint64, error) {
+	f.exportLock.RLock()
+	defer f.exportLock.RUnlock()
+
+	if table := f.tables[kind]; table != nil {
+		return table.compact()
+	}
+	return 0, errUnknownTable
+}
+
+// RechunkAncients rewrites the data files of the specified category into files of
+// the given maximum size, which also applies to the files created afterwards. It
+// runs concurrently with the reads and appends, but blocks exports, truncations
+// and compactions until done. An interrupted re-chunking is continued by calling
+// it again with the same size.
+func (f *freezer) RechunkAncients(kind string, maxFileSize uint32) error {
+	f.exportLock.Lock()
+	defer f.exportLock.Unlock()
+
+	if table := f.tables[kind]; table != nil {
+		return table.rechunk(maxFileSize, &f.appendLock)
+	}
+	return errUnknownTable
+}
+
 // Ancients returns the length of the frozen items.
 func (f *freezer) Ancients() (uint64, error) {
 	return atomic.LoadUint64(&f.frozen), nil
@@ -174,17 +294,99 @@ func (f *freezer) AncientSize(kind string) (uint64, error) {
 	return 0, errUnknownTable
 }
 
+// AncientSizes returns the total stored (compressed, if enabled) and decoded
+// sizes of the given range of items in the specified category, allowing the
+// evaluation of the compression effectiveness.
+func (f *freezer) AncientSizes(kind string, start, count uint64) (uint64, uint64, error) {
+	table := f.tables[kind]
+	if table == nil {
+		return 0, 0, errUnknownTable
+	}
+	sizes, err := table.sizes(start, count)
+	if err != nil {
+		return 0, 0, err
+	}
+	var stored, decoded uint64
+	for _, size := range sizes {
+		stored += uint64(size.stored)
+		decoded += uint64(size.decoded)
+	}
+	return stored, decoded, nil
+}
+
+// SetCorruptionHook registers a callback invoked whenever a corrupted data file
+// is detected and quarantined in any of the tables, with the table name and the
+// item that failed to be read. It allows the missing chain segment to be fetched
+// again, after truncating the freezer below the quarantined range.
+func (f *freezer) SetCorruptionHook(hook func(kind string, item uint64, err error)) {
+	for kind, table := range f.tables {
+		kind := kind
+
+		table.lock.Lock()
+		if hook == nil {
+			table.corrupted = nil
+		} else {
+			table.corrupted = func(item uint64, err error) { hook(kind, item, err) }
+		}
+		table.lock.Unlock()
+	}
+}
+
+// SetRetention limits the items served by the specified category to the given
+// policy, the zero policy lifting all limits. The older items are deleted as the
+// freezer grows, in batches, and their space is reclaimed by CompactAncients. The
+// policy is persisted, it stays in effect until replaced.
+func (f *freezer) SetRetention(kind string, policy ethdb.AncientRetention) error {
+	if table := f.tables[kind]; table != nil {
+		return table.setRetention(policy)
+	}
+	return errUnknownTable
+}
+
+// SetRetentionHook registers a callback invoked whenever items are deleted from
+// any of the tables due to its retention policy, with the table name and the
+// first item still served. It allows the consumers of the data to drop anything
+// referencing the deleted items.
+func (f *freezer) SetRetentionHook(hook func(kind string, tail uint64)) {
+	for kind, table := range f.tables {
+		kind := kind
+
+		table.lock.Lock()
+		if hook == nil {
+			table.retention.hook = nil
+		} else {
+			table.retention.hook = func(tail uint64) { hook(kind, tail) }
+		}
+		table.lock.Unlock()
+	}
+}
+
 // AppendAncient injects all binary blobs belong to block at the end of the
 // append-only immutable table files.
 //
-// Notably, this function is lock free but kind of thread-safe. All out-of-order
-// injection will be rejected. But if two injections with same number happen at
-// the same time, we can get into the trouble.
+// Notably, the injections are serialized and all out-of-order injection will be
+// rejected. The appends are only held briefly by a concurrent export. The blobs
+// are checked by the registered validators before any of them is written, an
+// invalid item rejecting the entire block.
 func (f *freezer) AppendAncient(number uint64, hash, header, body, receipts, td []byte) (err error) {
+	f.appendLock.Lock()
+	defer f.appendLock.Unlock()
+
 	// Ensure the binary blobs we are appending is continuous with freezer.
 	if atomic.LoadUint64(&f.frozen) != number {
 		return errOutOrderInsertion
 	}
+	items := map[string][]byte{
+		freezerHashTable:       hash,
+		freezerHeaderTable:     header,
+		freezerBodiesTable:     body,
+		freezerReceiptTable:    receipts,
+		freezerDifficultyTable: td,
+	}
+	if err := f.validate(number, items); err != nil {
+		log.Error("Rejected invalid ancient block", "number", number, "hash", common.BytesToHash(hash), "err", err)
+		return err
+	}
 	// Rollback all inserted data if any insertion below failed to ensure
 	// the tables won't out of sync.
 	defer func() {
@@ -218,11 +420,21 @@ func (f *freezer) AppendAncient(number uint64, hash, header, body, receipts, td
 		return err
 	}
 	atomic.AddUint64(&f.frozen, 1) // Only modify atomically
+
+	// The block is stored, failing to drop old items must not roll it back
+	for kind, table := range f.tables {
+		if err := table.enforceRetention(); err != nil {
+			log.Error("Failed to enforce ancient retention", "kind", kind, "err", err)
+		}
+	}
 	return nil
 }
 
 // Truncate discards any recent data above the provided threshold number.
 func (f *freezer) TruncateAncients(items uint64) error {
+	f.exportLock.RLock()
+	defer f.exportLock.RUnlock()
+
 	if atomic.LoadUint64(&f.frozen) <= items {
 		return nil
 	}
@@ -235,10 +447,14 @@ func (f *freezer) TruncateAncients(items uint64) error {
 	return nil
 }
 
-// sync flushes all data tables to disk.
+// Sync flushes all data tables to disk. The tables flushing every append are
+// already durable, they are skipped.
 func (f *freezer) Sync() error {
 	var errs []error
 	for _, table := range f.tables {
+		if table.sync.mode == syncAlways {
+			continue
+		}
 		if err := table.Sync(); err != nil {
 			errs = append(errs, err)
 		}
@@ -303,7 +519,16 @@ func (f *freezer) freeze(db ethdb.KeyValueStore) {
 			backoff = true
 			continue
 		}
-		// Seems we have data ready to be frozen, process in usable batches
+		// Seems we have data ready to be frozen, hold off any backfill for the
+		// batch. A backfill might have extended the ancient store meanwhile,
+		// so recheck the threshold.
+		f.freezeLock.Lock()
+		if *number-params.ImmutabilityThreshold <= f.frozen {
+			f.freezeLock.Unlock()
+			backoff = true
+			continue
+		}
+		// Process the blocks in usable batches
 		limit := *number - params.ImmutabilityThreshold
 		if limit-f.frozen > freezerBatchLimit {
 			limit = f.frozen + freezerBatchLimit
@@ -389,6 +614,7 @@ func (f *freezer) freeze(db ethdb.KeyValueStore) {
 		if f.frozen-first < freezerBatchLimit {
 			backoff = true
 		}
+		f.freezeLock.Unlock()
 	}
 }
 
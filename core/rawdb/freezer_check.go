@@ -0,0 +1,243 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// checkSamples is the number of randomly picked items of each table the fast
+// integrity check reads back, on top of the ones delimiting the data files.
+const checkSamples = 64
+
+// checkResult summarizes the integrity check of a freezer table.
+type checkResult struct {
+	entries int // Number of index entries verified
+	items   int // Number of items read back
+	corrupt int // Number of data files quarantined
+}
+
+// check verifies the integrity of the table. The fast mode validates the index
+// metadata, the index entries and items delimiting each data file, and a random
+// sample of entries and items. The full mode validates every index entry and
+// reads back every item.
+//
+// Inconsistent index entries and unreadable items quarantine the data file they
+// belong to, so the rest of the table stays accessible. It's meant to be called
+// from an init context, right after the table was repaired.
+func (t *freezerTable) check(full bool, samples int, rng *rand.Rand) (checkResult, error) {
+	var result checkResult
+
+	// Ensure the index metadata matches the tracked items
+	stat, err := t.index.Stat()
+	if err != nil {
+		return result, err
+	}
+	if stat.Size()%t.entrySize != 0 {
+		return result, fmt.Errorf("index size %d not a multiple of %d", stat.Size(), t.entrySize)
+	}
+	entries := uint64(stat.Size()/t.entrySize) - 1
+	if uint64(t.itemOffset)+entries != t.items {
+		return result, fmt.Errorf("index entries mismatch: have %d, want %d", entries, t.items-uint64(t.itemOffset))
+	}
+	if entries == 0 {
+		return result, nil
+	}
+	// Gather the positions to verify, either all or the boundaries and samples
+	var positions []uint64
+	if full {
+		positions = make([]uint64, 0, entries)
+		for pos := uint64(1); pos <= entries; pos++ {
+			positions = append(positions, pos)
+		}
+	} else {
+		seen := make(map[uint64]struct{})
+		add := func(pos uint64) {
+			if _, ok := seen[pos]; !ok && pos >= 1 && pos <= entries {
+				seen[pos] = struct{}{}
+				positions = append(positions, pos)
+			}
+		}
+		for filenum := t.tailId; filenum <= t.headId; filenum++ {
+			first, err := t.searchFile(filenum, entries)
+			if err != nil {
+				return result, err
+			}
+			add(first - 1) // Last item of the previous file
+			add(first)     // First item of the file
+		}
+		add(entries)
+		for i := 0; i < samples; i++ {
+			add(1 + uint64(rng.Int63n(int64(entries))))
+		}
+		sort.Slice(positions, func(i, j int) bool { return positions[i] < positions[j] })
+	}
+	// Verify the index entries and read back the items at the chosen positions
+	sizes := make(map[uint32]int64)
+	for _, pos := range positions {
+		item := uint64(t.itemOffset) + pos - 1
+
+		prev, cur, err := t.entryPair(pos)
+		if err != nil {
+			return result, err
+		}
+		result.entries++
+
+		t.lock.RLock()
+		_, quarantined := t.quarantine[cur.filenum]
+		t.lock.RUnlock()
+		if quarantined {
+			continue
+		}
+		if err := t.checkEntry(prev, cur, pos == 1, sizes); err != nil {
+			result.corrupt++
+			t.quarantineFile(item, &corruptionError{filenum: cur.filenum, err: fmt.Errorf("index entry %d: %v", pos, err)})
+			continue
+		}
+		if _, err := t.Retrieve(item); err != nil {
+			switch err.(type) {
+			case *corruptionError:
+				result.corrupt++
+			default:
+				if err != errDeleted && err != errQuarantined {
+					return result, err
+				}
+			}
+			continue
+		}
+		result.items++
+	}
+	return result, nil
+}
+
+// searchFile returns the position of the first index entry pointing into the
+// given data file or a later one.
+func (t *freezerTable) searchFile(filenum uint32, entries uint64) (uint64, error) {
+	var failure error
+	n := sort.Search(int(entries), func(i int) bool {
+		if failure != nil {
+			return true
+		}
+		_, entry, err := t.entryPair(uint64(i) + 1)
+		if err != nil {
+			failure = err
+			return true
+		}
+		return entry.filenum >= filenum
+	})
+	return uint64(n) + 1, failure
+}
+
+// entryPair reads the index entry at the given position along with the one
+// preceding it.
+func (t *freezerTable) entryPair(pos uint64) (indexEntry, indexEntry, error) {
+	var prev, cur indexEntry
+
+	buffer := make([]byte, 2*t.entrySize)
+	if _, err := t.index.ReadAt(buffer, int64(pos-1)*t.entrySize); err != nil {
+		return prev, cur, err
+	}
+	if err := prev.unmarshalBinary(buffer[:t.entrySize]); err != nil {
+		return prev, cur, err
+	}
+	if err := cur.unmarshalBinary(buffer[t.entrySize:]); err != nil {
+		return prev, cur, err
+	}
+	return prev, cur, nil
+}
+
+// checkEntry validates the arithmetic of an index entry against its predecessor,
+// the first entry being preceded by the start of the tail file. The sizes of the
+// data files are cached in the given map.
+func (t *freezerTable) checkEntry(prev, cur indexEntry, first bool, sizes map[uint32]int64) error {
+	if first {
+		prev = indexEntry{filenum: t.tailId}
+	}
+	if cur.filenum < t.tailId || cur.filenum > t.headId {
+		return fmt.Errorf("data file %d outside of range [%d, %d]", cur.filenum, t.tailId, t.headId)
+	}
+	if cur.inline != nil {
+		if cur.filenum != prev.filenum || cur.offset != prev.offset {
+			return fmt.Errorf("inlined item moved position: %d:%d -> %d:%d", prev.filenum, prev.offset, cur.filenum, cur.offset)
+		}
+		return nil
+	}
+	switch {
+	case cur.filenum == prev.filenum && cur.offset < prev.offset:
+		return fmt.Errorf("offset went backwards: %d -> %d", prev.offset, cur.offset)
+	case cur.filenum != prev.filenum && cur.filenum != prev.filenum+1:
+		return fmt.Errorf("data file skipped: %d -> %d", prev.filenum, cur.filenum)
+	}
+	size, ok := sizes[cur.filenum]
+	if !ok {
+		stat, err := os.Stat(t.dataFileName(cur.filenum))
+		if err != nil {
+			return err
+		}
+		size = stat.Size()
+		sizes[cur.filenum] = size
+	}
+	if int64(cur.offset) > size {
+		return fmt.Errorf("offset %d beyond data file size %d", cur.offset, size)
+	}
+	return nil
+}
+
+// check verifies the integrity of all the tables of the freezer, quarantining
+// the corrupted data files, see freezerTable.check for the details.
+func (f *freezer) check(full bool) error {
+	var (
+		start  = time.Now()
+		rng    = rand.New(rand.NewSource(start.UnixNano()))
+		total  checkResult
+		failed int
+	)
+	for name, table := range f.tables {
+		result, err := table.check(full, checkSamples, rng)
+		if err != nil {
+			return fmt.Errorf("failed to check table %s: %v", name, err)
+		}
+		total.entries += result.entries
+		total.items += result.items
+		total.corrupt += result.corrupt
+
+		if result.corrupt > 0 {
+			failed++
+		}
+	}
+	f.checkMeter.Mark(int64(total.items))
+	f.corruptMeter.Mark(int64(total.corrupt))
+
+	context := []interface{}{
+		"full", full, "entries", total.entries, "items", total.items,
+		"elapsed", common.PrettyDuration(time.Since(start)),
+	}
+	if total.corrupt > 0 {
+		context = append(context, "tables", failed, "corrupted", total.corrupt)
+		log.Error("Ancient database integrity check failed", context...)
+	} else {
+		log.Info("Checked ancient database integrity", context...)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+)
+
+// errExportNotEmpty is returned if the target directory of a freezer export
+// already contains files.
+var errExportNotEmpty = errors.New("export directory not empty")
+
+// tableExtent is the consistent extent of a freezer table recorded for export.
+type tableExtent struct {
+	index     string // Base name of the index file
+	indexSize int64  // Size of the index covering the recorded items
+	tailId    uint32 // Number of the earliest data file
+	headId    uint32 // Number of the head data file
+	headBytes uint32 // Number of bytes of the head data file covered by the index
+}
+
+// extent records the current extent of the table. The caller must ensure that
+// no items are being appended concurrently.
+func (t *freezerTable) extent() (*tableExtent, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.index == nil || t.head == nil {
+		return nil, errClosed
+	}
+	stat, err := t.index.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return &tableExtent{
+		index:     filepath.Base(t.index.Name()),
+		indexSize: stat.Size(),
+		tailId:    t.tailId,
+		headId:    atomic.LoadUint32(&t.headId),
+		headBytes: atomic.LoadUint32(&t.headBytes),
+	}, nil
+}
+
+// export copies the table up to the recorded extent into dir. Items appended
+// after the extent was recorded are left out. The caller must ensure that the
+// table is not truncated or compacted during the export.
+//
+// The data files are copied instead of being hard-linked, as a truncation can
+// reopen a sealed file for appending and would modify the export too.
+func (t *freezerTable) export(dir string, extent *tableExtent) error {
+	for num := extent.tailId; num <= extent.headId; num++ {
+		size := int64(-1)
+		if num == extent.headId {
+			size = int64(extent.headBytes)
+		}
+		src := t.dataFileName(num)
+		if err := copyFreezerFile(filepath.Join(dir, filepath.Base(src)), src, size); err != nil {
+			return err
+		}
+	}
+	// Copy the deletion metadata, they are replaced atomically so any version is
+	// consistent. Items deleted after the extent was recorded are deleted in the
+	// export too, which is harmless.
+	for _, name := range []string{quarantineName(t.name), tombstoneName(t.name), retentionName(t.name)} {
+		src := filepath.Join(t.path, name)
+		if _, err := os.Stat(src); os.IsNotExist(err) {
+			continue
+		}
+		if err := copyFreezerFile(filepath.Join(dir, name), src, -1); err != nil {
+			return err
+		}
+	}
+	// Copy the index last, it's the one determining the items of the export
+	return copyFreezerFile(filepath.Join(dir, extent.index), filepath.Join(t.path, extent.index), extent.indexSize)
+}
+
+// copyFreezerFile copies the first size bytes of src into the new file dst and
+// flushes it to disk. A negative size copies the entire file.
+func copyFreezerFile(dst, src string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if size < 0 {
+		_, err = io.Copy(out, in)
+	} else {
+		_, err = io.CopyN(out, in, size)
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Export writes a consistent copy of the given freezer tables into dir, which
+// must be empty or non-existent, returning the number of items exported. The
+// copy of all the tables can be opened as a freezer of its own.
+//
+// The appends are only held while the extent of the tables is recorded, the
+// copying runs concurrently with them. Truncations and compactions are blocked
+// until the export finishes.
+func (f *freezer) Export(dir string, tables []string) (uint64, error) {
+	for _, name := range tables {
+		if _, ok := f.tables[name]; !ok {
+			return 0, fmt.Errorf("unknown freezer table %s", name)
+		}
+	}
+	f.exportLock.Lock()
+	defer f.exportLock.Unlock()
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, err
+	}
+	if files, err := ioutil.ReadDir(dir); err != nil {
+		return 0, err
+	} else if len(files) > 0 {
+		return 0, errExportNotEmpty
+	}
+	// Hold the appends while recording the table extents, so that all of them end
+	// at the same item
+	f.appendLock.Lock()
+	var (
+		frozen  = atomic.LoadUint64(&f.frozen)
+		extents = make(map[string]*tableExtent)
+	)
+	for _, name := range tables {
+		extent, err := f.tables[name].extent()
+		if err != nil {
+			f.appendLock.Unlock()
+			return 0, err
+		}
+		extents[name] = extent
+	}
+	f.appendLock.Unlock()
+
+	for _, name := range tables {
+		if err := f.tables[name].export(dir, extents[name]); err != nil {
+			return 0, fmt.Errorf("failed to export table %s: %v", name, err)
+		}
+	}
+	return frozen, nil
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// migrationSuffix is appended to the name of a freezer table to derive the name
+// of the temporary table it's migrated into.
+const migrationSuffix = "-migrating"
+
+// tableExtensions returns the file extensions of the index and the data files of
+// a freezer table in the given format.
+func tableExtensions(noCompression bool) (string, string) {
+	if noCompression {
+		return "ridx", "rdat"
+	}
+	return "cidx", "cdat"
+}
+
+// tableDataFiles returns the paths of all the data files of a freezer table in
+// the given format.
+func tableDataFiles(path, name string, noCompression bool) ([]string, error) {
+	_, dat := tableExtensions(noCompression)
+	return filepath.Glob(filepath.Join(path, fmt.Sprintf("%s.*.%s", name, dat)))
+}
+
+// removeTable deletes the data files and the index, in either layout, of a
+// freezer table in the given format. The index is deleted last, so an
+// interrupted removal leaves the table looking truncated rather than missing.
+func removeTable(path, name string, noCompression bool) error {
+	files, err := tableDataFiles(path, name, noCompression)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	idx, _ := tableExtensions(noCompression)
+	for _, index := range []string{idx, idx + inlineIndexSuffix} {
+		if err := os.Remove(filepath.Join(path, fmt.Sprintf("%s.%s", name, index))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateTable converts a freezer table stored in a format other than the
+// configured one (i.e. a compressed table which is configured raw, or the other
+// way around) into the configured format.
+//
+// The items are copied into a temporary table, which is renamed over the legacy
+// one once complete, the index file last. The migration is resumable: if it's
+// interrupted, the temporary table is repaired on the next run and the copy is
+// continued from its last item. The legacy table is only deleted after the new
+// one is in place.
+//
+// Tables storing items in their index (format v2) are migrated into the same
+// layout, with the given inline limit. A zero limit refuses to migrate them.
+func migrateTable(path, name string, maxFileSize uint32, noCompression bool, limit int) error {
+	var (
+		legacyIdx, _ = tableExtensions(!noCompression)
+		targetIdx, _ = tableExtensions(noCompression)
+		inline       int
+	)
+	if common.FileExist(filepath.Join(path, fmt.Sprintf("%s.%s", name, legacyIdx+inlineIndexSuffix))) {
+		legacyIdx, targetIdx, inline = legacyIdx+inlineIndexSuffix, targetIdx+inlineIndexSuffix, limit
+	} else if !common.FileExist(filepath.Join(path, fmt.Sprintf("%s.%s", name, legacyIdx))) {
+		return nil // Nothing to migrate
+	}
+	// If the migrated table is already in place, the legacy table just didn't get
+	// deleted before the last shutdown.
+	if _, err := os.Stat(filepath.Join(path, fmt.Sprintf("%s.%s", name, targetIdx))); err == nil {
+		log.Info("Deleting migrated freezer table", "table", name)
+		return removeTable(path, name, !noCompression)
+	}
+	src, err := newInlineTable(path, name, metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, maxFileSize, !noCompression, syncPolicy{}, inline)
+	if err != nil {
+		return err
+	}
+	tmp := name + migrationSuffix
+	dst, err := newInlineTable(path, tmp, metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, maxFileSize, noCompression, syncPolicy{mode: syncOnSeal}, inline)
+	if err != nil {
+		src.Close()
+		return err
+	}
+	start := time.Now()
+	err = copyTable(name, src, dst)
+	src.Close()
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	// Move the temporary table into place, the index file last as its presence
+	// marks the migration complete.
+	files, err := tableDataFiles(path, tmp, noCompression)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Rename(file, filepath.Join(path, name+strings.TrimPrefix(filepath.Base(file), tmp))); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(filepath.Join(path, fmt.Sprintf("%s.%s", tmp, targetIdx)), filepath.Join(path, fmt.Sprintf("%s.%s", name, targetIdx))); err != nil {
+		return err
+	}
+	if err := removeTable(path, name, !noCompression); err != nil {
+		return err
+	}
+	log.Info("Migrated freezer table", "table", name, "elapsed", common.PrettyDuration(time.Since(start)))
+	return nil
+}
+
+// copyTable appends all the items of the source table missing from the
+// destination table, syncing the destination afterwards.
+func copyTable(name string, src, dst *freezerTable) error {
+	var (
+		items  = atomic.LoadUint64(&src.items)
+		first  = atomic.LoadUint64(&dst.items)
+		start  = time.Now()
+		logged = time.Now()
+	)
+	log.Info("Migrating freezer table", "table", name, "items", items, "done", first)
+	for item := first; item < items; item++ {
+		blob, err := src.Retrieve(item)
+		if err != nil {
+			return err
+		}
+		if err := dst.Append(item, blob); err != nil {
+			return err
+		}
+		if time.Since(logged) > 8*time.Second {
+			log.Info("Migrating freezer table", "table", name, "items", items, "done", item+1, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	return dst.Sync()
+}
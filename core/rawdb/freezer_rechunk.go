@@ -0,0 +1,306 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// rechunkSuffix is appended to the name of a freezer table to derive the name
+// of the temporary table it's re-chunked into.
+const rechunkSuffix = "-rechunking"
+
+// Phases of the re-chunking of a freezer table, as journalled on disk.
+const (
+	rechunkCopying  byte = iota // Items being copied into the temporary table
+	rechunkDeleting             // Original files being deleted
+	rechunkRenaming             // Temporary files being moved into place
+	rechunkDone                 // Re-chunking finished, the file size is in effect
+)
+
+// errRechunkQuarantined is returned if a table with quarantined data files is
+// attempted to be re-chunked.
+var errRechunkQuarantined = errors.New("table has quarantined data files")
+
+// rechunkName returns the name of the file journalling the re-chunking of a
+// freezer table.
+func rechunkName(name string) string {
+	return fmt.Sprintf("%s.rechunk", name)
+}
+
+// loadRechunk reads the journalled re-chunking of a freezer table, stored as the
+// 32 bit big endian file size followed by the phase. A zero size is returned if
+// the table was never re-chunked.
+func loadRechunk(path, name string) (uint32, byte, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(path, rechunkName(name)))
+	if os.IsNotExist(err) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(blob) != 5 || blob[4] > rechunkDone {
+		return 0, 0, fmt.Errorf("invalid re-chunking journal: %x", blob)
+	}
+	return binary.BigEndian.Uint32(blob), blob[4], nil
+}
+
+// storeRechunk journals the re-chunking of a freezer table, replacing the
+// previous journal atomically.
+func storeRechunk(path, name string, size uint32, phase byte) error {
+	blob := make([]byte, 5)
+	binary.BigEndian.PutUint32(blob, size)
+	blob[4] = phase
+
+	file := filepath.Join(path, rechunkName(name))
+	if err := ioutil.WriteFile(file+".tmp", blob, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// removeTableFiles deletes the data files and the index, in either format, of a
+// freezer table. The index is deleted first, so it's never left pointing into
+// missing data files.
+func removeTableFiles(path, name string, noCompression bool) error {
+	idx, _ := tableExtensions(noCompression)
+	for _, index := range []string{idx, idx + inlineIndexSuffix} {
+		if err := os.Remove(filepath.Join(path, fmt.Sprintf("%s.%s", name, index))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	files, err := tableDataFiles(path, name, noCompression)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recoverRechunk finishes the re-chunking of a freezer table interrupted while
+// swapping the files, returning the data file size set by the last re-chunking,
+// zero if none. An interrupted copy is left to be resumed by the next request,
+// the new files being created with its size already. It's called on startup,
+// before the table files are opened.
+func recoverRechunk(path, name string, noCompression bool) (uint32, error) {
+	size, phase, err := loadRechunk(path, name)
+	if err != nil || size == 0 {
+		return 0, err
+	}
+	switch phase {
+	case rechunkCopying:
+		log.Warn("Freezer table re-chunking interrupted", "table", name, "size", size)
+
+	case rechunkDeleting, rechunkRenaming:
+		log.Warn("Finishing interrupted freezer table re-chunking", "table", name, "size", size)
+		if err := finishRechunk(path, name, noCompression, size, phase); err != nil {
+			return 0, err
+		}
+	}
+	return size, nil
+}
+
+// finishRechunk replaces the files of a freezer table with the ones of its fully
+// copied temporary table, continuing from the given phase.
+func finishRechunk(path, name string, noCompression bool, size uint32, phase byte) error {
+	if phase == rechunkDeleting {
+		if err := removeTableFiles(path, name, noCompression); err != nil {
+			return err
+		}
+		if err := storeRechunk(path, name, size, rechunkRenaming); err != nil {
+			return err
+		}
+	}
+	// Move the temporary table into place, the index file last
+	tmp := name + rechunkSuffix
+	files, err := tableDataFiles(path, tmp, noCompression)
+	if err != nil {
+		return err
+	}
+	idx, _ := tableExtensions(noCompression)
+	for _, index := range []string{idx, idx + inlineIndexSuffix} {
+		if file := filepath.Join(path, fmt.Sprintf("%s.%s", tmp, index)); common.FileExist(file) {
+			files = append(files, file)
+		}
+	}
+	for _, file := range files {
+		if err := os.Rename(file, filepath.Join(path, name+strings.TrimPrefix(filepath.Base(file), tmp))); err != nil {
+			return err
+		}
+	}
+	return storeRechunk(path, name, size, rechunkDone)
+}
+
+// openRechunkTable opens the temporary table the table is re-chunked into,
+// creating it starting at the first item of the table if it doesn't exist yet.
+func (t *freezerTable) openRechunkTable(maxFileSize uint32, itemOffset uint32) (*freezerTable, error) {
+	tmp := t.name + rechunkSuffix
+
+	idx, _ := tableExtensions(t.noCompression)
+	if t.inline > 0 {
+		idx += inlineIndexSuffix
+	}
+	if index := filepath.Join(t.path, fmt.Sprintf("%s.%s", tmp, idx)); !common.FileExist(index) {
+		// The table doesn't start at item zero if its tail was discarded
+		if err := ioutil.WriteFile(index, t.marshall(&indexEntry{filenum: itemOffset}), 0644); err != nil {
+			return nil, err
+		}
+	}
+	return newInlineTable(t.path, tmp, metrics.NilMeter{}, metrics.NilMeter{}, metrics.NilGauge{}, maxFileSize, t.noCompression, syncPolicy{mode: syncOnSeal}, t.inline)
+}
+
+// copyRechunk appends the items of the table missing from the temporary table.
+// The deleted items are copied empty, they stay deleted by the tombstones of the
+// table.
+func (t *freezerTable) copyRechunk(dst *freezerTable) error {
+	var (
+		items  = atomic.LoadUint64(&t.items)
+		start  = time.Now()
+		logged = time.Now()
+	)
+	for item := atomic.LoadUint64(&dst.items); item < items; item++ {
+		blob, err := t.Retrieve(item)
+		if err == errDeleted {
+			blob, err = nil, nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := dst.Append(item, blob); err != nil {
+			return err
+		}
+		if time.Since(logged) > 8*time.Second {
+			t.logger.Info("Re-chunking freezer table", "items", items, "done", item+1, "elapsed", common.PrettyDuration(time.Since(start)))
+			logged = time.Now()
+		}
+	}
+	return nil
+}
+
+// rechunk rewrites all the data files of the table into files of the given
+// maximum size. The items are copied into a temporary table while the table is
+// serving reads and appends, the appends only being held (via the given lock)
+// to copy the last items and to swap the files.
+//
+// The re-chunking is resumable: if it's interrupted while copying, the next one
+// with the same size continues the copy. The swap is journalled, so if it's
+// interrupted, it's finished the next time the table opens. The caller must
+// ensure the table is not truncated or compacted meanwhile.
+func (t *freezerTable) rechunk(maxFileSize uint32, appendLock sync.Locker) error {
+	if maxFileSize == 0 {
+		return errors.New("zero data file size")
+	}
+	t.lock.RLock()
+	var (
+		closed      = t.index == nil || t.head == nil
+		quarantined = len(t.quarantine) > 0
+		itemOffset  = t.itemOffset
+	)
+	t.lock.RUnlock()
+
+	switch {
+	case closed:
+		return errClosed
+	case quarantined:
+		return errRechunkQuarantined
+	}
+	// Discard the leftovers of an earlier re-chunking to a different size
+	if size, phase, err := loadRechunk(t.path, t.name); err != nil {
+		return err
+	} else if phase == rechunkCopying && size != maxFileSize {
+		if err := removeTableFiles(t.path, t.name+rechunkSuffix, t.noCompression); err != nil {
+			return err
+		}
+	}
+	if err := storeRechunk(t.path, t.name, maxFileSize, rechunkCopying); err != nil {
+		return err
+	}
+	dst, err := t.openRechunkTable(maxFileSize, itemOffset)
+	if err != nil {
+		return err
+	}
+	if err := t.copyRechunk(dst); err != nil {
+		dst.Close()
+		return err
+	}
+	// Hold the appends, copy the remaining items and swap the files
+	appendLock.Lock()
+	defer appendLock.Unlock()
+
+	err = t.copyRechunk(dst)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	oldSize, err := t.sizeNolock()
+	if err != nil {
+		return err
+	}
+	if err := storeRechunk(t.path, t.name, maxFileSize, rechunkDeleting); err != nil {
+		return err
+	}
+	index := t.index.Name()
+	t.index.Close()
+	for num := range t.files {
+		t.releaseFile(num)
+	}
+	t.index, t.head = nil, nil
+
+	if err := finishRechunk(t.path, t.name, t.noCompression, maxFileSize, rechunkDeleting); err != nil {
+		return err
+	}
+	// Reopen the rewritten table in place
+	if t.index, err = openFreezerFileForAppend(index); err != nil {
+		return err
+	}
+	t.maxFileSize = maxFileSize
+	if err := t.repair(); err != nil {
+		return err
+	}
+	newSize, err := t.sizeNolock()
+	if err != nil {
+		return err
+	}
+	t.sizeGauge.Inc(int64(newSize) - int64(oldSize))
+	t.logger.Info("Re-chunked freezer table", "size", common.StorageSize(maxFileSize), "files", t.headId-t.tailId+1)
+	return nil
+}
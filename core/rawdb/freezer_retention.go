@@ -0,0 +1,286 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// retentionBatch is the number of items exceeding the retention of a table that
+// are collected before deleting them together, amortizing the tombstone writes.
+// It's also the granularity of the append times tracked for the age limit.
+const retentionBatch = 1024
+
+// retentionMark records that all the items below a number were appended before
+// the given time, allowing the items to be expired by age.
+type retentionMark struct {
+	item uint64 // Number of the first item appended after the time
+	time int64  // Unix timestamp in nanoseconds of the mark
+}
+
+// retention is the policy of a freezer table limiting the number, the size or
+// the age of the items served.
+type retention struct {
+	policy ethdb.AncientRetention // Limits of the items retained, zero values keeping all
+	tail   uint64                 // First item not deleted by the policy
+	marks  []retentionMark        // Append times of the retained items, tracked only with an age limit
+	hook   func(tail uint64)      // Optional callback invoked after deleting items
+}
+
+// retentionName returns the name of the file persisting the retention policy of
+// a freezer table.
+func retentionName(name string) string {
+	return fmt.Sprintf("%s.retention", name)
+}
+
+// loadRetention reads the retention policy of a freezer table, stored as the 64
+// bit big endian item count, size and age limits, the tail and the append time
+// marks, each a pair of 64 bit big endian integers.
+func loadRetention(path, name string) (retention, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(path, retentionName(name)))
+	if os.IsNotExist(err) {
+		return retention{}, nil
+	}
+	if err != nil {
+		return retention{}, err
+	}
+	if len(blob) < 32 || (len(blob)-32)%16 != 0 {
+		return retention{}, fmt.Errorf("invalid retention file: %d bytes", len(blob))
+	}
+	ret := retention{
+		policy: ethdb.AncientRetention{
+			Items: binary.BigEndian.Uint64(blob),
+			Bytes: binary.BigEndian.Uint64(blob[8:]),
+			Age:   time.Duration(binary.BigEndian.Uint64(blob[16:])),
+		},
+		tail: binary.BigEndian.Uint64(blob[24:]),
+	}
+	for blob = blob[32:]; len(blob) > 0; blob = blob[16:] {
+		ret.marks = append(ret.marks, retentionMark{
+			item: binary.BigEndian.Uint64(blob),
+			time: int64(binary.BigEndian.Uint64(blob[8:])),
+		})
+	}
+	return ret, nil
+}
+
+// storeRetention persists the retention policy of a freezer table, replacing the
+// previous one atomically. The file is deleted if there is no policy.
+func storeRetention(path, name string, ret *retention) error {
+	file := filepath.Join(path, retentionName(name))
+	if ret.policy == (ethdb.AncientRetention{}) {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	blob := make([]byte, 32, 32+16*len(ret.marks))
+	binary.BigEndian.PutUint64(blob, ret.policy.Items)
+	binary.BigEndian.PutUint64(blob[8:], ret.policy.Bytes)
+	binary.BigEndian.PutUint64(blob[16:], uint64(ret.policy.Age))
+	binary.BigEndian.PutUint64(blob[24:], ret.tail)
+	for _, mark := range ret.marks {
+		blob = append(blob, make([]byte, 16)...)
+		binary.BigEndian.PutUint64(blob[len(blob)-16:], mark.item)
+		binary.BigEndian.PutUint64(blob[len(blob)-8:], uint64(mark.time))
+	}
+	if err := ioutil.WriteFile(file+".tmp", blob, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// truncate drops the append time marks of the items beyond the new length of
+// the table, returning whether anything changed.
+func (ret *retention) truncate(items uint64) bool {
+	var changed bool
+	if ret.tail > items {
+		ret.tail, changed = items, true
+	}
+	for len(ret.marks) > 0 && ret.marks[len(ret.marks)-1].item > items {
+		ret.marks, changed = ret.marks[:len(ret.marks)-1], true
+	}
+	return changed
+}
+
+// setRetention limits the items served by the table to the given policy, the
+// zero policy lifting all limits. The older items are logically deleted as the
+// table grows, see enforceRetention. The policy is persisted next to the table.
+func (t *freezerTable) setRetention(policy ethdb.AncientRetention) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.retention.policy = policy
+	if t.retention.tail < uint64(t.itemOffset) {
+		t.retention.tail = uint64(t.itemOffset)
+	}
+	if policy.Age == 0 {
+		t.retention.marks = nil
+	}
+	return storeRetention(t.path, t.name, &t.retention)
+}
+
+// dataSizeFrom returns the size of the data stored for the items from the given
+// one onwards, estimated the same way as the size of the table, assuming the
+// sealed data files are full. The caller must hold the lock.
+func (t *freezerTable) dataSizeFrom(item uint64) (uint64, error) {
+	pos := item - uint64(t.itemOffset)
+
+	// The first index entry holds the tail file, not the end of an item
+	filenum, offset := t.tailId, uint32(0)
+	if pos > 0 {
+		buffer := make([]byte, t.entrySize)
+		if _, err := t.index.ReadAt(buffer, int64(pos)*t.entrySize); err != nil {
+			return 0, err
+		}
+		var entry indexEntry
+		if err := entry.unmarshalBinary(buffer); err != nil {
+			return 0, err
+		}
+		filenum, offset = entry.filenum, entry.offset
+	}
+	headId, headBytes := atomic.LoadUint32(&t.headId), atomic.LoadUint32(&t.headBytes)
+	if filenum == headId {
+		return uint64(headBytes - offset), nil
+	}
+	return uint64(t.maxFileSize)*uint64(headId-filenum) - uint64(offset) + uint64(headBytes), nil
+}
+
+// retentionLimit returns the first item to be retained by the policy of the
+// table, never deleting its last item. The caller must hold the lock.
+func (t *freezerTable) retentionLimit(items uint64) (uint64, error) {
+	var (
+		policy = t.retention.policy
+		tail   = t.retention.tail
+		limit  = tail
+	)
+	if items == 0 {
+		return limit, nil
+	}
+	if policy.Items > 0 && items > policy.Items && items-policy.Items > limit {
+		limit = items - policy.Items
+	}
+	if policy.Bytes > 0 {
+		var err error
+		n := sort.Search(int(items-tail), func(i int) bool {
+			if err != nil {
+				return true
+			}
+			var size uint64
+			size, err = t.dataSizeFrom(tail + uint64(i))
+			return size <= policy.Bytes
+		})
+		if err != nil {
+			return 0, err
+		}
+		if tail+uint64(n) > limit {
+			limit = tail + uint64(n)
+		}
+	}
+	if policy.Age > 0 {
+		expiry := time.Now().Add(-policy.Age).UnixNano()
+		for _, mark := range t.retention.marks {
+			if mark.time > expiry {
+				break
+			}
+			if mark.item > limit {
+				limit = mark.item
+			}
+		}
+	}
+	if limit > items-1 {
+		limit = items - 1
+	}
+	return limit, nil
+}
+
+// enforceRetention deletes the items beyond the retention limits of the table,
+// once at least retentionBatch of them accumulated. The space of the items is
+// reclaimed by the next compaction. The retention hook is invoked with the new
+// tail of the table if any items were deleted.
+//
+// With an age limit, the append time of the items is tracked with the same batch
+// granularity, the items being expired only once their whole batch is too old.
+func (t *freezerTable) enforceRetention() error {
+	t.lock.Lock()
+	var (
+		items = atomic.LoadUint64(&t.items)
+		tail  = t.retention.tail
+		hook  = t.retention.hook
+	)
+	if t.retention.policy == (ethdb.AncientRetention{}) {
+		t.lock.Unlock()
+		return nil
+	}
+	if t.index == nil || t.head == nil {
+		t.lock.Unlock()
+		return errClosed
+	}
+	// Track the append time of the items if they are expired by age
+	var marked bool
+	if t.retention.policy.Age > 0 {
+		if n := len(t.retention.marks); n == 0 || items >= t.retention.marks[n-1].item+retentionBatch {
+			t.retention.marks = append(t.retention.marks, retentionMark{item: items, time: time.Now().UnixNano()})
+			marked = true
+		}
+	}
+	limit, err := t.retentionLimit(items)
+	if err != nil {
+		t.lock.Unlock()
+		return err
+	}
+	if limit < tail+retentionBatch {
+		var err error
+		if marked {
+			err = storeRetention(t.path, t.name, &t.retention)
+		}
+		t.lock.Unlock()
+		return err
+	}
+	for item := tail; item < limit; item++ {
+		t.tombstones.set(item)
+	}
+	if err := storeTombstones(t.path, t.name, t.tombstones); err != nil {
+		t.lock.Unlock()
+		return err
+	}
+	// Drop the marks of the deleted items, they can't expire anything anymore
+	t.retention.tail = limit
+	for len(t.retention.marks) > 0 && t.retention.marks[0].item <= limit {
+		t.retention.marks = t.retention.marks[1:]
+	}
+	if err := storeRetention(t.path, t.name, &t.retention); err != nil {
+		t.lock.Unlock()
+		return err
+	}
+	t.lock.Unlock()
+
+	t.logger.Debug("Enforced freezer table retention", "deleted", limit-tail, "tail", limit)
+	if hook != nil {
+		hook(limit)
+	}
+	return nil
+}
@@ -21,15 +21,19 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/golang/snappy"
+	lru "github.com/hashicorp/golang-lru"
 )
 
 var (
@@ -43,22 +47,101 @@ var (
 
 	// errNotSupported is returned if the database doesn't support the required operation.
 	errNotSupported = errors.New("this operation is not supported")
+
+	// errFileEvicted is returned internally if a data file needed by a read was
+	// evicted from the file handle cache and needs to be reopened.
+	errFileEvicted = errors.New("data file evicted")
+
+	// errQuarantined is returned if the item requested resides in a data file
+	// which was found corrupted earlier.
+	errQuarantined = errors.New("data file quarantined")
 )
 
+// maxPooledReadBuffer is the maximum capacity of a read buffer which is returned
+// into the pool after use. Larger ones are left to the garbage collector to
+// avoid pinning the memory of a few outsized items.
+const maxPooledReadBuffer = 4 * 1024 * 1024
+
+// readBufferPool is a pool of scratch buffers used to read the compressed items
+// from the data files before decoding them. The buffers never leave the table,
+// the decoded items are always written into memory owned by the caller.
+var readBufferPool = sync.Pool{
+	New: func() interface{} { return new([]byte) },
+}
+
+// corruptionError is returned internally if the content of a data file turned
+// out to be impossible to read back, carrying the number of the data file.
+type corruptionError struct {
+	filenum uint32
+	err     error
+}
+
+func (e *corruptionError) Error() string {
+	return fmt.Sprintf("corrupted data file %d: %v", e.filenum, e.err)
+}
+
 // indexEntry contains the number/id of the file that the data resides in, aswell as the
 // offset within the file to the end of the data
 // In serialized form, the filenum is stored as uint16.
 type indexEntry struct {
 	filenum uint32 // stored as uint16 ( 2 bytes)
 	offset  uint32 // stored as uint32 ( 4 bytes)
+	inline  []byte // item stored in the entry itself, nil if it's in the data file (format v2 only)
 }
 
 const indexEntrySize = 6
 
+// inlineIndexSuffix is appended to the name of the index files in format v2, so
+// they can't be mistaken for legacy ones.
+const inlineIndexSuffix = "2"
+
+// inlineEntrySize returns the size of an index entry in format v2, which is
+// extended with a flag byte and a fixed size region for storing small items in
+// the index directly. The flag is zero if the item is stored in the data file,
+// otherwise it's the length of the inlined item plus one.
+func inlineEntrySize(limit int) int64 {
+	return indexEntrySize + 1 + int64(limit)
+}
+
+// syncMode is the strategy of a freezer table to flush the appended data to disk.
+type syncMode int
+
+const (
+	// syncManual flushes the data only if the table is synced explicitly.
+	syncManual syncMode = iota
+
+	// syncAlways flushes the data after every append.
+	syncAlways
+
+	// syncInterval flushes the data on append if the configured interval has
+	// elapsed since the last flush.
+	syncInterval
+
+	// syncOnSeal flushes the data file once it's full and sealed, the data in
+	// the head file is only flushed if the table is synced explicitly.
+	syncOnSeal
+)
+
+// syncPolicy defines the durability requirement of a freezer table. Regardless
+// of the policy, the table can always be flushed explicitly via Sync.
+type syncPolicy struct {
+	mode     syncMode
+	interval time.Duration // Minimal time between flushes, used by syncInterval
+}
+
 // unmarshallBinary deserializes binary b into the rawIndex entry.
 func (i *indexEntry) unmarshalBinary(b []byte) error {
 	i.filenum = uint32(binary.BigEndian.Uint16(b[:2]))
 	i.offset = binary.BigEndian.Uint32(b[2:6])
+	i.inline = nil
+
+	if len(b) > indexEntrySize && b[indexEntrySize] != 0 {
+		size := int(b[indexEntrySize]) - 1
+		if indexEntrySize+1+size > len(b) {
+			return fmt.Errorf("inline item overflow: %d > %d", size, len(b)-indexEntrySize-1)
+		}
+		i.inline = b[indexEntrySize+1 : indexEntrySize+1+size]
+	}
 	return nil
 }
 
@@ -70,6 +153,27 @@ func (i *indexEntry) marshallBinary() []byte {
 	return b
 }
 
+// marshallInline serializes the rawIndex entry into the format v2 binary with
+// the given inline limit.
+func (i *indexEntry) marshallInline(limit int) []byte {
+	b := make([]byte, inlineEntrySize(limit))
+	binary.BigEndian.PutUint16(b[:2], uint16(i.filenum))
+	binary.BigEndian.PutUint32(b[2:6], i.offset)
+	if i.inline != nil {
+		b[indexEntrySize] = byte(len(i.inline) + 1)
+		copy(b[indexEntrySize+1:], i.inline)
+	}
+	return b
+}
+
+// marshall serializes the rawIndex entry in the index format of the table.
+func (t *freezerTable) marshall(i *indexEntry) []byte {
+	if t.inline > 0 {
+		return i.marshallInline(t.inline)
+	}
+	return i.marshallBinary()
+}
+
 // freezerTable represents a single chained data table within the freezer (e.g. blocks).
 // It consists of a data file (snappy encoded arbitrary data blobs) and an indexEntry
 // file (uncompressed 64 bit indices into the data file).
@@ -77,18 +181,25 @@ type freezerTable struct {
 	// WARNING: The `items` field is accessed atomically. On 32 bit platforms, only
 	// 64-bit aligned fields can be atomic. The struct is guaranteed to be so aligned,
 	// so take advantage of that (https://golang.org/pkg/sync/atomic/#pkg-note-BUG).
-	items uint64 // Number of items stored in the table (including items removed from tail)
+	items    uint64 // Number of items stored in the table (including items removed from tail)
+	lastSync int64  // Unix timestamp in nanoseconds of the last flush
 
-	noCompression bool   // if true, disables snappy compression. Note: does not work retroactively
-	maxFileSize   uint32 // Max file size for data-files
+	noCompression bool       // if true, disables snappy compression. Note: does not work retroactively
+	inline        int        // Maximum size of the items stored in the index (format v2), zero if disabled
+	entrySize     int64      // Size of the index entries, depending on the index format
+	maxFileSize   uint32     // Max file size for data-files
+	sync          syncPolicy // Policy to flush the appended data to disk
+	dropCache     bool       // Whether to evict the flushed data from the OS page cache
 	name          string
 	path          string
 
-	head   *os.File            // File descriptor for the data head of the table
-	files  map[uint32]*os.File // open files
-	headId uint32              // number of the currently active head file
-	tailId uint32              // number of the earliest file
-	index  *os.File            // File descriptor for the indexEntry file of the table
+	head        *os.File            // File descriptor for the data head of the table
+	files       map[uint32]*os.File // open files
+	recent      *lru.Cache          // Access order of the open sealed data files (nil = keep all open)
+	recentLimit int                 // Maximum number of sealed data files kept open
+	headId      uint32              // number of the currently active head file
+	tailId      uint32              // number of the earliest file
+	index       *os.File            // File descriptor for the indexEntry file of the table
 
 	// In the case that old items are deleted (from the tail), we use itemOffset
 	// to count how many historic items have gone missing.
@@ -98,14 +209,24 @@ type freezerTable struct {
 	readMeter  metrics.Meter // Meter for measuring the effective amount of data read
 	writeMeter metrics.Meter // Meter for measuring the effective amount of data written
 	sizeGauge  metrics.Gauge // Gauge for tracking the combined size of all freezer tables
+	openMeter  metrics.Meter // Meter for measuring the data files opened lazily
+	closeMeter metrics.Meter // Meter for measuring the data files evicted from the cache
+
+	quarantine map[uint32]struct{}          // Data files found corrupted, their items are not served
+	tombstones *tombstones                  // Items deleted logically, their space is reclaimed by compaction
+	corrupted  func(item uint64, err error) // Optional callback invoked when a data file is quarantined
+	retention  retention                    // Policy deleting the items beyond the most recent ones
 
 	logger log.Logger   // Logger with database path and table name ambedded
 	lock   sync.RWMutex // Mutex protecting the data file descriptors
 }
 
+// freezerTableSize defines the maximum size of freezer data files.
+const freezerTableSize = 2 * 1000 * 1000 * 1000
+
 // newTable opens a freezer table with default settings - 2G files
-func newTable(path string, name string, readMeter metrics.Meter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, disableSnappy bool) (*freezerTable, error) {
-	return newCustomTable(path, name, readMeter, writeMeter, sizeGauge, 2*1000*1000*1000, disableSnappy)
+func newTable(path string, name string, readMeter metrics.Meter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, disableSnappy bool, sync syncPolicy, inline int) (*freezerTable, error) {
+	return newInlineTable(path, name, readMeter, writeMeter, sizeGauge, freezerTableSize, disableSnappy, sync, inline)
 }
 
 // openFreezerFileForAppend opens a freezer table file and seeks to the end
@@ -146,21 +267,99 @@ func truncateFreezerFile(file *os.File, size int64) error {
 	return nil
 }
 
+// quarantineName returns the name of the file persisting the numbers of the
+// quarantined data files of a freezer table.
+func quarantineName(name string) string {
+	return fmt.Sprintf("%s.quarantine", name)
+}
+
+// loadQuarantine reads the numbers of the quarantined data files of a freezer
+// table, stored as a list of 32 bit big endian integers.
+func loadQuarantine(path, name string) (map[uint32]struct{}, error) {
+	quarantine := make(map[uint32]struct{})
+
+	blob, err := ioutil.ReadFile(filepath.Join(path, quarantineName(name)))
+	if os.IsNotExist(err) {
+		return quarantine, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for len(blob) >= 4 {
+		quarantine[binary.BigEndian.Uint32(blob)] = struct{}{}
+		blob = blob[4:]
+	}
+	return quarantine, nil
+}
+
+// storeQuarantine persists the numbers of the quarantined data files of a freezer
+// table, replacing the previous list atomically. The file is deleted if there is
+// nothing quarantined.
+func storeQuarantine(path, name string, quarantine map[uint32]struct{}) error {
+	file := filepath.Join(path, quarantineName(name))
+	if len(quarantine) == 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	blob := make([]byte, 0, 4*len(quarantine))
+	for filenum := range quarantine {
+		blob = append(blob, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(blob[len(blob)-4:], filenum)
+	}
+	if err := ioutil.WriteFile(file+".tmp", blob, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
 // newCustomTable opens a freezer table, creating the data and index files if they are
 // non existent. Both files are truncated to the shortest common length to ensure
 // they don't go out of sync.
-func newCustomTable(path string, name string, readMeter metrics.Meter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, maxFilesize uint32, noCompression bool) (*freezerTable, error) {
+func newCustomTable(path string, name string, readMeter metrics.Meter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, maxFilesize uint32, noCompression bool, sync syncPolicy) (*freezerTable, error) {
+	return newInlineTable(path, name, readMeter, writeMeter, sizeGauge, maxFilesize, noCompression, sync, 0)
+}
+
+// newInlineTable opens a freezer table like newCustomTable, but stores the items
+// not larger than the inline limit (at most 254 bytes) directly in the index,
+// sparing the reads from the data file (format v2). Tables already existing in
+// the legacy format are opened as they are, with inlining disabled.
+//
+// Tables in format v2 can't be opened with inlining disabled: the legacy index
+// would be created afresh and the data files truncated to match it.
+func newInlineTable(path string, name string, readMeter metrics.Meter, writeMeter metrics.Meter, sizeGauge metrics.Gauge, maxFilesize uint32, noCompression bool, sync syncPolicy, inline int) (*freezerTable, error) {
 	// Ensure the containing directory exists and open the indexEntry file
 	if err := os.MkdirAll(path, 0755); err != nil {
 		return nil, err
 	}
-	var idxName string
-	if noCompression {
-		// Raw idx
-		idxName = fmt.Sprintf("%s.ridx", name)
-	} else {
-		// Compressed idx
-		idxName = fmt.Sprintf("%s.cidx", name)
+	if inline > math.MaxUint8-1 {
+		return nil, fmt.Errorf("inline limit too large: %d > %d", inline, math.MaxUint8-1)
+	}
+	// Finish any interrupted re-chunking and apply the data file size it set
+	if size, err := recoverRechunk(path, name, noCompression); err != nil {
+		return nil, err
+	} else if size > 0 {
+		maxFilesize = size
+	}
+	idx, _ := tableExtensions(noCompression)
+	idxName := fmt.Sprintf("%s.%s", name, idx)
+	if inline > 0 {
+		// Inlining is only enabled for new tables or tables already in format v2
+		if _, err := os.Stat(filepath.Join(path, idxName)); err == nil {
+			if _, err := os.Stat(filepath.Join(path, idxName+inlineIndexSuffix)); os.IsNotExist(err) {
+				inline = 0
+			}
+		}
+		if inline > 0 {
+			idxName += inlineIndexSuffix
+		}
+	} else if common.FileExist(filepath.Join(path, idxName+inlineIndexSuffix)) {
+		return nil, fmt.Errorf("freezer table %s stores items in its index, which is not enabled", name)
+	}
+	entrySize := int64(indexEntrySize)
+	if inline > 0 {
+		entrySize = inlineEntrySize(inline)
 	}
 	offsets, err := openFreezerFileForAppend(filepath.Join(path, idxName))
 	if err != nil {
@@ -173,16 +372,47 @@ func newCustomTable(path string, name string, readMeter metrics.Meter, writeMete
 		readMeter:     readMeter,
 		writeMeter:    writeMeter,
 		sizeGauge:     sizeGauge,
+		openMeter:     metrics.NilMeter{},
+		closeMeter:    metrics.NilMeter{},
 		name:          name,
 		path:          path,
 		logger:        log.New("database", path, "table", name),
 		noCompression: noCompression,
+		inline:        inline,
+		entrySize:     entrySize,
 		maxFileSize:   maxFilesize,
+		sync:          sync,
+		lastSync:      time.Now().UnixNano(),
+	}
+	if tab.quarantine, err = loadQuarantine(path, name); err != nil {
+		tab.Close()
+		return nil, err
+	}
+	if len(tab.quarantine) > 0 {
+		tab.logger.Error("Freezer table has quarantined data files", "files", len(tab.quarantine))
+	}
+	if tab.tombstones, err = loadTombstones(path, name); err != nil {
+		tab.Close()
+		return nil, err
+	}
+	if err := tab.recoverCompaction(); err != nil {
+		tab.Close()
+		return nil, err
 	}
 	if err := tab.repair(); err != nil {
 		tab.Close()
 		return nil, err
 	}
+	// Resume the retention policy, the table might have been truncated since
+	if tab.retention, err = loadRetention(path, name); err != nil {
+		tab.Close()
+		return nil, err
+	}
+	if tab.retention.tail < uint64(tab.itemOffset) {
+		tab.retention.tail = uint64(tab.itemOffset)
+	}
+	tab.retention.truncate(atomic.LoadUint64(&tab.items))
+
 	// Initialize the starting size counter
 	size, err := tab.sizeNolock()
 	if err != nil {
@@ -198,7 +428,7 @@ func newCustomTable(path string, name string, readMeter metrics.Meter, writeMete
 // be in sync with each other after a potential crash / data loss.
 func (t *freezerTable) repair() error {
 	// Create a temporary offset buffer to init files with and read indexEntry into
-	buffer := make([]byte, indexEntrySize)
+	buffer := make([]byte, t.entrySize)
 
 	// If we've just created the files, initialize the index with the 0 indexEntry
 	stat, err := t.index.Stat()
@@ -210,8 +440,8 @@ func (t *freezerTable) repair() error {
 			return err
 		}
 	}
-	// Ensure the index is a multiple of indexEntrySize bytes
-	if overflow := stat.Size() % indexEntrySize; overflow != 0 {
+	// Ensure the index is a multiple of the entry size
+	if overflow := stat.Size() % t.entrySize; overflow != 0 {
 		truncateFreezerFile(t.index, stat.Size()-overflow) // New file can't trigger this path
 	}
 	// Retrieve the file sizes and prepare for truncation
@@ -235,7 +465,7 @@ func (t *freezerTable) repair() error {
 	t.tailId = firstIndex.offset
 	t.itemOffset = firstIndex.filenum
 
-	t.index.ReadAt(buffer, offsetsSize-indexEntrySize)
+	t.index.ReadAt(buffer, offsetsSize-t.entrySize)
 	lastIndex.unmarshalBinary(buffer)
 	t.head, err = t.openFile(lastIndex.filenum, openFreezerFileForAppend)
 	if err != nil {
@@ -261,11 +491,11 @@ func (t *freezerTable) repair() error {
 		// Truncate the index to point within the head file
 		if contentExp > contentSize {
 			t.logger.Warn("Truncating dangling indexes", "indexed", common.StorageSize(contentExp), "stored", common.StorageSize(contentSize))
-			if err := truncateFreezerFile(t.index, offsetsSize-indexEntrySize); err != nil {
+			if err := truncateFreezerFile(t.index, offsetsSize-t.entrySize); err != nil {
 				return err
 			}
-			offsetsSize -= indexEntrySize
-			t.index.ReadAt(buffer, offsetsSize-indexEntrySize)
+			offsetsSize -= t.entrySize
+			t.index.ReadAt(buffer, offsetsSize-t.entrySize)
 			var newLastIndex indexEntry
 			newLastIndex.unmarshalBinary(buffer)
 			// We might have slipped back into an earlier head-file here
@@ -294,7 +524,7 @@ func (t *freezerTable) repair() error {
 		return err
 	}
 	// Update the item and byte counters and return
-	t.items = uint64(t.itemOffset) + uint64(offsetsSize/indexEntrySize-1) // last indexEntry points to the end of the data file
+	t.items = uint64(t.itemOffset) + uint64(offsetsSize/t.entrySize-1) // last indexEntry points to the end of the data file
 	t.headBytes = uint32(contentSize)
 	t.headId = lastIndex.filenum
 
@@ -313,10 +543,12 @@ func (t *freezerTable) repair() error {
 func (t *freezerTable) preopen() (err error) {
 	// The repair might have already opened (some) files
 	t.releaseFilesAfter(0, false)
-	// Open all except head in RDONLY
-	for i := t.tailId; i < t.headId; i++ {
-		if _, err = t.openFile(i, openFreezerFileForReadOnly); err != nil {
-			return err
+	// Open all except head in RDONLY, unless they are opened on demand
+	if t.recent == nil {
+		for i := t.tailId; i < t.headId; i++ {
+			if _, err = t.openFile(i, openFreezerFileForReadOnly); err != nil {
+				return err
+			}
 		}
 	}
 	// Open head in read/write
@@ -324,6 +556,48 @@ func (t *freezerTable) preopen() (err error) {
 	return err
 }
 
+// limitOpenFiles caps the number of data files the table keeps open at any point
+// in time. The head file is always kept open, the sealed ones are opened lazily
+// on access and evicted in least recently used order. A limit of zero reverts to
+// keeping all the data files open.
+func (t *freezerTable) limitOpenFiles(limit int, openMeter, closeMeter metrics.Meter) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.openMeter, t.closeMeter = openMeter, closeMeter
+	if limit <= 0 {
+		t.recent = nil
+		return t.preopen()
+	}
+	// The head file is pinned, the rest of the allowance goes to sealed files
+	if limit--; limit == 0 {
+		limit = 1
+	}
+	recent, err := lru.New(limit)
+	if err != nil {
+		return err
+	}
+	// Drop all the sealed files, they will be reopened on demand
+	for num := range t.files {
+		if num != t.headId {
+			t.closeFile(num)
+		}
+	}
+	t.recent, t.recentLimit = recent, limit
+	return nil
+}
+
+// setDropCache configures the table to evict its data from the OS page cache
+// whenever it's flushed to disk. Ancient data is rarely read, so caching it only
+// pollutes the page cache during large sequential writes (e.g. initial sync).
+// The sealed files are flushed before being evicted, regardless of the policy.
+func (t *freezerTable) setDropCache(drop bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.dropCache = drop
+}
+
 // truncate discards any recent data above the provided threshold number.
 func (t *freezerTable) truncate(items uint64) error {
 	t.lock.Lock()
@@ -340,12 +614,12 @@ func (t *freezerTable) truncate(items uint64) error {
 	}
 	// Something's out of sync, truncate the table's offset index
 	t.logger.Warn("Truncating freezer table", "items", t.items, "limit", items)
-	if err := truncateFreezerFile(t.index, int64(items+1)*indexEntrySize); err != nil {
+	if err := truncateFreezerFile(t.index, int64(items+1)*t.entrySize); err != nil {
 		return err
 	}
 	// Calculate the new expected size of the data file and truncate it
-	buffer := make([]byte, indexEntrySize)
-	if _, err := t.index.ReadAt(buffer, int64(items*indexEntrySize)); err != nil {
+	buffer := make([]byte, t.entrySize)
+	if _, err := t.index.ReadAt(buffer, int64(items)*t.entrySize); err != nil {
 		return err
 	}
 	var expected indexEntry
@@ -366,9 +640,35 @@ func (t *freezerTable) truncate(items uint64) error {
 		t.head = newHead
 		atomic.StoreUint32(&t.headId, expected.filenum)
 	}
+	// Lift the quarantine of the deleted files and of the new head, which is cut
+	// back to the retained items, as the truncated items can be refilled
+	var lifted bool
+	for filenum := range t.quarantine {
+		if filenum >= expected.filenum {
+			delete(t.quarantine, filenum)
+			lifted = true
+		}
+	}
+	if lifted {
+		if err := storeQuarantine(t.path, t.name, t.quarantine); err != nil {
+			return err
+		}
+	}
 	if err := truncateFreezerFile(t.head, int64(expected.offset)); err != nil {
 		return err
 	}
+	// Drop the tombstones and the retention marks of the truncated items, they
+	// can be refilled
+	if t.tombstones.truncate(items) {
+		if err := storeTombstones(t.path, t.name, t.tombstones); err != nil {
+			return err
+		}
+	}
+	if t.retention.truncate(items) {
+		if err := storeRetention(t.path, t.name, &t.retention); err != nil {
+			return err
+		}
+	}
 	// All data files truncated, set internal counters and return
 	atomic.StoreUint64(&t.items, items)
 	atomic.StoreUint32(&t.headBytes, expected.offset)
@@ -411,13 +711,7 @@ func (t *freezerTable) Close() error {
 func (t *freezerTable) openFile(num uint32, opener func(string) (*os.File, error)) (f *os.File, err error) {
 	var exist bool
 	if f, exist = t.files[num]; !exist {
-		var name string
-		if t.noCompression {
-			name = fmt.Sprintf("%s.%04d.rdat", t.name, num)
-		} else {
-			name = fmt.Sprintf("%s.%04d.cdat", t.name, num)
-		}
-		f, err = opener(filepath.Join(t.path, name))
+		f, err = opener(t.dataFileName(num))
 		if err != nil {
 			return nil, err
 		}
@@ -426,13 +720,50 @@ func (t *freezerTable) openFile(num uint32, opener func(string) (*os.File, error
 	return f, err
 }
 
+// openSealedFile opens a non-head data file in read only mode, tracking it in the
+// file handle cache if one is enabled. Assumes that the write-lock is held by the
+// caller.
+func (t *freezerTable) openSealedFile(num uint32) (*os.File, error) {
+	_, exist := t.files[num]
+	if t.recent != nil && !t.recent.Contains(num) && t.recent.Len() >= t.recentLimit {
+		// The cache is full, evict the least recently used file. Only these
+		// evictions are metered, explicit releases are not due to the limit.
+		if key, _, ok := t.recent.RemoveOldest(); ok && t.closeFile(key.(uint32)) {
+			t.closeMeter.Mark(1)
+		}
+	}
+	f, err := t.openFile(num, openFreezerFileForReadOnly)
+	if err != nil {
+		return nil, err
+	}
+	if t.recent != nil {
+		if !exist {
+			t.openMeter.Mark(1)
+		}
+		t.recent.Add(num, nil)
+	}
+	return f, nil
+}
+
 // releaseFile closes a file, and removes it from the open file cache.
 // Assumes that the caller holds the write lock
 func (t *freezerTable) releaseFile(num uint32) {
-	if f, exist := t.files[num]; exist {
+	t.closeFile(num)
+	if t.recent != nil {
+		t.recent.Remove(num)
+	}
+}
+
+// closeFile closes a file without touching the file handle cache, returning
+// whether there was anything to close. Assumes that the caller holds the write
+// lock.
+func (t *freezerTable) closeFile(num uint32) bool {
+	f, exist := t.files[num]
+	if exist {
 		delete(t.files, num)
 		f.Close()
 	}
+	return exist
 }
 
 // releaseFilesAfter closes all open files with a higher number, and optionally also deletes the files
@@ -441,6 +772,9 @@ func (t *freezerTable) releaseFilesAfter(num uint32, remove bool) {
 		if fnum > num {
 			delete(t.files, fnum)
 			f.Close()
+			if t.recent != nil {
+				t.recent.Remove(fnum)
+			}
 			if remove {
 				os.Remove(f.Name())
 			}
@@ -452,8 +786,10 @@ func (t *freezerTable) releaseFilesAfter(num uint32, remove bool) {
 // is a precautionary parameter to ensure data correctness, but the table will
 // reject already existing data.
 //
-// Note, this method will *not* flush any data to disk so be sure to explicitly
-// fsync before irreversibly deleting data from the database.
+// Note, whether the appended data is flushed to disk depends on the sync policy
+// of the table: sealed files might be flushed on rotation and the head file on
+// every append or after an interval, so be sure to explicitly fsync before
+// irreversibly deleting data from the database.
 func (t *freezerTable) Append(item uint64, blob []byte) error {
 	// Read lock prevents competition with truncate
 	t.lock.RLock()
@@ -471,9 +807,11 @@ func (t *freezerTable) Append(item uint64, blob []byte) error {
 	if !t.noCompression {
 		blob = snappy.Encode(nil, blob)
 	}
-	bLen := uint32(len(blob))
-	if t.headBytes+bLen < bLen ||
-		t.headBytes+bLen > t.maxFileSize {
+	var (
+		bLen    = uint32(len(blob))
+		inlined = t.inline > 0 && len(blob) <= t.inline
+	)
+	if !inlined && (t.headBytes+bLen < bLen || t.headBytes+bLen > t.maxFileSize) {
 		// we need a new file, writing would overflow
 		t.lock.RUnlock()
 		t.lock.Lock()
@@ -485,9 +823,18 @@ func (t *freezerTable) Append(item uint64, blob []byte) error {
 			t.lock.Unlock()
 			return err
 		}
+		// Flush the sealed file if it's required by the policy. The index
+		// is flushed too, the sealed data is unreachable without it.
+		if t.sync.mode == syncOnSeal || t.dropCache {
+			if err := t.Sync(); err != nil {
+				newHead.Close()
+				t.lock.Unlock()
+				return err
+			}
+		}
 		// Close old file, and reopen in RDONLY mode
 		t.releaseFile(t.headId)
-		t.openFile(t.headId, openFreezerFileForReadOnly)
+		t.openSealedFile(t.headId)
 
 		// Swap out the current head
 		t.head = newHead
@@ -498,93 +845,270 @@ func (t *freezerTable) Append(item uint64, blob []byte) error {
 	}
 
 	defer t.lock.RUnlock()
-	if _, err := t.head.Write(blob); err != nil {
-		return err
-	}
-	newOffset := atomic.AddUint32(&t.headBytes, bLen)
 	idx := indexEntry{
 		filenum: atomic.LoadUint32(&t.headId),
-		offset:  newOffset,
+	}
+	written := t.entrySize
+	if inlined {
+		// Small item, store it in the index entry without touching the data file
+		idx.offset = atomic.LoadUint32(&t.headBytes)
+		idx.inline = blob
+	} else {
+		if _, err := t.head.Write(blob); err != nil {
+			return err
+		}
+		idx.offset = atomic.AddUint32(&t.headBytes, bLen)
+		written += int64(bLen)
 	}
 	// Write indexEntry
-	t.index.Write(idx.marshallBinary())
+	t.index.Write(t.marshall(&idx))
 
-	t.writeMeter.Mark(int64(bLen + indexEntrySize))
-	t.sizeGauge.Inc(int64(bLen + indexEntrySize))
+	t.writeMeter.Mark(written)
+	t.sizeGauge.Inc(written)
 
 	atomic.AddUint64(&t.items, 1)
+
+	// Flush the appended data if it's required by the policy
+	switch t.sync.mode {
+	case syncAlways:
+		return t.Sync()
+	case syncInterval:
+		if time.Since(time.Unix(0, atomic.LoadInt64(&t.lastSync))) >= t.sync.interval {
+			return t.Sync()
+		}
+	}
 	return nil
 }
 
 // getBounds returns the indexes for the item
-// returns start, end, filenumber and error
-func (t *freezerTable) getBounds(item uint64) (uint32, uint32, uint32, error) {
+// returns start, end, filenumber, the inlined item (if any) and error
+func (t *freezerTable) getBounds(item uint64) (uint32, uint32, uint32, []byte, error) {
 	var startIdx, endIdx indexEntry
-	buffer := make([]byte, indexEntrySize)
-	if _, err := t.index.ReadAt(buffer, int64(item*indexEntrySize)); err != nil {
-		return 0, 0, 0, err
+	buffer := make([]byte, 2*t.entrySize)
+	if _, err := t.index.ReadAt(buffer, int64(item)*t.entrySize); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	if err := startIdx.unmarshalBinary(buffer[:t.entrySize]); err != nil {
+		return 0, 0, 0, nil, err
 	}
-	startIdx.unmarshalBinary(buffer)
-	if _, err := t.index.ReadAt(buffer, int64((item+1)*indexEntrySize)); err != nil {
-		return 0, 0, 0, err
+	if err := endIdx.unmarshalBinary(buffer[t.entrySize:]); err != nil {
+		return 0, 0, 0, nil, err
+	}
+	if endIdx.inline != nil {
+		// The item is stored in the index entry, no data file access needed
+		return endIdx.offset, endIdx.offset, endIdx.filenum, endIdx.inline, nil
 	}
-	endIdx.unmarshalBinary(buffer)
 	if startIdx.filenum != endIdx.filenum {
 		// If a piece of data 'crosses' a data-file,
 		// it's actually in one piece on the second data-file.
 		// We return a zero-indexEntry for the second file as start
-		return 0, endIdx.offset, endIdx.filenum, nil
+		return 0, endIdx.offset, endIdx.filenum, nil, nil
 	}
-	return startIdx.offset, endIdx.offset, endIdx.filenum, nil
+	return startIdx.offset, endIdx.offset, endIdx.filenum, nil, nil
 }
 
 // Retrieve looks up the data offset of an item with the given number and retrieves
 // the raw binary blob from the data file.
 func (t *freezerTable) Retrieve(item uint64) ([]byte, error) {
-	t.lock.RLock()
+	return t.RetrieveInto(item, nil)
+}
+
+// RetrieveInto looks up the data offset of an item with the given number and
+// retrieves the raw binary blob into the supplied buffer, growing it if too
+// small. The returned slice aliases the buffer if it was large enough, so the
+// caller must not hold onto a previous result when reusing the buffer.
+//
+// The buffer is never retained by the table, nor does the table ever hand out
+// any of its internal buffers, so misusing the returned slice can't corrupt
+// subsequent reads.
+func (t *freezerTable) RetrieveInto(item uint64, buf []byte) ([]byte, error) {
+	if t.noCompression {
+		blob, _, err := t.read(item, buf)
+		return blob, err
+	}
+	// Read the compressed item into a scratch buffer and decode it from there
+	scratch := readBufferPool.Get().(*[]byte)
+	defer func() {
+		if cap(*scratch) <= maxPooledReadBuffer {
+			readBufferPool.Put(scratch)
+		}
+	}()
+	blob, filenum, err := t.read(item, *scratch)
+	if err != nil {
+		return nil, err
+	}
+	*scratch = blob[:0]
+
+	decoded, err := snappy.Decode(buf[:cap(buf)], blob)
+	if err != nil {
+		cerr := &corruptionError{filenum: filenum, err: err}
+		t.quarantineFile(item, cerr)
+		return nil, cerr
+	}
+	return decoded, nil
+}
+
+// read retrieves the raw binary blob of an item into the supplied buffer,
+// reopening the data file if it was evicted from the file handle cache and
+// quarantining it if it turns out to be corrupted.
+func (t *freezerTable) read(item uint64, buf []byte) ([]byte, uint32, error) {
+	blob, filenum, err := t.retrieve(item, false, buf)
+	if err == errFileEvicted {
+		// The data file was evicted from the handle cache, reopen it exclusively
+		blob, filenum, err = t.retrieve(item, true, buf)
+	}
+	if err != nil {
+		if cerr, ok := err.(*corruptionError); ok {
+			t.quarantineFile(item, cerr)
+		}
+		return nil, filenum, err
+	}
+	t.readMeter.Mark(int64(len(blob)) + 2*t.entrySize)
+	return blob, filenum, nil
+}
+
+// quarantineFile marks the data file as corrupted, refusing to serve any item
+// from it until it's truncated away. The quarantine is persisted next to the
+// table, so it survives restarts.
+func (t *freezerTable) quarantineFile(item uint64, cerr *corruptionError) {
+	t.lock.Lock()
+	if _, ok := t.quarantine[cerr.filenum]; ok {
+		t.lock.Unlock()
+		return
+	}
+	t.quarantine[cerr.filenum] = struct{}{}
+	if err := storeQuarantine(t.path, t.name, t.quarantine); err != nil {
+		t.logger.Error("Failed to persist freezer quarantine", "err", err)
+	}
+	callback := t.corrupted
+	t.lock.Unlock()
+
+	t.logger.Error("Quarantined corrupted freezer data file", "file", cerr.filenum, "item", item, "err", cerr.err)
+	if callback != nil {
+		callback(item, cerr)
+	}
+}
+
+// itemSize is the size of a single item in a freezer table.
+type itemSize struct {
+	stored  uint32 // Size of the item in the data file, compressed if enabled
+	decoded uint32 // Size of the item as returned by Retrieve
+}
+
+// sizes returns both the stored and the decoded sizes of the given number of
+// items, starting at the specified one.
+func (t *freezerTable) sizes(start, count uint64) ([]itemSize, error) {
+	sizes := make([]itemSize, 0, count)
+	for item := start; item < start+count; item++ {
+		blob, _, err := t.retrieve(item, false, nil)
+		if err == errFileEvicted {
+			blob, _, err = t.retrieve(item, true, nil)
+		}
+		if err == errDeleted {
+			sizes = append(sizes, itemSize{})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		size := itemSize{stored: uint32(len(blob)), decoded: uint32(len(blob))}
+		if !t.noCompression {
+			decoded, err := snappy.DecodedLen(blob)
+			if err != nil {
+				return nil, err
+			}
+			size.decoded = uint32(decoded)
+		}
+		sizes = append(sizes, size)
+	}
+	return sizes, nil
+}
+
+// retrieve reads the raw binary blob of an item from the data file into the
+// supplied buffer (allocating a new one if too small), returning the number of
+// the data file too. If the file handle cache is enabled and the data file is
+// not open, errFileEvicted will be returned unless the exclusive lock is
+// requested, in which case the file will be reopened.
+func (t *freezerTable) retrieve(item uint64, exclusive bool, buf []byte) ([]byte, uint32, error) {
+	if exclusive {
+		t.lock.Lock()
+		defer t.lock.Unlock()
+	} else {
+		t.lock.RLock()
+		defer t.lock.RUnlock()
+	}
 	// Ensure the table and the item is accessible
 	if t.index == nil || t.head == nil {
-		t.lock.RUnlock()
-		return nil, errClosed
+		return nil, 0, errClosed
 	}
 	if atomic.LoadUint64(&t.items) <= item {
-		t.lock.RUnlock()
-		return nil, errOutOfBounds
+		return nil, 0, errOutOfBounds
 	}
 	// Ensure the item was not deleted from the tail either
 	if uint64(t.itemOffset) > item {
-		t.lock.RUnlock()
-		return nil, errOutOfBounds
+		return nil, 0, errOutOfBounds
+	}
+	if t.tombstones.has(item) {
+		return nil, 0, errDeleted
 	}
-	startOffset, endOffset, filenum, err := t.getBounds(item - uint64(t.itemOffset))
+	startOffset, endOffset, filenum, inline, err := t.getBounds(item - uint64(t.itemOffset))
 	if err != nil {
-		t.lock.RUnlock()
-		return nil, err
+		return nil, 0, err
 	}
-	dataFile, exist := t.files[filenum]
-	if !exist {
-		t.lock.RUnlock()
-		return nil, fmt.Errorf("missing data file %d", filenum)
+	if inline != nil {
+		if cap(buf) < len(inline) {
+			buf = make([]byte, len(inline))
+		}
+		blob := buf[:len(inline)]
+		copy(blob, inline)
+		return blob, filenum, nil
 	}
-	// Retrieve the data itself, decompress and return
-	blob := make([]byte, endOffset-startOffset)
-	if _, err := dataFile.ReadAt(blob, int64(startOffset)); err != nil {
-		t.lock.RUnlock()
-		return nil, err
+	if _, ok := t.quarantine[filenum]; ok {
+		return nil, filenum, errQuarantined
+	}
+	if startOffset > endOffset {
+		return nil, filenum, &corruptionError{filenum: filenum, err: fmt.Errorf("impossible offsets %d-%d", startOffset, endOffset)}
 	}
-	t.lock.RUnlock()
-	t.readMeter.Mark(int64(len(blob) + 2*indexEntrySize))
+	dataFile, exist := t.files[filenum]
+	switch {
+	case !exist && t.recent == nil:
+		return nil, filenum, fmt.Errorf("missing data file %d", filenum)
 
-	if t.noCompression {
-		return blob, nil
+	case !exist && !exclusive:
+		return nil, filenum, errFileEvicted
+
+	case !exist:
+		if dataFile, err = t.openSealedFile(filenum); err != nil {
+			return nil, filenum, err
+		}
+	case t.recent != nil:
+		t.recent.Get(filenum) // Bump the file in the eviction order, noop for the head
+	}
+	// Retrieve the data itself, decompression is done by the caller
+	size := int(endOffset - startOffset)
+	if cap(buf) < size {
+		buf = make([]byte, size)
 	}
-	return snappy.Decode(nil, blob)
+	blob := buf[:size]
+	if _, err := dataFile.ReadAt(blob, int64(startOffset)); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, filenum, &corruptionError{filenum: filenum, err: err}
+		}
+		return nil, filenum, err
+	}
+	return blob, filenum, nil
 }
 
 // has returns an indicator whether the specified number data
 // exists in the freezer table.
 func (t *freezerTable) has(number uint64) bool {
-	return atomic.LoadUint64(&t.items) > number
+	if atomic.LoadUint64(&t.items) <= number {
+		return false
+	}
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return !t.tombstones.has(number)
 }
 
 // size returns the total data size in the freezer table.
@@ -612,19 +1136,31 @@ func (t *freezerTable) Sync() error {
 	if err := t.index.Sync(); err != nil {
 		return err
 	}
-	return t.head.Sync()
+	if err := t.head.Sync(); err != nil {
+		return err
+	}
+	// The data is persisted, it won't be read back anytime soon (recent items
+	// are served from the key-value store), so don't let it crowd out the
+	// page cache of the live database.
+	if t.dropCache {
+		if err := dropPageCache(t.head); err != nil {
+			t.logger.Debug("Failed to drop page cache", "err", err)
+		}
+	}
+	atomic.StoreInt64(&t.lastSync, time.Now().UnixNano())
+	return nil
 }
 
 // printIndex is a debug print utility function for testing
 func (t *freezerTable) printIndex() {
-	buf := make([]byte, indexEntrySize)
+	buf := make([]byte, t.entrySize)
 
 	fmt.Printf("|-----------------|\n")
 	fmt.Printf("| fileno | offset |\n")
 	fmt.Printf("|--------+--------|\n")
 
 	for i := uint64(0); ; i++ {
-		if _, err := t.index.ReadAt(buf, int64(i*indexEntrySize)); err != nil {
+		if _, err := t.index.ReadAt(buf, int64(i)*t.entrySize); err != nil {
 			break
 		}
 		var entry indexEntry
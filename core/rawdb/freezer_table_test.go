@@ -19,12 +19,17 @@ package rawdb
 import (
 	"bytes"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/metrics"
 )
 
@@ -48,7 +53,7 @@ func TestFreezerBasics(t *testing.T) {
 	// set cutoff at 50 bytes
 	f, err := newCustomTable(os.TempDir(),
 		fmt.Sprintf("unittest-%d", rand.Uint64()),
-		metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge(), 50, true)
+		metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge(), 50, true, syncPolicy{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -95,7 +100,7 @@ func TestFreezerBasicsClosing(t *testing.T) {
 		f          *freezerTable
 		err        error
 	)
-	f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+	f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -104,7 +109,7 @@ func TestFreezerBasicsClosing(t *testing.T) {
 		data := getChunk(15, x)
 		f.Append(uint64(x), data)
 		f.Close()
-		f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -121,7 +126,7 @@ func TestFreezerBasicsClosing(t *testing.T) {
 			t.Fatalf("test %d, got \n%x != \n%x", y, got, exp)
 		}
 		f.Close()
-		f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -135,7 +140,7 @@ func TestFreezerRepairDanglingHead(t *testing.T) {
 	fname := fmt.Sprintf("dangling_headtest-%d", rand.Uint64())
 
 	{ // Fill table
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -164,7 +169,7 @@ func TestFreezerRepairDanglingHead(t *testing.T) {
 	idxFile.Close()
 	// Now open it again
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -186,7 +191,7 @@ func TestFreezerRepairDanglingHeadLarge(t *testing.T) {
 	fname := fmt.Sprintf("dangling_headtest-%d", rand.Uint64())
 
 	{ // Fill a table and close it
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -212,7 +217,7 @@ func TestFreezerRepairDanglingHeadLarge(t *testing.T) {
 	idxFile.Close()
 	// Now open it again
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -233,7 +238,7 @@ func TestFreezerRepairDanglingHeadLarge(t *testing.T) {
 	}
 	// And if we open it, we should now be able to read all of them (new values)
 	{
-		f, _ := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, _ := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		for y := 1; y < 255; y++ {
 			exp := getChunk(15, ^y)
 			got, err := f.Retrieve(uint64(y))
@@ -254,7 +259,7 @@ func TestSnappyDetection(t *testing.T) {
 	fname := fmt.Sprintf("snappytest-%d", rand.Uint64())
 	// Open with snappy
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -267,7 +272,7 @@ func TestSnappyDetection(t *testing.T) {
 	}
 	// Open without snappy
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, false)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, false, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -279,7 +284,7 @@ func TestSnappyDetection(t *testing.T) {
 
 	// Open with snappy
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -311,7 +316,7 @@ func TestFreezerRepairDanglingIndex(t *testing.T) {
 	fname := fmt.Sprintf("dangling_indextest-%d", rand.Uint64())
 
 	{ // Fill a table and close it
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -347,7 +352,7 @@ func TestFreezerRepairDanglingIndex(t *testing.T) {
 	// 45, 45, 15
 	// with 3+3+1 items
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -368,7 +373,7 @@ func TestFreezerTruncate(t *testing.T) {
 	fname := fmt.Sprintf("truncation-%d", rand.Uint64())
 
 	{ // Fill table
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -385,7 +390,7 @@ func TestFreezerTruncate(t *testing.T) {
 	}
 	// Reopen, truncate
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -410,7 +415,7 @@ func TestFreezerRepairFirstFile(t *testing.T) {
 	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
 	fname := fmt.Sprintf("truncationfirst-%d", rand.Uint64())
 	{ // Fill table
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -438,7 +443,7 @@ func TestFreezerRepairFirstFile(t *testing.T) {
 	}
 	// Reopen
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -466,7 +471,7 @@ func TestFreezerReadAndTruncate(t *testing.T) {
 	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
 	fname := fmt.Sprintf("read_truncate-%d", rand.Uint64())
 	{ // Fill table
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -483,7 +488,7 @@ func TestFreezerReadAndTruncate(t *testing.T) {
 	}
 	// Reopen and read all files
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -512,7 +517,7 @@ func TestOffset(t *testing.T) {
 	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
 	fname := fmt.Sprintf("offset-%d", rand.Uint64())
 	{ // Fill table
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 40, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 40, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -568,7 +573,7 @@ func TestOffset(t *testing.T) {
 	}
 	// Now open again
 	{
-		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 40, true)
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 40, true, syncPolicy{})
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -612,3 +617,1055 @@ func TestOffset(t *testing.T) {
 // However, all 'normal' failure modes arising due to failing to sync() or save a file should be
 // handled already, and the case described above can only (?) happen if an external process/user
 // deletes files from the filesystem.
+
+// TestFreezerOpenFilesLimit tests that the file handle cache keeps the number of
+// open data files within the configured limit while still serving all items.
+func TestFreezerOpenFilesLimit(t *testing.T) {
+	t.Parallel()
+	var (
+		fname      = fmt.Sprintf("openlimit-%d", rand.Uint64())
+		rm, wm, sg = metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+		om, cm     = metrics.NewMeterForced(), metrics.NewMeterForced()
+	)
+	f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if err := f.limitOpenFiles(4, om, cm); err != nil {
+		t.Fatal(err)
+	}
+	// Write 15 bytes 255 times, results in 85 files
+	for x := 0; x < 255; x++ {
+		if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+		if n := len(f.files); n > 4 {
+			t.Fatalf("open file count mismatch after append %d: have %d, want <= %d", x, n, 4)
+		}
+	}
+	// Read the items back in random order, ensuring the limit is not exceeded
+	for _, y := range rand.Perm(255) {
+		got, err := f.Retrieve(uint64(y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := getChunk(15, y); !bytes.Equal(got, exp) {
+			t.Fatalf("test %d, got \n%x != \n%x", y, got, exp)
+		}
+		if n := len(f.files); n > 4 {
+			t.Fatalf("open file count mismatch after read %d: have %d, want <= %d", y, n, 4)
+		}
+	}
+	if om.Count() == 0 || cm.Count() == 0 {
+		t.Errorf("file churn not metered: opened %d, closed %d", om.Count(), cm.Count())
+	}
+	// Truncating back into evicted files should still work, the explicitly
+	// released files must not be metered as evictions
+	closed := cm.Count()
+	if err := f.truncate(10); err != nil {
+		t.Fatal(err)
+	}
+	if cm.Count() != closed {
+		t.Errorf("explicit releases metered as evictions: have %d, want %d", cm.Count(), closed)
+	}
+	for y := 0; y < 10; y++ {
+		got, err := f.Retrieve(uint64(y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := getChunk(15, y); !bytes.Equal(got, exp) {
+			t.Fatalf("test %d, got \n%x != \n%x", y, got, exp)
+		}
+	}
+}
+
+// TestFreezerSyncPolicy tests that the appended data is flushed at the moments
+// required by the configured sync policy.
+func TestFreezerSyncPolicy(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+
+	var cases = []struct {
+		policy syncPolicy
+		synced []bool // Whether the table is expected to be flushed after each append
+	}{
+		{syncPolicy{mode: syncManual}, []bool{false, false, false, false, false}},
+		{syncPolicy{mode: syncAlways}, []bool{true, true, true, true, true}},
+		{syncPolicy{mode: syncInterval, interval: time.Hour}, []bool{false, false, false, false, false}},
+		{syncPolicy{mode: syncInterval}, []bool{true, true, true, true, true}},
+		// Write 15 bytes per item, 3 items fit in one file
+		{syncPolicy{mode: syncOnSeal}, []bool{false, false, false, true, false}},
+	}
+	for i, c := range cases {
+		fname := fmt.Sprintf("syncpolicy-%d", rand.Uint64())
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, c.policy)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x, want := range c.synced {
+			last := time.Now().Add(-time.Minute).UnixNano()
+			atomic.StoreInt64(&f.lastSync, last)
+			if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+				t.Fatal(err)
+			}
+			if synced := atomic.LoadInt64(&f.lastSync) != last; synced != want {
+				t.Errorf("case %d: append %d flush mismatch: have %v, want %v", i, x, synced, want)
+			}
+		}
+		f.Close()
+	}
+}
+
+// TestFreezerDropCache tests that a table evicting its data from the page cache
+// flushes the sealed files regardless of the sync policy and still serves all
+// the items.
+func TestFreezerDropCache(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	fname := fmt.Sprintf("dropcache-%d", rand.Uint64())
+
+	f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{mode: syncManual})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	f.setDropCache(true)
+
+	// Write 15 bytes per item, 3 items fit in one file
+	for x, want := range []bool{false, false, false, true, false, false, true} {
+		last := time.Now().Add(-time.Minute).UnixNano()
+		atomic.StoreInt64(&f.lastSync, last)
+		if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+		if synced := atomic.LoadInt64(&f.lastSync) != last; synced != want {
+			t.Errorf("append %d flush mismatch: have %v, want %v", x, synced, want)
+		}
+	}
+	if err := f.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for y := 0; y < 7; y++ {
+		got, err := f.Retrieve(uint64(y))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if exp := getChunk(15, y); !bytes.Equal(got, exp) {
+			t.Fatalf("test %d, got \n%x != \n%x", y, got, exp)
+		}
+	}
+}
+
+// TestFreezerItemSizes tests that both the stored and the decoded item sizes
+// are reported correctly, with and without compression.
+func TestFreezerItemSizes(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+
+	for _, noCompression := range []bool{true, false} {
+		fname := fmt.Sprintf("itemsizes-%d", rand.Uint64())
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, noCompression, syncPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Write 10 highly compressible items, spanning multiple data files
+		for x := 0; x < 10; x++ {
+			if err := f.Append(uint64(x), getChunk(30, x)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sizes, err := f.sizes(2, 5)
+		if err != nil {
+			t.Fatalf("failed to retrieve item sizes: %v", err)
+		}
+		if len(sizes) != 5 {
+			t.Fatalf("size count mismatch: have %d, want %d", len(sizes), 5)
+		}
+		for i, size := range sizes {
+			blob, _, _ := f.retrieve(uint64(2+i), true, nil)
+			if size.stored != uint32(len(blob)) {
+				t.Errorf("item %d, compression %v: stored size mismatch: have %d, want %d", 2+i, !noCompression, size.stored, len(blob))
+			}
+			if size.decoded != 30 {
+				t.Errorf("item %d, compression %v: decoded size mismatch: have %d, want %d", 2+i, !noCompression, size.decoded, 30)
+			}
+			if !noCompression && size.stored >= size.decoded {
+				t.Errorf("item %d: compressed size %d not smaller than decoded %d", 2+i, size.stored, size.decoded)
+			}
+		}
+		if _, err := f.sizes(8, 5); err != errOutOfBounds {
+			t.Errorf("compression %v: out of bounds error mismatch: have %v, want %v", !noCompression, err, errOutOfBounds)
+		}
+		f.Close()
+	}
+}
+
+// TestFreezerMigration tests that a compressed table is converted into a raw one
+// and that an interrupted migration is resumed.
+func TestFreezerMigration(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+
+	dir, err := ioutil.TempDir("", "freezer-migration")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a compressed table with items spanning multiple data files
+	f, err := newCustomTable(dir, "legacy", rm, wm, sg, 50, false, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 20; x++ {
+		if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	// Simulate an interrupted migration by copying a few items into the temporary
+	// table and corrupting its head.
+	tmp, err := newCustomTable(dir, "legacy"+migrationSuffix, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 7; x++ {
+		if err := tmp.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tmp.Close()
+	if err := os.Truncate(filepath.Join(dir, "legacy"+migrationSuffix+".0002.rdat"), 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := migrateTable(dir, "legacy", 50, true, 0); err != nil {
+		t.Fatalf("failed to migrate table: %v", err)
+	}
+	// Ensure only the migrated table is left behind and that it's intact
+	if files, _ := filepath.Glob(filepath.Join(dir, "*")); len(files) != 8 {
+		t.Fatalf("file count mismatch: have %d (%v), want %d", len(files), files, 8)
+	}
+	f, err = newCustomTable(dir, "legacy", rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for x := 0; x < 20; x++ {
+		blob, err := f.Retrieve(uint64(x))
+		if err != nil {
+			t.Fatalf("item %d: failed to retrieve: %v", x, err)
+		}
+		if !bytes.Equal(blob, getChunk(15, x)) {
+			t.Fatalf("item %d: data mismatch: have %x, want %x", x, blob, getChunk(15, x))
+		}
+	}
+	// Migrating an already migrated table should be a noop
+	if err := migrateTable(dir, "legacy", 50, true, 0); err != nil {
+		t.Fatalf("failed to rerun migration: %v", err)
+	}
+}
+
+// TestFreezerQuarantine tests that corrupted data files are quarantined, that
+// the quarantine survives restarts and that it's lifted by truncation.
+func TestFreezerQuarantine(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	fname := fmt.Sprintf("quarantine-%d", rand.Uint64())
+
+	// Fill a table with 3 items per data file and corrupt the second file
+	f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 9; x++ {
+		if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	if err := os.Truncate(filepath.Join(os.TempDir(), fmt.Sprintf("%s.0001.rdat", fname)), 5); err != nil {
+		t.Fatal(err)
+	}
+	f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported []uint64
+	f.corrupted = func(item uint64, err error) { reported = append(reported, item) }
+
+	if _, err := f.Retrieve(4); err == nil {
+		t.Fatalf("corrupted item retrieved")
+	} else if _, ok := err.(*corruptionError); !ok {
+		t.Fatalf("corruption error mismatch: have %v", err)
+	}
+	if _, err := f.Retrieve(3); err != errQuarantined {
+		t.Fatalf("quarantine error mismatch: have %v, want %v", err, errQuarantined)
+	}
+	if len(reported) != 1 || reported[0] != 4 {
+		t.Fatalf("reported corruptions mismatch: have %v, want %v", reported, []uint64{4})
+	}
+	if _, err := f.Retrieve(7); err != nil {
+		t.Fatalf("failed to retrieve healthy item: %v", err)
+	}
+	f.Close()
+
+	// Reopen the table and ensure the quarantine is retained
+	f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.Retrieve(5); err != errQuarantined {
+		t.Fatalf("quarantine error mismatch after restart: have %v, want %v", err, errQuarantined)
+	}
+	// Truncate the corrupted file away and refill it
+	if err := f.truncate(3); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(os.TempDir(), quarantineName(fname))); !os.IsNotExist(err) {
+		t.Fatalf("quarantine not lifted: %v", err)
+	}
+	for x := 3; x < 9; x++ {
+		if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for x := 0; x < 9; x++ {
+		blob, err := f.Retrieve(uint64(x))
+		if err != nil {
+			t.Fatalf("item %d: failed to retrieve: %v", x, err)
+		}
+		if !bytes.Equal(blob, getChunk(15, x)) {
+			t.Fatalf("item %d: data mismatch: have %x, want %x", x, blob, getChunk(15, x))
+		}
+	}
+}
+
+// TestFreezerQuarantineHead tests that truncating within a quarantined head file
+// lifts its quarantine, so the truncated items can be refilled.
+func TestFreezerQuarantineHead(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	fname := fmt.Sprintf("quarantine-head-%d", rand.Uint64())
+
+	// Fill a table with 3 items per data file and tear the last item off the head
+	// file underneath the live table
+	f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for x := 0; x < 9; x++ {
+		if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Truncate(filepath.Join(os.TempDir(), fmt.Sprintf("%s.0002.rdat", fname)), 40); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := f.Retrieve(8); err == nil {
+		t.Fatalf("corrupted item retrieved")
+	}
+	if _, err := f.Retrieve(6); err != errQuarantined {
+		t.Fatalf("quarantine error mismatch: have %v, want %v", err, errQuarantined)
+	}
+	// Truncate the corrupted item away, keeping the head file, and refill it
+	if err := f.truncate(8); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(os.TempDir(), quarantineName(fname))); !os.IsNotExist(err) {
+		t.Fatalf("quarantine not lifted: %v", err)
+	}
+	if err := f.Append(8, getChunk(15, 8)); err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 9; x++ {
+		blob, err := f.Retrieve(uint64(x))
+		if err != nil {
+			t.Fatalf("item %d: failed to retrieve: %v", x, err)
+		}
+		if !bytes.Equal(blob, getChunk(15, x)) {
+			t.Fatalf("item %d: data mismatch: have %x, want %x", x, blob, getChunk(15, x))
+		}
+	}
+}
+
+// TestFreezerTableCheck tests that both the sampled and the full integrity checks
+// detect and quarantine corrupted data files, leaving the healthy ones be.
+func TestFreezerTableCheck(t *testing.T) {
+	t.Parallel()
+
+	for _, full := range []bool{false, true} {
+		rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+		fname := fmt.Sprintf("check-%d", rand.Uint64())
+
+		// Fill a table with 3 items per data file and ensure it checks out
+		f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x := 0; x < 12; x++ {
+			if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		result, err := f.check(full, 2, rand.New(rand.NewSource(1)))
+		if err != nil {
+			t.Fatalf("full %v: failed to check healthy table: %v", full, err)
+		}
+		if result.corrupt != 0 {
+			t.Fatalf("full %v: healthy table reported corrupt: %d files", full, result.corrupt)
+		}
+		if full && result.items != 12 {
+			t.Fatalf("full %v: checked items mismatch: have %d, want %d", full, result.items, 12)
+		}
+		f.Close()
+
+		// Corrupt the second data file and ensure it gets quarantined
+		if err := os.Truncate(filepath.Join(os.TempDir(), fmt.Sprintf("%s.0001.rdat", fname)), 5); err != nil {
+			t.Fatal(err)
+		}
+		f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result, err = f.check(full, 2, rand.New(rand.NewSource(1))); err != nil {
+			t.Fatalf("full %v: failed to check corrupted table: %v", full, err)
+		}
+		if result.corrupt != 1 {
+			t.Fatalf("full %v: corrupted files mismatch: have %d, want %d", full, result.corrupt, 1)
+		}
+		if _, err := f.Retrieve(3); err != errQuarantined {
+			t.Fatalf("full %v: quarantine error mismatch: have %v, want %v", full, err, errQuarantined)
+		}
+		for _, x := range []uint64{0, 2, 6, 11} {
+			if _, err := f.Retrieve(x); err != nil {
+				t.Fatalf("full %v: failed to retrieve healthy item %d: %v", full, x, err)
+			}
+		}
+		f.Close()
+	}
+}
+
+// TestFreezerRechunk tests that a table can be re-chunked into smaller data files
+// while keeping its items, that the new size outlives restarts and that an
+// interrupted swap of the files is finished on open.
+func TestFreezerRechunk(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	fname := fmt.Sprintf("rechunk-%d", rand.Uint64())
+
+	// Fill a table with 3 items per data file and delete one of them
+	f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 20; x++ {
+		if err := f.Append(uint64(x), getChunk(15, x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Delete(4); err != nil {
+		t.Fatal(err)
+	}
+	verify := func(items int, files uint32) {
+		t.Helper()
+		for x := 0; x < items; x++ {
+			blob, err := f.Retrieve(uint64(x))
+			if x == 4 {
+				if err != errDeleted {
+					t.Fatalf("item %d: deletion error mismatch: have %v, want %v", x, err, errDeleted)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("item %d: failed to retrieve: %v", x, err)
+			}
+			if !bytes.Equal(blob, getChunk(15, x)) {
+				t.Fatalf("item %d: data mismatch: have %x, want %x", x, blob, getChunk(15, x))
+			}
+		}
+		if have := f.headId - f.tailId + 1; have != files {
+			t.Fatalf("data files mismatch: have %d, want %d", have, files)
+		}
+	}
+	// Re-chunk the table into one item per data file (the deleted item being
+	// copied empty, along with its predecessor) and keep appending
+	var lock sync.Mutex
+	if err := f.rechunk(20, &lock); err != nil {
+		t.Fatalf("failed to re-chunk table: %v", err)
+	}
+	verify(20, 19)
+	if err := f.Append(20, getChunk(15, 20)); err != nil {
+		t.Fatalf("failed to append after re-chunking: %v", err)
+	}
+	verify(21, 20)
+	f.Close()
+
+	// Reopen the table and ensure the new file size is retained
+	if f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 50, true, syncPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	if f.maxFileSize != 20 {
+		t.Fatalf("data file size mismatch after restart: have %d, want %d", f.maxFileSize, 20)
+	}
+	verify(21, 20)
+
+	// Copy the table back into larger files and crash before swapping them
+	dst, err := f.openRechunkTable(50, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.copyRechunk(dst); err != nil {
+		t.Fatal(err)
+	}
+	dst.Close()
+	f.Close()
+	if err := storeRechunk(os.TempDir(), fname, 50, rechunkDeleting); err != nil {
+		t.Fatal(err)
+	}
+	if f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 20, true, syncPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.maxFileSize != 50 {
+		t.Fatalf("data file size mismatch after recovery: have %d, want %d", f.maxFileSize, 50)
+	}
+	verify(21, 7)
+}
+
+// Tests that items can be retrieved into reused caller buffers from both raw and
+// compressed tables, without the results aliasing each other or internal state.
+func TestFreezerRetrieveInto(t *testing.T) {
+	t.Parallel()
+
+	for _, noCompression := range []bool{true, false} {
+		f, err := newCustomTable(os.TempDir(), fmt.Sprintf("retrieveinto-%d", rand.Uint64()),
+			metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge(), 50, noCompression, syncPolicy{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for x := 0; x < 32; x++ {
+			f.Append(uint64(x), getChunk(15, x))
+		}
+		buf := make([]byte, 0, 32)
+		for y := 0; y < 32; y++ {
+			blob, err := f.RetrieveInto(uint64(y), buf)
+			if err != nil {
+				t.Fatalf("compression %v, item %d: failed to retrieve: %v", !noCompression, y, err)
+			}
+			if exp := getChunk(15, y); !bytes.Equal(blob, exp) {
+				t.Fatalf("compression %v, item %d: content mismatch: have %x, want %x", !noCompression, y, blob, exp)
+			}
+			if &blob[:1][0] != &buf[:1][0] {
+				t.Fatalf("compression %v, item %d: buffer not reused", !noCompression, y)
+			}
+			// Scribble over the result, it must not affect any later read
+			for i := range blob {
+				blob[i] = 0xff
+			}
+		}
+		// Too small buffers should be grown, leaving the original untouched
+		small := make([]byte, 0, 4)
+		blob, err := f.RetrieveInto(1, small)
+		if err != nil {
+			t.Fatalf("compression %v: failed to retrieve into small buffer: %v", !noCompression, err)
+		}
+		if exp := getChunk(15, 1); !bytes.Equal(blob, exp) {
+			t.Fatalf("compression %v: content mismatch: have %x, want %x", !noCompression, blob, exp)
+		}
+		if have, err := f.Retrieve(2); err != nil || !bytes.Equal(have, getChunk(15, 2)) {
+			t.Fatalf("compression %v: content mismatch after reuse: have %x, want %x (err %v)", !noCompression, have, getChunk(15, 2), err)
+		}
+		f.Close()
+	}
+}
+
+// Tests that small items are stored in the index of inlining tables, surviving
+// reopens and truncations, while legacy tables keep their layout.
+func TestFreezerInline(t *testing.T) {
+	t.Parallel()
+
+	var (
+		dir        = os.TempDir()
+		fname      = fmt.Sprintf("inline-%d", rand.Uint64())
+		rm, wm, sg = metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	)
+	// Alternate inlined and regular items, the regular ones rolling files
+	size := func(x int) int {
+		if x%2 == 0 {
+			return 8
+		}
+		return 20
+	}
+	f, err := newInlineTable(dir, fname, rm, wm, sg, 50, true, syncPolicy{}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 20; x++ {
+		if err := f.Append(uint64(x), getChunk(size(x), x)); err != nil {
+			t.Fatalf("item %d: failed to append: %v", x, err)
+		}
+	}
+	// Only the regular items should reach the data files
+	if f.headId != 4 || f.headBytes != 40 {
+		t.Fatalf("data file layout mismatch: have file %d at %d, want file %d at %d", f.headId, f.headBytes, 4, 40)
+	}
+	check := func(items int) {
+		for x := 0; x < items; x++ {
+			blob, err := f.Retrieve(uint64(x))
+			if err != nil {
+				t.Fatalf("item %d: failed to retrieve: %v", x, err)
+			}
+			if exp := getChunk(size(x), x); !bytes.Equal(blob, exp) {
+				t.Fatalf("item %d: content mismatch: have %x, want %x", x, blob, exp)
+			}
+		}
+		if _, err := f.Retrieve(uint64(items)); err == nil {
+			t.Fatalf("item %d: retrieved beyond the end", items)
+		}
+	}
+	check(20)
+
+	// Reopen the table and truncate into the middle of an inlined run
+	f.Close()
+	if f, err = newInlineTable(dir, fname, rm, wm, sg, 50, true, syncPolicy{}, 16); err != nil {
+		t.Fatal(err)
+	}
+	check(20)
+	if err := f.truncate(9); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	check(9)
+	f.Close()
+
+	// Legacy tables must be opened in their original format
+	legacy := fmt.Sprintf("inline-legacy-%d", rand.Uint64())
+	if f, err = newCustomTable(dir, legacy, rm, wm, sg, 50, true, syncPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	f.Append(0, getChunk(8, 0))
+	f.Close()
+
+	if f, err = newInlineTable(dir, legacy, rm, wm, sg, 50, true, syncPolicy{}, 16); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if f.inline != 0 {
+		t.Fatalf("legacy table opened with inlining")
+	}
+	if blob, err := f.Retrieve(0); err != nil || !bytes.Equal(blob, getChunk(8, 0)) {
+		t.Fatalf("legacy content mismatch: have %x, want %x (err %v)", blob, getChunk(8, 0), err)
+	}
+	// Tables with inlined items must not be opened with inlining disabled
+	if f, err := newCustomTable(dir, fname, rm, wm, sg, 50, true, syncPolicy{}); err == nil {
+		f.Close()
+		t.Fatalf("inlined table opened with inlining disabled")
+	}
+	inlined, err := newInlineTable(dir, fname, rm, wm, sg, 50, true, syncPolicy{}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inlined.Close()
+	if inlined.items != 9 {
+		t.Fatalf("inlined table damaged by refused open: have %d items, want %d", inlined.items, 9)
+	}
+}
+
+// TestFreezerMigrationInline tests that tables storing items in their index are
+// migrated into the same layout, and only if inlining is enabled.
+func TestFreezerMigrationInline(t *testing.T) {
+	t.Parallel()
+	rm, wm, sg := metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+
+	dir, err := ioutil.TempDir("", "freezer-migration-inline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Create a compressed table with both inlined and regular items
+	size := func(x int) int {
+		if x%2 == 0 {
+			return 4
+		}
+		return 40
+	}
+	f, err := newInlineTable(dir, "inline", rm, wm, sg, 50, false, syncPolicy{}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 10; x++ {
+		if err := f.Append(uint64(x), getChunk(size(x), x)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+
+	if err := migrateTable(dir, "inline", 50, true, 0); err == nil {
+		t.Fatalf("inlined table migrated with inlining disabled")
+	}
+	if err := migrateTable(dir, "inline", 50, true, 16); err != nil {
+		t.Fatalf("failed to migrate table: %v", err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(dir, "inline.*.cdat")); len(files) != 0 {
+		t.Fatalf("legacy data files left behind: %v", files)
+	}
+	f, err = newInlineTable(dir, "inline", rm, wm, sg, 50, true, syncPolicy{}, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.inline != 16 {
+		t.Fatalf("migrated table inline limit mismatch: have %d, want %d", f.inline, 16)
+	}
+	for x := 0; x < 10; x++ {
+		blob, err := f.Retrieve(uint64(x))
+		if err != nil {
+			t.Fatalf("item %d: failed to retrieve: %v", x, err)
+		}
+		if !bytes.Equal(blob, getChunk(size(x), x)) {
+			t.Fatalf("item %d: data mismatch: have %x, want %x", x, blob, getChunk(size(x), x))
+		}
+	}
+}
+
+// TestFreezerTombstones tests that individual items can be deleted, that their
+// space is reclaimed by compacting the sealed data files and that the deletions
+// survive restarts.
+func TestFreezerTombstones(t *testing.T) {
+	t.Parallel()
+
+	var (
+		dir        = os.TempDir()
+		fname      = fmt.Sprintf("tombstones-%d", rand.Uint64())
+		rm, wm, sg = metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	)
+	// Write 15 bytes 30 times, 3 items per data file
+	f, err := newCustomTable(dir, fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for x := 0; x < 30; x++ {
+		f.Append(uint64(x), getChunk(15, x))
+	}
+	deleted := map[uint64]bool{1: true, 4: true, 5: true, 28: true}
+	for item := range deleted {
+		if err := f.Delete(item); err != nil {
+			t.Fatalf("item %d: failed to delete: %v", item, err)
+		}
+	}
+	if err := f.Delete(30); err != errOutOfBounds {
+		t.Fatalf("out of bounds deletion error mismatch: have %v, want %v", err, errOutOfBounds)
+	}
+	check := func(items uint64) {
+		for x := uint64(0); x < items; x++ {
+			blob, err := f.Retrieve(x)
+			if deleted[x] {
+				if err != errDeleted || f.has(x) {
+					t.Fatalf("item %d: deleted item served: %x, %v", x, blob, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("item %d: failed to retrieve: %v", x, err)
+			}
+			if !bytes.Equal(blob, getChunk(15, int(x))) {
+				t.Fatalf("item %d: content mismatch: %x", x, blob)
+			}
+		}
+	}
+	check(30)
+
+	// Compact the table, the deleted item in the head file should be left alone
+	reclaimed, err := f.compact()
+	if err != nil {
+		t.Fatalf("failed to compact: %v", err)
+	}
+	if reclaimed != 45 {
+		t.Fatalf("reclaimed size mismatch: have %d, want %d", reclaimed, 45)
+	}
+	for num, want := range map[uint32]int64{0: 30, 1: 15, 2: 45, 9: 45} {
+		stat, err := os.Stat(f.dataFileName(num))
+		if err != nil {
+			t.Fatalf("file %d: failed to stat: %v", num, err)
+		}
+		if stat.Size() != want {
+			t.Fatalf("file %d: size mismatch: have %d, want %d", num, stat.Size(), want)
+		}
+	}
+	check(30)
+	if reclaimed, err := f.compact(); err != nil || reclaimed != 0 {
+		t.Fatalf("repeated compaction mismatch: have %d/%v, want 0/nil", reclaimed, err)
+	}
+	// Reopen the table, the deletions should persist
+	f.Close()
+	if f, err = newCustomTable(dir, fname, rm, wm, sg, 50, true, syncPolicy{}); err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	check(30)
+
+	// Truncate the deleted head item away, it should be refillable
+	if err := f.truncate(28); err != nil {
+		t.Fatalf("failed to truncate: %v", err)
+	}
+	delete(deleted, 28)
+	for x := 28; x < 30; x++ {
+		f.Append(uint64(x), getChunk(15, x))
+	}
+	check(30)
+}
+
+// TestFreezerRetention tests that the items beyond the retention of a table are
+// deleted in batches as the table grows, notifying the retention hook.
+func TestFreezerRetention(t *testing.T) {
+	t.Parallel()
+
+	var (
+		fname      = fmt.Sprintf("retention-%d", rand.Uint64())
+		rm, wm, sg = metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	)
+	f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 4096, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var tails []uint64
+	if err := f.setRetention(ethdb.AncientRetention{Items: 10}); err != nil {
+		t.Fatalf("failed to set retention: %v", err)
+	}
+	f.retention.hook = func(tail uint64) { tails = append(tails, tail) }
+
+	items := uint64(10 + 2*retentionBatch + 5)
+	for x := uint64(0); x < items; x++ {
+		if err := f.Append(x, getChunk(4, int(x))); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.enforceRetention(); err != nil {
+			t.Fatalf("item %d: failed to enforce retention: %v", x, err)
+		}
+	}
+	if want := []uint64{retentionBatch, 2 * retentionBatch}; !reflect.DeepEqual(tails, want) {
+		t.Fatalf("retention tails mismatch: have %v, want %v", tails, want)
+	}
+	for x := uint64(0); x < items; x++ {
+		blob, err := f.Retrieve(x)
+		if x < 2*retentionBatch {
+			if err != errDeleted {
+				t.Fatalf("item %d: expired item served: %x, %v", x, blob, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(blob, getChunk(4, int(x))) {
+			t.Fatalf("item %d: retained item mismatch: %x, %v", x, blob, err)
+		}
+	}
+}
+
+// TestFreezerRetentionLimits tests that the items beyond the size and the age
+// limits of a table are deleted, and that the policy survives a restart.
+func TestFreezerRetentionLimits(t *testing.T) {
+	t.Parallel()
+
+	var (
+		fname      = fmt.Sprintf("retention-limits-%d", rand.Uint64())
+		rm, wm, sg = metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	)
+	// Retain 100 items of 4 bytes, spanning multiple data files
+	f, err := newCustomTable(os.TempDir(), fname, rm, wm, sg, 256, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.setRetention(ethdb.AncientRetention{Bytes: 400}); err != nil {
+		t.Fatalf("failed to set retention: %v", err)
+	}
+	var tails []uint64
+	f.retention.hook = func(tail uint64) { tails = append(tails, tail) }
+
+	items := uint64(100 + 2*retentionBatch)
+	for x := uint64(0); x < items; x++ {
+		if err := f.Append(x, getChunk(4, int(x))); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.enforceRetention(); err != nil {
+			t.Fatalf("item %d: failed to enforce retention: %v", x, err)
+		}
+	}
+	if want := []uint64{retentionBatch, 2 * retentionBatch}; !reflect.DeepEqual(tails, want) {
+		t.Fatalf("retention tails mismatch: have %v, want %v", tails, want)
+	}
+	// Reopen the table and expire the items by age instead
+	f.Close()
+	f, err = newCustomTable(os.TempDir(), fname, rm, wm, sg, 256, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if f.retention.policy.Bytes != 400 || f.retention.tail != 2*retentionBatch {
+		t.Fatalf("retention not persisted: policy %+v, tail %d", f.retention.policy, f.retention.tail)
+	}
+	if err := f.setRetention(ethdb.AncientRetention{Age: time.Hour}); err != nil {
+		t.Fatalf("failed to set retention: %v", err)
+	}
+	for x := items; x < items+2*retentionBatch; x++ {
+		if err := f.Append(x, getChunk(4, int(x))); err != nil {
+			t.Fatal(err)
+		}
+		if err := f.enforceRetention(); err != nil {
+			t.Fatalf("item %d: failed to enforce retention: %v", x, err)
+		}
+	}
+	if f.retention.tail != 2*retentionBatch {
+		t.Fatalf("recent items expired: tail %d", f.retention.tail)
+	}
+	if len(f.retention.marks) != 2 {
+		t.Fatalf("append time marks mismatch: have %d, want %d", len(f.retention.marks), 2)
+	}
+	// Age both batches beyond the limit, expiring the items below the last mark
+	f.retention.marks[0].time = time.Now().Add(-2 * time.Hour).UnixNano()
+	f.retention.marks[1].time = time.Now().Add(-2 * time.Hour).UnixNano()
+	if err := f.enforceRetention(); err != nil {
+		t.Fatalf("failed to enforce retention: %v", err)
+	}
+	if want := items + 1 + retentionBatch; f.retention.tail != want {
+		t.Fatalf("expired tail mismatch: have %d, want %d", f.retention.tail, want)
+	}
+	if _, err := f.Retrieve(f.retention.tail - 1); err != errDeleted {
+		t.Fatalf("expired item error mismatch: have %v, want %v", err, errDeleted)
+	}
+	if _, err := f.Retrieve(f.retention.tail); err != nil {
+		t.Fatalf("failed to retrieve retained item: %v", err)
+	}
+}
+
+// Tests that a table exported while being appended to can be opened and serves
+// exactly the items recorded by the extent.
+func TestFreezerTableExport(t *testing.T) {
+	t.Parallel()
+
+	var (
+		dir        = os.TempDir()
+		fname      = fmt.Sprintf("export-%d", rand.Uint64())
+		rm, wm, sg = metrics.NewMeter(), metrics.NewMeter(), metrics.NewGauge()
+	)
+	// Write 15 bytes 20 times, 3 items per data file
+	f, err := newCustomTable(dir, fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	for x := 0; x < 20; x++ {
+		f.Append(uint64(x), getChunk(15, x))
+	}
+	if err := f.Delete(4); err != nil {
+		t.Fatalf("failed to delete item: %v", err)
+	}
+	extent, err := f.extent()
+	if err != nil {
+		t.Fatalf("failed to record extent: %v", err)
+	}
+	// Keep appending after the extent was recorded, the items must not leak into
+	// the export
+	for x := 20; x < 30; x++ {
+		f.Append(uint64(x), getChunk(15, x))
+	}
+	export, err := ioutil.TempDir("", "freezer-export-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(export)
+
+	if err := f.export(export, extent); err != nil {
+		t.Fatalf("failed to export table: %v", err)
+	}
+	exported, err := newCustomTable(export, fname, rm, wm, sg, 50, true, syncPolicy{})
+	if err != nil {
+		t.Fatalf("failed to open exported table: %v", err)
+	}
+	defer exported.Close()
+
+	if items := atomic.LoadUint64(&exported.items); items != 20 {
+		t.Fatalf("exported items mismatch: have %d, want 20", items)
+	}
+	for x := uint64(0); x < 20; x++ {
+		blob, err := exported.Retrieve(x)
+		if x == 4 {
+			if err != errDeleted {
+				t.Fatalf("item %d: deleted item served: %x, %v", x, blob, err)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(blob, getChunk(15, int(x))) {
+			t.Fatalf("item %d: exported item mismatch: %x, %v", x, blob, err)
+		}
+	}
+	// Ensure the export refuses to overwrite existing files
+	if err := f.export(export, extent); err == nil {
+		t.Fatalf("export overwrote existing files")
+	}
+}
+
+// Tests that the configured sync modes of the freezer override the default flush
+// policies of the listed tables only.
+func TestFreezerSyncMode(t *testing.T) {
+	var (
+		always   = FreezerSync{Mode: FreezerSyncAlways}
+		interval = FreezerSync{Mode: FreezerSyncInterval, Interval: time.Second}
+	)
+	tests := []struct {
+		config   FreezerConfig
+		policies map[string]syncPolicy
+	}{
+		{FreezerConfig{}, nil},
+		{
+			FreezerConfig{Sync: map[string]FreezerSync{freezerBodiesTable: always}},
+			map[string]syncPolicy{freezerBodiesTable: {mode: syncAlways}},
+		},
+		{
+			FreezerConfig{Sync: map[string]FreezerSync{freezerHeaderTable: interval, freezerReceiptTable: always}},
+			map[string]syncPolicy{
+				freezerHeaderTable:  {mode: syncInterval, interval: time.Second},
+				freezerReceiptTable: {mode: syncAlways},
+			},
+		},
+	}
+	for i, tt := range tests {
+		dir, err := ioutil.TempDir("", "freezer")
+		if err != nil {
+			t.Fatalf("test %d: failed to create temp dir: %v", i, err)
+		}
+		db, err := NewDatabaseWithFreezerConfig(NewMemoryDatabase(), dir, "", tt.config)
+		if err != nil {
+			os.RemoveAll(dir)
+			t.Fatalf("test %d: failed to open freezer: %v", i, err)
+		}
+		f := db.(*freezerdb).freezer
+		for name, table := range f.tables {
+			want, ok := tt.policies[name]
+			if !ok {
+				want = freezerSyncPolicy[name]
+			}
+			if table.sync != want {
+				t.Errorf("test %d: table %s policy mismatch: have %+v, want %+v", i, name, table.sync, want)
+			}
+		}
+		if err := f.Sync(); err != nil {
+			t.Errorf("test %d: failed to sync freezer: %v", i, err)
+		}
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
@@ -0,0 +1,400 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// errDeleted is returned if the item requested was logically deleted from the
+// freezer table.
+var errDeleted = errors.New("item deleted")
+
+// tombstones is a bitmap of the logically deleted items of a freezer table. The
+// bitmap only spans the range between the lowest and the highest deleted item,
+// so sparse deletions at the chain head don't cost a bit for every item below.
+type tombstones struct {
+	base uint64 // Number of the item represented by the first bit, multiple of 8
+	bits []byte // Bitmap of the deleted items, starting at base
+}
+
+// has returns whether the given item is deleted.
+func (ts *tombstones) has(item uint64) bool {
+	if item < ts.base {
+		return false
+	}
+	idx := (item - ts.base) / 8
+	if idx >= uint64(len(ts.bits)) {
+		return false
+	}
+	return ts.bits[idx]&(1<<((item-ts.base)%8)) != 0
+}
+
+// set marks the given item as deleted, extending the bitmap if needed.
+func (ts *tombstones) set(item uint64) {
+	if len(ts.bits) == 0 {
+		ts.base = item &^ 7
+	}
+	if item < ts.base {
+		shift := (ts.base - item&^7) / 8
+		ts.bits = append(make([]byte, shift), ts.bits...)
+		ts.base = item &^ 7
+	}
+	idx := (item - ts.base) / 8
+	for uint64(len(ts.bits)) <= idx {
+		ts.bits = append(ts.bits, 0)
+	}
+	ts.bits[idx] |= 1 << ((item - ts.base) % 8)
+}
+
+// truncate drops the tombstones of the items at or above the given number,
+// returning whether anything was dropped.
+func (ts *tombstones) truncate(items uint64) bool {
+	var dropped bool
+	for len(ts.bits) > 0 {
+		last := len(ts.bits) - 1
+		first := ts.base + uint64(last)*8
+		if first+8 <= items {
+			break
+		}
+		var mask byte
+		if first < items {
+			mask = byte(1)<<(items-first) - 1
+		}
+		if ts.bits[last]&^mask != 0 {
+			dropped = true
+		}
+		if ts.bits[last] &= mask; ts.bits[last] != 0 {
+			break
+		}
+		ts.bits = ts.bits[:last]
+	}
+	return dropped
+}
+
+// count returns the number of deleted items.
+func (ts *tombstones) count() int {
+	var n int
+	for _, b := range ts.bits {
+		n += bits.OnesCount8(b)
+	}
+	return n
+}
+
+// tombstoneName returns the name of the file persisting the deleted items of a
+// freezer table.
+func tombstoneName(name string) string {
+	return fmt.Sprintf("%s.tomb", name)
+}
+
+// loadTombstones reads the deleted items of a freezer table, stored as the 64 bit
+// big endian number of the first item followed by the bitmap.
+func loadTombstones(path, name string) (*tombstones, error) {
+	blob, err := ioutil.ReadFile(filepath.Join(path, tombstoneName(name)))
+	if os.IsNotExist(err) {
+		return new(tombstones), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < 8 {
+		return nil, fmt.Errorf("invalid tombstone file: %d bytes", len(blob))
+	}
+	return &tombstones{
+		base: binary.BigEndian.Uint64(blob),
+		bits: blob[8:],
+	}, nil
+}
+
+// storeTombstones persists the deleted items of a freezer table, replacing the
+// previous bitmap atomically. The file is deleted if nothing is deleted.
+func storeTombstones(path, name string, ts *tombstones) error {
+	file := filepath.Join(path, tombstoneName(name))
+	if len(ts.bits) == 0 {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	blob := make([]byte, 8+len(ts.bits))
+	binary.BigEndian.PutUint64(blob, ts.base)
+	copy(blob[8:], ts.bits)
+
+	if err := ioutil.WriteFile(file+".tmp", blob, 0644); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
+
+// compactionName returns the name of the journal of an in-progress compaction
+// of a freezer table.
+func compactionName(name string) string {
+	return fmt.Sprintf("%s.compact", name)
+}
+
+// dataFileName returns the path of the given data file of the table.
+func (t *freezerTable) dataFileName(num uint32) string {
+	_, dat := tableExtensions(t.noCompression)
+	return filepath.Join(t.path, fmt.Sprintf("%s.%04d.%s", t.name, num, dat))
+}
+
+// Delete logically deletes an item from the table, leaving all the other items
+// in place. The item is not served anymore (errDeleted is returned instead), and
+// the space it occupies is reclaimed by the next compaction of its data file.
+func (t *freezerTable) Delete(item uint64) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil || t.head == nil {
+		return errClosed
+	}
+	if atomic.LoadUint64(&t.items) <= item || uint64(t.itemOffset) > item {
+		return errOutOfBounds
+	}
+	if t.tombstones.has(item) {
+		return nil
+	}
+	t.tombstones.set(item)
+	return storeTombstones(t.path, t.name, t.tombstones)
+}
+
+// compactEntry is an item of a data file being compacted.
+type compactEntry struct {
+	item   uint64 // Number of the item
+	start  uint32 // Offset of the item in the original data file
+	end    uint32 // End of the item in the original data file
+	inline []byte // Item stored in the index entry, if any
+}
+
+// compact rewrites the sealed data files containing deleted items without them,
+// reclaiming their space. The head file is never compacted, as it's still being
+// appended to. It returns the number of bytes reclaimed.
+//
+// The new index entries are journalled before replacing a data file, so that a
+// compaction interrupted by a crash is finished the next time the table opens.
+func (t *freezerTable) compact() (uint64, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.index == nil || t.head == nil {
+		return 0, errClosed
+	}
+	if t.tombstones.count() == 0 {
+		return 0, nil
+	}
+	stat, err := t.index.Stat()
+	if err != nil {
+		return 0, err
+	}
+	var (
+		reader = bufio.NewReader(io.NewSectionReader(t.index, t.entrySize, stat.Size()-t.entrySize))
+		buffer = make([]byte, t.entrySize)
+
+		reclaimed uint64
+		filenum   uint32         // Data file the entries are collected from
+		first     uint64         // Position of the first collected entry in the index
+		group     []compactEntry // Entries of the data file being collected
+		deleted   bool           // Whether any of the collected items are deleted
+		prev      indexEntry     // Previous index entry, for the item start offsets
+	)
+	flush := func() error {
+		if !deleted || filenum >= t.headId {
+			return nil
+		}
+		if _, ok := t.quarantine[filenum]; ok {
+			return nil
+		}
+		saved, err := t.compactFile(filenum, first, group)
+		if err != nil {
+			return err
+		}
+		reclaimed += saved
+		return nil
+	}
+	for pos := uint64(1); ; pos++ {
+		if _, err := io.ReadFull(reader, buffer); err == io.EOF {
+			break
+		} else if err != nil {
+			return reclaimed, err
+		}
+		var entry indexEntry
+		if err := entry.unmarshalBinary(buffer); err != nil {
+			return reclaimed, err
+		}
+		if pos == 1 || entry.filenum != filenum {
+			if err := flush(); err != nil {
+				return reclaimed, err
+			}
+			filenum, first, group, deleted = entry.filenum, pos, group[:0], false
+		}
+		item := uint64(t.itemOffset) + pos - 1
+		start := prev.offset
+		if pos == 1 || prev.filenum != entry.filenum {
+			start = 0
+		}
+		group = append(group, compactEntry{
+			item:   item,
+			start:  start,
+			end:    entry.offset,
+			inline: common.CopyBytes(entry.inline),
+		})
+		if entry.inline == nil && entry.offset > start && t.tombstones.has(item) {
+			deleted = true
+		}
+		prev = entry
+	}
+	if err := flush(); err != nil {
+		return reclaimed, err
+	}
+	if reclaimed > 0 {
+		t.logger.Info("Compacted freezer table", "reclaimed", common.StorageSize(reclaimed))
+	}
+	return reclaimed, nil
+}
+
+// compactFile rewrites a single sealed data file without its deleted items and
+// updates the index entries of all the items in it, which are located at the
+// given position of the index onwards. Assumes that the write lock is held.
+func (t *freezerTable) compactFile(filenum uint32, first uint64, group []compactEntry) (uint64, error) {
+	name := t.dataFileName(filenum)
+
+	src, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := openFreezerFileTruncated(name + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	var (
+		offset  uint32
+		entries = make([]byte, 0, int64(len(group))*t.entrySize)
+		buffer  []byte
+	)
+	for _, entry := range group {
+		if entry.inline == nil && !t.tombstones.has(entry.item) {
+			size := entry.end - entry.start
+			if uint32(cap(buffer)) < size {
+				buffer = make([]byte, size)
+			}
+			if _, err := src.ReadAt(buffer[:size], int64(entry.start)); err != nil {
+				dst.Close()
+				return 0, err
+			}
+			if _, err := dst.Write(buffer[:size]); err != nil {
+				dst.Close()
+				return 0, err
+			}
+			offset += size
+		}
+		entries = append(entries, t.marshall(&indexEntry{filenum: filenum, offset: offset, inline: entry.inline})...)
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return 0, err
+	}
+	if err := dst.Close(); err != nil {
+		return 0, err
+	}
+	// Journal the new index entries, then swap the data file and update the index
+	journal := make([]byte, 8+len(entries))
+	binary.BigEndian.PutUint64(journal, first)
+	copy(journal[8:], entries)
+
+	file := filepath.Join(t.path, compactionName(t.name))
+	if err := ioutil.WriteFile(file+".tmp", journal, 0644); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return 0, err
+	}
+	t.releaseFile(filenum)
+	if err := t.finishCompaction(first, entries); err != nil {
+		return 0, err
+	}
+	// Reopen the data file for the readers if all files are kept open
+	if t.recent == nil {
+		if _, err := t.openFile(filenum, openFreezerFileForReadOnly); err != nil {
+			return 0, err
+		}
+	}
+	return uint64(group[len(group)-1].end - offset), nil
+}
+
+// finishCompaction replaces the compacted data file with its rewritten version
+// if not done yet, writes the journalled index entries at the given position of
+// the index and deletes the journal.
+func (t *freezerTable) finishCompaction(first uint64, entries []byte) error {
+	var entry indexEntry
+	if err := entry.unmarshalBinary(entries[:t.entrySize]); err != nil {
+		return err
+	}
+	name := t.dataFileName(entry.filenum)
+	if _, err := os.Stat(name + ".tmp"); err == nil {
+		if err := os.Rename(name+".tmp", name); err != nil {
+			return err
+		}
+	}
+	if _, err := t.index.WriteAt(entries, int64(first)*t.entrySize); err != nil {
+		return err
+	}
+	if err := t.index.Sync(); err != nil {
+		return err
+	}
+	return os.Remove(filepath.Join(t.path, compactionName(t.name)))
+}
+
+// recoverCompaction finishes a compaction interrupted by a crash, or discards
+// the rewritten data files of a compaction which was not journalled yet. It's
+// called on startup, before the table is repaired.
+func (t *freezerTable) recoverCompaction() error {
+	journal, err := ioutil.ReadFile(filepath.Join(t.path, compactionName(t.name)))
+	if os.IsNotExist(err) {
+		_, dat := tableExtensions(t.noCompression)
+		stale, err := filepath.Glob(filepath.Join(t.path, fmt.Sprintf("%s.*.%s.tmp", t.name, dat)))
+		if err != nil {
+			return err
+		}
+		for _, file := range stale {
+			if err := os.Remove(file); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(journal) < 8+int(t.entrySize) || (int64(len(journal))-8)%t.entrySize != 0 {
+		return fmt.Errorf("invalid compaction journal: %d bytes", len(journal))
+	}
+	t.logger.Warn("Finishing interrupted freezer compaction")
+	return t.finishCompaction(binary.BigEndian.Uint64(journal), journal[8:])
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// RegisterValidator adds a check run on the items appended to the given table,
+// after the ones already registered.
+func (f *freezer) RegisterValidator(kind string, validator ethdb.AppendValidator) error {
+	if _, ok := f.tables[kind]; !ok {
+		return errUnknownTable
+	}
+	f.appendLock.Lock()
+	defer f.appendLock.Unlock()
+
+	f.validators[kind] = append(f.validators[kind], validator)
+	return nil
+}
+
+// validate runs the registered validators on the items about to be appended,
+// retrieving the previous items of the validated tables. The caller must hold
+// the append lock.
+func (f *freezer) validate(number uint64, items map[string][]byte) error {
+	for kind, validators := range f.validators {
+		if len(validators) == 0 {
+			continue
+		}
+		// The previous item might have been deleted, validate without it then
+		var prev []byte
+		if number > 0 {
+			blob, err := f.tables[kind].Retrieve(number - 1)
+			if err != nil && err != errDeleted {
+				return fmt.Errorf("failed to retrieve previous %s item #%d: %v", kind, number-1, err)
+			}
+			prev = blob
+		}
+		for _, validator := range validators {
+			if err := validator(number, items[kind], prev); err != nil {
+				f.rejectMeter.Mark(1)
+				return fmt.Errorf("invalid %s item #%d: %v", kind, number, err)
+			}
+		}
+	}
+	return nil
+}
+
+// validateHeaderLinkage ensures an appended header carries the expected number
+// and points to the previous header as its parent.
+func validateHeaderLinkage(number uint64, item []byte, prev []byte) error {
+	header := new(types.Header)
+	if err := rlp.DecodeBytes(item, header); err != nil {
+		return err
+	}
+	if !header.Number.IsUint64() || header.Number.Uint64() != number {
+		return fmt.Errorf("number mismatch: have %v, want %d", header.Number, number)
+	}
+	if prev != nil {
+		if parent := crypto.Keccak256Hash(prev); header.ParentHash != parent {
+			return fmt.Errorf("parent hash mismatch: have %x, want %x", header.ParentHash, parent)
+		}
+	}
+	return nil
+}
+
+// validateHashLength ensures an appended block hash is of the right length.
+func validateHashLength(number uint64, item []byte, prev []byte) error {
+	if len(item) != common.HashLength {
+		return fmt.Errorf("hash length mismatch: have %d, want %d", len(item), common.HashLength)
+	}
+	return nil
+}
@@ -19,8 +19,10 @@ package rawdb
 
 import (
 	"encoding/binary"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/metrics"
 )
 
@@ -29,6 +31,9 @@ var (
 	// databaseVerisionKey tracks the current database version.
 	databaseVerisionKey = []byte("DatabaseVersion")
 
+	// databaseSchemaKey tracks the schema version and features of the database.
+	databaseSchemaKey = []byte("DatabaseSchema")
+
 	// headHeaderKey tracks the latest known header's hash.
 	headHeaderKey = []byte("LastHeader")
 
@@ -47,9 +52,15 @@ var (
 	// snapshotJournalKey tracks the in-memory diff layers across restarts.
 	snapshotJournalKey = []byte("SnapshotJournal")
 
+	// snapshotGeneratorKey tracks the snapshot wiping and generation progress.
+	snapshotGeneratorKey = []byte("SnapshotGenerator")
+
 	// txIndexTailKey tracks the oldest block whose transactions have been indexed.
 	txIndexTailKey = []byte("TransactionIndexTail")
 
+	// logIndexTailKey tracks the oldest block whose logs have been indexed.
+	logIndexTailKey = []byte("LogIndexTail")
+
 	// fastTxLookupLimitKey tracks the transaction lookup limit during fast sync.
 	fastTxLookupLimitKey = []byte("FastTransactionLookupLimit")
 
@@ -64,8 +75,12 @@ var (
 
 	txLookupPrefix        = []byte("l") // txLookupPrefix + hash -> transaction/receipt lookup metadata
 	bloomBitsPrefix       = []byte("B") // bloomBitsPrefix + bit (uint16 big endian) + section (uint64 big endian) + hash -> bloom bits
+	logIndexPrefix        = []byte("x") // logIndexPrefix + position (byte) + address or topic + num (uint64 big endian) -> empty
 	SnapshotAccountPrefix = []byte("a") // SnapshotAccountPrefix + account hash -> account trie value
 	SnapshotStoragePrefix = []byte("o") // SnapshotStoragePrefix + account hash + storage hash -> storage trie value
+	SnapshotStatsPrefix   = []byte("O") // SnapshotStatsPrefix + account hash -> storage slot count and size
+	SnapshotWipePrefix    = []byte("W") // SnapshotWipePrefix + account hash -> empty (storage pending deletion)
+	witnessPrefix         = []byte("w") // witnessPrefix + num (uint64 big endian) + hash -> execution witness
 
 	preimagePrefix = []byte("secure-key-")      // preimagePrefix + hash -> preimage
 	configPrefix   = []byte("ethereum-config-") // config prefix for the db
@@ -104,6 +119,46 @@ var freezerNoSnappy = map[string]bool{
 	freezerDifficultyTable: true,
 }
 
+// FreezerTables returns the names of the ancient-tables, sorted.
+func FreezerTables() []string {
+	tables := make([]string, 0, len(freezerNoSnappy))
+	for name := range freezerNoSnappy {
+		tables = append(tables, name)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+// freezerSyncPolicy configures when the ancient-tables flush the appended data
+// to disk. All the chain data is flushed explicitly before being deleted from
+// the key-value store, the sealed files are flushed on rotation additionally to
+// keep the explicit flushes cheap.
+var freezerSyncPolicy = map[string]syncPolicy{
+	freezerHeaderTable:     {mode: syncOnSeal},
+	freezerHashTable:       {mode: syncOnSeal},
+	freezerBodiesTable:     {mode: syncOnSeal},
+	freezerReceiptTable:    {mode: syncOnSeal},
+	freezerDifficultyTable: {mode: syncOnSeal},
+}
+
+// freezerInlineLimit configures the maximum size of the items the ancient-tables
+// store directly in their index, sparing a data file read for each retrieval.
+// Hashes and difficulties are tiny, so they are never stored in the data files.
+// Only new tables are created with inlining, existing ones keep their layout.
+// Inlining is only used if enabled in the freezer configuration.
+var freezerInlineLimit = map[string]int{
+	freezerHashTable:       common.HashLength,
+	freezerDifficultyTable: 32,
+}
+
+// freezerValidators configures the checks the ancient-tables run on the items
+// before appending them. Headers must be numbered continuously and link to their
+// predecessor, hashes must have the right length.
+var freezerValidators = map[string][]ethdb.AppendValidator{
+	freezerHeaderTable: {validateHeaderLinkage},
+	freezerHashTable:   {validateHashLength},
+}
+
 // LegacyTxLookupEntry is the legacy TxLookupEntry definition with some unnecessary
 // fields.
 type LegacyTxLookupEntry struct {
@@ -154,6 +209,11 @@ func blockReceiptsKey(number uint64, hash common.Hash) []byte {
 	return append(append(blockReceiptsPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
 }
 
+// witnessKey = witnessPrefix + num (uint64 big endian) + hash
+func witnessKey(number uint64, hash common.Hash) []byte {
+	return append(append(witnessPrefix, encodeBlockNumber(number)...), hash.Bytes()...)
+}
+
 // txLookupKey = txLookupPrefix + hash
 func txLookupKey(hash common.Hash) []byte {
 	return append(txLookupPrefix, hash.Bytes()...)
@@ -174,6 +234,16 @@ func storageSnapshotsKey(accountHash common.Hash) []byte {
 	return append(SnapshotStoragePrefix, accountHash.Bytes()...)
 }
 
+// storageStatsKey = SnapshotStatsPrefix + account hash
+func storageStatsKey(accountHash common.Hash) []byte {
+	return append(SnapshotStatsPrefix, accountHash.Bytes()...)
+}
+
+// storageWipeKey = SnapshotWipePrefix + account hash
+func storageWipeKey(accountHash common.Hash) []byte {
+	return append(SnapshotWipePrefix, accountHash.Bytes()...)
+}
+
 // bloomBitsKey = bloomBitsPrefix + bit (uint16 big endian) + section (uint64 big endian) + hash
 func bloomBitsKey(bit uint, section uint64, hash common.Hash) []byte {
 	key := append(append(bloomBitsPrefix, make([]byte, 10)...), hash.Bytes()...)
@@ -184,6 +254,19 @@ func bloomBitsKey(bit uint, section uint64, hash common.Hash) []byte {
 	return key
 }
 
+// logIndexValueKey = logIndexPrefix + position + address or topic
+func logIndexValueKey(position byte, value []byte) []byte {
+	key := make([]byte, 0, len(logIndexPrefix)+1+len(value)+8)
+	key = append(key, logIndexPrefix...)
+	key = append(key, position)
+	return append(key, value...)
+}
+
+// logIndexKey = logIndexPrefix + position + address or topic + num (uint64 big endian)
+func logIndexKey(position byte, value []byte, number uint64) []byte {
+	return append(logIndexValueKey(position, value), encodeBlockNumber(number)...)
+}
+
 // preimageKey = preimagePrefix + hash
 func preimageKey(hash common.Hash) []byte {
 	return append(preimagePrefix, hash.Bytes()...)
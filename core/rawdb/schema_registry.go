@@ -0,0 +1,284 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// ValueCodec is the encoding of the values stored under a key prefix.
+type ValueCodec int
+
+const (
+	CodecRaw    ValueCodec = iota // Opaque binary blob
+	CodecRLP                      // RLP encoded item
+	CodecJSON                     // JSON encoded item
+	CodecHash                     // 32 byte hash
+	CodecNumber                   // 8 byte big endian number
+	CodecEmpty                    // No value, the key itself is the data
+)
+
+// String implements the stringer interface.
+func (c ValueCodec) String() string {
+	switch c {
+	case CodecRaw:
+		return "raw"
+	case CodecRLP:
+		return "rlp"
+	case CodecJSON:
+		return "json"
+	case CodecHash:
+		return "hash"
+	case CodecNumber:
+		return "number"
+	case CodecEmpty:
+		return "empty"
+	default:
+		return "unknown"
+	}
+}
+
+// KeyPrefix describes a category of data stored in the key-value database under
+// a common key prefix, along with the layout of its keys and the encoding of its
+// values.
+type KeyPrefix struct {
+	Group  string     // Subsystem owning the data, used for grouping in inspections
+	Name   string     // Human readable name of the data category
+	Prefix []byte     // Key prefix shared by all the entries
+	Suffix []byte     // Key suffix shared by all the entries, nil if none
+	KeyLen int        // Total length of the keys, including the prefix and suffix
+	Codec  ValueCodec // Encoding of the values
+}
+
+// Match reports whether the key belongs to the data category.
+func (p *KeyPrefix) Match(key []byte) bool {
+	return len(key) == p.KeyLen && bytes.HasPrefix(key, p.Prefix) && bytes.HasSuffix(key, p.Suffix)
+}
+
+// Decode validates a value stored with the codec and converts it into its typed
+// form: []byte for raw blobs, rlp.RawValue for RLP items, json.RawMessage for
+// JSON documents, common.Hash for hashes, uint64 for numbers and nil for empty
+// values.
+func (c ValueCodec) Decode(value []byte) (interface{}, error) {
+	switch c {
+	case CodecRaw:
+		return value, nil
+	case CodecRLP:
+		if _, _, rest, err := rlp.Split(value); err != nil {
+			return nil, err
+		} else if len(rest) > 0 {
+			return nil, fmt.Errorf("%d trailing bytes after rlp item", len(rest))
+		}
+		return rlp.RawValue(value), nil
+	case CodecJSON:
+		if !json.Valid(value) {
+			return nil, errors.New("invalid json")
+		}
+		return json.RawMessage(value), nil
+	case CodecHash:
+		if len(value) != common.HashLength {
+			return nil, fmt.Errorf("invalid hash length %d", len(value))
+		}
+		return common.BytesToHash(value), nil
+	case CodecNumber:
+		if len(value) != 8 {
+			return nil, fmt.Errorf("invalid number length %d", len(value))
+		}
+		return binary.BigEndian.Uint64(value), nil
+	case CodecEmpty:
+		if len(value) != 0 {
+			return nil, fmt.Errorf("unexpected value of %d bytes", len(value))
+		}
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown codec %d", c)
+	}
+}
+
+// Iterate walks the entries of the data category in key order, starting at the
+// given position (relative to the prefix), handing the values over decoded by
+// the codec of the category (see ValueCodec.Decode). Keys sharing the prefix but
+// having a different layout are skipped. Iteration stops if the callback returns
+// false, or with an error if a value can't be decoded.
+func (p *KeyPrefix) Iterate(db ethdb.Iteratee, start []byte, fn func(key []byte, value interface{}) bool) error {
+	var failure error
+	err := p.iterate(db, start, nil, func(key, value []byte) bool {
+		decoded, err := p.Codec.Decode(value)
+		if err != nil {
+			failure = fmt.Errorf("%s entry %x: %v", p.Name, key, err)
+			return false
+		}
+		return fn(key, decoded)
+	}, nil)
+	if err != nil {
+		return err
+	}
+	return failure
+}
+
+// iterate walks the raw entries of the data category in key order, within the
+// range [start, end) relative to the prefix, nil end meaning the end of the
+// category. Keys sharing the prefix but having a different layout are passed to
+// the foreign callback if it's non-nil.
+func (p *KeyPrefix) iterate(db ethdb.Iteratee, start, end []byte, fn func(key, value []byte) bool, foreign func(key []byte)) error {
+	var limit []byte
+	if end != nil {
+		limit = append(common.CopyBytes(p.Prefix), end...)
+	}
+	it := db.NewIterator(p.Prefix, start)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if limit != nil && bytes.Compare(key, limit) >= 0 {
+			break
+		}
+		if !p.Match(key) {
+			if foreign != nil {
+				foreign(key)
+			}
+			continue
+		}
+		if !fn(key, it.Value()) {
+			break
+		}
+	}
+	return it.Error()
+}
+
+// DeleteRange deletes the entries of the data category with keys in the range
+// [start, end) (relative to the prefix), nil end meaning the end of the category.
+// Keys sharing the prefix but having a different layout are left untouched. The
+// number of deleted entries is returned.
+//
+// If the range only holds entries of the category, it's deleted with the range
+// deletion of the store. Otherwise (e.g. categories sharing a prefix, or hashed
+// trie node keys falling into the range) the entries are deleted one by one.
+func (p *KeyPrefix) DeleteRange(db ethdb.KeyValueStore, start, end []byte) (int, error) {
+	var (
+		matched int
+		mixed   bool
+	)
+	err := p.iterate(db, start, end, func(key, value []byte) bool {
+		matched++
+		return true
+	}, func(key []byte) {
+		mixed = true
+	})
+	if err != nil || matched == 0 {
+		return 0, err
+	}
+	if !mixed {
+		first := append(common.CopyBytes(p.Prefix), start...)
+		limit := prefixEnd(p.Prefix)
+		if end != nil {
+			limit = append(common.CopyBytes(p.Prefix), end...)
+		}
+		if err := db.DeleteRange(first, limit); err != nil {
+			return 0, err
+		}
+		return matched, nil
+	}
+	var (
+		batch   = db.NewBatch()
+		deleted int
+		failure error
+	)
+	err = p.iterate(db, start, end, func(key, value []byte) bool {
+		batch.Delete(key)
+		deleted++
+
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if failure = batch.Write(); failure != nil {
+				return false
+			}
+			batch.Reset()
+		}
+		return true
+	}, nil)
+	if err != nil {
+		return 0, err
+	}
+	if failure != nil {
+		return 0, failure
+	}
+	if err := batch.Write(); err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+// prefixEnd returns the first key after all the keys sharing the given prefix,
+// nil if there's none (the prefix is all 0xff bytes).
+func prefixEnd(prefix []byte) []byte {
+	end := common.CopyBytes(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return nil
+}
+
+// witnessKeyPrefix is the data category of the execution witnesses, exposed on
+// its own for pruning them by block range.
+var witnessKeyPrefix = &KeyPrefix{Group: "Key-Value store", Name: "Execution witnesses", Prefix: witnessPrefix, KeyLen: len(witnessPrefix) + 8 + common.HashLength, Codec: CodecRLP}
+
+// KeyPrefixes is the registry of all the data categories stored in the key-value
+// database under a dedicated key prefix. New categories should be registered
+// here to get inspection and range deletion support.
+var KeyPrefixes = []*KeyPrefix{
+	{Group: "Key-Value store", Name: "Headers", Prefix: headerPrefix, KeyLen: len(headerPrefix) + 8 + common.HashLength, Codec: CodecRLP},
+	{Group: "Key-Value store", Name: "Bodies", Prefix: blockBodyPrefix, KeyLen: len(blockBodyPrefix) + 8 + common.HashLength, Codec: CodecRLP},
+	{Group: "Key-Value store", Name: "Receipts", Prefix: blockReceiptsPrefix, KeyLen: len(blockReceiptsPrefix) + 8 + common.HashLength, Codec: CodecRLP},
+	{Group: "Key-Value store", Name: "Difficulties", Prefix: headerPrefix, Suffix: headerTDSuffix, KeyLen: len(headerPrefix) + 8 + common.HashLength + len(headerTDSuffix), Codec: CodecRLP},
+	{Group: "Key-Value store", Name: "Block number->hash", Prefix: headerPrefix, Suffix: headerHashSuffix, KeyLen: len(headerPrefix) + 8 + len(headerHashSuffix), Codec: CodecHash},
+	{Group: "Key-Value store", Name: "Block hash->number", Prefix: headerNumberPrefix, KeyLen: len(headerNumberPrefix) + common.HashLength, Codec: CodecNumber},
+	witnessKeyPrefix,
+	{Group: "Key-Value store", Name: "Transaction index", Prefix: txLookupPrefix, KeyLen: len(txLookupPrefix) + common.HashLength, Codec: CodecRaw},
+	{Group: "Key-Value store", Name: "Bloombit index", Prefix: bloomBitsPrefix, KeyLen: len(bloomBitsPrefix) + 10 + common.HashLength, Codec: CodecRaw},
+	{Group: "Key-Value store", Name: "Log address index", Prefix: append(common.CopyBytes(logIndexPrefix), logIndexAddress), KeyLen: logIndexAddressKeySize, Codec: CodecEmpty},
+	{Group: "Key-Value store", Name: "Log topic index", Prefix: logIndexPrefix, KeyLen: logIndexTopicKeySize, Codec: CodecEmpty},
+	{Group: "Key-Value store", Name: "Trie preimages", Prefix: preimagePrefix, KeyLen: len(preimagePrefix) + common.HashLength, Codec: CodecRaw},
+	{Group: "Key-Value store", Name: "Account snapshot", Prefix: SnapshotAccountPrefix, KeyLen: len(SnapshotAccountPrefix) + common.HashLength, Codec: CodecRLP},
+	{Group: "Key-Value store", Name: "Storage snapshot", Prefix: SnapshotStoragePrefix, KeyLen: len(SnapshotStoragePrefix) + 2*common.HashLength, Codec: CodecRLP},
+	{Group: "Key-Value store", Name: "Storage stats snapshot", Prefix: SnapshotStatsPrefix, KeyLen: len(SnapshotStatsPrefix) + common.HashLength, Codec: CodecRLP},
+	{Group: "Key-Value store", Name: "Storage wipe snapshot", Prefix: SnapshotWipePrefix, KeyLen: len(SnapshotWipePrefix) + common.HashLength, Codec: CodecEmpty},
+	{Group: "Key-Value store", Name: "Clique snapshots", Prefix: []byte("clique-"), KeyLen: 7 + common.HashLength, Codec: CodecJSON},
+	{Group: "Light client", Name: "CHT trie nodes", Prefix: []byte("cht-"), KeyLen: 4 + common.HashLength, Codec: CodecRaw},
+	{Group: "Light client", Name: "Bloom trie nodes", Prefix: []byte("blt-"), KeyLen: 4 + common.HashLength, Codec: CodecRaw},
+}
+
+// LookupKeyPrefix returns the registered data category the key belongs to, or
+// nil if it doesn't belong to any.
+func LookupKeyPrefix(key []byte) *KeyPrefix {
+	for _, prefix := range KeyPrefixes {
+		if prefix.Match(key) {
+			return prefix
+		}
+	}
+	return nil
+}
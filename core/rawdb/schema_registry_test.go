@@ -0,0 +1,172 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package rawdb
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// Tests that the keys of the database are classified into the right categories.
+func TestLookupKeyPrefix(t *testing.T) {
+	hash := common.HexToHash("0xdeadbeef")
+	tests := []struct {
+		key  []byte
+		name string
+	}{
+		{headerKey(1, hash), "Headers"},
+		{headerTDKey(1, hash), "Difficulties"},
+		{headerHashKey(1), "Block number->hash"},
+		{headerNumberKey(hash), "Block hash->number"},
+		{blockBodyKey(1, hash), "Bodies"},
+		{blockReceiptsKey(1, hash), "Receipts"},
+		{txLookupKey(hash), "Transaction index"},
+		{bloomBitsKey(1, 2, hash), "Bloombit index"},
+		{logIndexKey(logIndexAddress, common.Address{1}.Bytes(), 1), "Log address index"},
+		{logIndexKey(1, hash.Bytes(), 1), "Log topic index"},
+		{preimageKey(hash), "Trie preimages"},
+		{accountSnapshotKey(hash), "Account snapshot"},
+		{storageSnapshotKey(hash, hash), "Storage snapshot"},
+		{storageStatsKey(hash), "Storage stats snapshot"},
+		{storageWipeKey(hash), "Storage wipe snapshot"},
+		{append([]byte("clique-"), hash.Bytes()...), "Clique snapshots"},
+		{append([]byte("cht-"), hash.Bytes()...), "CHT trie nodes"},
+		{append([]byte("blt-"), hash.Bytes()...), "Bloom trie nodes"},
+		{hash.Bytes(), ""},
+		{headHeaderKey, ""},
+	}
+	for i, tt := range tests {
+		var name string
+		if prefix := LookupKeyPrefix(tt.key); prefix != nil {
+			name = prefix.Name
+		}
+		if name != tt.name {
+			t.Errorf("test %d: category mismatch for %x: have %q, want %q", i, tt.key, name, tt.name)
+		}
+	}
+}
+
+// Tests that iterating and range deleting a category skips the keys sharing the
+// prefix but having a different layout.
+func TestKeyPrefixDeleteRange(t *testing.T) {
+	db := NewMemoryDatabase()
+	for i := uint64(0); i < 10; i++ {
+		hash := common.BigToHash(common.Big1)
+		db.Put(headerKey(i, hash), []byte{1})
+		db.Put(headerHashKey(i), hash.Bytes())
+	}
+	var headers, hashes *KeyPrefix
+	for _, prefix := range KeyPrefixes {
+		switch prefix.Name {
+		case "Headers":
+			headers = prefix
+		case "Block number->hash":
+			hashes = prefix
+		}
+	}
+	var count int
+	if err := headers.Iterate(db, encodeBlockNumber(2), func(key []byte, value interface{}) bool {
+		count++
+		return true
+	}); err != nil {
+		t.Fatalf("failed to iterate headers: %v", err)
+	}
+	if count != 8 {
+		t.Fatalf("iterated header count mismatch: have %d, want %d", count, 8)
+	}
+	deleted, err := headers.DeleteRange(db, encodeBlockNumber(2), encodeBlockNumber(5))
+	if err != nil {
+		t.Fatalf("failed to delete headers: %v", err)
+	}
+	if deleted != 3 {
+		t.Fatalf("deleted header count mismatch: have %d, want %d", deleted, 3)
+	}
+	for i := uint64(0); i < 10; i++ {
+		if have, want := HasHeader(db, common.BigToHash(common.Big1), i), i < 2 || i >= 5; have != want {
+			t.Errorf("header #%d presence mismatch: have %v, want %v", i, have, want)
+		}
+		if ReadCanonicalHash(db, i) == (common.Hash{}) {
+			t.Errorf("canonical hash #%d deleted", i)
+		}
+	}
+	if deleted, err = hashes.DeleteRange(db, nil, nil); err != nil || deleted != 10 {
+		t.Fatalf("failed to delete canonical hashes: deleted %d, err %v", deleted, err)
+	}
+}
+
+// Tests that iterating a category hands over the values decoded by its codec,
+// rejecting the malformed ones.
+func TestKeyPrefixIterateDecode(t *testing.T) {
+	db := NewMemoryDatabase()
+	for i := uint64(0); i < 3; i++ {
+		WriteCanonicalHash(db, common.BigToHash(new(big.Int).SetUint64(i)), i)
+	}
+	hashes := LookupKeyPrefix(headerHashKey(0))
+
+	var have []common.Hash
+	if err := hashes.Iterate(db, nil, func(key []byte, value interface{}) bool {
+		have = append(have, value.(common.Hash))
+		return true
+	}); err != nil {
+		t.Fatalf("failed to iterate canonical hashes: %v", err)
+	}
+	for i, hash := range have {
+		if want := common.BigToHash(big.NewInt(int64(i))); hash != want {
+			t.Errorf("canonical hash %d mismatch: have %x, want %x", i, hash, want)
+		}
+	}
+	if len(have) != 3 {
+		t.Fatalf("iterated canonical hash count mismatch: have %d, want %d", len(have), 3)
+	}
+	db.Put(headerHashKey(1), []byte{0x01})
+	if err := hashes.Iterate(db, nil, func(key []byte, value interface{}) bool { return true }); err == nil {
+		t.Fatalf("malformed canonical hash accepted")
+	}
+}
+
+// Tests that range deleting a category uses the range deletion of the store only
+// if the range holds no keys of other layouts.
+func TestKeyPrefixDeleteRangeForeign(t *testing.T) {
+	db := NewMemoryDatabase()
+	for i := byte(0); i < 10; i++ {
+		db.Put(txLookupKey(common.Hash{i}), []byte{i})
+	}
+	lookups := LookupKeyPrefix(txLookupKey(common.Hash{}))
+
+	// A hashed trie node key falling into the range must survive the deletion
+	node := append(common.CopyBytes(txLookupPrefix), common.Hash{0x05}.Bytes()[:common.HashLength-len(txLookupPrefix)]...)
+	db.Put(node, []byte{0xff})
+
+	deleted, err := lookups.DeleteRange(db, common.Hash{0x02}.Bytes(), common.Hash{0x07}.Bytes())
+	if err != nil || deleted != 5 {
+		t.Fatalf("failed to delete mixed range: deleted %d, err %v", deleted, err)
+	}
+	if ok, _ := db.Has(node); !ok {
+		t.Fatalf("foreign key deleted")
+	}
+	// The rest of the range only holds lookups, it's deleted at once
+	if deleted, err = lookups.DeleteRange(db, common.Hash{0x07}.Bytes(), nil); err != nil || deleted != 3 {
+		t.Fatalf("failed to delete pure range: deleted %d, err %v", deleted, err)
+	}
+	for i := byte(0); i < 10; i++ {
+		if have, _ := db.Has(txLookupKey(common.Hash{i})); have != (i < 2) {
+			t.Errorf("lookup %d presence mismatch: have %v, want %v", i, have, i < 2)
+		}
+	}
+}
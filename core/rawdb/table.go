@@ -62,6 +62,12 @@ func (t *table) Ancient(kind string, number uint64) ([]byte, error) {
 	return t.db.Ancient(kind, number)
 }
 
+// AncientInto is a noop passthrough that just forwards the request to the underlying
+// database.
+func (t *table) AncientInto(kind string, number uint64, buf []byte) ([]byte, error) {
+	return t.db.AncientInto(kind, number, buf)
+}
+
 // Ancients is a noop passthrough that just forwards the request to the underlying
 // database.
 func (t *table) Ancients() (uint64, error) {
@@ -120,6 +126,12 @@ func (t *table) Stat(property string) (string, error) {
 	return t.db.Stat(property)
 }
 
+// Stats returns the structured internal statistics of the database. The stats
+// are not scoped to the table's prefix.
+func (t *table) Stats() (*ethdb.Stats, error) {
+	return t.db.Stats()
+}
+
 // Compact flattens the underlying data store for the given key range. In essence,
 // deleted and overwritten versions are discarded, and the data is rearranged to
 // reduce the cost of operations needed to access them.
@@ -135,23 +147,47 @@ func (t *table) Compact(start []byte, limit []byte) error {
 	// If no limit was specified, use the first element not matching the prefix
 	// as the limit
 	if limit == nil {
-		limit = []byte(t.prefix)
-		for i := len(limit) - 1; i >= 0; i-- {
-			// Bump the current character, stopping if it doesn't overflow
-			limit[i]++
-			if limit[i] > 0 {
-				break
-			}
-			// Character overflown, proceed to the next or nil if the last
-			if i == 0 {
-				limit = nil
-			}
-		}
+		limit = t.limit()
 	}
 	// Range correctly calculated based on table prefix, delegate down
 	return t.db.Compact(start, limit)
 }
 
+// DeleteRange removes all the keys in the range [start, end) from the table.
+//
+// A nil start is treated as a key before all keys in the table; a nil end is
+// treated as a key after all keys in the table.
+func (t *table) DeleteRange(start, end []byte) error {
+	start = append([]byte(t.prefix), start...)
+	if end == nil {
+		end = t.limit()
+	} else {
+		end = append([]byte(t.prefix), end...)
+	}
+	return t.db.DeleteRange(start, end)
+}
+
+// limit returns the first key not matching the table prefix, or nil if there is
+// no such key, including when the table has no prefix at all.
+func (t *table) limit() []byte {
+	if len(t.prefix) == 0 {
+		return nil
+	}
+	limit := []byte(t.prefix)
+	for i := len(limit) - 1; i >= 0; i-- {
+		// Bump the current character, stopping if it doesn't overflow
+		limit[i]++
+		if limit[i] > 0 {
+			break
+		}
+		// Character overflown, proceed to the next or nil if the last
+		if i == 0 {
+			limit = nil
+		}
+	}
+	return limit
+}
+
 // NewBatch creates a write-only database that buffers changes to its host db
 // until a final write is called, each operation prefixing all keys with the
 // pre-configured string.
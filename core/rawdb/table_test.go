@@ -125,4 +125,29 @@ func testTableDatabase(t *testing.T, prefix string) {
 	// Test iterators with prefix and start point
 	check(db.NewIterator([]byte{0xee}, nil), 0, 0)
 	check(db.NewIterator(nil, []byte{0x00}), 6, 0)
+
+	// Test range deletions, entries outside of the table must be left intact
+	outer := NewMemoryDatabase()
+	outer.Put([]byte("zzz"), []byte{0x01})
+	db = NewTable(outer, prefix)
+	for _, entry := range entries {
+		db.Put(entry.key, entry.value)
+	}
+	if err := db.DeleteRange([]byte{0x03}, []byte{0xff, 0xff, 0x02}); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	check(db.NewIterator(nil, []byte{0xff, 0xff, 0x02}), 2, 4)
+	if err := db.DeleteRange([]byte{0xff, 0xff, 0x02}, nil); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	check(db.NewIterator(nil, []byte{0xff, 0xff, 0x02}), 0, 0)
+	if err := db.DeleteRange(nil, nil); err != nil {
+		t.Fatalf("Failed to delete range: %v", err)
+	}
+	check(db.NewIterator(nil, nil), 0, 0)
+	if prefix != "" {
+		if ok, _ := outer.Has([]byte("zzz")); !ok {
+			t.Fatalf("Entry outside of the table deleted")
+		}
+	}
 }
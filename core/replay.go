@@ -0,0 +1,109 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
+)
+
+// maxReplayBlocks is the maximum number of blocks re-executed by a single replay.
+// Nothing is flushed to disk during a replay, so the range needs to be bounded to
+// keep the memory use in check.
+const maxReplayBlocks = 1024
+
+// ReplayResult is the outcome of re-executing a range of blocks, diffing the
+// resulting state against the live one.
+type ReplayResult struct {
+	From        uint64                  `json:"from"`
+	To          uint64                  `json:"to"`
+	Root        common.Hash             `json:"root"`        // State root produced by the replay
+	Expected    common.Hash             `json:"expected"`    // State root of the last block in the live database
+	Divergences []state.StateDivergence `json:"divergences"` // Accounts and slots differing from the live state
+}
+
+// ReplayBlocks re-executes the canonical blocks from..to on top of the state of
+// block from-1, and structurally diffs the resulting state against the state of
+// block to in the live database, reporting the divergent accounts and storage
+// slots (at most limit many if non-zero).
+//
+// The replayed states are only committed into memory, the live database is not
+// written to. This makes it suitable for validating changes to the state
+// handling against a known good database, both in tests and on live nodes. The
+// intermediate states are dereferenced as the replay progresses, and the replay
+// is aborted if the range is longer than maxReplayBlocks or the dirty nodes
+// outgrow the dirty trie cache allowance of the chain.
+func ReplayBlocks(bc *BlockChain, from, to uint64, limit int) (*ReplayResult, error) {
+	if from == 0 || from > to {
+		return nil, fmt.Errorf("invalid replay range %d..%d", from, to)
+	}
+	if to-from+1 > maxReplayBlocks {
+		return nil, fmt.Errorf("replay range %d..%d too long, at most %d blocks allowed", from, to, maxReplayBlocks)
+	}
+	parent := bc.GetBlockByNumber(from - 1)
+	if parent == nil {
+		return nil, fmt.Errorf("block #%d not found", from-1)
+	}
+	// Execute the blocks on a private trie database, reading from the live disk
+	// but keeping all the replayed writes in memory
+	var (
+		db     = state.NewDatabase(bc.db)
+		triedb = db.TrieDB()
+		root   = parent.Root()
+		dirty  = common.StorageSize(bc.cacheConfig.TrieDirtyLimit) * 1024 * 1024
+	)
+	for number := from; number <= to; number++ {
+		block := bc.GetBlockByNumber(number)
+		if block == nil {
+			return nil, fmt.Errorf("block #%d not found", number)
+		}
+		statedb, err := state.New(root, db, nil)
+		if err != nil {
+			return nil, fmt.Errorf("state of block #%d unavailable: %v", number-1, err)
+		}
+		if _, _, _, err := bc.Processor().Process(block, statedb, bc.vmConfig); err != nil {
+			return nil, fmt.Errorf("failed to replay block #%d: %v", number, err)
+		}
+		prev := root
+		if root, err = statedb.Commit(bc.chainConfig.IsEIP158(block.Number())); err != nil {
+			return nil, fmt.Errorf("failed to commit block #%d: %v", number, err)
+		}
+		// Only the last replayed state is needed, release the previous one
+		triedb.Reference(root, common.Hash{})
+		triedb.Dereference(prev)
+
+		if nodes, _ := triedb.Size(); dirty > 0 && nodes > dirty {
+			return nil, fmt.Errorf("replay state of block #%d too large (%v > %v), replay a shorter range", number, nodes, dirty)
+		}
+	}
+	result := &ReplayResult{
+		From:     from,
+		To:       to,
+		Root:     root,
+		Expected: bc.GetBlockByNumber(to).Root(),
+	}
+	if result.Root != result.Expected {
+		divergences, err := state.CompareStates(db, result.Root, bc.stateCache, result.Expected, limit)
+		if err != nil {
+			return nil, err
+		}
+		result.Divergences = divergences
+	}
+	return result, nil
+}
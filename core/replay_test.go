@@ -0,0 +1,90 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Tests that replaying a range of blocks reproduces the live state without
+// writing anything into the live database.
+func TestReplayBlocks(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr    = crypto.PubkeyToAddress(key.PublicKey)
+		db      = rawdb.NewMemoryDatabase()
+		gspec   = &Genesis{Config: params.TestChainConfig, Alloc: GenesisAlloc{addr: {Balance: big.NewInt(1000000000)}}}
+		genesis = gspec.MustCommit(db)
+		signer  = types.NewEIP155Signer(gspec.Config.ChainID)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 4, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(addr), common.Address{byte(i + 1)}, big.NewInt(1000), params.TxGas, nil, nil), signer, key)
+		b.AddTx(tx)
+	})
+	chain, err := NewBlockChain(db, &CacheConfig{TrieDirtyDisabled: true}, gspec.Config, ethash.NewFaker(), vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create blockchain: %v", err)
+	}
+	defer chain.Stop()
+
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to insert chain: %v", err)
+	}
+	entries := countEntries(db)
+
+	result, err := ReplayBlocks(chain, 2, 4, 0)
+	if err != nil {
+		t.Fatalf("failed to replay blocks: %v", err)
+	}
+	if result.Root != blocks[3].Root() || result.Expected != blocks[3].Root() {
+		t.Fatalf("replayed root mismatch: have %x, want %x (expected %x)", result.Root, blocks[3].Root(), result.Expected)
+	}
+	if len(result.Divergences) != 0 {
+		t.Fatalf("divergences reported for a faithful replay: %v", result.Divergences)
+	}
+	if have := countEntries(db); have != entries {
+		t.Fatalf("live database modified by the replay: have %d entries, want %d", have, entries)
+	}
+	// Ensure invalid ranges are rejected
+	for _, rng := range [][2]uint64{{0, 2}, {3, 2}, {2, 5}, {1, maxReplayBlocks + 1}} {
+		if _, err := ReplayBlocks(chain, rng[0], rng[1], 0); err == nil {
+			t.Errorf("replay of range %d..%d succeeded", rng[0], rng[1])
+		}
+	}
+}
+
+// countEntries returns the number of entries in the key-value store.
+func countEntries(db ethdb.Iteratee) int {
+	it := db.NewIterator(nil, nil)
+	defer it.Release()
+
+	var n int
+	for it.Next() {
+		n++
+	}
+	return n
+}
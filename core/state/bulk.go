@@ -0,0 +1,210 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// BulkAccount is an account of a state written in bulk by CommitBulk.
+type BulkAccount struct {
+	Address common.Address
+	Nonce   uint64
+	Balance *big.Int // Nil is treated as zero
+	Code    []byte
+	Storage map[common.Hash]common.Hash
+}
+
+// bulkWriter is a key-value writer batching the writes into the database and
+// flushing them whenever the batch grows large enough.
+type bulkWriter struct {
+	batch ethdb.Batch
+	err   error
+}
+
+// Put inserts the given value into the batch, flushing it if it's full.
+func (w *bulkWriter) Put(key []byte, value []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.err = w.batch.Put(key, value); w.err != nil {
+		return w.err
+	}
+	if w.batch.ValueSize() > ethdb.IdealBatchSize {
+		if w.err = w.batch.Write(); w.err != nil {
+			return w.err
+		}
+		w.batch.Reset()
+	}
+	return nil
+}
+
+// Delete removes the key from the batch.
+func (w *bulkWriter) Delete(key []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.batch.Delete(key)
+	return w.err
+}
+
+// flush writes out any data left in the batch.
+func (w *bulkWriter) flush() error {
+	if w.err != nil {
+		return w.err
+	}
+	w.err = w.batch.Write()
+	return w.err
+}
+
+// CommitBulk writes a whole new state consisting of the given accounts straight
+// into the database and returns its root. Unlike building the state through a
+// StateDB, it doesn't journal the accounts or cache the trie nodes in memory.
+// The accounts and slots are hashed, sorted and streamed into the tries, and
+// every node is written as soon as its subtrie is complete. This is much faster
+// for huge states, e.g. genesis allocations of devnets with millions of accounts.
+//
+// The flat snapshot of the state is written alongside and marked as generated,
+// so it's not regenerated from the tries on startup. The preimages of the
+// addresses and slot keys are stored too, the same way as by the StateDB. Zero
+// storage values are skipped, as empty slots don't exist in the state.
+func CommitBulk(db ethdb.KeyValueStore, accounts []BulkAccount) (common.Hash, error) {
+	var (
+		start  = time.Now()
+		writer = &bulkWriter{batch: db.NewBatch()}
+
+		hashes = make([]common.Hash, len(accounts))
+		order  = make([]int, len(accounts))
+
+		slots   uint64
+		storage common.StorageSize
+	)
+	for i, account := range accounts {
+		hashes[i], order[i] = crypto.Keccak256Hash(account.Address[:]), i
+	}
+	sort.Slice(order, func(i, j int) bool {
+		return bytes.Compare(hashes[order[i]][:], hashes[order[j]][:]) < 0
+	})
+	var (
+		keys   = make([][]byte, 0, len(accounts))
+		values = make([][]byte, 0, len(accounts))
+	)
+	for n, i := range order {
+		var (
+			account   = &accounts[i]
+			addrHash  = hashes[i]
+			preimages = map[common.Hash][]byte{addrHash: common.CopyBytes(account.Address[:])}
+		)
+		if n > 0 && addrHash == hashes[order[n-1]] {
+			return common.Hash{}, fmt.Errorf("duplicate account %x", account.Address)
+		}
+		// Write the storage trie and the flat slots of the account
+		root, stats, err := commitBulkStorage(writer, addrHash, account.Storage, preimages)
+		if err != nil {
+			return common.Hash{}, err
+		}
+		if stats.Slots > 0 {
+			rawdb.WriteStorageStats(writer, addrHash, stats)
+		}
+		slots += stats.Slots
+		storage += common.StorageSize(stats.Slots*(1+2*common.HashLength) + stats.Size)
+
+		// Write the contract code and the account itself
+		codeHash := emptyCodeHash
+		if len(account.Code) > 0 {
+			codeHash = crypto.Keccak256(account.Code)
+			writer.Put(codeHash, account.Code)
+		}
+		balance := account.Balance
+		if balance == nil {
+			balance = new(big.Int)
+		}
+		blob, err := rlp.EncodeToBytes(&Account{Nonce: account.Nonce, Balance: balance, Root: root, CodeHash: codeHash})
+		if err != nil {
+			return common.Hash{}, err
+		}
+		keys, values = append(keys, addrHash[:]), append(values, blob)
+
+		slim := snapshot.SlimAccountRLP(account.Nonce, balance, root, codeHash)
+		rawdb.WriteAccountSnapshot(writer, addrHash, slim)
+		storage += common.StorageSize(1 + common.HashLength + len(slim))
+
+		rawdb.WritePreimages(writer, preimages)
+	}
+	root, nodes, err := trie.CommitSorted(writer, keys, values)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	if err := snapshot.MarkGenerated(writer, root, uint64(len(accounts)), slots, uint64(storage)); err != nil {
+		return common.Hash{}, err
+	}
+	if err := writer.flush(); err != nil {
+		return common.Hash{}, err
+	}
+	log.Info("Committed state in bulk", "root", root, "accounts", len(accounts), "slots", slots, "nodes", nodes, "elapsed", common.PrettyDuration(time.Since(start)))
+	return root, nil
+}
+
+// commitBulkStorage writes the storage trie and the flat slots of an account,
+// returning the storage root and accounting. The preimages of the slot keys are
+// added to the given set.
+func commitBulkStorage(writer *bulkWriter, addrHash common.Hash, storage map[common.Hash]common.Hash, preimages map[common.Hash][]byte) (common.Hash, *rawdb.StorageStats, error) {
+	var (
+		stats  = new(rawdb.StorageStats)
+		hashes = make([]common.Hash, 0, len(storage))
+		blobs  = make(map[common.Hash][]byte, len(storage))
+	)
+	for key, value := range storage {
+		if value == (common.Hash{}) {
+			continue
+		}
+		hash := crypto.Keccak256Hash(key[:])
+		blob, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value[:])) // Encoding []byte cannot fail
+
+		hashes, blobs[hash] = append(hashes, hash), blob
+		preimages[hash] = common.CopyBytes(key[:])
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return bytes.Compare(hashes[i][:], hashes[j][:]) < 0
+	})
+	var (
+		keys   = make([][]byte, len(hashes))
+		values = make([][]byte, len(hashes))
+	)
+	for i, hash := range hashes {
+		keys[i], values[i] = common.CopyBytes(hash[:]), blobs[hash]
+
+		rawdb.WriteStorageSnapshot(writer, addrHash, hash, values[i])
+		stats.Slots++
+		stats.Size += uint64(len(values[i]))
+	}
+	root, _, err := trie.CommitSorted(writer, keys, values)
+	return root, stats, err
+}
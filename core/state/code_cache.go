@@ -0,0 +1,103 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// codeCacheLimit is the maximum number of contract codes retained.
+	codeCacheLimit = 4096
+
+	// codeMissingLimit is the maximum number of failed code lookups retained.
+	codeMissingLimit = 16384
+
+	// codeMissingTTL is the time a failed code lookup is served from the cache,
+	// after which the code is looked up again. Codes are written in the meantime
+	// by state sync without going through the cache, hence the expiry.
+	codeMissingTTL = time.Minute
+)
+
+var (
+	codeCacheHitMeter      = metrics.NewRegisteredMeter("state/codecache/hit", nil)
+	codeCacheMissMeter     = metrics.NewRegisteredMeter("state/codecache/miss", nil)
+	codeCacheNegativeMeter = metrics.NewRegisteredMeter("state/codecache/negative", nil)
+)
+
+// missingCode is a failed code lookup retained by the code cache.
+type missingCode struct {
+	err  error     // Error returned by the lookup
+	time time.Time // Time of the lookup
+}
+
+// CodeCache is a cache of contract codes, layered on top of the clean cache of
+// the trie database. Besides the recently loaded codes it retains the failed
+// lookups for a while, so repeated queries for codes that don't exist don't hit
+// the disk over and over.
+//
+// A code cache can be shared by multiple state databases (e.g. the one of the
+// chain importer and the ones created for tracing), see NewDatabaseWithCodeCache.
+// It's safe for concurrent use.
+type CodeCache struct {
+	codes   *lru.Cache    // Recently loaded codes keyed by code hash
+	missing *lru.Cache    // Recently failed lookups keyed by code hash
+	ttl     time.Duration // Time the failed lookups are served for
+}
+
+// NewCodeCache creates an empty code cache.
+func NewCodeCache() *CodeCache {
+	codes, _ := lru.New(codeCacheLimit)
+	missing, _ := lru.New(codeMissingLimit)
+	return &CodeCache{codes: codes, missing: missing, ttl: codeMissingTTL}
+}
+
+// load retrieves the code with the given hash from the cache, resolving it with
+// the loader if it's not cached. Failed lookups are cached too, the same error
+// being returned until the entry expires.
+func (c *CodeCache) load(hash common.Hash, loader func() ([]byte, error)) ([]byte, error) {
+	if code, ok := c.codes.Get(hash); ok {
+		codeCacheHitMeter.Mark(1)
+		return code.([]byte), nil
+	}
+	if entry, ok := c.missing.Get(hash); ok {
+		if missing := entry.(*missingCode); time.Since(missing.time) < c.ttl {
+			codeCacheNegativeMeter.Mark(1)
+			return nil, missing.err
+		}
+		c.missing.Remove(hash)
+	}
+	codeCacheMissMeter.Mark(1)
+
+	code, err := loader()
+	if err != nil {
+		c.missing.Add(hash, &missingCode{err: err, time: time.Now()})
+		return nil, err
+	}
+	c.codes.Add(hash, code)
+	return code, nil
+}
+
+// add inserts a code into the cache, dropping any failed lookup of it.
+func (c *CodeCache) add(hash common.Hash, code []byte) {
+	c.missing.Remove(hash)
+	c.codes.Add(hash, code)
+}
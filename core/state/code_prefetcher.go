@@ -0,0 +1,92 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+// codePrefetchThreads is the number of concurrent workers loading contract code
+// in the background.
+const codePrefetchThreads = 4
+
+var (
+	codePrefetchLoadMeter = metrics.NewRegisteredMeter("state/codeprefetch/load", nil)
+	codePrefetchSkipMeter = metrics.NewRegisteredMeter("state/codeprefetch/skip", nil)
+)
+
+// PrefetchCode loads the code of the given accounts of the state at root into
+// the code cache of the database, so the execution doesn't stall on disk reads
+// when calling into cold contracts. The accounts are resolved through a state
+// reader of each worker, so it's safe to run concurrently with a state processing
+// the same root.
+//
+// The prefetching is aborted as soon as the interrupt flag is set, it's meant
+// to be raised when the processing of the block finishes.
+func PrefetchCode(db Database, snaps *snapshot.Tree, root common.Hash, addrs []common.Address, interrupt *uint32) {
+	// Deduplicate the accounts and feed them to the workers
+	var (
+		tasks = make(chan common.Address, len(addrs))
+		seen  = make(map[common.Address]struct{}, len(addrs))
+	)
+	for _, addr := range addrs {
+		if _, ok := seen[addr]; ok {
+			continue
+		}
+		seen[addr] = struct{}{}
+		tasks <- addr
+	}
+	close(tasks)
+
+	threads := codePrefetchThreads
+	if threads > len(seen) {
+		threads = len(seen)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reader, err := StateReaderAt(db, snaps, root, 0)
+			if err != nil {
+				return
+			}
+			for addr := range tasks {
+				if interrupt != nil && atomic.LoadUint32(interrupt) == 1 {
+					return
+				}
+				addrHash := crypto.Keccak256Hash(addr[:])
+				acc, err := reader.AccountByHash(addrHash)
+				if err != nil || acc == nil || bytes.Equal(acc.CodeHash, emptyCodeHash) {
+					codePrefetchSkipMeter.Mark(1)
+					continue
+				}
+				db.ContractCode(addrHash, common.BytesToHash(acc.CodeHash))
+				codePrefetchLoadMeter.Mark(1)
+			}
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// StateDivergence is an account or a storage slot differing between two states.
+type StateDivergence struct {
+	Account common.Hash   `json:"account"`        // Hash of the account address
+	Slot    *common.Hash  `json:"slot,omitempty"` // Hash of the storage slot, nil if the account differs
+	Have    hexutil.Bytes `json:"have"`           // RLP encoded value in the checked state, nil if missing
+	Want    hexutil.Bytes `json:"want"`           // RLP encoded value in the reference state, nil if missing
+}
+
+// CompareStates structurally diffs a state against a reference one, returning
+// the accounts and storage slots differing between them, ordered by account and
+// slot hash. The states may live in different databases. Only the modified parts
+// of the tries are visited, the shared subtrees being skipped.
+//
+// If the limit is non-zero, at most that many divergences are returned.
+func CompareStates(have Database, haveRoot common.Hash, want Database, wantRoot common.Hash, limit int) ([]StateDivergence, error) {
+	haveTrie, err := have.OpenTrie(haveRoot)
+	if err != nil {
+		return nil, err
+	}
+	wantTrie, err := want.OpenTrie(wantRoot)
+	if err != nil {
+		return nil, err
+	}
+	accounts, err := diffLeaves(haveTrie, wantTrie)
+	if err != nil {
+		return nil, err
+	}
+	var divergences []StateDivergence
+	for _, leaf := range accounts {
+		if limit > 0 && len(divergences) >= limit {
+			break
+		}
+		// Report the account itself if the fields other than the storage differ
+		var haveAcc, wantAcc Account
+		haveAcc.Root, wantAcc.Root = emptyRoot, emptyRoot
+		if leaf.have != nil {
+			if err := rlp.DecodeBytes(leaf.have, &haveAcc); err != nil {
+				return nil, err
+			}
+		}
+		if leaf.want != nil {
+			if err := rlp.DecodeBytes(leaf.want, &wantAcc); err != nil {
+				return nil, err
+			}
+		}
+		if leaf.have == nil || leaf.want == nil || haveAcc.Nonce != wantAcc.Nonce ||
+			haveAcc.Balance.Cmp(wantAcc.Balance) != 0 || !bytes.Equal(haveAcc.CodeHash, wantAcc.CodeHash) {
+			divergences = append(divergences, StateDivergence{Account: leaf.key, Have: leaf.have, Want: leaf.want})
+		}
+		if haveAcc.Root == wantAcc.Root {
+			continue
+		}
+		// Storage differs, report the slots one by one
+		haveStorage, err := have.OpenStorageTrie(leaf.key, haveAcc.Root)
+		if err != nil {
+			return nil, err
+		}
+		wantStorage, err := want.OpenStorageTrie(leaf.key, wantAcc.Root)
+		if err != nil {
+			return nil, err
+		}
+		slots, err := diffLeaves(haveStorage, wantStorage)
+		if err != nil {
+			return nil, err
+		}
+		for _, slot := range slots {
+			if limit > 0 && len(divergences) >= limit {
+				break
+			}
+			hash := slot.key
+			divergences = append(divergences, StateDivergence{Account: leaf.key, Slot: &hash, Have: slot.have, Want: slot.want})
+		}
+	}
+	return divergences, nil
+}
+
+// leafDiff is a leaf differing between two tries.
+type leafDiff struct {
+	key  common.Hash
+	have []byte // Value in the checked trie, nil if missing
+	want []byte // Value in the reference trie, nil if missing
+}
+
+// diffLeaves collects the leaves differing between two tries, ordered by key.
+func diffLeaves(have, want Trie) ([]*leafDiff, error) {
+	leaves := make(map[common.Hash]*leafDiff)
+	collect := func(a, b Trie, mine bool) error {
+		it, _ := trie.NewDifferenceIterator(a.NodeIterator(nil), b.NodeIterator(nil))
+		for it.Next(true) {
+			if !it.Leaf() {
+				continue
+			}
+			key := common.BytesToHash(it.LeafKey())
+			leaf := leaves[key]
+			if leaf == nil {
+				leaf = &leafDiff{key: key}
+				leaves[key] = leaf
+			}
+			if mine {
+				leaf.have = common.CopyBytes(it.LeafBlob())
+			} else {
+				leaf.want = common.CopyBytes(it.LeafBlob())
+			}
+		}
+		return it.Error()
+	}
+	if err := collect(want, have, true); err != nil {
+		return nil, err
+	}
+	if err := collect(have, want, false); err != nil {
+		return nil, err
+	}
+	// Leaves moved around in the trie show up on both sides, drop them
+	diffs := make([]*leafDiff, 0, len(leaves))
+	for _, leaf := range leaves {
+		if leaf.have != nil && bytes.Equal(leaf.have, leaf.want) {
+			continue
+		}
+		diffs = append(diffs, leaf)
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return bytes.Compare(diffs[i].key[:], diffs[j].key[:]) < 0
+	})
+	return diffs, nil
+}
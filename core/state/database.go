@@ -21,6 +21,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/trie"
 	lru "github.com/hashicorp/golang-lru"
 )
@@ -30,6 +31,16 @@ const (
 	codeSizeCacheSize = 100000
 )
 
+var (
+	// emptyStorageSkipMeter counts the storage reads answered without a lookup,
+	// as the account is known to have no storage.
+	emptyStorageSkipMeter = metrics.NewRegisteredMeter("state/shortcircuit/storage", nil)
+
+	// emptyCodeSkipMeter counts the code reads answered without a lookup, as
+	// the account is known to have no code.
+	emptyCodeSkipMeter = metrics.NewRegisteredMeter("state/shortcircuit/code", nil)
+)
+
 // Database wraps access to tries and contract code.
 type Database interface {
 	// OpenTrie opens the main account trie.
@@ -47,8 +58,16 @@ type Database interface {
 	// ContractCodeSize retrieves a particular contracts code's size.
 	ContractCodeSize(addrHash, codeHash common.Hash) (int, error)
 
+	// ReleaseTrie drops any reader retained for the given state root. It must be
+	// called once the trie nodes of the root are dereferenced from the database.
+	ReleaseTrie(root common.Hash)
+
 	// TrieDB retrieves the low level trie database used for data storage.
 	TrieDB() *trie.Database
+
+	// CodeCache retrieves the contract code cache of the database, nil if the
+	// database doesn't cache codes.
+	CodeCache() *CodeCache
 }
 
 // Trie is a Ethereum Merkle Patricia trie.
@@ -64,16 +83,29 @@ type Trie interface {
 	// trie.MissingNodeError is returned.
 	TryGet(key []byte) ([]byte, error)
 
+	// TryGetHashed is the same as TryGet, but operates on the already hashed key,
+	// saving the hashing if the caller knows the hash anyway.
+	TryGetHashed(hashKey []byte) ([]byte, error)
+
 	// TryUpdate associates key with value in the trie. If value has length zero, any
 	// existing value is deleted from the trie. The value bytes must not be modified
 	// by the caller while they are stored in the trie. If a node was not found in the
 	// database, a trie.MissingNodeError is returned.
 	TryUpdate(key, value []byte) error
 
+	// TryUpdateHashed is the same as TryUpdate, but operates on the already hashed
+	// key, saving the hashing if the caller knows the hash anyway. The original key
+	// is only used to track the preimage of the hash, nil skips the tracking.
+	TryUpdateHashed(key, hashKey, value []byte) error
+
 	// TryDelete removes any existing value for key from the trie. If a node was not
 	// found in the database, a trie.MissingNodeError is returned.
 	TryDelete(key []byte) error
 
+	// TryDeleteHashed is the same as TryDelete, but operates on the already hashed
+	// key, saving the hashing if the caller knows the hash anyway.
+	TryDeleteHashed(hashKey []byte) error
+
 	// Hash returns the root hash of the trie. It does not write to the database and
 	// can be used even if the trie doesn't have one.
 	Hash() common.Hash
@@ -107,21 +139,37 @@ func NewDatabase(db ethdb.Database) Database {
 // is safe for concurrent use and retains a lot of collapsed RLP trie nodes in a
 // large memory cache.
 func NewDatabaseWithCache(db ethdb.Database, cache int) Database {
+	return NewDatabaseWithCodeCache(db, cache, nil)
+}
+
+// NewDatabaseWithCodeCache creates a backing store for state, like the one of
+// NewDatabaseWithCache, sharing the given contract code cache. A new code cache
+// is created if nil.
+func NewDatabaseWithCodeCache(db ethdb.Database, cache int, codes *CodeCache) Database {
+	if codes == nil {
+		codes = NewCodeCache()
+	}
 	csc, _ := lru.New(codeSizeCacheSize)
 	return &cachingDB{
 		db:            trie.NewDatabaseWithCache(db, cache),
 		codeSizeCache: csc,
+		codes:         codes,
+		objects:       newObjectCache(),
+		readers:       newReaderPool(),
 	}
 }
 
 type cachingDB struct {
 	db            *trie.Database
 	codeSizeCache *lru.Cache
+	codes         *CodeCache   // Contract codes, possibly shared with other databases
+	objects       *objectCache // Decoded state objects retained across blocks
+	readers       *readerPool  // Recently opened account tries shared across readers
 }
 
 // OpenTrie opens the main account trie at a specific root hash.
 func (db *cachingDB) OpenTrie(root common.Hash) (Trie, error) {
-	return trie.NewSecure(root, db.db)
+	return db.readers.open(root, db.db)
 }
 
 // OpenStorageTrie opens the storage trie of an account.
@@ -141,7 +189,13 @@ func (db *cachingDB) CopyTrie(t Trie) Trie {
 
 // ContractCode retrieves a particular contract's code.
 func (db *cachingDB) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
-	code, err := db.db.Node(codeHash)
+	if codeHash == emptyCode {
+		emptyCodeSkipMeter.Mark(1)
+		return nil, nil
+	}
+	code, err := db.codes.load(codeHash, func() ([]byte, error) {
+		return db.db.Node(codeHash)
+	})
 	if err == nil {
 		db.codeSizeCache.Add(codeHash, len(code))
 	}
@@ -150,6 +204,10 @@ func (db *cachingDB) ContractCode(addrHash, codeHash common.Hash) ([]byte, error
 
 // ContractCodeSize retrieves a particular contracts code's size.
 func (db *cachingDB) ContractCodeSize(addrHash, codeHash common.Hash) (int, error) {
+	if codeHash == emptyCode {
+		emptyCodeSkipMeter.Mark(1)
+		return 0, nil
+	}
 	if cached, ok := db.codeSizeCache.Get(codeHash); ok {
 		return cached.(int), nil
 	}
@@ -157,7 +215,17 @@ func (db *cachingDB) ContractCodeSize(addrHash, codeHash common.Hash) (int, erro
 	return len(code), err
 }
 
+// ReleaseTrie drops the account trie of the given root from the reader pool.
+func (db *cachingDB) ReleaseTrie(root common.Hash) {
+	db.readers.release(root)
+}
+
 // TrieDB retrieves any intermediate trie-node caching layer.
 func (db *cachingDB) TrieDB() *trie.Database {
 	return db.db
 }
+
+// CodeCache retrieves the contract code cache of the database.
+func (db *cachingDB) CodeCache() *CodeCache {
+	return db.codes
+}
@@ -0,0 +1,101 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// DelegationPrefix is the prefix of the code of an account delegating its code
+// to another account (EIP-7702), the address of the delegate following it.
+var DelegationPrefix = []byte{0xef, 0x01, 0x00}
+
+// ParseDelegation extracts the address of the delegate from the code of an
+// account, reporting false if the code isn't a delegation designator.
+func ParseDelegation(code []byte) (common.Address, bool) {
+	if len(code) != len(DelegationPrefix)+common.AddressLength || !bytes.HasPrefix(code, DelegationPrefix) {
+		return common.Address{}, false
+	}
+	return common.BytesToAddress(code[len(DelegationPrefix):]), true
+}
+
+// AddressToDelegation creates the delegation designator pointing to the given
+// address.
+func AddressToDelegation(addr common.Address) []byte {
+	return append(common.CopyBytes(DelegationPrefix), addr[:]...)
+}
+
+// resolveDelegation returns the code to execute for an account with the given
+// code, the code of its delegate if it's a delegation designator, the code itself
+// otherwise.
+//
+// Delegations are resolved a single hop deep: the code of a delegate that itself
+// delegates is returned as is, designator included. This rules out cycles, an
+// account delegating to itself (or to an account delegating back to it) simply
+// resolving to a designator.
+func resolveDelegation(code []byte, getCode func(common.Address) ([]byte, error)) ([]byte, error) {
+	target, ok := ParseDelegation(code)
+	if !ok {
+		return code, nil
+	}
+	return getCode(target)
+}
+
+// GetResolvedCode retrieves the code to execute for the given account, following
+// its delegation if it has one. The resolution goes through the live objects on
+// every call, so changes of both the delegation and the delegate's code are
+// reflected right away.
+func (s *StateDB) GetResolvedCode(addr common.Address) []byte {
+	code, _ := resolveDelegation(s.GetCode(addr), func(target common.Address) ([]byte, error) {
+		return s.GetCode(target), nil
+	})
+	return code
+}
+
+// Code retrieves the code of the given account, nil if it doesn't exist or has
+// no code.
+func (r *Reader) Code(addr common.Address) ([]byte, error) {
+	addrHash := crypto.Keccak256Hash(addr[:])
+	acc, err := r.AccountByHash(addrHash)
+	if acc == nil || err != nil || bytes.Equal(acc.CodeHash, emptyCodeHash) {
+		return nil, err
+	}
+	return r.db.ContractCode(addrHash, common.BytesToHash(acc.CodeHash))
+}
+
+// ResolvedCode retrieves the code to execute for the given account, following
+// its delegation if it has one.
+func (r *Reader) ResolvedCode(addr common.Address) ([]byte, error) {
+	code, err := r.Code(addr)
+	if err != nil {
+		return nil, err
+	}
+	return resolveDelegation(code, r.Code)
+}
+
+// GetResolvedCode retrieves the code to execute for the given account, following
+// its delegation if it has one.
+func (s *ReadOnlyState) GetResolvedCode(addr common.Address) ([]byte, error) {
+	code, err := s.GetCode(addr)
+	if err != nil {
+		return nil, err
+	}
+	return resolveDelegation(code, s.GetCode)
+}
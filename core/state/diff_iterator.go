@@ -0,0 +1,176 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
+)
+
+// storageDiff is a storage trie whose root differs between the two states.
+type storageDiff struct {
+	owner   common.Hash // Hash of the account owning the storage
+	oldRoot common.Hash
+	newRoot common.Hash
+}
+
+// NodeDiffIterator iterates over the trie nodes differing between two states:
+// first the nodes of the account trie, then the nodes of the storage tries that
+// changed, ordered by the hash of their owning accounts. The nodes within a trie
+// are ordered by path.
+//
+// Only the modified parts of the tries are visited, the shared subtrees being
+// skipped, which makes the iterator suitable for extracting the node-level
+// changes of consecutive states.
+type NodeDiffIterator struct {
+	db Database
+
+	owner    common.Hash            // Owner of the trie being iterated, zero for the account trie
+	nodes    *trie.NodeDiffIterator // Node iterator of the current trie
+	storages []storageDiff          // Storage tries left to iterate
+	err      error                  // Failure set in case of an internal error in the iterator
+}
+
+// NewNodeDiffIterator creates an iterator over the trie nodes differing between
+// the states with the given roots. Both states must be available in the trie
+// database.
+func NewNodeDiffIterator(db Database, oldRoot, newRoot common.Hash) (*NodeDiffIterator, error) {
+	storages, err := diffStorageRoots(db, oldRoot, newRoot)
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := trie.NewNodeDiffIterator(db.TrieDB(), oldRoot, newRoot)
+	if err != nil {
+		return nil, err
+	}
+	return &NodeDiffIterator{db: db, nodes: nodes, storages: storages}, nil
+}
+
+// diffStorageRoots collects the accounts whose storage roots differ between the
+// two states, ordered by account hash.
+func diffStorageRoots(db Database, oldRoot, newRoot common.Hash) ([]storageDiff, error) {
+	oldTrie, err := db.OpenTrie(oldRoot)
+	if err != nil {
+		return nil, err
+	}
+	newTrie, err := db.OpenTrie(newRoot)
+	if err != nil {
+		return nil, err
+	}
+	// Gather the storage roots of the accounts modified on either side
+	roots := make(map[common.Hash]*storageDiff)
+	collect := func(a, b Trie, old bool) error {
+		it, _ := trie.NewDifferenceIterator(a.NodeIterator(nil), b.NodeIterator(nil))
+		for it.Next(true) {
+			if !it.Leaf() {
+				continue
+			}
+			var account Account
+			if err := rlp.DecodeBytes(it.LeafBlob(), &account); err != nil {
+				return err
+			}
+			owner := common.BytesToHash(it.LeafKey())
+			diff := roots[owner]
+			if diff == nil {
+				diff = &storageDiff{owner: owner, oldRoot: emptyRoot, newRoot: emptyRoot}
+				roots[owner] = diff
+			}
+			if old {
+				diff.oldRoot = account.Root
+			} else {
+				diff.newRoot = account.Root
+			}
+		}
+		return it.Error()
+	}
+	if err := collect(newTrie, oldTrie, true); err != nil {
+		return nil, err
+	}
+	if err := collect(oldTrie, newTrie, false); err != nil {
+		return nil, err
+	}
+	// Drop the accounts with unchanged storage and sort the rest
+	var storages []storageDiff
+	for _, diff := range roots {
+		if diff.oldRoot != diff.newRoot {
+			storages = append(storages, *diff)
+		}
+	}
+	sort.Slice(storages, func(i, j int) bool {
+		return bytes.Compare(storages[i].owner[:], storages[j].owner[:]) < 0
+	})
+	return storages, nil
+}
+
+// Next moves the iterator to the next differing node, returning whether there
+// are any further differences. In case of an internal error this method returns
+// false and sets the Error field to the encountered failure.
+func (it *NodeDiffIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for !it.nodes.Next() {
+		if it.err = it.nodes.Error(); it.err != nil {
+			return false
+		}
+		if len(it.storages) == 0 {
+			return false
+		}
+		diff := it.storages[0]
+		it.storages = it.storages[1:]
+
+		it.owner = diff.owner
+		if it.nodes, it.err = trie.NewNodeDiffIterator(it.db.TrieDB(), diff.oldRoot, diff.newRoot); it.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Owner returns the hash of the account owning the trie of the current node, or
+// zero for the nodes of the account trie.
+func (it *NodeDiffIterator) Owner() common.Hash {
+	return it.owner
+}
+
+// Path returns the path of the current node within its trie, in nibbles. The
+// slice is only valid until the next call to Next.
+func (it *NodeDiffIterator) Path() []byte {
+	return it.nodes.Path()
+}
+
+// Old returns the blob of the current node in the old state, nil if the node
+// was created.
+func (it *NodeDiffIterator) Old() []byte {
+	return it.nodes.Old()
+}
+
+// New returns the blob of the current node in the new state, nil if the node
+// was deleted.
+func (it *NodeDiffIterator) New() []byte {
+	return it.nodes.New()
+}
+
+// Error returns any failure that occurred during iteration, which might have
+// caused a premature iteration exit.
+func (it *NodeDiffIterator) Error() error {
+	return it.err
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	hintPrefetchAccountMeter = metrics.NewRegisteredMeter("state/hintprefetch/account", nil)
+	hintPrefetchSlotMeter    = metrics.NewRegisteredMeter("state/hintprefetch/slot", nil)
+	hintPrefetchCodeMeter    = metrics.NewRegisteredMeter("state/hintprefetch/code", nil)
+)
+
+// PrefetchHints is the set of accounts and storage slots expected to be accessed
+// by the upcoming blocks, before they are known.
+type PrefetchHints struct {
+	Accounts []common.Address                 // Accounts expected to be accessed
+	Slots    map[common.Address][]common.Hash // Storage slots expected to be accessed
+}
+
+// PrefetchHinter is implemented by the components able to predict the state the
+// next blocks are going to access, e.g. the transaction pool from its pending
+// transactions.
+type PrefetchHinter interface {
+	// PrefetchHints returns the accounts and slots likely to be accessed by the
+	// next block, nil if there's nothing to hint.
+	PrefetchHints() *PrefetchHints
+}
+
+// PrefetchState loads the hinted accounts, storage slots and contract code of the
+// state at root, warming the snapshot and the code caches so the first execution
+// of the next block (or the building of it) doesn't stall on disk reads. The
+// state is read through readers of each worker, so it's safe to run concurrently
+// with a state processing the same root.
+//
+// The prefetching is aborted as soon as the interrupt flag is set, it's meant to
+// be raised when the next block starts being processed.
+func PrefetchState(db Database, snaps *snapshot.Tree, root common.Hash, hints *PrefetchHints, interrupt *uint32) {
+	if hints == nil {
+		return
+	}
+	// Deduplicate the accounts, slotted ones included, and feed them to the workers
+	var (
+		tasks = make(chan common.Address, len(hints.Accounts)+len(hints.Slots))
+		seen  = make(map[common.Address]struct{}, len(hints.Accounts)+len(hints.Slots))
+	)
+	schedule := func(addr common.Address) {
+		if _, ok := seen[addr]; ok {
+			return
+		}
+		seen[addr] = struct{}{}
+		tasks <- addr
+	}
+	for _, addr := range hints.Accounts {
+		schedule(addr)
+	}
+	for addr := range hints.Slots {
+		schedule(addr)
+	}
+	close(tasks)
+
+	threads := codePrefetchThreads
+	if threads > len(seen) {
+		threads = len(seen)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < threads; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			reader, err := StateReaderAt(db, snaps, root, 0)
+			if err != nil {
+				return
+			}
+			for addr := range tasks {
+				if interrupt != nil && atomic.LoadUint32(interrupt) == 1 {
+					return
+				}
+				addrHash := crypto.Keccak256Hash(addr[:])
+				acc, err := reader.AccountByHash(addrHash)
+				hintPrefetchAccountMeter.Mark(1)
+				if err != nil || acc == nil {
+					continue
+				}
+				for _, slot := range hints.Slots[addr] {
+					if interrupt != nil && atomic.LoadUint32(interrupt) == 1 {
+						return
+					}
+					reader.StorageByHashes(addrHash, crypto.Keccak256Hash(slot[:]))
+					hintPrefetchSlotMeter.Mark(1)
+				}
+				if !bytes.Equal(acc.CodeHash, emptyCodeHash) {
+					db.ContractCode(addrHash, common.BytesToHash(acc.CodeHash))
+					hintPrefetchCodeMeter.Mark(1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
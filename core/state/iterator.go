@@ -21,6 +21,7 @@ import (
 	"fmt"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
@@ -152,3 +153,51 @@ func (it *NodeIterator) retrieve() bool {
 	}
 	return true
 }
+
+// NewStorageNodeIterator creates an iterator over the nodes of the storage trie
+// of the account with the given hash in the state at root, starting at the given
+// path. The nodes are resolved through the trie database, so the ones not flushed
+// to disk yet are iterated as well. The storage of non-existent accounts is empty.
+func NewStorageNodeIterator(db Database, root common.Hash, owner common.Hash, start []byte) (trie.NodeIterator, error) {
+	tr, err := db.OpenTrie(root)
+	if err != nil {
+		return nil, err
+	}
+	enc, err := tr.TryGetHashed(owner[:])
+	if err != nil {
+		return nil, err
+	}
+	storageRoot := emptyRoot
+	if len(enc) > 0 {
+		var account Account
+		if err := rlp.DecodeBytes(enc, &account); err != nil {
+			return nil, fmt.Errorf("invalid account %x: %v", owner, err)
+		}
+		storageRoot = account.Root
+	}
+	storage, err := db.OpenStorageTrie(owner, storageRoot)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NodeIterator(start), nil
+}
+
+// StorageNodeIterator creates an iterator over the nodes of the storage trie of
+// the given account, including the storage slots modified but not flushed into
+// the trie yet. The modifications are applied on a copy of the storage trie, so
+// the state itself is left untouched.
+func (s *StateDB) StorageNodeIterator(addr common.Address, start []byte) (trie.NodeIterator, error) {
+	obj := s.getStateObject(addr)
+	if obj == nil {
+		storage, err := s.db.OpenStorageTrie(crypto.Keccak256Hash(addr[:]), emptyRoot)
+		if err != nil {
+			return nil, err
+		}
+		return storage.NodeIterator(start), nil
+	}
+	tr := obj.pendingTrie(s.db)
+	if obj.dbErr != nil {
+		return nil, obj.dbErr
+	}
+	return tr.NodeIterator(start), nil
+}
@@ -21,7 +21,10 @@ import (
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 // Tests that the node iterator indeed walks over the entire database contents.
@@ -63,3 +66,108 @@ func TestNodeIteratorCoverage(t *testing.T) {
 	}
 	it.Release()
 }
+
+// Tests that the storage node iterator walks the storage trie of an account,
+// including the nodes not flushed to disk and the slots not committed yet.
+func TestStorageNodeIterator(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(common.Hash{}, db, nil)
+
+	addr := common.Address{0x1}
+	for i := byte(1); i <= 16; i++ {
+		state.SetState(addr, common.Hash{i}, common.Hash{i})
+	}
+	root, _ := state.Commit(false)
+
+	leaves := func(it trie.NodeIterator) int {
+		var count int
+		for it.Next(true) {
+			if it.Leaf() {
+				count++
+			}
+		}
+		if it.Error() != nil {
+			t.Fatalf("iteration failed: %v", it.Error())
+		}
+		return count
+	}
+	// Iterate the committed storage, which only lives in the trie database
+	it, err := NewStorageNodeIterator(db, root, crypto.Keccak256Hash(addr[:]), nil)
+	if err != nil {
+		t.Fatalf("failed to create storage iterator: %v", err)
+	}
+	if n := leaves(it); n != 16 {
+		t.Fatalf("storage leaf count mismatch: have %d, want %d", n, 16)
+	}
+	if it, _ = NewStorageNodeIterator(db, root, common.Hash{0xff}, nil); leaves(it) != 0 {
+		t.Fatalf("storage of non-existent account iterated")
+	}
+	// Modify the storage without committing, the changes should be iterated
+	state, _ = New(root, db, nil)
+	state.SetState(addr, common.Hash{0x1}, common.Hash{})
+	state.SetState(addr, common.Hash{0x20}, common.Hash{0x20})
+	state.SetState(addr, common.Hash{0x21}, common.Hash{0x21})
+
+	if it, err = state.StorageNodeIterator(addr, nil); err != nil {
+		t.Fatalf("failed to create pending storage iterator: %v", err)
+	}
+	if n := leaves(it); n != 17 {
+		t.Fatalf("pending storage leaf count mismatch: have %d, want %d", n, 17)
+	}
+	// The state itself should be left untouched
+	if hash := state.IntermediateRoot(false); hash == root {
+		t.Fatalf("state changes lost")
+	}
+	if val := state.GetState(addr, common.Hash{0x20}); val != (common.Hash{0x20}) {
+		t.Fatalf("storage slot mismatch: have %x, want %x", val, common.Hash{0x20})
+	}
+}
+
+// Tests that the node diff iterator walks over the changed nodes of the account
+// trie and of the modified storage tries only.
+func TestNodeDiffIterator(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(common.Hash{}, db, nil)
+
+	var (
+		addrA = common.Address{0xa}
+		addrB = common.Address{0xb}
+		addrC = common.Address{0xc}
+	)
+	for i := byte(1); i <= 16; i++ {
+		state.SetState(addrA, common.Hash{i}, common.Hash{i})
+		state.SetState(addrB, common.Hash{i}, common.Hash{i})
+	}
+	oldRoot, _ := state.Commit(false)
+
+	// Modify the storage of A and the balance of B, create C
+	state, _ = New(oldRoot, db, nil)
+	state.SetState(addrA, common.Hash{0x1}, common.Hash{0x11})
+	state.SetBalance(addrB, common.Big1)
+	state.SetState(addrC, common.Hash{0x1}, common.Hash{0x1})
+	newRoot, _ := state.Commit(false)
+
+	it, err := NewNodeDiffIterator(db, oldRoot, newRoot)
+	if err != nil {
+		t.Fatalf("failed to create iterator: %v", err)
+	}
+	owners := make(map[common.Hash]int)
+	for it.Next() {
+		owners[it.Owner()]++
+		for _, blob := range [][]byte{it.Old(), it.New()} {
+			if blob == nil {
+				continue
+			}
+			if stored, _ := db.TrieDB().Node(crypto.Keccak256Hash(blob)); !bytes.Equal(stored, blob) {
+				t.Fatalf("owner %x, path %x: blob %x not stored", it.Owner(), it.Path(), blob)
+			}
+		}
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	hashA, hashC := crypto.Keccak256Hash(addrA[:]), crypto.Keccak256Hash(addrC[:])
+	if len(owners) != 3 || owners[common.Hash{}] == 0 || owners[hashA] == 0 || owners[hashC] == 0 {
+		t.Fatalf("owner set mismatch: %v", owners)
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// objectCacheLimit is the maximum number of accounts retained in a single
+// generation of the object cache.
+const objectCacheLimit = 16384
+
+var (
+	objectCacheHitMeter  = metrics.NewRegisteredMeter("state/objcache/hit", nil)
+	objectCacheMissMeter = metrics.NewRegisteredMeter("state/objcache/miss", nil)
+)
+
+// cachedObject is the decoded metadata of an account along with its committed
+// storage slots. Cached objects are immutable once inserted into the cache.
+type cachedObject struct {
+	hash    common.Hash // Hash of the account RLP the object is built from
+	data    Account     // Decoded account metadata
+	storage Storage     // Committed storage slots accessed so far
+}
+
+// objectCache is a generational cache of decoded state objects, retained across
+// blocks to avoid decoding the frequently accessed accounts and reloading their
+// storage slots again and again.
+//
+// Objects are keyed by account hash, but only served if the account RLP being
+// resolved hashes to the same value the object was built from. Any write to the
+// account changes the RLP and thus invalidates the cached object.
+//
+// The cache holds two generations: the objects accessed in the most recently
+// committed block and the ones in the block before. Every commit retires the
+// older generation, so only the accounts accessed repeatedly are retained.
+type objectCache struct {
+	young map[common.Hash]*cachedObject // Objects accessed in the last committed block
+	old   map[common.Hash]*cachedObject // Objects accessed in the block before
+	lock  sync.Mutex
+}
+
+// newObjectCache creates an empty generational object cache.
+func newObjectCache() *objectCache {
+	return &objectCache{
+		young: make(map[common.Hash]*cachedObject),
+		old:   make(map[common.Hash]*cachedObject),
+	}
+}
+
+// get retrieves the cached object of the given account if it's built from the
+// account RLP with the specified hash.
+func (c *objectCache) get(addrHash common.Hash, hash common.Hash) *cachedObject {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if obj := c.young[addrHash]; obj != nil && obj.hash == hash {
+		objectCacheHitMeter.Mark(1)
+		return obj
+	}
+	if obj := c.old[addrHash]; obj != nil && obj.hash == hash {
+		objectCacheHitMeter.Mark(1)
+		return obj
+	}
+	objectCacheMissMeter.Mark(1)
+	return nil
+}
+
+// commit retires the old generation and starts a new one with the objects
+// accessed in the committed block. The objects of the previous young generation
+// are retained until the next commit.
+func (c *objectCache) commit(objects map[common.Hash]*cachedObject) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.old, c.young = c.young, objects
+}
+
+// updateObjectCache collects the live state objects after the commit and hands
+// them to the object cache as the new generation. The objects are keyed by the
+// hash of the account RLP in the format which will be resolved next time, the
+// slim format if the snapshot is available or the consensus format otherwise.
+func (s *StateDB) updateObjectCache() {
+	objects := make(map[common.Hash]*cachedObject, len(s.stateObjects))
+	for _, obj := range s.stateObjects {
+		if len(objects) >= objectCacheLimit {
+			break
+		}
+		if obj.deleted || obj.fakeStorage != nil {
+			continue
+		}
+		var enc []byte
+		if s.snap != nil {
+			enc = snapshot.SlimAccountRLP(obj.data.Nonce, obj.data.Balance, obj.data.Root, obj.data.CodeHash)
+		} else {
+			var err error
+			if enc, err = rlp.EncodeToBytes(&obj.data); err != nil {
+				continue
+			}
+		}
+		cached := &cachedObject{
+			hash: crypto.Keccak256Hash(enc),
+			data: Account{
+				Nonce:    obj.data.Nonce,
+				Balance:  new(big.Int).Set(obj.data.Balance),
+				Root:     obj.data.Root,
+				CodeHash: common.CopyBytes(obj.data.CodeHash),
+			},
+			storage: obj.originStorage.Copy(),
+		}
+		objects[obj.addrHash] = cached
+	}
+	s.objCache.commit(objects)
+}
+
+// loadCachedObject resolves the state object of the given account from the
+// object cache if it's built from the given account RLP. Nil is returned if
+// there is no such object cached.
+func (s *StateDB) loadCachedObject(addr common.Address, addrHash common.Hash, enc []byte) *stateObject {
+	if s.objCache == nil {
+		return nil
+	}
+	cached := s.objCache.get(addrHash, crypto.Keccak256Hash(enc))
+	if cached == nil {
+		return nil
+	}
+	obj := newObject(s, addr, Account{
+		Nonce:    cached.data.Nonce,
+		Balance:  new(big.Int).Set(cached.data.Balance),
+		Root:     cached.data.Root,
+		CodeHash: cached.data.CodeHash,
+	})
+	obj.originStorage = cached.storage.Copy()
+	obj.existed = true
+	return obj
+}
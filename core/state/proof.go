@@ -0,0 +1,145 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+)
+
+// AccountProof is the merkle proof of an account and some of its storage slots
+// against a state root, along with the proven content.
+type AccountProof struct {
+	Address common.Address
+	Proof   [][]byte // Account trie nodes along the path of the account
+
+	Nonce       uint64
+	Balance     *big.Int
+	StorageRoot common.Hash
+	CodeHash    common.Hash
+	CodeSize    int
+	Code        []byte // Contract code, only retrieved if requested
+
+	Storage []StorageProof // Proofs of the requested slots, in request order
+}
+
+// StorageProof is the merkle proof of a storage slot against the storage root
+// of its account, along with the proven value.
+type StorageProof struct {
+	Key   common.Hash
+	Value common.Hash
+	Proof [][]byte // Storage trie nodes along the path of the slot, empty for missing accounts
+}
+
+// Proof assembles the merkle proof of an account and the given storage slots,
+// along with the code size and optionally the code itself. Everything is served
+// from the tries of the reader's root, the proofs of missing accounts and slots
+// being proofs of absence.
+func (r *Reader) Proof(addr common.Address, slots []common.Hash, withCode bool) (*AccountProof, error) {
+	tr, err := r.accountTrie()
+	if err != nil {
+		return nil, err
+	}
+	addrHash := crypto.Keccak256Hash(addr[:])
+
+	var proof proofList
+	if err := tr.Prove(addrHash[:], 0, &proof); err != nil {
+		return nil, err
+	}
+	acc, err := r.trieAccount(tr, addrHash)
+	if err != nil {
+		return nil, err
+	}
+	result := &AccountProof{
+		Address:     addr,
+		Proof:       proof,
+		Balance:     new(big.Int),
+		StorageRoot: emptyRoot,
+		CodeHash:    common.BytesToHash(emptyCodeHash),
+		Storage:     make([]StorageProof, len(slots)),
+	}
+	if acc == nil {
+		for i, slot := range slots {
+			result.Storage[i] = StorageProof{Key: slot}
+		}
+		return result, nil
+	}
+	result.Nonce, result.Balance = acc.Nonce, acc.Balance
+	result.StorageRoot, result.CodeHash = acc.Root, common.BytesToHash(acc.CodeHash)
+
+	// Retrieve the code, or only its size if the code itself isn't needed
+	if !bytes.Equal(acc.CodeHash, emptyCodeHash) {
+		if withCode {
+			if result.Code, err = r.db.ContractCode(addrHash, result.CodeHash); err != nil {
+				return nil, err
+			}
+			result.CodeSize = len(result.Code)
+		} else {
+			if result.CodeSize, err = r.db.ContractCodeSize(addrHash, result.CodeHash); err != nil {
+				return nil, err
+			}
+		}
+	}
+	// Prove the requested slots from the storage trie
+	st, err := r.storageTrie(addrHash, acc.Root)
+	if err != nil {
+		return nil, err
+	}
+	for i, slot := range slots {
+		slotHash := crypto.Keccak256Hash(slot[:])
+
+		var proof proofList
+		if err := st.Prove(slotHash[:], 0, &proof); err != nil {
+			return nil, err
+		}
+		enc, err := st.TryGetHashed(slotHash[:])
+		if err != nil {
+			return nil, err
+		}
+		value, err := decodeSlot(addrHash, slotHash, enc)
+		if err != nil {
+			return nil, err
+		}
+		result.Storage[i] = StorageProof{Key: slot, Value: value, Proof: proof}
+	}
+	return result, nil
+}
+
+// Reader returns a reader over the current content of the state, including the
+// modifications not yet committed to the database. The modifications are only
+// visible after the state has been hashed (i.e. IntermediateRoot was called),
+// which is always the case for the states of finalized blocks.
+//
+// The reader works on copies of the tries, later changes to the state are not
+// reflected in it.
+func (s *StateDB) Reader() *Reader {
+	r := &Reader{
+		db:       s.db,
+		root:     s.trie.Hash(),
+		trie:     s.db.CopyTrie(s.trie),
+		storages: make(map[common.Hash]Trie),
+	}
+	for _, obj := range s.stateObjects {
+		if obj.trie != nil && !obj.deleted {
+			r.storages[obj.addrHash] = s.db.CopyTrie(obj.trie)
+		}
+	}
+	return r
+}
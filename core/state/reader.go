@@ -0,0 +1,277 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// Reader provides read-only access to the accounts and storage slots of the
+// state at a given root. The data is served from the snapshot if it's available
+// and covers the requested item, from the tries otherwise. It's the preferred way
+// to access state without executing on top of it, StateDB being needed only for
+// the mutations.
+//
+// All the data served by a reader belongs to its root: the snapshot layer of the
+// root reflects exactly that state, and once it turns stale (e.g. flattened into
+// the disk layer by the chain progressing) the reader transparently falls back to
+// the tries. The tries stay readable as long as the trie database retains the
+// nodes of the root, afterwards the reads fail with a trie.MissingNodeError, they
+// never return data of a different state.
+//
+// Besides the address keyed lookups, the items can be retrieved by their hashes
+// directly. These skip the hashing and don't need the preimages, which is what
+// the code paths only knowing the hashes (e.g. snap sync, snapshot repair) need.
+//
+// Reader is not safe for concurrent use.
+type Reader struct {
+	db     Database
+	root   common.Hash
+	number uint64            // Number of the block the state belongs to, zero if unknown
+	snap   snapshot.Snapshot // Snapshot of the state, nil if unavailable
+
+	trie     Trie                 // Account trie, opened on the first snapshot miss
+	storages map[common.Hash]Trie // Storage tries opened so far, keyed by account hash (nil if no storage)
+}
+
+// StateReader is the read-only access to the accounts and storage slots of a
+// state, implemented by Reader and ReadOnlyState.
+type StateReader interface {
+	// GetBalance retrieves the balance of the given account, zero if it doesn't
+	// exist.
+	GetBalance(addr common.Address) (*big.Int, error)
+
+	// GetNonce retrieves the nonce of the given account, zero if it doesn't exist.
+	GetNonce(addr common.Address) (uint64, error)
+
+	// GetCode retrieves the code of the given account, nil if it doesn't exist or
+	// has no code.
+	GetCode(addr common.Address) ([]byte, error)
+
+	// GetState retrieves the value of the given storage slot of an account, zero
+	// if the slot or the account doesn't exist.
+	GetState(addr common.Address, key common.Hash) (common.Hash, error)
+}
+
+// StateReaderAt is the factory of all the read-only state accesses. It creates
+// the fastest available reader for the state at root, which belongs to the block
+// with the given number (zero if unknown), snaps being optional. If no snapshot
+// is available for the root, the account trie is opened right away to ensure the
+// state exists. See Reader for the consistency guarantees.
+//
+// No state history is retained beyond the tries, so the block number can't be
+// used to recover a pruned state. It's used to name the block whose state is
+// missing instead.
+func StateReaderAt(db Database, snaps *snapshot.Tree, root common.Hash, number uint64) (*Reader, error) {
+	r := &Reader{
+		db:       db,
+		root:     root,
+		number:   number,
+		storages: make(map[common.Hash]Trie),
+	}
+	if snaps != nil {
+		r.snap = snaps.Snapshot(root)
+	}
+	if r.snap == nil {
+		if _, err := r.accountTrie(); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// Account retrieves the account with the given address, nil if it doesn't exist.
+func (r *Reader) Account(addr common.Address) (*Account, error) {
+	return r.AccountByHash(crypto.Keccak256Hash(addr[:]))
+}
+
+// AccountByHash retrieves the account with the given address hash, nil if it
+// doesn't exist.
+func (r *Reader) AccountByHash(addrHash common.Hash) (*Account, error) {
+	if r.snap != nil {
+		if acc, err := r.snap.Account(addrHash); err == nil {
+			if acc == nil {
+				return nil, nil
+			}
+			data := &Account{
+				Nonce:    acc.Nonce,
+				Balance:  acc.Balance,
+				Root:     common.BytesToHash(acc.Root),
+				CodeHash: acc.CodeHash,
+			}
+			if len(data.CodeHash) == 0 {
+				data.CodeHash = emptyCodeHash
+			}
+			if data.Root == (common.Hash{}) {
+				data.Root = emptyRoot
+			}
+			return data, nil
+		}
+	}
+	// Snapshot unavailable or unable to serve the account, load from the trie
+	tr, err := r.accountTrie()
+	if err != nil {
+		return nil, err
+	}
+	return r.trieAccount(tr, addrHash)
+}
+
+// accountTrie returns the account trie of the state, opening it if needed.
+func (r *Reader) accountTrie() (Trie, error) {
+	if r.trie == nil {
+		tr, err := r.db.OpenTrie(r.root)
+		if err != nil {
+			if r.number != 0 {
+				return nil, fmt.Errorf("state of block #%d unavailable: %v", r.number, err)
+			}
+			return nil, err
+		}
+		r.trie = tr
+	}
+	return r.trie, nil
+}
+
+// trieAccount retrieves the account with the given address hash from the account
+// trie, nil if it doesn't exist.
+func (r *Reader) trieAccount(tr Trie, addrHash common.Hash) (*Account, error) {
+	enc, err := tr.TryGetHashed(addrHash[:])
+	if err != nil {
+		return nil, err
+	}
+	if len(enc) == 0 {
+		return nil, nil
+	}
+	data := new(Account)
+	if err := rlp.DecodeBytes(enc, data); err != nil {
+		return nil, fmt.Errorf("invalid account %x: %v", addrHash, err)
+	}
+	return data, nil
+}
+
+// storageTrie returns the storage trie of the given account, opening it if needed.
+func (r *Reader) storageTrie(addrHash common.Hash, root common.Hash) (Trie, error) {
+	if tr := r.storages[addrHash]; tr != nil {
+		return tr, nil
+	}
+	tr, err := r.db.OpenStorageTrie(addrHash, root)
+	if err != nil {
+		return nil, err
+	}
+	r.storages[addrHash] = tr
+	return tr, nil
+}
+
+// Storage retrieves the value of the given storage slot of an account. The zero
+// value is returned for missing slots and accounts.
+func (r *Reader) Storage(addr common.Address, key common.Hash) (common.Hash, error) {
+	return r.StorageByHashes(crypto.Keccak256Hash(addr[:]), crypto.Keccak256Hash(key[:]))
+}
+
+// StorageByHashes retrieves the value of a storage slot by the hash of the slot
+// key and the hash of the account address. The zero value is returned for missing
+// slots and accounts.
+func (r *Reader) StorageByHashes(addrHash, slotHash common.Hash) (common.Hash, error) {
+	var (
+		enc []byte
+		err error
+	)
+	if r.snap != nil {
+		enc, err = r.snap.Storage(addrHash, slotHash)
+	}
+	// Snapshot unavailable or unable to serve the slot, load from the trie
+	if r.snap == nil || err != nil {
+		tr, ok := r.storages[addrHash]
+		if !ok {
+			acc, err := r.AccountByHash(addrHash)
+			if err != nil {
+				return common.Hash{}, err
+			}
+			// Accounts without storage have nothing to look up, remember them
+			// instead of opening an empty trie
+			if acc == nil || acc.Root == emptyRoot {
+				r.storages[addrHash] = nil
+			} else if tr, err = r.storageTrie(addrHash, acc.Root); err != nil {
+				return common.Hash{}, err
+			}
+		}
+		if tr == nil {
+			emptyStorageSkipMeter.Mark(1)
+			return common.Hash{}, nil
+		}
+		if enc, err = tr.TryGetHashed(slotHash[:]); err != nil {
+			return common.Hash{}, err
+		}
+	}
+	return decodeSlot(addrHash, slotHash, enc)
+}
+
+// decodeSlot decodes the RLP encoded value of a storage slot, the zero value
+// standing for a missing slot.
+func decodeSlot(addrHash, slotHash common.Hash, enc []byte) (common.Hash, error) {
+	var value common.Hash
+	if len(enc) > 0 {
+		_, content, _, err := rlp.Split(enc)
+		if err != nil {
+			return common.Hash{}, fmt.Errorf("invalid slot %x of %x: %v", slotHash, addrHash, err)
+		}
+		value.SetBytes(content)
+	}
+	return value, nil
+}
+
+// GetBalance retrieves the balance of the given account, zero if it doesn't
+// exist.
+func (r *Reader) GetBalance(addr common.Address) (*big.Int, error) {
+	acc, err := r.Account(addr)
+	if acc == nil || err != nil {
+		return new(big.Int), err
+	}
+	return acc.Balance, nil
+}
+
+// GetNonce retrieves the nonce of the given account, zero if it doesn't exist.
+func (r *Reader) GetNonce(addr common.Address) (uint64, error) {
+	acc, err := r.Account(addr)
+	if acc == nil || err != nil {
+		return 0, err
+	}
+	return acc.Nonce, nil
+}
+
+// GetCode retrieves the code of the given account, nil if it doesn't exist or
+// has no code.
+func (r *Reader) GetCode(addr common.Address) ([]byte, error) {
+	addrHash := crypto.Keccak256Hash(addr[:])
+	acc, err := r.AccountByHash(addrHash)
+	if acc == nil || err != nil || bytes.Equal(acc.CodeHash, emptyCodeHash) {
+		return nil, err
+	}
+	return r.db.ContractCode(addrHash, common.BytesToHash(acc.CodeHash))
+}
+
+// GetState retrieves the value of the given storage slot of an account, zero if
+// the slot or the account doesn't exist.
+func (r *Reader) GetState(addr common.Address, key common.Hash) (common.Hash, error) {
+	return r.Storage(addr, key)
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/trie"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+// readerPoolLimit is the maximum number of state roots whose account tries are
+// retained in the reader pool.
+const readerPoolLimit = 128
+
+var (
+	readerPoolHitMeter  = metrics.NewRegisteredMeter("state/readers/hit", nil)
+	readerPoolMissMeter = metrics.NewRegisteredMeter("state/readers/miss", nil)
+)
+
+// readerPool retains the recently opened account tries keyed by their state
+// root, so that the repeated accesses of the same state (e.g. RPC calls served
+// on top of the chain head) don't have to construct the trie over and over.
+//
+// The pooled tries are never handed out directly, only cheap copies of them.
+// As tries never modify their nodes in place, the copies share all the resolved
+// nodes with the pooled one while being safe to read and modify concurrently.
+//
+// A pooled trie stays valid as long as the trie nodes of its root are retained
+// by the trie database. Once a root is dereferenced, its reader must be released
+// from the pool.
+type readerPool struct {
+	tries *lru.Cache // Account tries keyed by state root, safe for concurrent use
+}
+
+// newReaderPool creates an empty pool of account trie readers.
+func newReaderPool() *readerPool {
+	tries, _ := lru.New(readerPoolLimit)
+	return &readerPool{tries: tries}
+}
+
+// open returns a copy of the account trie of the given root, constructing and
+// pooling the trie if it's not available yet.
+func (p *readerPool) open(root common.Hash, db *trie.Database) (*trie.SecureTrie, error) {
+	if cached, ok := p.tries.Get(root); ok {
+		readerPoolHitMeter.Mark(1)
+		return cached.(*trie.SecureTrie).Copy(), nil
+	}
+	readerPoolMissMeter.Mark(1)
+
+	tr, err := trie.NewSecure(root, db)
+	if err != nil {
+		return nil, err
+	}
+	p.tries.Add(root, tr)
+	return tr.Copy(), nil
+}
+
+// release drops the account trie of the given root from the pool.
+func (p *readerPool) release(root common.Hash) {
+	p.tries.Remove(root)
+}
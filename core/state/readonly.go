@@ -0,0 +1,210 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"math/big"
+	"sync"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/crypto"
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const (
+	// readOnlyAccountLimit is the maximum number of accounts cached by a read-only
+	// view of the state.
+	readOnlyAccountLimit = 16384
+
+	// readOnlySlotLimit is the maximum number of storage slots cached by a
+	// read-only view of the state.
+	readOnlySlotLimit = 65536
+
+	// readOnlyStorageLimit is the maximum number of storage tries an idle reader
+	// of a read-only view retains, the readers exceeding it are dropped.
+	readOnlyStorageLimit = 256
+)
+
+// ReadOnlyState is an immutable view of the state at a given root, which can be
+// queried by many goroutines concurrently. It's meant for the pure reads (e.g.
+// balance, storage or code retrievals of RPC calls), which don't need the
+// journaling and the mutation support of StateDB.
+//
+// The recently retrieved accounts and slots are cached and shared between all the
+// users of the view. Since the state never changes, the cached items never turn
+// stale. The data is served by Readers, see Reader for the consistency guarantees.
+type ReadOnlyState struct {
+	db    Database
+	snaps *snapshot.Tree
+	root  common.Hash
+
+	readers  sync.Pool  // Idle readers of the state, each used by one goroutine at a time
+	accounts *lru.Cache // Accounts retrieved recently, keyed by address hash, nil if missing
+	slots    *lru.Cache // Storage slots retrieved recently, keyed by address and slot hash
+}
+
+// NewReadOnlyState creates a concurrent read-only view of the state at root,
+// snaps being optional.
+func NewReadOnlyState(db Database, snaps *snapshot.Tree, root common.Hash) (*ReadOnlyState, error) {
+	// Create a reader upfront to ensure the state exists
+	reader, err := StateReaderAt(db, snaps, root, 0)
+	if err != nil {
+		return nil, err
+	}
+	accounts, _ := lru.New(readOnlyAccountLimit)
+	slots, _ := lru.New(readOnlySlotLimit)
+
+	s := &ReadOnlyState{
+		db:       db,
+		snaps:    snaps,
+		root:     root,
+		accounts: accounts,
+		slots:    slots,
+	}
+	s.readers.Put(reader)
+	return s, nil
+}
+
+// Root returns the root hash of the state.
+func (s *ReadOnlyState) Root() common.Hash {
+	return s.root
+}
+
+// reader retrieves an idle reader of the state or creates a new one if there's
+// none available. The reader must be returned to the pool after use.
+func (s *ReadOnlyState) reader() (*Reader, error) {
+	if reader, ok := s.readers.Get().(*Reader); ok {
+		return reader, nil
+	}
+	return StateReaderAt(s.db, s.snaps, s.root, 0)
+}
+
+// release returns a reader to the pool after use. The readers having opened too
+// many storage tries are dropped instead, so the pool doesn't grow unbounded.
+func (s *ReadOnlyState) release(reader *Reader) {
+	if len(reader.storages) > readOnlyStorageLimit {
+		return
+	}
+	s.readers.Put(reader)
+}
+
+// account retrieves the account with the given address hash, nil if it doesn't
+// exist. The returned account is shared and must not be modified.
+func (s *ReadOnlyState) account(addrHash common.Hash) (*Account, error) {
+	if cached, ok := s.accounts.Get(addrHash); ok {
+		return cached.(*Account), nil
+	}
+	reader, err := s.reader()
+	if err != nil {
+		return nil, err
+	}
+	acc, err := reader.AccountByHash(addrHash)
+	s.release(reader)
+	if err != nil {
+		return nil, err
+	}
+	s.accounts.Add(addrHash, acc)
+	return acc, nil
+}
+
+// Exist reports whether the given account exists in the state.
+func (s *ReadOnlyState) Exist(addr common.Address) (bool, error) {
+	acc, err := s.account(crypto.Keccak256Hash(addr[:]))
+	return acc != nil, err
+}
+
+// GetBalance retrieves the balance of the given account, zero if it doesn't
+// exist.
+func (s *ReadOnlyState) GetBalance(addr common.Address) (*big.Int, error) {
+	acc, err := s.account(crypto.Keccak256Hash(addr[:]))
+	if acc == nil || err != nil {
+		return new(big.Int), err
+	}
+	return new(big.Int).Set(acc.Balance), nil
+}
+
+// GetNonce retrieves the nonce of the given account, zero if it doesn't exist.
+func (s *ReadOnlyState) GetNonce(addr common.Address) (uint64, error) {
+	acc, err := s.account(crypto.Keccak256Hash(addr[:]))
+	if acc == nil || err != nil {
+		return 0, err
+	}
+	return acc.Nonce, nil
+}
+
+// GetCodeHash retrieves the code hash of the given account, zero if it doesn't
+// exist.
+func (s *ReadOnlyState) GetCodeHash(addr common.Address) (common.Hash, error) {
+	acc, err := s.account(crypto.Keccak256Hash(addr[:]))
+	if acc == nil || err != nil {
+		return common.Hash{}, err
+	}
+	return common.BytesToHash(acc.CodeHash), nil
+}
+
+// GetCode retrieves the code of the given account, nil if it doesn't exist or
+// has no code.
+func (s *ReadOnlyState) GetCode(addr common.Address) ([]byte, error) {
+	addrHash := crypto.Keccak256Hash(addr[:])
+	acc, err := s.account(addrHash)
+	if acc == nil || err != nil || bytes.Equal(acc.CodeHash, emptyCodeHash) {
+		return nil, err
+	}
+	return s.db.ContractCode(addrHash, common.BytesToHash(acc.CodeHash))
+}
+
+// GetCodeSize retrieves the code size of the given account, zero if it doesn't
+// exist or has no code.
+func (s *ReadOnlyState) GetCodeSize(addr common.Address) (int, error) {
+	addrHash := crypto.Keccak256Hash(addr[:])
+	acc, err := s.account(addrHash)
+	if acc == nil || err != nil || bytes.Equal(acc.CodeHash, emptyCodeHash) {
+		return 0, err
+	}
+	return s.db.ContractCodeSize(addrHash, common.BytesToHash(acc.CodeHash))
+}
+
+// GetState retrieves the value of the given storage slot of an account, zero if
+// the slot or the account doesn't exist.
+func (s *ReadOnlyState) GetState(addr common.Address, key common.Hash) (common.Hash, error) {
+	var (
+		addrHash = crypto.Keccak256Hash(addr[:])
+		slotHash = crypto.Keccak256Hash(key[:])
+		cacheKey = string(append(addrHash[:], slotHash[:]...))
+	)
+	if cached, ok := s.slots.Get(cacheKey); ok {
+		return cached.(common.Hash), nil
+	}
+	// Skip the storage lookup altogether for missing accounts
+	acc, err := s.account(addrHash)
+	if acc == nil || err != nil {
+		return common.Hash{}, err
+	}
+	reader, err := s.reader()
+	if err != nil {
+		return common.Hash{}, err
+	}
+	value, err := reader.StorageByHashes(addrHash, slotHash)
+	s.release(reader)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	s.slots.Add(cacheKey, value)
+	return value, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// countStorage iterates the persisted storage snapshot of an account and counts
+// the number of slots and their total size. If limit is non-nil, only slots
+// before it are counted.
+func countStorage(db ethdb.KeyValueStore, accountHash common.Hash, limit []byte) *rawdb.StorageStats {
+	stats := new(rawdb.StorageStats)
+
+	it := rawdb.IterateStorageSnapshots(db, accountHash)
+	defer it.Release()
+
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(rawdb.SnapshotStoragePrefix)+2*common.HashLength {
+			continue
+		}
+		if limit != nil && bytes.Compare(key[len(rawdb.SnapshotStoragePrefix)+common.HashLength:], limit) >= 0 {
+			break
+		}
+		stats.Slots++
+		stats.Size += uint64(len(it.Value()))
+	}
+	return stats
+}
+
+// loadStorageStats retrieves the storage accounting of an account from the
+// database, falling back to counting the slots if no stats are tracked (e.g.
+// the storage was modified since they were last counted, or the snapshot was
+// created by an older version).
+//
+// Note, the counted stats are not persisted: this is a read path running under
+// the read lock of the disk layer, concurrently with the flushes updating the
+// storage. The stats are only ever written by the generator and the flushes.
+func loadStorageStats(db ethdb.KeyValueStore, accountHash common.Hash) *rawdb.StorageStats {
+	if stats := rawdb.ReadStorageStats(db, accountHash); stats != nil {
+		return stats
+	}
+	return countStorage(db, accountHash, nil)
+}
+
+// updateStorageStats applies a slot modification onto the storage accounting.
+func updateStorageStats(stats *rawdb.StorageStats, prev []byte, data []byte) {
+	switch {
+	case len(prev) == 0 && len(data) > 0:
+		stats.Slots++
+		stats.Size += uint64(len(data))
+
+	case len(prev) > 0 && len(data) == 0:
+		stats.Slots--
+		stats.Size -= uint64(len(prev))
+
+	case len(prev) > 0 && len(data) > 0:
+		stats.Size = stats.Size - uint64(len(prev)) + uint64(len(data))
+	}
+}
+
+// writeStorageStats persists the storage accounting of an account, deleting the
+// entry altogether if the account has no storage left.
+func writeStorageStats(db ethdb.KeyValueWriter, accountHash common.Hash, stats *rawdb.StorageStats) {
+	if stats.Slots == 0 {
+		rawdb.DeleteStorageStats(db, accountHash)
+		return
+	}
+	rawdb.WriteStorageStats(db, accountHash, stats)
+}
+
+// StorageStats retrieves the number of storage slots and their total size of an
+// account, as tracked by the persistent disk layer. Note, the returned stats do
+// not include the modifications in the memory diff layers on top.
+func (t *Tree) StorageStats(accountHash common.Hash) (*rawdb.StorageStats, error) {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	for _, layer := range t.layers {
+		if base, ok := layer.(*diskLayer); ok {
+			return base.storageStats(accountHash)
+		}
+	}
+	return nil, ErrSnapshotStale
+}
+
+// storageStats retrieves the storage accounting of an account from the disk
+// layer, ensuring it's already covered by the generator.
+func (dl *diskLayer) storageStats(accountHash common.Hash) (*rawdb.StorageStats, error) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.stale {
+		return nil, ErrSnapshotStale
+	}
+	// The stats of the account in progress are only written when it's done
+	if marker := dl.genMarkerOf(accountHash[:]); marker != nil && bytes.Compare(accountHash[:], marker) >= 0 {
+		return nil, newNotCoveredError(marker, dl.genShards)
+	}
+	// The storage being wiped is already gone, don't count the leftovers
+	if dl.wiper != nil && dl.wiper.wiping(accountHash) {
+		return new(rawdb.StorageStats), nil
+	}
+	return loadStorageStats(dl.diskdb, accountHash), nil
+}
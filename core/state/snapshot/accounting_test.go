@@ -0,0 +1,100 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"testing"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// Tests that the per-account storage accounting is maintained incrementally as
+// diff layers are flattened into the disk layer.
+func TestStorageAccounting(t *testing.T) {
+	var (
+		db        = memorydb.New()
+		accKeep   = common.Hash{0x1}
+		accNuke   = common.Hash{0x2}
+		accLegacy = common.Hash{0x3}
+		baseRoot  = randomHash()
+		diffRoot  = randomHash()
+	)
+	// Create a few accounts with storage, one of them without any stats tracked
+	rawdb.WriteStorageSnapshot(db, accKeep, common.Hash{0x10}, []byte{0x01})
+	rawdb.WriteStorageSnapshot(db, accKeep, common.Hash{0x11}, []byte{0x01, 0x02})
+	rawdb.WriteStorageStats(db, accKeep, &rawdb.StorageStats{Slots: 2, Size: 3})
+
+	rawdb.WriteStorageSnapshot(db, accNuke, common.Hash{0x20}, []byte{0x01})
+	rawdb.WriteStorageStats(db, accNuke, &rawdb.StorageStats{Slots: 1, Size: 1})
+
+	rawdb.WriteStorageSnapshot(db, accLegacy, common.Hash{0x30}, []byte{0x01, 0x02, 0x03})
+	rawdb.WriteSnapshotRoot(db, baseRoot)
+
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			baseRoot: &diskLayer{
+				diskdb: db,
+				cache:  fastcache.New(500 * 1024),
+				root:   baseRoot,
+			},
+		},
+	}
+	// Modify, add and delete some slots, nuke and recreate an account
+	if err := snaps.Update(diffRoot, baseRoot, map[common.Hash]struct{}{accNuke: {}}, nil, map[common.Hash]map[common.Hash][]byte{
+		accKeep: {
+			common.Hash{0x10}: nil,
+			common.Hash{0x11}: {0x01, 0x02, 0x03, 0x04},
+			common.Hash{0x12}: {0x01},
+		},
+		accNuke: {
+			common.Hash{0x21}: {0x01, 0x02},
+		},
+		accLegacy: {
+			common.Hash{0x31}: {0x01},
+		},
+	}); err != nil {
+		t.Fatalf("failed to update snapshot tree: %v", err)
+	}
+	if err := snaps.Cap(diffRoot, 0); err != nil {
+		t.Fatalf("failed to flatten snapshot tree: %v", err)
+	}
+	for i, tt := range []struct {
+		account common.Hash
+		slots   uint64
+		size    uint64
+	}{
+		{accKeep, 2, 5},
+		{accNuke, 1, 2},
+		{accLegacy, 2, 4},
+		{common.Hash{0x4}, 0, 0},
+	} {
+		stats, err := snaps.StorageStats(tt.account)
+		if err != nil {
+			t.Fatalf("test %d: failed to retrieve stats: %v", i, err)
+		}
+		if stats.Slots != tt.slots || stats.Size != tt.size {
+			t.Errorf("test %d: stats mismatch: have %d/%d, want %d/%d", i, stats.Slots, stats.Size, tt.slots, tt.size)
+		}
+	}
+	// Counting the untracked accounts must not write into the database
+	if stats := rawdb.ReadStorageStats(db, accLegacy); stats != nil {
+		t.Errorf("counted stats persisted on read: %+v", stats)
+	}
+}
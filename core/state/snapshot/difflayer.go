@@ -102,8 +102,9 @@ type diffLayer struct {
 	parent snapshot   // Parent snapshot modified by this one, never nil
 	memory uint64     // Approximate guess as to how much memory we use
 
-	root  common.Hash // Root hash to which this snapshot diff belongs to
-	stale uint32      // Signals that the layer became stale (state progressed)
+	root   common.Hash // Root hash to which this snapshot diff belongs to
+	number uint64      // Number of the block the diff belongs to, zero if unknown
+	stale  uint32      // Signals that the layer became stale (state progressed)
 
 	// destructSet is a very special helper marker. If an account is marked as
 	// deleted, then it's recorded in this set. However it's allowed that an account
@@ -355,6 +356,15 @@ func (dl *diffLayer) accountRLP(hash common.Hash, depth int) ([]byte, error) {
 //
 // Note the returned slot is not a copy, please don't modify it.
 func (dl *diffLayer) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	return dl.StorageInto(accountHash, storageHash, nil)
+}
+
+// StorageInto is an allocation free variant of Storage. Slots found in the diff
+// layers are returned directly, whereas slots resolved from the disk layer are
+// appended into the provided buffer.
+//
+// Note the returned slot is not a copy, please don't modify it.
+func (dl *diffLayer) StorageInto(accountHash, storageHash common.Hash, buf []byte) ([]byte, error) {
 	// Check the bloom filter first whether there's even a point in reaching into
 	// all the maps in all the layers below
 	dl.lock.RLock()
@@ -368,16 +378,16 @@ func (dl *diffLayer) Storage(accountHash, storageHash common.Hash) ([]byte, erro
 	// diff layers, reach straight into the bottom persistent disk layer
 	if !hit {
 		snapshotBloomStorageMissMeter.Mark(1)
-		return dl.origin.Storage(accountHash, storageHash)
+		return dl.origin.StorageInto(accountHash, storageHash, buf)
 	}
 	// The bloom filter hit, start poking in the internal maps
-	return dl.storage(accountHash, storageHash, 0)
+	return dl.storage(accountHash, storageHash, buf, 0)
 }
 
 // storage is an internal version of Storage that skips the bloom filter checks
 // and uses the internal maps to try and retrieve the data. It's meant  to be
 // used if a higher layer's bloom filter hit already.
-func (dl *diffLayer) storage(accountHash, storageHash common.Hash, depth int) ([]byte, error) {
+func (dl *diffLayer) storage(accountHash, storageHash common.Hash, buf []byte, depth int) ([]byte, error) {
 	dl.lock.RLock()
 	defer dl.lock.RUnlock()
 
@@ -410,11 +420,11 @@ func (dl *diffLayer) storage(accountHash, storageHash common.Hash, depth int) ([
 	}
 	// Storage slot unknown to this diff, resolve from parent
 	if diff, ok := dl.parent.(*diffLayer); ok {
-		return diff.storage(accountHash, storageHash, depth+1)
+		return diff.storage(accountHash, storageHash, buf, depth+1)
 	}
 	// Failed to resolve through diff layers, mark a bloom error and use the disk
 	snapshotBloomStorageFalseHitMeter.Mark(1)
-	return dl.parent.Storage(accountHash, storageHash)
+	return dl.parent.StorageInto(accountHash, storageHash, buf)
 }
 
 // Update creates a new layer on top of the existing snapshot diff tree with
@@ -473,6 +483,7 @@ func (dl *diffLayer) flatten() snapshot {
 		parent:      parent.parent,
 		origin:      parent.origin,
 		root:        dl.root,
+		number:      dl.number,
 		destructSet: parent.destructSet,
 		accountData: parent.accountData,
 		storageData: parent.storageData,
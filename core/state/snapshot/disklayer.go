@@ -26,6 +26,7 @@ import (
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
+	"github.com/steakknife/bloomfilter"
 )
 
 // diskLayer is a low level persistent snapshot built on top of a key-value store.
@@ -33,14 +34,20 @@ type diskLayer struct {
 	diskdb ethdb.KeyValueStore // Key-value store containing the base snapshot
 	triedb *trie.Database      // Trie node cache for reconstuction purposes
 	cache  *fastcache.Cache    // Cache to avoid hitting the disk for direct access
+	filter *accountFilter      // Filter to short circuit missing accounts, nil if disabled
+	wiper  *storageWiper       // Background deleter of destructed storages, nil if disabled
 
-	root  common.Hash // Root hash of the base snapshot
-	stale bool        // Signals that the layer became stale (state progressed)
+	root   common.Hash // Root hash of the base snapshot
+	number uint64      // Number of the block of the base snapshot, zero if unknown
+	stale  bool        // Signals that the layer became stale (state progressed)
 
 	genMarker  []byte                    // Marker for the state that's indexed during initial layer generation
+	genShards  [][]byte                  // Markers of the account hash ranges if the generation is sharded, nil otherwise
 	genPending chan struct{}             // Notification channel when generation is done (test synchronicity)
 	genAbort   chan chan *generatorStats // Notification channel to abort generating the snapshot in this layer
 
+	flushed *bloomfilter.Filter // Accounts and slots written by the flush creating this layer, nil if none
+
 	lock sync.RWMutex
 }
 
@@ -49,6 +56,17 @@ func (dl *diskLayer) Root() common.Hash {
 	return dl.root
 }
 
+// genMarkerOf returns the generation marker relevant for the given account (and
+// storage slot) hash: the marker of the shard containing it if the generation is
+// sharded, or the global one otherwise. Nil is returned if the generation is done.
+// The caller must hold the lock of the layer.
+func (dl *diskLayer) genMarkerOf(key []byte) []byte {
+	if dl.genMarker == nil || dl.genShards == nil {
+		return dl.genMarker
+	}
+	return dl.genShards[shardOf(key, len(dl.genShards))]
+}
+
 // Parent always returns nil as there's no layer below the disk.
 func (dl *diskLayer) Parent() snapshot {
 	return nil
@@ -93,8 +111,8 @@ func (dl *diskLayer) AccountRLP(hash common.Hash) ([]byte, error) {
 	}
 	// If the layer is being generated, ensure the requested hash has already been
 	// covered by the generator.
-	if dl.genMarker != nil && bytes.Compare(hash[:], dl.genMarker) > 0 {
-		return nil, ErrNotCoveredYet
+	if marker := dl.genMarkerOf(hash[:]); marker != nil && bytes.Compare(hash[:], marker) > 0 {
+		return nil, newNotCoveredError(marker, dl.genShards)
 	}
 	// If we're in the disk layer, all diff layers missed
 	snapshotDirtyAccountMissMeter.Mark(1)
@@ -105,6 +123,14 @@ func (dl *diskLayer) AccountRLP(hash common.Hash) ([]byte, error) {
 		snapshotCleanAccountReadMeter.Mark(int64(len(blob)))
 		return blob, nil
 	}
+	// Short circuit if the account definitely doesn't exist
+	if dl.filter != nil {
+		if !dl.filter.contains(hash) {
+			snapshotFilterAccountMissMeter.Mark(1)
+			return nil, nil
+		}
+		snapshotFilterAccountHitMeter.Mark(1)
+	}
 	// Cache doesn't contain account, pull from disk and cache for later
 	blob := rawdb.ReadAccountSnapshot(dl.diskdb, hash)
 	dl.cache.Set(hash[:], blob)
@@ -121,6 +147,13 @@ func (dl *diskLayer) AccountRLP(hash common.Hash) ([]byte, error) {
 // Storage directly retrieves the storage data associated with a particular hash,
 // within a particular account.
 func (dl *diskLayer) Storage(accountHash, storageHash common.Hash) ([]byte, error) {
+	return dl.StorageInto(accountHash, storageHash, nil)
+}
+
+// StorageInto retrieves the storage data associated with a particular hash,
+// within a particular account, appending it to the provided buffer if it can
+// be served from the clean cache.
+func (dl *diskLayer) StorageInto(accountHash, storageHash common.Hash, buf []byte) ([]byte, error) {
 	dl.lock.RLock()
 	defer dl.lock.RUnlock()
 
@@ -133,14 +166,19 @@ func (dl *diskLayer) Storage(accountHash, storageHash common.Hash) ([]byte, erro
 
 	// If the layer is being generated, ensure the requested hash has already been
 	// covered by the generator.
-	if dl.genMarker != nil && bytes.Compare(key, dl.genMarker) > 0 {
-		return nil, ErrNotCoveredYet
+	if marker := dl.genMarkerOf(key); marker != nil && bytes.Compare(key, marker) > 0 {
+		return nil, newNotCoveredError(marker, dl.genShards)
 	}
 	// If we're in the disk layer, all diff layers missed
 	snapshotDirtyStorageMissMeter.Mark(1)
 
+	// If the storage of the account is being wiped, it doesn't exist anymore
+	if dl.wiper != nil && dl.wiper.wiping(accountHash) {
+		return nil, nil
+	}
+
 	// Try to retrieve the storage slot from the memory cache
-	if blob, found := dl.cache.HasGet(nil, key); found {
+	if blob, found := dl.cache.HasGet(buf[:0], key); found {
 		snapshotCleanStorageHitMeter.Mark(1)
 		snapshotCleanStorageReadMeter.Mark(int64(len(blob)))
 		return blob, nil
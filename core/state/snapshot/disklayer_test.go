@@ -18,7 +18,9 @@ package snapshot
 
 import (
 	"bytes"
+	"errors"
 	"io/ioutil"
+	"math"
 	"os"
 	"testing"
 
@@ -40,6 +42,46 @@ func reverse(blob []byte) []byte {
 	return res
 }
 
+// Tests that allocation free storage reads return the same data as the plain
+// ones and that cached disk slots are loaded into the caller provided buffer.
+func TestDiskStorageInto(t *testing.T) {
+	var (
+		db      = memorydb.New()
+		account = common.Hash{0x1}
+		slot    = common.Hash{0x10}
+		root    = randomHash()
+	)
+	rawdb.WriteStorageSnapshot(db, account, slot, slot[:])
+
+	base := &diskLayer{
+		diskdb: db,
+		cache:  fastcache.New(500 * 1024),
+		root:   root,
+	}
+	// Read the slot once to warm up the cache, then read it again into a buffer
+	if blob, err := base.Storage(account, slot); err != nil || !bytes.Equal(blob, slot[:]) {
+		t.Fatalf("storage mismatch: have %x (err: %v), want %x", blob, err, slot)
+	}
+	buf := make([]byte, 0, common.HashLength)
+	blob, err := base.StorageInto(account, slot, buf)
+	if err != nil || !bytes.Equal(blob, slot[:]) {
+		t.Fatalf("buffered storage mismatch: have %x (err: %v), want %x", blob, err, slot)
+	}
+	if &blob[0] != &buf[:1][0] {
+		t.Errorf("cached slot not loaded into the provided buffer")
+	}
+	// Ensure diff layers on top serve the same data
+	diff := base.Update(randomHash(), nil, nil, map[common.Hash]map[common.Hash][]byte{
+		account: {common.Hash{0x20}: []byte{0x20}},
+	})
+	if blob, err := diff.StorageInto(account, slot, buf); err != nil || !bytes.Equal(blob, slot[:]) {
+		t.Fatalf("diff storage mismatch: have %x (err: %v), want %x", blob, err, slot)
+	}
+	if blob, err := diff.StorageInto(account, common.Hash{0x20}, buf); err != nil || !bytes.Equal(blob, []byte{0x20}) {
+		t.Fatalf("diff storage mismatch: have %x (err: %v), want %x", blob, err, []byte{0x20})
+	}
+}
+
 // Tests that merging something into a disk layer persists it into the database
 // and invalidates any previously written and cached values.
 func TestDiskMerge(t *testing.T) {
@@ -314,9 +356,12 @@ func TestDiskPartialMerge(t *testing.T) {
 		assertAccount := func(account common.Hash, data []byte) {
 			t.Helper()
 			blob, err := base.AccountRLP(account)
-			if bytes.Compare(account[:], genMarker) > 0 && err != ErrNotCoveredYet {
+			if bytes.Compare(account[:], genMarker) > 0 && !errors.Is(err, ErrNotCoveredYet) {
 				t.Fatalf("test %d: post-marker (%x) account access (%x) succeeded: %x", i, genMarker, account, blob)
 			}
+			if nerr, ok := err.(*NotCoveredError); err != nil && (!ok || !bytes.Equal(nerr.Marker, genMarker)) {
+				t.Fatalf("test %d: post-marker (%x) account access (%x) error mismatch: %v", i, genMarker, account, err)
+			}
 			if bytes.Compare(account[:], genMarker) <= 0 && !bytes.Equal(blob, data) {
 				t.Fatalf("test %d: pre-marker (%x) account access (%x) mismatch: have %x, want %x", i, genMarker, account, blob, data)
 			}
@@ -330,7 +375,7 @@ func TestDiskPartialMerge(t *testing.T) {
 		assertStorage := func(account common.Hash, slot common.Hash, data []byte) {
 			t.Helper()
 			blob, err := base.Storage(account, slot)
-			if bytes.Compare(append(account[:], slot[:]...), genMarker) > 0 && err != ErrNotCoveredYet {
+			if bytes.Compare(append(account[:], slot[:]...), genMarker) > 0 && !errors.Is(err, ErrNotCoveredYet) {
 				t.Fatalf("test %d: post-marker (%x) storage access (%x:%x) succeeded: %x", i, genMarker, account, slot, blob)
 			}
 			if bytes.Compare(append(account[:], slot[:]...), genMarker) <= 0 && !bytes.Equal(blob, data) {
@@ -509,3 +554,116 @@ func TestDiskSeek(t *testing.T) {
 		}
 	}
 }
+
+// Tests that the flush statistics detect the accounts and slots rewritten by
+// consecutive flushes.
+func TestDiskFlushStats(t *testing.T) {
+	var (
+		acc1 = randomHash()
+		acc2 = randomHash()
+		slot = randomHash()
+	)
+	first := newFlushStats(nil, 2)
+	first.account(acc1, 10)
+	first.slot(acc1, slot, 5)
+	first.storageStats(&rawdb.StorageStats{Slots: 1, Size: 5})
+	prev := first.finish()
+
+	if first.flat != 15 || first.overwrites != 0 {
+		t.Fatalf("first flush mismatch: flat %d, overwrites %d", first.flat, first.overwrites)
+	}
+	if first.meta <= common.HashLength {
+		t.Fatalf("storage accounting not tracked as metadata: %d", first.meta)
+	}
+	second := newFlushStats(prev, 3)
+	second.account(acc1, 20)
+	second.account(acc2, 30)
+	second.slot(acc1, slot, 7)
+	second.slot(acc2, slot, 9)
+	second.finish()
+
+	if second.flat != 66 || second.overwrites != 27 {
+		t.Fatalf("second flush mismatch: flat %d, overwrites %d, want 66, 27", second.flat, second.overwrites)
+	}
+}
+
+// Tests that the not covered errors report the generation progress.
+func TestNotCoveredErrorProgress(t *testing.T) {
+	tests := []struct {
+		marker   []byte
+		progress float64
+	}{
+		{nil, 0},
+		{[]byte{}, 0},
+		{[]byte{0x40}, 0.25},
+		{common.HexToHash("0x80").Bytes(), 0},
+		{common.HexToHash("0x8000000000000000000000000000000000000000000000000000000000000000").Bytes(), 0.5},
+		{append([]byte{0xc0}, make([]byte, 63)...), 0.75},
+	}
+	for i, tt := range tests {
+		err := newNotCoveredError(tt.marker, nil)
+		if !errors.Is(err, ErrNotCoveredYet) {
+			t.Errorf("test %d: error not matching ErrNotCoveredYet", i)
+		}
+		if have := err.Progress(); math.Abs(have-tt.progress) > 1e-9 {
+			t.Errorf("test %d: progress mismatch: have %v, want %v", i, have, tt.progress)
+		}
+	}
+	// If the generation is sharded, all the shards should be accounted for
+	shards := [][]byte{
+		shardDone(0, 4),           // first quarter done
+		{0x60},                    // second quarter half done
+		{},                        // third quarter not started
+		shardOrigin(3, 4).Bytes(), // fourth quarter just started
+	}
+	err := newNotCoveredError(shards[2], shards)
+	if have := err.Progress(); math.Abs(have-0.375) > 1e-6 {
+		t.Errorf("sharded progress mismatch: have %v, want %v", have, 0.375)
+	}
+}
+
+// Tests that the coverage checks of a disk layer being generated on shards only
+// consult the marker of the shard the requested item belongs to.
+func TestDiskShardedCoverage(t *testing.T) {
+	shards := make([][]byte, 4)
+	for i := range shards {
+		shards[i] = []byte{}
+	}
+	shards[0] = shardDone(0, len(shards))
+	shards[1] = append(common.Hash{0x40, 0x10}.Bytes(), common.Hash{0x10}.Bytes()...)
+
+	base := &diskLayer{
+		diskdb:    memorydb.New(),
+		cache:     fastcache.New(500 * 1024),
+		root:      randomHash(),
+		genMarker: []byte{},
+		genShards: shards,
+	}
+	tests := []struct {
+		account common.Hash
+		slot    common.Hash
+		covered bool
+		marker  []byte
+	}{
+		{common.Hash{0x00}, common.Hash{0xff}, true, nil},
+		{common.Hash{0x3f, 0xff}, common.Hash{0xff}, true, nil},
+		{common.Hash{0x40, 0x01}, common.Hash{0xff}, true, nil},
+		{common.Hash{0x40, 0x10}, common.Hash{0x01}, true, nil},
+		{common.Hash{0x40, 0x10}, common.Hash{0x20}, false, shards[1]},
+		{common.Hash{0x40, 0x20}, common.Hash{0x01}, false, shards[1]},
+		{common.Hash{0x80}, common.Hash{0x01}, false, []byte{}},
+		{common.Hash{0xff}, common.Hash{0x01}, false, []byte{}},
+	}
+	for i, tt := range tests {
+		_, err := base.Storage(tt.account, tt.slot)
+		if tt.covered {
+			if err != nil {
+				t.Errorf("test %d: covered slot not served: %v", i, err)
+			}
+			continue
+		}
+		if nerr, ok := err.(*NotCoveredError); !ok || !bytes.Equal(nerr.Marker, tt.marker) {
+			t.Errorf("test %d: error mismatch: have %v, want marker %x", i, err, tt.marker)
+		}
+	}
+}
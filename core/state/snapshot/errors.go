@@ -0,0 +1,123 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+var (
+	// ErrSnapshotStale is returned from data accessors if the underlying snapshot
+	// layer had been invalidated due to the chain progressing forward far enough
+	// to not maintain the layer's original state.
+	ErrSnapshotStale = errors.New("snapshot stale")
+
+	// ErrNotCoveredYet is returned from data accessors if the underlying snapshot
+	// is being generated currently and the requested data item is not yet in the
+	// range of accounts covered. The accessors return it wrapped into a
+	// NotCoveredError carrying the generation progress, errors.Is matching it.
+	ErrNotCoveredYet = errors.New("not covered yet")
+
+	// ErrSnapshotMissing is returned from the tree operations if the requested
+	// layer is not (or no longer) part of the snapshot tree.
+	ErrSnapshotMissing = errors.New("snapshot missing")
+
+	// ErrSnapshotDiskLayer is returned from the tree operations which need a diff
+	// layer to operate on, but were given the persistent disk layer.
+	ErrSnapshotDiskLayer = errors.New("snapshot is disk layer")
+
+	// ErrNotAncestor is returned if a range of layers is requested whose first
+	// layer is not an ancestor of the last one.
+	ErrNotAncestor = errors.New("snapshot not an ancestor")
+
+	// ErrSnapshotRejected is returned if a new layer is rejected by one of the
+	// validators registered on the tree.
+	ErrSnapshotRejected = errors.New("snapshot rejected")
+
+	// ErrNumberMissing is returned in strict mode if a snapshot is attempted to
+	// be inserted without a block number.
+	ErrNumberMissing = errors.New("snapshot block number missing")
+
+	// ErrNumberRegression is returned in strict mode if a snapshot is attempted
+	// to be inserted with a block number not above the one of its parent.
+	ErrNumberRegression = errors.New("snapshot block number regression")
+
+	// errSnapshotCycle is returned if a snapshot is attempted to be inserted
+	// that forms a cycle in the snapshot tree.
+	errSnapshotCycle = errors.New("snapshot cycle")
+)
+
+// LayerError is returned from the tree operations failing on a specific layer.
+// It wraps one of the errors of the package, which errors.Is matches, and the
+// underlying cause if any.
+type LayerError struct {
+	Root  common.Hash // Root of the layer the operation failed on
+	Err   error       // Error of the package classifying the failure
+	Cause error       // Underlying cause of the failure, nil if none
+}
+
+// newLayerError creates an error for the layer with the given root.
+func newLayerError(root common.Hash, err error) *LayerError {
+	return &LayerError{Root: root, Err: err}
+}
+
+// Error implements error.
+func (e *LayerError) Error() string {
+	if e.Cause != nil {
+		return fmt.Sprintf("%v [%#x]: %v", e.Err, e.Root, e.Cause)
+	}
+	return fmt.Sprintf("%v [%#x]", e.Err, e.Root)
+}
+
+// Unwrap returns the error of the package classifying the failure.
+func (e *LayerError) Unwrap() error {
+	return e.Err
+}
+
+// Remedy is the handling expected from the callers for an error returned by the
+// snapshot tree or its layers.
+type Remedy int
+
+const (
+	// RemedyFail means the error is permanent, the operation must fail.
+	RemedyFail Remedy = iota
+
+	// RemedyRetry means the layer was invalidated by the chain progressing, the
+	// operation can be retried against a fresh layer retrieved from the tree.
+	RemedyRetry
+
+	// RemedyFallback means the data is not (yet) available from the snapshot, it
+	// has to be served from the tries instead.
+	RemedyFallback
+)
+
+// RemedyOf classifies an error returned by the snapshot tree or its layers by
+// the handling expected from the caller. Errors not originating from the
+// package are considered permanent. The error must not be nil.
+func RemedyOf(err error) Remedy {
+	switch {
+	case errors.Is(err, ErrSnapshotStale):
+		return RemedyRetry
+	case errors.Is(err, ErrNotCoveredYet), errors.Is(err, ErrSnapshotMissing):
+		return RemedyFallback
+	default:
+		return RemedyFail
+	}
+}
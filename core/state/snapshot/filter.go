@@ -0,0 +1,189 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/steakknife/bloomfilter"
+)
+
+// accountFilterMinItems is the minimal number of accounts the account existence
+// filter is sized for. The filter is rebuilt with doubled capacity every time
+// the number of inserted accounts exceeds it.
+const accountFilterMinItems = 1 << 20
+
+// accountFilter is a probabilistic filter over all the account hashes in the
+// persistent snapshot. It's used by the disk layer to short circuit lookups of
+// accounts which definitely don't exist, avoiding the database misses.
+//
+// The filter is shared by the successive disk layers, being updated whenever
+// accounts are generated or flushed into the disk layer. Accounts must only be
+// added after they are written into the database, otherwise a concurrent rebuild
+// might miss them. Since Bloom filters can't delete, destructed accounts stay in
+// the filter until the next rebuild, only affecting the false-positive rate.
+type accountFilter struct {
+	diskdb ethdb.KeyValueStore // Key-value store containing the base snapshot
+	rate   float64             // Target false-positive rate at full capacity
+
+	bloom    *bloomfilter.Filter // Filter covering all the persisted accounts, nil if not built yet
+	capacity uint64              // Number of accounts the active filter is sized for
+	building *bloomfilter.Filter // Filter being built in the background, nil if none
+	closed   uint32              // Flag whether the filter is discarded (atomic)
+
+	lock sync.RWMutex
+}
+
+// newAccountFilter creates an account existence filter with the specified target
+// false-positive rate and starts building it from the persisted snapshot in the
+// background. The estimated number of accounts is used to size the filter.
+func newAccountFilter(diskdb ethdb.KeyValueStore, rate float64, accounts uint64) *accountFilter {
+	filter := &accountFilter{
+		diskdb: diskdb,
+		rate:   rate,
+	}
+	capacity := uint64(accountFilterMinItems)
+	for capacity < accounts {
+		capacity *= 2
+	}
+	filter.lock.Lock()
+	filter.rebuild(capacity)
+	filter.lock.Unlock()
+	return filter
+}
+
+// rebuild starts building a new filter with the given capacity in the background,
+// swapping out the active one when done. The caller must hold the write lock.
+func (f *accountFilter) rebuild(capacity uint64) {
+	bloom, err := bloomfilter.NewOptimal(capacity, f.rate)
+	if err != nil {
+		log.Error("Failed to create account filter", "capacity", capacity, "rate", f.rate, "err", err)
+		return
+	}
+	f.building = bloom
+
+	go func() {
+		var (
+			start   = time.Now()
+			keylen  = len(rawdb.SnapshotAccountPrefix) + common.HashLength
+			scanned int
+		)
+		it := f.diskdb.NewIterator(rawdb.SnapshotAccountPrefix, nil)
+		defer it.Release()
+
+		for it.Next() {
+			if atomic.LoadUint32(&f.closed) == 1 {
+				return
+			}
+			key := it.Key()
+			if !bytes.HasPrefix(key, rawdb.SnapshotAccountPrefix) {
+				break
+			}
+			if len(key) != keylen {
+				continue
+			}
+			bloom.Add(accountBloomHasher(common.BytesToHash(key[len(rawdb.SnapshotAccountPrefix):])))
+			scanned++
+		}
+		if err := it.Error(); err != nil {
+			log.Error("Failed to build account filter", "err", err)
+			return
+		}
+		f.lock.Lock()
+		f.bloom, f.capacity, f.building = bloom, capacity, nil
+		f.lock.Unlock()
+
+		log.Info("Built account existence filter", "accounts", scanned, "capacity", capacity, "elapsed", common.PrettyDuration(time.Since(start)))
+	}()
+}
+
+// add inserts the account hashes into the filter. The accounts must already be
+// written into the database.
+func (f *accountFilter) add(hashes []common.Hash) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	for _, hash := range hashes {
+		if f.bloom != nil {
+			f.bloom.Add(accountBloomHasher(hash))
+		}
+		if f.building != nil {
+			f.building.Add(accountBloomHasher(hash))
+		}
+	}
+	// If the active filter is overloaded, rebuild a larger one
+	if f.bloom != nil && f.building == nil && f.bloom.N() > f.capacity {
+		f.rebuild(f.capacity * 2)
+	}
+}
+
+// contains reports whether the account might exist in the persisted snapshot.
+// False means the account definitely doesn't exist, true is returned if it might
+// exist or the filter is not built yet.
+func (f *accountFilter) contains(hash common.Hash) bool {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if f.bloom == nil {
+		return true
+	}
+	return f.bloom.Contains(accountBloomHasher(hash))
+}
+
+// close discards the filter, terminating any background building.
+func (f *accountFilter) close() {
+	atomic.StoreUint32(&f.closed, 1)
+}
+
+// EnableAccountFilter attaches an account existence filter with the specified
+// target false-positive rate to the persistent snapshot, short circuiting the
+// lookups of the definitely missing accounts. The filter is built from the
+// persisted snapshot in the background and maintained as the snapshot changes.
+func (t *Tree) EnableAccountFilter(rate float64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.filterRate = rate
+	if dl := t.disklayer(); dl != nil {
+		dl.lock.Lock()
+		if dl.filter != nil {
+			dl.filter.close()
+		}
+		dl.filter = t.newAccountFilter()
+		dl.lock.Unlock()
+	}
+}
+
+// newAccountFilter creates an account existence filter for the persisted snapshot
+// if it's enabled, sized by the accounts counted in the last generation.
+func (t *Tree) newAccountFilter() *accountFilter {
+	if t.filterRate <= 0 {
+		return nil
+	}
+	var accounts uint64
+	if progress := loadProgress(t.diskdb); progress != nil {
+		accounts = progress.Accounts
+	}
+	return newAccountFilter(t.diskdb, t.filterRate, accounts)
+}
@@ -0,0 +1,100 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"testing"
+	"time"
+
+	"github.com/VictoriaMetrics/fastcache"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+)
+
+// waitFilter blocks until the account existence filter is built.
+func waitFilter(t *testing.T, filter *accountFilter) {
+	for i := 0; i < 100; i++ {
+		filter.lock.RLock()
+		built := filter.bloom != nil
+		filter.lock.RUnlock()
+
+		if built {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("account filter not built")
+}
+
+// Tests that the account existence filter covers all the persisted accounts,
+// including the ones flushed after the filter is built, while rejecting the
+// vast majority of the missing ones.
+func TestAccountFilter(t *testing.T) {
+	var (
+		db       = memorydb.New()
+		baseRoot = randomHash()
+		diffRoot = randomHash()
+		accounts []common.Hash
+	)
+	for i := 0; i < 1024; i++ {
+		hash := randomHash()
+		rawdb.WriteAccountSnapshot(db, hash, randomAccount())
+		accounts = append(accounts, hash)
+	}
+	rawdb.WriteSnapshotRoot(db, baseRoot)
+
+	snaps := &Tree{
+		diskdb: db,
+		layers: map[common.Hash]snapshot{
+			baseRoot: &diskLayer{
+				diskdb: db,
+				cache:  fastcache.New(500 * 1024),
+				root:   baseRoot,
+			},
+		},
+	}
+	snaps.EnableAccountFilter(0.01)
+	waitFilter(t, snaps.disklayer().filter)
+
+	// Flush a new account into the disk layer, it should be covered too
+	fresh := randomHash()
+	if err := snaps.Update(diffRoot, baseRoot, nil, map[common.Hash][]byte{fresh: randomAccount()}, nil); err != nil {
+		t.Fatalf("failed to update snapshot tree: %v", err)
+	}
+	if err := snaps.Cap(diffRoot, 0); err != nil {
+		t.Fatalf("failed to flatten snapshot tree: %v", err)
+	}
+	accounts = append(accounts, fresh)
+
+	dl := snaps.disklayer()
+	for _, hash := range accounts {
+		if blob, err := dl.AccountRLP(hash); err != nil || len(blob) == 0 {
+			t.Fatalf("account %x missing: %v", hash, err)
+		}
+	}
+	// Ensure most of the missing accounts are rejected by the filter
+	var passed int
+	for i := 0; i < 1024; i++ {
+		if dl.filter.contains(randomHash()) {
+			passed++
+		}
+	}
+	if passed > 64 {
+		t.Errorf("too many false positives: %d out of %d", passed, 1024)
+	}
+}
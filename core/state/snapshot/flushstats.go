@@ -0,0 +1,112 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/steakknife/bloomfilter"
+)
+
+const (
+	// flushBloomBitsPerItem is the number of bloom bits allocated for every item
+	// flushed into the disk layer, keeping the false positive rate of the
+	// overwrite detection below 1%.
+	flushBloomBitsPerItem = 10
+
+	// flushBloomFuncs is the number of bits a single item sets in the bloom.
+	flushBloomFuncs = 7
+)
+
+var (
+	snapshotFlushMetaSizeMeter      = metrics.NewRegisteredMeter("state/snapshot/flush/meta/size", nil)
+	snapshotFlushOverwriteSizeMeter = metrics.NewRegisteredMeter("state/snapshot/flush/overwrite/size", nil)
+
+	// snapshotFlushAmplificationGauge is the ratio of all the data written by the
+	// disk layer flushes to the part of it not written by the preceding flush.
+	snapshotFlushAmplificationGauge = metrics.NewRegisteredGaugeFloat64("state/snapshot/flush/amplification", nil)
+)
+
+// flushStats tracks the data written by merging a diff layer into the disk layer:
+// how much of it is flat state versus metadata (root marker, storage accounting),
+// and how much of the flat state was already written by the previous flush. The
+// latter is detected with a bloom filter, so it may slightly overestimate the
+// overwrites.
+type flushStats struct {
+	prev *bloomfilter.Filter // Accounts and slots written by the previous flush
+	cur  *bloomfilter.Filter // Accounts and slots written by this flush
+
+	flat       int // Flat state data written by this flush
+	meta       int // Metadata written by this flush
+	overwrites int // Flat state data also written by the previous flush
+}
+
+// newFlushStats creates the tracker of a flush writing at most the given number
+// of accounts and slots, prev being the filter of the previous flush, if any.
+func newFlushStats(prev *bloomfilter.Filter, items int) *flushStats {
+	bits := uint64(items) * flushBloomBitsPerItem
+	if bits < 1024 {
+		bits = 1024
+	}
+	cur, _ := bloomfilter.New(bits, flushBloomFuncs) // Only fails for zero parameters
+	return &flushStats{prev: prev, cur: cur}
+}
+
+// account records the write of an account.
+func (s *flushStats) account(hash common.Hash, size int) {
+	s.flat += size
+	if s.prev != nil && s.prev.Contains(accountBloomHasher(hash)) {
+		s.overwrites += size
+	}
+	s.cur.Add(accountBloomHasher(hash))
+}
+
+// slot records the write of a storage slot.
+func (s *flushStats) slot(accountHash, storageHash common.Hash, size int) {
+	s.flat += size
+	if s.prev != nil && s.prev.Contains(storageBloomHasher{accountHash, storageHash}) {
+		s.overwrites += size
+	}
+	s.cur.Add(storageBloomHasher{accountHash, storageHash})
+}
+
+// storageStats records the write of the storage accounting of an account.
+func (s *flushStats) storageStats(stats *rawdb.StorageStats) {
+	if stats.Slots == 0 {
+		return // Deleted, not written
+	}
+	if blob, err := rlp.EncodeToBytes(stats); err == nil {
+		s.meta += len(blob)
+	}
+}
+
+// finish reports the statistics of the flush, returning the filter of the items
+// written to be used as the reference of the next flush.
+func (s *flushStats) finish() *bloomfilter.Filter {
+	s.meta += common.HashLength // Snapshot root marker
+
+	snapshotFlushMetaSizeMeter.Mark(int64(s.meta))
+	snapshotFlushOverwriteSizeMeter.Mark(int64(s.overwrites))
+
+	written := snapshotFlushAccountSizeMeter.Count() + snapshotFlushStorageSizeMeter.Count() + snapshotFlushMetaSizeMeter.Count()
+	if fresh := written - snapshotFlushOverwriteSizeMeter.Count(); fresh > 0 {
+		snapshotFlushAmplificationGauge.Update(float64(written) / float64(fresh))
+	}
+	return s.cur
+}
@@ -19,7 +19,9 @@ package snapshot
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math/big"
+	"sync"
 	"time"
 
 	"github.com/VictoriaMetrics/fastcache"
@@ -41,6 +43,35 @@ var (
 	emptyCode = crypto.Keccak256Hash(nil)
 )
 
+// generatorShards is the number of account hash ranges a fresh snapshot is
+// generated on concurrently. It must be a power of two, at most 256.
+var generatorShards = 8
+
+// validShards reports whether the snapshot can be generated on the given number
+// of account hash ranges. Zero means the generation is not sharded.
+func validShards(shards int) bool {
+	return shards >= 0 && shards <= 256 && shards&(shards-1) == 0
+}
+
+// shardOf returns the index of the account hash range containing the given
+// account (and storage slot) hash.
+func shardOf(key []byte, shards int) int {
+	return int(key[0]) / (256 / shards)
+}
+
+// shardOrigin returns the first account hash of the given shard.
+func shardOrigin(shard, shards int) common.Hash {
+	return common.Hash{byte(shard * (256 / shards))}
+}
+
+// shardDone returns the generation marker of a fully generated shard, which is
+// above all the account and storage slot hashes within the shard.
+func shardDone(shard, shards int) []byte {
+	marker := bytes.Repeat([]byte{0xff}, 2*common.HashLength)
+	marker[0] = byte((shard+1)*(256/shards) - 1)
+	return marker
+}
+
 // generatorStats is a collection of statistics gathered by the snapshot generator
 // for logging purposes.
 type generatorStats struct {
@@ -50,6 +81,8 @@ type generatorStats struct {
 	accounts uint64             // Number of accounts indexed
 	slots    uint64             // Number of storage slots indexed
 	storage  common.StorageSize // Account and storage slot size
+
+	lock sync.Mutex // Lock protecting the counters and ordering the checkpoints of the shards
 }
 
 // Log creates an contextual log with the given message and the context pulled
@@ -88,10 +121,100 @@ func (gs *generatorStats) Log(msg string, marker []byte) {
 	log.Info(msg, ctx...)
 }
 
+// NotCoveredError is returned from data accessors if the snapshot is being
+// generated and the generator didn't reach the requested item yet. It carries
+// the generation marker at the time of the access, so callers can tell how far
+// the generation got. It matches ErrNotCoveredYet via errors.Is.
+type NotCoveredError struct {
+	Marker []byte   // Account (and storage slot) hash up to which the snapshot is generated
+	Shards [][]byte // Generation markers of all the shards if the generation is sharded, nil otherwise
+}
+
+// newNotCoveredError creates an error for an item beyond the generation marker,
+// along with the markers of all the shards if the generation is sharded.
+func newNotCoveredError(marker []byte, shards [][]byte) *NotCoveredError {
+	err := &NotCoveredError{Marker: common.CopyBytes(marker)}
+	if shards != nil {
+		err.Shards = make([][]byte, len(shards))
+		for i, shard := range shards {
+			err.Shards[i] = common.CopyBytes(shard)
+		}
+	}
+	return err
+}
+
+// Error implements error, reporting the generation progress.
+func (e *NotCoveredError) Error() string {
+	return fmt.Sprintf("%v: generated up to %x (%.2f%%)", ErrNotCoveredYet, e.Marker, e.Progress()*100)
+}
+
+// Is reports whether the target is ErrNotCoveredYet.
+func (e *NotCoveredError) Is(target error) bool {
+	return target == ErrNotCoveredYet
+}
+
+// Progress estimates the fraction of the account space already generated, based
+// on the markers and the accounts being uniformly distributed. If the generation
+// is sharded, the progress of all the shards is summed up, not only the one of
+// the shard containing the requested item.
+func (e *NotCoveredError) Progress() float64 {
+	if e.Shards == nil {
+		if len(e.Marker) == 0 {
+			return 0
+		}
+		return markerPosition(e.Marker)
+	}
+	var (
+		total float64
+		width = 1 / float64(len(e.Shards))
+	)
+	for i, marker := range e.Shards {
+		if len(marker) == 0 {
+			continue // shard not started yet
+		}
+		done := (markerPosition(marker) - float64(i)*width) / width
+		if done > 1 {
+			done = 1
+		}
+		if done > 0 {
+			total += done
+		}
+	}
+	return total * width
+}
+
+// markerPosition returns the relative position of a generation marker in the
+// account space, in the range [0, 1].
+func markerPosition(marker []byte) float64 {
+	var prefix [8]byte
+	copy(prefix[:], marker)
+	return float64(binary.BigEndian.Uint64(prefix[:])) / math.MaxUint64
+}
+
+// progress assembles the generation checkpoint at the given marker (and shard
+// markers if sharded) from the internally maintained statistics.
+func (gs *generatorStats) progress(marker []byte, shards [][]byte) *journalProgress {
+	return &journalProgress{
+		Marker:   marker,
+		Shards:   shards,
+		Accounts: gs.accounts,
+		Slots:    gs.slots,
+		Storage:  uint64(gs.storage),
+	}
+}
+
 // generateSnapshot regenerates a brand new snapshot based on an existing state
 // database and head block asynchronously. The snapshot is returned immediately
 // and generation is continued in the background until done.
 func generateSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash, wiper chan struct{}) *diskLayer {
+	// Checkpoint the wiping before it starts, carrying over the progress of an
+	// interrupted wipe so that it's resumed instead of restarted.
+	progress := &journalProgress{Wiping: true}
+	if prev := loadProgress(diskdb); prev != nil && prev.Wiping {
+		progress.WipeMarker = prev.WipeMarker
+	}
+	writeProgress(diskdb, progress)
+
 	// Wipe any previously existing snapshot from the database if no wiper is
 	// currently in progress.
 	if wiper == nil {
@@ -109,6 +232,12 @@ func generateSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache i
 		genPending: make(chan struct{}),
 		genAbort:   make(chan chan *generatorStats),
 	}
+	if generatorShards > 1 {
+		base.genShards = make([][]byte, generatorShards)
+		for i := range base.genShards {
+			base.genShards[i] = []byte{}
+		}
+	}
 	go base.generate(&generatorStats{wiping: wiper, start: time.Now()})
 	return base
 }
@@ -117,6 +246,9 @@ func generateSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache i
 // constructing the state snapshot. All the arguments are purely for statistics
 // gethering and logging, since the method surfs the blocks as they arrive, often
 // being restarted.
+//
+// If the generation is sharded, the account hash ranges are generated by their
+// own goroutines concurrently, each tracking its own marker.
 func (dl *diskLayer) generate(stats *generatorStats) {
 	// If a database wipe is in operation, wait until it's done
 	if stats.wiping != nil {
@@ -145,16 +277,123 @@ func (dl *diskLayer) generate(stats *generatorStats) {
 	}
 	stats.Log("Resuming state snapshot generation", dl.genMarker)
 
+	// Start a generator for every shard not finished yet
+	shards := len(dl.genShards)
+	if shards == 0 {
+		shards = 1
+	}
+	var (
+		stop    = make(chan struct{})
+		done    = make(chan struct{}, shards)
+		running int
+	)
+	for i := 0; i < shards; i++ {
+		if bytes.Equal(dl.shardMarker(i), shardDone(i, shards)) {
+			continue
+		}
+		running++
+		go func(shard int, accTrie *trie.SecureTrie) {
+			dl.generateShard(accTrie, shard, shards, stats, stop)
+			done <- struct{}{}
+		}(i, accTrie.Copy()) // Tries are not safe for concurrent use
+	}
+	// Wait for all the shards to finish, aborting them if requested
+	logged := time.NewTicker(8 * time.Second)
+	defer logged.Stop()
+
+	for running > 0 {
+		select {
+		case <-done:
+			running--
+
+		case <-logged.C:
+			stats.lock.Lock()
+			stats.Log("Generating state snapshot", dl.logMarker())
+			stats.lock.Unlock()
+
+		case abort := <-dl.genAbort:
+			close(stop)
+			for ; running > 0; running-- {
+				<-done
+			}
+			stats.Log("Aborting state snapshot generation", dl.logMarker())
+			abort <- stats
+			return
+		}
+	}
+	// Snapshot fully generated, set the marker to nil
+	progress := stats.progress(nil, nil)
+	progress.Done = true
+	writeProgress(dl.diskdb, progress)
+
+	log.Info("Generated state snapshot", "accounts", stats.accounts, "slots", stats.slots,
+		"storage", stats.storage, "elapsed", common.PrettyDuration(time.Since(stats.start)))
+
+	dl.lock.Lock()
+	dl.genMarker = nil
+	dl.genShards = nil
+	close(dl.genPending)
+	dl.lock.Unlock()
+
+	// Someone will be looking for us, wait it out
+	abort := <-dl.genAbort
+	abort <- nil
+}
+
+// generateShard iterates over the accounts of a shard starting from its marker,
+// writing them and their storage slots into the snapshot. It returns once the
+// shard is fully generated or the stop channel is closed, flushing the data and
+// the progress of the shard in both cases.
+func (dl *diskLayer) generateShard(accTrie *trie.SecureTrie, shard, shards int, stats *generatorStats, stop chan struct{}) {
+	// The marker of the shard is only updated by this goroutine, no need to lock
+	marker := dl.shardMarker(shard)
+
 	var accMarker []byte
-	if len(dl.genMarker) > 0 { // []byte{} is the start, use nil for that
-		accMarker = dl.genMarker[:common.HashLength]
+	if len(marker) > 0 { // []byte{} is the start, use nil for that
+		accMarker = marker[:common.HashLength]
 	}
-	accIt := trie.NewIterator(accTrie.NodeIterator(accMarker))
+	origin := shardOrigin(shard, shards)
+	if accMarker != nil {
+		origin = common.BytesToHash(accMarker)
+	}
+	accIt := trie.NewIterator(accTrie.NodeIterator(origin[:]))
 	batch := dl.diskdb.NewBatch()
 
+	// Track the accounts written in the batch, to be inserted into the existence
+	// filter after they are persisted, along with the statistics of the batch
+	var (
+		pending  []common.Hash
+		accounts uint64
+		slots    uint64
+		storage  common.StorageSize
+	)
+	flush := func(marker []byte) {
+		stats.lock.Lock()
+		defer stats.lock.Unlock()
+
+		stats.accounts += accounts
+		stats.slots += slots
+		stats.storage += storage
+		accounts, slots, storage = 0, 0, 0
+
+		writeProgress(batch, dl.checkpoint(stats, shard, marker))
+		batch.Write()
+		batch.Reset()
+
+		dl.lock.Lock()
+		if dl.filter != nil {
+			dl.filter.add(pending)
+		}
+		dl.setShardMarker(shard, marker)
+		dl.lock.Unlock()
+		pending = pending[:0]
+	}
 	// Iterate from the previous marker and continue generating the state snapshot
-	logged := time.Now()
 	for accIt.Next() {
+		// Stop at the end of the shard, the rest belongs to the next one
+		if shardOf(accIt.Key, shards) != shard {
+			break
+		}
 		// Retrieve the current account and flatten it into the internal format
 		accountHash := common.BytesToHash(accIt.Key)
 
@@ -172,28 +411,23 @@ func (dl *diskLayer) generate(stats *generatorStats) {
 		// If the account is not yet in-progress, write it out
 		if accMarker == nil || !bytes.Equal(accountHash[:], accMarker) {
 			rawdb.WriteAccountSnapshot(batch, accountHash, data)
-			stats.storage += common.StorageSize(1 + common.HashLength + len(data))
-			stats.accounts++
+			pending = append(pending, accountHash)
+			storage += common.StorageSize(1 + common.HashLength + len(data))
+			accounts++
 		}
 		// If we've exceeded our batch allowance or termination was requested, flush to disk
-		var abort chan *generatorStats
+		var abort bool
 		select {
-		case abort = <-dl.genAbort:
+		case <-stop:
+			abort = true
 		default:
 		}
-		if batch.ValueSize() > ethdb.IdealBatchSize || abort != nil {
+		if batch.ValueSize() > ethdb.IdealBatchSize || abort {
 			// Only write and set the marker if we actually did something useful
 			if batch.ValueSize() > 0 {
-				batch.Write()
-				batch.Reset()
-
-				dl.lock.Lock()
-				dl.genMarker = accountHash[:]
-				dl.lock.Unlock()
+				flush(accountHash[:])
 			}
-			if abort != nil {
-				stats.Log("Aborting state snapshot generation", accountHash[:])
-				abort <- stats
+			if abort {
 				return
 			}
 		}
@@ -204,59 +438,91 @@ func (dl *diskLayer) generate(stats *generatorStats) {
 				log.Crit("Storage trie inaccessible for snapshot generation", "err", err)
 			}
 			var storeMarker []byte
-			if accMarker != nil && bytes.Equal(accountHash[:], accMarker) && len(dl.genMarker) > common.HashLength {
-				storeMarker = dl.genMarker[common.HashLength:]
+			if accMarker != nil && bytes.Equal(accountHash[:], accMarker) && len(marker) > common.HashLength {
+				storeMarker = marker[common.HashLength:]
+			}
+			// Track the storage accounting of the account, picking up the slots
+			// already generated if the account is resumed midway
+			accounting := new(rawdb.StorageStats)
+			if storeMarker != nil {
+				accounting = countStorage(dl.diskdb, accountHash, storeMarker)
 			}
 			storeIt := trie.NewIterator(storeTrie.NodeIterator(storeMarker))
 			for storeIt.Next() {
 				rawdb.WriteStorageSnapshot(batch, accountHash, common.BytesToHash(storeIt.Key), storeIt.Value)
-				stats.storage += common.StorageSize(1 + 2*common.HashLength + len(storeIt.Value))
-				stats.slots++
+				storage += common.StorageSize(1 + 2*common.HashLength + len(storeIt.Value))
+				slots++
+
+				accounting.Slots++
+				accounting.Size += uint64(len(storeIt.Value))
 
 				// If we've exceeded our batch allowance or termination was requested, flush to disk
-				var abort chan *generatorStats
+				var abort bool
 				select {
-				case abort = <-dl.genAbort:
+				case <-stop:
+					abort = true
 				default:
 				}
-				if batch.ValueSize() > ethdb.IdealBatchSize || abort != nil {
+				if batch.ValueSize() > ethdb.IdealBatchSize || abort {
 					// Only write and set the marker if we actually did something useful
 					if batch.ValueSize() > 0 {
-						batch.Write()
-						batch.Reset()
-
-						dl.lock.Lock()
-						dl.genMarker = append(accountHash[:], storeIt.Key...)
-						dl.lock.Unlock()
+						flush(append(accountHash[:], storeIt.Key...))
 					}
-					if abort != nil {
-						stats.Log("Aborting state snapshot generation", append(accountHash[:], storeIt.Key...))
-						abort <- stats
+					if abort {
 						return
 					}
 				}
 			}
-		}
-		if time.Since(logged) > 8*time.Second {
-			stats.Log("Generating state snapshot", accIt.Key)
-			logged = time.Now()
+			writeStorageStats(batch, accountHash, accounting)
 		}
 		// Some account processed, unmark the marker
 		accMarker = nil
 	}
-	// Snapshot fully generated, set the marker to nil
-	if batch.ValueSize() > 0 {
-		batch.Write()
+	// Shard fully generated, mark it done
+	flush(shardDone(shard, shards))
+}
+
+// checkpoint assembles the generation checkpoint with the marker of the given
+// shard replaced. The caller must hold the lock of the statistics, which orders
+// the checkpoints of the shards.
+func (dl *diskLayer) checkpoint(stats *generatorStats, shard int, marker []byte) *journalProgress {
+	if dl.genShards == nil {
+		return stats.progress(marker, nil)
 	}
-	log.Info("Generated state snapshot", "accounts", stats.accounts, "slots", stats.slots,
-		"storage", stats.storage, "elapsed", common.PrettyDuration(time.Since(stats.start)))
+	markers := make([][]byte, len(dl.genShards))
+	copy(markers, dl.genShards)
+	markers[shard] = marker
 
-	dl.lock.Lock()
-	dl.genMarker = nil
-	close(dl.genPending)
-	dl.lock.Unlock()
+	return stats.progress(dl.genMarker, markers)
+}
 
-	// Someone will be looking for us, wait it out
-	abort := <-dl.genAbort
-	abort <- nil
+// shardMarker returns the generation marker of the given shard. If the generation
+// isn't sharded, the global marker is the one of the only shard.
+func (dl *diskLayer) shardMarker(shard int) []byte {
+	if dl.genShards == nil {
+		return dl.genMarker
+	}
+	return dl.genShards[shard]
+}
+
+// setShardMarker updates the generation marker of the given shard. The caller
+// must hold the lock of the layer.
+func (dl *diskLayer) setShardMarker(shard int, marker []byte) {
+	if dl.genShards == nil {
+		dl.genMarker = marker
+		return
+	}
+	dl.genShards[shard] = marker
+}
+
+// logMarker returns the marker to report the generation progress with. There's
+// no single position to report if the generation is sharded.
+func (dl *diskLayer) logMarker() []byte {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.genShards != nil {
+		return nil
+	}
+	return dl.genMarker
 }
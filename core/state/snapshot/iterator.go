@@ -164,10 +164,22 @@ func (it *diffAccountIterator) Release() {}
 type diskAccountIterator struct {
 	layer *diskLayer
 	it    ethdb.Iterator
+	fail  error // Any failures encountered (stale)
 }
 
 // AccountIterator creates an account iterator over a disk layer.
+//
+// The database iterator is a point-in-time view of the persistent data. It's
+// created under the layer lock, ensuring that it either sees the layer before
+// any flush on top of it started, or fails if the layer is already stale and
+// the database might contain a partially flushed diff.
 func (dl *diskLayer) AccountIterator(seek common.Hash) AccountIterator {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.stale {
+		return &diskAccountIterator{layer: dl, fail: ErrSnapshotStale}
+	}
 	pos := common.TrimRightZeroes(seek[:])
 	return &diskAccountIterator{
 		layer: dl,
@@ -197,10 +209,10 @@ func (it *diskAccountIterator) Next() bool {
 
 // Error returns any failure that occurred during iteration, which might have
 // caused a premature iteration exit (e.g. snapshot stack becoming stale).
-//
-// A diff layer is immutable after creation content wise and can always be fully
-// iterated without error, so this method always returns nil.
 func (it *diskAccountIterator) Error() error {
+	if it.fail != nil {
+		return it.fail
+	}
 	if it.it == nil {
 		return nil // Iterator is exhausted and released
 	}
@@ -333,13 +345,27 @@ type diskStorageIterator struct {
 	layer   *diskLayer
 	account common.Hash
 	it      ethdb.Iterator
+	fail    error // Any failures encountered (stale)
 }
 
 // StorageIterator creates a storage iterator over a disk layer.
 // If the whole storage is destructed, then all entries in the disk
-// layer are deleted already. So the "destructed" flag returned here
-// is always false.
+// layer are deleted already (or are being wiped and are skipped). So
+// the "destructed" flag returned here is always false.
+//
+// Similarly to the account iterator, the database view is pinned under the
+// layer lock, failing if the layer is already stale.
 func (dl *diskLayer) StorageIterator(account common.Hash, seek common.Hash) (StorageIterator, bool) {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.stale {
+		return &diskStorageIterator{layer: dl, account: account, fail: ErrSnapshotStale}, false
+	}
+	// If the storage of the account is being wiped, there's nothing to iterate
+	if dl.wiper != nil && dl.wiper.wiping(account) {
+		return &diskStorageIterator{layer: dl, account: account}, false
+	}
 	pos := common.TrimRightZeroes(seek[:])
 	return &diskStorageIterator{
 		layer:   dl,
@@ -370,10 +396,10 @@ func (it *diskStorageIterator) Next() bool {
 
 // Error returns any failure that occurred during iteration, which might have
 // caused a premature iteration exit (e.g. snapshot stack becoming stale).
-//
-// A diff layer is immutable after creation content wise and can always be fully
-// iterated without error, so this method always returns nil.
 func (it *diskStorageIterator) Error() error {
+	if it.fail != nil {
+		return it.fail
+	}
 	if it.it == nil {
 		return nil // Iterator is exhausted and released
 	}
@@ -0,0 +1,232 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// ChangeType is the kind of modification an account went through within a range
+// of snapshot layers.
+type ChangeType byte
+
+const (
+	ChangeCreated ChangeType = iota // Account didn't exist at the start of the range
+	ChangeUpdated                   // Account existed at both ends of the range
+	ChangeDeleted                   // Account doesn't exist at the end of the range
+)
+
+// String implements the stringer interface.
+func (c ChangeType) String() string {
+	switch c {
+	case ChangeCreated:
+		return "created"
+	case ChangeUpdated:
+		return "updated"
+	case ChangeDeleted:
+		return "deleted"
+	default:
+		return fmt.Sprintf("unknown(%d)", byte(c))
+	}
+}
+
+// AccountChangeIterator is an iterator to step over the accounts modified within
+// a range of diff layers in hash order, exposing the kind of the modifications,
+// the destruct markers and the original values.
+type AccountChangeIterator interface {
+	Iterator
+
+	// Change returns the kind of the net modification of the current account.
+	Change() ChangeType
+
+	// Destructed reports whether the current account was destructed within the
+	// range, wiping its storage, even if it was recreated afterwards.
+	Destructed() bool
+
+	// Account returns the RLP encoded slim account at the end of the range, or
+	// nil if it was deleted.
+	Account() []byte
+
+	// Origin returns the RLP encoded slim account at the start of the range, or
+	// nil if it didn't exist. The flag is false if the original value couldn't
+	// be resolved, since the disk layer is not generated that far yet.
+	Origin() ([]byte, bool)
+}
+
+// accountChangeIterator is an account change iterator over the diff layers on
+// top of a base layer, up to and including a head layer.
+type accountChangeIterator struct {
+	base snapshot // Layer the range starts at, exclusive
+	head snapshot // Layer the range ends at, inclusive
+
+	hashes     []common.Hash            // Sorted hashes of all the accounts touched in the range
+	destructed map[common.Hash]struct{} // Accounts destructed in the range
+
+	curHash    common.Hash // Hash of the account the iterator is positioned on
+	curChange  ChangeType  // Kind of the modification of the current account
+	curAccount []byte      // Value of the current account at the end of the range
+	curOrigin  []byte      // Value of the current account at the start of the range
+	curKnown   bool        // Whether the original value of the current account is known
+
+	fail error
+}
+
+// AccountChangeIterator creates an iterator over the accounts modified by the
+// diff layers on top of the layer with the root from, up to and including the
+// layer with the root to. Only the net modifications are yielded: accounts
+// created and deleted within the range are skipped, as are the ones rewritten
+// with their original value.
+//
+// If the original value of an account can't be resolved, the modification is
+// reported as an update (or deletion) with an unknown origin.
+func (t *Tree) AccountChangeIterator(from, to common.Hash) (AccountChangeIterator, error) {
+	t.lock.RLock()
+	base, head := t.layers[from], t.layers[to]
+	t.lock.RUnlock()
+
+	if base == nil {
+		return nil, newLayerError(from, ErrSnapshotMissing)
+	}
+	if head == nil {
+		return nil, newLayerError(to, ErrSnapshotMissing)
+	}
+	// Collect the accounts touched by the layers in the range
+	var (
+		touched    = make(map[common.Hash]struct{})
+		destructed = make(map[common.Hash]struct{})
+	)
+	for layer := head; layer != base; layer = layer.Parent() {
+		diff, ok := layer.(*diffLayer)
+		if !ok {
+			return nil, &LayerError{Root: from, Err: ErrNotAncestor, Cause: fmt.Errorf("descendant [%#x]", to)}
+		}
+		for _, hash := range diff.AccountList() {
+			touched[hash] = struct{}{}
+		}
+		diff.lock.RLock()
+		for hash := range diff.destructSet {
+			destructed[hash] = struct{}{}
+		}
+		diff.lock.RUnlock()
+	}
+	list := make([]common.Hash, 0, len(touched))
+	for hash := range touched {
+		list = append(list, hash)
+	}
+	sort.Sort(hashes(list))
+
+	return &accountChangeIterator{
+		base:       base,
+		head:       head,
+		hashes:     list,
+		destructed: destructed,
+	}, nil
+}
+
+// Next steps the iterator forward one element, returning false if exhausted or
+// if any of the layers in the range became stale.
+func (it *accountChangeIterator) Next() bool {
+	for it.fail == nil && len(it.hashes) > 0 {
+		hash := it.hashes[0]
+		it.hashes = it.hashes[1:]
+
+		account, err := it.head.AccountRLP(hash)
+		if err != nil {
+			it.fail = err
+			return false
+		}
+		known := true
+		origin, err := it.base.AccountRLP(hash)
+		if errors.Is(err, ErrNotCoveredYet) {
+			origin, known = nil, false
+		} else if err != nil {
+			it.fail = err
+			return false
+		}
+		_, destructed := it.destructed[hash]
+
+		var change ChangeType
+		switch {
+		case len(account) == 0 && known && len(origin) == 0:
+			continue // Transient account, created and deleted within the range
+		case len(account) == 0:
+			change = ChangeDeleted
+		case known && len(origin) == 0:
+			change = ChangeCreated
+		case known && !destructed && bytes.Equal(account, origin):
+			continue // Rewritten with the original value
+		default:
+			change = ChangeUpdated
+		}
+		it.curHash, it.curChange, it.curAccount = hash, change, account
+		it.curOrigin, it.curKnown = origin, known
+		return true
+	}
+	return false
+}
+
+// Error returns any failure that occurred during iteration, which might have
+// caused a premature iteration exit (e.g. snapshot stack becoming stale).
+func (it *accountChangeIterator) Error() error {
+	return it.fail
+}
+
+// Hash returns the hash of the account the iterator is currently at.
+func (it *accountChangeIterator) Hash() common.Hash {
+	return it.curHash
+}
+
+// Change returns the kind of the net modification of the current account.
+func (it *accountChangeIterator) Change() ChangeType {
+	return it.curChange
+}
+
+// Destructed reports whether the current account was destructed within the range.
+func (it *accountChangeIterator) Destructed() bool {
+	_, ok := it.destructed[it.curHash]
+	return ok
+}
+
+// Account returns the RLP encoded slim account at the end of the range, or nil
+// if it was deleted.
+//
+// Note the returned account is not a copy, please don't modify it.
+func (it *accountChangeIterator) Account() []byte {
+	if len(it.curAccount) == 0 {
+		return nil
+	}
+	return it.curAccount
+}
+
+// Origin returns the RLP encoded slim account at the start of the range, and
+// whether it could be resolved.
+//
+// Note the returned account is not a copy, please don't modify it.
+func (it *accountChangeIterator) Origin() ([]byte, bool) {
+	if len(it.curOrigin) == 0 {
+		return nil, it.curKnown
+	}
+	return it.curOrigin, it.curKnown
+}
+
+// Release is a noop for the change iterator as there are no held resources.
+func (it *accountChangeIterator) Release() {}
@@ -81,7 +81,7 @@ type fastIterator struct {
 func newFastIterator(tree *Tree, root common.Hash, account common.Hash, seek common.Hash, accountIterator bool) (*fastIterator, error) {
 	snap := tree.Snapshot(root)
 	if snap == nil {
-		return nil, fmt.Errorf("unknown snapshot: %x", root)
+		return nil, newLayerError(root, ErrSnapshotMissing)
 	}
 	fi := &fastIterator{
 		tree:    tree,
@@ -128,8 +128,12 @@ func (fi *fastIterator) init() {
 		// clashing any more.
 		it := fi.iterators[i]
 		for {
-			// If the iterator is exhausted, drop it off the end
+			// If the iterator is exhausted, drop it off the end, tracking any
+			// failure that caused it (e.g. stale layer)
 			if !it.it.Next() {
+				if err := it.it.Error(); err != nil && fi.fail == nil {
+					fi.fail = err
+				}
 				it.it.Release()
 				last := len(fi.iterators) - 1
 
@@ -173,7 +177,7 @@ func (fi *fastIterator) init() {
 
 // Next steps the iterator forward one element, returning false if exhausted.
 func (fi *fastIterator) Next() bool {
-	if len(fi.iterators) == 0 {
+	if fi.fail != nil || len(fi.iterators) == 0 {
 		return false
 	}
 	if !fi.initiated {
@@ -233,6 +237,11 @@ func (fi *fastIterator) next(idx int) bool {
 	// next one is surely not exhausted yet, otherwise it would have been removed
 	// already).
 	if it := fi.iterators[idx].it; !it.Next() {
+		// If the iterator was aborted rather than exhausted, fail the iteration
+		if err := it.Error(); err != nil {
+			fi.fail = err
+			return false
+		}
 		it.Release()
 
 		fi.iterators = append(fi.iterators[:idx], fi.iterators[idx+1:]...)
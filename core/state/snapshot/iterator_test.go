@@ -18,6 +18,7 @@ package snapshot
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"math/rand"
@@ -57,7 +58,7 @@ func TestAccountIteratorBasics(t *testing.T) {
 	it := diffLayer.AccountIterator(common.Hash{})
 	verifyIterator(t, 100, it, verifyNothing) // Nil is allowed for single layer iterator
 
-	diskLayer := diffToDisk(diffLayer)
+	diskLayer := diffToDisk(context.Background(), diffLayer)
 	it = diskLayer.AccountIterator(common.Hash{})
 	verifyIterator(t, 100, it, verifyNothing) // Nil is allowed for single layer iterator
 }
@@ -97,7 +98,7 @@ func TestStorageIteratorBasics(t *testing.T) {
 		verifyIterator(t, 100, it, verifyNothing) // Nil is allowed for single layer iterator
 	}
 
-	diskLayer := diffToDisk(diffLayer)
+	diskLayer := diffToDisk(context.Background(), diffLayer)
 	for account := range accounts {
 		it, _ := diskLayer.StorageIterator(account, common.Hash{})
 		verifyIterator(t, 100-nilStorage[account], it, verifyNothing) // Nil is allowed for single layer iterator
@@ -585,6 +586,59 @@ func TestAccountIteratorFlattening(t *testing.T) {
 	//verifyIterator(t, 7, it)
 }
 
+// TestAccountIteratorFlushConsistency tests that disk iterators created before
+// a flush keep seeing the original content, whereas iterators created after the
+// disk layer went stale fail instead of observing a partially flushed state.
+func TestAccountIteratorFlushConsistency(t *testing.T) {
+	// Create a disk layer with some accounts and a diff on top
+	diskdb := rawdb.NewMemoryDatabase()
+	for _, hash := range []string{"0xaa", "0xbb", "0xcc"} {
+		rawdb.WriteAccountSnapshot(diskdb, common.HexToHash(hash), randomAccount())
+	}
+	base := &diskLayer{
+		diskdb: diskdb,
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil,
+		randomAccountSet("0xdd", "0xee"), nil)
+
+	// Create an iterator over the disk layer and flush the diff underneath it
+	it := base.AccountIterator(common.Hash{})
+	defer it.Release()
+
+	if err := snaps.Cap(common.HexToHash("0x02"), 0); err != nil {
+		t.Fatalf("failed to flatten snapshot stack: %v", err)
+	}
+	verifyIterator(t, 3, it, verifyAccount)
+
+	// Iterators created on the stale layer should fail
+	stale := base.AccountIterator(common.Hash{})
+	if stale.Next() {
+		t.Fatalf("stale disk iterator advanced")
+	}
+	if err := stale.Error(); err != ErrSnapshotStale {
+		t.Fatalf("stale disk iterator error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+	storage, _ := base.StorageIterator(common.HexToHash("0xaa"), common.Hash{})
+	if storage.Next() || storage.Error() != ErrSnapshotStale {
+		t.Fatalf("stale disk storage iterator error mismatch: have %v, want %v", storage.Error(), ErrSnapshotStale)
+	}
+	// Multi-layer iterators should surface the failure instead of skipping data
+	fast, _ := newFastIterator(&Tree{layers: map[common.Hash]snapshot{base.root: base}}, base.root, common.Hash{}, common.Hash{}, true)
+	if fast.Next() {
+		t.Fatalf("fast iterator over stale layer advanced")
+	}
+	if err := fast.Error(); err != ErrSnapshotStale {
+		t.Fatalf("fast iterator error mismatch: have %v, want %v", err, ErrSnapshotStale)
+	}
+}
+
 func TestAccountIteratorSeek(t *testing.T) {
 	// Create a snapshot stack with some initial data
 	base := &diskLayer{
@@ -1044,3 +1098,93 @@ func benchmarkAccountIteration(b *testing.B, iterator func(snap snapshot) Accoun
 	}
 }
 */
+
+// Tests that the change iterator yields the net account modifications within a
+// range of layers, along with the destruct markers and the original values.
+func TestAccountChangeIterator(t *testing.T) {
+	var (
+		diskdb = rawdb.NewMemoryDatabase()
+		blobs  = make(map[string][]byte)
+	)
+	for _, hash := range []string{"0xa2", "0xa3", "0xa5", "0xa6"} {
+		blobs[hash] = randomAccount()
+		rawdb.WriteAccountSnapshot(diskdb, common.HexToHash(hash), blobs[hash])
+	}
+	base := &diskLayer{
+		diskdb: diskdb,
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	accounts := randomAccountSet("0xa1", "0xa2", "0xa4")
+	accounts[common.HexToHash("0xa6")] = blobs["0xa6"]
+	snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil, accounts, nil)
+
+	destructs := map[common.Hash]struct{}{
+		common.HexToHash("0xa3"): {},
+		common.HexToHash("0xa4"): {},
+		common.HexToHash("0xa5"): {},
+	}
+	accounts = map[common.Hash][]byte{common.HexToHash("0xa5"): blobs["0xa5"]}
+	snaps.Update(common.HexToHash("0x03"), common.HexToHash("0x02"), destructs, accounts, nil)
+
+	type change struct {
+		hash       common.Hash
+		change     ChangeType
+		destructed bool
+		origin     bool
+	}
+	collect := func(from, to string) []change {
+		it, err := snaps.AccountChangeIterator(common.HexToHash(from), common.HexToHash(to))
+		if err != nil {
+			t.Fatalf("failed to create change iterator %s-%s: %v", from, to, err)
+		}
+		defer it.Release()
+
+		var changes []change
+		for it.Next() {
+			origin, known := it.Origin()
+			if !known {
+				t.Fatalf("origin of %x unknown", it.Hash())
+			}
+			if (it.Change() == ChangeCreated) != (origin == nil) {
+				t.Fatalf("origin of %x mismatches %v change", it.Hash(), it.Change())
+			}
+			if (it.Change() == ChangeDeleted) != (it.Account() == nil) {
+				t.Fatalf("value of %x mismatches %v change", it.Hash(), it.Change())
+			}
+			changes = append(changes, change{it.Hash(), it.Change(), it.Destructed(), origin != nil})
+		}
+		if err := it.Error(); err != nil {
+			t.Fatalf("change iteration %s-%s failed: %v", from, to, err)
+		}
+		return changes
+	}
+	want := []change{
+		{common.HexToHash("0xa1"), ChangeCreated, false, false},
+		{common.HexToHash("0xa2"), ChangeUpdated, false, true},
+		{common.HexToHash("0xa3"), ChangeDeleted, true, true},
+		{common.HexToHash("0xa5"), ChangeUpdated, true, true},
+	}
+	if have := collect("0x01", "0x03"); fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("full range changes mismatch:\nhave %v\nwant %v", have, want)
+	}
+	want = []change{
+		{common.HexToHash("0xa3"), ChangeDeleted, true, true},
+		{common.HexToHash("0xa4"), ChangeDeleted, true, true},
+		{common.HexToHash("0xa5"), ChangeUpdated, true, true},
+	}
+	if have := collect("0x02", "0x03"); fmt.Sprint(have) != fmt.Sprint(want) {
+		t.Errorf("partial range changes mismatch:\nhave %v\nwant %v", have, want)
+	}
+	if have := collect("0x03", "0x03"); len(have) != 0 {
+		t.Errorf("empty range changes mismatch: have %v, want none", have)
+	}
+	if _, err := snaps.AccountChangeIterator(common.HexToHash("0x03"), common.HexToHash("0x02")); err == nil {
+		t.Errorf("change iterator created over inverted range")
+	}
+}
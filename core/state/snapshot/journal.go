@@ -41,6 +41,74 @@ type journalGenerator struct {
 	Accounts uint64
 	Slots    uint64
 	Storage  uint64
+	Shards   [][]byte `rlp:"tail"` // Markers of the account hash ranges, empty if not sharded
+}
+
+// journalProgress is the snapshot wiping and generation checkpoint. Different
+// from the generator entry in the journal which is only written on shutdown, the
+// checkpoint is persisted along with the wiped or generated data, so that the
+// progress can be resumed precisely even if the journal is not available.
+type journalProgress struct {
+	Wiping     bool   // Whether the database is in progress of being wiped
+	WipeMarker []byte // Database key up to which the leftovers are wiped
+	Done       bool   // Whether the generator finished creating the snapshot
+	Marker     []byte // Account (and storage slot) hash up to which the snapshot is generated
+	Accounts   uint64
+	Slots      uint64
+	Storage    uint64
+	Shards     [][]byte `rlp:"tail"` // Markers of the account hash ranges, empty if not sharded
+}
+
+// loadProgress retrieves the persisted snapshot wiping and generation checkpoint.
+// Nil is returned if the checkpoint is not available or corrupted.
+func loadProgress(db ethdb.KeyValueReader) *journalProgress {
+	blob := rawdb.ReadSnapshotGenerator(db)
+	if len(blob) == 0 {
+		return nil
+	}
+	var progress journalProgress
+	if err := rlp.DecodeBytes(blob, &progress); err != nil {
+		log.Warn("Failed to decode snapshot progress", "err", err)
+		return nil
+	}
+	return &progress
+}
+
+// writeProgress persists the snapshot wiping and generation checkpoint. The
+// given writer is expected to be the batch carrying the data it covers.
+func writeProgress(db ethdb.KeyValueWriter, progress *journalProgress) {
+	blob, err := rlp.EncodeToBytes(progress)
+	if err != nil {
+		panic(err) // Cannot happen, here to catch dev errors
+	}
+	rawdb.WriteSnapshotGenerator(db, blob)
+}
+
+// MarkGenerated marks the flat snapshot data persisted in the database as the
+// fully generated snapshot of the given state root. It writes the generation
+// checkpoint and an empty journal, so the snapshot is loaded on the next start
+// instead of being regenerated from the tries. It's meant for states written in
+// bulk along with their snapshot (e.g. the genesis); the caller is responsible
+// for the flat data and its storage accounting being complete.
+func MarkGenerated(db ethdb.KeyValueWriter, root common.Hash, accounts, slots, storage uint64) error {
+	journal, err := rlp.EncodeToBytes(journalGenerator{
+		Done:     true,
+		Accounts: accounts,
+		Slots:    slots,
+		Storage:  storage,
+	})
+	if err != nil {
+		return err
+	}
+	writeProgress(db, &journalProgress{
+		Done:     true,
+		Accounts: accounts,
+		Slots:    slots,
+		Storage:  storage,
+	})
+	rawdb.WriteSnapshotJournal(db, journal)
+	rawdb.WriteSnapshotRoot(db, root)
+	return nil
 }
 
 // journalDestruct is an account deletion entry in a diffLayer's disk journal.
@@ -62,7 +130,9 @@ type journalStorage struct {
 }
 
 // loadSnapshot loads a pre-existing state snapshot backed by a key-value store.
-func loadSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash) (snapshot, error) {
+// If a seal is given, the journal must be sealed with it, otherwise it must be
+// plain.
+func loadSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash, seal *JournalSeal) (snapshot, error) {
 	// Retrieve the block number and hash of the snapshot, failing if no snapshot
 	// is present in the database (or crashed mid-update).
 	baseRoot := rawdb.ReadSnapshotRoot(diskdb)
@@ -81,6 +151,10 @@ func loadSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int,
 	if len(journal) == 0 {
 		return nil, errors.New("missing or corrupted snapshot journal")
 	}
+	journal, err := seal.open(journal)
+	if err != nil {
+		return nil, err
+	}
 	r := rlp.NewStream(bytes.NewReader(journal), 0)
 
 	// Read the snapshot generation progress for the disk layer
@@ -88,6 +162,9 @@ func loadSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int,
 	if err := r.Decode(&generator); err != nil {
 		return nil, fmt.Errorf("failed to load snapshot progress marker: %v", err)
 	}
+	if !validShards(len(generator.Shards)) {
+		return nil, fmt.Errorf("invalid snapshot generator shards: %d", len(generator.Shards))
+	}
 	// Load all the snapshot diffs from the journal
 	snapshot, err := loadDiffLayer(base, r)
 	if err != nil {
@@ -100,38 +177,70 @@ func loadSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int,
 	}
 	// Everything loaded correctly, resume any suspended operations
 	if !generator.Done {
-		// If the generator was still wiping, restart one from scratch (fine for
-		// now as it's rare and the wiper deletes the stuff it touches anyway, so
-		// restarting won't incur a lot of extra database hops.
+		// If the generator was still wiping, resume it from the last checkpoint
 		var wiper chan struct{}
 		if generator.Wiping {
 			log.Info("Resuming previous snapshot wipe")
 			wiper = wipeSnapshot(diskdb, false)
 		}
 		// Whether or not wiping was in progress, load any generator progress too
-		base.genMarker = generator.Marker
-		if base.genMarker == nil {
-			base.genMarker = []byte{}
-		}
-		base.genPending = make(chan struct{})
-		base.genAbort = make(chan chan *generatorStats)
-
-		var origin uint64
-		if len(generator.Marker) >= 8 {
-			origin = binary.BigEndian.Uint64(generator.Marker)
-		}
-		go base.generate(&generatorStats{
-			wiping:   wiper,
-			origin:   origin,
-			start:    time.Now(),
-			accounts: generator.Accounts,
-			slots:    generator.Slots,
-			storage:  common.StorageSize(generator.Storage),
-		})
+		base.resumeGeneration(wiper, generator.Marker, generator.Shards, generator.Accounts, generator.Slots, generator.Storage)
 	}
 	return snapshot, nil
 }
 
+// resumeSnapshot reconstructs the disk layer of the snapshot from the persisted
+// checkpoint if the journal is not usable. It's only possible if the persisted
+// snapshot belongs to the requested root and no wiping is in progress, since
+// the journalled diff layers are lost. Nil is returned if it can't be resumed.
+func resumeSnapshot(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash) *diskLayer {
+	if baseRoot := rawdb.ReadSnapshotRoot(diskdb); baseRoot == (common.Hash{}) || baseRoot != root {
+		return nil
+	}
+	progress := loadProgress(diskdb)
+	if progress == nil || progress.Wiping || !validShards(len(progress.Shards)) {
+		return nil
+	}
+	base := &diskLayer{
+		diskdb: diskdb,
+		triedb: triedb,
+		cache:  fastcache.New(cache * 1024 * 1024),
+		root:   root,
+	}
+	if !progress.Done {
+		base.resumeGeneration(nil, progress.Marker, progress.Shards, progress.Accounts, progress.Slots, progress.Storage)
+	}
+	return base
+}
+
+// resumeGeneration restarts the snapshot generation of the disk layer from the
+// given marker (or the markers of the shards if sharded), carrying over the
+// statistics of the previous run.
+func (dl *diskLayer) resumeGeneration(wiper chan struct{}, marker []byte, shards [][]byte, accounts, slots, storage uint64) {
+	dl.genMarker = marker
+	if dl.genMarker == nil {
+		dl.genMarker = []byte{}
+	}
+	if len(shards) > 0 {
+		dl.genShards = shards
+	}
+	dl.genPending = make(chan struct{})
+	dl.genAbort = make(chan chan *generatorStats)
+
+	var origin uint64
+	if len(marker) >= 8 {
+		origin = binary.BigEndian.Uint64(marker)
+	}
+	go dl.generate(&generatorStats{
+		wiping:   wiper,
+		origin:   origin,
+		start:    time.Now(),
+		accounts: accounts,
+		slots:    slots,
+		storage:  common.StorageSize(storage),
+	})
+}
+
 // loadDiffLayer reads the next sections of a snapshot journal, reconstructing a new
 // diff and verifying that it can be linked to the requested parent.
 func loadDiffLayer(parent snapshot, r *rlp.Stream) (snapshot, error) {
@@ -207,6 +316,7 @@ func (dl *diskLayer) Journal(buffer *bytes.Buffer) (common.Hash, error) {
 	entry := journalGenerator{
 		Done:   dl.genMarker == nil,
 		Marker: dl.genMarker,
+		Shards: dl.genShards,
 	}
 	if stats != nil {
 		entry.Wiping = (stats.wiping != nil)
@@ -239,27 +349,29 @@ func (dl *diffLayer) Journal(buffer *bytes.Buffer) (common.Hash, error) {
 	if err := rlp.Encode(buffer, dl.root); err != nil {
 		return common.Hash{}, err
 	}
+	// Write the diffs in key order, so identical layers always serialize into
+	// identical journals
 	destructs := make([]journalDestruct, 0, len(dl.destructSet))
-	for hash := range dl.destructSet {
+	for _, hash := range SortedDestructs(dl.destructSet) {
 		destructs = append(destructs, journalDestruct{Hash: hash})
 	}
 	if err := rlp.Encode(buffer, destructs); err != nil {
 		return common.Hash{}, err
 	}
 	accounts := make([]journalAccount, 0, len(dl.accountData))
-	for hash, blob := range dl.accountData {
-		accounts = append(accounts, journalAccount{Hash: hash, Blob: blob})
+	for _, hash := range SortedKeys(dl.accountData) {
+		accounts = append(accounts, journalAccount{Hash: hash, Blob: dl.accountData[hash]})
 	}
 	if err := rlp.Encode(buffer, accounts); err != nil {
 		return common.Hash{}, err
 	}
 	storage := make([]journalStorage, 0, len(dl.storageData))
-	for hash, slots := range dl.storageData {
-		keys := make([]common.Hash, 0, len(slots))
+	for _, hash := range SortedStorageAccounts(dl.storageData) {
+		slots := dl.storageData[hash]
+		keys := SortedKeys(slots)
 		vals := make([][]byte, 0, len(slots))
-		for key, val := range slots {
-			keys = append(keys, key)
-			vals = append(vals, val)
+		for _, key := range keys {
+			vals = append(vals, slots[key])
 		}
 		storage = append(storage, journalStorage{Hash: hash, Keys: keys, Vals: vals})
 	}
@@ -268,3 +380,100 @@ func (dl *diffLayer) Journal(buffer *bytes.Buffer) (common.Hash, error) {
 	}
 	return base, nil
 }
+
+// auditJournal decodes a freshly written snapshot journal and verifies that it
+// reproduces the journalled layers exactly, catching any encoding issue before
+// the journal is needed for a restart.
+func auditJournal(journal []byte, head snapshot) error {
+	// Collect the in-memory layers, the head first
+	var diffs []*diffLayer
+	for {
+		diff, ok := head.(*diffLayer)
+		if !ok {
+			break
+		}
+		diffs = append(diffs, diff)
+		head = diff.parent
+	}
+	disk, ok := head.(*diskLayer)
+	if !ok {
+		return fmt.Errorf("unknown data layer: %T", head)
+	}
+	// Decode the journal on top of the live disk layer
+	r := rlp.NewStream(bytes.NewReader(journal), 0)
+
+	var generator journalGenerator
+	if err := r.Decode(&generator); err != nil {
+		return fmt.Errorf("failed to load snapshot progress marker: %v", err)
+	}
+	if generator.Done != (disk.genMarker == nil) || !bytes.Equal(generator.Marker, disk.genMarker) {
+		return fmt.Errorf("generator marker mismatch: have %x (done %v), want %x", generator.Marker, generator.Done, disk.genMarker)
+	}
+	if len(generator.Shards) != len(disk.genShards) {
+		return fmt.Errorf("generator shard count mismatch: have %d, want %d", len(generator.Shards), len(disk.genShards))
+	}
+	for i, marker := range generator.Shards {
+		if !bytes.Equal(marker, disk.genShards[i]) {
+			return fmt.Errorf("generator shard %d marker mismatch: have %x, want %x", i, marker, disk.genShards[i])
+		}
+	}
+	loaded, err := loadDiffLayer(disk, r)
+	if err != nil {
+		return err
+	}
+	// Cross-check the decoded layers one by one against the live ones
+	for i, want := range diffs {
+		have, ok := loaded.(*diffLayer)
+		if !ok {
+			return fmt.Errorf("missing diff layer %d [%#x]", i, want.root)
+		}
+		if err := compareDiffLayers(have, want); err != nil {
+			return fmt.Errorf("diff layer %d [%#x]: %v", i, want.root, err)
+		}
+		loaded = have.parent
+	}
+	if loaded != snapshot(disk) {
+		return fmt.Errorf("dangling diff layer [%#x]", loaded.Root())
+	}
+	return nil
+}
+
+// compareDiffLayers checks whether two diff layers contain the same state changes.
+func compareDiffLayers(have, want *diffLayer) error {
+	want.lock.RLock()
+	defer want.lock.RUnlock()
+
+	if have.root != want.root {
+		return fmt.Errorf("root mismatch: have %#x", have.root)
+	}
+	if len(have.destructSet) != len(want.destructSet) {
+		return fmt.Errorf("destruct count mismatch: have %d, want %d", len(have.destructSet), len(want.destructSet))
+	}
+	for hash := range want.destructSet {
+		if _, ok := have.destructSet[hash]; !ok {
+			return fmt.Errorf("destruct %#x missing", hash)
+		}
+	}
+	if len(have.accountData) != len(want.accountData) {
+		return fmt.Errorf("account count mismatch: have %d, want %d", len(have.accountData), len(want.accountData))
+	}
+	for hash, blob := range want.accountData {
+		if enc, ok := have.accountData[hash]; !ok || !bytes.Equal(enc, blob) {
+			return fmt.Errorf("account %#x mismatch: have %x, want %x", hash, enc, blob)
+		}
+	}
+	if len(have.storageData) != len(want.storageData) {
+		return fmt.Errorf("storage count mismatch: have %d, want %d", len(have.storageData), len(want.storageData))
+	}
+	for hash, slots := range want.storageData {
+		if len(have.storageData[hash]) != len(slots) {
+			return fmt.Errorf("storage %#x slot count mismatch: have %d, want %d", hash, len(have.storageData[hash]), len(slots))
+		}
+		for key, val := range slots {
+			if enc, ok := have.storageData[hash][key]; !ok || !bytes.Equal(enc, val) {
+				return fmt.Errorf("storage %#x slot %#x mismatch: have %x, want %x", hash, key, enc, val)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+const (
+	// journalSealMagic is the leading byte of a sealed journal. Plain journals
+	// always start with an RLP list header, so the two can't be confused.
+	journalSealMagic = 0x53
+
+	// journalSealVersion is the version of the sealed journal format.
+	journalSealVersion = 1
+
+	// journalSealHeaderSize is the size of the sealed journal header: the magic
+	// byte, the format version and the sealing mode.
+	journalSealHeaderSize = 3
+)
+
+// Sealing modes of the journal.
+const (
+	journalSealMAC     = 0 // Journal authenticated with HMAC-SHA256
+	journalSealEncrypt = 1 // Journal encrypted and authenticated with AES-GCM
+)
+
+var (
+	// errJournalSealed is returned if a sealed journal is found but no secret
+	// is configured to open it.
+	errJournalSealed = errors.New("snapshot journal is sealed, secret not configured")
+
+	// errJournalNotSealed is returned if a plain journal is found although a
+	// secret is configured, which might be the result of tampering.
+	errJournalNotSealed = errors.New("snapshot journal is not sealed")
+
+	// errJournalTampered is returned if the authentication of a sealed journal
+	// fails, either due to tampering or a different secret.
+	errJournalTampered = errors.New("snapshot journal authentication failed")
+)
+
+// JournalSeal configures the sealing of the snapshot journal, which contains the
+// full recent state diffs, so tampering with it is detected at load time. A
+// journal failing the checks is discarded, falling back to resuming the disk
+// layer or regenerating the snapshot.
+type JournalSeal struct {
+	Secret  []byte // Node secret the journal keys are derived from
+	Encrypt bool   // Whether to encrypt the journal besides authenticating it
+}
+
+// key derives the key for the given purpose from the node secret.
+func (s *JournalSeal) key(purpose string) []byte {
+	mac := hmac.New(sha256.New, s.Secret)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+// seal authenticates, and if configured encrypts, the journal.
+func (s *JournalSeal) seal(journal []byte) ([]byte, error) {
+	header := []byte{journalSealMagic, journalSealVersion, journalSealMAC}
+	if !s.Encrypt {
+		mac := hmac.New(sha256.New, s.key("snapshot journal mac"))
+		mac.Write(header)
+		mac.Write(journal)
+
+		sealed := append(header, journal...)
+		return mac.Sum(sealed), nil
+	}
+	header[2] = journalSealEncrypt
+
+	aead, err := s.cipher()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, journal, header), nil
+}
+
+// open verifies, and if needed decrypts, a sealed journal. A nil seal accepts
+// plain journals only, a non-nil one sealed journals only.
+func (s *JournalSeal) open(blob []byte) ([]byte, error) {
+	sealed := len(blob) > 0 && blob[0] == journalSealMagic
+	switch {
+	case s == nil && !sealed:
+		return blob, nil
+	case s == nil:
+		return nil, errJournalSealed
+	case !sealed:
+		return nil, errJournalNotSealed
+	case len(blob) < journalSealHeaderSize:
+		return nil, errJournalTampered
+	case blob[1] != journalSealVersion:
+		return nil, fmt.Errorf("unsupported snapshot journal seal version %d, want %d", blob[1], journalSealVersion)
+	}
+	header, body := blob[:journalSealHeaderSize], blob[journalSealHeaderSize:]
+
+	switch header[2] {
+	case journalSealMAC:
+		if len(body) < sha256.Size {
+			return nil, errJournalTampered
+		}
+		journal, sum := body[:len(body)-sha256.Size], body[len(body)-sha256.Size:]
+
+		mac := hmac.New(sha256.New, s.key("snapshot journal mac"))
+		mac.Write(header)
+		mac.Write(journal)
+		if !hmac.Equal(mac.Sum(nil), sum) {
+			return nil, errJournalTampered
+		}
+		return journal, nil
+
+	case journalSealEncrypt:
+		aead, err := s.cipher()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < aead.NonceSize() {
+			return nil, errJournalTampered
+		}
+		journal, err := aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], header)
+		if err != nil {
+			return nil, errJournalTampered
+		}
+		return journal, nil
+
+	default:
+		return nil, fmt.Errorf("unknown snapshot journal seal mode %d", header[2])
+	}
+}
+
+// cipher creates the AES-GCM cipher used to encrypt the journal.
+func (s *JournalSeal) cipher() (cipher.AEAD, error) {
+	block, err := aes.NewCipher(s.key("snapshot journal encryption"))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,207 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// errNoLiveDiskLayer is returned if the snapshot tree can't be repaired since it
+// doesn't reference any live disk layer to anchor the layers to.
+var errNoLiveDiskLayer = errors.New("no live disk layer")
+
+// RepairResult contains the statistics of a snapshot tree index rebuild.
+type RepairResult struct {
+	Layers   int `json:"layers"`   // Number of layers in the rebuilt tree
+	Restored int `json:"restored"` // Number of layers missing from the lookup but reachable from the heads
+	Dropped  int `json:"dropped"`  // Number of stale or orphaned layers removed from the lookup
+}
+
+// RebuildIndexes reconstructs the derived indexes of the snapshot tree from the
+// layers themselves, fixing any inconsistency without discarding the journal.
+// The root lookup is rebuilt by walking the parent links of all known layers,
+// dropping the stale ones and the ones not anchored to the live disk layer, and
+// the aggregated bloom filters of the diff layers are regenerated.
+//
+// Updates to the tree are blocked while the indexes are rebuilt.
+func (t *Tree) RebuildIndexes() (*RepairResult, error) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	// Gather all the layers reachable from the lookup, locating the disk layer
+	var (
+		known = make(map[snapshot]struct{})
+		base  *diskLayer
+	)
+	for _, layer := range t.layers {
+		for ; layer != nil; layer = layer.Parent() {
+			if _, ok := known[layer]; ok {
+				break
+			}
+			known[layer] = struct{}{}
+
+			if disk, ok := layer.(*diskLayer); ok && !disk.Stale() {
+				if base != nil && base != disk {
+					return nil, fmt.Errorf("multiple live disk layers: %#x, %#x", base.root, disk.root)
+				}
+				base = disk
+			}
+		}
+	}
+	if base == nil {
+		return nil, errNoLiveDiskLayer
+	}
+	// Keep all the live layers anchored to the disk layer
+	var (
+		layers   = make(map[common.Hash]snapshot)
+		children = make(map[common.Hash][]common.Hash)
+		result   = new(RepairResult)
+	)
+	for layer := range known {
+		if !anchored(layer, base) {
+			continue
+		}
+		root := layer.Root()
+		if prev, ok := layers[root]; ok && prev != layer {
+			return nil, fmt.Errorf("duplicate layer %#x", root)
+		}
+		layers[root] = layer
+		if t.layers[root] != layer {
+			result.Restored++
+		}
+		if diff, ok := layer.(*diffLayer); ok {
+			parent := diff.parent.Root()
+			children[parent] = append(children[parent], root)
+		}
+	}
+	for root, layer := range t.layers {
+		if layers[root] != layer {
+			result.Dropped++
+		}
+	}
+	t.layers = layers
+	result.Layers = len(layers)
+
+	// Regenerate the cumulative blooms from the disk layer upwards
+	var rebloom func(root common.Hash)
+	rebloom = func(root common.Hash) {
+		if diff, ok := t.layers[root].(*diffLayer); ok {
+			diff.rebloom(base)
+		}
+		for _, child := range children[root] {
+			rebloom(child)
+		}
+	}
+	rebloom(base.root)
+
+	if result.Restored > 0 || result.Dropped > 0 {
+		log.Warn("Repaired snapshot tree indexes", "layers", result.Layers, "restored", result.Restored, "dropped", result.Dropped)
+	}
+	return result, nil
+}
+
+// anchored reports whether the layer and all its ancestors are live and the
+// chain of layers terminates in the given disk layer.
+func anchored(layer snapshot, base *diskLayer) bool {
+	for ; layer != nil; layer = layer.Parent() {
+		if layer.Stale() {
+			return false
+		}
+		if disk, ok := layer.(*diskLayer); ok {
+			return disk == base
+		}
+	}
+	return false
+}
+
+// CheckInvariants verifies the consistency of the snapshot tree indexes, returning
+// the first violation found. It's meant to be used by tests and for debugging; on
+// failure, the indexes can be fixed with RebuildIndexes.
+func (t *Tree) CheckInvariants() error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var base *diskLayer
+	for root, layer := range t.layers {
+		if disk, ok := layer.(*diskLayer); ok {
+			if base != nil {
+				return fmt.Errorf("multiple disk layers: %#x, %#x", base.root, root)
+			}
+			base = disk
+		}
+	}
+	if base == nil {
+		return errNoLiveDiskLayer
+	}
+	for root, layer := range t.layers {
+		if layer.Root() != root {
+			return fmt.Errorf("layer %#x indexed as %#x", layer.Root(), root)
+		}
+		if layer.Stale() {
+			return fmt.Errorf("stale layer %#x", root)
+		}
+		diff, ok := layer.(*diffLayer)
+		if !ok {
+			continue
+		}
+		if !anchored(diff, base) {
+			return fmt.Errorf("layer %#x not anchored to disk layer %#x", root, base.root)
+		}
+		for parent := diff.parent; parent != nil; parent = parent.Parent() {
+			if t.layers[parent.Root()] != parent {
+				return fmt.Errorf("ancestor %#x of layer %#x not indexed", parent.Root(), root)
+			}
+		}
+		if err := diff.checkBloom(base); err != nil {
+			return fmt.Errorf("layer %#x: %v", root, err)
+		}
+	}
+	return nil
+}
+
+// checkBloom verifies that the layer is indexed against the given disk layer and
+// that its aggregated bloom filter contains all the local diffs.
+func (dl *diffLayer) checkBloom(origin *diskLayer) error {
+	dl.lock.RLock()
+	defer dl.lock.RUnlock()
+
+	if dl.origin != origin {
+		return fmt.Errorf("origin mismatch: have %#x, want %#x", dl.origin.root, origin.root)
+	}
+	for hash := range dl.destructSet {
+		if !dl.diffed.Contains(destructBloomHasher(hash)) {
+			return fmt.Errorf("destruct %#x missing from bloom", hash)
+		}
+	}
+	for hash := range dl.accountData {
+		if !dl.diffed.Contains(accountBloomHasher(hash)) {
+			return fmt.Errorf("account %#x missing from bloom", hash)
+		}
+	}
+	for accountHash, slots := range dl.storageData {
+		for storageHash := range slots {
+			if !dl.diffed.Contains(storageBloomHasher{accountHash, storageHash}) {
+				return fmt.Errorf("slot %#x:%#x missing from bloom", accountHash, storageHash)
+			}
+		}
+	}
+	return nil
+}
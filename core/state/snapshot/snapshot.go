@@ -19,8 +19,9 @@ package snapshot
 
 import (
 	"bytes"
-	"errors"
+	"context"
 	"fmt"
+	"runtime/trace"
 	"sync"
 	"sync/atomic"
 
@@ -65,6 +66,8 @@ var (
 	snapshotFlushStorageItemMeter = metrics.NewRegisteredMeter("state/snapshot/flush/storage/item", nil)
 	snapshotFlushStorageSizeMeter = metrics.NewRegisteredMeter("state/snapshot/flush/storage/size", nil)
 
+	snapshotWipeStorageItemMeter = metrics.NewRegisteredMeter("state/snapshot/wipe/storage/item", nil)
+
 	snapshotBloomIndexTimer = metrics.NewRegisteredResettingTimer("state/snapshot/bloom/index", nil)
 	snapshotBloomErrorGauge = metrics.NewRegisteredGaugeFloat64("state/snapshot/bloom/error", nil)
 
@@ -76,19 +79,11 @@ var (
 	snapshotBloomStorageFalseHitMeter = metrics.NewRegisteredMeter("state/snapshot/bloom/storage/falsehit", nil)
 	snapshotBloomStorageMissMeter     = metrics.NewRegisteredMeter("state/snapshot/bloom/storage/miss", nil)
 
-	// ErrSnapshotStale is returned from data accessors if the underlying snapshot
-	// layer had been invalidated due to the chain progressing forward far enough
-	// to not maintain the layer's original state.
-	ErrSnapshotStale = errors.New("snapshot stale")
-
-	// ErrNotCoveredYet is returned from data accessors if the underlying snapshot
-	// is being generated currently and the requested data item is not yet in the
-	// range of accounts covered.
-	ErrNotCoveredYet = errors.New("not covered yet")
+	snapshotFilterAccountHitMeter  = metrics.NewRegisteredMeter("state/snapshot/filter/account/hit", nil)
+	snapshotFilterAccountMissMeter = metrics.NewRegisteredMeter("state/snapshot/filter/account/miss", nil)
 
-	// errSnapshotCycle is returned if a snapshot is attempted to be inserted
-	// that forms a cycle in the snapshot tree.
-	errSnapshotCycle = errors.New("snapshot cycle")
+	snapshotTreeWidthGauge = metrics.NewRegisteredGauge("state/snapshot/tree/width", nil)
+	snapshotTreeDepthGauge = metrics.NewRegisteredGauge("state/snapshot/tree/depth", nil)
 )
 
 // Snapshot represents the functionality supported by a snapshot storage layer.
@@ -107,6 +102,14 @@ type Snapshot interface {
 	// Storage directly retrieves the storage data associated with a particular hash,
 	// within a particular account.
 	Storage(accountHash, storageHash common.Hash) ([]byte, error)
+
+	// StorageInto is an allocation free variant of Storage. If the slot needs to
+	// be loaded from the persistent layer, it's appended to buf; if it's found in
+	// the memory diffs, the internal data is returned directly.
+	//
+	// Note, the returned slice is only valid until buf is reused. Callers wishing
+	// to retain the data must explicitly copy it.
+	StorageInto(accountHash, storageHash common.Hash, buf []byte) ([]byte, error)
 }
 
 // snapshot is the internal version of the snapshot data layer that supports some
@@ -143,6 +146,14 @@ type snapshot interface {
 	StorageIterator(account common.Hash, seek common.Hash) (StorageIterator, bool)
 }
 
+// Validator is a callback invoked with the state changes of a block before the
+// corresponding diff layer is linked into the snapshot tree. It can be used by
+// downstream projects to enforce custom invariants on state transitions (e.g.
+// immutable accounts or storage quotas). Any returned error rejects the update.
+//
+// Note, the maps are the ones retained by the diff layer, don't modify them.
+type Validator func(root common.Hash, parent common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error
+
 // SnapshotTree is an Ethereum state snapshot tree. It consists of one persistent
 // base layer backed by a key-value store, on top of which arbitrarily many in-
 // memory diff layers are topped. The memory diffs can form a tree with branching,
@@ -157,7 +168,17 @@ type Tree struct {
 	triedb *trie.Database           // In-memory cache to access the trie through
 	cache  int                      // Megabytes permitted to use for read caches
 	layers map[common.Hash]snapshot // Collection of all known layers
-	lock   sync.RWMutex
+
+	validators []Validator  // Custom checks to run before linking a new layer
+	filterRate float64      // False-positive rate of the account existence filter, zero if disabled
+	memBudget  uint64       // Memory allowance of the retained diff layers, zero if unlimited
+	memLayers  int          // Minimum number of diff layers retained regardless of the memory budget
+	flushLimit uint64       // Accumulator size triggering a flush to disk, zero for the default
+	seal       *JournalSeal // Sealing of the journal, nil if stored plain
+	audit      bool         // Whether to verify the journal after writing it
+	strict     bool         // Whether to enforce increasing block numbers along the layers
+	ephemeral  bool         // Whether the tree lives in memory only, without a journal
+	lock       sync.RWMutex
 }
 
 // New attempts to load an already existing snapshot from a persistent key-value
@@ -168,19 +189,39 @@ type Tree struct {
 // be reconstructed from scratch based on the tries in the key-value store, on a
 // background thread.
 func New(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash, async bool) *Tree {
+	return NewWithSeal(diskdb, triedb, cache, root, async, nil)
+}
+
+// NewWithSeal is the same as New, but with the journal sealed with the given
+// node secret, authenticating it (and optionally encrypting it). A journal not
+// sealed with the same secret is rejected, falling back to resuming the disk
+// layer or regenerating the snapshot.
+func NewWithSeal(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root common.Hash, async bool, seal *JournalSeal) *Tree {
 	// Create a new, empty snapshot tree
 	snap := &Tree{
 		diskdb: diskdb,
 		triedb: triedb,
 		cache:  cache,
 		layers: make(map[common.Hash]snapshot),
+		seal:   seal,
 	}
 	if !async {
 		defer snap.waitBuild()
 	}
 	// Attempt to load a previously persisted snapshot and rebuild one if failed
-	head, err := loadSnapshot(diskdb, triedb, cache, root)
+	head, err := loadSnapshot(diskdb, triedb, cache, root, seal)
 	if err != nil {
+		// If the persisted snapshot matches the requested root, resume it from
+		// the last checkpoint instead of regenerating from scratch
+		if base := resumeSnapshot(diskdb, triedb, cache, root); base != nil {
+			log.Warn("Failed to load snapshot, resuming from checkpoint", "err", err)
+			base.lock.Lock()
+			base.wiper = newStorageWiper(diskdb, base.cache)
+			base.lock.Unlock()
+
+			snap.layers[root] = base
+			return snap
+		}
 		log.Warn("Failed to load snapshot, regenerating", "err", err)
 		snap.Rebuild(root)
 		return snap
@@ -190,6 +231,28 @@ func New(diskdb ethdb.KeyValueStore, triedb *trie.Database, cache int, root comm
 		snap.layers[head.Root()] = head
 		head = head.Parent()
 	}
+	if base := snap.disklayer(); base != nil {
+		base.wiper = newStorageWiper(diskdb, base.cache)
+	}
+	return snap
+}
+
+// NewEphemeral creates a snapshot tree living entirely in memory, generated from
+// the tries of the given root. The persistent layer is kept in a private memory
+// database and journalling is disabled, providing the same API surface without
+// touching any real database, which is useful for tests and simulations.
+//
+// The snapshot is generated synchronously before returning.
+func NewEphemeral(triedb *trie.Database, cache int, root common.Hash) *Tree {
+	snap := &Tree{
+		diskdb:    rawdb.NewMemoryDatabase(),
+		triedb:    triedb,
+		cache:     cache,
+		layers:    make(map[common.Hash]snapshot),
+		ephemeral: true,
+	}
+	snap.Rebuild(root)
+	snap.waitBuild()
 	return snap
 }
 
@@ -214,6 +277,17 @@ func (t *Tree) waitBuild() {
 	}
 }
 
+// disklayer is an internal helper function to return the disk layer.
+// The lock of the tree is assumed to be held already.
+func (t *Tree) disklayer() *diskLayer {
+	for _, layer := range t.layers {
+		if base, ok := layer.(*diskLayer); ok {
+			return base
+		}
+	}
+	return nil
+}
+
 // Snapshot retrieves a snapshot belonging to the given block root, or nil if no
 // snapshot is maintained for that block.
 func (t *Tree) Snapshot(blockRoot common.Hash) Snapshot {
@@ -226,6 +300,13 @@ func (t *Tree) Snapshot(blockRoot common.Hash) Snapshot {
 // Update adds a new snapshot into the tree, if that can be linked to an existing
 // old parent. It is disallowed to insert a disk layer (the origin of all).
 func (t *Tree) Update(blockRoot common.Hash, parentRoot common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+	return t.UpdateWithNumber(blockRoot, parentRoot, 0, destructs, accounts, storage)
+}
+
+// UpdateWithNumber is the same as Update, but also records the number of the
+// block the snapshot belongs to, zero meaning unknown. In strict mode the number
+// is mandatory and must be above the number of the parent, if that's known.
+func (t *Tree) UpdateWithNumber(blockRoot common.Hash, parentRoot common.Hash, number uint64, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
 	// Reject noop updates to avoid self-loops in the snapshot tree. This is a
 	// special case that can only happen for Clique networks where empty blocks
 	// don't modify the state (0 block subsidy).
@@ -235,12 +316,45 @@ func (t *Tree) Update(blockRoot common.Hash, parentRoot common.Hash, destructs m
 	if blockRoot == parentRoot {
 		return errSnapshotCycle
 	}
+	ctx, task := trace.NewTask(context.Background(), "snapshot.Update")
+	defer task.End()
+
+	trace.Logf(ctx, "layer", "root=%x parent=%x destructs=%d accounts=%d storage=%d", blockRoot, parentRoot, len(destructs), len(accounts), len(storage))
+
 	// Generate a new snapshot on top of the parent
-	parent := t.Snapshot(parentRoot).(snapshot)
-	if parent == nil {
-		return fmt.Errorf("parent [%#x] snapshot missing", parentRoot)
+	parent, ok := t.Snapshot(parentRoot).(snapshot)
+	if !ok {
+		return newLayerError(parentRoot, ErrSnapshotMissing)
+	}
+	// Run all the registered validators before touching the tree
+	t.lock.RLock()
+	validators, strict := t.validators, t.strict
+	t.lock.RUnlock()
+
+	if strict {
+		if number == 0 {
+			return ErrNumberMissing
+		}
+		if parentNumber := layerNumber(parent); parentNumber != 0 && number <= parentNumber {
+			return ErrNumberRegression
+		}
+	}
+
+	region := trace.StartRegion(ctx, "validate")
+	for _, validate := range validators {
+		if err := validate(blockRoot, parentRoot, destructs, accounts, storage); err != nil {
+			region.End()
+			return &LayerError{Root: blockRoot, Err: ErrSnapshotRejected, Cause: err}
+		}
 	}
+	region.End()
+
+	region = trace.StartRegion(ctx, "diff")
 	snap := parent.Update(blockRoot, destructs, accounts, storage)
+	snap.number = number
+	region.End()
+
+	trace.Logf(ctx, "memory", "%d", snap.memory)
 
 	// Save the new snapshot for later
 	t.lock.Lock()
@@ -250,6 +364,16 @@ func (t *Tree) Update(blockRoot common.Hash, parentRoot common.Hash, destructs m
 	return nil
 }
 
+// RegisterValidator adds a custom validator to run on every subsequent Update,
+// before the new diff layer is linked into the tree. Validators are invoked in
+// the order of registration and the first failure aborts the update.
+func (t *Tree) RegisterValidator(validator Validator) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.validators = append(t.validators, validator)
+}
+
 // Cap traverses downwards the snapshot tree from a head block hash until the
 // number of allowed layers are crossed. All layers beyond the permitted number
 // are flattened downwards.
@@ -257,14 +381,21 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 	// Retrieve the head snapshot to cap from
 	snap := t.Snapshot(root)
 	if snap == nil {
-		return fmt.Errorf("snapshot [%#x] missing", root)
+		return newLayerError(root, ErrSnapshotMissing)
 	}
 	diff, ok := snap.(*diffLayer)
 	if !ok {
-		return fmt.Errorf("snapshot [%#x] is disk layer", root)
+		return newLayerError(root, ErrSnapshotDiskLayer)
 	}
+	ctx, task := trace.NewTask(context.Background(), "snapshot.Cap")
+	defer task.End()
+
+	trace.Logf(ctx, "cap", "root=%x layers=%d", root, layers)
+
 	// Run the internal capping and discard all stale layers
+	region := trace.StartRegion(ctx, "lock")
 	t.lock.Lock()
+	region.End()
 	defer t.lock.Unlock()
 
 	// Flattening the bottom-most diff layer requires special casing since there's
@@ -276,11 +407,16 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 	case 0:
 		// If full commit was requested, flatten the diffs and merge onto disk
 		diff.lock.RLock()
-		base := diffToDisk(diff.flatten().(*diffLayer))
+		region := trace.StartRegion(ctx, "flatten")
+		bottom := diff.flatten().(*diffLayer)
+		region.End()
+		base := diffToDisk(ctx, bottom)
 		diff.lock.RUnlock()
 
 		// Replace the entire snapshot tree with the flat base
 		t.layers = map[common.Hash]snapshot{base.root: base}
+		snapshotTreeWidthGauge.Update(1)
+		snapshotTreeDepthGauge.Update(0)
 		return nil
 
 	case 1:
@@ -291,15 +427,19 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 			base   *diskLayer
 		)
 		diff.lock.RLock()
+		region := trace.StartRegion(ctx, "flatten")
 		bottom = diff.flatten().(*diffLayer)
-		if bottom.memory >= aggregatorMemoryLimit {
-			base = diffToDisk(bottom)
+		region.End()
+		if bottom.memory >= t.flushThreshold() {
+			base = diffToDisk(ctx, bottom)
 		}
 		diff.lock.RUnlock()
 
 		// If all diff layers were removed, replace the entire snapshot tree
 		if base != nil {
 			t.layers = map[common.Hash]snapshot{base.root: base}
+			snapshotTreeWidthGauge.Update(1)
+			snapshotTreeDepthGauge.Update(0)
 			return nil
 		}
 		// Merge the new aggregated layer into the snapshot tree, clean stales below
@@ -307,9 +447,22 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 
 	default:
 		// Many layers requested to be retained, cap normally
-		persisted = t.cap(diff, layers)
+		persisted = t.cap(ctx, diff, layers, false)
+
+		// If the retained diff layers exceed the memory budget, keep persisting the
+		// bottom-most ones until they fit, retaining the configured minimum anyway.
+		for retain := layers; t.memBudget > 0 && retain >= 2 && retain > t.memLayers; retain-- {
+			if diffMemory(diff) <= t.memBudget {
+				break
+			}
+			if base := t.cap(ctx, diff, retain, true); base != nil {
+				persisted = base
+			}
+		}
 	}
 	// Remove any layer that is stale or links into a stale layer
+	defer trace.StartRegion(ctx, "prune").End()
+
 	children := make(map[common.Hash][]common.Hash)
 	for root, snap := range t.layers {
 		if diff, ok := snap.(*diffLayer); ok {
@@ -330,6 +483,10 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 			remove(root)
 		}
 	}
+	width, depth := t.shape(children)
+	snapshotTreeWidthGauge.Update(int64(width))
+	snapshotTreeDepthGauge.Update(int64(depth))
+
 	// If the disk layer was modified, regenerate all the cumulative blooms
 	if persisted != nil {
 		var rebloom func(root common.Hash)
@@ -346,12 +503,91 @@ func (t *Tree) Cap(root common.Hash, layers int) error {
 	return nil
 }
 
+// shape returns the width (number of heads) and the depth (number of diff layers
+// on the longest branch) of the snapshot tree, walking it from the disk layer
+// with the given parent to children mapping. The caller must hold the lock.
+func (t *Tree) shape(children map[common.Hash][]common.Hash) (int, int) {
+	base := t.disklayer()
+	if base == nil {
+		return 0, 0
+	}
+	var (
+		width, depth int
+		walk         func(root common.Hash, level int)
+	)
+	walk = func(root common.Hash, level int) {
+		if level > depth {
+			depth = level
+		}
+		var live bool
+		for _, child := range children[root] {
+			if _, ok := t.layers[child]; ok {
+				live = true
+				walk(child, level+1)
+			}
+		}
+		if !live {
+			width++
+		}
+	}
+	walk(base.root, 0)
+	return width, depth
+}
+
+// SetMemoryBudget limits the memory held by the diff layers retained by Cap. If
+// the retained layers exceed the budget, the bottom-most ones are persisted even
+// if the requested number of layers is not crossed, as long as at least the
+// given minimum number of diff layers is kept for reorg safety. Zero budget
+// disables the limit.
+func (t *Tree) SetMemoryBudget(budget uint64, minLayers int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.memBudget, t.memLayers = budget, minLayers
+}
+
+// SetFlushLimit sets the size the bottom-most accumulator layer may grow to
+// before Cap persists it to disk. Lower limits trade larger and rarer flushes
+// for smaller ones performed every few blocks, bounding the merge work of any
+// single Cap and thus keeping the block import latency flat. Zero restores the
+// default limit. Full flushes (capping to zero layers) are not affected.
+func (t *Tree) SetFlushLimit(limit uint64) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.flushLimit = limit
+}
+
+// flushThreshold returns the accumulator size at which it's persisted to disk.
+// The caller must hold the tree lock.
+func (t *Tree) flushThreshold() uint64 {
+	if t.flushLimit == 0 {
+		return aggregatorMemoryLimit
+	}
+	return t.flushLimit
+}
+
+// diffMemory returns the total memory held by the diff layers from the given one
+// down to the disk layer. The caller must hold the tree lock.
+func diffMemory(diff *diffLayer) uint64 {
+	var memory uint64
+	for {
+		memory += diff.memory
+		parent, ok := diff.parent.(*diffLayer)
+		if !ok {
+			return memory
+		}
+		diff = parent
+	}
+}
+
 // cap traverses downwards the diff tree until the number of allowed layers are
 // crossed. All diffs beyond the permitted number are flattened downwards. If the
-// layer limit is reached, memory cap is also enforced (but not before).
+// layer limit is reached, memory cap is also enforced (but not before), unless
+// persisting the flattened layers is forced.
 //
 // The method returns the new disk layer if diffs were persistend into it.
-func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
+func (t *Tree) cap(ctx context.Context, diff *diffLayer, layers int, force bool) *diskLayer {
 	// Dive until we run out of layers or reach the persistent database
 	for ; layers > 2; layers-- {
 		// If we still have diff layers below, continue down
@@ -371,14 +607,16 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 	case *diffLayer:
 		// Flatten the parent into the grandparent. The flattening internally obtains a
 		// write lock on grandparent.
+		region := trace.StartRegion(ctx, "flatten")
 		flattened := parent.flatten().(*diffLayer)
+		region.End()
 		t.layers[flattened.root] = flattened
 
 		diff.lock.Lock()
 		defer diff.lock.Unlock()
 
 		diff.parent = flattened
-		if flattened.memory < aggregatorMemoryLimit {
+		if flattened.memory < t.flushThreshold() && !force {
 			// Accumulator layer is smaller than the limit, so we can abort, unless
 			// there's a snapshot being generated currently. In that case, the trie
 			// will move fron underneath the generator so we **must** merge all the
@@ -394,7 +632,7 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 	bottom := diff.parent.(*diffLayer)
 
 	bottom.lock.RLock()
-	base := diffToDisk(bottom)
+	base := diffToDisk(ctx, bottom)
 	bottom.lock.RUnlock()
 
 	t.layers[base.root] = base
@@ -404,17 +642,32 @@ func (t *Tree) cap(diff *diffLayer, layers int) *diskLayer {
 
 // diffToDisk merges a bottom-most diff into the persistent disk layer underneath
 // it. The method will panic if called onto a non-bottom-most diff layer.
-func diffToDisk(bottom *diffLayer) *diskLayer {
+//
+// The phases of the merge are annotated as regions of the execution trace task
+// carried by the context.
+func diffToDisk(ctx context.Context, bottom *diffLayer) *diskLayer {
+	defer trace.StartRegion(ctx, "diffToDisk").End()
+
 	var (
 		base  = bottom.parent.(*diskLayer)
 		batch = base.diskdb.NewBatch()
 		stats *generatorStats
 	)
+	trace.Logf(ctx, "flush", "root=%x memory=%d destructs=%d accounts=%d storage=%d", bottom.root, bottom.memory, len(bottom.destructSet), len(bottom.accountData), len(bottom.storageData))
+
+	items := len(bottom.accountData)
+	for _, storage := range bottom.storageData {
+		items += len(storage)
+	}
+	flush := newFlushStats(base.flushed, items)
+
 	// If the disk layer is running a snapshot generator, abort it
 	if base.genAbort != nil {
+		region := trace.StartRegion(ctx, "abortGeneration")
 		abort := make(chan *generatorStats)
 		base.genAbort <- abort
 		stats = <-abort
+		region.End()
 	}
 	// Start by temporarily deleting the current snapshot block marker. This
 	// ensures that in the case of a crash, the entire snapshot is invalidated.
@@ -429,15 +682,30 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 	base.lock.Unlock()
 
 	// Destroy all the destructed accounts from the database
+	var wipes []common.Hash
+
+	region := trace.StartRegion(ctx, "destructs")
 	for hash := range bottom.destructSet {
 		// Skip any account not covered yet by the snapshot
-		if base.genMarker != nil && bytes.Compare(hash[:], base.genMarker) > 0 {
+		if marker := base.genMarkerOf(hash[:]); marker != nil && bytes.Compare(hash[:], marker) > 0 {
 			continue
 		}
-		// Remove all storage slots
+		// Remove the account, scheduling the deletion of large storages for the
+		// background wiper and removing the rest inline
+		if base.wiper != nil && base.wiper.wiping(hash) {
+			base.wiper.finish(hash)
+		}
+		stats := rawdb.ReadStorageStats(base.diskdb, hash)
+
 		rawdb.DeleteAccountSnapshot(batch, hash)
+		rawdb.DeleteStorageStats(batch, hash)
 		base.cache.Set(hash[:], nil)
 
+		if deferWipe(base, bottom, hash, stats) {
+			rawdb.WriteStorageWipe(batch, hash)
+			wipes = append(wipes, hash)
+			continue
+		}
 		it := rawdb.IterateStorageSnapshots(base.diskdb, hash)
 		for it.Next() {
 			if key := it.Key(); len(key) == 65 { // TODO(karalabe): Yuck, we should move this into the iterator
@@ -449,10 +717,13 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 		}
 		it.Release()
 	}
+	region.End()
+
 	// Push all updated accounts into the database
+	region = trace.StartRegion(ctx, "accounts")
 	for hash, data := range bottom.accountData {
 		// Skip any account not covered yet by the snapshot
-		if base.genMarker != nil && bytes.Compare(hash[:], base.genMarker) > 0 {
+		if marker := base.genMarkerOf(hash[:]); marker != nil && bytes.Compare(hash[:], marker) > 0 {
 			continue
 		}
 		// Push the account to disk
@@ -468,21 +739,46 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 		}
 		snapshotFlushAccountItemMeter.Mark(1)
 		snapshotFlushAccountSizeMeter.Mark(int64(len(data)))
+		flush.account(hash, len(data))
 	}
+	region.End()
+
 	// Push all the storage slots into the database
+	region = trace.StartRegion(ctx, "storage")
 	for accountHash, storage := range bottom.storageData {
 		// Skip any account not covered yet by the snapshot
-		if base.genMarker != nil && bytes.Compare(accountHash[:], base.genMarker) > 0 {
+		marker := base.genMarkerOf(accountHash[:])
+		if marker != nil && bytes.Compare(accountHash[:], marker) > 0 {
 			continue
 		}
+		// If the account's storage is still being wiped, finish it before writing
+		// any new slots
+		if base.wiper != nil && base.wiper.wiping(accountHash) {
+			base.wiper.finish(accountHash)
+		}
 		// Generation might be mid-account, track that case too
-		midAccount := base.genMarker != nil && bytes.Equal(accountHash[:], base.genMarker[:common.HashLength])
+		midAccount := marker != nil && bytes.Equal(accountHash[:], marker[:common.HashLength])
 
+		// Destructed accounts start their storage accounting from scratch, so it
+		// can be tracked from the written slots alone. Otherwise the accounting is
+		// dropped and recounted on every request, as updating it would need
+		// the previous value of every slot. Accounts still being generated are
+		// left to the generator, which accounts for them at the end.
+		var (
+			stats         *rawdb.StorageStats
+			_, destructed = bottom.destructSet[accountHash]
+		)
+		if destructed && !midAccount {
+			stats = new(rawdb.StorageStats)
+		}
 		for storageHash, data := range storage {
 			// Skip any slot not covered yet by the snapshot
-			if midAccount && bytes.Compare(storageHash[:], base.genMarker[common.HashLength:]) > 0 {
+			if midAccount && bytes.Compare(storageHash[:], marker[common.HashLength:]) > 0 {
 				continue
 			}
+			if stats != nil {
+				updateStorageStats(stats, nil, data)
+			}
 			if len(data) > 0 {
 				rawdb.WriteStorageSnapshot(batch, accountHash, storageHash, data)
 				base.cache.Set(append(accountHash[:], storageHash[:]...), data)
@@ -493,6 +789,14 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 			}
 			snapshotFlushStorageItemMeter.Mark(1)
 			snapshotFlushStorageSizeMeter.Mark(int64(len(data)))
+			flush.slot(accountHash, storageHash, len(data))
+		}
+		switch {
+		case stats != nil:
+			writeStorageStats(batch, accountHash, stats)
+			flush.storageStats(stats)
+		case !midAccount:
+			rawdb.DeleteStorageStats(batch, accountHash)
 		}
 		if batch.ValueSize() > ethdb.IdealBatchSize {
 			if err := batch.Write(); err != nil {
@@ -501,18 +805,45 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 			batch.Reset()
 		}
 	}
+	region.End()
+
 	// Update the snapshot block marker and write any remainder data
+	region = trace.StartRegion(ctx, "write")
 	rawdb.WriteSnapshotRoot(batch, bottom.root)
 	if err := batch.Write(); err != nil {
 		log.Crit("Failed to write leftover snapshot", "err", err)
 	}
+	region.End()
+
+	// Hand the large storages over to the wiper. It must be done after the
+	// schedule is persisted, otherwise the wiper might finish before the stale
+	// schedule is written.
+	if len(wipes) > 0 {
+		base.wiper.schedule(wipes)
+	}
+
+	// Insert the flushed accounts into the existence filter. It must be done
+	// after the accounts are persisted, otherwise a concurrent rebuild of the
+	// filter might miss them.
+	if base.filter != nil {
+		hashes := make([]common.Hash, 0, len(bottom.accountData))
+		for hash := range bottom.accountData {
+			hashes = append(hashes, hash)
+		}
+		base.filter.add(hashes)
+	}
 	res := &diskLayer{
 		root:       bottom.root,
 		cache:      base.cache,
 		diskdb:     base.diskdb,
 		triedb:     base.triedb,
+		filter:     base.filter,
+		wiper:      base.wiper,
 		genMarker:  base.genMarker,
+		genShards:  append([][]byte(nil), base.genShards...),
 		genPending: base.genPending,
+		flushed:    flush.finish(),
+		number:     bottom.number,
 	}
 	// If snapshot generation hasn't finished yet, port over all the starts and
 	// continue where the previous round left off.
@@ -527,6 +858,21 @@ func diffToDisk(bottom *diffLayer) *diskLayer {
 	return res
 }
 
+// deferWipe decides whether the storage deletion of a destructed account should
+// be scheduled for the background wiper instead of running inline. Only large
+// storages, or ones of unknown size, of accounts fully covered by the generator
+// and not written into by the flattened layer are deferred.
+func deferWipe(base *diskLayer, bottom *diffLayer, hash common.Hash, stats *rawdb.StorageStats) bool {
+	if base.wiper == nil || (stats != nil && stats.Slots <= storageWipeInline) {
+		return false
+	}
+	if marker := base.genMarkerOf(hash[:]); marker != nil && bytes.Compare(hash[:], marker[:common.HashLength]) >= 0 {
+		return false
+	}
+	_, written := bottom.storageData[hash]
+	return !written
+}
+
 // Journal commits an entire diff hierarchy to disk into a single journal entry.
 // This is meant to be used during shutdown to persist the snapshot without
 // flattening everything down (bad for reorgs).
@@ -537,22 +883,125 @@ func (t *Tree) Journal(root common.Hash) (common.Hash, error) {
 	// Retrieve the head snapshot to journal from var snap snapshot
 	snap := t.Snapshot(root)
 	if snap == nil {
-		return common.Hash{}, fmt.Errorf("snapshot [%#x] missing", root)
+		return common.Hash{}, newLayerError(root, ErrSnapshotMissing)
 	}
 	// Run the journaling
 	t.lock.Lock()
 	defer t.lock.Unlock()
 
+	// Ephemeral snapshots are lost on shutdown, don't bother journalling
+	if t.ephemeral {
+		return t.disklayer().root, nil
+	}
+
 	journal := new(bytes.Buffer)
 	base, err := snap.(snapshot).Journal(journal)
 	if err != nil {
 		return common.Hash{}, err
 	}
-	// Store the journal into the database and return
-	rawdb.WriteSnapshotJournal(t.diskdb, journal.Bytes())
+	// Seal the journal if requested, then store it into the database and return
+	blob := journal.Bytes()
+	if t.seal != nil {
+		if blob, err = t.seal.seal(blob); err != nil {
+			return common.Hash{}, fmt.Errorf("failed to seal snapshot journal: %v", err)
+		}
+	}
+	rawdb.WriteSnapshotJournal(t.diskdb, blob)
+
+	// If self-auditing is enabled, read the journal back and verify it. A bad
+	// journal is dropped, falling back to a snapshot rebuild on the next start
+	// instead of loading corrupted layers.
+	if t.audit {
+		blob, err := t.seal.open(rawdb.ReadSnapshotJournal(t.diskdb))
+		if err == nil {
+			err = auditJournal(blob, snap.(snapshot))
+		}
+		if err != nil {
+			log.Error("Snapshot journal audit failed", "root", root, "err", err)
+			rawdb.DeleteSnapshotJournal(t.diskdb)
+			return common.Hash{}, fmt.Errorf("snapshot journal audit failed: %v", err)
+		}
+	}
 	return base, nil
 }
 
+// EnableAudit turns on the self-audit mode, in which every journal written is
+// read back and decoded, verifying that it reproduces the journalled layers.
+// It's meant to catch encoding issues deterministically, at the cost of extra
+// work on shutdown.
+func (t *Tree) EnableAudit() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.audit = true
+}
+
+// EnableStrict turns on the strict mode, in which every subsequent update must
+// carry a block number above the one of its parent, rejecting the layers which
+// would link unrelated chain segments or regress the block ordering.
+func (t *Tree) EnableStrict() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.strict = true
+}
+
+// Verify checks the invariants of the snapshot tree: every layer is indexed by
+// its own root, there's a single disk layer, every diff layer links to an indexed
+// parent on a path ending at the disk layer, and the known block numbers are
+// increasing along the paths. It's meant to be used by tests.
+func (t *Tree) Verify() error {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	var disks int
+	for root, layer := range t.layers {
+		if layer.Root() != root {
+			return fmt.Errorf("layer [%#x] indexed as [%#x]", layer.Root(), root)
+		}
+		if _, ok := layer.(*diskLayer); ok {
+			disks++
+			continue
+		}
+		// Walk the parents down to the disk layer, the path can't be longer than
+		// the number of layers in the tree unless it's cyclic
+		for depth := 0; ; depth++ {
+			if depth == len(t.layers) {
+				return fmt.Errorf("layer [%#x]: %v", root, errSnapshotCycle)
+			}
+			parent := layer.Parent()
+			if parent == nil {
+				break
+			}
+			if t.layers[parent.Root()] != parent {
+				return fmt.Errorf("layer [%#x]: parent [%#x] not indexed", layer.Root(), parent.Root())
+			}
+			if number, parentNumber := layerNumber(layer), layerNumber(parent); number != 0 && parentNumber != 0 && number <= parentNumber {
+				return fmt.Errorf("layer [%#x]: %v: %d <= %d", layer.Root(), ErrNumberRegression, number, parentNumber)
+			}
+			layer = parent
+		}
+		if _, ok := layer.(*diskLayer); !ok {
+			return fmt.Errorf("layer [%#x] not based on a disk layer", root)
+		}
+	}
+	if len(t.layers) > 0 && disks != 1 {
+		return fmt.Errorf("invalid disk layer count: %d", disks)
+	}
+	return nil
+}
+
+// layerNumber returns the block number of a snapshot layer, zero if unknown.
+func layerNumber(layer snapshot) uint64 {
+	switch layer := layer.(type) {
+	case *diffLayer:
+		return layer.number
+	case *diskLayer:
+		return layer.number
+	}
+	return 0
+}
+
 // Rebuild wipes all available snapshot data from the persistent database and
 // discard all caches and diff layers. Afterwards, it starts a new snapshot
 // generator with the given root hash.
@@ -579,6 +1028,12 @@ func (t *Tree) Rebuild(root common.Hash) {
 			// Layer should be inactive now, mark it as stale
 			layer.lock.Lock()
 			layer.stale = true
+			if layer.filter != nil {
+				layer.filter.close()
+			}
+			if layer.wiper != nil {
+				layer.wiper.close()
+			}
 			layer.lock.Unlock()
 
 		case *diffLayer:
@@ -594,8 +1049,46 @@ func (t *Tree) Rebuild(root common.Hash) {
 	// Start generating a new snapshot from scratch on a backgroung thread. The
 	// generator will run a wiper first if there's not one running right now.
 	log.Info("Rebuilding state snapshot")
+	dropStorageWipes(t.diskdb)
+	base := generateSnapshot(t.diskdb, t.triedb, t.cache, root, wiper)
+
+	base.lock.Lock()
+	base.filter = t.newAccountFilter()
+	base.wiper = newStorageWiper(t.diskdb, base.cache)
+	base.lock.Unlock()
+
 	t.layers = map[common.Hash]snapshot{
-		root: generateSnapshot(t.diskdb, t.triedb, t.cache, root, wiper),
+		root: base,
+	}
+}
+
+// Progress is the snapshot wiping and generation progress as checkpointed in
+// the database.
+type Progress struct {
+	Wiping     bool               // Whether the leftovers of a previous snapshot are being wiped
+	WipeMarker []byte             // Database key up to which the leftovers are wiped
+	Done       bool               // Whether the snapshot is fully generated
+	Marker     []byte             // Account (and storage slot) hash up to which the snapshot is generated
+	Accounts   uint64             // Number of accounts generated
+	Slots      uint64             // Number of storage slots generated
+	Storage    common.StorageSize // Total size of the generated accounts and storage slots
+}
+
+// Progress returns the last checkpointed wiping and generation progress of the
+// snapshot, or nil if no checkpoint is available.
+func (t *Tree) Progress() *Progress {
+	progress := loadProgress(t.diskdb)
+	if progress == nil {
+		return nil
+	}
+	return &Progress{
+		Wiping:     progress.Wiping,
+		WipeMarker: progress.WipeMarker,
+		Done:       progress.Done,
+		Marker:     progress.Marker,
+		Accounts:   progress.Accounts,
+		Slots:      progress.Slots,
+		Storage:    common.StorageSize(progress.Storage),
 	}
 }
 
@@ -17,6 +17,8 @@
 package snapshot
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"math/big"
 	"math/rand"
@@ -25,7 +27,10 @@ import (
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 	"github.com/ethereum/go-ethereum/rlp"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 // randomHash generates a random blob of data and returns it as a hash.
@@ -369,3 +374,600 @@ func TestPostCapBasicDataAccess(t *testing.T) {
 		t.Error("expected error capping the disk layer, got none")
 	}
 }
+
+// Tests that capping with a memory budget persists diff layers beyond the layer
+// count until the retained ones fit, but never retains less than the minimum.
+func TestCapMemoryBudget(t *testing.T) {
+	build := func() (*Tree, uint64) {
+		base := &diskLayer{
+			diskdb: rawdb.NewMemoryDatabase(),
+			root:   common.HexToHash("0x01"),
+			cache:  fastcache.New(1024 * 500),
+		}
+		snaps := &Tree{
+			layers: map[common.Hash]snapshot{
+				base.root: base,
+			},
+		}
+		for i := 2; i <= 7; i++ {
+			accounts := map[common.Hash][]byte{
+				common.HexToHash(fmt.Sprintf("0xa%d", i)): randomAccount(),
+			}
+			snaps.Update(common.HexToHash(fmt.Sprintf("0x%02d", i)), common.HexToHash(fmt.Sprintf("0x%02d", i-1)), nil, accounts, nil)
+		}
+		return snaps, snaps.layers[common.HexToHash("0x07")].(*diffLayer).memory
+	}
+	tests := []struct {
+		budget    float64 // Memory budget in units of single layer memory
+		minLayers int
+		want      int // Number of diff layers retained
+	}{
+		{0, 0, 5},   // No budget, layer count honored
+		{10, 0, 5},  // Budget not exceeded
+		{2.5, 0, 2}, // Budget exceeded, persist until it fits
+		{2.5, 3, 3}, // Budget exceeded, minimum retained
+		{0.5, 0, 1}, // Budget too small, only the head retained
+	}
+	for i, tt := range tests {
+		snaps, memory := build()
+		snaps.SetMemoryBudget(uint64(tt.budget*float64(memory)), tt.minLayers)
+
+		if err := snaps.Cap(common.HexToHash("0x07"), 5); err != nil {
+			t.Fatalf("test %d: failed to cap: %v", i, err)
+		}
+		if n := len(snaps.layers) - 1; n != tt.want {
+			t.Errorf("test %d: retained layer count mismatch: have %d, want %d", i, n, tt.want)
+		}
+		if snaps.Snapshot(common.HexToHash("0x07")) == nil {
+			t.Errorf("test %d: head layer missing", i)
+		}
+	}
+}
+
+// Tests that a lowered flush limit persists the accumulator layer as soon as it
+// reaches the limit, instead of waiting for the default threshold.
+func TestCapFlushLimit(t *testing.T) {
+	for _, limit := range []uint64{0, 1} {
+		base := &diskLayer{
+			diskdb: rawdb.NewMemoryDatabase(),
+			root:   common.HexToHash("0x01"),
+			cache:  fastcache.New(1024 * 500),
+		}
+		snaps := &Tree{
+			layers: map[common.Hash]snapshot{
+				base.root: base,
+			},
+		}
+		snaps.SetFlushLimit(limit)
+
+		for i := 2; i <= 5; i++ {
+			accounts := map[common.Hash][]byte{
+				common.HexToHash(fmt.Sprintf("0xa%d", i)): randomAccount(),
+			}
+			snaps.Update(common.HexToHash(fmt.Sprintf("0x%02d", i)), common.HexToHash(fmt.Sprintf("0x%02d", i-1)), nil, accounts, nil)
+			if err := snaps.Cap(common.HexToHash(fmt.Sprintf("0x%02d", i)), 2); err != nil {
+				t.Fatalf("limit %d: failed to cap: %v", limit, err)
+			}
+		}
+		root := snaps.disklayer().Root()
+		switch {
+		case limit == 0 && root != common.HexToHash("0x01"):
+			t.Errorf("default limit: disk layer flushed: have %x", root)
+		case limit != 0 && root != common.HexToHash("0x04"):
+			t.Errorf("limit %d: disk layer mismatch: have %x, want %x", limit, root, common.HexToHash("0x04"))
+		}
+	}
+}
+
+// Tests that the tree operations return the typed errors of the package, and that
+// they are classified with the expected remedies.
+func TestErrorRemedies(t *testing.T) {
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil, nil, nil)
+	snaps.RegisterValidator(func(root common.Hash, parent common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+		return errors.New("invalid")
+	})
+	_, changeErr := snaps.AccountChangeIterator(common.HexToHash("0xff"), common.HexToHash("0x02"))
+
+	tests := []struct {
+		err    error
+		want   error
+		remedy Remedy
+	}{
+		{snaps.Cap(common.HexToHash("0xff"), 0), ErrSnapshotMissing, RemedyFallback},
+		{snaps.Cap(common.HexToHash("0x01"), 0), ErrSnapshotDiskLayer, RemedyFail},
+		{snaps.Update(common.HexToHash("0x03"), common.HexToHash("0xff"), nil, nil, nil), ErrSnapshotMissing, RemedyFallback},
+		{snaps.Update(common.HexToHash("0x03"), common.HexToHash("0x02"), nil, nil, nil), ErrSnapshotRejected, RemedyFail},
+		{changeErr, ErrSnapshotMissing, RemedyFallback},
+		{newNotCoveredError([]byte{0x80}, nil), ErrNotCoveredYet, RemedyFallback},
+		{ErrSnapshotStale, ErrSnapshotStale, RemedyRetry},
+	}
+	for i, tt := range tests {
+		if !errors.Is(tt.err, tt.want) {
+			t.Errorf("test %d: error mismatch: have %v, want %v", i, tt.err, tt.want)
+		}
+		if remedy := RemedyOf(tt.err); remedy != tt.remedy {
+			t.Errorf("test %d: remedy mismatch: have %d, want %d", i, remedy, tt.remedy)
+		}
+	}
+	if remedy := RemedyOf(errors.New("foreign")); remedy != RemedyFail {
+		t.Errorf("foreign error remedy mismatch: have %d, want %d", remedy, RemedyFail)
+	}
+}
+
+// Tests that the width and depth of the snapshot tree are measured correctly.
+func TestTreeShape(t *testing.T) {
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	shape := func() (int, int) {
+		children := make(map[common.Hash][]common.Hash)
+		for root, snap := range snaps.layers {
+			if diff, ok := snap.(*diffLayer); ok {
+				parent := diff.parent.Root()
+				children[parent] = append(children[parent], root)
+			}
+		}
+		return snaps.shape(children)
+	}
+	if width, depth := shape(); width != 1 || depth != 0 {
+		t.Fatalf("empty tree shape mismatch: have %d/%d, want %d/%d", width, depth, 1, 0)
+	}
+	snaps.Update(common.HexToHash("0xa1"), common.HexToHash("0x01"), nil, nil, nil)
+	snaps.Update(common.HexToHash("0xa2"), common.HexToHash("0xa1"), nil, nil, nil)
+	snaps.Update(common.HexToHash("0xb2"), common.HexToHash("0xa1"), nil, nil, nil)
+	snaps.Update(common.HexToHash("0xc2"), common.HexToHash("0xa1"), nil, nil, nil)
+	snaps.Update(common.HexToHash("0xa3"), common.HexToHash("0xa2"), nil, nil, nil)
+	snaps.Update(common.HexToHash("0xa4"), common.HexToHash("0xa3"), nil, nil, nil)
+
+	if width, depth := shape(); width != 3 || depth != 4 {
+		t.Fatalf("forked tree shape mismatch: have %d/%d, want %d/%d", width, depth, 3, 4)
+	}
+}
+
+// Tests that registered validators are consulted before a new diff layer is
+// linked into the tree and that a rejection leaves the tree untouched.
+func TestValidatorRejection(t *testing.T) {
+	// Create an empty base layer and a snapshot tree out of it
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	// Register a validator that forbids touching a specific account
+	frozen := common.HexToHash("0xa1")
+	snaps.RegisterValidator(func(root common.Hash, parent common.Hash, destructs map[common.Hash]struct{}, accounts map[common.Hash][]byte, storage map[common.Hash]map[common.Hash][]byte) error {
+		if _, ok := destructs[frozen]; ok {
+			return fmt.Errorf("account %#x destructed", frozen)
+		}
+		if _, ok := accounts[frozen]; ok {
+			return fmt.Errorf("account %#x modified", frozen)
+		}
+		return nil
+	})
+	if err := snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil, randomAccountSet("0xa1"), nil); err == nil {
+		t.Fatalf("expected rejection, got none")
+	}
+	if n := len(snaps.layers); n != 1 {
+		t.Errorf("layer count mismatch after rejection: have %d, want %d", n, 1)
+	}
+	if err := snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil, randomAccountSet("0xa2"), nil); err != nil {
+		t.Fatalf("failed to create a diff layer: %v", err)
+	}
+	if n := len(snaps.layers); n != 2 {
+		t.Errorf("layer count mismatch after update: have %d, want %d", n, 2)
+	}
+}
+
+// Tests that the strict mode rejects updates regressing the block numbers and
+// that the invariant check catches inconsistent trees.
+func TestStrictUpdates(t *testing.T) {
+	// Create an empty base layer and a strict snapshot tree out of it
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	snaps.EnableStrict()
+
+	if err := snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil, randomAccountSet("0xa1"), nil); err != ErrNumberMissing {
+		t.Fatalf("unnumbered update error mismatch: have %v, want %v", err, ErrNumberMissing)
+	}
+	if err := snaps.UpdateWithNumber(common.HexToHash("0x02"), common.HexToHash("0x01"), 10, nil, randomAccountSet("0xa1"), nil); err != nil {
+		t.Fatalf("failed to create a diff layer: %v", err)
+	}
+	for _, number := range []uint64{9, 10} {
+		if err := snaps.UpdateWithNumber(common.HexToHash("0x03"), common.HexToHash("0x02"), number, nil, randomAccountSet("0xa2"), nil); err != ErrNumberRegression {
+			t.Fatalf("number %d: regression error mismatch: have %v, want %v", number, err, ErrNumberRegression)
+		}
+	}
+	// Block numbers may skip, empty blocks don't create layers
+	if err := snaps.UpdateWithNumber(common.HexToHash("0x03"), common.HexToHash("0x02"), 12, nil, randomAccountSet("0xa2"), nil); err != nil {
+		t.Fatalf("failed to create a diff layer: %v", err)
+	}
+	if err := snaps.Verify(); err != nil {
+		t.Fatalf("valid tree rejected: %v", err)
+	}
+	// Flatten the bottom layer and ensure its number is inherited by the disk
+	if err := snaps.Cap(common.HexToHash("0x03"), 0); err != nil {
+		t.Fatalf("failed to flatten the tree: %v", err)
+	}
+	if err := snaps.UpdateWithNumber(common.HexToHash("0x04"), common.HexToHash("0x03"), 12, nil, randomAccountSet("0xa3"), nil); err != ErrNumberRegression {
+		t.Fatalf("regression onto disk error mismatch: have %v, want %v", err, ErrNumberRegression)
+	}
+	if err := snaps.Verify(); err != nil {
+		t.Fatalf("valid flattened tree rejected: %v", err)
+	}
+	// Corrupt the tree and ensure the invariant check catches it
+	if err := snaps.UpdateWithNumber(common.HexToHash("0x04"), common.HexToHash("0x03"), 13, nil, randomAccountSet("0xa3"), nil); err != nil {
+		t.Fatalf("failed to create a diff layer: %v", err)
+	}
+	snaps.layers[common.HexToHash("0x04")].(*diffLayer).number = 5
+	if err := snaps.Verify(); err == nil {
+		t.Fatalf("number regression not detected")
+	}
+	snaps.layers[common.HexToHash("0x04")].(*diffLayer).number = 13
+	delete(snaps.layers, common.HexToHash("0x03"))
+	if err := snaps.Verify(); err == nil {
+		t.Fatalf("unindexed parent not detected")
+	}
+}
+
+// Tests that the self-audit mode verifies the written journal against the live
+// layers and detects any discrepancy.
+func TestJournalAudit(t *testing.T) {
+	// Create a base layer with a couple of diff layers on top
+	diskdb := rawdb.NewMemoryDatabase()
+	base := &diskLayer{
+		diskdb: diskdb,
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		diskdb: diskdb,
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	snaps.EnableAudit()
+
+	storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, nil)
+	snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil, randomAccountSet("0xa1"), storage)
+	snaps.Update(common.HexToHash("0x03"), common.HexToHash("0x02"), map[common.Hash]struct{}{common.HexToHash("0xa1"): {}}, randomAccountSet("0xa2"), nil)
+
+	if _, err := snaps.Journal(common.HexToHash("0x03")); err != nil {
+		t.Fatalf("failed to journal snapshot: %v", err)
+	}
+	journal := rawdb.ReadSnapshotJournal(diskdb)
+	if len(journal) == 0 {
+		t.Fatalf("audited journal missing")
+	}
+	// Modify a live layer and ensure the journal doesn't pass the audit any more
+	head := snaps.Snapshot(common.HexToHash("0x03")).(*diffLayer)
+	head.accountData[common.HexToHash("0xa2")] = randomAccount()
+
+	if err := auditJournal(journal, head); err == nil {
+		t.Fatalf("mismatching journal passed the audit")
+	}
+}
+
+// Tests that journalling the same layers always produces the same bytes,
+// regardless of the map iteration order.
+func TestJournalDeterministic(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	base := &diskLayer{
+		diskdb: diskdb,
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	var (
+		destructs = make(map[common.Hash]struct{})
+		accounts  = make(map[common.Hash][]byte)
+		storage   = make(map[common.Hash]map[common.Hash][]byte)
+	)
+	for i := 0; i < 32; i++ {
+		destructs[randomHash()] = struct{}{}
+		accounts[randomHash()] = randomAccount()
+
+		slots := make(map[common.Hash][]byte)
+		for j := 0; j < 8; j++ {
+			slots[randomHash()] = randomHash().Bytes()
+		}
+		storage[randomHash()] = slots
+	}
+	head := newDiffLayer(base, common.HexToHash("0x02"), destructs, accounts, storage)
+
+	want := new(bytes.Buffer)
+	if _, err := head.Journal(want); err != nil {
+		t.Fatalf("failed to journal layers: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		have := new(bytes.Buffer)
+		if _, err := head.Journal(have); err != nil {
+			t.Fatalf("failed to journal layers: %v", err)
+		}
+		if !bytes.Equal(have.Bytes(), want.Bytes()) {
+			t.Fatalf("journal %d mismatch", i)
+		}
+	}
+}
+
+// Tests that sealed journals are only loaded with the same secret they were
+// sealed with, and that tampering with them is detected.
+func TestJournalSeal(t *testing.T) {
+	for _, encrypt := range []bool{false, true} {
+		diskdb := rawdb.NewMemoryDatabase()
+		base := &diskLayer{
+			diskdb: diskdb,
+			root:   common.HexToHash("0x01"),
+			cache:  fastcache.New(1024 * 500),
+		}
+		rawdb.WriteSnapshotRoot(diskdb, base.root)
+
+		seal := &JournalSeal{Secret: []byte("node secret"), Encrypt: encrypt}
+		snaps := &Tree{
+			diskdb: diskdb,
+			layers: map[common.Hash]snapshot{
+				base.root: base,
+			},
+			seal:  seal,
+			audit: true,
+		}
+		storage := randomStorageSet([]string{"0xa1"}, [][]string{{"0x01", "0x02"}}, nil)
+		snaps.Update(common.HexToHash("0x02"), common.HexToHash("0x01"), nil, randomAccountSet("0xa1"), storage)
+
+		if _, err := snaps.Journal(common.HexToHash("0x02")); err != nil {
+			t.Fatalf("encrypt %v: failed to journal snapshot: %v", encrypt, err)
+		}
+		journal := rawdb.ReadSnapshotJournal(diskdb)
+		if plain, _ := seal.open(journal); encrypt == bytes.Contains(journal, plain) {
+			t.Errorf("encrypt %v: journal encryption mismatch", encrypt)
+		}
+		// Loading with the same secret should succeed, anything else should fail
+		if _, err := loadSnapshot(diskdb, nil, 1, common.HexToHash("0x02"), seal); err != nil {
+			t.Errorf("encrypt %v: failed to load sealed journal: %v", encrypt, err)
+		}
+		if _, err := loadSnapshot(diskdb, nil, 1, common.HexToHash("0x02"), nil); err != errJournalSealed {
+			t.Errorf("encrypt %v: unsealed load error mismatch: have %v, want %v", encrypt, err, errJournalSealed)
+		}
+		other := &JournalSeal{Secret: []byte("other secret"), Encrypt: encrypt}
+		if _, err := loadSnapshot(diskdb, nil, 1, common.HexToHash("0x02"), other); err != errJournalTampered {
+			t.Errorf("encrypt %v: wrong secret load error mismatch: have %v, want %v", encrypt, err, errJournalTampered)
+		}
+		tampered := common.CopyBytes(journal)
+		tampered[len(tampered)/2] ^= 0x01
+		rawdb.WriteSnapshotJournal(diskdb, tampered)
+		if _, err := loadSnapshot(diskdb, nil, 1, common.HexToHash("0x02"), seal); err != errJournalTampered {
+			t.Errorf("encrypt %v: tampered load error mismatch: have %v, want %v", encrypt, err, errJournalTampered)
+		}
+		// Plain journals must be rejected if a seal is expected
+		plain, _ := seal.open(journal)
+		rawdb.WriteSnapshotJournal(diskdb, plain)
+		if _, err := loadSnapshot(diskdb, nil, 1, common.HexToHash("0x02"), seal); err != errJournalNotSealed {
+			t.Errorf("encrypt %v: plain load error mismatch: have %v, want %v", encrypt, err, errJournalNotSealed)
+		}
+	}
+}
+
+// Tests that an ephemeral snapshot tree is generated synchronously in memory and
+// doesn't journal anything.
+func TestEphemeralSnapshot(t *testing.T) {
+	triedb := trie.NewDatabase(memorydb.New())
+	accTrie, _ := trie.NewSecure(common.Hash{}, triedb)
+	for i := 0; i < 16; i++ {
+		acc := &Account{Balance: big.NewInt(int64(i + 1)), Root: emptyRoot.Bytes(), CodeHash: emptyCode.Bytes()}
+		val, _ := rlp.EncodeToBytes(acc)
+		accTrie.Update([]byte{byte(i)}, val)
+	}
+	root, _ := accTrie.Commit(nil)
+
+	snaps := NewEphemeral(triedb, 16, root)
+	if progress := snaps.Progress(); progress == nil || !progress.Done {
+		t.Fatalf("ephemeral snapshot not generated: %+v", progress)
+	}
+	account, err := snaps.Snapshot(root).Account(crypto.Keccak256Hash([]byte{0x03}))
+	if err != nil || account == nil || account.Balance.Cmp(big.NewInt(4)) != 0 {
+		t.Fatalf("account mismatch: have %v (err %v), want balance %d", account, err, 4)
+	}
+	// Stack a diff on top and ensure journalling is a noop
+	if err := snaps.Update(common.HexToHash("0x02"), root, nil, randomAccountSet("0xa1"), nil); err != nil {
+		t.Fatalf("failed to update snapshot tree: %v", err)
+	}
+	base, err := snaps.Journal(common.HexToHash("0x02"))
+	if err != nil {
+		t.Fatalf("failed to journal snapshot: %v", err)
+	}
+	if base != root {
+		t.Fatalf("journal base mismatch: have %x, want %x", base, root)
+	}
+	if journal := rawdb.ReadSnapshotJournal(snaps.diskdb); len(journal) != 0 {
+		t.Fatalf("ephemeral snapshot journalled")
+	}
+}
+
+// Tests that the snapshot generation is checkpointed and resumed precisely from
+// the checkpoint if the journal is not available.
+func TestGeneratorResume(t *testing.T) {
+	var (
+		diskdb = memorydb.New()
+		triedb = trie.NewDatabase(memorydb.New())
+	)
+	accTrie, _ := trie.NewSecure(common.Hash{}, triedb)
+	for i := 0; i < 16; i++ {
+		acc := &Account{Balance: big.NewInt(int64(i + 1)), Root: emptyRoot.Bytes(), CodeHash: emptyCode.Bytes()}
+		val, _ := rlp.EncodeToBytes(acc)
+		accTrie.Update([]byte{byte(i)}, val)
+	}
+	root, _ := accTrie.Commit(nil)
+
+	// Generate the snapshot, the completion should be checkpointed
+	snaps := &Tree{
+		diskdb: diskdb,
+		triedb: triedb,
+		cache:  16,
+		layers: map[common.Hash]snapshot{
+			root: generateSnapshot(diskdb, triedb, 16, root, nil),
+		},
+	}
+	snaps.waitBuild()
+
+	progress := snaps.Progress()
+	if progress == nil || !progress.Done || progress.Accounts != 16 {
+		t.Fatalf("generation checkpoint mismatch: %+v", progress)
+	}
+	// Rewind the checkpoint into the middle of the generation and inject an
+	// entry before the marker which is removed by a fresh regeneration only
+	it := snaps.layers[root].(*diskLayer).AccountIterator(common.Hash{})
+	for i := 0; i < 8; i++ {
+		it.Next()
+	}
+	marker := it.Hash()
+	it.Release()
+
+	bogus := common.Hash{}
+	rawdb.WriteAccountSnapshot(diskdb, bogus, randomAccount())
+	writeProgress(diskdb, &journalProgress{Marker: marker[:], Accounts: 8})
+
+	// Reopen the snapshot without journal, the generation should be resumed
+	snaps = New(diskdb, triedb, 16, root, false)
+	if blob := rawdb.ReadAccountSnapshot(diskdb, bogus); len(blob) == 0 {
+		t.Fatalf("snapshot regenerated instead of resumed")
+	}
+	if progress = snaps.Progress(); progress == nil || !progress.Done || progress.Accounts != 16 {
+		t.Fatalf("generation checkpoint mismatch: %+v", progress)
+	}
+}
+
+// Tests that a sharded snapshot generation is checkpointed per shard and only the
+// unfinished shards are resumed if the journal is not available.
+func TestShardedGeneratorResume(t *testing.T) {
+	var (
+		diskdb = memorydb.New()
+		triedb = trie.NewDatabase(memorydb.New())
+	)
+	accTrie, _ := trie.NewSecure(common.Hash{}, triedb)
+	for i := 0; i < 64; i++ {
+		acc := &Account{Balance: big.NewInt(int64(i + 1)), Root: emptyRoot.Bytes(), CodeHash: emptyCode.Bytes()}
+		val, _ := rlp.EncodeToBytes(acc)
+		accTrie.Update([]byte{byte(i)}, val)
+	}
+	root, _ := accTrie.Commit(nil)
+
+	// Generate the snapshot on shards, the completion should be checkpointed
+	snaps := &Tree{
+		diskdb: diskdb,
+		triedb: triedb,
+		cache:  16,
+		layers: map[common.Hash]snapshot{
+			root: generateSnapshot(diskdb, triedb, 16, root, nil),
+		},
+	}
+	snaps.waitBuild()
+
+	if progress := snaps.Progress(); progress == nil || !progress.Done || progress.Accounts != 64 {
+		t.Fatalf("generation checkpoint mismatch: %+v", progress)
+	}
+	// Rewind the checkpoint to only the first shard being done and inject an
+	// entry into it which is removed by a fresh regeneration only
+	var (
+		shards = make([][]byte, generatorShards)
+		done   uint64
+		bogus  = common.Hash{}
+	)
+	for i := range shards {
+		shards[i] = []byte{}
+	}
+	shards[0] = shardDone(0, generatorShards)
+
+	it := snaps.layers[root].(*diskLayer).AccountIterator(common.Hash{})
+	for it.Next() && shardOf(it.Hash().Bytes(), generatorShards) == 0 {
+		done++
+	}
+	it.Release()
+
+	rawdb.WriteAccountSnapshot(diskdb, bogus, randomAccount())
+	writeProgress(diskdb, &journalProgress{Marker: []byte{}, Shards: shards, Accounts: done})
+
+	// Reopen the snapshot without journal, the pending shards should be resumed
+	snaps = New(diskdb, triedb, 16, root, false)
+	if blob := rawdb.ReadAccountSnapshot(diskdb, bogus); len(blob) == 0 {
+		t.Fatalf("done shard regenerated")
+	}
+	if progress := snaps.Progress(); progress == nil || !progress.Done || progress.Accounts != 64 {
+		t.Fatalf("generation checkpoint mismatch: %+v", progress)
+	}
+}
+
+// Tests that the snapshot tree indexes can be rebuilt from the layers if they
+// get out of sync.
+func TestRebuildIndexes(t *testing.T) {
+	base := &diskLayer{
+		diskdb: rawdb.NewMemoryDatabase(),
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	// Create a small tree with two branches
+	for i, link := range [][2]string{{"0x02", "0x01"}, {"0x03", "0x02"}, {"0x04", "0x03"}, {"0x05", "0x02"}} {
+		accounts := randomAccountSet(fmt.Sprintf("0xa%d", i))
+		if err := snaps.Update(common.HexToHash(link[0]), common.HexToHash(link[1]), nil, accounts, nil); err != nil {
+			t.Fatalf("failed to create diff layer %s: %v", link[0], err)
+		}
+	}
+	if err := snaps.CheckInvariants(); err != nil {
+		t.Fatalf("invariants violated on a healthy tree: %v", err)
+	}
+	// Drop an intermediate layer from the lookup and inject an orphaned stale one
+	stale := snaps.layers[common.HexToHash("0x05")].(*diffLayer)
+	delete(snaps.layers, common.HexToHash("0x03"))
+	orphan := newDiffLayer(stale, common.HexToHash("0x06"), nil, randomAccountSet("0xa9"), nil)
+	snaps.layers[orphan.root] = orphan
+	stale.stale = 1
+
+	if err := snaps.CheckInvariants(); err == nil {
+		t.Fatalf("invariants held on a corrupted tree")
+	}
+	result, err := snaps.RebuildIndexes()
+	if err != nil {
+		t.Fatalf("failed to rebuild indexes: %v", err)
+	}
+	if want := (RepairResult{Layers: 4, Restored: 1, Dropped: 2}); *result != want {
+		t.Fatalf("repair result mismatch: have %+v, want %+v", *result, want)
+	}
+	if err := snaps.CheckInvariants(); err != nil {
+		t.Fatalf("invariants violated after repair: %v", err)
+	}
+	if snaps.Snapshot(common.HexToHash("0x03")) == nil {
+		t.Fatalf("dropped layer not restored")
+	}
+}
@@ -18,6 +18,7 @@ package snapshot
 
 import (
 	"bytes"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 )
@@ -34,3 +35,34 @@ func (hs hashes) Less(i, j int) bool { return bytes.Compare(hs[i][:], hs[j][:])
 
 // Swap swaps the elements with indexes i and j.
 func (hs hashes) Swap(i, j int) { hs[i], hs[j] = hs[j], hs[i] }
+
+// SortedDestructs returns the hashes of the destructed accounts in ascending order.
+func SortedDestructs(destructs map[common.Hash]struct{}) []common.Hash {
+	list := make([]common.Hash, 0, len(destructs))
+	for hash := range destructs {
+		list = append(list, hash)
+	}
+	sort.Sort(hashes(list))
+	return list
+}
+
+// SortedKeys returns the keys of an account or storage slot set in ascending order.
+func SortedKeys(data map[common.Hash][]byte) []common.Hash {
+	list := make([]common.Hash, 0, len(data))
+	for hash := range data {
+		list = append(list, hash)
+	}
+	sort.Sort(hashes(list))
+	return list
+}
+
+// SortedStorageAccounts returns the hashes of the accounts with modified storage
+// in ascending order.
+func SortedStorageAccounts(storage map[common.Hash]map[common.Hash][]byte) []common.Hash {
+	list := make([]common.Hash, 0, len(storage))
+	for hash := range storage {
+		list = append(list, hash)
+	}
+	sort.Sort(hashes(list))
+	return list
+}
@@ -18,8 +18,11 @@ package snapshot
 
 import (
 	"bytes"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -52,13 +55,42 @@ func wipeSnapshot(db ethdb.KeyValueStore, full bool) chan struct{} {
 // as the wiper is meant to run on a background thread but the root needs to be
 // removed in sync to avoid data races. After all is done, the snapshot range of
 // the database is compacted to free up unused data blocks.
+//
+// The wiping progress is checkpointed in the database, if a previous wipe was
+// interrupted, it's resumed from the last checkpoint instead of from scratch.
 func wipeContent(db ethdb.KeyValueStore) error {
-	if err := wipeKeyRange(db, "accounts", rawdb.SnapshotAccountPrefix, len(rawdb.SnapshotAccountPrefix)+common.HashLength); err != nil {
-		return err
+	var marker []byte
+	if progress := loadProgress(db); progress != nil && progress.Wiping {
+		marker = progress.WipeMarker
 	}
-	if err := wipeKeyRange(db, "storage", rawdb.SnapshotStoragePrefix, len(rawdb.SnapshotStoragePrefix)+2*common.HashLength); err != nil {
-		return err
+	ranges := []struct {
+		kind   string
+		prefix []byte
+		keylen int
+	}{
+		{"accounts", rawdb.SnapshotAccountPrefix, len(rawdb.SnapshotAccountPrefix) + common.HashLength},
+		{"storage", rawdb.SnapshotStoragePrefix, len(rawdb.SnapshotStoragePrefix) + 2*common.HashLength},
+		{"stats", rawdb.SnapshotStatsPrefix, len(rawdb.SnapshotStatsPrefix) + common.HashLength},
+	}
+	// Skip all the ranges already wiped before the checkpoint
+	for i, r := range ranges {
+		if bytes.HasPrefix(marker, r.prefix) {
+			ranges = ranges[i:]
+			break
+		}
 	}
+	for _, r := range ranges {
+		var start []byte
+		if bytes.HasPrefix(marker, r.prefix) {
+			start = marker[len(r.prefix):]
+		}
+		if err := wipeKeyRange(db, r.kind, r.prefix, start, r.keylen); err != nil {
+			return err
+		}
+	}
+	// Everything wiped, drop the checkpoint of the wiping
+	rawdb.DeleteSnapshotGenerator(db)
+
 	// Compact the snapshot section of the database to get rid of unused space
 	start := time.Now()
 
@@ -82,17 +114,18 @@ func wipeContent(db ethdb.KeyValueStore) error {
 }
 
 // wipeKeyRange deletes a range of keys from the database starting with prefix
-// and having a specific total key length.
-func wipeKeyRange(db ethdb.KeyValueStore, kind string, prefix []byte, keylen int) error {
+// and having a specific total key length. The deletion starts at the given
+// position within the range, checkpointing the progress along the way.
+func wipeKeyRange(db ethdb.KeyValueStore, kind string, prefix []byte, start []byte, keylen int) error {
 	// Batch deletions together to avoid holding an iterator for too long
 	var (
 		batch = db.NewBatch()
 		items int
 	)
 	// Iterate over the key-range and delete all of them
-	start, logged := time.Now(), time.Now()
+	begin, logged := time.Now(), time.Now()
 
-	it := db.NewIterator(prefix, nil)
+	it := db.NewIterator(prefix, start)
 	for it.Next() {
 		// Skip any keys with the correct prefix but wrong length (trie nodes)
 		key := it.Key()
@@ -108,6 +141,7 @@ func wipeKeyRange(db ethdb.KeyValueStore, kind string, prefix []byte, keylen int
 
 		if items%10000 == 0 {
 			// Batch too large (or iterator too long lived, flush and recreate)
+			writeProgress(batch, &journalProgress{Wiping: true, WipeMarker: key})
 			it.Release()
 			if err := batch.Write(); err != nil {
 				return err
@@ -117,7 +151,7 @@ func wipeKeyRange(db ethdb.KeyValueStore, kind string, prefix []byte, keylen int
 			it = db.NewIterator(prefix, seekPos)
 
 			if time.Since(logged) > 8*time.Second {
-				log.Info("Deleting state snapshot leftovers", "kind", kind, "wiped", items, "elapsed", common.PrettyDuration(time.Since(start)))
+				log.Info("Deleting state snapshot leftovers", "kind", kind, "wiped", items, "elapsed", common.PrettyDuration(time.Since(begin)))
 				logged = time.Now()
 			}
 		}
@@ -126,6 +160,188 @@ func wipeKeyRange(db ethdb.KeyValueStore, kind string, prefix []byte, keylen int
 	if err := batch.Write(); err != nil {
 		return err
 	}
-	log.Info("Deleted state snapshot leftovers", "kind", kind, "wiped", items, "elapsed", common.PrettyDuration(time.Since(start)))
+	log.Info("Deleted state snapshot leftovers", "kind", kind, "wiped", items, "elapsed", common.PrettyDuration(time.Since(begin)))
 	return nil
 }
+
+// storageWipeBatch is the number of storage slots the background storage wiper
+// deletes in one go, before releasing the database iterator and yielding to any
+// waiting foreground deletion.
+const storageWipeBatch = 10000
+
+// storageWipeInline is the maximum number of storage slots of a destructed
+// account which are deleted inline when flattening into the disk layer. Larger
+// storages are scheduled for deletion in the background.
+var storageWipeInline = uint64(10000)
+
+// storageWiper deletes the persisted storage of destructed accounts from the
+// snapshot in the background, so flattening a layer doesn't need to delete a
+// potentially enormous number of slots inline.
+//
+// Accounts scheduled for wiping are treated by the disk layer as having no
+// storage at all. The schedule is persisted in the database alongside the
+// account deletions, so an interrupted wipe is resumed after a restart.
+//
+// The wiper is shared by the successive disk layers. Accounts are only ever
+// scheduled when they are fully covered by the generator and don't have any
+// storage written in the same flattening; if a later flattening writes storage
+// for an account still being wiped, the wipe is finished synchronously first.
+type storageWiper struct {
+	diskdb ethdb.KeyValueStore // Key-value store containing the base snapshot
+	cache  *fastcache.Cache    // Clean cache of the disk layers to evict the wiped slots from
+
+	pending map[common.Hash]struct{} // Accounts whose storage is scheduled for deletion
+	running bool                     // Flag whether the background deleter is running
+	closed  uint32                   // Flag whether the wiper is discarded (atomic)
+
+	lock  sync.RWMutex   // Lock protecting the schedule
+	wipe  sync.Mutex     // Lock serializing the deletions
+	group sync.WaitGroup // Tracker for the background deleter
+}
+
+// newStorageWiper creates a storage wiper, resuming any deletion scheduled in
+// the database previously.
+func newStorageWiper(diskdb ethdb.KeyValueStore, cache *fastcache.Cache) *storageWiper {
+	wiper := &storageWiper{
+		diskdb:  diskdb,
+		cache:   cache,
+		pending: make(map[common.Hash]struct{}),
+	}
+	if hashes := rawdb.ReadStorageWipes(diskdb); len(hashes) > 0 {
+		log.Info("Resuming snapshot storage wipes", "accounts", len(hashes))
+		wiper.schedule(hashes)
+	}
+	return wiper
+}
+
+// schedule marks the storage of the given accounts for deletion and starts the
+// background deleter if it's not running yet. The schedule must already be
+// persisted into the database.
+func (w *storageWiper) schedule(hashes []common.Hash) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	for _, hash := range hashes {
+		w.pending[hash] = struct{}{}
+	}
+	if !w.running && len(w.pending) > 0 && atomic.LoadUint32(&w.closed) == 0 {
+		w.running = true
+		w.group.Add(1)
+		go w.loop()
+	}
+}
+
+// wiping reports whether the storage of the account is scheduled for deletion.
+func (w *storageWiper) wiping(hash common.Hash) bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+
+	_, ok := w.pending[hash]
+	return ok
+}
+
+// loop deletes the scheduled storages one batch at a time until none is left
+// or the wiper is discarded.
+func (w *storageWiper) loop() {
+	defer w.group.Done()
+
+	for {
+		w.lock.Lock()
+		if len(w.pending) == 0 || atomic.LoadUint32(&w.closed) == 1 {
+			w.running = false
+			w.lock.Unlock()
+			return
+		}
+		var hash common.Hash
+		for hash = range w.pending {
+			break
+		}
+		w.lock.Unlock()
+
+		if err := w.delete(hash, storageWipeBatch); err != nil {
+			log.Error("Failed to wipe snapshot storage", "account", hash, "err", err) // Database close will trigger this
+			w.lock.Lock()
+			w.running = false
+			w.lock.Unlock()
+			return
+		}
+	}
+}
+
+// finish synchronously deletes all the remaining storage of the account if it's
+// scheduled for deletion.
+func (w *storageWiper) finish(hash common.Hash) {
+	if err := w.delete(hash, 0); err != nil {
+		log.Crit("Failed to wipe snapshot storage", "account", hash, "err", err)
+	}
+}
+
+// delete removes at most limit storage slots of the account from the database,
+// zero meaning no limit. If no slots are left, the account is unscheduled.
+func (w *storageWiper) delete(hash common.Hash, limit int) error {
+	w.wipe.Lock()
+	defer w.wipe.Unlock()
+
+	if !w.wiping(hash) {
+		return nil
+	}
+	var (
+		batch = w.diskdb.NewBatch()
+		items int
+		done  = true
+	)
+	it := rawdb.IterateStorageSnapshots(w.diskdb, hash)
+	for it.Next() {
+		key := it.Key()
+		if len(key) != len(rawdb.SnapshotStoragePrefix)+2*common.HashLength {
+			continue
+		}
+		batch.Delete(key)
+		w.cache.Del(key[len(rawdb.SnapshotStoragePrefix):])
+		items++
+
+		if limit > 0 && items >= limit {
+			done = false
+			break
+		}
+		if batch.ValueSize() > ethdb.IdealBatchSize {
+			if err := batch.Write(); err != nil {
+				it.Release()
+				return err
+			}
+			batch.Reset()
+		}
+	}
+	it.Release()
+	if err := it.Error(); err != nil {
+		return err
+	}
+	if done {
+		rawdb.DeleteStorageWipe(batch, hash)
+	}
+	if err := batch.Write(); err != nil {
+		return err
+	}
+	snapshotWipeStorageItemMeter.Mark(int64(items))
+	if done {
+		w.lock.Lock()
+		delete(w.pending, hash)
+		w.lock.Unlock()
+	}
+	return nil
+}
+
+// close discards the wiper, waiting for the background deleter to terminate.
+// The schedule persisted in the database is left intact.
+func (w *storageWiper) close() {
+	atomic.StoreUint32(&w.closed, 1)
+	w.group.Wait()
+}
+
+// dropStorageWipes removes all the scheduled storage deletions from the database,
+// used when the entire snapshot is being wiped anyway.
+func dropStorageWipes(db ethdb.KeyValueStore) {
+	for _, hash := range rawdb.ReadStorageWipes(db) {
+		rawdb.DeleteStorageWipe(db, hash)
+	}
+}
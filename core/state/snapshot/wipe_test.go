@@ -19,7 +19,9 @@ package snapshot
 import (
 	"math/rand"
 	"testing"
+	"time"
 
+	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
@@ -122,3 +124,137 @@ func TestWipe(t *testing.T) {
 		t.Fatalf("misc item count mismatch: have %d, want %d", items, 65536)
 	}
 }
+
+// Tests that an interrupted wipe is resumed from the persisted checkpoint
+// instead of being restarted from scratch.
+func TestWipeResume(t *testing.T) {
+	db := memorydb.New()
+
+	account := common.Hash{0x1}
+	rawdb.WriteAccountSnapshot(db, account, randomHash().Bytes())
+	for i := 0; i < 16; i++ {
+		rawdb.WriteStorageSnapshot(db, account, common.Hash{byte(i)}, randomHash().Bytes())
+	}
+	// Checkpoint the wipe in the middle of the storage range, the accounts are
+	// regarded as wiped already
+	marker := append(append(common.CopyBytes(rawdb.SnapshotStoragePrefix), account[:]...), common.Hash{0x8}.Bytes()...)
+	writeProgress(db, &journalProgress{Wiping: true, WipeMarker: marker})
+
+	if err := wipeContent(db); err != nil {
+		t.Fatalf("failed to wipe snapshot: %v", err)
+	}
+	if blob := rawdb.ReadAccountSnapshot(db, account); len(blob) == 0 {
+		t.Errorf("account wiped before the checkpoint")
+	}
+	for i := 0; i < 16; i++ {
+		blob := rawdb.ReadStorageSnapshot(db, account, common.Hash{byte(i)})
+		if wiped := len(blob) == 0; wiped != (i >= 8) {
+			t.Errorf("slot %d: wipe mismatch: have %v, want %v", i, wiped, i >= 8)
+		}
+	}
+	if progress := loadProgress(db); progress != nil {
+		t.Errorf("wipe checkpoint remained after wipe: %v", progress)
+	}
+}
+
+// Tests that the storage of destructed accounts is wiped in the background if
+// it's large, while being hidden from the disk layer straight away.
+func TestStorageWipe(t *testing.T) {
+	defer func(limit uint64) { storageWipeInline = limit }(storageWipeInline)
+	storageWipeInline = 8
+
+	var (
+		db     = rawdb.NewMemoryDatabase()
+		large  = common.HexToHash("0xa1")
+		small  = common.HexToHash("0xa2")
+		reborn = common.HexToHash("0xa3")
+	)
+	for _, account := range []common.Hash{large, small, reborn} {
+		slots := 4
+		if account != small {
+			slots = 3 * storageWipeBatch
+		}
+		rawdb.WriteAccountSnapshot(db, account, randomAccount())
+		for i := 0; i < slots; i++ {
+			rawdb.WriteStorageSnapshot(db, account, randomHash(), randomHash().Bytes())
+		}
+		rawdb.WriteStorageStats(db, account, &rawdb.StorageStats{Slots: uint64(slots)})
+	}
+	base := &diskLayer{
+		diskdb: db,
+		root:   common.HexToHash("0x01"),
+		cache:  fastcache.New(1024 * 500),
+	}
+	base.wiper = newStorageWiper(db, base.cache)
+	snaps := &Tree{
+		layers: map[common.Hash]snapshot{
+			base.root: base,
+		},
+	}
+	// Destruct all the accounts, resurrecting one with fresh storage
+	destructs := map[common.Hash]struct{}{large: {}, small: {}, reborn: {}}
+	accounts := map[common.Hash][]byte{reborn: randomAccount()}
+	storage := map[common.Hash]map[common.Hash][]byte{reborn: {common.HexToHash("0x01"): []byte{0x01}}}
+
+	if err := snaps.Update(common.HexToHash("0x02"), base.root, destructs, accounts, storage); err != nil {
+		t.Fatalf("failed to create diff layer: %v", err)
+	}
+	if err := snaps.Cap(common.HexToHash("0x02"), 0); err != nil {
+		t.Fatalf("failed to flatten layers: %v", err)
+	}
+	disk := snaps.disklayer()
+
+	// The small and the resurrected storage must be wiped inline, the large one
+	// must be hidden until it's wiped in the background
+	if n := countStorage(db, small, nil).Slots; n != 0 {
+		t.Errorf("small storage not wiped inline: %d slots left", n)
+	}
+	if n := countStorage(db, reborn, nil).Slots; n != 1 {
+		t.Errorf("resurrected storage slot count mismatch: have %d, want %d", n, 1)
+	}
+	it, _ := disk.StorageIterator(large, common.Hash{})
+	if it.Next() {
+		t.Errorf("storage being wiped is iterable")
+	}
+	it.Release()
+
+	for start := time.Now(); disk.wiper.wiping(large); {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("background wipe timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := countStorage(db, large, nil).Slots; n != 0 {
+		t.Errorf("large storage not wiped: %d slots left", n)
+	}
+	if wipes := rawdb.ReadStorageWipes(db); len(wipes) != 0 {
+		t.Errorf("stale wipe schedule left: %x", wipes)
+	}
+}
+
+// Tests that a scheduled storage wipe is resumed after a restart, and finished
+// synchronously if the account gets new storage in the meantime.
+func TestStorageWipeResume(t *testing.T) {
+	var (
+		db      = rawdb.NewMemoryDatabase()
+		account = common.HexToHash("0xa1")
+	)
+	for i := 0; i < 2*storageWipeBatch; i++ {
+		rawdb.WriteStorageSnapshot(db, account, randomHash(), randomHash().Bytes())
+	}
+	rawdb.WriteStorageWipe(db, account)
+
+	wiper := newStorageWiper(db, fastcache.New(1024*500))
+	wiper.finish(account)
+
+	if wiper.wiping(account) {
+		t.Fatalf("account still scheduled after finishing")
+	}
+	if n := countStorage(db, account, nil).Slots; n != 0 {
+		t.Errorf("storage not wiped: %d slots left", n)
+	}
+	if wipes := rawdb.ReadStorageWipes(db); len(wipes) != 0 {
+		t.Errorf("stale wipe schedule left: %x", wipes)
+	}
+	wiper.close()
+}
@@ -0,0 +1,80 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"errors"
+
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	snapshotFallbackNotCoveredMeter = metrics.NewRegisteredMeter("state/snapshot/fallback/notcovered", nil)
+	snapshotFallbackStaleMeter      = metrics.NewRegisteredMeter("state/snapshot/fallback/stale", nil)
+	snapshotFallbackMissingMeter    = metrics.NewRegisteredMeter("state/snapshot/fallback/missing", nil)
+)
+
+// SnapshotFallbacks is the summary of the state reads which should have been
+// served by the snapshot but fell back to the much slower tries, classified by
+// the reason of the fallback.
+type SnapshotFallbacks struct {
+	Reads      int // Number of account and storage reads which should have hit the snapshot
+	NotCovered int // Fallbacks due to the snapshot generation not reaching the item yet
+	Stale      int // Fallbacks due to the snapshot layer becoming stale
+	Missing    int // Fallbacks due to the snapshot layer being unavailable or failing
+}
+
+// Total returns the total number of fallbacks.
+func (f SnapshotFallbacks) Total() int {
+	return f.NotCovered + f.Stale + f.Missing
+}
+
+// Rate returns the fraction of the reads which fell back to the tries.
+func (f SnapshotFallbacks) Rate() float64 {
+	if f.Reads == 0 {
+		return 0
+	}
+	return float64(f.Total()) / float64(f.Reads)
+}
+
+// SnapshotFallbacks returns the summary of the reads which fell back from the
+// snapshot to the tries since the state was created. If snapshots are disabled
+// altogether, nothing is tracked.
+func (s *StateDB) SnapshotFallbacks() SnapshotFallbacks {
+	return s.snapFallbacks
+}
+
+// trackSnapshotRead records the outcome of a state read which should have been
+// served by the snapshot, nil meaning no fallback was needed. A missing snapshot
+// layer is tracked as snapshot.ErrSnapshotMissing.
+func (s *StateDB) trackSnapshotRead(err error) {
+	s.snapFallbacks.Reads++
+
+	switch {
+	case err == nil:
+	case errors.Is(err, snapshot.ErrNotCoveredYet):
+		s.snapFallbacks.NotCovered++
+		snapshotFallbackNotCoveredMeter.Mark(1)
+	case errors.Is(err, snapshot.ErrSnapshotStale):
+		s.snapFallbacks.Stale++
+		snapshotFallbackStaleMeter.Mark(1)
+	default:
+		s.snapFallbacks.Missing++
+		snapshotFallbackMissingMeter.Mark(1)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"bytes"
+	"fmt"
+	"math/big"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// AccountState is the image of an account at a point of the execution, limited
+// to the storage slots accessed.
+type AccountState struct {
+	Balance *big.Int
+	Nonce   uint64
+	Code    []byte
+	Storage map[common.Hash]common.Hash
+}
+
+// copy returns a deep copy of the account image.
+func (a *AccountState) copy() *AccountState {
+	if a == nil {
+		return nil
+	}
+	cpy := &AccountState{
+		Balance: new(big.Int).Set(a.Balance),
+		Nonce:   a.Nonce,
+		Code:    a.Code,
+		Storage: make(map[common.Hash]common.Hash, len(a.Storage)),
+	}
+	for key, value := range a.Storage {
+		cpy.Storage[key] = value
+	}
+	return cpy
+}
+
+// StateDiff contains the images of all the accounts and storage slots accessed
+// since the tracking started, before and after the execution. Non-existent
+// accounts are represented by nil images.
+//
+// Accounts destructed (or otherwise overwritten) and created anew are listed in
+// Reset (nil if none), since their storage is wiped: the slots missing from the
+// post image are empty, not unchanged.
+type StateDiff struct {
+	Pre   map[common.Address]*AccountState
+	Post  map[common.Address]*AccountState
+	Reset map[common.Address]struct{}
+}
+
+// TrackStateDiff starts (or restarts) recording the pre-images of the accounts
+// and storage slots accessed, usually at the start of a transaction. The state
+// diff of the execution since is returned by StateDiff.
+func (s *StateDB) TrackStateDiff() {
+	s.diffPre = make(map[common.Address]*AccountState)
+	s.diffSlots = make(map[common.Address]map[common.Hash]struct{})
+	s.diffReset = make(map[*stateObject]struct{})
+	s.diffOrigin = make(map[common.Address]*stateObject)
+}
+
+// StateDiff returns the pre and post images of all the accounts and storage
+// slots accessed since TrackStateDiff was called, nil if no tracking is active.
+// The post images reflect the current state, including uncommitted changes.
+func (s *StateDB) StateDiff() *StateDiff {
+	if s.diffPre == nil {
+		return nil
+	}
+	diff := &StateDiff{
+		Pre:  make(map[common.Address]*AccountState, len(s.diffPre)),
+		Post: make(map[common.Address]*AccountState, len(s.diffPre)),
+	}
+	for addr, pre := range s.diffPre {
+		diff.Pre[addr] = pre.copy()
+
+		obj := s.stateObjects[addr]
+		if obj == nil || obj.deleted {
+			diff.Post[addr] = nil
+			continue
+		}
+		// Reverted creations restore the previous object, so only the resets of
+		// the live objects count
+		if _, ok := s.diffReset[obj]; ok {
+			if diff.Reset == nil {
+				diff.Reset = make(map[common.Address]struct{})
+			}
+			diff.Reset[addr] = struct{}{}
+		}
+		post := s.accountImage(obj)
+		for key := range s.diffSlots[addr] {
+			post.Storage[key] = obj.GetState(s.db, key)
+		}
+		diff.Post[addr] = post
+	}
+	return diff
+}
+
+// accountImage returns the image of an account without any storage slots.
+func (s *StateDB) accountImage(obj *stateObject) *AccountState {
+	return &AccountState{
+		Balance: new(big.Int).Set(obj.Balance()),
+		Nonce:   obj.Nonce(),
+		Code:    obj.Code(s.db),
+		Storage: make(map[common.Hash]common.Hash),
+	}
+}
+
+// recordAccount records the pre-image of an account the first time it's accessed
+// while the state diff is tracked. Deleted and missing objects are recorded as
+// non-existent accounts.
+func (s *StateDB) recordAccount(addr common.Address, obj *stateObject) {
+	if _, ok := s.diffPre[addr]; ok {
+		return
+	}
+	if obj == nil || obj.deleted {
+		s.diffPre[addr] = nil
+		return
+	}
+	s.diffPre[addr] = s.accountImage(obj)
+	s.diffOrigin[addr] = obj
+}
+
+// recordSlot records the pre-image of a storage slot the first time it's accessed
+// while the state diff is tracked. The account must already be recorded.
+//
+// The slot is read from the object the account pre-image was taken from, not the
+// live one: the account might have been created anew since (CreateAccount or
+// CREATE2 over an existing account), wiping its storage. The original object is
+// only replaced, not modified, and all earlier writes to the slot recorded it.
+func (s *StateDB) recordSlot(addr common.Address, key common.Hash) {
+	slots := s.diffSlots[addr]
+	if slots == nil {
+		slots = make(map[common.Hash]struct{})
+		s.diffSlots[addr] = slots
+	}
+	if _, ok := slots[key]; ok {
+		return
+	}
+	slots[key] = struct{}{}
+
+	// Non-existent accounts have no storage, their pre-image has no slots
+	if pre := s.diffPre[addr]; pre != nil {
+		pre.Storage[key] = s.diffOrigin[addr].GetState(s.db, key)
+	}
+}
+
+// ApplyStateDiff computes the root of the state resulting from applying the post
+// images of the diff on top of the state at root, without writing anything into
+// the database. The state is modified in memory only and discarded afterwards,
+// so it's safe to use for validating state updates proposed by third parties
+// (e.g. external block builders) before executing or importing them.
+//
+// The post images are applied as partial updates: the balance, nonce and code of
+// the account are overwritten along with the listed storage slots, the rest of
+// the storage is left as is, unless the account is listed as reset, in which
+// case it's created anew with empty storage first. Accounts with nil post images
+// are deleted, hence the diff must be taken after finalising the state, as
+// self-destructed accounts are only deleted (and imaged as nil) by then.
+func ApplyStateDiff(db Database, root common.Hash, diff *StateDiff, deleteEmptyObjects bool) (common.Hash, error) {
+	state, err := New(root, db, nil)
+	if err != nil {
+		return common.Hash{}, err
+	}
+	for addr, post := range diff.Post {
+		if post == nil {
+			state.Suicide(addr)
+			continue
+		}
+		if _, ok := diff.Reset[addr]; ok {
+			state.CreateAccount(addr)
+		}
+		state.SetBalance(addr, post.Balance)
+		state.SetNonce(addr, post.Nonce)
+		if !bytes.Equal(state.GetCode(addr), post.Code) {
+			state.SetCode(addr, post.Code)
+		}
+		for key, value := range post.Storage {
+			state.SetState(addr, key, value)
+		}
+	}
+	newRoot := state.IntermediateRoot(deleteEmptyObjects)
+	if err := state.Error(); err != nil {
+		return common.Hash{}, err
+	}
+	return newRoot, nil
+}
+
+// VerifyStateDiff checks whether applying the post images of the diff on top of
+// the state at root results in the expected root. Nothing is written into the
+// database, see ApplyStateDiff.
+func VerifyStateDiff(db Database, root common.Hash, expected common.Hash, diff *StateDiff, deleteEmptyObjects bool) error {
+	have, err := ApplyStateDiff(db, root, diff, deleteEmptyObjects)
+	if err != nil {
+		return err
+	}
+	if have != expected {
+		return fmt.Errorf("state root mismatch: have %x, want %x", have, expected)
+	}
+	return nil
+}
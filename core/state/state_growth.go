@@ -0,0 +1,126 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	stateGrowthTrieGauge     = metrics.NewRegisteredGauge("state/growth/trie", nil)
+	stateGrowthFlatGauge     = metrics.NewRegisteredGauge("state/growth/flat", nil)
+	stateGrowthCodeGauge     = metrics.NewRegisteredGauge("state/growth/code", nil)
+	stateGrowthAccountsGauge = metrics.NewRegisteredGauge("state/growth/accounts", nil)
+	stateGrowthSlotsGauge    = metrics.NewRegisteredGauge("state/growth/slots", nil)
+)
+
+// StateGrowth is the amount of data added to the state since it was created,
+// usually by a single block.
+type StateGrowth struct {
+	TrieNodes common.StorageSize `json:"trieNodes"` // Size of the new trie nodes committed into the trie database
+	FlatState common.StorageSize `json:"flatState"` // Net size of the account and storage entries created, negative if shrinking
+	Code      common.StorageSize `json:"code"`      // Size of the contract code deployed
+	Accounts  int                `json:"accounts"`  // Net number of accounts created, negative if shrinking
+	Slots     int                `json:"slots"`     // Net number of storage slots created, negative if shrinking
+}
+
+// Total returns the combined size of the data added to the state.
+func (g StateGrowth) Total() common.StorageSize {
+	return g.TrieNodes + g.FlatState + g.Code
+}
+
+// StateGrowth returns the amount of data added to the state since it was created.
+// The trie nodes and the code are only accounted for on commit.
+//
+// The flat state is measured as the size of the account and storage slot entries
+// keyed by their hashes. Deleted storage slots are deducted, but the storage of
+// destructed accounts is not, as its size is unknown without iterating it.
+func (s *StateDB) StateGrowth() StateGrowth {
+	return s.growth
+}
+
+// trackAccountGrowth accounts for an account being written into or deleted from
+// the account trie, tracking whether it's present in the trie in the object.
+func (s *StateDB) trackAccountGrowth(obj *stateObject, present bool) {
+	if obj.existed == present {
+		return
+	}
+	obj.existed = present
+
+	size := len(snapshot.SlimAccountRLP(obj.data.Nonce, obj.data.Balance, obj.data.Root, obj.data.CodeHash))
+	if present {
+		s.growth.Accounts++
+		s.growth.FlatState += common.StorageSize(common.HashLength + size)
+	} else {
+		s.growth.Accounts--
+		s.growth.FlatState -= common.StorageSize(common.HashLength + size)
+	}
+}
+
+// trackSlot accounts for a storage slot being changed from the original value
+// to the new one, zero meaning non-existent.
+func (g *StateGrowth) trackSlot(prev, next common.Hash) {
+	var (
+		prevSize = slotSize(prev)
+		nextSize = slotSize(next)
+	)
+	switch {
+	case prevSize == 0 && nextSize > 0:
+		g.Slots++
+		g.FlatState += common.StorageSize(common.HashLength + nextSize)
+	case prevSize > 0 && nextSize == 0:
+		g.Slots--
+		g.FlatState -= common.StorageSize(common.HashLength + prevSize)
+	default:
+		g.FlatState += common.StorageSize(nextSize - prevSize)
+	}
+}
+
+// mergeSlotGrowth folds the storage growth accumulated by the object while its
+// storage trie was updated into the state's. The storage tries are updated
+// concurrently, so the objects track their own growth until merged serially.
+func (s *StateDB) mergeSlotGrowth(obj *stateObject) {
+	s.growth.FlatState += obj.growth.FlatState
+	s.growth.Slots += obj.growth.Slots
+	obj.growth = StateGrowth{}
+}
+
+// slotSize returns the size of the RLP encoding of a storage slot value with the
+// leading zeroes trimmed, as stored in the tries and the snapshot. Zero values
+// are not stored at all.
+func slotSize(value common.Hash) int {
+	trimmed := common.TrimLeftZeroes(value[:])
+	switch {
+	case len(trimmed) == 0:
+		return 0
+	case len(trimmed) == 1 && trimmed[0] < 0x80:
+		return 1
+	default:
+		return 1 + len(trimmed)
+	}
+}
+
+// reportStateGrowth updates the state growth metrics after a commit.
+func (s *StateDB) reportStateGrowth() {
+	stateGrowthTrieGauge.Update(int64(s.growth.TrieNodes))
+	stateGrowthFlatGauge.Update(int64(s.growth.FlatState))
+	stateGrowthCodeGauge.Update(int64(s.growth.Code))
+	stateGrowthAccountsGauge.Update(int64(s.growth.Accounts))
+	stateGrowthSlotsGauge.Update(int64(s.growth.Slots))
+}
@@ -24,6 +24,7 @@ import (
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/metrics"
 	"github.com/ethereum/go-ethereum/rlp"
@@ -84,16 +85,24 @@ type stateObject struct {
 	dirtyStorage   Storage // Storage entries that have been modified in the current transaction execution
 	fakeStorage    Storage // Fake storage which constructed by caller for debugging purpose.
 
+	pendingRootCache *common.Hash // Storage root including the unflushed slots, nil if not computed since the last write
+	growth           StateGrowth  // Storage growth of the flushed slots, not yet merged into the state's
+
 	// Cache flags.
 	// When an object is marked suicided it will be delete from the trie
 	// during the "update" phase of the state transition.
 	dirtyCode bool // true if the code was updated
 	suicided  bool
 	deleted   bool
+	existed   bool // true if the account is present in the account trie, as of the last update
 }
 
-// empty returns whether the account is considered empty.
+// empty returns whether the account is considered empty, as defined by the
+// empty account rules of the state.
 func (s *stateObject) empty() bool {
+	if rules := s.db.emptyRules; rules != nil && rules.IsEmpty != nil {
+		return rules.IsEmpty(s.data.Nonce, s.data.Balance, s.data.CodeHash)
+	}
 	return s.data.Nonce == 0 && s.data.Balance.Sign() == 0 && bytes.Equal(s.data.CodeHash, emptyCodeHash)
 }
 
@@ -195,6 +204,13 @@ func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Has
 	if value, cached := s.originStorage[key]; cached {
 		return value
 	}
+	// If the account had no storage at the start of the block, there's nothing
+	// to look up in the snapshot or the trie
+	if s.data.Root == emptyRoot {
+		emptyStorageSkipMeter.Mark(1)
+		s.originStorage[key] = common.Hash{}
+		return common.Hash{}
+	}
 	// If no live objects are available, attempt to use snapshots
 	var (
 		enc []byte
@@ -213,7 +229,12 @@ func (s *stateObject) GetCommittedState(db Database, key common.Hash) common.Has
 		if _, destructed := s.db.snapDestructs[s.addrHash]; destructed {
 			return common.Hash{}
 		}
-		enc, err = s.db.snap.Storage(s.addrHash, crypto.Keccak256Hash(key[:]))
+		// The slot is read into a scratch buffer owned by the state database, it's
+		// only valid until the next read so it must be decoded (copied) below.
+		enc, err = s.db.snap.StorageInto(s.addrHash, crypto.Keccak256Hash(key[:]), s.db.snapSlotBuf[:0])
+		s.db.trackSnapshotRead(err)
+	} else if s.db.snaps != nil {
+		s.db.trackSnapshotRead(snapshot.ErrSnapshotMissing)
 	}
 	// If snapshot unavailable or reading from it failed, load from the database
 	if s.db.snap == nil || err != nil {
@@ -278,6 +299,7 @@ func (s *stateObject) SetStorage(storage map[common.Hash]common.Hash) {
 
 func (s *stateObject) setState(key, value common.Hash) {
 	s.dirtyStorage[key] = value
+	s.pendingRootCache = nil
 }
 
 // finalise moves all dirty storage slots into the pending area to be hashed or
@@ -320,19 +342,23 @@ func (s *stateObject) updateTrie(db Database) Trie {
 		if value == s.originStorage[key] {
 			continue
 		}
+		s.growth.trackSlot(s.originStorage[key], value)
 		s.originStorage[key] = value
 
-		var v []byte
+		var (
+			v    []byte
+			hash = crypto.Keccak256Hash(key[:])
+		)
 		if (value == common.Hash{}) {
-			s.setError(tr.TryDelete(key[:]))
+			s.setError(tr.TryDeleteHashed(hash[:]))
 		} else {
 			// Encoding []byte cannot fail, ok to ignore the error.
 			v, _ = rlp.EncodeToBytes(common.TrimLeftZeroes(value[:]))
-			s.setError(tr.TryUpdate(key[:], v))
+			s.setError(tr.TryUpdateHashed(key[:], hash[:], v))
 		}
 		// If state snapshotting is active, cache the data til commit
 		if storage != nil {
-			storage[crypto.Keccak256Hash(key[:])] = v // v will be nil if value is 0x00
+			storage[hash] = v // v will be nil if value is 0x00
 		}
 	}
 	if len(s.pendingStorage) > 0 {
@@ -341,6 +367,49 @@ func (s *stateObject) updateTrie(db Database) Trie {
 	return tr
 }
 
+// pendingRoot returns the storage root of the object including all the slots
+// modified since the last flush, without flushing them. The modified slots are
+// hashed into a copy of the storage trie and the result is cached until the
+// next storage write.
+func (s *stateObject) pendingRoot(db Database) common.Hash {
+	if s.pendingRootCache != nil {
+		return *s.pendingRootCache
+	}
+	if len(s.pendingStorage) == 0 && len(s.dirtyStorage) == 0 {
+		return s.data.Root
+	}
+	root := s.pendingTrie(db).Hash()
+	s.pendingRootCache = &root
+	return root
+}
+
+// pendingTrie returns a copy of the storage trie of the object with all the
+// slots modified since the last flush inserted, leaving the live trie intact.
+func (s *stateObject) pendingTrie(db Database) Trie {
+	changes := make(Storage, len(s.pendingStorage)+len(s.dirtyStorage))
+	for key, value := range s.pendingStorage {
+		changes[key] = value
+	}
+	for key, value := range s.dirtyStorage {
+		changes[key] = value
+	}
+	tr := db.CopyTrie(s.getTrie(db))
+	for key, value := range changes {
+		if value == s.originStorage[key] {
+			continue
+		}
+		hash := crypto.Keccak256Hash(key[:])
+		if (value == common.Hash{}) {
+			s.setError(tr.TryDeleteHashed(hash[:]))
+		} else {
+			// Encoding []byte cannot fail, ok to ignore the error.
+			v, _ := rlp.EncodeToBytes(common.TrimLeftZeroes(value[:]))
+			s.setError(tr.TryUpdateHashed(nil, hash[:], v)) // Throwaway copy, no preimages needed
+		}
+	}
+	return tr
+}
+
 // UpdateRoot sets the trie root to the current root hash of
 func (s *stateObject) updateRoot(db Database) {
 	// If nothing changed, don't bother with hashing anything
@@ -423,9 +492,11 @@ func (s *stateObject) deepCopy(db *StateDB) *stateObject {
 	stateObject.dirtyStorage = s.dirtyStorage.Copy()
 	stateObject.originStorage = s.originStorage.Copy()
 	stateObject.pendingStorage = s.pendingStorage.Copy()
+	stateObject.pendingRootCache = s.pendingRootCache
 	stateObject.suicided = s.suicided
 	stateObject.dirtyCode = s.dirtyCode
 	stateObject.deleted = s.deleted
+	stateObject.existed = s.existed
 	return stateObject
 }
 
@@ -444,6 +515,7 @@ func (s *stateObject) Code(db Database) []byte {
 		return s.code
 	}
 	if bytes.Equal(s.CodeHash(), emptyCodeHash) {
+		emptyCodeSkipMeter.Mark(1)
 		return nil
 	}
 	code, err := db.ContractCode(s.addrHash, common.BytesToHash(s.CodeHash()))
@@ -462,6 +534,7 @@ func (s *stateObject) CodeSize(db Database) int {
 		return len(s.code)
 	}
 	if bytes.Equal(s.CodeHash(), emptyCodeHash) {
+		emptyCodeSkipMeter.Mark(1)
 		return 0
 	}
 	size, err := db.ContractCodeSize(s.addrHash, common.BytesToHash(s.CodeHash()))
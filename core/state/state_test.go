@@ -248,3 +248,62 @@ func compareStateObjects(so0, so1 *stateObject, t *testing.T) {
 		}
 	}
 }
+
+// Tests that structurally diffing two states in different databases reports the
+// differing accounts and storage slots only.
+func TestCompareStates(t *testing.T) {
+	var (
+		addr1 = common.Address{0x01}
+		addr2 = common.Address{0x02}
+		addr3 = common.Address{0x03}
+	)
+	build := func(modified bool) (Database, common.Hash) {
+		db := NewDatabase(rawdb.NewMemoryDatabase())
+		state, _ := New(common.Hash{}, db, nil)
+		state.SetBalance(addr1, big.NewInt(1))
+		state.SetBalance(addr2, big.NewInt(2))
+		state.SetState(addr2, common.Hash{0x01}, common.Hash{0x01})
+		state.SetState(addr2, common.Hash{0x02}, common.Hash{0x02})
+		if modified {
+			state.SetBalance(addr1, big.NewInt(10))
+			state.SetState(addr2, common.Hash{0x02}, common.Hash{0x03})
+			state.SetBalance(addr3, big.NewInt(3))
+		}
+		root, _ := state.Commit(false)
+		return db, root
+	}
+	haveDb, haveRoot := build(true)
+	wantDb, wantRoot := build(false)
+
+	divergences, err := CompareStates(haveDb, haveRoot, wantDb, wantRoot, 0)
+	if err != nil {
+		t.Fatalf("failed to compare states: %v", err)
+	}
+	expected := map[string]bool{
+		crypto.Keccak256Hash(addr1[:]).Hex(): true,
+		crypto.Keccak256Hash(addr2[:]).Hex() + crypto.Keccak256Hash(common.Hash{0x02}.Bytes()).Hex(): true,
+		crypto.Keccak256Hash(addr3[:]).Hex(): true,
+	}
+	if len(divergences) != len(expected) {
+		t.Fatalf("divergence count mismatch: have %d, want %d", len(divergences), len(expected))
+	}
+	for i, div := range divergences {
+		id := div.Account.Hex()
+		if div.Slot != nil {
+			id += div.Slot.Hex()
+		}
+		if !expected[id] {
+			t.Errorf("unexpected divergence %d: %+v", i, div)
+		}
+		if i > 0 && bytes.Compare(divergences[i-1].Account[:], div.Account[:]) > 0 {
+			t.Errorf("divergence %d out of order", i)
+		}
+	}
+	// Ensure the limit is honoured and identical states don't diverge
+	if divergences, _ := CompareStates(haveDb, haveRoot, wantDb, wantRoot, 1); len(divergences) != 1 {
+		t.Errorf("limited divergence count mismatch: have %d, want 1", len(divergences))
+	}
+	if divergences, _ := CompareStates(wantDb, wantRoot, wantDb, wantRoot, 0); len(divergences) != 0 {
+		t.Errorf("identical states diverged: %v", divergences)
+	}
+}
@@ -21,7 +21,9 @@ import (
 	"errors"
 	"fmt"
 	"math/big"
+	"runtime"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/ethereum/go-ethereum/common"
@@ -30,6 +32,7 @@ import (
 	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
 	"github.com/ethereum/go-ethereum/rlp"
 	"github.com/ethereum/go-ethereum/trie"
 )
@@ -45,6 +48,10 @@ var (
 
 	// emptyCode is the known hash of the empty EVM bytecode.
 	emptyCode = crypto.Keccak256Hash(nil)
+
+	// errForkFinalised is returned if a state is reset to a fork, but the changes
+	// made since were finalised, so they can't be undone anymore.
+	errForkFinalised = errors.New("state finalised since fork")
 )
 
 type proofList [][]byte
@@ -58,6 +65,19 @@ func (n *proofList) Delete(key []byte) error {
 	panic("not supported")
 }
 
+// EmptyRules defines the empty account semantics of a state, allowing chains not
+// following the EIP-158 rules (e.g. private networks or layer two chains) to
+// customise them. The zero value retains the Ethereum semantics.
+type EmptyRules struct {
+	// IsEmpty reports whether an account is considered empty. If nil, an account
+	// is empty if it has a zero nonce, zero balance and no code.
+	IsEmpty func(nonce uint64, balance *big.Int, codeHash []byte) bool
+
+	// KeepTouched disables the deletion of the touched empty accounts, even if
+	// it's requested by the chain rules upon finalisation.
+	KeepTouched bool
+}
+
 // StateDBs within the ethereum protocol are used to store anything
 // within the merkle trie. StateDBs take care of caching and storing
 // nested states. It's the general query interface to retrieve:
@@ -72,6 +92,23 @@ type StateDB struct {
 	snapDestructs map[common.Hash]struct{}
 	snapAccounts  map[common.Hash][]byte
 	snapStorage   map[common.Hash]map[common.Hash][]byte
+	snapSlotBuf   [common.HashLength + 1]byte // Scratch space for allocation free slot reads
+	snapFallbacks SnapshotFallbacks           // Summary of the reads falling back from the snapshot to the tries
+	snapNumber    uint64                      // Number of the block the state belongs to, zero if unknown
+
+	objCache *objectCache // Decoded state objects retained across blocks, nil if unavailable
+	codes    *CodeCache   // Contract codes shared with the database, nil if unavailable
+
+	emptyRules *EmptyRules // Custom empty account semantics, nil for the Ethereum ones
+
+	balanceOrigins map[common.Address]*big.Int // Balances of the accounts when first accessed, nil if not tracked
+
+	growth StateGrowth // Amount of data added to the state since its creation
+
+	diffPre    map[common.Address]*AccountState            // Pre-images of the accounts accessed, nil if not tracked
+	diffSlots  map[common.Address]map[common.Hash]struct{} // Storage slots accessed while tracking the state diff
+	diffReset  map[*stateObject]struct{}                   // Objects created over existing accounts while tracking the state diff
+	diffOrigin map[common.Address]*stateObject             // Objects the account pre-images were taken from, read for the slot pre-images
 
 	// This map holds 'live' objects, which will get modified while processing a state transition.
 	stateObjects        map[common.Address]*stateObject
@@ -93,7 +130,8 @@ type StateDB struct {
 	logs         map[common.Hash][]*types.Log
 	logSize      uint
 
-	preimages map[common.Hash][]byte
+	preimages      map[common.Hash][]byte
+	recordSlotKeys bool // Whether the preimages of the written slot keys are recorded
 
 	// Journal of state modifications. This is the backbone of
 	// Snapshot and RevertToSnapshot.
@@ -132,6 +170,10 @@ func New(root common.Hash, db Database, snaps *snapshot.Tree) (*StateDB, error)
 		preimages:           make(map[common.Hash][]byte),
 		journal:             newJournal(),
 	}
+	if cdb, ok := db.(*cachingDB); ok {
+		sdb.objCache = cdb.objects
+		sdb.codes = cdb.codes
+	}
 	if sdb.snaps != nil {
 		if sdb.snap = sdb.snaps.Snapshot(root); sdb.snap != nil {
 			sdb.snapDestructs = make(map[common.Hash]struct{})
@@ -149,8 +191,18 @@ func (s *StateDB) setError(err error) {
 	}
 }
 
+// Error returns the memorized database failure occurred earlier, including the
+// failures of the live state objects not yet merged into the state.
 func (s *StateDB) Error() error {
-	return s.dbErr
+	if s.dbErr != nil {
+		return s.dbErr
+	}
+	for _, obj := range s.stateObjects {
+		if obj.dbErr != nil {
+			return obj.dbErr
+		}
+	}
+	return nil
 }
 
 // Reset clears out all ephemeral state objects from the state db, but keeps
@@ -170,6 +222,7 @@ func (s *StateDB) Reset(root common.Hash) error {
 	s.logs = make(map[common.Hash][]*types.Log)
 	s.logSize = 0
 	s.preimages = make(map[common.Hash][]byte)
+	s.growth = StateGrowth{}
 	s.clearJournalAndRefund()
 
 	if s.snaps != nil {
@@ -243,8 +296,70 @@ func (s *StateDB) Exist(addr common.Address) bool {
 	return s.getStateObject(addr) != nil
 }
 
+// NewEmptyRules derives the empty account semantics of the state of the given
+// block from the chain configuration, nil if the chain follows the Ethereum rules.
+func NewEmptyRules(config *params.ChainConfig, number *big.Int) *EmptyRules {
+	if config.IsKeepTouched(number) {
+		return &EmptyRules{KeepTouched: true}
+	}
+	return nil
+}
+
+// SetEmptyRules overrides the empty account semantics of the state. It must be
+// set before any state transition is applied. Nil restores the Ethereum rules.
+func (s *StateDB) SetEmptyRules(rules *EmptyRules) {
+	s.emptyRules = rules
+}
+
+// RecordSlotPreimages enables recording the preimages of the storage slot keys
+// written from now on into Preimages, along with the ones seen by the VM. They
+// are captured on write, so they are complete regardless of whether the slots
+// were read from the snapshot or the tries.
+func (s *StateDB) RecordSlotPreimages() {
+	s.recordSlotKeys = true
+}
+
+// TrackBalanceChanges enables the tracking of the balance changes of all the
+// accounts accessed from now on, e.g. to account for the fees paid and received
+// in a block without re-deriving them from receipts and traces.
+func (s *StateDB) TrackBalanceChanges() {
+	if s.balanceOrigins != nil {
+		return
+	}
+	s.balanceOrigins = make(map[common.Address]*big.Int)
+	for addr, obj := range s.stateObjects {
+		s.balanceOrigins[addr] = new(big.Int).Set(obj.data.Balance)
+	}
+}
+
+// BalanceChanges returns the net balance changes of the accounts since balance
+// tracking was enabled, omitting the accounts with unchanged balances. Reverted
+// changes are not included and destructed accounts are treated as empty ones.
+// Nil is returned if tracking is not enabled.
+func (s *StateDB) BalanceChanges() map[common.Address]*big.Int {
+	if s.balanceOrigins == nil {
+		return nil
+	}
+	changes := make(map[common.Address]*big.Int)
+	for addr, origin := range s.balanceOrigins {
+		obj := s.stateObjects[addr]
+		if obj == nil {
+			continue // Account creation reverted
+		}
+		balance := obj.data.Balance
+		if obj.deleted {
+			balance = common.Big0
+		}
+		if delta := new(big.Int).Sub(balance, origin); delta.Sign() != 0 {
+			changes[addr] = delta
+		}
+	}
+	return changes
+}
+
 // Empty returns whether the state object is either non-existent
-// or empty according to the EIP161 specification (balance = nonce = code = 0)
+// or empty according to the EIP161 specification (balance = nonce = code = 0),
+// unless overridden by custom empty account rules.
 func (s *StateDB) Empty(addr common.Address) bool {
 	so := s.getStateObject(addr)
 	return so == nil || so.empty()
@@ -305,6 +420,9 @@ func (s *StateDB) GetCodeHash(addr common.Address) common.Hash {
 // GetState retrieves a value from the given account's storage trie.
 func (s *StateDB) GetState(addr common.Address, hash common.Hash) common.Hash {
 	stateObject := s.getStateObject(addr)
+	if s.diffPre != nil {
+		s.recordSlot(addr, hash)
+	}
 	if stateObject != nil {
 		return stateObject.GetState(s.db, hash)
 	}
@@ -355,6 +473,18 @@ func (s *StateDB) StorageTrie(addr common.Address) Trie {
 	return cpy.getTrie(s.db)
 }
 
+// PendingStorageRoot returns the up-to-date storage root of the given account,
+// including all the storage changes made in the current block, without flushing
+// them or finalising the state. The root is cached until the next storage write
+// to the account. The empty root is returned for non-existent accounts.
+func (s *StateDB) PendingStorageRoot(addr common.Address) common.Hash {
+	stateObject := s.getStateObject(addr)
+	if stateObject == nil {
+		return emptyRoot
+	}
+	return stateObject.pendingRoot(s.db)
+}
+
 func (s *StateDB) HasSuicided(addr common.Address) bool {
 	stateObject := s.getStateObject(addr)
 	if stateObject != nil {
@@ -406,6 +536,12 @@ func (s *StateDB) SetCode(addr common.Address, code []byte) {
 
 func (s *StateDB) SetState(addr common.Address, key, value common.Hash) {
 	stateObject := s.GetOrNewStateObject(addr)
+	if s.diffPre != nil {
+		s.recordSlot(addr, key)
+	}
+	if s.recordSlotKeys {
+		s.AddPreimage(crypto.Keccak256Hash(key[:]), key[:])
+	}
 	if stateObject != nil {
 		stateObject.SetState(s.db, key, value)
 	}
@@ -415,6 +551,11 @@ func (s *StateDB) SetState(addr common.Address, key, value common.Hash) {
 // storage. This function should only be used for debugging.
 func (s *StateDB) SetStorage(addr common.Address, storage map[common.Hash]common.Hash) {
 	stateObject := s.GetOrNewStateObject(addr)
+	if s.recordSlotKeys {
+		for key := range storage {
+			s.AddPreimage(crypto.Keccak256Hash(key[:]), key[:])
+		}
+	}
 	if stateObject != nil {
 		stateObject.SetStorage(storage)
 	}
@@ -458,9 +599,17 @@ func (s *StateDB) updateStateObject(obj *stateObject) {
 	if err != nil {
 		panic(fmt.Errorf("can't encode object at %x: %v", addr[:], err))
 	}
-	if err = s.trie.TryUpdate(addr[:], data); err != nil {
+	if err = s.trie.TryUpdateHashed(addr[:], obj.addrHash[:], data); err != nil {
 		s.setError(fmt.Errorf("updateStateObject (%x) error: %v", addr[:], err))
 	}
+	s.trackAccountGrowth(obj, true)
+
+	// Merge the outcome of the storage trie update, which may have been done
+	// concurrently with other objects
+	s.mergeSlotGrowth(obj)
+	if obj.dbErr != nil {
+		s.setError(obj.dbErr)
+	}
 
 	// If state snapshotting is active, cache the data til commit. Note, this
 	// update mechanism is not symmetric to the deletion, because whereas it is
@@ -479,16 +628,21 @@ func (s *StateDB) deleteStateObject(obj *stateObject) {
 	}
 	// Delete the account from the trie
 	addr := obj.Address()
-	if err := s.trie.TryDelete(addr[:]); err != nil {
+	if err := s.trie.TryDeleteHashed(obj.addrHash[:]); err != nil {
 		s.setError(fmt.Errorf("deleteStateObject (%x) error: %v", addr[:], err))
 	}
+	s.trackAccountGrowth(obj, false)
 }
 
 // getStateObject retrieves a state object given by the address, returning nil if
 // the object is not found or was deleted in this execution context. If you need
 // to differentiate between non-existent/just-deleted, use getDeletedStateObject.
 func (s *StateDB) getStateObject(addr common.Address) *stateObject {
-	if obj := s.getDeletedStateObject(addr); obj != nil && !obj.deleted {
+	obj := s.getDeletedStateObject(addr)
+	if s.diffPre != nil {
+		s.recordAccount(addr, obj)
+	}
+	if obj != nil && !obj.deleted {
 		return obj
 	}
 	return nil
@@ -505,18 +659,33 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 	}
 	// If no live objects are available, attempt to use snapshots
 	var (
-		data Account
-		err  error
+		data     Account
+		addrHash = crypto.Keccak256Hash(addr[:])
+		err      error
 	)
 	if s.snap != nil {
 		if metrics.EnabledExpensive {
 			defer func(start time.Time) { s.SnapshotAccountReads += time.Since(start) }(time.Now())
 		}
-		var acc *snapshot.Account
-		if acc, err = s.snap.Account(crypto.Keccak256Hash(addr[:])); err == nil {
-			if acc == nil {
+		var (
+			acc = new(snapshot.Account)
+			enc []byte
+		)
+		enc, err = s.snap.AccountRLP(addrHash)
+		s.trackSnapshotRead(err)
+
+		if err == nil {
+			if len(enc) == 0 {
 				return nil
 			}
+			// Short circuit if the decoded object is still cached
+			if obj := s.loadCachedObject(addr, addrHash, enc); obj != nil {
+				s.setStateObject(obj)
+				return obj
+			}
+			err = rlp.DecodeBytes(enc, acc)
+		}
+		if err == nil {
 			data.Nonce, data.Balance, data.CodeHash = acc.Nonce, acc.Balance, acc.CodeHash
 			if len(data.CodeHash) == 0 {
 				data.CodeHash = emptyCodeHash
@@ -526,13 +695,15 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 				data.Root = emptyRoot
 			}
 		}
+	} else if s.snaps != nil {
+		s.trackSnapshotRead(snapshot.ErrSnapshotMissing)
 	}
 	// If snapshot unavailable or reading from it failed, load from the database
 	if s.snap == nil || err != nil {
 		if metrics.EnabledExpensive {
 			defer func(start time.Time) { s.AccountReads += time.Since(start) }(time.Now())
 		}
-		enc, err := s.trie.TryGet(addr[:])
+		enc, err := s.trie.TryGetHashed(addrHash[:])
 		if err != nil {
 			s.setError(fmt.Errorf("getDeleteStateObject (%x) error: %v", addr[:], err))
 			return nil
@@ -540,6 +711,11 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 		if len(enc) == 0 {
 			return nil
 		}
+		// Short circuit if the decoded object is still cached
+		if obj := s.loadCachedObject(addr, addrHash, enc); obj != nil {
+			s.setStateObject(obj)
+			return obj
+		}
 		if err := rlp.DecodeBytes(enc, &data); err != nil {
 			log.Error("Failed to decode state object", "addr", addr, "err", err)
 			return nil
@@ -547,11 +723,19 @@ func (s *StateDB) getDeletedStateObject(addr common.Address) *stateObject {
 	}
 	// Insert into the live set
 	obj := newObject(s, addr, data)
+	obj.existed = true
 	s.setStateObject(obj)
 	return obj
 }
 
 func (s *StateDB) setStateObject(object *stateObject) {
+	// If balance tracking is enabled, record the balance on first access. For
+	// accounts being created, the previous instance was already accessed.
+	if s.balanceOrigins != nil {
+		if _, ok := s.balanceOrigins[object.address]; !ok {
+			s.balanceOrigins[object.address] = new(big.Int).Set(object.data.Balance)
+		}
+	}
 	s.stateObjects[object.Address()] = object
 }
 
@@ -568,6 +752,9 @@ func (s *StateDB) GetOrNewStateObject(addr common.Address) *stateObject {
 // the given address, it is overwritten and returned as the second return value.
 func (s *StateDB) createObject(addr common.Address) (newobj, prev *stateObject) {
 	prev = s.getDeletedStateObject(addr) // Note, prev might have been deleted, we need that!
+	if s.diffPre != nil {
+		s.recordAccount(addr, prev)
+	}
 
 	var prevdestruct bool
 	if s.snap != nil && prev != nil {
@@ -578,6 +765,10 @@ func (s *StateDB) createObject(addr common.Address) (newobj, prev *stateObject)
 	}
 	newobj = newObject(s, addr, Account{})
 	newobj.setNonce(0) // sets the object to dirty
+	if s.diffPre != nil && prev != nil {
+		s.diffReset[newobj] = struct{}{}
+	}
+	newobj.existed = prev != nil && prev.existed
 	if prev == nil {
 		s.journal.append(createObjectChange{account: &addr})
 	} else {
@@ -593,8 +784,8 @@ func (s *StateDB) createObject(addr common.Address) (newobj, prev *stateObject)
 // CreateAccount is called during the EVM CREATE operation. The situation might arise that
 // a contract does the following:
 //
-//   1. sends funds to sha(account ++ (nonce + 1))
-//   2. tx_create(sha(account ++ nonce)) (note that this gets the address of 1)
+//  1. sends funds to sha(account ++ (nonce + 1))
+//  2. tx_create(sha(account ++ nonce)) (note that this gets the address of 1)
 //
 // Carrying over the balance ensures that Ether doesn't disappear.
 func (s *StateDB) CreateAccount(addr common.Address) {
@@ -648,6 +839,30 @@ func (s *StateDB) Copy() *StateDB {
 		logSize:             s.logSize,
 		preimages:           make(map[common.Hash][]byte, len(s.preimages)),
 		journal:             newJournal(),
+		objCache:            s.objCache,
+		codes:               s.codes,
+		emptyRules:          s.emptyRules,
+		recordSlotKeys:      s.recordSlotKeys,
+		growth:              s.growth,
+	}
+	if s.balanceOrigins != nil {
+		state.balanceOrigins = make(map[common.Address]*big.Int, len(s.balanceOrigins))
+		for addr, balance := range s.balanceOrigins {
+			state.balanceOrigins[addr] = new(big.Int).Set(balance)
+		}
+	}
+	if s.diffPre != nil {
+		state.diffPre = make(map[common.Address]*AccountState, len(s.diffPre))
+		for addr, pre := range s.diffPre {
+			state.diffPre[addr] = pre.copy()
+		}
+		state.diffSlots = make(map[common.Address]map[common.Hash]struct{}, len(s.diffSlots))
+		for addr, slots := range s.diffSlots {
+			state.diffSlots[addr] = make(map[common.Hash]struct{}, len(slots))
+			for key := range slots {
+				state.diffSlots[addr][key] = struct{}{}
+			}
+		}
 	}
 	// Copy the dirty states, logs, and preimages
 	for addr := range s.journal.dirties {
@@ -680,6 +895,26 @@ func (s *StateDB) Copy() *StateDB {
 		}
 		state.stateObjectsDirty[addr] = struct{}{}
 	}
+	// The objects of the copy differ from the original ones, remap the resets
+	// and the pre-image origins
+	if s.diffReset != nil {
+		state.diffReset = make(map[*stateObject]struct{}, len(s.diffReset))
+		for obj := range s.diffReset {
+			if s.stateObjects[obj.address] == obj {
+				state.diffReset[state.stateObjects[obj.address]] = struct{}{}
+			}
+		}
+	}
+	if s.diffOrigin != nil {
+		state.diffOrigin = make(map[common.Address]*stateObject, len(s.diffOrigin))
+		for addr, obj := range s.diffOrigin {
+			if cpy, ok := state.stateObjects[addr]; ok && s.stateObjects[addr] == obj {
+				state.diffOrigin[addr] = cpy
+			} else {
+				state.diffOrigin[addr] = obj.deepCopy(state)
+			}
+		}
+	}
 	for hash, logs := range s.logs {
 		cpy := make([]*types.Log, len(logs))
 		for i, l := range logs {
@@ -718,6 +953,49 @@ func (s *StateDB) RevertToSnapshot(revid int) {
 	s.validRevisions = s.validRevisions[:idx]
 }
 
+// StateFork is a pristine point of a state, which the state can be restored to
+// any number of times, e.g. to execute the same call repeatedly on the same
+// pre-state. Restoring only undoes the changes made since the fork, which is
+// proportional to the dirty set instead of rebuilding the whole state.
+type StateFork struct {
+	state    *StateDB
+	revision int // Revision of the state at the fork, renewed on every reset
+
+	thash, bhash common.Hash // Transaction context at the fork
+	txIndex      int
+}
+
+// Fork captures the current state as a pristine point to reset to.
+func (s *StateDB) Fork() *StateFork {
+	return &StateFork{
+		state:    s,
+		revision: s.Snapshot(),
+		thash:    s.thash,
+		bhash:    s.bhash,
+		txIndex:  s.txIndex,
+	}
+}
+
+// Reset restores the state to the point of the fork, undoing all the changes
+// made since. It fails if the changes were finalised in the meantime, as they
+// can't be undone anymore.
+func (f *StateFork) Reset() error {
+	s := f.state
+
+	idx := sort.Search(len(s.validRevisions), func(i int) bool {
+		return s.validRevisions[i].id >= f.revision
+	})
+	if idx == len(s.validRevisions) || s.validRevisions[idx].id != f.revision {
+		return errForkFinalised
+	}
+	s.RevertToSnapshot(f.revision)
+	s.thash, s.bhash, s.txIndex = f.thash, f.bhash, f.txIndex
+
+	// Reverting invalidates the revision, take a new one for the next reset
+	f.revision = s.Snapshot()
+	return nil
+}
+
 // GetRefund returns the current value of the refund counter.
 func (s *StateDB) GetRefund() uint64 {
 	return s.refund
@@ -738,7 +1016,7 @@ func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 			// Thus, we can safely ignore it here
 			continue
 		}
-		if obj.suicided || (deleteEmptyObjects && obj.empty()) {
+		if obj.suicided || (s.deleteEmpty(deleteEmptyObjects) && obj.empty()) {
 			obj.deleted = true
 
 			// If state snapshotting is active, also mark the destruction there.
@@ -760,6 +1038,15 @@ func (s *StateDB) Finalise(deleteEmptyObjects bool) {
 	s.clearJournalAndRefund()
 }
 
+// deleteEmpty reports whether the touched empty accounts should be deleted, given
+// the deletion requested by the chain rules.
+func (s *StateDB) deleteEmpty(requested bool) bool {
+	if s.emptyRules != nil && s.emptyRules.KeepTouched {
+		return false
+	}
+	return requested
+}
+
 // IntermediateRoot computes the current root hash of the state trie.
 // It is called in between transactions to get the root hash that
 // goes into transaction receipts.
@@ -767,8 +1054,51 @@ func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 	// Finalise all the dirty storage states and write them into the tries
 	s.Finalise(deleteEmptyObjects)
 
+	// Storage roots are independent across accounts, so the objects with storage
+	// changes are rehashed concurrently, while the account trie is updated with
+	// the rest. The account trie root doesn't depend on the order of the updates.
+	//
+	// If expensive metrics are enabled, everything is done serially to keep the
+	// time measurements accurate.
+	var serial, hashing []*stateObject
 	for addr := range s.stateObjectsPending {
 		obj := s.stateObjects[addr]
+		if obj.deleted || len(obj.pendingStorage) == 0 || metrics.EnabledExpensive {
+			serial = append(serial, obj)
+			continue
+		}
+		// The snapshot storage maps are shared, create them before hashing
+		if s.snap != nil && s.snapStorage[obj.addrHash] == nil {
+			s.snapStorage[obj.addrHash] = make(map[common.Hash][]byte)
+		}
+		hashing = append(hashing, obj)
+	}
+	// The workers only touch the objects they hash. Everything shared, like the
+	// state growth and the database errors, is merged serially once all of them
+	// are done.
+	var wg sync.WaitGroup
+	if len(hashing) > 0 {
+		tasks := make(chan *stateObject, len(hashing))
+		for _, obj := range hashing {
+			tasks <- obj
+		}
+		close(tasks)
+
+		threads := runtime.NumCPU()
+		if threads > len(hashing) {
+			threads = len(hashing)
+		}
+		wg.Add(threads)
+		for i := 0; i < threads; i++ {
+			go func() {
+				defer wg.Done()
+				for obj := range tasks {
+					obj.updateRoot(s.db)
+				}
+			}()
+		}
+	}
+	for _, obj := range serial {
 		if obj.deleted {
 			s.deleteStateObject(obj)
 		} else {
@@ -776,6 +1106,10 @@ func (s *StateDB) IntermediateRoot(deleteEmptyObjects bool) common.Hash {
 			s.updateStateObject(obj)
 		}
 	}
+	wg.Wait()
+	for _, obj := range hashing {
+		s.updateStateObject(obj)
+	}
 	if len(s.stateObjectsPending) > 0 {
 		s.stateObjectsPending = make(map[common.Address]struct{})
 	}
@@ -794,6 +1128,13 @@ func (s *StateDB) Prepare(thash, bhash common.Hash, ti int) {
 	s.txIndex = ti
 }
 
+// SetBlockNumber sets the number of the block the state belongs to, recorded
+// with the snapshot layer created on commit. It's required by the strict mode
+// of the snapshot tree.
+func (s *StateDB) SetBlockNumber(number uint64) {
+	s.snapNumber = number
+}
+
 func (s *StateDB) clearJournalAndRefund() {
 	if len(s.journal.entries) > 0 {
 		s.journal = newJournal()
@@ -811,17 +1152,24 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 	s.IntermediateRoot(deleteEmptyObjects)
 
 	// Commit objects to the trie, measuring the elapsed time
+	triedb := s.db.TrieDB()
 	for addr := range s.stateObjectsDirty {
 		if obj := s.stateObjects[addr]; !obj.deleted {
 			// Write any contract code associated with the state object
 			if obj.code != nil && obj.dirtyCode {
-				s.db.TrieDB().InsertBlob(common.BytesToHash(obj.CodeHash()), obj.code)
+				triedb.InsertBlob(common.BytesToHash(obj.CodeHash()), obj.code)
+				if s.codes != nil {
+					s.codes.add(common.BytesToHash(obj.CodeHash()), obj.code)
+				}
 				obj.dirtyCode = false
+				s.growth.Code += common.StorageSize(len(obj.code))
 			}
 			// Write any storage changes in the state object to its storage trie
+			inserted := triedb.Inserted()
 			if err := obj.CommitTrie(s.db); err != nil {
 				return common.Hash{}, err
 			}
+			s.growth.TrieNodes += triedb.Inserted() - inserted
 		}
 	}
 	if len(s.stateObjectsDirty) > 0 {
@@ -835,6 +1183,7 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 	// The onleaf func is called _serially_, so we can reuse the same account
 	// for unmarshalling every time.
 	var account Account
+	inserted := triedb.Inserted()
 	root, err := s.trie.Commit(func(leaf []byte, parent common.Hash) error {
 		if err := rlp.DecodeBytes(leaf, &account); err != nil {
 			return nil
@@ -851,6 +1200,13 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 	if metrics.EnabledExpensive {
 		s.AccountCommits += time.Since(start)
 	}
+	s.growth.TrieNodes += triedb.Inserted() - inserted
+	s.reportStateGrowth()
+	// Retain the live objects for the following blocks. It must be done before
+	// releasing the snapshot, the cache key depends on its availability.
+	if s.objCache != nil && err == nil {
+		s.updateObjectCache()
+	}
 	// If snapshotting is enabled, update the snapshot tree with this new version
 	if s.snap != nil {
 		if metrics.EnabledExpensive {
@@ -858,7 +1214,7 @@ func (s *StateDB) Commit(deleteEmptyObjects bool) (common.Hash, error) {
 		}
 		// Only update if there's a state transition (skip empty Clique blocks)
 		if parent := s.snap.Root(); parent != root {
-			if err := s.snaps.Update(root, parent, s.snapDestructs, s.snapAccounts, s.snapStorage); err != nil {
+			if err := s.snaps.UpdateWithNumber(root, parent, s.snapNumber, s.snapDestructs, s.snapAccounts, s.snapStorage); err != nil {
 				log.Warn("Failed to update snapshot tree", "from", parent, "to", root, "err", err)
 			}
 			if err := s.snaps.Cap(root, 127); err != nil { // Persistent layer is 128th, the last available trie
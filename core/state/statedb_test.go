@@ -28,10 +28,18 @@ import (
 	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 
+	"github.com/davecgh/go-spew/spew"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state/snapshot"
 	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb/memorydb"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/ethereum/go-ethereum/params"
+	"github.com/ethereum/go-ethereum/trie"
 )
 
 // Tests that updating a state trie does not leak any database writes prior to
@@ -474,6 +482,70 @@ func TestTouchDelete(t *testing.T) {
 	}
 }
 
+// Tests that the empty account rules of the state are honoured when touching
+// accounts, producing the correct state roots in all modes.
+func TestEmptyRules(t *testing.T) {
+	var (
+		empty = common.Address{0x01}
+		rich  = common.Address{0x02}
+	)
+	// reference creates a state containing the given accounts and returns its root
+	reference := func(addrs ...common.Address) common.Hash {
+		state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		for _, addr := range addrs {
+			state.CreateAccount(addr)
+			if addr == rich {
+				state.SetBalance(addr, big.NewInt(5))
+			}
+		}
+		root, _ := state.Commit(false)
+		return root
+	}
+	// touch creates both accounts, touches them with the given rules and returns
+	// the resulting root
+	touch := func(rules *EmptyRules) common.Hash {
+		state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		state.SetEmptyRules(rules)
+		state.CreateAccount(empty)
+		state.CreateAccount(rich)
+		state.SetBalance(rich, big.NewInt(5))
+		root, _ := state.Commit(false)
+
+		state, _ = New(root, state.Database(), nil)
+		state.SetEmptyRules(rules)
+		state.AddBalance(empty, new(big.Int))
+		state.AddBalance(rich, new(big.Int))
+		root, _ = state.Commit(true)
+		return root
+	}
+	// The Ethereum rules delete the touched empty account only
+	if have, want := touch(nil), reference(rich); have != want {
+		t.Errorf("default rules: root mismatch: have %x, want %x", have, want)
+	}
+	// Retaining touched accounts should leave the state untouched
+	if have, want := touch(&EmptyRules{KeepTouched: true}), reference(empty, rich); have != want {
+		t.Errorf("retaining rules: root mismatch: have %x, want %x", have, want)
+	}
+	// Disregarding balances should delete both accounts
+	rules := &EmptyRules{
+		IsEmpty: func(nonce uint64, balance *big.Int, codeHash []byte) bool {
+			return nonce == 0 && bytes.Equal(codeHash, emptyCodeHash)
+		},
+	}
+	if have, want := touch(rules), reference(); have != want {
+		t.Errorf("custom rules: root mismatch: have %x, want %x", have, want)
+	}
+	// The rules derived from the chain config should switch at the configured block
+	config := *params.TestChainConfig
+	config.KeepTouchedBlock = big.NewInt(2)
+	if rules := NewEmptyRules(&config, big.NewInt(1)); rules != nil {
+		t.Errorf("rules before the switch block: have %+v, want nil", rules)
+	}
+	if have, want := touch(NewEmptyRules(&config, big.NewInt(2))), reference(empty, rich); have != want {
+		t.Errorf("derived rules: root mismatch: have %x, want %x", have, want)
+	}
+}
+
 // TestCopyOfCopy tests that modified objects are carried over to the copy, and the copy of the copy.
 // See https://github.com/ethereum/go-ethereum/pull/15225#issuecomment-380191512
 func TestCopyOfCopy(t *testing.T) {
@@ -727,3 +799,971 @@ func TestMissingTrieNodes(t *testing.T) {
 		t.Fatalf("expected error, got root :%x", root)
 	}
 }
+
+// Tests that the decoded state objects are retained across blocks, along with
+// the committed storage slots, and invalidated once the accounts are modified.
+func TestObjectCache(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(common.Hash{}, db, nil)
+
+	addr := toAddr([]byte("hot"))
+	state.SetBalance(addr, big.NewInt(1))
+	state.SetState(addr, common.Hash{0x1}, common.Hash{0x1})
+	root, _ := state.Commit(false)
+
+	// Open the next block, the object should be resolved from the cache with
+	// the committed slot warmed up already.
+	state, _ = New(root, db, nil)
+	obj := state.getStateObject(addr)
+	if obj == nil {
+		t.Fatalf("account is missing")
+	}
+	if val, ok := obj.originStorage[common.Hash{0x1}]; !ok || val != (common.Hash{0x1}) {
+		t.Fatalf("storage slot is not cached, got %x", val)
+	}
+	if balance := state.GetBalance(addr); balance.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("balance mismatch, want %d, got %d", 1, balance)
+	}
+	// Modify the account, the cached object of the old version should not
+	// be served to the new version.
+	state.SetBalance(addr, big.NewInt(2))
+	state.SetState(addr, common.Hash{0x1}, common.Hash{0x2})
+	root, _ = state.Commit(false)
+
+	state, _ = New(root, db, nil)
+	if val := state.GetState(addr, common.Hash{0x1}); val != (common.Hash{0x2}) {
+		t.Fatalf("storage slot mismatch, want %x, got %x", common.Hash{0x2}, val)
+	}
+	if balance := state.GetBalance(addr); balance.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("balance mismatch, want %d, got %d", 2, balance)
+	}
+	// Mutating the live object must not leak into the cache
+	state.GetOrNewStateObject(addr).data.Balance.SetUint64(100)
+
+	state, _ = New(root, db, nil)
+	if balance := state.GetBalance(addr); balance.Cmp(big.NewInt(2)) != 0 {
+		t.Fatalf("balance mismatch, want %d, got %d", 2, balance)
+	}
+}
+
+// Tests that the balance changes are tracked correctly, including reverted
+// changes, new and destructed accounts.
+func TestBalanceChanges(t *testing.T) {
+	var (
+		addrA = common.Address{0x0a}
+		addrB = common.Address{0x0b}
+		addrC = common.Address{0x0c}
+		addrD = common.Address{0x0d}
+		addrE = common.Address{0x0e}
+	)
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	state.SetBalance(addrA, big.NewInt(10))
+	state.SetBalance(addrD, big.NewInt(4))
+	root, _ := state.Commit(false)
+
+	state, _ = New(root, state.Database(), nil)
+	if changes := state.BalanceChanges(); changes != nil {
+		t.Fatalf("untracked balance changes returned: %v", changes)
+	}
+	state.TrackBalanceChanges()
+
+	// Transfer from A to B, destruct D and credit C in a reverted call
+	state.SubBalance(addrA, big.NewInt(3))
+	state.AddBalance(addrB, big.NewInt(3))
+	state.Suicide(addrD)
+
+	snap := state.Snapshot()
+	state.SubBalance(addrA, big.NewInt(1))
+	state.AddBalance(addrC, big.NewInt(1))
+	state.RevertToSnapshot(snap)
+
+	// Touch E without changing its balance
+	state.AddBalance(addrE, new(big.Int))
+	state.Finalise(true)
+
+	want := map[common.Address]*big.Int{
+		addrA: big.NewInt(-3),
+		addrB: big.NewInt(3),
+		addrD: big.NewInt(-4),
+	}
+	if changes := state.BalanceChanges(); !reflect.DeepEqual(changes, want) {
+		t.Fatalf("balance changes mismatch: have %v, want %v", changes, want)
+	}
+	if changes := state.Copy().BalanceChanges(); !reflect.DeepEqual(changes, want) {
+		t.Fatalf("copied balance changes mismatch: have %v, want %v", changes, want)
+	}
+}
+
+// Tests that the concurrent storage root hashing in IntermediateRoot produces
+// the same results as the serial one.
+func TestIntermediateRootConcurrency(t *testing.T) {
+	// populate creates a state with the same storage heavy accounts, returning
+	// the intermediate root and the growth computed with the given hashing mode.
+	populate := func(serial bool) (common.Hash, StateGrowth) {
+		defer func(old bool) { metrics.EnabledExpensive = old }(metrics.EnabledExpensive)
+		metrics.EnabledExpensive = serial
+
+		state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+		for i := byte(0); i < 64; i++ {
+			addr := common.BytesToAddress([]byte{i})
+			state.AddBalance(addr, big.NewInt(int64(i)+1))
+			for j := byte(0); j < i%8; j++ {
+				state.SetState(addr, common.BytesToHash([]byte{j}), common.BytesToHash([]byte{i, j}))
+			}
+		}
+		state.Suicide(common.BytesToAddress([]byte{3}))
+		return state.IntermediateRoot(true), state.StateGrowth()
+	}
+	haveRoot, haveGrowth := populate(false)
+	wantRoot, wantGrowth := populate(true)
+	if haveRoot != wantRoot {
+		t.Fatalf("root mismatch: have %x, want %x", haveRoot, wantRoot)
+	}
+	if haveGrowth != wantGrowth {
+		t.Fatalf("growth mismatch: have %+v, want %+v", haveGrowth, wantGrowth)
+	}
+}
+
+// Tests that the database errors hit by the storage tries hashed concurrently
+// in IntermediateRoot are surfaced by the state.
+func TestIntermediateRootConcurrentErrors(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	state, _ := New(common.Hash{}, NewDatabase(diskdb), nil)
+	for i := byte(1); i <= 8; i++ {
+		addr := common.BytesToAddress([]byte{i})
+		for j := byte(1); j <= 4; j++ {
+			state.SetState(addr, common.BytesToHash([]byte{j}), common.BytesToHash([]byte{i, j}))
+		}
+	}
+	root, _ := state.Commit(false)
+	state.Database().TrieDB().Commit(root, false)
+
+	// Drop the storage trie root of one account from the database
+	broken := common.BytesToAddress([]byte{4})
+	diskdb.Delete(state.getStateObject(broken).data.Root.Bytes())
+
+	state, _ = New(root, NewDatabase(diskdb), nil)
+	for i := byte(1); i <= 8; i++ {
+		state.SetState(common.BytesToAddress([]byte{i}), common.Hash{0xff}, common.Hash{0xff})
+	}
+	state.IntermediateRoot(false)
+	if err := state.Error(); err == nil {
+		t.Fatalf("missing storage trie node not reported")
+	}
+}
+
+// Tests that the database errors hit by reading the storage of an account are
+// surfaced by the state, even if the account is never written.
+func TestStorageReadErrors(t *testing.T) {
+	diskdb := rawdb.NewMemoryDatabase()
+	state, _ := New(common.Hash{}, NewDatabase(diskdb), nil)
+	addr := common.BytesToAddress([]byte{1})
+	state.SetState(addr, common.Hash{0x01}, common.Hash{0x01})
+	root, _ := state.Commit(false)
+	state.Database().TrieDB().Commit(root, false)
+
+	// Drop the storage trie root of the account from the database
+	diskdb.Delete(state.getStateObject(addr).data.Root.Bytes())
+
+	state, _ = New(root, NewDatabase(diskdb), nil)
+	state.GetState(addr, common.Hash{0x01})
+	if err := state.Error(); err == nil {
+		t.Fatalf("missing storage trie node not reported")
+	}
+}
+
+// Tests that the pending storage root of an account reflects all the storage
+// changes of the block, without flushing them into the storage trie.
+func TestPendingStorageRoot(t *testing.T) {
+	addr := common.Address{0x01}
+
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	state.SetState(addr, common.Hash{0x01}, common.Hash{0x01})
+	state.SetState(addr, common.Hash{0x02}, common.Hash{0x02})
+	root, _ := state.Commit(false)
+
+	state, _ = New(root, state.Database(), nil)
+	committed := state.PendingStorageRoot(addr)
+	if committed == emptyRoot {
+		t.Fatalf("committed storage root not resolved")
+	}
+	if root := state.PendingStorageRoot(common.Address{0x02}); root != emptyRoot {
+		t.Fatalf("non-existent account storage root mismatch: have %x, want %x", root, emptyRoot)
+	}
+	// expected computes the storage root by finalising a copy of the state
+	expected := func() common.Hash {
+		cpy := state.Copy()
+		cpy.IntermediateRoot(false)
+		return cpy.getStateObject(addr).data.Root
+	}
+	// Modify one slot in a finalised transaction and one in the current one
+	state.SetState(addr, common.Hash{0x01}, common.Hash{})
+	state.Finalise(false)
+	state.SetState(addr, common.Hash{0x03}, common.Hash{0x03})
+
+	pending := state.PendingStorageRoot(addr)
+	if want := expected(); pending != want {
+		t.Fatalf("pending storage root mismatch: have %x, want %x", pending, want)
+	}
+	if obj := state.getStateObject(addr); len(obj.pendingStorage) != 1 || len(obj.dirtyStorage) != 1 {
+		t.Fatalf("storage changes flushed: %d pending, %d dirty", len(obj.pendingStorage), len(obj.dirtyStorage))
+	}
+	// Ensure writes and reverts invalidate the cached root
+	snap := state.Snapshot()
+	state.SetState(addr, common.Hash{0x04}, common.Hash{0x04})
+	if root := state.PendingStorageRoot(addr); root == pending {
+		t.Fatalf("pending storage root not updated after write")
+	}
+	state.RevertToSnapshot(snap)
+	if root := state.PendingStorageRoot(addr); root != pending {
+		t.Fatalf("pending storage root mismatch after revert: have %x, want %x", root, pending)
+	}
+	if root := state.IntermediateRoot(false); root == (common.Hash{}) {
+		t.Fatalf("failed to hash state")
+	}
+	if root := state.PendingStorageRoot(addr); root != pending {
+		t.Fatalf("pending storage root mismatch after flush: have %x, want %x", root, pending)
+	}
+}
+
+// Tests that the state diff contains the pre and post images of all the accounts
+// and storage slots accessed since the tracking started.
+func TestStateDiff(t *testing.T) {
+	var (
+		addrA = common.Address{0x0a}
+		addrB = common.Address{0x0b}
+		slot1 = common.Hash{0x01}
+		slot2 = common.Hash{0x02}
+	)
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	state.SetBalance(addrA, big.NewInt(10))
+	state.SetCode(addrA, []byte{0x60})
+	state.SetState(addrA, slot1, common.Hash{0x01})
+	state.SetState(addrA, slot2, common.Hash{0x02})
+	root, _ := state.Commit(false)
+
+	state, _ = New(root, state.Database(), nil)
+	if diff := state.StateDiff(); diff != nil {
+		t.Fatalf("untracked state diff returned: %v", diff)
+	}
+	state.TrackStateDiff()
+
+	state.SubBalance(addrA, big.NewInt(3))
+	state.AddBalance(addrB, big.NewInt(3))
+	state.SetNonce(addrA, 1)
+	state.SetState(addrA, slot1, common.Hash{0x05})
+	state.GetState(addrA, slot2)
+
+	diff := state.StateDiff()
+	want := &StateDiff{
+		Pre: map[common.Address]*AccountState{
+			addrA: {Balance: big.NewInt(10), Code: []byte{0x60}, Storage: map[common.Hash]common.Hash{slot1: {0x01}, slot2: {0x02}}},
+			addrB: nil,
+		},
+		Post: map[common.Address]*AccountState{
+			addrA: {Balance: big.NewInt(7), Nonce: 1, Code: []byte{0x60}, Storage: map[common.Hash]common.Hash{slot1: {0x05}, slot2: {0x02}}},
+			addrB: {Balance: big.NewInt(3), Storage: map[common.Hash]common.Hash{}},
+		},
+	}
+	if !reflect.DeepEqual(diff, want) {
+		t.Fatalf("state diff mismatch:\nhave %s\nwant %s", spew.Sdump(diff), spew.Sdump(want))
+	}
+	// Restart the tracking and ensure the pre-images reflect the current state
+	state.TrackStateDiff()
+	state.GetBalance(addrA)
+	if pre := state.StateDiff().Pre[addrA]; pre.Balance.Cmp(big.NewInt(7)) != 0 {
+		t.Fatalf("restarted pre-image balance mismatch: have %v, want %v", pre.Balance, 7)
+	}
+	// Re-create the account and ensure the slot pre-images are still read from
+	// the original storage, not the wiped one
+	state.CreateAccount(addrA)
+	state.GetState(addrA, slot1)
+	state.SetState(addrA, slot2, common.Hash{0x06})
+
+	pre := state.StateDiff().Pre[addrA]
+	if want := (map[common.Hash]common.Hash{slot1: {0x05}, slot2: {0x02}}); !reflect.DeepEqual(pre.Storage, want) {
+		t.Fatalf("re-created slot pre-images mismatch: have %v, want %v", pre.Storage, want)
+	}
+}
+
+// Tests that applying a state diff on top of its pre state yields the root of
+// the post state, without modifying the database.
+func TestApplyStateDiff(t *testing.T) {
+	var (
+		db    = NewDatabase(rawdb.NewMemoryDatabase())
+		addrA = common.Address{0x0a}
+		addrB = common.Address{0x0b}
+		addrC = common.Address{0x0c}
+		addrD = common.Address{0x0d}
+	)
+	state, _ := New(common.Hash{}, db, nil)
+	state.SetBalance(addrA, big.NewInt(10))
+	state.SetState(addrA, common.Hash{0x01}, common.Hash{0x01})
+	state.SetBalance(addrC, big.NewInt(1))
+	state.SetState(addrD, common.Hash{0x01}, common.Hash{0x01})
+	state.SetState(addrD, common.Hash{0x02}, common.Hash{0x02})
+	root, _ := state.Commit(false)
+
+	state, _ = New(root, db, nil)
+	state.TrackStateDiff()
+	state.SubBalance(addrA, big.NewInt(3))
+	state.SetState(addrA, common.Hash{0x01}, common.Hash{})
+	state.SetState(addrA, common.Hash{0x02}, common.Hash{0x02})
+	state.SetCode(addrB, []byte{0x60})
+	state.Suicide(addrC)
+	state.Suicide(addrD)
+	state.Finalise(false)
+
+	// Re-create a destructed account, its old storage must not leak into the diff
+	state.SetState(addrD, common.Hash{0x03}, common.Hash{0x03})
+	state.Finalise(false)
+	diff := state.StateDiff()
+	if _, ok := diff.Reset[addrD]; !ok {
+		t.Fatalf("re-created account not marked as reset")
+	}
+	want := state.IntermediateRoot(false)
+
+	size, _ := db.TrieDB().Size()
+	if err := VerifyStateDiff(db, root, want, diff, false); err != nil {
+		t.Fatalf("failed to verify state diff: %v", err)
+	}
+	if err := VerifyStateDiff(db, root, root, diff, false); err == nil {
+		t.Fatalf("mismatching root accepted")
+	}
+	if have, _ := db.TrieDB().Size(); have != size {
+		t.Fatalf("trie database modified: size %v, want %v", have, size)
+	}
+	if _, err := ApplyStateDiff(db, common.Hash{0x01}, diff, false); err == nil {
+		t.Fatalf("state diff applied on missing state")
+	}
+}
+
+// Tests that the reads falling back from the snapshot to the tries are counted
+// and classified.
+func TestSnapshotFallbacks(t *testing.T) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		sdb   = NewDatabase(db)
+		addrA = common.Address{0xa}
+		addrB = common.Address{0xb}
+	)
+	state, _ := New(common.Hash{}, sdb, nil)
+	state.SetBalance(addrA, big.NewInt(1))
+	state.SetState(addrA, common.Hash{0x01}, common.Hash{0x11})
+	state.SetBalance(addrB, big.NewInt(2))
+	root, _ := state.Commit(false)
+	sdb.TrieDB().Commit(root, false)
+
+	snaps := snapshot.New(db, sdb.TrieDB(), 16, root, false)
+
+	// Reads served by the snapshot shouldn't count as fallbacks
+	state, _ = New(root, sdb, snaps)
+	state.GetBalance(addrA)
+	state.GetState(addrA, common.Hash{0x01})
+	if have, want := state.SnapshotFallbacks(), (SnapshotFallbacks{Reads: 2}); have != want {
+		t.Errorf("healthy fallbacks mismatch: have %+v, want %+v", have, want)
+	}
+	// Reads from a stale snapshot layer should count as stale fallbacks
+	snaps.Rebuild(root)
+	state.GetState(addrA, common.Hash{0x02})
+	state.GetBalance(addrB)
+	if have, want := state.SnapshotFallbacks(), (SnapshotFallbacks{Reads: 4, Stale: 2}); have != want {
+		t.Errorf("stale fallbacks mismatch: have %+v, want %+v", have, want)
+	}
+	// Reads of a state without snapshot layer should count as missing fallbacks
+	state, _ = New(root, sdb, snapshot.New(rawdb.NewMemoryDatabase(), sdb.TrieDB(), 16, common.Hash{}, false))
+	state.GetBalance(addrA)
+	if have, want := state.SnapshotFallbacks(), (SnapshotFallbacks{Reads: 1, Missing: 1}); have != want {
+		t.Errorf("missing fallbacks mismatch: have %+v, want %+v", have, want)
+	}
+	if rate := state.SnapshotFallbacks().Rate(); rate != 1 {
+		t.Errorf("fallback rate mismatch: have %v, want %v", rate, 1)
+	}
+}
+
+// Tests that the state growth is accounted for the accounts, slots, code and
+// trie nodes added and deleted by a commit.
+func TestStateGrowth(t *testing.T) {
+	var (
+		sdb   = NewDatabase(rawdb.NewMemoryDatabase())
+		addrA = common.Address{0xa}
+		addrB = common.Address{0xb}
+		code  = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	)
+	state, _ := New(common.Hash{}, sdb, nil)
+	state.SetBalance(addrA, big.NewInt(1))
+	state.SetState(addrA, common.Hash{0x01}, common.BigToHash(big.NewInt(0x11)))
+	state.SetState(addrA, common.Hash{0x02}, common.BigToHash(big.NewInt(0x1122)))
+	state.SetCode(addrB, code)
+	root, _ := state.Commit(false)
+
+	growth := state.StateGrowth()
+	if growth.Accounts != 2 || growth.Slots != 2 || growth.Code != common.StorageSize(len(code)) {
+		t.Fatalf("creation growth mismatch: %+v", growth)
+	}
+	if growth.TrieNodes == 0 {
+		t.Fatalf("trie node growth not tracked")
+	}
+	slots := common.StorageSize(2*common.HashLength + 1 + 3)
+	if accounts := growth.FlatState - slots; accounts <= 2*common.HashLength {
+		t.Fatalf("flat state growth mismatch: have %v, want more than %v", growth.FlatState, slots+2*common.HashLength)
+	}
+	// Delete a slot, shrink another and destruct an account in a new block
+	state, _ = New(root, sdb, nil)
+	state.SetState(addrA, common.Hash{0x01}, common.Hash{})
+	state.SetState(addrA, common.Hash{0x02}, common.BigToHash(big.NewInt(0x22)))
+	state.Suicide(addrB)
+	state.Commit(true)
+
+	growth = state.StateGrowth()
+	if growth.Accounts != -1 || growth.Slots != -1 || growth.Code != 0 {
+		t.Fatalf("deletion growth mismatch: %+v", growth)
+	}
+	if growth.FlatState >= -(common.HashLength + 1 + 1) {
+		t.Fatalf("flat state shrinkage mismatch: have %v", growth.FlatState)
+	}
+	// Rewriting the same values shouldn't grow anything
+	state, _ = New(root, sdb, nil)
+	state.SetState(addrA, common.Hash{0x01}, common.BigToHash(big.NewInt(0x11)))
+	state.Commit(false)
+
+	if growth = state.StateGrowth(); growth != (StateGrowth{}) {
+		t.Fatalf("noop growth mismatch: %+v", growth)
+	}
+}
+
+// Tests that the account tries are shared between the states opened on the same
+// root without the modifications of one leaking into the other.
+func TestReaderPool(t *testing.T) {
+	db := NewDatabase(rawdb.NewMemoryDatabase())
+	state, _ := New(common.Hash{}, db, nil)
+
+	addr := toAddr([]byte("shared"))
+	state.SetBalance(addr, big.NewInt(1))
+	root, _ := state.Commit(false)
+
+	pool := db.(*cachingDB).readers
+	stateA, _ := New(root, db, nil)
+	if _, ok := pool.tries.Get(root); !ok {
+		t.Fatalf("account trie of %x not pooled", root)
+	}
+	stateB, _ := New(root, db, nil)
+
+	// Modify one of the states, the other one should not be affected
+	stateA.SetBalance(addr, big.NewInt(2))
+	stateA.SetBalance(toAddr([]byte("fresh")), big.NewInt(3))
+	if _, err := stateA.Commit(false); err != nil {
+		t.Fatalf("failed to commit state: %v", err)
+	}
+	if balance := stateB.GetBalance(addr); balance.Cmp(big.NewInt(1)) != 0 {
+		t.Fatalf("balance mismatch, want %d, got %d", 1, balance)
+	}
+	if hash := stateB.IntermediateRoot(false); hash != root {
+		t.Fatalf("root mismatch, want %x, got %x", root, hash)
+	}
+	// Release the root and ensure the trie is dropped from the pool
+	db.ReleaseTrie(root)
+	if _, ok := pool.tries.Get(root); ok {
+		t.Fatalf("account trie of %x not released", root)
+	}
+}
+
+// Tests that the code of the called contracts is loaded into the code cache by
+// the prefetcher, and nothing is loaded once it's interrupted.
+func TestPrefetchCode(t *testing.T) {
+	db := NewDatabaseWithCache(rawdb.NewMemoryDatabase(), 16)
+	state, _ := New(common.Hash{}, db, nil)
+
+	var (
+		addrA = common.Address{0xa}
+		addrB = common.Address{0xb}
+		addrC = common.Address{0xc}
+		code  = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	)
+	state.SetCode(addrA, code)
+	state.SetBalance(addrB, big.NewInt(1))
+	root, _ := state.Commit(false)
+	db.TrieDB().Commit(root, false)
+
+	cache := db.(*cachingDB).codeSizeCache
+	codeHash := crypto.Keccak256Hash(code)
+
+	var interrupt uint32 = 1
+	PrefetchCode(db, nil, root, []common.Address{addrA, addrB, addrC}, &interrupt)
+	if cache.Contains(codeHash) {
+		t.Fatalf("code loaded by interrupted prefetcher")
+	}
+	interrupt = 0
+	PrefetchCode(db, nil, root, []common.Address{addrA, addrB, addrC, addrA}, &interrupt)
+	if size, ok := cache.Get(codeHash); !ok || size.(int) != len(code) {
+		t.Fatalf("code not prefetched: have %v/%v, want %d", size, ok, len(code))
+	}
+	if cache.Len() != 1 {
+		t.Fatalf("unexpected code loaded: have %d items, want 1", cache.Len())
+	}
+}
+
+// Tests that failed code lookups are cached until they expire or the code gets
+// committed, and that the code cache is shared between databases.
+func TestCodeCacheNegative(t *testing.T) {
+	var (
+		diskdb = rawdb.NewMemoryDatabase()
+		db     = NewDatabase(diskdb)
+		shared = NewDatabaseWithCodeCache(diskdb, 0, db.CodeCache())
+		code   = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+		hash   = crypto.Keccak256Hash(code)
+	)
+	if _, err := db.ContractCode(common.Hash{}, hash); err == nil {
+		t.Fatalf("missing code returned")
+	}
+	// Write the code behind the back of the cache, ensure the miss is retained
+	diskdb.Put(hash[:], code)
+	if _, err := shared.ContractCode(common.Hash{}, hash); err == nil {
+		t.Fatalf("cached code miss not served")
+	}
+	// Expire the miss and ensure the code is looked up again
+	db.CodeCache().ttl = 0
+	if have, err := shared.ContractCode(common.Hash{}, hash); err != nil || !bytes.Equal(have, code) {
+		t.Fatalf("expired code miss served: %x, %v", have, err)
+	}
+	// Ensure committed codes replace the cached misses
+	code2 := []byte{0x60, 0x01}
+	db.CodeCache().ttl = time.Hour
+	if _, err := db.ContractCode(common.Hash{}, crypto.Keccak256Hash(code2)); err == nil {
+		t.Fatalf("missing code returned")
+	}
+	state, _ := New(common.Hash{}, db, nil)
+	state.SetCode(common.Address{0xa}, code2)
+	state.Commit(false)
+	if have, err := shared.ContractCode(common.Hash{}, crypto.Keccak256Hash(code2)); err != nil || !bytes.Equal(have, code2) {
+		t.Fatalf("committed code mismatch: %x, %v", have, err)
+	}
+}
+
+// Tests that the code of the hinted accounts, slotted ones included, is loaded
+// by the hint prefetcher, and nothing is loaded once it's interrupted.
+func TestPrefetchState(t *testing.T) {
+	db := NewDatabaseWithCache(rawdb.NewMemoryDatabase(), 16)
+	state, _ := New(common.Hash{}, db, nil)
+
+	var (
+		addrA = common.Address{0xa}
+		addrB = common.Address{0xb}
+		codeA = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+		codeB = []byte{0x60, 0x01, 0x60, 0x00, 0xf3}
+	)
+	state.SetCode(addrA, codeA)
+	state.SetCode(addrB, codeB)
+	state.SetState(addrB, common.Hash{0x1}, common.Hash{0x2})
+	root, _ := state.Commit(false)
+	db.TrieDB().Commit(root, false)
+
+	hints := &PrefetchHints{
+		Accounts: []common.Address{addrA, {0xc}},
+		Slots: map[common.Address][]common.Hash{
+			addrB: {{0x1}, {0x3}},
+			{0xd}: {{0x1}},
+		},
+	}
+	cache := db.(*cachingDB).codeSizeCache
+
+	var interrupt uint32 = 1
+	PrefetchState(db, nil, root, hints, &interrupt)
+	if cache.Len() != 0 {
+		t.Fatalf("code loaded by interrupted prefetcher")
+	}
+	interrupt = 0
+	PrefetchState(db, nil, root, hints, &interrupt)
+	for _, code := range [][]byte{codeA, codeB} {
+		if size, ok := cache.Get(crypto.Keccak256Hash(code)); !ok || size.(int) != len(code) {
+			t.Fatalf("code not prefetched: have %v/%v, want %d", size, ok, len(code))
+		}
+	}
+	if cache.Len() != 2 {
+		t.Fatalf("unexpected code loaded: have %d items, want 2", cache.Len())
+	}
+}
+
+// Tests that a state can be reset to a fork repeatedly, undoing all the changes
+// made since, until the changes are finalised.
+func TestStateFork(t *testing.T) {
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+
+	addr := common.Address{0x1}
+	state.SetBalance(addr, big.NewInt(1))
+	state.SetState(addr, common.Hash{0x1}, common.Hash{0x1})
+	root := state.IntermediateRoot(false)
+
+	fork := state.Fork()
+	for i := 0; i < 3; i++ {
+		if err := fork.Reset(); err != nil {
+			t.Fatalf("run %d: failed to reset: %v", i, err)
+		}
+		if balance := state.GetBalance(addr); balance.Cmp(big.NewInt(1)) != 0 {
+			t.Fatalf("run %d: balance mismatch: have %v, want %v", i, balance, 1)
+		}
+		if val := state.GetState(addr, common.Hash{0x1}); val != (common.Hash{0x1}) {
+			t.Fatalf("run %d: storage mismatch: have %x, want %x", i, val, common.Hash{0x1})
+		}
+		if len(state.Logs()) != 0 || state.GetRefund() != 0 {
+			t.Fatalf("run %d: leftover logs %d, refund %d", i, len(state.Logs()), state.GetRefund())
+		}
+		state.Prepare(common.Hash{0xaa}, common.Hash{0xbb}, i)
+		state.SetBalance(addr, big.NewInt(int64(i+2)))
+		state.SetState(addr, common.Hash{0x1}, common.Hash{byte(i + 2)})
+		state.SetCode(common.Address{0x2}, []byte{0x1})
+		state.AddLog(&types.Log{Address: addr})
+		state.AddRefund(100)
+	}
+	if err := fork.Reset(); err != nil {
+		t.Fatalf("failed to reset: %v", err)
+	}
+	if hash := state.IntermediateRoot(false); hash != root {
+		t.Fatalf("root mismatch after reset: have %x, want %x", hash, root)
+	}
+	// Finalised changes can't be undone anymore
+	state.SetBalance(addr, big.NewInt(5))
+	state.Finalise(false)
+	if err := fork.Reset(); err != errForkFinalised {
+		t.Fatalf("reset error mismatch: have %v, want %v", err, errForkFinalised)
+	}
+}
+
+// Tests that the state reader serves the accounts and slots both by address and
+// by hash, with and without a snapshot.
+func TestReader(t *testing.T) {
+	var (
+		db   = rawdb.NewMemoryDatabase()
+		sdb  = NewDatabase(db)
+		addr = common.Address{0xa}
+		slot = common.Hash{0x01}
+	)
+	state, _ := New(common.Hash{}, sdb, nil)
+	state.SetBalance(addr, big.NewInt(1))
+	state.SetState(addr, slot, common.Hash{0x11})
+	root, _ := state.Commit(false)
+	sdb.TrieDB().Commit(root, false)
+
+	snaps := snapshot.New(db, sdb.TrieDB(), 16, root, false)
+	for i, snaps := range []*snapshot.Tree{nil, snaps} {
+		reader, err := StateReaderAt(sdb, snaps, root, 0)
+		if err != nil {
+			t.Fatalf("test %d: failed to create reader: %v", i, err)
+		}
+		acc, err := reader.AccountByHash(crypto.Keccak256Hash(addr[:]))
+		if err != nil || acc == nil || acc.Balance.Cmp(big.NewInt(1)) != 0 {
+			t.Fatalf("test %d: account by hash mismatch: %v, %v", i, acc, err)
+		}
+		if acc, err := reader.Account(common.Address{0xb}); acc != nil || err != nil {
+			t.Fatalf("test %d: missing account mismatch: %v, %v", i, acc, err)
+		}
+		val, err := reader.StorageByHashes(crypto.Keccak256Hash(addr[:]), crypto.Keccak256Hash(slot[:]))
+		if err != nil || val != (common.Hash{0x11}) {
+			t.Fatalf("test %d: slot by hashes mismatch: %x, %v", i, val, err)
+		}
+		if val, err := reader.Storage(addr, common.Hash{0x02}); val != (common.Hash{}) || err != nil {
+			t.Fatalf("test %d: missing slot mismatch: %x, %v", i, val, err)
+		}
+		// Ensure the address based getters are served too
+		if balance, err := reader.GetBalance(addr); err != nil || balance.Cmp(big.NewInt(1)) != 0 {
+			t.Fatalf("test %d: balance mismatch: %v, %v", i, balance, err)
+		}
+		if val, err := reader.GetState(addr, slot); err != nil || val != (common.Hash{0x11}) {
+			t.Fatalf("test %d: state mismatch: %x, %v", i, val, err)
+		}
+		if code, err := reader.GetCode(addr); err != nil || code != nil {
+			t.Fatalf("test %d: code mismatch: %x, %v", i, code, err)
+		}
+	}
+	// Ensure the reader falls back to the tries if the snapshot becomes stale
+	reader, _ := StateReaderAt(sdb, snaps, root, 0)
+	snaps.Rebuild(root)
+	if val, err := reader.Storage(addr, slot); err != nil || val != (common.Hash{0x11}) {
+		t.Fatalf("stale snapshot slot mismatch: %x, %v", val, err)
+	}
+	// Ensure missing states are rejected
+	if _, err := StateReaderAt(sdb, nil, common.Hash{0x01}, 0); err == nil {
+		t.Fatalf("reader created for missing state")
+	}
+	if _, err := StateReaderAt(sdb, nil, common.Hash{0x01}, 7); err == nil || !strings.Contains(err.Error(), "#7") {
+		t.Fatalf("missing state error mismatch: %v", err)
+	}
+}
+
+// Tests that storage and code lookups of accounts known to have neither are
+// answered without touching the tries or the database.
+func TestEmptyStorageShortCircuit(t *testing.T) {
+	var (
+		db   = rawdb.NewMemoryDatabase()
+		sdb  = NewDatabase(db)
+		addr = common.Address{0xa}
+	)
+	state, _ := New(common.Hash{}, sdb, nil)
+	state.SetBalance(addr, big.NewInt(1))
+	root, _ := state.Commit(false)
+	sdb.TrieDB().Commit(root, false)
+
+	state, _ = New(root, sdb, nil)
+	if val := state.GetState(addr, common.Hash{0x01}); val != (common.Hash{}) {
+		t.Fatalf("slot mismatch: have %x, want zero", val)
+	}
+	if obj := state.getStateObject(addr); obj.trie != nil {
+		t.Fatalf("storage trie opened for account without storage")
+	}
+	if code, err := sdb.ContractCode(common.Hash{}, emptyCode); code != nil || err != nil {
+		t.Fatalf("empty code mismatch: %x, %v", code, err)
+	}
+	if size, err := sdb.ContractCodeSize(common.Hash{}, emptyCode); size != 0 || err != nil {
+		t.Fatalf("empty code size mismatch: %d, %v", size, err)
+	}
+	reader, err := StateReaderAt(sdb, nil, root, 0)
+	if err != nil {
+		t.Fatalf("failed to create reader: %v", err)
+	}
+	for _, addr := range []common.Address{addr, {0xb}} {
+		if val, err := reader.Storage(addr, common.Hash{0x01}); val != (common.Hash{}) || err != nil {
+			t.Fatalf("reader slot of %x mismatch: %x, %v", addr, val, err)
+		}
+		if tr := reader.storages[crypto.Keccak256Hash(addr[:])]; tr != nil {
+			t.Fatalf("reader opened storage trie of %x without storage", addr)
+		}
+	}
+}
+
+// Tests that the proofs assembled by the reader are verifiable against the state
+// root and carry the proven content.
+func TestReaderProof(t *testing.T) {
+	var (
+		sdb   = NewDatabase(rawdb.NewMemoryDatabase())
+		addr  = common.Address{0xa}
+		code  = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+		slots = []common.Hash{{0x01}, {0x02}}
+	)
+	state, _ := New(common.Hash{}, sdb, nil)
+	state.SetNonce(addr, 3)
+	state.SetBalance(addr, big.NewInt(7))
+	state.SetCode(addr, code)
+	state.SetState(addr, slots[0], common.Hash{0x11})
+	root, _ := state.Commit(false)
+
+	verify := func(root common.Hash, key []byte, proof [][]byte) []byte {
+		db := memorydb.New()
+		for _, node := range proof {
+			db.Put(crypto.Keccak256(node), node)
+		}
+		val, err := trie.VerifyProof(root, crypto.Keccak256(key), db)
+		if err != nil {
+			t.Fatalf("invalid proof of %x: %v", key, err)
+		}
+		return val
+	}
+	reader, _ := StateReaderAt(sdb, nil, root, 0)
+	for i, withCode := range []bool{false, true} {
+		proof, err := reader.Proof(addr, slots, withCode)
+		if err != nil {
+			t.Fatalf("test %d: failed to prove account: %v", i, err)
+		}
+		if verify(root, addr[:], proof.Proof) == nil {
+			t.Fatalf("test %d: account proven missing", i)
+		}
+		if proof.Nonce != 3 || proof.Balance.Cmp(big.NewInt(7)) != 0 || proof.CodeHash != crypto.Keccak256Hash(code) || proof.CodeSize != len(code) {
+			t.Fatalf("test %d: account mismatch: %+v", i, proof)
+		}
+		if withCode != (proof.Code != nil) || (withCode && !bytes.Equal(proof.Code, code)) {
+			t.Fatalf("test %d: code mismatch: have %x", i, proof.Code)
+		}
+		if proof.Storage[0].Value != (common.Hash{0x11}) || verify(proof.StorageRoot, slots[0][:], proof.Storage[0].Proof) == nil {
+			t.Fatalf("test %d: existing slot mismatch: %+v", i, proof.Storage[0])
+		}
+		if proof.Storage[1].Value != (common.Hash{}) || verify(proof.StorageRoot, slots[1][:], proof.Storage[1].Proof) != nil {
+			t.Fatalf("test %d: missing slot mismatch: %+v", i, proof.Storage[1])
+		}
+	}
+	// Ensure missing accounts are proven absent
+	proof, err := reader.Proof(common.Address{0xb}, slots, true)
+	if err != nil {
+		t.Fatalf("failed to prove missing account: %v", err)
+	}
+	if verify(root, common.Address{0xb}.Bytes(), proof.Proof) != nil || proof.StorageRoot != emptyRoot || len(proof.Storage) != len(slots) {
+		t.Fatalf("missing account mismatch: %+v", proof)
+	}
+	// Ensure uncommitted but hashed modifications are proven by the state reader
+	state, _ = New(root, sdb, nil)
+	state.SetState(addr, slots[1], common.Hash{0x22})
+	pending := state.IntermediateRoot(false)
+
+	proof, err = state.Reader().Proof(addr, slots[1:], false)
+	if err != nil {
+		t.Fatalf("failed to prove pending state: %v", err)
+	}
+	if proof.Storage[0].Value != (common.Hash{0x22}) || verify(proof.StorageRoot, slots[1][:], proof.Storage[0].Proof) == nil {
+		t.Fatalf("pending slot mismatch: %+v", proof.Storage[0])
+	}
+	verify(pending, addr[:], proof.Proof)
+}
+
+// Tests that the read-only state serves consistent data to concurrent users.
+func TestReadOnlyState(t *testing.T) {
+	var (
+		db    = rawdb.NewMemoryDatabase()
+		sdb   = NewDatabase(db)
+		addrs = make([]common.Address, 16)
+		code  = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	)
+	state, _ := New(common.Hash{}, sdb, nil)
+	for i := range addrs {
+		addrs[i] = common.Address{byte(i + 1)}
+		state.SetNonce(addrs[i], uint64(i))
+		state.SetBalance(addrs[i], big.NewInt(int64(i+1)))
+		state.SetState(addrs[i], common.Hash{0x01}, common.Hash{byte(i + 1)})
+	}
+	state.SetCode(addrs[0], code)
+	root, _ := state.Commit(false)
+	sdb.TrieDB().Commit(root, false)
+
+	snaps := snapshot.New(db, sdb.TrieDB(), 16, root, false)
+	for i, snaps := range []*snapshot.Tree{nil, snaps} {
+		view, err := NewReadOnlyState(sdb, snaps, root)
+		if err != nil {
+			t.Fatalf("test %d: failed to create read-only state: %v", i, err)
+		}
+		var (
+			wg   sync.WaitGroup
+			errc = make(chan error, 8)
+		)
+		for j := 0; j < 8; j++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for k, addr := range addrs {
+					if nonce, err := view.GetNonce(addr); err != nil || nonce != uint64(k) {
+						errc <- fmt.Errorf("nonce mismatch of %x: %d, %v", addr, nonce, err)
+						return
+					}
+					if balance, err := view.GetBalance(addr); err != nil || balance.Int64() != int64(k+1) {
+						errc <- fmt.Errorf("balance mismatch of %x: %v, %v", addr, balance, err)
+						return
+					}
+					if value, err := view.GetState(addr, common.Hash{0x01}); err != nil || value != (common.Hash{byte(k + 1)}) {
+						errc <- fmt.Errorf("slot mismatch of %x: %x, %v", addr, value, err)
+						return
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		close(errc)
+		if err := <-errc; err != nil {
+			t.Fatalf("test %d: %v", i, err)
+		}
+		if have, err := view.GetCode(addrs[0]); err != nil || !bytes.Equal(have, code) {
+			t.Fatalf("test %d: code mismatch: %x, %v", i, have, err)
+		}
+		if size, err := view.GetCodeSize(addrs[1]); err != nil || size != 0 {
+			t.Fatalf("test %d: code size of codeless account mismatch: %d, %v", i, size, err)
+		}
+		missing := common.Address{0xff}
+		if ok, err := view.Exist(missing); ok || err != nil {
+			t.Fatalf("test %d: missing account exists: %v", i, err)
+		}
+		if balance, err := view.GetBalance(missing); err != nil || balance.Sign() != 0 {
+			t.Fatalf("test %d: missing account balance mismatch: %v, %v", i, balance, err)
+		}
+	}
+	// Ensure the readers retaining too many storage tries aren't pooled
+	view, _ := NewReadOnlyState(sdb, nil, root)
+	reader, _ := view.reader()
+	for i := 0; i <= readOnlyStorageLimit; i++ {
+		reader.storages[common.Hash{byte(i), byte(i >> 8)}] = nil
+	}
+	view.release(reader)
+	if pooled, _ := view.readers.Get().(*Reader); pooled == reader {
+		t.Fatalf("oversized reader pooled")
+	}
+	if _, err := NewReadOnlyState(sdb, nil, common.Hash{0x01}); err == nil {
+		t.Fatalf("read-only state created for missing state")
+	}
+}
+
+// Tests that delegated code is resolved a single hop deep, both from the live
+// state and from committed ones, and that delegation changes are picked up.
+func TestDelegationResolution(t *testing.T) {
+	var (
+		sdb      = NewDatabase(rawdb.NewMemoryDatabase())
+		eoa      = common.Address{0x1}
+		loop     = common.Address{0x2}
+		contract = common.Address{0x3}
+		other    = common.Address{0x4}
+		code     = []byte{0x60, 0x00, 0x60, 0x00, 0xf3}
+	)
+	state, _ := New(common.Hash{}, sdb, nil)
+	state.SetCode(eoa, AddressToDelegation(contract))
+	state.SetCode(loop, AddressToDelegation(eoa))
+	state.SetCode(contract, code)
+
+	if have := state.GetResolvedCode(eoa); !bytes.Equal(have, code) {
+		t.Fatalf("resolved code mismatch: have %x, want %x", have, code)
+	}
+	if have := state.GetResolvedCode(contract); !bytes.Equal(have, code) {
+		t.Fatalf("plain code mismatch: have %x, want %x", have, code)
+	}
+	if have, want := state.GetResolvedCode(loop), AddressToDelegation(contract); !bytes.Equal(have, want) {
+		t.Fatalf("chained delegation mismatch: have %x, want %x", have, want)
+	}
+	root, _ := state.Commit(false)
+
+	reader, _ := StateReaderAt(sdb, nil, root, 0)
+	if have, err := reader.ResolvedCode(eoa); err != nil || !bytes.Equal(have, code) {
+		t.Fatalf("reader resolved code mismatch: have %x, %v, want %x", have, err, code)
+	}
+	if have, err := reader.ResolvedCode(other); err != nil || have != nil {
+		t.Fatalf("reader missing account code mismatch: have %x, %v", have, err)
+	}
+	// Redirect the delegation to an empty account and make it self-referencing
+	state.SetCode(eoa, AddressToDelegation(other))
+	if have := state.GetResolvedCode(eoa); len(have) != 0 {
+		t.Fatalf("redirected delegation mismatch: have %x", have)
+	}
+	state.SetCode(eoa, AddressToDelegation(eoa))
+	if have, want := state.GetResolvedCode(eoa), AddressToDelegation(eoa); !bytes.Equal(have, want) {
+		t.Fatalf("self delegation mismatch: have %x, want %x", have, want)
+	}
+	if _, ok := ParseDelegation(append(AddressToDelegation(eoa), 0x00)); ok {
+		t.Fatalf("oversized designator parsed")
+	}
+}
+
+// Tests that the preimages of the written slot keys are recorded if enabled,
+// independently of the reads, and that reverted writes drop them.
+func TestSlotPreimageRecording(t *testing.T) {
+	var (
+		addr = common.Address{0x1}
+		keys = []common.Hash{{0x1}, {0x2}, {0x3}}
+	)
+	state, _ := New(common.Hash{}, NewDatabase(rawdb.NewMemoryDatabase()), nil)
+	state.SetState(addr, keys[0], common.Hash{0x1})
+	if len(state.Preimages()) != 0 {
+		t.Fatalf("preimages recorded while disabled: %v", state.Preimages())
+	}
+	state.RecordSlotPreimages()
+	state.GetState(addr, keys[2])
+	state.SetState(addr, keys[1], common.Hash{0x1})
+
+	rev := state.Snapshot()
+	state.SetState(addr, keys[2], common.Hash{0x1})
+	if preimage := state.Preimages()[crypto.Keccak256Hash(keys[2][:])]; !bytes.Equal(preimage, keys[2][:]) {
+		t.Fatalf("preimage of written slot mismatch: have %x, want %x", preimage, keys[2])
+	}
+	state.RevertToSnapshot(rev)
+
+	preimages := state.Preimages()
+	if len(preimages) != 1 {
+		t.Fatalf("recorded preimages mismatch: have %d, want %d", len(preimages), 1)
+	}
+	if preimage := preimages[crypto.Keccak256Hash(keys[1][:])]; !bytes.Equal(preimage, keys[1][:]) {
+		t.Fatalf("preimage of written slot mismatch: have %x, want %x", preimage, keys[1])
+	}
+	if copied := state.Copy(); !copied.recordSlotKeys {
+		t.Fatalf("slot preimage recording not copied")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package state
+
+import (
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+)
+
+// Witness is the data required to execute a block statelessly: the trie nodes
+// proving all the accounts and storage slots accessed during execution, the
+// bytecodes executed and the ancestor headers accessed (at least the parent).
+type Witness struct {
+	Headers []*types.Header // Ancestor headers, for the parent state root and BLOCKHASH
+	Codes   [][]byte        // Bytecodes of the contracts executed
+	Nodes   [][]byte        // Trie nodes of the accessed accounts and storage slots
+}
+
+// NewWitnessDatabase creates a state database serving all the reads exclusively
+// from the content of an execution witness. Accessing any state not covered by
+// the witness fails with a missing trie node or code error, which is recorded in
+// the state and surfaced by StateDB.Error and StateDB.Commit.
+func NewWitnessDatabase(witness *Witness) Database {
+	db := rawdb.NewMemoryDatabase()
+	for _, blob := range witness.Nodes {
+		if err := db.Put(crypto.Keccak256(blob), blob); err != nil {
+			log.Crit("Failed to store witness node", "err", err)
+		}
+	}
+	for _, code := range witness.Codes {
+		if err := db.Put(crypto.Keccak256(code), code); err != nil {
+			log.Crit("Failed to store witness code", "err", err)
+		}
+	}
+	return NewDatabase(db)
+}
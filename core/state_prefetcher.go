@@ -92,3 +92,15 @@ func precacheTransaction(config *params.ChainConfig, bc ChainContext, author *co
 	_, err = ApplyMessage(vm, msg, gaspool)
 	return err
 }
+
+// callTargets returns the recipients of the transactions in a block, skipping
+// the contract creations.
+func callTargets(block *types.Block) []common.Address {
+	var targets []common.Address
+	for _, tx := range block.Transactions() {
+		if to := tx.To(); to != nil {
+			targets = append(targets, *to)
+		}
+	}
+	return targets
+}
@@ -21,6 +21,7 @@ import (
 	"math/big"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/state"
 	"github.com/ethereum/go-ethereum/core/vm"
 	"github.com/ethereum/go-ethereum/params"
 )
@@ -160,7 +161,14 @@ func NewStateTransition(evm *vm.EVM, msg Message, gp *GasPool) *StateTransition
 // the gas used (which includes gas refunds) and an error if it failed. An error always
 // indicates a core error meaning that the message would always fail for that particular
 // state and would never be accepted within a block.
+//
+// The empty account semantics of the chain are applied to the state, so the
+// callers finalising it in between messages (tracers, calls) follow the rules
+// of the block processing.
 func ApplyMessage(evm *vm.EVM, msg Message, gp *GasPool) (*ExecutionResult, error) {
+	if statedb, ok := evm.StateDB.(*state.StateDB); ok {
+		statedb.SetEmptyRules(state.NewEmptyRules(evm.ChainConfig(), evm.BlockNumber))
+	}
 	return NewStateTransition(evm, msg, gp).TransitionDb()
 }
 
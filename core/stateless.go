@@ -0,0 +1,114 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// errWitnessNoParent is returned if the parent header of the block to execute
+// statelessly is not included in the witness.
+var errWitnessNoParent = errors.New("parent header missing from witness")
+
+// ExecuteStateless executes a block on top of the pre-state proven by an
+// execution witness, without access to any local chain or state data. The
+// post-state root and the receipts are returned, leaving their validation
+// against the block to the caller. Any state access not covered by the witness
+// fails the execution.
+func ExecuteStateless(config *params.ChainConfig, engine consensus.Engine, block *types.Block, witness *state.Witness) (common.Hash, types.Receipts, error) {
+	chain := newWitnessChain(config, engine, witness.Headers)
+	parent := chain.GetHeader(block.ParentHash(), block.NumberU64()-1)
+	if parent == nil {
+		return common.Hash{}, nil, errWitnessNoParent
+	}
+	statedb, err := state.New(parent.Root, state.NewWitnessDatabase(witness), nil)
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	// Process the block, reporting any missing witness data in favour of the
+	// execution failures caused by it
+	receipts, _, _, err := NewStateProcessor(config, chain, engine).Process(block, statedb, vm.Config{})
+	if dberr := statedb.Error(); dberr != nil {
+		return common.Hash{}, nil, fmt.Errorf("state access outside witness: %v", dberr)
+	}
+	if err != nil {
+		return common.Hash{}, nil, err
+	}
+	root := statedb.IntermediateRoot(config.IsEIP158(block.Number()))
+	if err := statedb.Error(); err != nil {
+		return common.Hash{}, nil, fmt.Errorf("state access outside witness: %v", err)
+	}
+	return root, receipts, nil
+}
+
+// witnessChain is a chain context serving the ancestor headers included in an
+// execution witness.
+type witnessChain struct {
+	config  *params.ChainConfig
+	engine  consensus.Engine
+	headers map[common.Hash]*types.Header
+	numbers map[uint64]*types.Header
+}
+
+// newWitnessChain creates a chain context from the ancestor headers of a witness.
+func newWitnessChain(config *params.ChainConfig, engine consensus.Engine, headers []*types.Header) *witnessChain {
+	chain := &witnessChain{
+		config:  config,
+		engine:  engine,
+		headers: make(map[common.Hash]*types.Header),
+		numbers: make(map[uint64]*types.Header),
+	}
+	for _, header := range headers {
+		chain.headers[header.Hash()] = header
+		chain.numbers[header.Number.Uint64()] = header
+	}
+	return chain
+}
+
+// Config retrieves the chain configuration.
+func (c *witnessChain) Config() *params.ChainConfig { return c.config }
+
+// Engine retrieves the consensus engine.
+func (c *witnessChain) Engine() consensus.Engine { return c.engine }
+
+// CurrentHeader is not available without a local chain.
+func (c *witnessChain) CurrentHeader() *types.Header { return nil }
+
+// GetHeader retrieves a witness header by hash and number.
+func (c *witnessChain) GetHeader(hash common.Hash, number uint64) *types.Header {
+	if header := c.headers[hash]; header != nil && header.Number.Uint64() == number {
+		return header
+	}
+	return nil
+}
+
+// GetHeaderByNumber retrieves a witness header by number.
+func (c *witnessChain) GetHeaderByNumber(number uint64) *types.Header { return c.numbers[number] }
+
+// GetHeaderByHash retrieves a witness header by hash.
+func (c *witnessChain) GetHeaderByHash(hash common.Hash) *types.Header { return c.headers[hash] }
+
+// GetBlock is not available without a local chain.
+func (c *witnessChain) GetBlock(hash common.Hash, number uint64) *types.Block { return nil }
@@ -0,0 +1,74 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/state"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Tests that a block can be executed statelessly on top of a witness and that
+// any state access outside of the witness fails the execution.
+func TestExecuteStateless(t *testing.T) {
+	var (
+		key, _  = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr    = crypto.PubkeyToAddress(key.PublicKey)
+		db      = rawdb.NewMemoryDatabase()
+		gspec   = &Genesis{Config: params.TestChainConfig, Alloc: GenesisAlloc{addr: {Balance: big.NewInt(1000000000)}}}
+		genesis = gspec.MustCommit(db)
+		signer  = types.NewEIP155Signer(gspec.Config.ChainID)
+	)
+	blocks, _ := GenerateChain(gspec.Config, genesis, ethash.NewFaker(), db, 2, func(i int, b *BlockGen) {
+		tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(addr), common.Address{byte(i + 1)}, big.NewInt(1000), params.TxGas, nil, nil), signer, key)
+		b.AddTx(tx)
+	})
+	// Assemble a witness out of the entire pre-state of the last block
+	witness := &state.Witness{Headers: []*types.Header{blocks[0].Header()}}
+	it := db.NewIterator(nil, nil)
+	for it.Next() {
+		if len(it.Key()) == common.HashLength {
+			witness.Nodes = append(witness.Nodes, common.CopyBytes(it.Value()))
+		}
+	}
+	it.Release()
+
+	root, receipts, err := ExecuteStateless(gspec.Config, ethash.NewFaker(), blocks[1], witness)
+	if err != nil {
+		t.Fatalf("failed to execute block statelessly: %v", err)
+	}
+	if root != blocks[1].Root() {
+		t.Fatalf("post-state root mismatch: have %x, want %x", root, blocks[1].Root())
+	}
+	if hash := types.DeriveSha(receipts); hash != blocks[1].ReceiptHash() {
+		t.Fatalf("receipt root mismatch: have %x, want %x", hash, blocks[1].ReceiptHash())
+	}
+	// Ensure execution fails if the parent or the state is missing
+	if _, _, err := ExecuteStateless(gspec.Config, ethash.NewFaker(), blocks[1], &state.Witness{}); err != errWitnessNoParent {
+		t.Fatalf("missing parent error mismatch: have %v, want %v", err, errWitnessNoParent)
+	}
+	if _, _, err := ExecuteStateless(gspec.Config, ethash.NewFaker(), blocks[1], &state.Witness{Headers: witness.Headers}); err == nil {
+		t.Fatalf("execution succeeded without state")
+	}
+}
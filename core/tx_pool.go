@@ -487,6 +487,30 @@ func (pool *TxPool) Pending() (map[common.Address]types.Transactions, error) {
 	return pending, nil
 }
 
+// PrefetchHints returns the senders and recipients of the pending transactions,
+// the accounts the next block is likely to access. It implements the
+// state.PrefetchHinter interface to warm the state caches ahead of the block.
+func (pool *TxPool) PrefetchHints() *state.PrefetchHints {
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+
+	if len(pool.pending) == 0 {
+		return nil
+	}
+	hints := &state.PrefetchHints{
+		Accounts: make([]common.Address, 0, len(pool.pending)),
+	}
+	for addr, list := range pool.pending {
+		hints.Accounts = append(hints.Accounts, addr)
+		for _, tx := range list.Flatten() {
+			if to := tx.To(); to != nil {
+				hints.Accounts = append(hints.Accounts, *to)
+			}
+		}
+	}
+	return hints
+}
+
 // Locals retrieves the accounts currently considered local by the pool.
 func (pool *TxPool) Locals() []common.Address {
 	pool.mu.Lock()
@@ -23,6 +23,7 @@ import (
 	"math/big"
 	"math/rand"
 	"os"
+	"reflect"
 	"testing"
 	"time"
 
@@ -966,6 +967,36 @@ func TestTransactionPendingLimiting(t *testing.T) {
 	}
 }
 
+// Tests that the prefetch hints of the pool contain the senders and recipients
+// of the pending transactions only.
+func TestTransactionPrefetchHints(t *testing.T) {
+	t.Parallel()
+
+	pool, key := setupTxPool()
+	defer pool.Stop()
+
+	if hints := pool.PrefetchHints(); hints != nil {
+		t.Fatalf("hints of empty pool: have %v, want nil", hints)
+	}
+	account := crypto.PubkeyToAddress(key.PublicKey)
+	pool.currentState.AddBalance(account, big.NewInt(1000000))
+
+	if err := pool.addRemoteSync(transaction(0, 100000, key)); err != nil {
+		t.Fatalf("failed to add pending transaction: %v", err)
+	}
+	if err := pool.addRemoteSync(transaction(2, 100000, key)); err != nil {
+		t.Fatalf("failed to add queued transaction: %v", err)
+	}
+	hints := pool.PrefetchHints()
+	if hints == nil {
+		t.Fatalf("no hints for pending transaction")
+	}
+	want := []common.Address{account, {}}
+	if !reflect.DeepEqual(hints.Accounts, want) {
+		t.Fatalf("hinted accounts mismatch: have %v, want %v", hints.Accounts, want)
+	}
+}
+
 // Tests that if the transaction count belonging to multiple accounts go above
 // some hard threshold, the higher transactions are dropped to prevent DOS
 // attacks.
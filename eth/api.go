@@ -321,6 +321,35 @@ func (api *PrivateDebugAPI) Preimage(ctx context.Context, hash common.Hash) (hex
 	return nil, errors.New("unknown preimage")
 }
 
+// StateGrowth returns the amount of data added to the state by a recently
+// processed block.
+func (api *PrivateDebugAPI) StateGrowth(hash common.Hash) (*state.StateGrowth, error) {
+	growth, ok := api.eth.BlockChain().StateGrowth(hash)
+	if !ok {
+		return nil, fmt.Errorf("state growth of block %#x unknown", hash)
+	}
+	return &growth, nil
+}
+
+// ReplayBlocks re-executes the canonical blocks from..to in memory on top of the
+// state of block from-1 and reports the accounts and storage slots diverging from
+// the live state of block to (at most limit many if non-zero). Long ranges are
+// rejected, since the replayed states are kept in memory.
+func (api *PrivateDebugAPI) ReplayBlocks(from, to hexutil.Uint64, limit int) (*core.ReplayResult, error) {
+	return core.ReplayBlocks(api.eth.BlockChain(), uint64(from), uint64(to), limit)
+}
+
+// TxIndexProgress returns the status of the transaction index.
+func (api *PrivateDebugAPI) TxIndexProgress() core.TxIndexProgress {
+	return api.eth.BlockChain().TxIndexProgress()
+}
+
+// BackfillTxIndex extends the transaction index down to the given block number,
+// the missing indices are constructed in the background.
+func (api *PrivateDebugAPI) BackfillTxIndex(from hexutil.Uint64) error {
+	return api.eth.BlockChain().BackfillTxIndex(uint64(from))
+}
+
 // BadBlockArgs represents the entries in the list returned when bad blocks are queried.
 type BadBlockArgs struct {
 	Hash  common.Hash            `json:"hash"`
@@ -0,0 +1,168 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package eth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/consensus/ethash"
+	"github.com/ethereum/go-ethereum/core"
+	"github.com/ethereum/go-ethereum/core/rawdb"
+	"github.com/ethereum/go-ethereum/core/types"
+	"github.com/ethereum/go-ethereum/core/vm"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/eth/tracers"
+	"github.com/ethereum/go-ethereum/params"
+)
+
+// Tests that block tracing follows the empty account semantics of the chain,
+// keeping the touched empty accounts alive for the later transactions.
+func TestTraceBlockKeepTouched(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		empty  = common.Address{0xee}
+		callee = common.Address{0xcc}
+		config = *params.TestChainConfig
+		db     = rawdb.NewMemoryDatabase()
+		engine = ethash.NewFaker()
+	)
+	config.KeepTouchedBlock = big.NewInt(0)
+
+	gspec := &core.Genesis{
+		Config: &config,
+		Alloc: core.GenesisAlloc{
+			addr:   {Balance: big.NewInt(params.Ether)},
+			empty:  {Balance: new(big.Int)},
+			callee: {Code: []byte{byte(vm.PUSH1), 0, byte(vm.POP)}, Balance: new(big.Int)},
+		},
+	}
+	genesis := gspec.MustCommit(db)
+	signer := types.NewEIP155Signer(config.ChainID)
+
+	blocks, _ := core.GenerateChain(&config, genesis, engine, db, 1, func(i int, b *core.BlockGen) {
+		touch, _ := types.SignTx(types.NewTransaction(b.TxNonce(addr), empty, new(big.Int), params.TxGas, nil, nil), signer, key)
+		b.AddTx(touch)
+		check, _ := types.SignTx(types.NewTransaction(b.TxNonce(addr), callee, new(big.Int), 100000, nil, nil), signer, key)
+		b.AddTx(check)
+	})
+	chain, err := core.NewBlockChain(db, nil, &config, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	api := NewPrivateDebugAPI(&Ethereum{blockchain: chain, engine: engine, chainDb: db})
+
+	// Trace the existence of the touched account from the contract call after
+	// the touching transaction
+	tracer := fmt.Sprintf("{exists: null, step: function(log, db) { this.exists = db.exists(toAddress('%x')); }, fault: function() {}, result: function() { return this.exists; }}", empty)
+
+	results, err := api.traceBlock(context.Background(), blocks[0], &TraceConfig{Tracer: &tracer})
+	if err != nil {
+		t.Fatalf("failed to trace block: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("trace result count mismatch: have %d, want %d", len(results), 2)
+	}
+	result, ok := results[1].Result.(json.RawMessage)
+	if !ok {
+		t.Fatalf("second transaction not traced: %v", results[1].Error)
+	}
+	if string(result) != "true" {
+		t.Fatalf("touched empty account deleted: exists %s", result)
+	}
+}
+
+// Tests that the prestate tracer is served natively, returning the state of the
+// accessed accounts and slots before each transaction of the block.
+func TestTraceBlockPrestate(t *testing.T) {
+	var (
+		key, _ = crypto.HexToECDSA("b71c71a67e1177ad4e901695e1b4b9ee17ae16c6668d313eac2f96dbcda3f291")
+		addr   = crypto.PubkeyToAddress(key.PublicKey)
+		callee = common.Address{0xcc}
+		code   = []byte{byte(vm.PUSH1), 1, byte(vm.PUSH1), 0, byte(vm.SSTORE)}
+		db     = rawdb.NewMemoryDatabase()
+		engine = ethash.NewFaker()
+	)
+	gspec := &core.Genesis{
+		Config: params.TestChainConfig,
+		Alloc: core.GenesisAlloc{
+			addr:   {Balance: big.NewInt(params.Ether)},
+			callee: {Code: code, Balance: new(big.Int), Storage: map[common.Hash]common.Hash{{}: {0x05}}},
+		},
+	}
+	genesis := gspec.MustCommit(db)
+	signer := types.NewEIP155Signer(params.TestChainConfig.ChainID)
+
+	blocks, _ := core.GenerateChain(params.TestChainConfig, genesis, engine, db, 1, func(i int, b *core.BlockGen) {
+		for j := 0; j < 2; j++ {
+			tx, _ := types.SignTx(types.NewTransaction(b.TxNonce(addr), callee, big.NewInt(1), 100000, big.NewInt(1), nil), signer, key)
+			b.AddTx(tx)
+		}
+	})
+	chain, err := core.NewBlockChain(db, nil, params.TestChainConfig, engine, vm.Config{}, nil, nil)
+	if err != nil {
+		t.Fatalf("failed to create chain: %v", err)
+	}
+	defer chain.Stop()
+	if _, err := chain.InsertChain(blocks); err != nil {
+		t.Fatalf("failed to import chain: %v", err)
+	}
+	api := NewPrivateDebugAPI(&Ethereum{blockchain: chain, engine: engine, chainDb: db})
+
+	tracer := tracers.PrestateTracer
+	results, err := api.traceBlock(context.Background(), blocks[0], &TraceConfig{Tracer: &tracer})
+	if err != nil {
+		t.Fatalf("failed to trace block: %v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("trace result count mismatch: have %d, want %d", len(results), 2)
+	}
+	receipt := chain.GetReceiptsByHash(blocks[0].Hash())[0]
+	for i, want := range []struct {
+		nonce   uint64
+		balance *big.Int
+		slot    common.Hash
+	}{
+		{0, big.NewInt(params.Ether), common.Hash{0x05}},
+		{1, new(big.Int).Sub(big.NewInt(params.Ether), new(big.Int).SetUint64(receipt.GasUsed+1)), common.BytesToHash([]byte{0x01})},
+	} {
+		prestate, ok := results[i].Result.(map[common.Address]*tracers.PrestateAccount)
+		if !ok {
+			t.Fatalf("tx %d: unexpected result: %v (error %s)", i, results[i].Result, results[i].Error)
+		}
+		if sender := prestate[addr]; sender == nil || sender.Nonce != want.nonce || sender.Balance.ToInt().Cmp(want.balance) != 0 {
+			t.Errorf("tx %d: sender prestate mismatch: have %+v, want nonce %d balance %v", i, sender, want.nonce, want.balance)
+		}
+		contract := prestate[callee]
+		if contract == nil || !bytes.Equal(contract.Code, code) {
+			t.Fatalf("tx %d: callee prestate mismatch: have %+v", i, contract)
+		}
+		if slot := contract.Storage[common.Hash{}]; slot != want.slot {
+			t.Errorf("tx %d: slot prestate mismatch: have %x, want %x", i, slot, want.slot)
+		}
+	}
+}
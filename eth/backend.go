@@ -175,6 +175,22 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 			rawdb.WriteDatabaseVersion(chainDb, core.BlockChainVersion)
 		}
 	}
+	// Ensure the schema is compatible and record the features in use. Contrary
+	// to the version check above this can't be skipped, since a database using
+	// features unknown to this binary would be corrupted by it.
+	var features uint64
+	if config.SnapshotCache > 0 {
+		features |= rawdb.FeatureSnapshot
+	}
+	if config.LogIndexing {
+		features |= rawdb.FeatureLogIndex
+	}
+	if ctx.Config.AncientInlineIndex {
+		features |= rawdb.FeatureInlineIndex
+	}
+	if err := rawdb.ValidateSchema(chainDb, features); err != nil {
+		return nil, err
+	}
 	var (
 		vmConfig = vm.Config{
 			EnablePreimageRecording: config.EnablePreimageRecording,
@@ -188,12 +204,34 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 			TrieDirtyDisabled:   config.NoPruning,
 			TrieTimeLimit:       config.TrieTimeout,
 			SnapshotLimit:       config.SnapshotCache,
+			SnapshotFlushLimit:  config.SnapshotFlushLimit,
+			SnapshotFilterRate:  config.SnapshotFilterRate,
+			SnapshotAudit:       config.SnapshotAudit,
+			SnapshotDiffBudget:  config.SnapshotDiffBudget,
+			SnapshotDiffLayers:  config.SnapshotDiffLayers,
+			SnapshotStrict:      config.SnapshotStrict,
+			TxLookupScanWindow:  config.TxLookupScanWindow,
+			LogIndexing:         config.LogIndexing,
 		}
 	)
 	eth.blockchain, err = core.NewBlockChain(chainDb, cacheConfig, chainConfig, eth.engine, vmConfig, eth.shouldPreserve, &config.TxLookupLimit)
 	if err != nil {
 		return nil, err
 	}
+	// Tell the user how to fetch the ancient chain segments found corrupted again,
+	// and report the block history deleted by the retention policy
+	if maintainer, ok := chainDb.(ethdb.AncientMaintainer); ok {
+		maintainer.SetCorruptionHook(func(kind string, number uint64, err error) {
+			rewind := number
+			if rewind > 0 {
+				rewind--
+			}
+			log.Error("Ancient chain data corrupted, rewind below it to sync it again", "kind", kind, "number", number, "rewind", fmt.Sprintf("debug.setHead(%#x)", rewind), "err", err)
+		})
+		maintainer.SetRetentionHook(func(kind string, tail uint64) {
+			log.Info("Deleted expired ancient chain data", "kind", kind, "tail", tail)
+		})
+	}
 	// Rewind the chain in case of an incompatible config upgrade.
 	if compat, ok := genesisErr.(*params.ConfigCompatError); ok {
 		log.Warn("Rewinding chain to upgrade configuration", "err", compat)
@@ -206,6 +244,7 @@ func New(ctx *node.ServiceContext, config *Config) (*Ethereum, error) {
 		config.TxPool.Journal = ctx.ResolvePath(config.TxPool.Journal)
 	}
 	eth.txPool = core.NewTxPool(config.TxPool, chainConfig, eth.blockchain)
+	eth.blockchain.SetPrefetchHinter(eth.txPool)
 
 	// Permit the downloader to use the trie cache allowance during fast sync
 	cacheLimit := cacheConfig.TrieCleanLimit + cacheConfig.TrieDirtyLimit + cacheConfig.SnapshotLimit
@@ -105,7 +105,9 @@ type Config struct {
 	NoPruning  bool // Whether to disable pruning and flush everything to disk
 	NoPrefetch bool // Whether to disable prefetching and only load state on demand
 
-	TxLookupLimit uint64 `toml:",omitempty"` // The maximum number of blocks from head whose tx indices are reserved.
+	TxLookupLimit      uint64 `toml:",omitempty"` // The maximum number of blocks from head whose tx indices are reserved.
+	TxLookupScanWindow uint64 `toml:",omitempty"` // The number of unindexed blocks searched for transactions missing from the index.
+	LogIndexing        bool   `toml:",omitempty"` // Whether to maintain the address and topic index of the canonical logs.
 
 	// Whitelist of required block number -> hash values to accept
 	Whitelist map[uint64]common.Hash `toml:"-"`
@@ -132,6 +134,13 @@ type Config struct {
 	TrieTimeout    time.Duration
 	SnapshotCache  int
 
+	SnapshotFlushLimit uint64  `toml:",omitempty"` // Size of the snapshot accumulator layer triggering a flush (0 = default)
+	SnapshotFilterRate float64 `toml:",omitempty"` // False-positive rate of the snapshot account existence filter (0 = disabled)
+	SnapshotAudit      bool    `toml:",omitempty"` // Whether to read back and verify every snapshot journal written
+	SnapshotDiffBudget uint64  `toml:",omitempty"` // Memory limit of the snapshot diff layers, flattening beyond it (0 = disabled)
+	SnapshotDiffLayers int     `toml:",omitempty"` // Minimum number of snapshot diff layers kept despite the memory limit
+	SnapshotStrict     bool    `toml:",omitempty"` // Whether to reject snapshot layers not increasing the block number
+
 	// Mining options
 	Miner miner.Config
 
@@ -20,10 +20,12 @@ import (
 	"context"
 	"errors"
 	"math/big"
+	"sort"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/core"
 	"github.com/ethereum/go-ethereum/core/bloombits"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/core/types"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/event"
@@ -158,11 +160,102 @@ func (f *Filter) Logs(ctx context.Context) ([]*types.Log, error) {
 			return logs, err
 		}
 	}
+	// If the rest of the range is covered by the local log index, use it instead
+	// of iterating over all the blocks
+	if tail := rawdb.ReadLogIndexTail(f.db); tail != nil && uint64(f.begin) >= *tail && f.hasCriteria() {
+		rest, err := f.logIndexedLogs(ctx, end)
+		logs = append(logs, rest...)
+		return logs, err
+	}
 	rest, err := f.unindexedLogs(ctx, end)
 	logs = append(logs, rest...)
 	return logs, err
 }
 
+// hasCriteria reports whether the filter has any address or topic restriction
+// that can be looked up in the log index.
+func (f *Filter) hasCriteria() bool {
+	if len(f.addresses) > 0 {
+		return true
+	}
+	for _, sub := range f.topics {
+		if len(sub) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// logIndexedLogs returns the logs matching the filter criteria based on the
+// address and topic index of the canonical logs maintained locally.
+func (f *Filter) logIndexedLogs(ctx context.Context, end uint64) ([]*types.Log, error) {
+	var logs []*types.Log
+
+	for _, number := range f.logIndexCandidates(uint64(f.begin), end) {
+		if err := ctx.Err(); err != nil {
+			return logs, err
+		}
+		f.begin = int64(number) + 1
+
+		// The index might contain stale entries of reorged blocks, so the logs
+		// of the candidate blocks are always checked against the filter
+		header, err := f.backend.HeaderByNumber(ctx, rpc.BlockNumber(number))
+		if header == nil || err != nil {
+			return logs, err
+		}
+		found, err := f.checkMatches(ctx, header)
+		if err != nil {
+			return logs, err
+		}
+		logs = append(logs, found...)
+	}
+	f.begin = int64(end) + 1
+	return logs, nil
+}
+
+// logIndexCandidates intersects the indexed block numbers of all the filter
+// clauses in the range [begin, end], returning the blocks which might contain
+// matching logs in ascending order.
+func (f *Filter) logIndexCandidates(begin, end uint64) []uint64 {
+	var clauses [][]uint64
+	if len(f.addresses) > 0 {
+		var numbers []uint64
+		for _, address := range f.addresses {
+			numbers = append(numbers, rawdb.ReadAddressLogBlocks(f.db, address, begin, end)...)
+		}
+		clauses = append(clauses, numbers)
+	}
+	for i, sub := range f.topics {
+		if len(sub) == 0 {
+			continue // empty rule set == wildcard
+		}
+		var numbers []uint64
+		for _, topic := range sub {
+			numbers = append(numbers, rawdb.ReadTopicLogBlocks(f.db, i, topic, begin, end)...)
+		}
+		clauses = append(clauses, numbers)
+	}
+	// Count the clauses matched by each block, retaining the ones matching all
+	counts := make(map[uint64]int)
+	for _, numbers := range clauses {
+		seen := make(map[uint64]struct{}, len(numbers))
+		for _, number := range numbers {
+			if _, ok := seen[number]; !ok {
+				seen[number] = struct{}{}
+				counts[number]++
+			}
+		}
+	}
+	var candidates []uint64
+	for number, count := range counts {
+		if count == len(clauses) {
+			candidates = append(candidates, number)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i] < candidates[j] })
+	return candidates
+}
+
 // indexedLogs returns the logs matching the filter criteria based on the bloom
 // bits indexed available locally or via the network.
 func (f *Filter) indexedLogs(ctx context.Context, end uint64) ([]*types.Log, error) {
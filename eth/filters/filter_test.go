@@ -95,7 +95,10 @@ func BenchmarkFilters(b *testing.B) {
 	}
 }
 
-func TestFilters(t *testing.T) {
+func TestFilters(t *testing.T)         { testFilters(t, false) }
+func TestLogIndexFilters(t *testing.T) { testFilters(t, true) }
+
+func testFilters(t *testing.T, logIndex bool) {
 	dir, err := ioutil.TempDir("", "filtertest")
 	if err != nil {
 		t.Fatal(err)
@@ -167,6 +170,12 @@ func TestFilters(t *testing.T) {
 		rawdb.WriteHeadBlockHash(db, block.Hash())
 		rawdb.WriteReceipts(db, block.Hash(), block.NumberU64(), receipts[i])
 	}
+	if logIndex {
+		rawdb.IndexLogs(db, 0, uint64(len(chain))+1)
+		if tail := rawdb.ReadLogIndexTail(db); tail == nil || *tail != 0 {
+			t.Fatalf("log index tail mismatch: have %v, want 0", tail)
+		}
+	}
 
 	filter := NewRangeFilter(backend, 0, -1, []common.Address{addr}, [][]common.Hash{{hash1, hash2, hash3, hash4}})
 
@@ -25,6 +25,8 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		NoPruning               bool
 		NoPrefetch              bool
 		TxLookupLimit           uint64                 `toml:",omitempty"`
+		TxLookupScanWindow      uint64                 `toml:",omitempty"`
+		LogIndexing             bool                   `toml:",omitempty"`
 		Whitelist               map[uint64]common.Hash `toml:"-"`
 		LightServ               int                    `toml:",omitempty"`
 		LightIngress            int                    `toml:",omitempty"`
@@ -40,6 +42,12 @@ func (c Config) MarshalTOML() (interface{}, error) {
 		TrieCleanCache          int
 		TrieDirtyCache          int
 		TrieTimeout             time.Duration
+		SnapshotFlushLimit      uint64  `toml:",omitempty"`
+		SnapshotFilterRate      float64 `toml:",omitempty"`
+		SnapshotAudit           bool    `toml:",omitempty"`
+		SnapshotDiffBudget      uint64  `toml:",omitempty"`
+		SnapshotDiffLayers      int     `toml:",omitempty"`
+		SnapshotStrict          bool    `toml:",omitempty"`
 		Miner                   miner.Config
 		Ethash                  ethash.Config
 		TxPool                  core.TxPoolConfig
@@ -62,6 +70,8 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.NoPruning = c.NoPruning
 	enc.NoPrefetch = c.NoPrefetch
 	enc.TxLookupLimit = c.TxLookupLimit
+	enc.TxLookupScanWindow = c.TxLookupScanWindow
+	enc.LogIndexing = c.LogIndexing
 	enc.Whitelist = c.Whitelist
 	enc.LightServ = c.LightServ
 	enc.LightIngress = c.LightIngress
@@ -77,6 +87,12 @@ func (c Config) MarshalTOML() (interface{}, error) {
 	enc.TrieCleanCache = c.TrieCleanCache
 	enc.TrieDirtyCache = c.TrieDirtyCache
 	enc.TrieTimeout = c.TrieTimeout
+	enc.SnapshotFlushLimit = c.SnapshotFlushLimit
+	enc.SnapshotFilterRate = c.SnapshotFilterRate
+	enc.SnapshotAudit = c.SnapshotAudit
+	enc.SnapshotDiffBudget = c.SnapshotDiffBudget
+	enc.SnapshotDiffLayers = c.SnapshotDiffLayers
+	enc.SnapshotStrict = c.SnapshotStrict
 	enc.Miner = c.Miner
 	enc.Ethash = c.Ethash
 	enc.TxPool = c.TxPool
@@ -101,6 +117,8 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		NoPruning               *bool
 		NoPrefetch              *bool
 		TxLookupLimit           *uint64                `toml:",omitempty"`
+		TxLookupScanWindow      *uint64                `toml:",omitempty"`
+		LogIndexing             *bool                  `toml:",omitempty"`
 		Whitelist               map[uint64]common.Hash `toml:"-"`
 		LightServ               *int                   `toml:",omitempty"`
 		LightIngress            *int                   `toml:",omitempty"`
@@ -116,6 +134,12 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 		TrieCleanCache          *int
 		TrieDirtyCache          *int
 		TrieTimeout             *time.Duration
+		SnapshotFlushLimit      *uint64  `toml:",omitempty"`
+		SnapshotFilterRate      *float64 `toml:",omitempty"`
+		SnapshotAudit           *bool    `toml:",omitempty"`
+		SnapshotDiffBudget      *uint64  `toml:",omitempty"`
+		SnapshotDiffLayers      *int     `toml:",omitempty"`
+		SnapshotStrict          *bool    `toml:",omitempty"`
 		Miner                   *miner.Config
 		Ethash                  *ethash.Config
 		TxPool                  *core.TxPoolConfig
@@ -155,6 +179,12 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.TxLookupLimit != nil {
 		c.TxLookupLimit = *dec.TxLookupLimit
 	}
+	if dec.TxLookupScanWindow != nil {
+		c.TxLookupScanWindow = *dec.TxLookupScanWindow
+	}
+	if dec.LogIndexing != nil {
+		c.LogIndexing = *dec.LogIndexing
+	}
 	if dec.Whitelist != nil {
 		c.Whitelist = dec.Whitelist
 	}
@@ -200,6 +230,24 @@ func (c *Config) UnmarshalTOML(unmarshal func(interface{}) error) error {
 	if dec.TrieTimeout != nil {
 		c.TrieTimeout = *dec.TrieTimeout
 	}
+	if dec.SnapshotFlushLimit != nil {
+		c.SnapshotFlushLimit = *dec.SnapshotFlushLimit
+	}
+	if dec.SnapshotFilterRate != nil {
+		c.SnapshotFilterRate = *dec.SnapshotFilterRate
+	}
+	if dec.SnapshotAudit != nil {
+		c.SnapshotAudit = *dec.SnapshotAudit
+	}
+	if dec.SnapshotDiffBudget != nil {
+		c.SnapshotDiffBudget = *dec.SnapshotDiffBudget
+	}
+	if dec.SnapshotDiffLayers != nil {
+		c.SnapshotDiffLayers = *dec.SnapshotDiffLayers
+	}
+	if dec.SnapshotStrict != nil {
+		c.SnapshotStrict = *dec.SnapshotStrict
+	}
 	if dec.Miner != nil {
 		c.Miner = *dec.Miner
 	}
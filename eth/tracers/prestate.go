@@ -0,0 +1,62 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package tracers
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/core/state"
+)
+
+// PrestateTracer is the name of the built in prestate tracer. Instead of running
+// its JavaScript version, the callers can serve it natively from the state diff
+// of the traced execution, see Prestate.
+const PrestateTracer = "prestateTracer"
+
+// PrestateAccount is the state of an account before the traced execution, in the
+// format of the prestate tracer (i.e. a genesis allocation).
+type PrestateAccount struct {
+	Balance *hexutil.Big                `json:"balance"`
+	Nonce   uint64                      `json:"nonce"`
+	Code    hexutil.Bytes               `json:"code"`
+	Storage map[common.Hash]common.Hash `json:"storage"`
+}
+
+// Prestate assembles the result of the prestate tracer from the pre-images of
+// a state diff tracked over the execution. Contrary to the JavaScript tracer,
+// no fixups of the sender and recipient are needed, as the pre-images are taken
+// before the execution modifies them. Accounts not existing beforehand (e.g. the
+// created contracts) are omitted.
+func Prestate(diff *state.StateDiff) map[common.Address]*PrestateAccount {
+	prestate := make(map[common.Address]*PrestateAccount, len(diff.Pre))
+	for addr, pre := range diff.Pre {
+		if pre == nil {
+			continue
+		}
+		account := &PrestateAccount{
+			Balance: (*hexutil.Big)(pre.Balance),
+			Nonce:   pre.Nonce,
+			Code:    pre.Code,
+			Storage: make(map[common.Hash]common.Hash, len(pre.Storage)),
+		}
+		for key, value := range pre.Storage {
+			account.Storage[key] = value
+		}
+		prestate[addr] = account
+	}
+	return prestate
+}
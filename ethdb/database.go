@@ -17,7 +17,10 @@
 // Package ethdb defines the interfaces for an Ethereum data store.
 package ethdb
 
-import "io"
+import (
+	"io"
+	"time"
+)
 
 // KeyValueReader wraps the Has and Get method of a backing data store.
 type KeyValueReader interface {
@@ -37,10 +40,44 @@ type KeyValueWriter interface {
 	Delete(key []byte) error
 }
 
-// Stater wraps the Stat method of a backing data store.
+// Stats is a structured snapshot of the internal statistics of a data store.
+// The counters are cumulative since the store was opened, the fields a backend
+// doesn't track are left zero.
+type Stats struct {
+	Levels []LevelStats `json:"levels"` // Statistics of the levels of LSM-tree based stores
+
+	MemoryCompactions    uint64 `json:"memoryCompactions"`    // Number of memtable flushes
+	Level0Compactions    uint64 `json:"level0Compactions"`    // Number of table compactions in level 0
+	NonLevel0Compactions uint64 `json:"nonLevel0Compactions"` // Number of table compactions in the other levels
+	SeekCompactions      uint64 `json:"seekCompactions"`      // Number of table compactions triggered by reads
+
+	WriteDelays uint64        `json:"writeDelays"` // Number of writes delayed due to compaction
+	WriteDelay  time.Duration `json:"writeDelay"`  // Total time the writes were delayed due to compaction
+	WritePaused bool          `json:"writePaused"` // Whether the writes are paused due to compaction
+
+	DiskRead  uint64 `json:"diskRead"`  // Amount of data read from disk
+	DiskWrite uint64 `json:"diskWrite"` // Amount of data written to disk
+
+	BlockCacheSize uint64 `json:"blockCacheSize"` // Amount of data held by the block cache
+	OpenTables     uint64 `json:"openTables"`     // Number of table files kept open
+}
+
+// LevelStats is the statistics of a single level of an LSM-tree based store.
+type LevelStats struct {
+	Tables          uint64        `json:"tables"`          // Number of tables in the level
+	Size            uint64        `json:"size"`            // Total size of the tables in the level
+	CompactionTime  time.Duration `json:"compactionTime"`  // Time spent compacting into the level
+	CompactionRead  uint64        `json:"compactionRead"`  // Amount of data read by the compactions
+	CompactionWrite uint64        `json:"compactionWrite"` // Amount of data written by the compactions
+}
+
+// Stater wraps the Stat and Stats methods of a backing data store.
 type Stater interface {
 	// Stat returns a particular internal stat of the database.
 	Stat(property string) (string, error)
+
+	// Stats returns the structured internal statistics of the database.
+	Stats() (*Stats, error)
 }
 
 // Compacter wraps the Compact method of a backing data store.
@@ -55,11 +92,23 @@ type Compacter interface {
 	Compact(start []byte, limit []byte) error
 }
 
+// RangeDeleter wraps the DeleteRange method of a backing data store.
+type RangeDeleter interface {
+	// DeleteRange removes all the keys in the range [start, end) from the data
+	// store. Stores lacking native support emulate it by deleting the keys one
+	// by one, so the deletion is not atomic.
+	//
+	// A nil start is treated as a key before all keys in the data store; a nil end
+	// is treated as a key after all keys in the data store.
+	DeleteRange(start, end []byte) error
+}
+
 // KeyValueStore contains all the methods required to allow handling different
 // key-value data stores backing the high level database.
 type KeyValueStore interface {
 	KeyValueReader
 	KeyValueWriter
+	RangeDeleter
 	Batcher
 	Iteratee
 	Stater
@@ -76,6 +125,11 @@ type AncientReader interface {
 	// Ancient retrieves an ancient binary blob from the append-only immutable files.
 	Ancient(kind string, number uint64) ([]byte, error)
 
+	// AncientInto retrieves an ancient binary blob into the supplied buffer,
+	// growing it if too small, and returns the slice holding the data. The
+	// buffer is never retained, so it can be reused across reads.
+	AncientInto(kind string, number uint64, buf []byte) ([]byte, error)
+
 	// Ancients returns the ancient item numbers in the ancient store.
 	Ancients() (uint64, error)
 
@@ -96,6 +150,59 @@ type AncientWriter interface {
 	Sync() error
 }
 
+// AppendValidator checks an item before it's appended to an ancient store. It's
+// given the number of the item and the previous item of the same category, which
+// is nil for the first item or if the previous one was deleted. A non-nil error
+// rejects the append.
+type AppendValidator func(number uint64, item []byte, prev []byte) error
+
+// AncientRetention is the policy of an ancient store limiting the items served
+// by a category to the most recent ones. The older items are deleted if any of
+// the limits is exceeded, a zero limit being ignored.
+type AncientRetention struct {
+	Items uint64        // Number of the most recent items retained
+	Bytes uint64        // Size of the most recent items retained, as stored
+	Age   time.Duration // Age of the oldest item retained, measured from its append
+}
+
+// AncientMaintainer contains the maintenance methods of an ancient store. It's
+// not part of the Database interface, the callers need to check whether the
+// store at hand supports it.
+type AncientMaintainer interface {
+	// AncientSizes returns the total stored (compressed, if enabled) and decoded
+	// sizes of the given range of items in the specified category.
+	AncientSizes(kind string, start, count uint64) (uint64, uint64, error)
+
+	// SetCorruptionHook registers a callback invoked whenever a corrupted item is
+	// detected, with its category and number, after the ancient store stopped
+	// serving the range of items it's stored with.
+	SetCorruptionHook(hook func(kind string, number uint64, err error))
+
+	// DeleteAncient deletes a single item of the specified category, leaving all
+	// the other items in place.
+	DeleteAncient(kind string, number uint64) error
+
+	// CompactAncients reclaims the space of the deleted items of the specified
+	// category, returning the number of bytes freed.
+	CompactAncients(kind string) (uint64, error)
+
+	// RechunkAncients rewrites the files of the specified category into files of
+	// the given maximum size, which also applies to the files created afterwards.
+	RechunkAncients(kind string, maxFileSize uint32) error
+
+	// RegisterValidator adds a check run on the items appended to the specified
+	// category, after the ones already registered.
+	RegisterValidator(kind string, validator AppendValidator) error
+
+	// SetRetention limits the items served by the specified category to the given
+	// policy, the zero policy lifting all limits. The policy is persisted.
+	SetRetention(kind string, policy AncientRetention) error
+
+	// SetRetentionHook registers a callback invoked whenever items are deleted due
+	// to the retention policy, with the category and its first item still served.
+	SetRetentionHook(hook func(kind string, tail uint64))
+}
+
 // Reader contains the methods required to read data from both key-value as well as
 // immutable ancient data.
 type Reader interface {
@@ -123,6 +230,7 @@ type AncientStore interface {
 type Database interface {
 	Reader
 	Writer
+	RangeDeleter
 	Batcher
 	Iteratee
 	Stater
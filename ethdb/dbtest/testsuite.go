@@ -313,6 +313,56 @@ func TestDatabaseSuite(t *testing.T, New func() ethdb.KeyValueStore) {
 		}
 	})
 
+	t.Run("DeleteRange", func(t *testing.T) {
+		tests := []struct {
+			start, end string
+			left       []string
+		}{
+			{"2", "4", []string{"1", "4", "5"}},
+			{"", "3", []string{"3", "4", "5"}},
+			{"3", "", []string{"1", "2"}},
+			{"", "", []string{}},
+			{"22", "3", []string{"1", "2", "3", "4", "5"}},
+		}
+		for i, tt := range tests {
+			db := New()
+			for _, k := range []string{"1", "2", "3", "4", "5"} {
+				if err := db.Put([]byte(k), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			var start, end []byte
+			if tt.start != "" {
+				start = []byte(tt.start)
+			}
+			if tt.end != "" {
+				end = []byte(tt.end)
+			}
+			if err := db.DeleteRange(start, end); err != nil {
+				t.Fatalf("test %d: failed to delete range: %v", i, err)
+			}
+			if got := iterateKeys(db.NewIterator(nil, nil)); !reflect.DeepEqual(got, tt.left) {
+				t.Errorf("test %d: got: %s; want: %s", i, got, tt.left)
+			}
+			db.Close()
+		}
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		db := New()
+		defer db.Close()
+
+		if err := db.Put([]byte("key"), []byte("value")); err != nil {
+			t.Fatal(err)
+		}
+		stats, err := db.Stats()
+		if err != nil {
+			t.Fatalf("failed to retrieve stats: %v", err)
+		}
+		if stats == nil {
+			t.Fatalf("nil stats returned")
+		}
+	})
 }
 
 func iterateKeys(it ethdb.Iterator) []string {
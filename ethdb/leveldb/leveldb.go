@@ -20,9 +20,6 @@
 package leveldb
 
 import (
-	"fmt"
-	"strconv"
-	"strings"
 	"sync"
 	"time"
 
@@ -74,6 +71,7 @@ type Database struct {
 	level0CompGauge    metrics.Gauge // Gauge for tracking the number of table compaction in level0
 	nonlevel0CompGauge metrics.Gauge // Gauge for tracking the number of table compaction in non0 level
 	seekCompGauge      metrics.Gauge // Gauge for tracking the number of table compaction caused by read opt
+	blockCacheGauge    metrics.Gauge // Gauge for tracking the amount of data held by the block cache
 
 	quitLock sync.Mutex      // Mutex protecting the quit channel access
 	quitChan chan chan error // Quit channel to stop the metrics collection before closing the database
@@ -127,6 +125,7 @@ func New(file string, cache int, handles int, namespace string) (*Database, erro
 	ldb.level0CompGauge = metrics.NewRegisteredGauge(namespace+"compact/level0", nil)
 	ldb.nonlevel0CompGauge = metrics.NewRegisteredGauge(namespace+"compact/nonlevel0", nil)
 	ldb.seekCompGauge = metrics.NewRegisteredGauge(namespace+"compact/seek", nil)
+	ldb.blockCacheGauge = metrics.NewRegisteredGauge(namespace+"cache/block", nil)
 
 	// Start up the metrics gathering and return
 	go ldb.meter(metricsGatheringInterval)
@@ -195,6 +194,65 @@ func (db *Database) Stat(property string) (string, error) {
 	return db.db.GetProperty(property)
 }
 
+// Stats returns the structured internal statistics of the database.
+func (db *Database) Stats() (*ethdb.Stats, error) {
+	var s leveldb.DBStats
+	if err := db.db.Stats(&s); err != nil {
+		return nil, err
+	}
+	stats := &ethdb.Stats{
+		Levels:               make([]ethdb.LevelStats, len(s.LevelSizes)),
+		MemoryCompactions:    uint64(s.MemComp),
+		Level0Compactions:    uint64(s.Level0Comp),
+		NonLevel0Compactions: uint64(s.NonLevel0Comp),
+		SeekCompactions:      uint64(s.SeekComp),
+		WriteDelays:          uint64(s.WriteDelayCount),
+		WriteDelay:           s.WriteDelayDuration,
+		WritePaused:          s.WritePaused,
+		DiskRead:             s.IORead,
+		DiskWrite:            s.IOWrite,
+		BlockCacheSize:       uint64(s.BlockCacheSize),
+		OpenTables:           uint64(s.OpenedTablesCount),
+	}
+	for i := range stats.Levels {
+		stats.Levels[i] = ethdb.LevelStats{
+			Tables:          uint64(s.LevelTablesCounts[i]),
+			Size:            uint64(s.LevelSizes[i]),
+			CompactionTime:  s.LevelDurations[i],
+			CompactionRead:  uint64(s.LevelRead[i]),
+			CompactionWrite: uint64(s.LevelWrite[i]),
+		}
+	}
+	return stats, nil
+}
+
+// DeleteRange removes all the keys in the range [start, end) from the database.
+// LevelDB has no native range deletion, so the keys are iterated and deleted in
+// batches.
+func (db *Database) DeleteRange(start, end []byte) error {
+	it := db.db.NewIterator(&util.Range{Start: start, Limit: end}, nil)
+	defer it.Release()
+
+	var (
+		batch = new(leveldb.Batch)
+		size  int
+	)
+	for it.Next() {
+		batch.Delete(it.Key())
+		if size += len(it.Key()); size >= ethdb.IdealBatchSize {
+			if err := db.db.Write(batch, nil); err != nil {
+				return err
+			}
+			batch.Reset()
+			size = 0
+		}
+	}
+	if err := it.Error(); err != nil {
+		return err
+	}
+	return db.db.Write(batch, nil)
+}
+
 // Compact flattens the underlying data store for the given key range. In essence,
 // deleted and overwritten versions are discarded, and the data is rearranged to
 // reduce the cost of operations needed to access them.
@@ -211,192 +269,71 @@ func (db *Database) Path() string {
 	return db.fn
 }
 
-// meter periodically retrieves internal leveldb counters and reports them to
-// the metrics subsystem.
-//
-// This is how a LevelDB stats table looks like (currently):
-//   Compactions
-//    Level |   Tables   |    Size(MB)   |    Time(sec)  |    Read(MB)   |   Write(MB)
-//   -------+------------+---------------+---------------+---------------+---------------
-//      0   |          0 |       0.00000 |       1.27969 |       0.00000 |      12.31098
-//      1   |         85 |     109.27913 |      28.09293 |     213.92493 |     214.26294
-//      2   |        523 |    1000.37159 |       7.26059 |      66.86342 |      66.77884
-//      3   |        570 |    1113.18458 |       0.00000 |       0.00000 |       0.00000
-//
-// This is how the write delay look like (currently):
-// DelayN:5 Delay:406.604657ms Paused: false
-//
-// This is how the iostats look like (currently):
-// Read(MB):3895.04860 Write(MB):3654.64712
+// meter periodically retrieves the internal leveldb statistics and reports them
+// to the metrics subsystem.
 func (db *Database) meter(refresh time.Duration) {
-	// Create the counters to store current and previous compaction values
-	compactions := make([][]float64, 2)
-	for i := 0; i < 2; i++ {
-		compactions[i] = make([]float64, 4)
-	}
-	// Create storage for iostats.
-	var iostats [2]float64
-
-	// Create storage and warning log tracer for write delay.
 	var (
-		delaystats      [2]int64
+		prev            = new(ethdb.Stats)
+		prevTotals      levelTotals
 		lastWritePaused time.Time
-	)
 
-	var (
 		errc chan error
 		merr error
 	)
-
 	timer := time.NewTimer(refresh)
 	defer timer.Stop()
 
 	// Iterate ad infinitum and collect the stats
-	for i := 1; errc == nil && merr == nil; i++ {
+	for errc == nil && merr == nil {
 		// Retrieve the database stats
-		stats, err := db.db.GetProperty("leveldb.stats")
+		stats, err := db.Stats()
 		if err != nil {
 			db.log.Error("Failed to read database stats", "err", err)
 			merr = err
 			continue
 		}
-		// Find the compaction table, skip the header
-		lines := strings.Split(stats, "\n")
-		for len(lines) > 0 && strings.TrimSpace(lines[0]) != "Compactions" {
-			lines = lines[1:]
-		}
-		if len(lines) <= 3 {
-			db.log.Error("Compaction leveldbTable not found")
-			merr = errors.New("compaction leveldbTable not found")
-			continue
-		}
-		lines = lines[3:]
-
-		// Iterate over all the leveldbTable rows, and accumulate the entries
-		for j := 0; j < len(compactions[i%2]); j++ {
-			compactions[i%2][j] = 0
-		}
-		for _, line := range lines {
-			parts := strings.Split(line, "|")
-			if len(parts) != 6 {
-				break
-			}
-			for idx, counter := range parts[2:] {
-				value, err := strconv.ParseFloat(strings.TrimSpace(counter), 64)
-				if err != nil {
-					db.log.Error("Compaction entry parsing failed", "err", err)
-					merr = err
-					continue
-				}
-				compactions[i%2][idx] += value
-			}
-		}
 		// Update all the requested meters
+		totals := sumLevels(stats.Levels)
 		if db.diskSizeGauge != nil {
-			db.diskSizeGauge.Update(int64(compactions[i%2][0] * 1024 * 1024))
+			db.diskSizeGauge.Update(int64(totals.size))
 		}
 		if db.compTimeMeter != nil {
-			db.compTimeMeter.Mark(int64((compactions[i%2][1] - compactions[(i-1)%2][1]) * 1000 * 1000 * 1000))
+			db.compTimeMeter.Mark(int64(totals.time - prevTotals.time))
 		}
 		if db.compReadMeter != nil {
-			db.compReadMeter.Mark(int64((compactions[i%2][2] - compactions[(i-1)%2][2]) * 1024 * 1024))
+			db.compReadMeter.Mark(int64(totals.read - prevTotals.read))
 		}
 		if db.compWriteMeter != nil {
-			db.compWriteMeter.Mark(int64((compactions[i%2][3] - compactions[(i-1)%2][3]) * 1024 * 1024))
-		}
-		// Retrieve the write delay statistic
-		writedelay, err := db.db.GetProperty("leveldb.writedelay")
-		if err != nil {
-			db.log.Error("Failed to read database write delay statistic", "err", err)
-			merr = err
-			continue
-		}
-		var (
-			delayN        int64
-			delayDuration string
-			duration      time.Duration
-			paused        bool
-		)
-		if n, err := fmt.Sscanf(writedelay, "DelayN:%d Delay:%s Paused:%t", &delayN, &delayDuration, &paused); n != 3 || err != nil {
-			db.log.Error("Write delay statistic not found")
-			merr = err
-			continue
-		}
-		duration, err = time.ParseDuration(delayDuration)
-		if err != nil {
-			db.log.Error("Failed to parse delay duration", "err", err)
-			merr = err
-			continue
+			db.compWriteMeter.Mark(int64(totals.write - prevTotals.write))
 		}
 		if db.writeDelayNMeter != nil {
-			db.writeDelayNMeter.Mark(delayN - delaystats[0])
+			db.writeDelayNMeter.Mark(int64(stats.WriteDelays - prev.WriteDelays))
 		}
 		if db.writeDelayMeter != nil {
-			db.writeDelayMeter.Mark(duration.Nanoseconds() - delaystats[1])
+			db.writeDelayMeter.Mark(int64(stats.WriteDelay - prev.WriteDelay))
 		}
 		// If a warning that db is performing compaction has been displayed, any subsequent
 		// warnings will be withheld for one minute not to overwhelm the user.
-		if paused && delayN-delaystats[0] == 0 && duration.Nanoseconds()-delaystats[1] == 0 &&
+		if stats.WritePaused && stats.WriteDelays == prev.WriteDelays && stats.WriteDelay == prev.WriteDelay &&
 			time.Now().After(lastWritePaused.Add(degradationWarnInterval)) {
 			db.log.Warn("Database compacting, degraded performance")
 			lastWritePaused = time.Now()
 		}
-		delaystats[0], delaystats[1] = delayN, duration.Nanoseconds()
-
-		// Retrieve the database iostats.
-		ioStats, err := db.db.GetProperty("leveldb.iostats")
-		if err != nil {
-			db.log.Error("Failed to read database iostats", "err", err)
-			merr = err
-			continue
-		}
-		var nRead, nWrite float64
-		parts := strings.Split(ioStats, " ")
-		if len(parts) < 2 {
-			db.log.Error("Bad syntax of ioStats", "ioStats", ioStats)
-			merr = fmt.Errorf("bad syntax of ioStats %s", ioStats)
-			continue
-		}
-		if n, err := fmt.Sscanf(parts[0], "Read(MB):%f", &nRead); n != 1 || err != nil {
-			db.log.Error("Bad syntax of read entry", "entry", parts[0])
-			merr = err
-			continue
-		}
-		if n, err := fmt.Sscanf(parts[1], "Write(MB):%f", &nWrite); n != 1 || err != nil {
-			db.log.Error("Bad syntax of write entry", "entry", parts[1])
-			merr = err
-			continue
-		}
 		if db.diskReadMeter != nil {
-			db.diskReadMeter.Mark(int64((nRead - iostats[0]) * 1024 * 1024))
+			db.diskReadMeter.Mark(int64(stats.DiskRead - prev.DiskRead))
 		}
 		if db.diskWriteMeter != nil {
-			db.diskWriteMeter.Mark(int64((nWrite - iostats[1]) * 1024 * 1024))
+			db.diskWriteMeter.Mark(int64(stats.DiskWrite - prev.DiskWrite))
 		}
-		iostats[0], iostats[1] = nRead, nWrite
-
-		compCount, err := db.db.GetProperty("leveldb.compcount")
-		if err != nil {
-			db.log.Error("Failed to read database iostats", "err", err)
-			merr = err
-			continue
+		if db.blockCacheGauge != nil {
+			db.blockCacheGauge.Update(int64(stats.BlockCacheSize))
 		}
+		db.memCompGauge.Update(int64(stats.MemoryCompactions))
+		db.level0CompGauge.Update(int64(stats.Level0Compactions))
+		db.nonlevel0CompGauge.Update(int64(stats.NonLevel0Compactions))
+		db.seekCompGauge.Update(int64(stats.SeekCompactions))
 
-		var (
-			memComp       uint32
-			level0Comp    uint32
-			nonLevel0Comp uint32
-			seekComp      uint32
-		)
-		if n, err := fmt.Sscanf(compCount, "MemComp:%d Level0Comp:%d NonLevel0Comp:%d SeekComp:%d", &memComp, &level0Comp, &nonLevel0Comp, &seekComp); n != 4 || err != nil {
-			db.log.Error("Compaction count statistic not found")
-			merr = err
-			continue
-		}
-		db.memCompGauge.Update(int64(memComp))
-		db.level0CompGauge.Update(int64(level0Comp))
-		db.nonlevel0CompGauge.Update(int64(nonLevel0Comp))
-		db.seekCompGauge.Update(int64(seekComp))
+		prev, prevTotals = stats, totals
 
 		// Sleep a bit, then repeat the stats collection
 		select {
@@ -414,6 +351,26 @@ func (db *Database) meter(refresh time.Duration) {
 	errc <- merr
 }
 
+// levelTotals is the statistics of all the levels of the database summed up.
+type levelTotals struct {
+	size  uint64
+	time  time.Duration
+	read  uint64
+	write uint64
+}
+
+// sumLevels sums up the statistics of the levels of the database.
+func sumLevels(levels []ethdb.LevelStats) levelTotals {
+	var totals levelTotals
+	for _, level := range levels {
+		totals.size += level.Size
+		totals.time += level.CompactionTime
+		totals.read += level.CompactionRead
+		totals.write += level.CompactionWrite
+	}
+	return totals
+}
+
 // batch is a write-only leveldb batch that commits changes to its host database
 // when Write is called. A batch cannot be used concurrently.
 type batch struct {
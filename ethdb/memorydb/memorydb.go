@@ -168,6 +168,32 @@ func (db *Database) Stat(property string) (string, error) {
 	return "", errors.New("unknown property")
 }
 
+// Stats returns the structured internal statistics of the database. The memory
+// database doesn't track any.
+func (db *Database) Stats() (*ethdb.Stats, error) {
+	return new(ethdb.Stats), nil
+}
+
+// DeleteRange removes all the keys in the range [start, end) from the database.
+func (db *Database) DeleteRange(start, end []byte) error {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	if db.db == nil {
+		return errMemorydbClosed
+	}
+	for key := range db.db {
+		if start != nil && key < string(start) {
+			continue
+		}
+		if end != nil && key >= string(end) {
+			continue
+		}
+		delete(db.db, key)
+	}
+	return nil
+}
+
 // Compact is not supported on a memory database, but there's no need either as
 // a memory database doesn't waste space anyway.
 func (db *Database) Compact(start []byte, limit []byte) error {
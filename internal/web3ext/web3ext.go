@@ -270,6 +270,11 @@ web3._extend({
 			params: 1,
 			outputFormatter: console.log
 		}),
+		new web3._extend.Method({
+			name: 'chaindbStats',
+			call: 'debug_chaindbStats',
+			params: 0,
+		}),
 		new web3._extend.Method({
 			name: 'chaindbCompact',
 			call: 'debug_chaindbCompact',
@@ -439,6 +444,28 @@ web3._extend({
 			call: 'debug_getBadBlocks',
 			params: 0,
 		}),
+		new web3._extend.Method({
+			name: 'stateGrowth',
+			call: 'debug_stateGrowth',
+			params: 1,
+		}),
+		new web3._extend.Method({
+			name: 'replayBlocks',
+			call: 'debug_replayBlocks',
+			params: 3,
+			inputFormatter: [web3._extend.utils.fromDecimal, web3._extend.utils.fromDecimal, null],
+		}),
+		new web3._extend.Method({
+			name: 'txIndexProgress',
+			call: 'debug_txIndexProgress',
+			params: 0,
+		}),
+		new web3._extend.Method({
+			name: 'backfillTxIndex',
+			call: 'debug_backfillTxIndex',
+			params: 1,
+			inputFormatter: [web3._extend.utils.fromDecimal],
+		}),
 		new web3._extend.Method({
 			name: 'storageRangeAt',
 			call: 'debug_storageRangeAt',
@@ -480,7 +480,7 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 					}
 					triedb := h.blockchain.StateCache().TrieDB()
 
-					account, err := h.getAccount(triedb, header.Root, common.BytesToHash(request.AccKey))
+					account, err := h.getAccount(header.Root, common.BytesToHash(request.AccKey))
 					if err != nil {
 						p.Log().Warn("Failed to retrieve account for code", "block", header.Number, "hash", header.Hash(), "account", common.BytesToHash(request.AccKey), "err", err)
 						atomic.AddUint32(&p.invalidCount, 1)
@@ -636,7 +636,7 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 						}
 					default:
 						// Account key specified, open a storage trie
-						account, err := h.getAccount(statedb.TrieDB(), root, common.BytesToHash(request.AccKey))
+						account, err := h.getAccount(root, common.BytesToHash(request.AccKey))
 						if err != nil {
 							p.Log().Warn("Failed to retrieve account for proof", "block", header.Number, "hash", header.Hash(), "account", common.BytesToHash(request.AccKey), "err", err)
 							atomic.AddUint32(&p.invalidCount, 1)
@@ -843,18 +843,17 @@ func (h *serverHandler) handleMsg(p *clientPeer, wg *sync.WaitGroup) error {
 }
 
 // getAccount retrieves an account from the state based on root.
-func (h *serverHandler) getAccount(triedb *trie.Database, root, hash common.Hash) (state.Account, error) {
-	trie, err := trie.New(root, triedb)
+func (h *serverHandler) getAccount(root, hash common.Hash) (*state.Account, error) {
+	reader, err := h.blockchain.StateReaderAt(root, 0)
 	if err != nil {
-		return state.Account{}, err
+		return nil, err
 	}
-	blob, err := trie.TryGet(hash[:])
+	account, err := reader.AccountByHash(hash)
 	if err != nil {
-		return state.Account{}, err
+		return nil, err
 	}
-	var account state.Account
-	if err = rlp.DecodeBytes(blob, &account); err != nil {
-		return state.Account{}, err
+	if account == nil {
+		return nil, errors.New("account not found")
 	}
 	return account, nil
 }
@@ -66,6 +66,12 @@ func (db *odrDatabase) CopyTrie(t state.Trie) state.Trie {
 	}
 }
 
+func (db *odrDatabase) ReleaseTrie(root common.Hash) {}
+
+func (db *odrDatabase) CodeCache() *state.CodeCache {
+	return nil
+}
+
 func (db *odrDatabase) ContractCode(addrHash, codeHash common.Hash) ([]byte, error) {
 	if codeHash == sha3Nil {
 		return nil, nil
@@ -105,6 +111,15 @@ func (t *odrTrie) TryGet(key []byte) ([]byte, error) {
 	return res, err
 }
 
+func (t *odrTrie) TryGetHashed(hashKey []byte) ([]byte, error) {
+	var res []byte
+	err := t.do(hashKey, func() (err error) {
+		res, err = t.trie.TryGet(hashKey)
+		return err
+	})
+	return res, err
+}
+
 func (t *odrTrie) TryUpdate(key, value []byte) error {
 	key = crypto.Keccak256(key)
 	return t.do(key, func() error {
@@ -112,6 +127,12 @@ func (t *odrTrie) TryUpdate(key, value []byte) error {
 	})
 }
 
+func (t *odrTrie) TryUpdateHashed(key, hashKey, value []byte) error {
+	return t.do(hashKey, func() error {
+		return t.trie.TryUpdate(hashKey, value)
+	})
+}
+
 func (t *odrTrie) TryDelete(key []byte) error {
 	key = crypto.Keccak256(key)
 	return t.do(key, func() error {
@@ -119,6 +140,12 @@ func (t *odrTrie) TryDelete(key []byte) error {
 	})
 }
 
+func (t *odrTrie) TryDeleteHashed(hashKey []byte) error {
+	return t.do(hashKey, func() error {
+		return t.trie.TryDelete(hashKey)
+	})
+}
+
 func (t *odrTrie) Commit(onleaf trie.LeafCallback) (common.Hash, error) {
 	if t.trie == nil {
 		return t.id.Root, nil
@@ -32,7 +32,9 @@ import (
 	"github.com/ethereum/go-ethereum/accounts/scwallet"
 	"github.com/ethereum/go-ethereum/accounts/usbwallet"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/core/rawdb"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/p2p"
 	"github.com/ethereum/go-ethereum/p2p/enode"
@@ -70,6 +72,40 @@ type Config struct {
 	// in memory.
 	DataDir string
 
+	// DBEngine is the name of the key-value store backend (as registered in rawdb)
+	// used by the persistent databases. LevelDB is used if empty.
+	DBEngine string `toml:",omitempty"`
+
+	// AncientFullCheck makes the freezer verify all its items on startup instead
+	// of a random sample of them.
+	AncientFullCheck bool `toml:",omitempty"`
+
+	// AncientDropCache makes the freezer evict the ancient chain data from the OS
+	// page cache after writing it, leaving the cache to the hot database.
+	AncientDropCache bool `toml:",omitempty"`
+
+	// AncientMigrate makes the freezer convert the tables stored in a format other
+	// than the configured one on startup, which may take a while.
+	AncientMigrate bool `toml:",omitempty"`
+
+	// AncientInlineIndex makes the freezer store the small items of new tables in
+	// their indexes. Such tables can't be opened by older versions anymore.
+	AncientInlineIndex bool `toml:",omitempty"`
+
+	// AncientMaxOpenFiles limits the number of data files each freezer table
+	// keeps open, reopening the evicted ones on access. Zero means no limit.
+	AncientMaxOpenFiles int `toml:",omitempty"`
+
+	// AncientSync overrides the strategy of the freezer tables to flush the
+	// appended data to disk, keyed by table name. Tables not listed keep their
+	// default strategy.
+	AncientSync map[string]rawdb.FreezerSync `toml:",omitempty"`
+
+	// AncientHistoryRetention limits the block bodies and receipts kept by the
+	// freezer, replacing the policy persisted with them. If nil, the persisted
+	// policy stays in effect.
+	AncientHistoryRetention *ethdb.AncientRetention `toml:",omitempty"`
+
 	// Configuration of peer-to-peer networking.
 	P2P p2p.Config
 
@@ -346,6 +382,20 @@ func (c *Config) ResolvePath(path string) string {
 	return filepath.Join(c.instanceDir(), path)
 }
 
+// freezerConfig returns the settings of the freezer attached to the databases.
+func (c *Config) freezerConfig() rawdb.FreezerConfig {
+	return rawdb.FreezerConfig{
+		MaxOpenFiles: c.AncientMaxOpenFiles,
+		Migrate:      c.AncientMigrate,
+		FullCheck:    c.AncientFullCheck,
+		DropCache:    c.AncientDropCache,
+		InlineIndex:  c.AncientInlineIndex,
+		Sync:         c.AncientSync,
+
+		HistoryRetention: c.AncientHistoryRetention,
+	}
+}
+
 func (c *Config) instanceDir() string {
 	if c.DataDir == "" {
 		return ""
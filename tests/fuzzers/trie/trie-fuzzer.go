@@ -175,7 +175,11 @@ func runRandTest(rt randTest) error {
 				checktr.Update(it.Key, it.Value)
 			}
 			if tr.Hash() != checktr.Hash() {
-				return fmt.Errorf("hash mismatch in opItercheckhash")
+				diffs, err := trie.DiffTries(tr, checktr)
+				if err != nil {
+					return fmt.Errorf("hash mismatch in opItercheckhash, diff failed: %v", err)
+				}
+				return fmt.Errorf("hash mismatch in opItercheckhash, divergent nodes: %v", diffs)
 			}
 		case opProve:
 			rt[i].err = tr.Prove(step.key, 0, proofDb{})
@@ -26,6 +26,7 @@ import (
 
 	"github.com/VictoriaMetrics/fastcache"
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/log"
 	"github.com/ethereum/go-ethereum/metrics"
@@ -54,6 +55,10 @@ var (
 	memcacheCommitTimeTimer  = metrics.NewRegisteredResettingTimer("trie/memcache/commit/time", nil)
 	memcacheCommitNodesMeter = metrics.NewRegisteredMeter("trie/memcache/commit/nodes", nil)
 	memcacheCommitSizeMeter  = metrics.NewRegisteredMeter("trie/memcache/commit/size", nil)
+
+	memcacheProbeDirtyMeter = metrics.NewRegisteredMeter("trie/memcache/probe/dirty", nil)
+	memcacheProbeCleanMeter = metrics.NewRegisteredMeter("trie/memcache/probe/clean", nil)
+	memcacheProbeDiskMeter  = metrics.NewRegisteredMeter("trie/memcache/probe/disk", nil)
 )
 
 // secureKeyPrefix is the database key prefix used to store trie node preimages.
@@ -82,6 +87,7 @@ type Database struct {
 	newest  common.Hash                 // Newest tracked node, flush-list tail
 
 	preimages map[common.Hash][]byte // Preimages of nodes from the secure trie
+	resolver  PreimageResolver       // External source of the preimages missing from the database
 
 	gctime  time.Duration      // Time spent on garbage collection since last commit
 	gcnodes uint64             // Nodes garbage collected since last commit
@@ -94,6 +100,9 @@ type Database struct {
 	dirtiesSize   common.StorageSize // Storage size of the dirty node cache (exc. metadata)
 	childrenSize  common.StorageSize // Storage size of the external children tracking
 	preimagesSize common.StorageSize // Storage size of the preimages cache
+	insertedSize  common.StorageSize // Storage size of all the nodes ever inserted into the dirty cache
+
+	writes writeStats // Statistics of the data written by the flushes
 
 	lock sync.RWMutex
 }
@@ -346,6 +355,7 @@ func (db *Database) insert(hash common.Hash, size int, node node) {
 		db.dirties[db.newest].flushNext, db.newest = hash, hash
 	}
 	db.dirtiesSize += common.StorageSize(common.HashLength + entry.size)
+	db.insertedSize += common.StorageSize(common.HashLength + entry.size)
 }
 
 // insertPreimage writes a new trie node pre-image to the memory database if it's
@@ -368,7 +378,7 @@ func (db *Database) node(hash common.Hash) node {
 		if enc := db.cleans.Get(nil, hash[:]); enc != nil {
 			memcacheCleanHitMeter.Mark(1)
 			memcacheCleanReadMeter.Mark(int64(len(enc)))
-			return mustDecodeNode(hash[:], enc)
+			return mustDecodeNodeUnsafe(hash[:], enc)
 		}
 	}
 	// Retrieve the node from the dirty cache if available
@@ -393,7 +403,16 @@ func (db *Database) node(hash common.Hash) node {
 		memcacheCleanMissMeter.Mark(1)
 		memcacheCleanWriteMeter.Mark(int64(len(enc)))
 	}
-	return mustDecodeNode(hash[:], enc)
+	return mustDecodeNodeUnsafe(hash[:], enc)
+}
+
+// insertClean stores a trie node retrieved from an external source into the
+// clean cache, if it's enabled.
+func (db *Database) insertClean(hash common.Hash, blob []byte) {
+	if db.cleans != nil {
+		db.cleans.Set(hash[:], blob)
+		memcacheCleanWriteMeter.Mark(int64(len(blob)))
+	}
 }
 
 // Node retrieves an encoded cached trie node from memory. If it cannot be found
@@ -435,6 +454,33 @@ func (db *Database) Node(hash common.Hash) ([]byte, error) {
 	return enc, err
 }
 
+// HasNode reports whether the trie node with the given hash is available, either
+// in memory or in the persistent database. Unlike Node, the content of the node
+// is not retrieved: the dirty and clean caches are checked first, then the disk
+// is probed for the key only.
+func (db *Database) HasNode(hash common.Hash) bool {
+	// It doesn't make sense to probe the metaroot
+	if hash == (common.Hash{}) {
+		return false
+	}
+	db.lock.RLock()
+	_, dirty := db.dirties[hash]
+	db.lock.RUnlock()
+
+	if dirty {
+		memcacheProbeDirtyMeter.Mark(1)
+		return true
+	}
+	if db.cleans != nil && db.cleans.Has(hash[:]) {
+		memcacheProbeCleanMeter.Mark(1)
+		return true
+	}
+	memcacheProbeDiskMeter.Mark(1)
+
+	ok, _ := db.diskdb.Has(hash[:])
+	return ok
+}
+
 // preimage retrieves a cached trie node pre-image from memory. If it cannot be
 // found cached, the method queries the persistent database for the content.
 func (db *Database) preimage(hash common.Hash) ([]byte, error) {
@@ -447,7 +493,39 @@ func (db *Database) preimage(hash common.Hash) ([]byte, error) {
 		return preimage, nil
 	}
 	// Content unavailable in memory, attempt to retrieve from disk
-	return db.diskdb.Get(secureKey(hash))
+	preimage, err := db.diskdb.Get(secureKey(hash))
+	if len(preimage) > 0 {
+		return preimage, nil
+	}
+	// Preimage unknown locally, fall back to the external resolver if any
+	db.lock.RLock()
+	resolver := db.resolver
+	db.lock.RUnlock()
+
+	if resolver != nil {
+		if preimage := resolver(hash); preimage != nil {
+			if crypto.Keccak256Hash(preimage) != hash {
+				return nil, fmt.Errorf("invalid preimage of %x: %x", hash, preimage)
+			}
+			return preimage, nil
+		}
+	}
+	return nil, err
+}
+
+// PreimageResolver retrieves the preimage of a hashed trie key from a source
+// outside of the database, nil if it's unknown. Resolvers must be safe for
+// concurrent use.
+type PreimageResolver func(hash common.Hash) []byte
+
+// SetPreimageResolver installs an external source for the preimages of the
+// hashed trie keys missing from the database, such as the addresses known to a
+// state conversion. The resolved preimages are verified but not persisted.
+func (db *Database) SetPreimageResolver(resolver PreimageResolver) {
+	db.lock.Lock()
+	defer db.lock.Unlock()
+
+	db.resolver = resolver
 }
 
 // secureKey returns the database key for the preimage of key (as a newly
@@ -606,6 +684,8 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	// If the preimage cache got large enough, push to disk. If it's still small
 	// leave for later to deduplicate writes.
 	flushPreimages := db.preimagesSize > 4*1024*1024
+
+	db.writes.begin(len(db.dirties) + len(db.preimages))
 	if flushPreimages {
 		for hash, preimage := range db.preimages {
 			copy(keyBuf[secureKeyPrefixLength:], hash[:])
@@ -613,6 +693,7 @@ func (db *Database) Cap(limit common.StorageSize) error {
 				log.Error("Failed to commit preimage from trie database", "err", err)
 				return err
 			}
+			db.writes.preimage(hash, len(preimage))
 			if batch.ValueSize() > ethdb.IdealBatchSize {
 				if err := batch.Write(); err != nil {
 					return err
@@ -626,9 +707,11 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	for size > limit && oldest != (common.Hash{}) {
 		// Fetch the oldest referenced node and push into the batch
 		node := db.dirties[oldest]
-		if err := batch.Put(oldest[:], node.rlp()); err != nil {
+		blob := node.rlp()
+		if err := batch.Put(oldest[:], blob); err != nil {
 			return err
 		}
+		db.writes.node(oldest, len(blob))
 		// If we exceeded the ideal batch size, commit and reset
 		if batch.ValueSize() >= ethdb.IdealBatchSize {
 			if err := batch.Write(); err != nil {
@@ -675,6 +758,7 @@ func (db *Database) Cap(limit common.StorageSize) error {
 	db.flushnodes += uint64(nodes - len(db.dirties))
 	db.flushsize += storage - db.dirtiesSize
 	db.flushtime += time.Since(start)
+	db.writes.finish()
 
 	memcacheFlushTimeTimer.Update(time.Since(start))
 	memcacheFlushSizeMeter.Mark(int64(storage - db.dirtiesSize))
@@ -706,12 +790,14 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	copy(keyBuf[:], secureKeyPrefix)
 
 	// Move all of the accumulated preimages into a write batch
+	db.writes.begin(len(db.dirties) + len(db.preimages))
 	for hash, preimage := range db.preimages {
 		copy(keyBuf[secureKeyPrefixLength:], hash[:])
 		if err := batch.Put(keyBuf[:], preimage); err != nil {
 			log.Error("Failed to commit preimage from trie database", "err", err)
 			return err
 		}
+		db.writes.preimage(hash, len(preimage))
 		// If the batch is too large, flush to disk
 		if batch.ValueSize() > ethdb.IdealBatchSize {
 			if err := batch.Write(); err != nil {
@@ -750,6 +836,7 @@ func (db *Database) Commit(node common.Hash, report bool) error {
 	// Reset the storage counters and bumpd metrics
 	db.preimages = make(map[common.Hash][]byte)
 	db.preimagesSize = 0
+	db.writes.finish()
 
 	memcacheCommitTimeTimer.Update(time.Since(start))
 	memcacheCommitSizeMeter.Mark(int64(storage - db.dirtiesSize))
@@ -785,9 +872,12 @@ func (db *Database) commit(hash common.Hash, batch ethdb.Batch, uncacher *cleane
 	if err != nil {
 		return err
 	}
-	if err := batch.Put(hash[:], node.rlp()); err != nil {
+	blob := node.rlp()
+	if err := batch.Put(hash[:], blob); err != nil {
 		return err
 	}
+	db.writes.node(hash, len(blob))
+
 	// If we've reached an optimal batch size, commit and start over
 	if batch.ValueSize() >= ethdb.IdealBatchSize {
 		if err := batch.Write(); err != nil {
@@ -863,3 +953,13 @@ func (db *Database) Size() (common.StorageSize, common.StorageSize) {
 	var metarootRefs = common.StorageSize(len(db.dirties[common.Hash{}].children) * (common.HashLength + 2))
 	return db.dirtiesSize + db.childrenSize + metadataSize - metarootRefs, db.preimagesSize
 }
+
+// Inserted returns the cumulative storage size of all the nodes inserted into the
+// memory cache, regardless of them being flushed or garbage collected since. The
+// nodes already cached are not counted again.
+func (db *Database) Inserted() common.StorageSize {
+	db.lock.RLock()
+	defer db.lock.RUnlock()
+
+	return db.insertedSize
+}
@@ -31,3 +31,39 @@ func TestDatabaseMetarootFetch(t *testing.T) {
 		t.Fatalf("metaroot retrieval succeeded")
 	}
 }
+
+// Tests that the write statistics of the trie database detect the data written
+// by consecutive flushes.
+func TestDatabaseWriteStats(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+
+	commit := func(values int) common.Hash {
+		trie, _ := NewSecure(common.Hash{}, db)
+		for i := 0; i < values; i++ {
+			trie.Update(common.LeftPadBytes([]byte{byte(i)}, 32), []byte{byte(i), 1})
+		}
+		root, _ := trie.Commit(nil)
+		if err := db.Commit(root, false); err != nil {
+			t.Fatalf("failed to commit trie: %v", err)
+		}
+		return root
+	}
+	commit(100)
+	if db.writes.nodes == 0 || db.writes.preimages == 0 {
+		t.Fatalf("flush not tracked: nodes %v, preimages %v", db.writes.nodes, db.writes.preimages)
+	}
+	if db.writes.overwrites != 0 {
+		t.Fatalf("first flush overwrites mismatch: have %v, want 0", db.writes.overwrites)
+	}
+	// Flush the same trie again, everything should be rewritten
+	commit(100)
+	if have, want := db.writes.overwrites, db.writes.nodes+db.writes.preimages; have != want {
+		t.Fatalf("repeated flush overwrites mismatch: have %v, want %v", have, want)
+	}
+	// Empty flushes must not reset the reference of the next flush
+	db.Cap(1 << 30)
+	commit(100)
+	if db.writes.overwrites == 0 {
+		t.Fatalf("overwrites lost after empty flush")
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// NodeDiffIterator iterates over the standalone trie nodes differing between two
+// tries stored in the database, ordered by path. At every path at least one of
+// the tries holds a node the other one doesn't: a modified node yields both
+// blobs, a created or deleted one only the blob of the side holding it.
+//
+// The subtrees shared by the two tries are skipped entirely, so the cost of the
+// iteration is proportional to the size of the difference, not of the tries.
+type NodeDiffIterator struct {
+	db *Database
+
+	olds NodeIterator // Nodes of the old trie missing from the new one
+	news NodeIterator // Nodes of the new trie missing from the old one
+
+	oldDone, newDone bool // Whether the respective iterators are exhausted
+
+	path     []byte // Path of the current difference
+	oldBlob  []byte // Node of the old trie at the current path, nil if none
+	newBlob  []byte // Node of the new trie at the current path, nil if none
+	err      error  // Failure set in case of an internal error in the iterator
+	started  bool   // Whether the underlying iterators were positioned already
+	finished bool   // Whether the iteration is complete
+}
+
+// NewNodeDiffIterator creates an iterator over the nodes differing between the
+// tries with the given roots. Both tries must be available in the database.
+func NewNodeDiffIterator(db *Database, oldRoot, newRoot common.Hash) (*NodeDiffIterator, error) {
+	oldTrie, err := New(oldRoot, db)
+	if err != nil {
+		return nil, err
+	}
+	newTrie, err := New(newRoot, db)
+	if err != nil {
+		return nil, err
+	}
+	olds, _ := NewDifferenceIterator(newTrie.NodeIterator(nil), oldTrie.NodeIterator(nil))
+	news, _ := NewDifferenceIterator(oldTrie.NodeIterator(nil), newTrie.NodeIterator(nil))
+
+	return &NodeDiffIterator{db: db, olds: olds, news: news}, nil
+}
+
+// Next moves the iterator to the next differing path, returning whether there
+// are any further differences. In case of an internal error this method returns
+// false and sets the Error field to the encountered failure.
+func (it *NodeDiffIterator) Next() bool {
+	if it.finished || it.err != nil {
+		return false
+	}
+	if !it.started {
+		it.oldDone, it.newDone = !it.advance(it.olds), !it.advance(it.news)
+		it.started = true
+	}
+	if it.err != nil {
+		return false
+	}
+	if it.oldDone && it.newDone {
+		it.finished = true
+		return false
+	}
+	// Pick the side(s) with the lowest path and load their nodes
+	var cmp int
+	switch {
+	case it.oldDone:
+		cmp = 1
+	case it.newDone:
+		cmp = -1
+	default:
+		cmp = bytes.Compare(it.olds.Path(), it.news.Path())
+	}
+	it.oldBlob, it.newBlob = nil, nil
+	if cmp <= 0 {
+		it.path = append(it.path[:0], it.olds.Path()...)
+		if it.oldBlob, it.err = it.db.Node(it.olds.Hash()); it.err != nil {
+			return false
+		}
+		it.oldDone = !it.advance(it.olds)
+	}
+	if cmp >= 0 {
+		it.path = append(it.path[:0], it.news.Path()...)
+		if it.newBlob, it.err = it.db.Node(it.news.Hash()); it.err != nil {
+			return false
+		}
+		it.newDone = !it.advance(it.news)
+	}
+	return it.err == nil
+}
+
+// advance moves the given iterator to its next standalone node, skipping the
+// values and the nodes embedded into their parents.
+func (it *NodeDiffIterator) advance(nodes NodeIterator) bool {
+	for nodes.Next(true) {
+		if nodes.Hash() != (common.Hash{}) {
+			return true
+		}
+	}
+	if err := nodes.Error(); err != nil {
+		it.err = err
+	}
+	return false
+}
+
+// Path returns the path of the current differing node, in nibbles. The slice is
+// only valid until the next call to Next.
+func (it *NodeDiffIterator) Path() []byte {
+	return it.path
+}
+
+// Old returns the blob of the node at the current path in the old trie, nil if
+// the node was created.
+func (it *NodeDiffIterator) Old() []byte {
+	return it.oldBlob
+}
+
+// New returns the blob of the node at the current path in the new trie, nil if
+// the node was deleted.
+func (it *NodeDiffIterator) New() []byte {
+	return it.newBlob
+}
+
+// Error returns any failure that occurred during iteration, which might have
+// caused a premature iteration exit.
+func (it *NodeDiffIterator) Error() error {
+	return it.err
+}
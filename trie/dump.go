@@ -0,0 +1,156 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/rlp"
+)
+
+// GenerateTrie deterministically builds a trie with the given number of entries
+// from a seed, returning the trie along with its content. The keys are of random
+// length (up to 32 bytes), so the trie contains nodes embedded into their parents
+// too. The first byte of every key is its length, keeping the keys prefix-free
+// like the ones of the state tries.
+//
+// The trie is not committed, it's meant to be used by tests and fuzzers as the
+// reference to compare other implementations against.
+func GenerateTrie(db *Database, seed int64, entries int) (*Trie, map[string][]byte) {
+	var (
+		rnd     = rand.New(rand.NewSource(seed))
+		trie, _ = New(common.Hash{}, db)
+		content = make(map[string][]byte)
+	)
+	for len(content) < entries {
+		key := make([]byte, 2+rnd.Intn(31))
+		rnd.Read(key[1:])
+		key[0] = byte(len(key))
+		val := make([]byte, 1+rnd.Intn(64))
+		rnd.Read(val)
+
+		trie.Update(key, val)
+		content[string(key)] = val
+	}
+	return trie, content
+}
+
+// DumpedNode is a standalone node of a trie, as stored in the database.
+type DumpedNode struct {
+	Hash common.Hash // Hash of the node
+	Blob []byte      // RLP encoding of the node
+}
+
+// NodeDump is the flat representation of a trie: its standalone nodes keyed by
+// their path (in nibbles) from the root. Nodes embedded into their parents are
+// not dumped separately, they are part of the parent's blob. The root is always
+// dumped, at the empty path.
+type NodeDump map[string]DumpedNode
+
+// DumpTrie produces the node dump of a trie. The trie doesn't need to be hashed
+// or committed, the nodes missing from memory are resolved from the database.
+func DumpTrie(t *Trie) (NodeDump, error) {
+	dump := make(NodeDump)
+	if t.root == nil {
+		return dump, nil
+	}
+	h := newHasher(false)
+	defer returnHasherToPool(h)
+
+	if err := t.dump(h, t.root, nil, dump); err != nil {
+		return nil, err
+	}
+	return dump, nil
+}
+
+// dump recursively adds the standalone nodes of a subtrie into the node dump.
+func (t *Trie) dump(h *hasher, n node, path []byte, dump NodeDump) error {
+	switch n := n.(type) {
+	case hashNode:
+		resolved, err := t.resolveHash(n, path)
+		if err != nil {
+			return err
+		}
+		return t.dump(h, resolved, path, dump)
+
+	case *shortNode, *fullNode:
+		collapsed, _ := h.proofHash(n)
+		blob, err := rlp.EncodeToBytes(collapsed)
+		if err != nil {
+			return err
+		}
+		if len(blob) >= 32 || len(path) == 0 {
+			dump[string(path)] = DumpedNode{Hash: crypto.Keccak256Hash(blob), Blob: blob}
+		}
+		if sn, ok := n.(*shortNode); ok {
+			return t.dump(h, sn.Val, append(append([]byte{}, path...), sn.Key...), dump)
+		}
+		for i, child := range n.(*fullNode).Children[:16] {
+			if child != nil {
+				if err := t.dump(h, child, append(append([]byte{}, path...), byte(i)), dump); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// NodeDiff is a divergence between two tries: a path at which they hold different
+// standalone nodes. The hash of the side not having a node at the path is zero.
+type NodeDiff struct {
+	Path []byte      // Path of the node from the root, in nibbles
+	A    common.Hash // Hash of the node in the first trie
+	B    common.Hash // Hash of the node in the second trie
+}
+
+// DiffTries structurally compares two tries, returning all the paths at which
+// they diverge, ordered by path. Since a modified node changes the hashes of all
+// its ancestors, the deepest reported paths pinpoint the actual differences.
+func DiffTries(a, b *Trie) ([]NodeDiff, error) {
+	dumpA, err := DumpTrie(a)
+	if err != nil {
+		return nil, err
+	}
+	dumpB, err := DumpTrie(b)
+	if err != nil {
+		return nil, err
+	}
+	return DiffDumps(dumpA, dumpB), nil
+}
+
+// DiffDumps structurally compares two node dumps, see DiffTries.
+func DiffDumps(a, b NodeDump) []NodeDiff {
+	var diffs []NodeDiff
+	for path, na := range a {
+		if nb := b[path]; nb.Hash != na.Hash {
+			diffs = append(diffs, NodeDiff{Path: []byte(path), A: na.Hash, B: nb.Hash})
+		}
+	}
+	for path, nb := range b {
+		if _, ok := a[path]; !ok {
+			diffs = append(diffs, NodeDiff{Path: []byte(path), B: nb.Hash})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return string(diffs[i].Path) < string(diffs[j].Path)
+	})
+	return diffs
+}
@@ -20,9 +20,11 @@ import (
 	"bytes"
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 
 	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 )
 
@@ -57,6 +59,57 @@ func TestIterator(t *testing.T) {
 	}
 }
 
+// Tests that node iterators keep traversing the content of the trie at their
+// creation, even if the trie is modified and committed in the meantime.
+func TestIteratorAcrossCommit(t *testing.T) {
+	trie := newEmpty()
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key, val := fmt.Sprintf("key-%03d", i), fmt.Sprintf("val-%03d", i)
+		trie.Update([]byte(key), []byte(val))
+		want[key] = val
+	}
+	// Create an iterator over the dirty trie, one over the committed trie and
+	// start them both before modifying the trie
+	dirty := NewIterator(trie.NodeIterator(nil))
+	dirty.Next()
+	trie.Commit(nil)
+	committed := NewIterator(trie.NodeIterator(nil))
+	committed.Next()
+
+	for i := 0; i < 100; i += 2 {
+		trie.Delete([]byte(fmt.Sprintf("key-%03d", i)))
+		trie.Update([]byte(fmt.Sprintf("key-%03d", i+1)), []byte("modified"))
+	}
+	trie.Commit(nil)
+	unstarted := NewIterator(trie.NodeIterator(nil))
+	trie.Update([]byte("key-new"), []byte("new"))
+	trie.Commit(nil)
+
+	for i, it := range []*Iterator{dirty, committed} {
+		found := map[string]string{string(it.Key): string(it.Value)}
+		for it.Next() {
+			found[string(it.Key)] = string(it.Value)
+		}
+		if it.Err != nil {
+			t.Fatalf("iterator %d failed: %v", i, it.Err)
+		}
+		if !reflect.DeepEqual(found, want) {
+			t.Errorf("iterator %d content mismatch: have %d entries, want %d", i, len(found), len(want))
+		}
+	}
+	count := 0
+	for unstarted.Next() {
+		if string(unstarted.Key) == "key-new" {
+			t.Fatalf("unstarted iterator sees later modifications")
+		}
+		count++
+	}
+	if count != 50 {
+		t.Errorf("unstarted iterator entry count mismatch: have %d, want %d", count, 50)
+	}
+}
+
 type kv struct {
 	k, v []byte
 	t    bool
@@ -440,3 +493,68 @@ func checkIteratorNoDups(t *testing.T, it NodeIterator, seen map[string]bool) in
 	}
 	return len(seen)
 }
+
+// Tests that the node diff iterator yields exactly the nodes differing between
+// two committed tries, along with their blobs.
+func TestNodeDiffIterator(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	a, content := GenerateTrie(triedb, 1, 500)
+	rootA, _ := a.Commit(nil)
+
+	// Modify, delete and insert some entries and commit the result too
+	b, _ := New(rootA, triedb)
+	var n int
+	for key := range content {
+		switch {
+		case n < 10:
+			b.Update([]byte(key), []byte("modified"))
+		case n < 20:
+			b.Delete([]byte(key))
+		}
+		n++
+	}
+	for i := 0; i < 10; i++ {
+		b.Update([]byte(fmt.Sprintf("inserted-%d", i)), []byte("inserted"))
+	}
+	rootB, _ := b.Commit(nil)
+	a, _ = New(rootA, triedb)
+	b, _ = New(rootB, triedb)
+
+	dumpA, _ := DumpTrie(a)
+	dumpB, _ := DumpTrie(b)
+	want := DiffDumps(dumpA, dumpB)
+
+	it, err := NewNodeDiffIterator(triedb, rootA, rootB)
+	if err != nil {
+		t.Fatalf("failed to create iterator: %v", err)
+	}
+	var have []NodeDiff
+	for it.Next() {
+		var diff NodeDiff
+		diff.Path = append([]byte{}, it.Path()...)
+		if it.Old() != nil {
+			if node := dumpA[string(diff.Path)]; !bytes.Equal(node.Blob, it.Old()) {
+				t.Fatalf("path %x: old blob mismatch: have %x, want %x", diff.Path, it.Old(), node.Blob)
+			}
+			diff.A = crypto.Keccak256Hash(it.Old())
+		}
+		if it.New() != nil {
+			if node := dumpB[string(diff.Path)]; !bytes.Equal(node.Blob, it.New()) {
+				t.Fatalf("path %x: new blob mismatch: have %x, want %x", diff.Path, it.New(), node.Blob)
+			}
+			diff.B = crypto.Keccak256Hash(it.New())
+		}
+		have = append(have, diff)
+	}
+	if err := it.Error(); err != nil {
+		t.Fatalf("iteration failed: %v", err)
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Fatalf("diff mismatch:\nhave %v\nwant %v", have, want)
+	}
+	// Ensure identical tries don't diverge
+	it, _ = NewNodeDiffIterator(triedb, rootB, rootB)
+	if it.Next() {
+		t.Fatalf("identical tries diverge at %x", it.Path())
+	}
+}
@@ -18,8 +18,10 @@ package trie
 
 import (
 	"bytes"
+	"reflect"
 	"testing"
 
+	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/rlp"
 )
 
@@ -92,3 +94,33 @@ func TestDecodeFullNode(t *testing.T) {
 		t.Fatalf("decode full node err: %v", err)
 	}
 }
+
+// Tests the ownership rules of the node decoders: the safe decoder must not
+// reference the input, the unsafe one must reference it instead of copying.
+func TestDecodeNodeOwnership(t *testing.T) {
+	enc, err := rlp.EncodeToBytes(newTestFullNode([]byte("decodeownership")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	orig := common.CopyBytes(enc)
+
+	safe, err := decodeNode(nil, enc)
+	if err != nil {
+		t.Fatalf("failed to decode node: %v", err)
+	}
+	unsafe, err := decodeNodeUnsafe(nil, enc)
+	if err != nil {
+		t.Fatalf("failed to decode node: %v", err)
+	}
+	// Mutate the input and check which decoded node observes the change
+	for i := range enc {
+		enc[i] = ^enc[i]
+	}
+	want, _ := decodeNode(nil, orig)
+	if !reflect.DeepEqual(safe, want) {
+		t.Fatalf("safe decoding references the input: have %v, want %v", safe, want)
+	}
+	if reflect.DeepEqual(unsafe, want) {
+		t.Fatalf("unsafe decoding copied the input")
+	}
+}
@@ -20,6 +20,8 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/ethdb"
@@ -36,6 +38,12 @@ import (
 // nodes of the longest existing prefix of the key (at least the root node), ending
 // with the node that proves the absence of the key.
 func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) error {
+	return t.prove(key, fromLevel, proofDb, nil)
+}
+
+// prove constructs a merkle proof for key, resolving and encoding the nodes on
+// the path through the given cache if it's non-nil.
+func (t *Trie) prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter, cache *proofCache) error {
 	// Collect all nodes on the path to key.
 	key = keybytesToHex(key)
 	var nodes []node
@@ -57,7 +65,7 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) e
 			nodes = append(nodes, n)
 		case hashNode:
 			var err error
-			tn, err = t.resolveHash(n, nil)
+			tn, err = cache.resolve(t, n)
 			if err != nil {
 				log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
 				return err
@@ -74,21 +82,145 @@ func (t *Trie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) e
 			fromLevel--
 			continue
 		}
-		var hn node
-		n, hn = hasher.proofHash(n)
-		if hash, ok := hn.(hashNode); ok || i == 0 {
-			// If the node's database encoding is a hash (or is the
-			// root node), it becomes a proof element.
-			enc, _ := rlp.EncodeToBytes(n)
-			if !ok {
-				hash = hasher.hashData(enc)
-			}
+		// If the node's database encoding is a hash (or is the root node), it
+		// becomes a proof element.
+		if hash, enc := cache.encode(hasher, n, i == 0); enc != nil {
 			proofDb.Put(hash, enc)
 		}
 	}
 	return nil
 }
 
+// proofElement is the proof encoding of a trie node, along with its hash. The
+// encoding is nil if the node is embedded into its parent.
+type proofElement struct {
+	hash []byte
+	enc  []byte
+}
+
+// proofCache is a cache of the trie nodes resolved and encoded while proving a
+// batch of keys. It's shared between the proving workers, so the upper levels
+// of the trie, common to all the proven paths, are only resolved and encoded
+// once. A nil cache resolves and encodes everything directly.
+type proofCache struct {
+	nodes map[common.Hash]node  // Resolved nodes by hash
+	elems map[node]proofElement // Proof elements by (short or full) node
+	lock  sync.RWMutex
+}
+
+// newProofCache creates an empty proof cache.
+func newProofCache() *proofCache {
+	return &proofCache{
+		nodes: make(map[common.Hash]node),
+		elems: make(map[node]proofElement),
+	}
+}
+
+// resolve retrieves the trie node with the given hash.
+func (c *proofCache) resolve(t *Trie, n hashNode) (node, error) {
+	if c == nil {
+		return t.resolveHash(n, nil)
+	}
+	hash := common.BytesToHash(n)
+
+	c.lock.RLock()
+	resolved, ok := c.nodes[hash]
+	c.lock.RUnlock()
+	if ok {
+		return resolved, nil
+	}
+	resolved, err := t.resolveHash(n, nil)
+	if err != nil {
+		return nil, err
+	}
+	c.lock.Lock()
+	c.nodes[hash] = resolved
+	c.lock.Unlock()
+	return resolved, nil
+}
+
+// encode returns the proof encoding of a short or full node along with its hash,
+// or a nil encoding if the node is embedded into its parent. The root is always
+// encoded.
+func (c *proofCache) encode(hasher *hasher, n node, root bool) ([]byte, []byte) {
+	if c != nil {
+		c.lock.RLock()
+		elem, ok := c.elems[n]
+		c.lock.RUnlock()
+		if ok {
+			return elem.hash, elem.enc
+		}
+	}
+	var elem proofElement
+
+	collapsed, hn := hasher.proofHash(n)
+	if hash, ok := hn.(hashNode); ok || root {
+		elem.enc, _ = rlp.EncodeToBytes(collapsed)
+		if !ok {
+			hash = hasher.hashData(elem.enc)
+		}
+		elem.hash = hash
+	}
+	if c != nil {
+		c.lock.Lock()
+		c.elems[n] = elem
+		c.lock.Unlock()
+	}
+	return elem.hash, elem.enc
+}
+
+// ProveBatch constructs merkle proofs for a batch of keys, writing the proof of
+// each key into the proof database at the same index. The proofs are identical
+// to the ones constructed by Prove, but the upper levels of the trie, shared by
+// all the paths, are only resolved and encoded once, while the paths themselves
+// are proven concurrently by the given number of workers.
+//
+// The proof databases are written concurrently, but each by a single worker.
+func (t *Trie) ProveBatch(keys [][]byte, fromLevel uint, proofDbs []ethdb.KeyValueWriter, workers int) error {
+	if len(keys) != len(proofDbs) {
+		return fmt.Errorf("key and proof count mismatch: %d != %d", len(keys), len(proofDbs))
+	}
+	if workers > len(keys) {
+		workers = len(keys)
+	}
+	if workers < 1 {
+		workers = 1
+	}
+	var (
+		cache = newProofCache()
+		tasks = make(chan int, len(keys))
+		errc  = make(chan error, workers)
+		abort int32
+	)
+	for i := range keys {
+		tasks <- i
+	}
+	close(tasks)
+
+	for i := 0; i < workers; i++ {
+		go func() {
+			for task := range tasks {
+				if atomic.LoadInt32(&abort) == 1 {
+					break
+				}
+				if err := t.prove(keys[task], fromLevel, proofDbs[task], cache); err != nil {
+					atomic.StoreInt32(&abort, 1)
+					errc <- err
+					return
+				}
+			}
+			errc <- nil
+		}()
+	}
+	var failure error
+	for i := 0; i < workers; i++ {
+		if err := <-errc; err != nil && failure == nil {
+			failure = err
+		}
+	}
+	return failure
+}
+
 // Prove constructs a merkle proof for key. The result contains all encoded nodes
 // on the path to the value at key. The value itself is also included in the last
 // node and can be retrieved by verifying the proof.
@@ -100,6 +232,108 @@ func (t *SecureTrie) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWri
 	return t.trie.Prove(key, fromLevel, proofDb)
 }
 
+// ProveBatch constructs merkle proofs for a batch of keys, writing the proof of
+// each key into the proof database at the same index, sharing the work on the
+// upper levels of the trie between the keys. See Trie.ProveBatch.
+func (t *SecureTrie) ProveBatch(keys [][]byte, fromLevel uint, proofDbs []ethdb.KeyValueWriter, workers int) error {
+	return t.trie.ProveBatch(keys, fromLevel, proofDbs, workers)
+}
+
+// ProveRange constructs a merkle proof for the key range [start, end]. The result
+// contains all encoded nodes on the paths to both boundary keys, collected in a
+// single traversal so that the shared upper nodes are visited and emitted once.
+//
+// If the range is empty, the proof can be checked with VerifyExclusionProof to
+// show that no key within the range exists in the trie.
+func (t *Trie) ProveRange(start, end []byte, proofDb ethdb.KeyValueWriter) error {
+	if bytes.Compare(start, end) > 0 {
+		return errors.New("invalid range, start > end")
+	}
+	// Collect all nodes on the two boundary paths.
+	var nodes []node
+	if err := t.collectPaths(t.root, [][]byte{keybytesToHex(start), keybytesToHex(end)}, &nodes); err != nil {
+		log.Error(fmt.Sprintf("Unhandled trie error: %v", err))
+		return err
+	}
+	hasher := newHasher(false)
+	defer returnHasherToPool(hasher)
+
+	for i, n := range nodes {
+		var hn node
+		n, hn = hasher.proofHash(n)
+		if hash, ok := hn.(hashNode); ok || i == 0 {
+			// If the node's database encoding is a hash (or is the
+			// root node), it becomes a proof element.
+			enc, _ := rlp.EncodeToBytes(n)
+			if !ok {
+				hash = hasher.hashData(enc)
+			}
+			proofDb.Put(hash, enc)
+		}
+	}
+	return nil
+}
+
+// collectPaths walks down the trie along the given sorted hex keys and appends
+// the visited nodes to the list. Keys sharing a path are followed together and
+// only split up at the node where they diverge, so every node is collected once.
+func (t *Trie) collectPaths(tn node, keys [][]byte, nodes *[]node) error {
+	if len(keys) == 0 || tn == nil {
+		return nil
+	}
+	switch n := tn.(type) {
+	case *shortNode:
+		*nodes = append(*nodes, n)
+
+		// Keys that don't match the shortnode are non-existent in
+		// the trie, the shortnode itself proves their absence.
+		var rest [][]byte
+		for _, key := range keys {
+			if len(key) > len(n.Key) && bytes.Equal(n.Key, key[:len(n.Key)]) {
+				rest = append(rest, key[len(n.Key):])
+			}
+		}
+		return t.collectPaths(n.Val, rest, nodes)
+	case *fullNode:
+		*nodes = append(*nodes, n)
+
+		// The keys are sorted, the ones stepping into the same child
+		// are adjacent and can be grouped together.
+		for i := 0; i < len(keys); {
+			j := i + 1
+			for j < len(keys) && keys[j][0] == keys[i][0] {
+				j++
+			}
+			var rest [][]byte
+			for _, key := range keys[i:j] {
+				if len(key) > 1 {
+					rest = append(rest, key[1:])
+				}
+			}
+			if err := t.collectPaths(n.Children[keys[i][0]], rest, nodes); err != nil {
+				return err
+			}
+			i = j
+		}
+		return nil
+	case hashNode:
+		child, err := t.resolveHash(n, nil)
+		if err != nil {
+			return err
+		}
+		return t.collectPaths(child, keys, nodes)
+	default:
+		panic(fmt.Sprintf("%T: invalid node: %v", tn, tn))
+	}
+}
+
+// ProveRange constructs a merkle proof for the key range [start, end]. The result
+// contains all encoded nodes on the paths to both boundary keys, collected in a
+// single traversal so that the shared upper nodes are visited and emitted once.
+func (t *SecureTrie) ProveRange(start, end []byte, proofDb ethdb.KeyValueWriter) error {
+	return t.trie.ProveRange(start, end, proofDb)
+}
+
 // VerifyProof checks merkle proofs. The given proof must contain the value for
 // key in a trie with the given root hash. VerifyProof returns an error if the
 // proof contains invalid trie nodes or the wrong value.
@@ -474,6 +708,77 @@ func VerifyRangeProof(rootHash common.Hash, firstKey []byte, keys [][]byte, valu
 	return nil, hasRightElement(root, keys[len(keys)-1])
 }
 
+// VerifyExclusionProof checks whether the given proof proves that no key in the
+// range [start, end] exists in the trie with the specified root. The proof should
+// be generated by ProveRange, or be the merged edge proofs of the boundary keys.
+//
+// The boundary paths are resolved from the proof first. Any resolved value or
+// unresolved subtrie which falls within the range is regarded as the evidence
+// of the existence of an element, so the verification fails.
+func VerifyExclusionProof(rootHash common.Hash, start, end []byte, proof ethdb.KeyValueReader) error {
+	if bytes.Compare(start, end) > 0 {
+		return errors.New("invalid range, start > end")
+	}
+	// todo(rjl493456442) different length edge keys should be supported
+	if len(start) != len(end) {
+		return errors.New("inconsistent edge path")
+	}
+	// Special case, the trie is empty and nothing can be contained.
+	if rootHash == emptyRoot {
+		return nil
+	}
+	// Convert the boundary proofs to trie paths, both of them are
+	// allowed to be non-existent(and they must be).
+	root, _, err := proofToPath(rootHash, nil, start, proof, true)
+	if err != nil {
+		return err
+	}
+	root, _, err = proofToPath(rootHash, root, end, proof, true)
+	if err != nil {
+		return err
+	}
+	if hasRangeElement(root, nil, keybytesToHex(start), keybytesToHex(end)) {
+		return errors.New("range is not empty")
+	}
+	return nil
+}
+
+// hasRangeElement reports whether the partially resolved trie contains any
+// element within the range [start, end]. The unresolved subtries which overlap
+// with the range are treated as non-empty.
+func hasRangeElement(n node, path []byte, start, end []byte) bool {
+	// Skip the whole branch if it's not overlapped with the range.
+	if len(path) > 0 {
+		l := len(path)
+		if l > len(start) {
+			l = len(start)
+		}
+		if bytes.Compare(path[:l], start[:l]) < 0 || bytes.Compare(path[:l], end[:l]) > 0 {
+			return false
+		}
+	}
+	switch rn := n.(type) {
+	case nil:
+		return false
+	case *shortNode:
+		return hasRangeElement(rn.Val, append(append([]byte{}, path...), rn.Key...), start, end)
+	case *fullNode:
+		for i, child := range rn.Children {
+			if child == nil {
+				continue
+			}
+			if hasRangeElement(child, append(append([]byte{}, path...), byte(i)), start, end) {
+				return true
+			}
+		}
+		return false
+	case hashNode, valueNode:
+		return true
+	default:
+		panic(fmt.Sprintf("%T: invalid node: %v", n, n))
+	}
+}
+
 // get returns the child of the given node. Return nil if the
 // node with specified key doesn't exist at all.
 //
@@ -26,6 +26,7 @@ import (
 
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/ethdb"
 	"github.com/ethereum/go-ethereum/ethdb/memorydb"
 )
 
@@ -77,6 +78,66 @@ func TestProof(t *testing.T) {
 	}
 }
 
+// Tests that batched proofs are identical to the individually constructed ones,
+// both for existing and missing keys, with the nodes resolved from the database.
+func TestProveBatch(t *testing.T) {
+	_, vals := randomTrie(500)
+
+	trie := newEmpty()
+	for _, kv := range vals {
+		trie.Update(kv.k, kv.v)
+	}
+	root, _ := trie.Commit(nil)
+	trie, _ = New(root, trie.db)
+
+	var keys [][]byte
+	for _, kv := range vals {
+		keys = append(keys, kv.k)
+	}
+	for i := 0; i < 50; i++ {
+		keys = append(keys, randBytes(32))
+	}
+	for _, workers := range []int{1, 4, 1000} {
+		proofs := make([]*memorydb.Database, len(keys))
+		writers := make([]ethdb.KeyValueWriter, len(keys))
+		for i := range keys {
+			proofs[i] = memorydb.New()
+			writers[i] = proofs[i]
+		}
+		if err := trie.ProveBatch(keys, 0, writers, workers); err != nil {
+			t.Fatalf("workers %d: failed to prove batch: %v", workers, err)
+		}
+		for i, key := range keys {
+			want := memorydb.New()
+			if err := trie.Prove(key, 0, want); err != nil {
+				t.Fatalf("workers %d: failed to prove key %x: %v", workers, key, err)
+			}
+			if proofs[i].Len() != want.Len() {
+				t.Fatalf("workers %d: proof size mismatch for key %x: have %d, want %d", workers, key, proofs[i].Len(), want.Len())
+			}
+			it := want.NewIterator(nil, nil)
+			for it.Next() {
+				if have, _ := proofs[i].Get(it.Key()); !bytes.Equal(have, it.Value()) {
+					t.Fatalf("workers %d: proof node mismatch for key %x: have %x, want %x", workers, key, have, it.Value())
+				}
+			}
+			it.Release()
+
+			val, err := VerifyProof(root, key, proofs[i])
+			if err != nil {
+				t.Fatalf("workers %d: failed to verify proof for key %x: %v", workers, key, err)
+			}
+			if kv := vals[string(key)]; (kv == nil && val != nil) || (kv != nil && !bytes.Equal(val, kv.v)) {
+				t.Fatalf("workers %d: verified value mismatch for key %x: have %x", workers, key, val)
+			}
+		}
+	}
+	// Mismatching proof database counts should be rejected
+	if err := trie.ProveBatch(keys, 0, nil, 1); err == nil {
+		t.Fatalf("mismatching proof count accepted")
+	}
+}
+
 func TestOneElementProof(t *testing.T) {
 	trie := new(Trie)
 	updateString(trie, "k", "v")
@@ -510,6 +571,60 @@ func TestGappedRangeProof(t *testing.T) {
 	}
 }
 
+// TestExclusionProof tests the exclusion proof of the empty ranges between
+// the adjacent elements. The test cases are generated randomly.
+func TestExclusionProof(t *testing.T) {
+	trie, vals := randomTrie(4096)
+	var entries entrySlice
+	for _, kv := range vals {
+		entries = append(entries, kv)
+	}
+	sort.Sort(entries)
+	for i := 0; i < 500; i++ {
+		pos := mrand.Intn(len(entries) - 1)
+		start := increseKey(common.CopyBytes(entries[pos].k))
+		end := decreseKey(common.CopyBytes(entries[pos+1].k))
+		if bytes.Compare(start, end) > 0 {
+			continue
+		}
+		proof := memorydb.New()
+		if err := trie.ProveRange(start, end, proof); err != nil {
+			t.Fatalf("Failed to prove the range %v", err)
+		}
+		if err := VerifyExclusionProof(trie.Hash(), start, end, proof); err != nil {
+			t.Fatalf("Case %d(%x->%x) expect no error, got %v", i, start, end, err)
+		}
+		// The single traversal proof should be identical with the
+		// merged edge proofs.
+		merged := memorydb.New()
+		trie.Prove(start, 0, merged)
+		trie.Prove(end, 0, merged)
+		if proof.Len() != merged.Len() {
+			t.Fatalf("Case %d(%x->%x) proof size mismatch, want %d, got %d", i, start, end, merged.Len(), proof.Len())
+		}
+		// Extend the range to cover the neighbouring elements, the
+		// verification is expected to fail.
+		for _, bound := range [][2][]byte{{entries[pos].k, end}, {start, entries[pos+1].k}} {
+			proof := memorydb.New()
+			if err := trie.ProveRange(bound[0], bound[1], proof); err != nil {
+				t.Fatalf("Failed to prove the range %v", err)
+			}
+			if err := VerifyExclusionProof(trie.Hash(), bound[0], bound[1], proof); err == nil {
+				t.Fatalf("Case %d(%x->%x) expect error, got nil", i, bound[0], bound[1])
+			}
+		}
+	}
+	// Prove the empty range after the last element.
+	last := increseKey(common.CopyBytes(entries[len(entries)-1].k))
+	proof := memorydb.New()
+	if err := trie.ProveRange(last, bytes.Repeat([]byte{0xff}, 32), proof); err != nil {
+		t.Fatalf("Failed to prove the range %v", err)
+	}
+	if err := VerifyExclusionProof(trie.Hash(), last, bytes.Repeat([]byte{0xff}, 32), proof); err != nil {
+		t.Fatalf("Expect no error, got %v", err)
+	}
+}
+
 func TestHasRightElement(t *testing.T) {
 	trie := new(Trie)
 	var entries entrySlice
@@ -0,0 +1,95 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/ethereum/go-ethereum/log"
+	"github.com/ethereum/go-ethereum/metrics"
+)
+
+var (
+	externalNodeHitMeter     = metrics.NewRegisteredMeter("trie/resolver/hit", nil)
+	externalNodeFailMeter    = metrics.NewRegisteredMeter("trie/resolver/fail", nil)
+	externalNodeInvalidMeter = metrics.NewRegisteredMeter("trie/resolver/invalid", nil)
+)
+
+// errInvalidExternalNode is returned if an externally resolved trie node doesn't
+// match the hash it was requested by.
+var errInvalidExternalNode = errors.New("invalid external trie node")
+
+// NodeResolver retrieves the RLP encoded trie node with the given hash from an
+// external source (e.g. a remote peer or an archive service) if it's missing
+// from the local database. The path is the position of the node in the trie.
+//
+// The returned nodes are verified against the requested hash before use, so a
+// misbehaving source can't poison the trie. Resolvers must be safe for concurrent
+// use.
+type NodeResolver func(hash common.Hash, path []byte) ([]byte, error)
+
+// RetryResolver wraps a resolver, retrying the failed retrievals (including the
+// ones delivering invalid nodes) up to the given number of times, doubling the
+// delay between the attempts starting from backoff.
+func RetryResolver(resolver NodeResolver, retries int, backoff time.Duration) NodeResolver {
+	return func(hash common.Hash, path []byte) ([]byte, error) {
+		delay := backoff
+		for attempt := 0; ; attempt++ {
+			blob, err := resolver(hash, path)
+			if err == nil {
+				if crypto.Keccak256Hash(blob) == hash {
+					return blob, nil
+				}
+				err = errInvalidExternalNode
+			}
+			if attempt >= retries {
+				return nil, err
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+}
+
+// resolveExternal retrieves a trie node missing from the local database through
+// the external resolver of the trie. The verified node is cached in the clean
+// cache of the database, so it's not retrieved again while retained.
+func (t *Trie) resolveExternal(hash common.Hash, prefix []byte) (node, error) {
+	blob, err := t.resolver(hash, common.CopyBytes(prefix))
+	if err != nil {
+		externalNodeFailMeter.Mark(1)
+		log.Debug("Failed to resolve external trie node", "hash", hash, "path", prefix, "err", err)
+		return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
+	}
+	if crypto.Keccak256Hash(blob) != hash {
+		externalNodeInvalidMeter.Mark(1)
+		log.Warn("Rejected invalid external trie node", "hash", hash, "path", prefix)
+		return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
+	}
+	n, err := decodeNode(hash[:], blob)
+	if err != nil {
+		externalNodeInvalidMeter.Mark(1)
+		log.Warn("Rejected undecodable external trie node", "hash", hash, "path", prefix, "err", err)
+		return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
+	}
+	externalNodeHitMeter.Mark(1)
+	t.db.insertClean(hash, blob)
+	return n, nil
+}
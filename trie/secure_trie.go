@@ -62,6 +62,19 @@ func NewSecure(root common.Hash, db *Database) (*SecureTrie, error) {
 	return &SecureTrie{trie: *trie}, nil
 }
 
+// NewSecureWithResolver creates a secure trie like NewSecure, but the nodes
+// missing from db are retrieved through the given resolver.
+func NewSecureWithResolver(root common.Hash, db *Database, resolver NodeResolver) (*SecureTrie, error) {
+	if db == nil {
+		panic("trie.NewSecure called without a database")
+	}
+	trie, err := NewWithResolver(root, db, resolver)
+	if err != nil {
+		return nil, err
+	}
+	return &SecureTrie{trie: *trie}, nil
+}
+
 // Get returns the value for key stored in the trie.
 // The value bytes must not be modified by the caller.
 func (t *SecureTrie) Get(key []byte) []byte {
@@ -79,6 +92,20 @@ func (t *SecureTrie) TryGet(key []byte) ([]byte, error) {
 	return t.trie.TryGet(t.hashKey(key))
 }
 
+// TryGetHashed returns the value for the already hashed key stored in the trie,
+// avoiding the hashing if the caller knows the hash anyway.
+// The value bytes must not be modified by the caller.
+// If a node was not found in the database, a MissingNodeError is returned.
+func (t *SecureTrie) TryGetHashed(hashKey []byte) ([]byte, error) {
+	return t.trie.TryGet(hashKey)
+}
+
+// HasNode reports whether a node exists at the given path (in nibbles) of the
+// trie, without reading and decoding the node itself.
+func (t *SecureTrie) HasNode(path []byte) (bool, error) {
+	return t.trie.HasNode(path)
+}
+
 // Update associates key with value in the trie. Subsequent calls to
 // Get will return value. If value has length zero, any existing value
 // is deleted from the trie and calls to Get will return nil.
@@ -109,6 +136,26 @@ func (t *SecureTrie) TryUpdate(key, value []byte) error {
 	return nil
 }
 
+// TryUpdateHashed associates the value with the already hashed key in the trie,
+// avoiding the hashing if the caller knows the hash anyway. The original key is
+// only used to track the preimage of the hash and it's not verified against it.
+// If the key is nil, no preimage is recorded (e.g. the caller doesn't know it, or
+// the trie is a throwaway copy only used for hashing).
+//
+// The value bytes must not be modified by the caller while they are
+// stored in the trie.
+//
+// If a node was not found in the database, a MissingNodeError is returned.
+func (t *SecureTrie) TryUpdateHashed(key, hashKey, value []byte) error {
+	if err := t.trie.TryUpdate(hashKey, value); err != nil {
+		return err
+	}
+	if key != nil {
+		t.getSecKeyCache()[string(hashKey)] = common.CopyBytes(key)
+	}
+	return nil
+}
+
 // Delete removes any existing value for key from the trie.
 func (t *SecureTrie) Delete(key []byte) {
 	if err := t.TryDelete(key); err != nil {
@@ -124,8 +171,35 @@ func (t *SecureTrie) TryDelete(key []byte) error {
 	return t.trie.TryDelete(hk)
 }
 
+// TryDeleteHashed removes any existing value for the already hashed key from
+// the trie, avoiding the hashing if the caller knows the hash anyway.
+// If a node was not found in the database, a MissingNodeError is returned.
+func (t *SecureTrie) TryDeleteHashed(hashKey []byte) error {
+	delete(t.getSecKeyCache(), string(hashKey))
+	return t.trie.TryDelete(hashKey)
+}
+
+// DeleteRange removes at most max leaves with hashed keys in the range
+// [start, end) from the trie, nil end meaning no upper bound and non-positive
+// max meaning no limit. The number of removed leaves is returned along with the
+// hashed key to continue the deletion from, which is nil if the range is
+// exhausted.
+func (t *SecureTrie) DeleteRange(start, end []byte, max int) (int, []byte, error) {
+	keys, next, err := t.trie.rangeKeys(start, end, max)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i, key := range keys {
+		if err := t.TryDeleteHashed(key); err != nil {
+			return i, key, err
+		}
+	}
+	return len(keys), next, nil
+}
+
 // GetKey returns the sha3 preimage of a hashed key that was
-// previously used to store a value.
+// previously used to store a value, or the one supplied by the
+// preimage resolver of the database if it's unknown.
 func (t *SecureTrie) GetKey(shaKey []byte) []byte {
 	if key, ok := t.getSecKeyCache()[string(shaKey)]; ok {
 		return key
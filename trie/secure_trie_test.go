@@ -105,6 +105,65 @@ func TestSecureGetKey(t *testing.T) {
 	}
 }
 
+// Tests that the preimages missing from the database are served by the external
+// resolver, which is not allowed to return invalid ones.
+func TestSecurePreimageResolver(t *testing.T) {
+	db := NewDatabase(memorydb.New())
+	trie, _ := NewSecure(common.Hash{}, db)
+
+	// Insert an entry through the underlying trie, leaving no preimage behind
+	seckey := crypto.Keccak256([]byte("foo"))
+	trie.trie.Update(seckey, []byte("bar"))
+	if k := trie.GetKey(seckey); k != nil {
+		t.Fatalf("GetKey returned %q for unknown preimage", k)
+	}
+	preimages := map[common.Hash][]byte{common.BytesToHash(seckey): []byte("foo")}
+	db.SetPreimageResolver(func(hash common.Hash) []byte {
+		return preimages[hash]
+	})
+	it := NewIterator(trie.NodeIterator(nil))
+	for it.Next() {
+		if k := trie.GetKey(it.Key); !bytes.Equal(k, []byte("foo")) {
+			t.Fatalf("GetKey returned %q, want %q", k, "foo")
+		}
+	}
+	// Ensure invalid preimages are rejected
+	preimages[common.BytesToHash(seckey)] = []byte("baz")
+	if k := trie.GetKey(seckey); k != nil {
+		t.Fatalf("GetKey returned invalid preimage %q", k)
+	}
+}
+
+func TestSecureHashedAccess(t *testing.T) {
+	trie := newEmptySecure()
+	trie.Update([]byte("foo"), []byte("bar"))
+	trie.Update([]byte("baz"), []byte("qux"))
+
+	hashed := newEmptySecure()
+	hashed.TryUpdateHashed([]byte("foo"), crypto.Keccak256([]byte("foo")), []byte("bar"))
+	hashed.TryUpdateHashed([]byte("baz"), crypto.Keccak256([]byte("baz")), []byte("qux"))
+
+	if have, want := hashed.Hash(), trie.Hash(); have != want {
+		t.Errorf("root mismatch: have %x, want %x", have, want)
+	}
+	if val, _ := hashed.TryGetHashed(crypto.Keccak256([]byte("foo"))); !bytes.Equal(val, []byte("bar")) {
+		t.Errorf("TryGetHashed returned %q, want %q", val, "bar")
+	}
+	if k := hashed.GetKey(crypto.Keccak256([]byte("foo"))); !bytes.Equal(k, []byte("foo")) {
+		t.Errorf("GetKey returned %q, want %q", k, "foo")
+	}
+	trie.Delete([]byte("baz"))
+	hashed.TryDeleteHashed(crypto.Keccak256([]byte("baz")))
+	if have, want := hashed.Hash(), trie.Hash(); have != want {
+		t.Errorf("root mismatch after deletion: have %x, want %x", have, want)
+	}
+	// Updating without the original key must not record any preimage
+	hashed.TryUpdateHashed(nil, crypto.Keccak256([]byte("qux")), []byte("quux"))
+	if k := hashed.GetKey(crypto.Keccak256([]byte("qux"))); k != nil {
+		t.Errorf("GetKey returned %q for an update without key, want nil", k)
+	}
+}
+
 func TestSecureTrieConcurrency(t *testing.T) {
 	// Create an initial trie and copy if for concurrent access
 	_, trie, _ := makeTestSecureTrie()
@@ -0,0 +1,120 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// SizeEstimate is the estimated size of a trie, counting its standalone nodes
+// only (the embedded ones being part of their parents).
+type SizeEstimate struct {
+	Nodes   uint64             // Estimated number of standalone nodes
+	Size    common.StorageSize // Estimated total size of the standalone nodes
+	Samples int                // Number of random descents the estimate is based on
+	Visited int                // Number of nodes loaded while sampling
+}
+
+// EstimateSize estimates the number of nodes and the total size of the trie with
+// the given root, without traversing it fully. It performs random descents from
+// the root to the leaves, each one yielding an unbiased estimate from the number
+// of children met along the way (Knuth's estimator), and averages them.
+//
+// The descents stop once maxVisit nodes are loaded, though the first descent is
+// always completed. The more nodes visited, the more accurate the estimate, the
+// deviation being the largest for unbalanced tries. The sampling is seeded by the
+// root, so repeated estimates of the same trie are identical.
+func EstimateSize(db *Database, root common.Hash, maxVisit int) (*SizeEstimate, error) {
+	estimate := new(SizeEstimate)
+	if root == emptyRoot || root == (common.Hash{}) {
+		return estimate, nil
+	}
+	var (
+		rnd   = rand.New(rand.NewSource(int64(binary.BigEndian.Uint64(root[:]))))
+		nodes float64
+		size  float64
+	)
+	for estimate.Samples == 0 || estimate.Visited < maxVisit {
+		var (
+			hash    = root
+			path    []byte
+			weight  = 1.0
+			dnodes  float64
+			dsize   float64
+			visited int
+		)
+		for {
+			blob, err := db.Node(hash)
+			if err != nil || len(blob) == 0 {
+				return nil, &MissingNodeError{NodeHash: hash, Path: path}
+			}
+			n, err := decodeNode(hash[:], blob)
+			if err != nil {
+				return nil, err
+			}
+			visited++
+			dnodes += weight
+			dsize += weight * float64(len(blob))
+
+			children := standaloneChildren(n, path, nil)
+			if len(children) == 0 {
+				break
+			}
+			child := children[rnd.Intn(len(children))]
+			weight *= float64(len(children))
+			hash, path = common.BytesToHash(child.hash), child.path
+		}
+		// Only account complete descents, partial ones would skew the estimate
+		if estimate.Samples > 0 && estimate.Visited+visited > maxVisit {
+			break
+		}
+		estimate.Samples++
+		estimate.Visited += visited
+		nodes += dnodes
+		size += dsize
+	}
+	estimate.Nodes = uint64(nodes/float64(estimate.Samples) + 0.5)
+	estimate.Size = common.StorageSize(size / float64(estimate.Samples))
+	return estimate, nil
+}
+
+// standaloneChild is a reference to a standalone node along with its path.
+type standaloneChild struct {
+	hash hashNode
+	path []byte
+}
+
+// standaloneChildren collects the references to the standalone nodes directly
+// below the given node, descending into the embedded ones.
+func standaloneChildren(n node, path []byte, children []standaloneChild) []standaloneChild {
+	switch n := n.(type) {
+	case hashNode:
+		return append(children, standaloneChild{hash: n, path: path})
+	case *shortNode:
+		return standaloneChildren(n.Val, append(append([]byte{}, path...), n.Key...), children)
+	case *fullNode:
+		for i, child := range n.Children[:16] {
+			if child != nil {
+				children = standaloneChildren(child, append(append([]byte{}, path...), byte(i)), children)
+			}
+		}
+	}
+	return children
+}
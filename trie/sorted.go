@@ -0,0 +1,130 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// sortedCommitter builds a trie bottom-up from a sorted set of keys, writing
+// every node into the database as soon as its subtrie is complete. Only the
+// nodes on the path being built are held in memory.
+type sortedCommitter struct {
+	hasher *hasher
+	db     ethdb.KeyValueWriter
+	nodes  int
+	err    error
+}
+
+// CommitSorted builds the trie of the given keys and values, writing its nodes
+// straight into the database instead of going through the dirty node cache of
+// a trie.Database, and returns the root hash. It's meant for bulk writing whole
+// tries (e.g. the genesis state), where inserting the entries one by one would
+// be wasteful.
+//
+// The keys must all have the same length and be sorted in strictly ascending
+// order; empty values are not allowed. The number of nodes written is returned
+// along with the root.
+func CommitSorted(db ethdb.KeyValueWriter, keys [][]byte, values [][]byte) (common.Hash, int, error) {
+	if len(keys) != len(values) {
+		return common.Hash{}, 0, fmt.Errorf("key/value count mismatch: %d != %d", len(keys), len(values))
+	}
+	if len(keys) == 0 {
+		return emptyRoot, 0, nil
+	}
+	hexkeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		if len(key) != len(keys[0]) {
+			return common.Hash{}, 0, fmt.Errorf("key %x length mismatch: have %d, want %d", key, len(key), len(keys[0]))
+		}
+		if i > 0 && bytes.Compare(keys[i-1], key) >= 0 {
+			return common.Hash{}, 0, fmt.Errorf("key %x not above previous %x", key, keys[i-1])
+		}
+		if len(values[i]) == 0 {
+			return common.Hash{}, 0, fmt.Errorf("empty value for key %x", key)
+		}
+		hexkeys[i] = keybytesToHex(key)
+	}
+	c := &sortedCommitter{
+		hasher: newHasher(false),
+		db:     db,
+	}
+	defer returnHasherToPool(c.hasher)
+
+	root := c.build(hexkeys, values, 0, true)
+	if c.err != nil {
+		return common.Hash{}, 0, c.err
+	}
+	hash, ok := root.(hashNode)
+	if !ok {
+		return common.Hash{}, 0, errors.New("root node not hashed")
+	}
+	return common.BytesToHash(hash), c.nodes, nil
+}
+
+// build creates the subtrie of the given hex keys (sharing the first depth
+// nibbles) and their values, storing it into the database. The returned node is
+// the hash of the subtrie, or the subtrie itself if it's small enough to be
+// embedded into its parent. The root of the trie is always hashed.
+func (c *sortedCommitter) build(keys [][]byte, values [][]byte, depth int, root bool) node {
+	// A single key ends the path in a leaf
+	if len(keys) == 1 {
+		return c.store(&shortNode{Key: keys[0][depth:], Val: valueNode(values[0])}, root)
+	}
+	// Multiple keys sharing a prefix are collapsed into an extension. The keys
+	// are sorted, so the prefix of the first and last is shared by all of them.
+	if shared := prefixLen(keys[0][depth:], keys[len(keys)-1][depth:]); shared > 0 {
+		child := c.build(keys, values, depth+shared, false)
+		return c.store(&shortNode{Key: keys[0][depth : depth+shared], Val: child}, root)
+	}
+	// Keys diverging at this depth are branched on their next nibble
+	branch := new(fullNode)
+	for start := 0; start < len(keys); {
+		end := start + 1
+		for end < len(keys) && keys[end][depth] == keys[start][depth] {
+			end++
+		}
+		branch.Children[keys[start][depth]] = c.build(keys[start:end], values[start:end], depth+1, false)
+		start = end
+	}
+	return c.store(branch, root)
+}
+
+// store hashes the node, whose children are already stored, and writes it into
+// the database. Nodes smaller than a hash are returned as is to be embedded in
+// their parents, unless storing them is forced.
+func (c *sortedCommitter) store(n node, force bool) node {
+	// The encoding of the node is left in the hasher's buffer after hashing
+	_, hashed := c.hasher.proofHash(n)
+	hash, ok := hashed.(hashNode)
+	if !ok {
+		if !force {
+			return n
+		}
+		hash = c.hasher.hashData(c.hasher.tmp)
+	}
+	if err := c.db.Put(hash, common.CopyBytes(c.hasher.tmp)); err != nil && c.err == nil {
+		c.err = err
+	}
+	c.nodes++
+	return hash
+}
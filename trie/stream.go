@@ -0,0 +1,83 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"context"
+	"time"
+
+	"github.com/ethereum/go-ethereum/common"
+)
+
+// StreamCallback is invoked by StreamNodes for every standalone node of a trie,
+// with its path (in nibbles) from the root, its hash and its RLP encoding. The
+// arguments are not shared, they may be retained. Returning an error aborts the
+// streaming.
+type StreamCallback func(path []byte, hash common.Hash, blob []byte) error
+
+// StreamNodes feeds all the standalone nodes of a committed trie into the
+// callback, in ascending path order, parents before their children. Nodes
+// embedded into their parents are part of the parent's blob and are not streamed
+// separately. It's meant for exporting whole tries, e.g. for backups or for
+// seeding witness caches, without loading them into memory.
+//
+// If the rate is non-zero, the streaming is throttled to at most that many nodes
+// per second to limit its impact on the node's disk. The streaming is aborted
+// when the context is cancelled, returning its error. The number of streamed
+// nodes is returned in every case.
+func StreamNodes(ctx context.Context, db *Database, root common.Hash, rate int, callback StreamCallback) (int, error) {
+	if root == emptyRoot || root == (common.Hash{}) {
+		return 0, nil
+	}
+	t, err := New(root, db)
+	if err != nil {
+		return 0, err
+	}
+	var (
+		start    = time.Now()
+		streamed int
+	)
+	it := t.NodeIterator(nil)
+	for it.Next(true) {
+		if err := ctx.Err(); err != nil {
+			return streamed, err
+		}
+		hash := it.Hash()
+		if hash == (common.Hash{}) {
+			continue // Embedded node or value, part of the parent
+		}
+		// Throttle the stream if we're ahead of the permitted rate
+		if rate > 0 {
+			if wait := time.Duration(streamed)*time.Second/time.Duration(rate) - time.Since(start); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return streamed, ctx.Err()
+				case <-time.After(wait):
+				}
+			}
+		}
+		blob, err := db.Node(hash)
+		if err != nil {
+			return streamed, err
+		}
+		if err := callback(common.CopyBytes(it.Path()), hash, common.CopyBytes(blob)); err != nil {
+			return streamed, err
+		}
+		streamed++
+	}
+	return streamed, it.Error()
+}
@@ -50,7 +50,7 @@ type request struct {
 // hashes.
 type SyncResult struct {
 	Hash common.Hash // Hash of the originally unknown trie node
-	Data []byte      // Data content of the retrieved node
+	Data []byte      // Data content of the retrieved node, must not be modified once delivered
 }
 
 // syncMemBatch is an in-memory buffer of successfully downloaded but not yet
@@ -196,7 +196,7 @@ func (s *Sync) Process(results []SyncResult) (bool, int, error) {
 			continue
 		}
 		// Decode the node data content and update the request
-		node, err := decodeNode(item.Hash[:], item.Data)
+		node, err := decodeNodeUnsafe(item.Hash[:], item.Data)
 		if err != nil {
 			return committed, i, err
 		}
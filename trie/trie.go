@@ -46,8 +46,9 @@ type LeafCallback func(leaf []byte, parent common.Hash) error
 //
 // Trie is not safe for concurrent use.
 type Trie struct {
-	db   *Database
-	root node
+	db       *Database
+	root     node
+	resolver NodeResolver // Optional resolver of the nodes missing from the database
 	// Keep track of the number leafs which have been inserted since the last
 	// hashing operation. This number will not directly map to the number of
 	// actually unhashed nodes
@@ -66,11 +67,20 @@ func (t *Trie) newFlag() nodeFlag {
 // New will panic if db is nil and returns a MissingNodeError if root does
 // not exist in the database. Accessing the trie loads nodes from db on demand.
 func New(root common.Hash, db *Database) (*Trie, error) {
+	return NewWithResolver(root, db, nil)
+}
+
+// NewWithResolver creates a trie like New, but the nodes missing from db are
+// retrieved through the given resolver instead of failing immediately. It's
+// meant for nodes operating on partial state, which can fetch the locally
+// pruned nodes from the network.
+func NewWithResolver(root common.Hash, db *Database, resolver NodeResolver) (*Trie, error) {
 	if db == nil {
 		panic("trie.New called without a database")
 	}
 	trie := &Trie{
-		db: db,
+		db:       db,
+		resolver: resolver,
 	}
 	if root != (common.Hash{}) && root != emptyRoot {
 		rootnode, err := trie.resolveHash(root[:], nil)
@@ -84,8 +94,12 @@ func New(root common.Hash, db *Database) (*Trie, error) {
 
 // NodeIterator returns an iterator that returns nodes of the trie. Iteration starts at
 // the key after the given start key.
+//
+// The iterator traverses the content of the trie at the moment of its creation,
+// any later modification or commit of the trie doesn't affect it. The iteration
+// only fails if the trie database drops nodes of the original content.
 func (t *Trie) NodeIterator(start []byte) NodeIterator {
-	return newNodeIterator(t, start)
+	return t.Snapshot().NodeIterator(start)
 }
 
 // Get returns the value for key stored in the trie.
@@ -146,6 +160,50 @@ func (t *Trie) tryGet(origNode node, key []byte, pos int) (value []byte, newnode
 	}
 }
 
+// HasNode reports whether a node exists at the given path (in nibbles) of the
+// trie. The ancestors of the node are resolved as usual, but the node itself is
+// only probed for existence in the database, without being read and decoded.
+// Values are not nodes, a path ending in one is reported as missing.
+//
+// If an ancestor of the node was not found in the database, a MissingNodeError
+// is returned.
+func (t *Trie) HasNode(path []byte) (bool, error) {
+	n := t.root
+	for pos := 0; ; {
+		if hash, ok := n.(hashNode); ok && pos == len(path) {
+			return t.db.HasNode(common.BytesToHash(hash)), nil
+		}
+		switch nn := n.(type) {
+		case nil, valueNode:
+			return false, nil
+		case *shortNode:
+			if pos == len(path) {
+				return true, nil
+			}
+			if len(path)-pos < len(nn.Key) || !bytes.Equal(nn.Key, path[pos:pos+len(nn.Key)]) {
+				return false, nil
+			}
+			n, pos = nn.Val, pos+len(nn.Key)
+		case *fullNode:
+			if pos == len(path) {
+				return true, nil
+			}
+			if path[pos] >= byte(len(nn.Children)) {
+				return false, nil
+			}
+			n, pos = nn.Children[path[pos]], pos+1
+		case hashNode:
+			child, err := t.resolveHash(nn, path[:pos])
+			if err != nil {
+				return false, err
+			}
+			n = child
+		default:
+			panic(fmt.Sprintf("%T: invalid node: %v", n, n))
+		}
+	}
+}
+
 // Update associates key with value in the trie. Subsequent calls to
 // Get will return value. If value has length zero, any existing value
 // is deleted from the trie and calls to Get will return nil.
@@ -274,6 +332,43 @@ func (t *Trie) TryDelete(key []byte) error {
 	return nil
 }
 
+// DeleteRange removes at most max leaves with keys in the range [start, end)
+// from the trie, nil end meaning no upper bound and non-positive max meaning no
+// limit. The number of removed leaves is returned along with the key to continue
+// the deletion from, which is nil if the range is exhausted. It allows clearing
+// large key ranges incrementally.
+func (t *Trie) DeleteRange(start, end []byte, max int) (int, []byte, error) {
+	keys, next, err := t.rangeKeys(start, end, max)
+	if err != nil {
+		return 0, nil, err
+	}
+	for i, key := range keys {
+		if err := t.TryDelete(key); err != nil {
+			return i, key, err
+		}
+	}
+	return len(keys), next, nil
+}
+
+// rangeKeys collects at most max leaf keys in the range [start, end), returning
+// the next key in the range if there are more. Non-positive max collects all.
+func (t *Trie) rangeKeys(start, end []byte, max int) ([][]byte, []byte, error) {
+	var (
+		keys [][]byte
+		it   = NewIterator(t.NodeIterator(start))
+	)
+	for it.Next() {
+		if end != nil && bytes.Compare(it.Key, end) >= 0 {
+			break
+		}
+		if max > 0 && len(keys) >= max {
+			return keys, common.CopyBytes(it.Key), nil
+		}
+		keys = append(keys, common.CopyBytes(it.Key))
+	}
+	return keys, nil, it.Err
+}
+
 // delete returns the new root of the trie with key deleted.
 // It reduces the trie to minimal form by simplifying
 // nodes on the way up after deleting recursively.
@@ -405,6 +500,9 @@ func (t *Trie) resolveHash(n hashNode, prefix []byte) (node, error) {
 	if node := t.db.node(hash); node != nil {
 		return node, nil
 	}
+	if t.resolver != nil {
+		return t.resolveExternal(hash, prefix)
+	}
 	return nil, &MissingNodeError{NodeHash: hash, Path: prefix}
 }
 
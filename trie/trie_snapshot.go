@@ -0,0 +1,87 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethdb"
+)
+
+// Snapshot is an immutable, read-only view of a trie at the moment it was taken.
+//
+// The snapshot shares its nodes with the live trie instead of copying them. This
+// is safe because the trie never modifies a node in place: inserts, deletes,
+// hashing and commits all replace the nodes along the touched path with fresh
+// copies and only swap the root of the writer. Nodes resolved from the database
+// while reading the snapshot are not cached back into it, so the snapshot itself
+// is never mutated either.
+//
+// Snapshot is safe for concurrent use.
+type Snapshot struct {
+	db       *Database
+	root     node
+	hash     common.Hash
+	resolver NodeResolver
+}
+
+// Snapshot returns a read-only view of the current content of the trie. The
+// trie is hashed beforehand so that the shared nodes carry their cached hashes
+// and none of the readers needs to compute them.
+//
+// The trie can keep being modified after the snapshot was taken, the changes
+// will not be visible through the snapshot.
+func (t *Trie) Snapshot() *Snapshot {
+	hash := t.Hash()
+	return &Snapshot{db: t.db, root: t.root, hash: hash, resolver: t.resolver}
+}
+
+// trie returns a throwaway trie rooted at the snapshot's root node. Any node
+// resolution done by the returned trie only affects its own root pointer.
+func (s *Snapshot) trie() *Trie {
+	return &Trie{db: s.db, root: s.root, resolver: s.resolver}
+}
+
+// Hash returns the root hash of the snapshot.
+func (s *Snapshot) Hash() common.Hash {
+	return s.hash
+}
+
+// TryGet returns the value for key stored in the snapshot. The value bytes must
+// not be modified by the caller. If a node was not found in the database, a
+// MissingNodeError is returned.
+func (s *Snapshot) TryGet(key []byte) ([]byte, error) {
+	value, _, _, err := s.trie().tryGet(s.root, keybytesToHex(key), 0)
+	return value, err
+}
+
+// NodeIterator returns an iterator that returns nodes of the snapshot. Iteration
+// starts at the key after the given start key.
+func (s *Snapshot) NodeIterator(start []byte) NodeIterator {
+	return newNodeIterator(s.trie(), start)
+}
+
+// Prove constructs a merkle proof for key against the snapshot root, see the
+// Trie.Prove for the details.
+func (s *Snapshot) Prove(key []byte, fromLevel uint, proofDb ethdb.KeyValueWriter) error {
+	return s.trie().Prove(key, fromLevel, proofDb)
+}
+
+// ProveRange constructs a merkle proof for the given key range against the
+// snapshot root, see the Trie.ProveRange for the details.
+func (s *Snapshot) ProveRange(start, end []byte, proofDb ethdb.KeyValueWriter) error {
+	return s.trie().ProveRange(start, end, proofDb)
+}
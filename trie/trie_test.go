@@ -18,15 +18,20 @@ package trie
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"math/big"
 	"math/rand"
 	"os"
 	"reflect"
+	"sort"
+	"sync"
 	"testing"
 	"testing/quick"
+	"time"
 
 	"github.com/davecgh/go-spew/spew"
 	"github.com/ethereum/go-ethereum/common"
@@ -615,6 +620,439 @@ func TestTinyTrie(t *testing.T) {
 	}
 }
 
+// Tests that ranges of leaves can be deleted incrementally, with the continuation
+// keys resuming where the previous deletion stopped.
+func TestDeleteRange(t *testing.T) {
+	var (
+		trie = newEmpty()
+		want = newEmpty()
+	)
+	for i := byte(0); i < 100; i++ {
+		key, val := []byte{i, 0x01}, []byte{i}
+		trie.Update(key, val)
+		if i < 20 || i >= 80 {
+			want.Update(key, val)
+		}
+	}
+	var (
+		start   = []byte{20}
+		end     = []byte{80}
+		deleted int
+		rounds  int
+	)
+	for start != nil {
+		n, next, err := trie.DeleteRange(start, end, 7)
+		if err != nil {
+			t.Fatalf("round %d: failed to delete range: %v", rounds, err)
+		}
+		if n > 7 {
+			t.Fatalf("round %d: deleted too many leaves: %d", rounds, n)
+		}
+		deleted, start = deleted+n, next
+		rounds++
+	}
+	if deleted != 60 || rounds != 9 {
+		t.Fatalf("deletion mismatch: have %d leaves in %d rounds, want %d in %d", deleted, rounds, 60, 9)
+	}
+	if have, exp := trie.Hash(), want.Hash(); have != exp {
+		t.Fatalf("root mismatch: have %x, want %x", have, exp)
+	}
+	// Deleting an open ended range should clear the rest of the trie
+	if n, next, err := trie.DeleteRange([]byte{50}, nil, 100); err != nil || n != 20 || next != nil {
+		t.Fatalf("open ended deletion mismatch: have %d/%x/%v, want %d/nil/nil", n, next, err, 20)
+	}
+	// Deleting without a limit should clear the whole range in one go
+	if n, next, err := trie.DeleteRange(nil, nil, 0); err != nil || n != 20 || next != nil {
+		t.Fatalf("unlimited deletion mismatch: have %d/%x/%v, want %d/nil/nil", n, next, err, 20)
+	}
+	if root := trie.Hash(); root != emptyRoot {
+		t.Fatalf("root mismatch after clearing: have %x, want %x", root, emptyRoot)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	// Create a trie partially backed by the database
+	triedb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, triedb)
+	for i := byte(0); i < 100; i++ {
+		trie.Update(common.LeftPadBytes([]byte{i}, 32), []byte{i + 1})
+	}
+	root, _ := trie.Commit(nil)
+	trie, _ = New(root, triedb)
+	for i := byte(100); i < 150; i++ {
+		trie.Update(common.LeftPadBytes([]byte{i}, 32), []byte{i + 1})
+	}
+	snap := trie.Snapshot()
+	if snap.Hash() != trie.Hash() {
+		t.Fatalf("snapshot root mismatch: have %x, want %x", snap.Hash(), trie.Hash())
+	}
+	hash := snap.Hash()
+
+	// Read the snapshot concurrently while the trie keeps being modified
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := byte(0); j < 150; j++ {
+				val, err := snap.TryGet(common.LeftPadBytes([]byte{j}, 32))
+				if err != nil || !bytes.Equal(val, []byte{j + 1}) {
+					t.Errorf("snapshot value mismatch for %d: have %x/%v, want %x", j, val, err, []byte{j + 1})
+				}
+			}
+		}()
+	}
+	for i := byte(0); i < 150; i++ {
+		trie.Update(common.LeftPadBytes([]byte{i}, 32), []byte{i + 2})
+	}
+	trie.Commit(nil)
+	wg.Wait()
+
+	// Ensure the snapshot still reflects the content at creation time
+	if snap.Hash() != hash {
+		t.Fatalf("snapshot root changed: have %x, want %x", snap.Hash(), hash)
+	}
+	if val, _ := snap.TryGet(common.LeftPadBytes([]byte{10}, 32)); !bytes.Equal(val, []byte{11}) {
+		t.Fatalf("snapshot value changed: have %x, want %x", val, []byte{11})
+	}
+	if val, _ := trie.TryGet(common.LeftPadBytes([]byte{10}, 32)); !bytes.Equal(val, []byte{12}) {
+		t.Fatalf("trie value mismatch: have %x, want %x", val, []byte{12})
+	}
+	it := NewIterator(snap.NodeIterator(nil))
+	for it.Next() {
+		if it.Value[0] != it.Key[31]+1 {
+			t.Fatalf("iterated value mismatch for %x: have %x", it.Key, it.Value)
+		}
+	}
+	if it.Err != nil {
+		t.Fatalf("snapshot iteration failed: %v", it.Err)
+	}
+}
+
+func TestNodeResolver(t *testing.T) {
+	// Create a trie in a source database and an empty local one
+	srcdb := NewDatabase(memorydb.New())
+	trie, _ := New(common.Hash{}, srcdb)
+	for i := byte(0); i < 100; i++ {
+		trie.Update(common.LeftPadBytes([]byte{i}, 32), []byte{i + 1})
+	}
+	root, _ := trie.Commit(nil)
+	srcdb.Commit(root, false)
+
+	// Ensure missing nodes are retrieved through the resolver
+	var (
+		localdb = NewDatabase(memorydb.New())
+		calls   int
+		lock    sync.Mutex
+	)
+	resolver := func(hash common.Hash, path []byte) ([]byte, error) {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		return srcdb.Node(hash)
+	}
+	if _, err := New(root, localdb); err == nil {
+		t.Fatalf("missing root opened without resolver")
+	}
+	local, err := NewWithResolver(root, localdb, resolver)
+	if err != nil {
+		t.Fatalf("failed to open trie with resolver: %v", err)
+	}
+	for i := byte(0); i < 100; i++ {
+		val, err := local.TryGet(common.LeftPadBytes([]byte{i}, 32))
+		if err != nil || !bytes.Equal(val, []byte{i + 1}) {
+			t.Fatalf("resolved value mismatch for %d: have %x/%v, want %x", i, val, err, []byte{i + 1})
+		}
+	}
+	if calls == 0 {
+		t.Fatalf("resolver not invoked")
+	}
+	// Ensure nodes not matching the requested hash are rejected
+	poisoned, _ := NewWithResolver(common.Hash{}, localdb, func(hash common.Hash, path []byte) ([]byte, error) {
+		return []byte{0xc2, 0x80, 0x80}, nil
+	})
+	poisoned.root = hashNode(root[:])
+	if _, err := poisoned.TryGet(common.LeftPadBytes([]byte{1}, 32)); err == nil {
+		t.Fatalf("poisoned node accepted")
+	} else if _, ok := err.(*MissingNodeError); !ok {
+		t.Fatalf("unexpected error for poisoned node: %v", err)
+	}
+	// Ensure the retrying resolver recovers from transient failures
+	var failures int
+	retrying := RetryResolver(func(hash common.Hash, path []byte) ([]byte, error) {
+		if failures < 2 {
+			failures++
+			return []byte{0x80}, nil
+		}
+		return srcdb.Node(hash)
+	}, 3, time.Millisecond)
+	if blob, err := retrying(root, nil); err != nil || crypto.Keccak256Hash(blob) != root {
+		t.Fatalf("retrying resolver failed: %v", err)
+	}
+	failures = 0
+	if _, err := RetryResolver(func(hash common.Hash, path []byte) ([]byte, error) {
+		failures++
+		return []byte{0x80}, nil
+	}, 2, time.Millisecond)(root, nil); err != errInvalidExternalNode || failures != 3 {
+		t.Fatalf("retrying resolver mismatch: err %v, attempts %d", err, failures)
+	}
+}
+
+func TestDumpAndDiff(t *testing.T) {
+	// Ensure the generated tries are deterministic
+	triedb := NewDatabase(memorydb.New())
+	a, content := GenerateTrie(triedb, 1, 500)
+	b, _ := GenerateTrie(NewDatabase(memorydb.New()), 1, 500)
+	if a.Hash() != b.Hash() {
+		t.Fatalf("generated trie mismatch: %x != %x", a.Hash(), b.Hash())
+	}
+	if c, _ := GenerateTrie(NewDatabase(memorydb.New()), 2, 500); c.Hash() == a.Hash() {
+		t.Fatalf("generated tries of different seeds match")
+	}
+	// Ensure the dump matches the nodes stored in the database
+	root, _ := a.Commit(nil)
+	a, _ = New(root, triedb)
+
+	dump, err := DumpTrie(a)
+	if err != nil {
+		t.Fatalf("failed to dump trie: %v", err)
+	}
+	if dump[""].Hash != root {
+		t.Fatalf("dumped root mismatch: have %x, want %x", dump[""].Hash, root)
+	}
+	for path, node := range dump {
+		blob, err := triedb.Node(node.Hash)
+		if err != nil || !bytes.Equal(blob, node.Blob) {
+			t.Fatalf("path %x: dumped node mismatch: %x, %v", path, node.Blob, err)
+		}
+	}
+	if diffs, err := DiffTries(a, b); err != nil || len(diffs) != 0 {
+		t.Fatalf("identical tries diverge: %v, %v", diffs, err)
+	}
+	// Modify a single entry and ensure the diff pinpoints it
+	var key []byte
+	for k := range content {
+		key = []byte(k)
+		break
+	}
+	b.Update(key, []byte("modified"))
+
+	diffs, err := DiffTries(a, b)
+	if err != nil {
+		t.Fatalf("failed to diff tries: %v", err)
+	}
+	if len(diffs) == 0 || len(diffs[0].Path) != 0 {
+		t.Fatalf("root divergence not reported: %v", diffs)
+	}
+	deepest := diffs[0].Path
+	for _, diff := range diffs {
+		if len(diff.Path) > len(deepest) {
+			deepest = diff.Path
+		}
+	}
+	if !bytes.HasPrefix(keybytesToHex(key), deepest) {
+		t.Fatalf("deepest divergence %x not on the path of %x", deepest, keybytesToHex(key))
+	}
+}
+
+func TestEstimateSize(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	tr, _ := GenerateTrie(triedb, 1, 2000)
+	root, _ := tr.Commit(nil)
+	tr, _ = New(root, triedb)
+
+	dump, err := DumpTrie(tr)
+	if err != nil {
+		t.Fatalf("failed to dump trie: %v", err)
+	}
+	var size int
+	for _, node := range dump {
+		size += len(node.Blob)
+	}
+	// Ensure a reasonable budget yields an estimate close to the real size
+	estimate, err := EstimateSize(triedb, root, 4000)
+	if err != nil {
+		t.Fatalf("failed to estimate size: %v", err)
+	}
+	if estimate.Visited > 4000 || estimate.Samples < 2 {
+		t.Fatalf("sampling mismatch: %d nodes visited in %d samples", estimate.Visited, estimate.Samples)
+	}
+	if diff := math.Abs(float64(estimate.Nodes)-float64(len(dump))) / float64(len(dump)); diff > 0.2 {
+		t.Fatalf("node count estimate off: have %d, want %d", estimate.Nodes, len(dump))
+	}
+	if diff := math.Abs(float64(estimate.Size)-float64(size)) / float64(size); diff > 0.2 {
+		t.Fatalf("size estimate off: have %v, want %d", estimate.Size, size)
+	}
+	// Ensure a tiny budget still completes a single descent
+	if estimate, err = EstimateSize(triedb, root, 1); err != nil || estimate.Samples != 1 {
+		t.Fatalf("single descent mismatch: %+v, %v", estimate, err)
+	}
+	// Ensure empty and missing tries are handled
+	if estimate, err = EstimateSize(triedb, emptyRoot, 100); err != nil || estimate.Nodes != 0 {
+		t.Fatalf("empty trie estimate mismatch: %+v, %v", estimate, err)
+	}
+	if _, err := EstimateSize(triedb, common.Hash{0x1}, 100); err == nil {
+		t.Fatalf("missing trie estimated")
+	} else if _, ok := err.(*MissingNodeError); !ok {
+		t.Fatalf("missing node error mismatch: %v", err)
+	}
+}
+
+func TestCommitSorted(t *testing.T) {
+	// Cover empty, single leaf, embedded (short keys) and realistic tries
+	for _, tt := range []struct{ keys, length, size int }{{0, 32, 1}, {1, 32, 1}, {3, 32, 1}, {1000, 32, 32}, {300, 2, 1}} {
+		var (
+			entries = make(map[string][]byte)
+			keys    = make([][]byte, 0, tt.keys)
+			values  = make([][]byte, 0, tt.keys)
+			tr      = newEmpty()
+		)
+		for len(entries) < tt.keys {
+			key, value := make([]byte, tt.length), make([]byte, tt.size)
+			rand.Read(key)
+			rand.Read(value)
+			value[0] |= 0x1 // avoid empty values once trimmed
+
+			entries[string(key)] = value
+			tr.Update(key, value)
+		}
+		for key := range entries {
+			keys = append(keys, []byte(key))
+		}
+		sort.Slice(keys, func(i, j int) bool { return bytes.Compare(keys[i], keys[j]) < 0 })
+		for _, key := range keys {
+			values = append(values, entries[string(key)])
+		}
+		diskdb := memorydb.New()
+		root, nodes, err := CommitSorted(diskdb, keys, values)
+		if err != nil {
+			t.Fatalf("%d keys: failed to commit: %v", tt.keys, err)
+		}
+		if want := tr.Hash(); root != want {
+			t.Fatalf("%d keys: root mismatch: have %x, want %x", tt.keys, root, want)
+		}
+		if diskdb.Len() != nodes {
+			t.Fatalf("%d keys: node count mismatch: have %d, want %d", tt.keys, diskdb.Len(), nodes)
+		}
+		// Ensure the trie is loadable from the database
+		loaded, err := New(root, NewDatabase(diskdb))
+		if err != nil {
+			t.Fatalf("%d keys: failed to open trie: %v", tt.keys, err)
+		}
+		for i, key := range keys {
+			if have, err := loaded.TryGet(key); err != nil || !bytes.Equal(have, values[i]) {
+				t.Fatalf("%d keys: value %x mismatch: have %x, want %x (%v)", tt.keys, key, have, values[i], err)
+			}
+		}
+	}
+	// Ensure invalid inputs are rejected
+	if _, _, err := CommitSorted(memorydb.New(), [][]byte{{0x2}, {0x1}}, [][]byte{{0x1}, {0x1}}); err == nil {
+		t.Fatalf("unsorted keys committed")
+	}
+	if _, _, err := CommitSorted(memorydb.New(), [][]byte{{0x1}, {0x2, 0x3}}, [][]byte{{0x1}, {0x1}}); err == nil {
+		t.Fatalf("uneven keys committed")
+	}
+	if _, _, err := CommitSorted(memorydb.New(), [][]byte{{0x1}}, [][]byte{nil}); err == nil {
+		t.Fatalf("empty value committed")
+	}
+}
+
+func TestStreamNodes(t *testing.T) {
+	triedb := NewDatabase(memorydb.New())
+	tr, _ := GenerateTrie(triedb, 1, 1000)
+	root, _ := tr.Commit(nil)
+	triedb.Commit(root, false)
+	tr, _ = New(root, triedb)
+
+	dump, err := DumpTrie(tr)
+	if err != nil {
+		t.Fatalf("failed to dump trie: %v", err)
+	}
+	// Ensure all the standalone nodes are streamed, in ascending path order
+	var last []byte
+	streamed, err := StreamNodes(context.Background(), triedb, root, 0, func(path []byte, hash common.Hash, blob []byte) error {
+		if last != nil && bytes.Compare(last, path) >= 0 {
+			t.Fatalf("path %x streamed after %x", path, last)
+		}
+		last = path
+
+		node, ok := dump[string(path)]
+		if !ok {
+			t.Fatalf("unexpected node at path %x", path)
+		}
+		if node.Hash != hash || !bytes.Equal(node.Blob, blob) {
+			t.Fatalf("node mismatch at path %x: have %x, want %x", path, hash, node.Hash)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to stream nodes: %v", err)
+	}
+	if streamed != len(dump) {
+		t.Fatalf("streamed node count mismatch: have %d, want %d", streamed, len(dump))
+	}
+	// Ensure the streaming is aborted on cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	streamed, err = StreamNodes(ctx, triedb, root, 0, func(path []byte, hash common.Hash, blob []byte) error {
+		cancel()
+		return nil
+	})
+	if err != context.Canceled || streamed != 1 {
+		t.Fatalf("cancellation mismatch: streamed %d, err %v", streamed, err)
+	}
+	// Ensure the streaming is throttled
+	start := time.Now()
+	if streamed, err = StreamNodes(context.Background(), triedb, root, 2000, func([]byte, common.Hash, []byte) error { return nil }); err != nil {
+		t.Fatalf("failed to stream throttled nodes: %v", err)
+	}
+	if min := time.Duration(streamed-1) * time.Second / 2000; time.Since(start) < min {
+		t.Fatalf("throttling too loose: %d nodes in %v, want at least %v", streamed, time.Since(start), min)
+	}
+}
+
+// Tests that node existence probes find the standalone nodes of a trie, both in
+// memory and on disk, without needing the probed nodes to be readable.
+func TestHasNode(t *testing.T) {
+	diskdb := memorydb.New()
+	triedb := NewDatabase(diskdb)
+	tr, _ := GenerateTrie(triedb, 1, 1000)
+	root, _ := tr.Commit(nil)
+
+	// Probe the root while it's only available in the dirty cache
+	tr, _ = New(root, triedb)
+	if ok, err := tr.HasNode(nil); !ok || err != nil {
+		t.Fatalf("dirty root not found: %v, %v", ok, err)
+	}
+	triedb.Commit(root, false)
+
+	dump, err := DumpTrie(tr)
+	if err != nil {
+		t.Fatalf("failed to dump trie: %v", err)
+	}
+	var deepest string
+	for path := range dump {
+		if ok, err := tr.HasNode([]byte(path)); !ok || err != nil {
+			t.Fatalf("node at path %x not found: %v, %v", path, ok, err)
+		}
+		if len(path) > len(deepest) {
+			deepest = path
+		}
+	}
+	if ok, err := tr.HasNode([]byte{16}); ok || err != nil {
+		t.Fatalf("value path reported as node: %v, %v", ok, err)
+	}
+	// Drop a node from disk, its probe should fail without affecting the others
+	diskdb.Delete(dump[deepest].Hash.Bytes())
+
+	tr, _ = New(root, triedb)
+	if ok, err := tr.HasNode([]byte(deepest)); ok || err != nil {
+		t.Fatalf("deleted node at path %x found: %v, %v", deepest, ok, err)
+	}
+	if ok, err := tr.HasNode(nil); !ok || err != nil {
+		t.Fatalf("root not found: %v, %v", ok, err)
+	}
+}
+
 func TestCommitAfterHash(t *testing.T) {
 	// Create a realistic account trie to hash
 	addresses, accounts := makeAccounts(1000)
@@ -0,0 +1,105 @@
+// Copyright 2020 The go-ethereum Authors
+// This file is part of the go-ethereum library.
+//
+// The go-ethereum library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The go-ethereum library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the go-ethereum library. If not, see <http://www.gnu.org/licenses/>.
+
+package trie
+
+import (
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/metrics"
+	"github.com/steakknife/bloomfilter"
+)
+
+const (
+	// writeBloomBitsPerItem is the number of bloom bits allocated for every item
+	// written by a flush, keeping the false positive rate of the overwrite
+	// detection below 1%.
+	writeBloomBitsPerItem = 10
+
+	// writeBloomFuncs is the number of bits a single item sets in the bloom.
+	writeBloomFuncs = 7
+)
+
+var (
+	writeNodeSizeMeter      = metrics.NewRegisteredMeter("trie/write/node/size", nil)
+	writePreimageSizeMeter  = metrics.NewRegisteredMeter("trie/write/preimage/size", nil)
+	writeOverwriteSizeMeter = metrics.NewRegisteredMeter("trie/write/overwrite/size", nil)
+
+	// writeAmplificationGauge is the ratio of all the data written by the trie
+	// database flushes to the part of it not written by the preceding flush.
+	writeAmplificationGauge = metrics.NewRegisteredGaugeFloat64("trie/write/amplification", nil)
+)
+
+// writeStats tracks the data persisted by the flushes of the trie database (both
+// capping and committing): how much of it are trie nodes versus preimages, and
+// how much was already written by the previous flush. The latter is detected
+// with a bloom filter, so it may slightly overestimate the overwrites.
+type writeStats struct {
+	prev *bloomfilter.Filter // Items written by the previous flush
+	cur  *bloomfilter.Filter // Items written by the current flush
+
+	nodes      common.StorageSize // Trie node data written by the current flush
+	preimages  common.StorageSize // Preimage data written by the current flush
+	overwrites common.StorageSize // Data of the current flush also written by the previous one
+}
+
+// begin starts tracking a new flush writing at most the given number of items.
+func (s *writeStats) begin(items int) {
+	bits := uint64(items) * writeBloomBitsPerItem
+	if bits < 1024 {
+		bits = 1024
+	}
+	s.cur, _ = bloomfilter.New(bits, writeBloomFuncs) // Only fails for zero parameters
+	s.nodes, s.preimages, s.overwrites = 0, 0, 0
+}
+
+// node records the write of a trie node.
+func (s *writeStats) node(hash common.Hash, size int) {
+	s.nodes += common.StorageSize(size)
+	s.track(hash, size)
+}
+
+// preimage records the write of a preimage, keyed by the hash it belongs to.
+func (s *writeStats) preimage(hash common.Hash, size int) {
+	s.preimages += common.StorageSize(size)
+	s.track(hash, size)
+}
+
+// track inserts an item into the current flush and checks whether it was also
+// written by the previous one.
+func (s *writeStats) track(hash common.Hash, size int) {
+	if s.prev != nil && s.prev.Contains(syncBloomHasher(hash[:])) {
+		s.overwrites += common.StorageSize(size)
+	}
+	s.cur.Add(syncBloomHasher(hash[:]))
+}
+
+// finish closes the current flush, reporting its statistics and making it the
+// reference of the next one. Flushes not writing anything are ignored.
+func (s *writeStats) finish() {
+	if s.nodes+s.preimages == 0 {
+		s.cur = nil
+		return
+	}
+	writeNodeSizeMeter.Mark(int64(s.nodes))
+	writePreimageSizeMeter.Mark(int64(s.preimages))
+	writeOverwriteSizeMeter.Mark(int64(s.overwrites))
+
+	written := writeNodeSizeMeter.Count() + writePreimageSizeMeter.Count()
+	if fresh := written - writeOverwriteSizeMeter.Count(); fresh > 0 {
+		writeAmplificationGauge.Update(float64(written) / float64(fresh))
+	}
+	s.prev, s.cur = s.cur, nil
+}